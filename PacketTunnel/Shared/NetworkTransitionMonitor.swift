@@ -5,9 +5,9 @@ import os.log
     import SystemConfiguration
 #endif
 
-/// Monitors network path changes and triggers socket rebinding when network transitions occur.
-/// This handles cases where the network interface changes (e.g., WiFi to cellular) and the
-/// UDP socket becomes stale, causing "network is unreachable" errors.
+/// Monitors network path changes and forwards them to Go, which reasserts the tunnel when the
+/// network interface changes (e.g., WiFi to cellular) or comes back, before the stale UDP socket
+/// causes "network is unreachable" errors.
 ///
 /// It also reports the real (pre-VPN-override) system DNS servers on macOS, since olm cannot
 /// read the OS's DNS configuration itself here: the app additionally applies NEDNSSettings (see
@@ -33,16 +33,18 @@ import os.log
 class NetworkTransitionMonitor {
     private let monitor = NWPathMonitor()
     private let queue = DispatchQueue(label: "NetworkTransitionMonitor", qos: .utility)
-    private var lastInterfaceType: NWInterface.InterfaceType?
-    private var wasUnsatisfied = false
 
     private let logger: OSLog = {
         let subsystem = Bundle.main.bundleIdentifier ?? "net.pangolin.Pangolin.PacketTunnel"
         return OSLog(subsystem: subsystem, category: "NetworkTransitionMonitor")
     }()
 
-    /// Called when a network transition requires socket rebinding
-    var onRebindRequired: (() -> Void)?
+    /// Called on the monitor queue with every path update that changed the status, interface,
+    /// address families, expensive/constrained flags or network identifier, as the JSON object
+    /// Go's notifyNetworkChange takes. Go tells transitions apart and applies its reassert
+    /// policy right away.
+    var onPathChanged: (([String: Any]) -> Void)?
+    private var lastReportedPath: NSDictionary?
 
     /// Called when the real system DNS servers change, formatted as "host:53"
     /// (or "[host]:53" for IPv6) ready to hand to olm's SetSystemDNS.
@@ -51,10 +53,6 @@ class NetworkTransitionMonitor {
     private var dnsWorkItem: DispatchWorkItem?
     private let dnsDebounceInterval: TimeInterval = 1.0
 
-    /// Debouncing support to prevent excessive rebind calls
-    private var rebindWorkItem: DispatchWorkItem?
-    private let debounceInterval: TimeInterval = 2.5
-
     /// Starts monitoring network path changes
     func start() {
         os_log("Starting network transition monitor", log: logger, type: .debug)
@@ -73,10 +71,6 @@ class NetworkTransitionMonitor {
     func stop() {
         os_log("Stopping network transition monitor", log: logger, type: .debug)
 
-        // Cancel any pending rebind
-        rebindWorkItem?.cancel()
-        rebindWorkItem = nil
-
         dnsWorkItem?.cancel()
         dnsWorkItem = nil
 
@@ -84,61 +78,33 @@ class NetworkTransitionMonitor {
     }
 
     private func handlePathUpdate(_ path: NWPath) {
-        let currentInterfaceType = path.availableInterfaces.first?.type
         let isSatisfied = path.status == .satisfied
 
-        var shouldRebind = false
-
-        // Case 1: Interface type changed (e.g., WiFi -> Cellular)
-        if let lastType = lastInterfaceType,
-            let currentType = currentInterfaceType,
-            lastType != currentType,
-            isSatisfied
-        {
-            shouldRebind = true
-            os_log(
-                "Network interface changed: %{public}@ -> %{public}@", log: logger, type: .info,
-                interfaceTypeString(lastType), interfaceTypeString(currentType))
-        }
-
-        // Case 2: Network became available after being unavailable
-        if wasUnsatisfied && isSatisfied {
-            shouldRebind = true
-            os_log(
-                "Network became available after being unavailable", log: logger, type: .info)
-        }
-
-        // Update state for next comparison
-        lastInterfaceType = currentInterfaceType
-        wasUnsatisfied = !isSatisfied
-
-        // Trigger rebind if needed (with debouncing)
-        if shouldRebind {
-            scheduleRebind()
+        // The network identifier lets Go pick the matching per-network DNS profile and tell a
+        // link flap from a move to another network. See `networkIdentifier(for:)`.
+        let report: [String: Any] = [
+            "status": pathStatusString(path.status),
+            "interfaceType": path.availableInterfaces.first.map { interfaceTypeString($0.type) } ?? "",
+            "expensive": path.isExpensive,
+            "constrained": path.isConstrained,
+            "supportsIPv4": path.supportsIPv4,
+            "supportsIPv6": path.supportsIPv6,
+            "networkId": isSatisfied ? networkIdentifier(for: path) : "",
+        ]
+        let reportDictionary = report as NSDictionary
+        if lastReportedPath != reportDictionary {
+            lastReportedPath = reportDictionary
+            os_log("Network path changed: %{public}@", log: logger, type: .info, report.description)
+            onPathChanged?(report)
         }
 
         // DNS can change independently of interface type (e.g. switching between two
-        // Wi-Fi networks), so check on every path update, not just shouldRebind.
+        // Wi-Fi networks), so check on every path update, not just on a transition.
         if isSatisfied {
             scheduleSystemDNSCheck()
         }
     }
 
-    private func scheduleRebind() {
-        // Cancel any pending rebind
-        rebindWorkItem?.cancel()
-
-        // Schedule rebind with debounce
-        let workItem = DispatchWorkItem { [weak self] in
-            guard let self = self else { return }
-            os_log("Triggering socket rebind after network transition", log: self.logger, type: .info)
-            self.onRebindRequired?()
-        }
-        rebindWorkItem = workItem
-
-        DispatchQueue.main.asyncAfter(deadline: .now() + debounceInterval, execute: workItem)
-    }
-
     private func scheduleSystemDNSCheck() {
         dnsWorkItem?.cancel()
 
@@ -287,6 +253,37 @@ class NetworkTransitionMonitor {
         }
     #endif
 
+    /// Identifies the underlying network as "<interface type>:<gateway>", e.g.
+    /// "WiFi:192.168.1.1". The default gateway tells home and office apart without
+    /// the location permission reading the Wi-Fi SSID would need. Empty when
+    /// the path has no gateway.
+    private func networkIdentifier(for path: NWPath) -> String {
+        guard let interface = path.availableInterfaces.first,
+            case let .hostPort(host, _)? = path.gateways.first
+        else {
+            return ""
+        }
+        var gateway = "\(host)"
+        // Drop the interface scope from link-local IPv6 gateways
+        if let percent = gateway.firstIndex(of: "%") {
+            gateway = String(gateway[..<percent])
+        }
+        return "\(interfaceTypeString(interface.type)):\(gateway)"
+    }
+
+    private func pathStatusString(_ status: NWPath.Status) -> String {
+        switch status {
+        case .satisfied:
+            return "satisfied"
+        case .unsatisfied:
+            return "unsatisfied"
+        case .requiresConnection:
+            return "requiresConnection"
+        @unknown default:
+            return "unsatisfied"
+        }
+    }
+
     private func interfaceTypeString(_ type: NWInterface.InterfaceType) -> String {
         switch type {
         case .wifi:
@@ -32,6 +32,11 @@ class PacketTunnelProvider: NEPacketTunnelProvider {
         // Initialize the tunnel adapter
         tunnelAdapter = TunnelAdapter(with: self)
 
+        // An MDM profile's managed configuration arrives in the VPN payload's
+        // VendorConfig as "managedConfig", a dictionary or a JSON string
+        let result = TunnelAdapter.setManagedConfig(managedConfigJSON())
+        os_log("Managed configuration: %{public}@", log: logger, type: .debug, result)
+
         // Use the tunnel adapter to start the tunnel and discover the file descriptor
         tunnelAdapter?.start(options: options) { [weak self] (error: Error?) in
             if let error = error {
@@ -62,42 +67,142 @@ class PacketTunnelProvider: NEPacketTunnelProvider {
         #endif
     }
     
+    // Returns the managed configuration of the VPN payload as JSON, or nil when
+    // the tunnel is not managed
+    private func managedConfigJSON() -> String? {
+        let providerConfiguration = (protocolConfiguration as? NETunnelProviderProtocol)?.providerConfiguration
+        switch providerConfiguration?["managedConfig"] {
+        case let json as String:
+            return json
+        case let config as [String: Any]:
+            guard JSONSerialization.isValidJSONObject(config),
+                  let data = try? JSONSerialization.data(withJSONObject: config) else {
+                os_log("Ignoring managed configuration that is not valid JSON", log: logger, type: .error)
+                return nil
+            }
+            return String(data: data, encoding: .utf8)
+        default:
+            return nil
+        }
+    }
+
     override func handleAppMessage(_ messageData: Data, completionHandler: ((Data?) -> Void)?) {
-        // Handle messages from the app if needed
-        completionHandler?(nil)
+        // Messages are JSON objects with a "command"; unknown ones get no reply
+        guard let message = try? JSONSerialization.jsonObject(with: messageData) as? [String: Any],
+              let command = message["command"] as? String else {
+            completionHandler?(nil)
+            return
+        }
+
+        switch command {
+        case "setLogLevel":
+            // {"command": "setLogLevel", "level": "debug" | "info" | "warn" | "error"}
+            guard let name = message["level"] as? String, let level = LogLevel(rawValue: name) else {
+                os_log("setLogLevel message without a valid level", log: logger, type: .error)
+                completionHandler?(nil)
+                return
+            }
+            let result = TunnelAdapter.setLogLevel(level)
+            os_log("setLogLevel returned: %{public}@", log: logger, type: .info, result)
+            completionHandler?(result.data(using: .utf8))
+        case "getRecentLogs":
+            // {"command": "getRecentLogs", "maxLines": 500, "minLevel": "info"};
+            // both are optional. Replies with the JSON array from Go.
+            let maxLines = (message["maxLines"] as? NSNumber)?.int32Value ?? 0
+            let minLevel = (message["minLevel"] as? String).flatMap { LogLevel(rawValue: $0) }
+            completionHandler?(TunnelAdapter.getRecentLogs(maxLines: maxLines, minLevel: minLevel).data(using: .utf8))
+        case "setTelemetryEnabled":
+            // {"command": "setTelemetryEnabled", "enabled": true}
+            let enabled = (message["enabled"] as? Bool) ?? false
+            completionHandler?(TunnelAdapter.setTelemetryEnabled(enabled).data(using: .utf8))
+        case "getHealthMetrics":
+            // {"command": "getHealthMetrics"}
+            completionHandler?(TunnelAdapter.getHealthMetrics().data(using: .utf8))
+        case "setDNSQueryLogEnabled":
+            // {"command": "setDNSQueryLogEnabled", "enabled": true}
+            let enabled = (message["enabled"] as? Bool) ?? false
+            completionHandler?(TunnelAdapter.setDNSQueryLogEnabled(enabled).data(using: .utf8))
+        case "getDNSQueryLog":
+            // {"command": "getDNSQueryLog", "maxEntries": 200}; maxEntries is
+            // optional. Replies with the JSON array from Go.
+            let maxEntries = (message["maxEntries"] as? NSNumber)?.int32Value ?? 0
+            completionHandler?(TunnelAdapter.getDNSQueryLog(maxEntries: maxEntries).data(using: .utf8))
+        case "flushDNSCache":
+            // {"command": "flushDNSCache"}
+            completionHandler?(TunnelAdapter.flushDNSCache().data(using: .utf8))
+        case "updateTunnelConfig":
+            // {"command": "updateTunnelConfig", "config": {...}} with the full
+            // startTunnel config. Replies with Go's JSON result.
+            guard let config = message["config"] as? [String: Any],
+                  let data = try? JSONSerialization.data(withJSONObject: config),
+                  let json = String(data: data, encoding: .utf8) else {
+                os_log("updateTunnelConfig message without a valid config", log: logger, type: .error)
+                completionHandler?(nil)
+                return
+            }
+            completionHandler?(TunnelAdapter.updateTunnelConfig(json).data(using: .utf8))
+        case "getEffectiveConfigSources":
+            // {"command": "getEffectiveConfigSources"}
+            completionHandler?(TunnelAdapter.getEffectiveConfigSources().data(using: .utf8))
+        case "getTelemetryReport":
+            // {"command": "getTelemetryReport", "reset": true}; the app resets
+            // once it has submitted the report
+            let reset = (message["reset"] as? Bool) ?? false
+            completionHandler?(TunnelAdapter.getTelemetryReport(reset: reset).data(using: .utf8))
+        default:
+            completionHandler?(nil)
+        }
     }
     
     override func sleep(completionHandler: @escaping () -> Void) {
-        os_log("Device going to sleep, setting power mode to low", log: logger, type: .info)
-        setPowerMode(mode: "low")
+        os_log("Device going to sleep, pausing tunnel", log: logger, type: .info)
+        pauseTunnel()
+        #if os(iOS)
+        // Batch periodic work so iOS does not throttle the extension
+        setBackgroundMode(enabled: true)
+        #endif
         completionHandler()
     }
     
     override func wake() {
-        os_log("Device waking up, setting power mode to normal", log: logger, type: .info)
-        setPowerMode(mode: "normal")
+        os_log("Device waking up, resuming tunnel", log: logger, type: .info)
+        #if os(iOS)
+        setBackgroundMode(enabled: false)
+        #endif
+        resumeTunnel()
     }
     
-    private func setPowerMode(mode: String) {
-        let modeCString = mode.utf8CString
-        let modePtr = UnsafeMutablePointer<CChar>.allocate(capacity: modeCString.count)
-        modeCString.withUnsafeBufferPointer { buffer in
-            modePtr.initialize(from: buffer.baseAddress!, count: buffer.count)
+    private func setBackgroundMode(enabled: Bool) {
+        if let result = PangolinGo.setBackgroundMode(enabled ? 1 : 0) {
+            let message = String(cString: result)
+            PangolinGo.freeCString(result)
+            os_log("setBackgroundMode returned: %{public}@", log: logger, type: .debug, message)
+        } else {
+            os_log("Failed to call Go setBackgroundMode function (returned nil)", log: logger, type: .error)
         }
-        defer {
-            modePtr.deallocate()
+    }
+    
+    private func pauseTunnel() {
+        if let result = PangolinGo.pauseTunnel() {
+            let message = String(cString: result)
+            PangolinGo.freeCString(result)
+            os_log("pauseTunnel returned: %{public}@", log: logger, type: .debug, message)
+        } else {
+            os_log("Failed to call Go pauseTunnel function (returned nil)", log: logger, type: .error)
         }
-        
-        if let result = PangolinGo.setPowerMode(modePtr) {
+    }
+    
+    private func resumeTunnel() {
+        if let result = PangolinGo.resumeTunnel() {
             let message = String(cString: result)
-            result.deallocate()
-            os_log("setPowerMode returned: %{public}@", log: logger, type: .debug, message)
+            PangolinGo.freeCString(result)
+            os_log("resumeTunnel returned: %{public}@", log: logger, type: .debug, message)
             
-            if message.lowercased().contains("error") || message.lowercased().contains("fail") {
-                os_log("Failed to set power mode: %{public}@", log: logger, type: .error, message)
+            if message.hasPrefix("Error") {
+                os_log("Failed to resume tunnel: %{public}@", log: logger, type: .error, message)
             }
         } else {
-            os_log("Failed to call Go setPowerMode function (returned nil)", log: logger, type: .error)
+            os_log("Failed to call Go resumeTunnel function (returned nil)", log: logger, type: .error)
         }
     }
 }
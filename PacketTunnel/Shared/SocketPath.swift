@@ -19,3 +19,28 @@ func getSocketPath() -> String {
     #endif
 }
 
+
+/// Returns the directory where PangolinGo persists small state files.
+/// Uses the app group container so the app can read them too, otherwise falls back to the temp directory.
+func getStateDirectoryPath() -> String {
+    if let appGroupContainer = FileManager.default.containerURL(forSecurityApplicationGroupIdentifier: "group.net.pangolin.Pangolin") {
+        return appGroupContainer.appendingPathComponent("PangolinGo", isDirectory: true).path
+    } else {
+        return (NSTemporaryDirectory() as NSString).appendingPathComponent("PangolinGo")
+    }
+}
+
+/// Returns the path of the status snapshot PangolinGo writes for widgets and the menu extra.
+func getStatusSnapshotPath() -> String {
+    return (getStateDirectoryPath() as NSString).appendingPathComponent("status.json")
+}
+
+/// Returns the paths of the files PangolinGo leaves behind for the diagnostics bundle: the
+/// flight recorder dump and the runtime's crash output.
+func getDiagnosticsFilePaths() -> [String] {
+    let stateDirectory = getStateDirectoryPath() as NSString
+    return [
+        stateDirectory.appendingPathComponent("flightrecorder.log"),
+        stateDirectory.appendingPathComponent("crash.log"),
+    ]
+}
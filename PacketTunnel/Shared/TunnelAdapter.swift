@@ -8,69 +8,121 @@ import os.log
     import UIKit
 #endif
 
-// Centralized log level configuration
-enum LogLevel: Int {
-    case debug = 0
-    case info = 1
-    case warn = 2
-    case error = 3
+// Centralized log level configuration; the raw values are what Go's
+// setLogLevel takes
+enum LogLevel: String {
+    case debug
+    case info
+    case warn
+    case error
 }
 
-// NetworkSettingsJSON represents the JSON structure from Go
+// NetworkSettingsJSON mirrors NEPacketTunnelNetworkSettings as produced by Go.
+// See NetworkSettingsSchema in PangolinGo/nesettings.go; a missing subobject
+// means the previously applied value is kept.
 private struct NetworkSettingsJSON: Codable {
+    let schemaVersion: Int
     let tunnelRemoteAddress: String?
     let mtu: Int?
-    let dnsServers: [String]?
-    let ipv4Addresses: [String]?
-    let ipv4SubnetMasks: [String]?
-    let ipv4IncludedRoutes: [IPv4RouteJSON]?
-    let ipv4ExcludedRoutes: [IPv4RouteJSON]?
-    let ipv6Addresses: [String]?
-    let ipv6NetworkPrefixes: [String]?
-    let ipv6IncludedRoutes: [IPv6RouteJSON]?
-    let ipv6ExcludedRoutes: [IPv6RouteJSON]?
-
-    enum CodingKeys: String, CodingKey {
-        case tunnelRemoteAddress = "tunnel_remote_address"
-        case mtu
-        case dnsServers = "dns_servers"
-        case ipv4Addresses = "ipv4_addresses"
-        case ipv4SubnetMasks = "ipv4_subnet_masks"
-        case ipv4IncludedRoutes = "ipv4_included_routes"
-        case ipv4ExcludedRoutes = "ipv4_excluded_routes"
-        case ipv6Addresses = "ipv6_addresses"
-        case ipv6NetworkPrefixes = "ipv6_network_prefixes"
-        case ipv6IncludedRoutes = "ipv6_included_routes"
-        case ipv6ExcludedRoutes = "ipv6_excluded_routes"
-    }
+    let ipv4Settings: IPv4SettingsJSON?
+    let ipv6Settings: IPv6SettingsJSON?
+    let dnsSettings: DNSSettingsJSON?
+    let proxySettings: ProxySettingsJSON?
+    /// What differs from the settings fetched last; nil from a bridge that
+    /// does not report it, which means everything may have changed.
+    let changes: [String]?
+}
+
+private struct IPv4SettingsJSON: Codable {
+    let addresses: [String]
+    let subnetMasks: [String]
+    let includedRoutes: [IPv4RouteJSON]?
+    let excludedRoutes: [IPv4RouteJSON]?
 }
 
 private struct IPv4RouteJSON: Codable {
     let destinationAddress: String
-    let subnetMask: String?
+    let subnetMask: String
     let gatewayAddress: String?
     let isDefault: Bool?
+}
 
-    enum CodingKeys: String, CodingKey {
-        case destinationAddress = "destination_address"
-        case subnetMask = "subnet_mask"
-        case gatewayAddress = "gateway_address"
-        case isDefault = "is_default"
-    }
+private struct IPv6SettingsJSON: Codable {
+    let addresses: [String]
+    let networkPrefixLengths: [Int]
+    let includedRoutes: [IPv6RouteJSON]?
+    let excludedRoutes: [IPv6RouteJSON]?
 }
 
 private struct IPv6RouteJSON: Codable {
     let destinationAddress: String
-    let networkPrefixLength: Int?
+    let networkPrefixLength: Int
     let gatewayAddress: String?
     let isDefault: Bool?
+}
 
-    enum CodingKeys: String, CodingKey {
-        case destinationAddress = "destination_address"
-        case networkPrefixLength = "network_prefix_length"
-        case gatewayAddress = "gateway_address"
-        case isDefault = "is_default"
-    }
+private struct DNSSettingsJSON: Codable {
+    let servers: [String]
+    let searchDomains: [String]?
+    let matchDomains: [String]?
+    let matchDomainsNoSearch: Bool?
+}
+
+private struct ProxySettingsJSON: Codable {
+    let autoProxyConfigurationEnabled: Bool?
+    let proxyAutoConfigurationURL: String?
+    let httpEnabled: Bool?
+    let httpServer: ProxyServerJSON?
+    let httpsEnabled: Bool?
+    let httpsServer: ProxyServerJSON?
+    let excludeSimpleHostnames: Bool?
+    let exceptionList: [String]?
+    let matchDomains: [String]?
+}
+
+private struct ProxyServerJSON: Codable {
+    let address: String
+    let port: Int
+}
+
+private let supportedNetworkSettingsSchemaVersion = 1
+
+// GoLifecycleResultJSON is what initOlm, startTunnel and stopTunnel return;
+// see LifecycleResult in PangolinGo/lifecycleresult.go
+private struct GoLifecycleResultJSON: Codable {
+    let ok: Bool
+    let message: String?
+    let error: GoLifecycleErrorJSON?
+    // Only stopTunnel reports how the shutdown went
+    let shutdown: GoShutdownReportJSON?
+}
+
+private struct GoLifecycleErrorJSON: Codable {
+    let code: String
+    let message: String
+    let retryable: Bool
+}
+
+// GoShutdownReportJSON is how a stop went; see ShutdownReport in
+// PangolinGo/shutdown.go
+private struct GoShutdownReportJSON: Codable {
+    let flushed: Bool
+    let pendingPackets: Int
+    let deviceClosed: Bool
+    let forceCancelled: [String]
+    let stillRunning: [String]
+    let timedOut: Bool
+    let durationMs: Double
+}
+
+// GoEventJSON is one event pushed by Go; see BridgeEvent in
+// PangolinGo/eventbus.go. Fields that do not apply to the type are nil.
+private struct GoEventJSON: Codable {
+    let type: String
+    let state: String?
+    let siteId: Int?
+    let version: Int?
+    let message: String?
 }
 
 // Adapter class that handles tunnel file descriptor discovery and management
@@ -83,14 +135,18 @@ public class TunnelAdapter {
 
     private var lastAppliedSettings: NEPacketTunnelNetworkSettings?
     private var lastSeenVersion: Int = -1
-    private var settingsPollTimer: DispatchSourceTimer?
-    private let pollInterval: TimeInterval = 0.5  // 500ms
-    private var overrideDNS: Bool = false
+    /// ID of the Go event callback, 0 when not registered; guarded by eventLock
+    private var eventCallbackID: Int32 = 0
+    private let eventLock = NSLock()
+    /// Serializes the events Go pushes, so settings are applied in order
+    private let eventQueue = DispatchQueue(label: "com.pangolin.tunnel.events", qos: .utility)
     private var networkTransitionMonitor: NetworkTransitionMonitor?
+    /// How long Go may take to flush packets and stop olm when the tunnel stops
+    private static let stopTimeoutSeconds: Int32 = 5
     public init(with packetTunnelProvider: NEPacketTunnelProvider) {
         self.packetTunnelProvider = packetTunnelProvider
         // Set log level for Go logger to debug
-        PangolinGo.setLogLevel(Int32(LogLevel.debug.rawValue))
+        TunnelAdapter.setLogLevel(.debug)
 
         // Get app version from bundle (semver)
         let appVersion =
@@ -116,6 +172,9 @@ public class TunnelAdapter {
             "logLevel": "debug",
             "version": appVersion,
             "agent": agent,
+            "stateDir": getStateDirectoryPath(),
+            "osVersion": TunnelAdapter.osVersion(),
+            "deviceModel": TunnelAdapter.hardwareModel(),
         ]
 
         // Convert config to JSON string
@@ -139,11 +198,10 @@ public class TunnelAdapter {
         // Call Go initOlm function with JSON configuration
         if let result = PangolinGo.initOlm(configJSONPtr) {
             let message = String(cString: result)
-            result.deallocate()
+            PangolinGo.freeCString(result)
             os_log("Go init returned: %{public}@", log: logger, type: .debug, message)
 
-            // Check if the Go function returned an error
-            if message.lowercased().contains("error") || message.lowercased().contains("fail") {
+            if TunnelAdapter.lifecycleError(message) != nil {
                 os_log("Go init failed: %{public}@", log: logger, type: .error, message)
             }
         } else {
@@ -151,6 +209,213 @@ public class TunnelAdapter {
         }
     }
 
+    // Sets the log level of Go and olm; takes effect right away, also while the
+    // tunnel runs. Returns Go's result message.
+    @discardableResult
+    static func setLogLevel(_ level: LogLevel) -> String {
+        let levelCString = level.rawValue.utf8CString
+        let levelPtr = UnsafeMutablePointer<CChar>.allocate(capacity: levelCString.count)
+        levelCString.withUnsafeBufferPointer { buffer in
+            levelPtr.initialize(from: buffer.baseAddress!, count: buffer.count)
+        }
+        defer {
+            levelPtr.deallocate()
+        }
+
+        guard let result = PangolinGo.setLogLevel(levelPtr) else {
+            return "Failed to call Go setLogLevel function"
+        }
+        let message = String(cString: result)
+        PangolinGo.freeCString(result)
+        return message
+    }
+
+    // Returns the newest Go and olm log lines as Go's JSON array, oldest first;
+    // maxLines of 0 returns all that are kept and a nil level returns every
+    // level.
+    static func getRecentLogs(maxLines: Int32, minLevel: LogLevel? = nil) -> String {
+        let levelCString = (minLevel?.rawValue ?? "").utf8CString
+        let levelPtr = UnsafeMutablePointer<CChar>.allocate(capacity: levelCString.count)
+        levelCString.withUnsafeBufferPointer { buffer in
+            levelPtr.initialize(from: buffer.baseAddress!, count: buffer.count)
+        }
+        defer {
+            levelPtr.deallocate()
+        }
+
+        guard let result = PangolinGo.getRecentLogs(maxLines, levelPtr) else {
+            return "[]"
+        }
+        let logs = String(cString: result)
+        PangolinGo.freeCString(result)
+        return logs
+    }
+
+    // Opts in to or out of Go's anonymous telemetry counters; opting out deletes
+    // them. Returns Go's result message.
+    @discardableResult
+    static func setTelemetryEnabled(_ enabled: Bool) -> String {
+        guard let result = PangolinGo.setTelemetryEnabled(enabled ? 1 : 0) else {
+            return "Failed to call Go setTelemetryEnabled function"
+        }
+        let message = String(cString: result)
+        PangolinGo.freeCString(result)
+        return message
+    }
+
+    // Returns Go's telemetry report as JSON. With reset set a new period
+    // begins, which the app asks for once it submitted the report.
+    static func getTelemetryReport(reset: Bool) -> String {
+        guard let result = PangolinGo.getTelemetryReport(reset ? 1 : 0) else {
+            return "{}"
+        }
+        let report = String(cString: result)
+        PangolinGo.freeCString(result)
+        return report
+    }
+
+    // Hands Go the managed configuration from an MDM profile as JSON, or nil to
+    // remove it. Go layers it over the options of the next start. Returns Go's
+    // result message.
+    @discardableResult
+    static func setManagedConfig(_ json: String?) -> String {
+        let configCString = (json ?? "").utf8CString
+        let configPtr = UnsafeMutablePointer<CChar>.allocate(capacity: configCString.count)
+        configCString.withUnsafeBufferPointer { buffer in
+            configPtr.initialize(from: buffer.baseAddress!, count: buffer.count)
+        }
+        defer {
+            configPtr.deallocate()
+        }
+
+        guard let result = PangolinGo.setManagedConfig(configPtr) else {
+            return "Failed to call Go setManagedConfig function"
+        }
+        let message = String(cString: result)
+        PangolinGo.freeCString(result)
+        return message
+    }
+
+    // Applies a new tunnel config, in Go's startTunnel JSON, to the running
+    // tunnel without reconnecting where Go can. Returns Go's JSON saying what
+    // was applied and what needs a restart, or an error message.
+    static func updateTunnelConfig(_ json: String) -> String {
+        let configCString = json.utf8CString
+        let configPtr = UnsafeMutablePointer<CChar>.allocate(capacity: configCString.count)
+        configCString.withUnsafeBufferPointer { buffer in
+            configPtr.initialize(from: buffer.baseAddress!, count: buffer.count)
+        }
+        defer {
+            configPtr.deallocate()
+        }
+
+        guard let result = PangolinGo.updateTunnelConfig(configPtr) else {
+            return "Failed to call Go updateTunnelConfig function"
+        }
+        let message = String(cString: result)
+        PangolinGo.freeCString(result)
+        return message
+    }
+
+    // Returns where each field of the running tunnel's config came from as
+    // Go's JSON
+    static func getEffectiveConfigSources() -> String {
+        guard let result = PangolinGo.getEffectiveConfigSources() else {
+            return "{}"
+        }
+        let sources = String(cString: result)
+        PangolinGo.freeCString(result)
+        return sources
+    }
+
+    // Returns Go's per-site RTT, handshake age and health warnings as JSON
+    static func getHealthMetrics() -> String {
+        guard let result = PangolinGo.getHealthMetrics() else {
+            return "{}"
+        }
+        let metrics = String(cString: result)
+        PangolinGo.freeCString(result)
+        return metrics
+    }
+
+    // Opts in to or out of Go's DNS query log; opting out clears it. Returns
+    // Go's result message.
+    @discardableResult
+    static func setDNSQueryLogEnabled(_ enabled: Bool) -> String {
+        guard let result = PangolinGo.setDNSQueryLogEnabled(enabled ? 1 : 0) else {
+            return "Failed to call Go setDNSQueryLogEnabled function"
+        }
+        let message = String(cString: result)
+        PangolinGo.freeCString(result)
+        return message
+    }
+
+    // Returns the newest queries Go sent upstream as a JSON array, oldest
+    // first; maxEntries of 0 returns all that are kept.
+    static func getDNSQueryLog(maxEntries: Int32) -> String {
+        guard let result = PangolinGo.getDNSQueryLog(maxEntries) else {
+            return "[]"
+        }
+        let log = String(cString: result)
+        PangolinGo.freeCString(result)
+        return log
+    }
+
+    // Drops the answers Go's DNS cache holds and returns its message
+    static func flushDNSCache() -> String {
+        guard let result = PangolinGo.flushDNSCache() else {
+            return "Failed to call Go flushDNSCache function"
+        }
+        let message = String(cString: result)
+        PangolinGo.freeCString(result)
+        return message
+    }
+
+    // Turns a lifecycle result from Go into an error, or nil on success. The
+    // error's code is Go's error code under "code", with "retryable" next to it.
+    private static func lifecycleError(_ json: String) -> NSError? {
+        guard let data = json.data(using: .utf8),
+            let result = try? JSONDecoder().decode(GoLifecycleResultJSON.self, from: data)
+        else {
+            return NSError(
+                domain: "PangolinGo", code: -1,
+                userInfo: [NSLocalizedDescriptionKey: "Unreadable result from Go: \(json)"])
+        }
+        guard !result.ok, let error = result.error else { return nil }
+        return NSError(
+            domain: "PangolinGo", code: -1,
+            userInfo: [
+                NSLocalizedDescriptionKey: error.message,
+                "code": error.code,
+                "retryable": error.retryable,
+            ])
+    }
+
+    // OS version reported to the control plane, e.g. "18.1.0"
+    private static func osVersion() -> String {
+        let os = ProcessInfo.processInfo.operatingSystemVersion
+        return "\(os.majorVersion).\(os.minorVersion).\(os.patchVersion)"
+    }
+
+    // Hardware model identifier reported to the control plane, e.g.
+    // "iPhone16,2" or "Mac14,2"
+    private static func hardwareModel() -> String {
+        #if os(iOS)
+            let name = "hw.machine"
+        #else
+            let name = "hw.model"
+        #endif
+        var size = 0
+        guard sysctlbyname(name, nil, &size, nil, 0) == 0, size > 0 else {
+            return ""
+        }
+        var model = [CChar](repeating: 0, count: size)
+        guard sysctlbyname(name, &model, &size, nil, 0) == 0 else {
+            return ""
+        }
+        return String(cString: model)
+    }
+
     // Discovers the tunnel file descriptor
     // Scans open file descriptors and matches them against the utun control interface
     // Works on both macOS and iOS
@@ -279,7 +544,7 @@ public class TunnelAdapter {
         }
 
         // Tunnel configuration
-        let config: [String: Any] = [
+        var config: [String: Any] = [
             "endpoint": endpoint,
             "id": id,
             "secret": secret,
@@ -296,8 +561,34 @@ public class TunnelAdapter {
             "fingerprint": fingerprint,
             "postures": postures,
         ]
-
-        self.overrideDNS = overrideDNSValue
+        // Optional tri-state DNS override; when absent Go derives it from overrideDNS
+        if let dnsOverrideScope = options["dnsOverrideScope"] as? String {
+            config["dnsOverrideScope"] = dnsOverrideScope
+        }
+        // Name this device resolves as over the tunnel; Go falls back to the hostname
+        if let deviceName = options["deviceName"] as? String {
+            config["deviceName"] = deviceName
+        }
+        // Upstream DNS per network, selected as reportNetworkIdentifier reports changes
+        if let dnsProfiles = options["dnsProfiles"] as? [[String: Any]] {
+            config["dnsProfiles"] = dnsProfiles
+        }
+        // What queries forwarded to public resolvers may reveal
+        if let dnsPrivacy = options["dnsPrivacy"] as? [String: Any] {
+            config["dnsPrivacy"] = dnsPrivacy
+        }
+        // What network transitions do to the tunnel, e.g. nothing for a dock's link flap
+        if let reassertPolicy = options["reassertPolicy"] as? [String: Any] {
+            config["reassertPolicy"] = reassertPolicy
+        }
+        // How Go restarts a stuck tunnel, e.g. {"enabled": false} to leave it to the app
+        if let autoReconnect = options["autoReconnect"] as? [String: Any] {
+            config["autoReconnect"] = autoReconnect
+        }
+        // Session cookie name of self-hosted servers with a custom server.session_cookie_name
+        if let sessionCookieName = options["sessionCookieName"] as? String {
+            config["sessionCookieName"] = sessionCookieName
+        }
 
         // Convert config to JSON string
         guard let jsonData = try? JSONSerialization.data(withJSONObject: config),
@@ -327,13 +618,11 @@ public class TunnelAdapter {
 
         if let result = PangolinGo.startTunnel(tunnelFD, configJSONPtr) {
             let message = String(cString: result)
-            result.deallocate()
+            PangolinGo.freeCString(result)
             os_log("Go startTunnel returned: %{public}@", log: logger, type: .debug, message)
 
-            // Check if the Go function returned an error
-            if message.lowercased().contains("error") || message.lowercased().contains("fail") {
-                goError = NSError(
-                    domain: "PangolinGo", code: -1, userInfo: [NSLocalizedDescriptionKey: message])
+            if let error = TunnelAdapter.lifecycleError(message) {
+                goError = error
                 os_log("Go tunnel start failed: %{public}@", log: logger, type: .error, message)
             }
         } else {
@@ -358,8 +647,8 @@ public class TunnelAdapter {
         // Initialize version tracking
         lastSeenVersion = PangolinGo.getNetworkSettingsVersion()
 
-        // Start polling for network settings updates
-        startSettingsPolling()
+        // Start receiving events, including network settings updates
+        startEventWatch()
 
         // Start network transition monitoring
         startNetworkTransitionMonitoring()
@@ -371,7 +660,7 @@ public class TunnelAdapter {
     //
     // - Returns: An error if stopping failed, nil otherwise
     public func stop() -> Error? {
-        stopSettingsPolling()
+        stopEventWatch()
         stopNetworkTransitionMonitoring()
         return stopGoTunnel()
     }
@@ -380,16 +669,15 @@ public class TunnelAdapter {
     private func stopGoTunnel() -> Error? {
         os_log("Stopping Go tunnel", log: logger, type: .debug)
         var stopError: Error? = nil
-        if let result = PangolinGo.stopTunnel() {
+        // No drain: the system is already tearing the tunnel down, and gives
+        // the extension only a few seconds before it is killed
+        if let result = PangolinGo.stopTunnel(0, TunnelAdapter.stopTimeoutSeconds) {
             let message = String(cString: result)
-            result.deallocate()
+            PangolinGo.freeCString(result)
             os_log("Go stopTunnel returned: %{public}@", log: logger, type: .debug, message)
 
-            // Check if the Go function returned an error
-            if message.lowercased().contains("error") || message.lowercased().contains("fail") {
-                stopError = NSError(
-                    domain: "PangolinGo", code: -1, userInfo: [NSLocalizedDescriptionKey: message])
-            }
+            stopError = TunnelAdapter.lifecycleError(message)
+            logShutdownReport(message)
         } else {
             stopError = NSError(
                 domain: "PangolinGo", code: -1,
@@ -412,37 +700,86 @@ public class TunnelAdapter {
         return stopError
     }
 
-    // MARK: - Network Settings Polling
+    // Logs what a stop left running, so extensions exiting mid-shutdown show
+    // up in the logs
+    private func logShutdownReport(_ json: String) {
+        guard let data = json.data(using: .utf8),
+            let report = try? JSONDecoder().decode(GoLifecycleResultJSON.self, from: data).shutdown
+        else { return }
+        if report.timedOut {
+            os_log(
+                "Go tunnel shutdown passed its deadline; still running: %{public}@", log: logger,
+                type: .error, report.stillRunning.joined(separator: ", "))
+        } else if !report.flushed || !report.deviceClosed {
+            os_log(
+                "Go tunnel shutdown dropped %d packets, device closed: %{public}@", log: logger,
+                type: .info, report.pendingPackets, String(report.deviceClosed))
+        }
+    }
 
-    private func startSettingsPolling() {
-        stopSettingsPolling()  // Stop any existing timer
+    // MARK: - Go Events
+
+    // Go pushes events instead of Swift polling the settings token.
+    // Registering delivers the current token, so a change between reading it
+    // and registering is not missed.
+    private func startEventWatch() {
+        stopEventWatch()  // Drop any existing registration
+
+        os_log("Registering for Go events", log: logger, type: .debug)
+        let context = Unmanaged.passUnretained(self).toOpaque()
+        let id = PangolinGo.registerEventCallback(
+            { event, context in
+                guard let event = event, let context = context else { return }
+                let adapter = Unmanaged<TunnelAdapter>.fromOpaque(context).takeUnretainedValue()
+                adapter.handleGoEvent(String(cString: event))
+            }, context)
+
+        eventLock.lock()
+        eventCallbackID = id
+        eventLock.unlock()
+    }
 
-        os_log(
-            "Starting network settings polling (interval: %.1f seconds)", log: logger, type: .debug,
-            pollInterval)
+    private func stopEventWatch() {
+        eventLock.lock()
+        let id = eventCallbackID
+        eventCallbackID = 0
+        eventLock.unlock()
+        guard id != 0 else { return }
 
-        let queue = DispatchQueue(label: "com.pangolin.tunnel.settings-poll", qos: .utility)
-        let timer = DispatchSource.makeTimerSource(queue: queue)
-        timer.schedule(deadline: .now() + pollInterval, repeating: pollInterval)
-        timer.setEventHandler { [weak self] in
-            self?.pollNetworkSettings()
+        // Returns once the callback is no longer running, so self may go away
+        if let result = PangolinGo.unregisterEventCallback(id) {
+            PangolinGo.freeCString(result)
         }
-        timer.resume()
-        settingsPollTimer = timer
+        os_log("Unregistered from Go events", log: logger, type: .debug)
     }
 
-    private func stopSettingsPolling() {
-        if let timer = settingsPollTimer {
-            timer.cancel()
-            settingsPollTimer = nil
-            os_log("Stopped network settings polling", log: logger, type: .debug)
+    // Called on a Go thread; hands the event off rather than blocking Go
+    private func handleGoEvent(_ json: String) {
+        guard let data = json.data(using: .utf8),
+            let event = try? JSONDecoder().decode(GoEventJSON.self, from: data)
+        else {
+            os_log("Failed to decode Go event: %{public}@", log: logger, type: .error, json)
+            return
         }
-    }
 
-    private func pollNetworkSettings() {
-        // Poll the version number first (lightweight)
-        let currentVersion = PangolinGo.getNetworkSettingsVersion()
+        switch event.type {
+        case "settings":
+            let token = event.version ?? 0
+            eventQueue.async { [weak self] in
+                guard let self = self else { return }
+                if token < self.lastSeenVersion {
+                    // The Go tunnel stopped underneath us (token 0); wait for it to come back
+                    self.lastSeenVersion = token
+                    return
+                }
+                self.applyNetworkSettingsVersion(token)
+            }
+        default:
+            os_log("Go event: %{public}@", log: logger, type: .debug, json)
+        }
+    }
 
+    private func applyNetworkSettingsVersion(_ currentVersion: Int) {
         // Only fetch full settings if version has changed
         if currentVersion > lastSeenVersion {
             os_log(
@@ -457,7 +794,7 @@ public class TunnelAdapter {
             }
 
             let jsonString = String(cString: result)
-            result.deallocate()
+            PangolinGo.freeCString(result)
 
             // Parse JSON
             guard let jsonData = jsonString.data(using: .utf8) else {
@@ -478,6 +815,14 @@ public class TunnelAdapter {
                 return
             }
 
+            // The bridge bumped the version but the result is what was applied
+            // last, so there is nothing to hand to the system
+            if let changes = settingsJSON.changes, changes.isEmpty, lastAppliedSettings != nil {
+                os_log("Network settings unchanged, skipping update", log: logger, type: .debug)
+                ackNetworkSettings(version: currentVersion, error: nil)
+                return
+            }
+
             // Convert to NEPacketTunnelNetworkSettings, merging with existing settings
             guard
                 let newSettings = convertJSONToNetworkSettings(
@@ -488,19 +833,24 @@ public class TunnelAdapter {
 
             // Version changed, so settings are different - update them
             os_log("Network settings version changed, updating...", log: logger, type: .debug)
-            updateNetworkSettings(newSettings)
+            updateNetworkSettings(newSettings, version: currentVersion)
         }
     }
 
     private func convertJSONToNetworkSettings(
         _ json: NetworkSettingsJSON, mergingWith existing: NEPacketTunnelNetworkSettings?
     ) -> NEPacketTunnelNetworkSettings? {
-        // If all fields are nil/empty, return nil (no settings to apply)
+        guard json.schemaVersion == supportedNetworkSettingsSchemaVersion else {
+            os_log(
+                "Unsupported network settings schema version %d", log: logger, type: .error,
+                json.schemaVersion)
+            return nil
+        }
+
+        // If nothing was provided, return nil (no settings to apply)
         let hasSettings =
-            json.tunnelRemoteAddress != nil || json.mtu != nil
-            || (json.dnsServers != nil && !json.dnsServers!.isEmpty)
-            || (json.ipv4Addresses != nil && !json.ipv4Addresses!.isEmpty)
-            || (json.ipv6Addresses != nil && !json.ipv6Addresses!.isEmpty)
+            json.tunnelRemoteAddress != nil || json.mtu != nil || json.ipv4Settings != nil
+            || json.ipv6Settings != nil || json.dnsSettings != nil || json.proxySettings != nil
 
         if !hasSettings {
             return nil
@@ -510,145 +860,111 @@ public class TunnelAdapter {
         let remoteAddress = json.tunnelRemoteAddress ?? existing?.tunnelRemoteAddress ?? "127.0.0.1"
         let settings = NEPacketTunnelNetworkSettings(tunnelRemoteAddress: remoteAddress)
 
-        // Set MTU (use JSON value if provided, otherwise preserve existing)
         if let mtu = json.mtu {
             settings.mtu = NSNumber(value: mtu)
-        } else if let existingMTU = existing?.mtu {
-            settings.mtu = existingMTU
+        } else {
+            settings.mtu = existing?.mtu
         }
 
-        // Set DNS settings (use JSON value if provided, otherwise preserve existing)
-        if let dnsServers = json.dnsServers, !dnsServers.isEmpty {
-            let dnsSettings = NEDNSSettings(servers: dnsServers)
-            // Set search domains to empty array to match all domains only if overrideDNS is enabled
-            if overrideDNS {
-                dnsSettings.matchDomains = [""]
-            }
+        if let dnsJSON = json.dnsSettings {
+            let dnsSettings = NEDNSSettings(servers: dnsJSON.servers)
+            dnsSettings.searchDomains = dnsJSON.searchDomains
+            dnsSettings.matchDomains = dnsJSON.matchDomains
+            dnsSettings.matchDomainsNoSearch = dnsJSON.matchDomainsNoSearch ?? false
             settings.dnsSettings = dnsSettings
-        } else if let existingDNS = existing?.dnsSettings {
-            // Only modify matchDomains if overrideDNS is enabled
-            if overrideDNS {
-                existingDNS.matchDomains = [""]
-            }
-            settings.dnsSettings = existingDNS
-        }
-
-        // Set IPv4 settings
-        if let ipv4Addresses = json.ipv4Addresses, !ipv4Addresses.isEmpty {
-            // Log raw values from JSON before creating settings
-            let subnetMasks =
-                json.ipv4SubnetMasks
-                ?? Array(repeating: "255.255.255.0", count: ipv4Addresses.count)
-
-            let ipv4Settings = NEIPv4Settings(addresses: ipv4Addresses, subnetMasks: subnetMasks)
-
-            // Convert routes
-            var includedRoutes: [NEIPv4Route] = []
-            if let routesJSON = json.ipv4IncludedRoutes {
-                for routeJSON in routesJSON {
-                    if routeJSON.isDefault == true {
-                        includedRoutes.append(NEIPv4Route.default())
-                    } else {
-                        let destination = routeJSON.destinationAddress
-                        let subnetMask = routeJSON.subnetMask ?? "255.255.255.255"
-                        let route = NEIPv4Route(
-                            destinationAddress: destination, subnetMask: subnetMask)
-                        if let gateway = routeJSON.gatewayAddress {
-                            route.gatewayAddress = gateway
-                        }
-                        includedRoutes.append(route)
-                    }
-                }
-            }
-            ipv4Settings.includedRoutes = includedRoutes
-
-            var excludedRoutes: [NEIPv4Route] = []
-            if let routesJSON = json.ipv4ExcludedRoutes {
-                for routeJSON in routesJSON {
-                    if routeJSON.isDefault == true {
-                        excludedRoutes.append(NEIPv4Route.default())
-                    } else {
-                        let destination = routeJSON.destinationAddress
-                        let subnetMask = routeJSON.subnetMask ?? "255.255.255.255"
-                        let route = NEIPv4Route(
-                            destinationAddress: destination, subnetMask: subnetMask)
-                        if let gateway = routeJSON.gatewayAddress {
-                            route.gatewayAddress = gateway
-                        }
-                        excludedRoutes.append(route)
-                    }
-                }
-            }
-            ipv4Settings.excludedRoutes = excludedRoutes
+        } else {
+            settings.dnsSettings = existing?.dnsSettings
+        }
+
+        // Rebuilding hundreds of routes is the expensive part, so keep the applied
+        // objects when the bridge says neither addresses nor routes changed
+        let interfaceChanges: Set<String> = ["full", "addresses-changed", "routes-added", "routes-removed"]
+        let keepInterface =
+            existing != nil && json.changes.map { interfaceChanges.isDisjoint(with: $0) } ?? false
+
+        if keepInterface {
+            settings.ipv4Settings = existing?.ipv4Settings
+            settings.ipv6Settings = existing?.ipv6Settings
+        } else {
+            applyInterfaceSettings(json, to: settings, mergingWith: existing)
+        }
+
+        if let proxyJSON = json.proxySettings {
+            settings.proxySettings = makeProxySettings(proxyJSON)
+        } else {
+            settings.proxySettings = existing?.proxySettings
+        }
+
+        return settings
+    }
+
+    private func applyInterfaceSettings(
+        _ json: NetworkSettingsJSON, to settings: NEPacketTunnelNetworkSettings,
+        mergingWith existing: NEPacketTunnelNetworkSettings?
+    ) {
+        if let ipv4JSON = json.ipv4Settings {
+            let ipv4Settings = NEIPv4Settings(
+                addresses: ipv4JSON.addresses, subnetMasks: ipv4JSON.subnetMasks)
+            ipv4Settings.includedRoutes = (ipv4JSON.includedRoutes ?? []).map(makeIPv4Route)
+            ipv4Settings.excludedRoutes = (ipv4JSON.excludedRoutes ?? []).map(makeIPv4Route)
             settings.ipv4Settings = ipv4Settings
+        } else {
+            settings.ipv4Settings = existing?.ipv4Settings
         }
 
-        // Set IPv6 settings
-        if let ipv6Addresses = json.ipv6Addresses, !ipv6Addresses.isEmpty {
-            let networkPrefixes =
-                json.ipv6NetworkPrefixes ?? Array(repeating: "64", count: ipv6Addresses.count)
-            let networkPrefixLengths = networkPrefixes.compactMap { Int($0) }.map {
-                NSNumber(value: $0)
-            }
+        if let ipv6JSON = json.ipv6Settings {
             let ipv6Settings = NEIPv6Settings(
-                addresses: ipv6Addresses, networkPrefixLengths: networkPrefixLengths)
-
-            // Convert routes
-            var includedRoutes: [NEIPv6Route] = []
-            if let routesJSON = json.ipv6IncludedRoutes {
-                for routeJSON in routesJSON {
-                    if routeJSON.isDefault == true {
-                        includedRoutes.append(NEIPv6Route.default())
-                    } else {
-                        let destination = routeJSON.destinationAddress
-                        let prefixLength = routeJSON.networkPrefixLength ?? 128
-                        let route = NEIPv6Route(
-                            destinationAddress: destination,
-                            networkPrefixLength: NSNumber(value: prefixLength))
-                        if let gateway = routeJSON.gatewayAddress {
-                            route.gatewayAddress = gateway
-                        }
-                        includedRoutes.append(route)
-                    }
-                }
-            }
-            ipv6Settings.includedRoutes = includedRoutes
-
-            var excludedRoutes: [NEIPv6Route] = []
-            if let routesJSON = json.ipv6ExcludedRoutes {
-                for routeJSON in routesJSON {
-                    if routeJSON.isDefault == true {
-                        excludedRoutes.append(NEIPv6Route.default())
-                    } else {
-                        let destination = routeJSON.destinationAddress
-                        let prefixLength = routeJSON.networkPrefixLength ?? 128
-                        let route = NEIPv6Route(
-                            destinationAddress: destination,
-                            networkPrefixLength: NSNumber(value: prefixLength))
-                        if let gateway = routeJSON.gatewayAddress {
-                            route.gatewayAddress = gateway
-                        }
-                        excludedRoutes.append(route)
-                    }
-                }
-            }
-            ipv6Settings.excludedRoutes = excludedRoutes
-
+                addresses: ipv6JSON.addresses,
+                networkPrefixLengths: ipv6JSON.networkPrefixLengths.map { NSNumber(value: $0) })
+            ipv6Settings.includedRoutes = (ipv6JSON.includedRoutes ?? []).map(makeIPv6Route)
+            ipv6Settings.excludedRoutes = (ipv6JSON.excludedRoutes ?? []).map(makeIPv6Route)
             settings.ipv6Settings = ipv6Settings
-        } else if let existingIPv6 = existing?.ipv6Settings {
-            // Preserve existing IPv6 settings if not being updated
-            settings.ipv6Settings = existingIPv6
+        } else {
+            settings.ipv6Settings = existing?.ipv6Settings
         }
+    }
 
-        // If no IPv4 settings were set from JSON, preserve existing ones
-        if settings.ipv4Settings == nil, let existingIPv4 = existing?.ipv4Settings {
-            settings.ipv4Settings = existingIPv4
+    private func makeIPv4Route(_ json: IPv4RouteJSON) -> NEIPv4Route {
+        if json.isDefault == true {
+            return NEIPv4Route.default()
         }
+        let route = NEIPv4Route(destinationAddress: json.destinationAddress, subnetMask: json.subnetMask)
+        route.gatewayAddress = json.gatewayAddress
+        return route
+    }
 
-        return settings
+    private func makeIPv6Route(_ json: IPv6RouteJSON) -> NEIPv6Route {
+        if json.isDefault == true {
+            return NEIPv6Route.default()
+        }
+        let route = NEIPv6Route(
+            destinationAddress: json.destinationAddress,
+            networkPrefixLength: NSNumber(value: json.networkPrefixLength))
+        route.gatewayAddress = json.gatewayAddress
+        return route
+    }
+
+    private func makeProxySettings(_ json: ProxySettingsJSON) -> NEProxySettings {
+        let proxySettings = NEProxySettings()
+        proxySettings.autoProxyConfigurationEnabled = json.autoProxyConfigurationEnabled ?? false
+        if let pacURL = json.proxyAutoConfigurationURL {
+            proxySettings.proxyAutoConfigurationURL = URL(string: pacURL)
+        }
+        proxySettings.httpEnabled = json.httpEnabled ?? false
+        if let server = json.httpServer {
+            proxySettings.httpServer = NEProxyServer(address: server.address, port: server.port)
+        }
+        proxySettings.httpsEnabled = json.httpsEnabled ?? false
+        if let server = json.httpsServer {
+            proxySettings.httpsServer = NEProxyServer(address: server.address, port: server.port)
+        }
+        proxySettings.excludeSimpleHostnames = json.excludeSimpleHostnames ?? false
+        proxySettings.exceptionList = json.exceptionList
+        proxySettings.matchDomains = json.matchDomains
+        return proxySettings
     }
 
-    private func updateNetworkSettings(_ settings: NEPacketTunnelNetworkSettings) {
+    private func updateNetworkSettings(_ settings: NEPacketTunnelNetworkSettings, version: Int) {
         packetTunnelProvider?.setTunnelNetworkSettings(settings) { [weak self] error in
             guard let self = self else { return }
 
@@ -660,9 +976,29 @@ public class TunnelAdapter {
                 os_log("Network settings updated successfully", log: self.logger, type: .debug)
                 self.lastAppliedSettings = settings
             }
+            self.ackNetworkSettings(version: version, error: error)
         }
     }
 
+    /// Tells Go whether a settings version was applied, so it can retry a
+    /// failed apply and report it in the server health.
+    private func ackNetworkSettings(version: Int, error: Error?) {
+        let errorCString = (error?.localizedDescription ?? "").utf8CString
+        let errorPtr = UnsafeMutablePointer<CChar>.allocate(capacity: errorCString.count)
+        errorCString.withUnsafeBufferPointer { buffer in
+            errorPtr.initialize(from: buffer.baseAddress!, count: buffer.count)
+        }
+        defer { errorPtr.deallocate() }
+
+        guard let result = PangolinGo.ackNetworkSettingsApplied(version, error == nil ? 1 : 0, errorPtr) else {
+            os_log("Failed to call Go ackNetworkSettingsApplied function (returned nil)", log: logger, type: .error)
+            return
+        }
+        let message = String(cString: result)
+        PangolinGo.freeCString(result)
+        os_log("ackNetworkSettingsApplied result: %{public}@", log: logger, type: .debug, message)
+    }
+
     // MARK: - Network Transition Monitoring
 
     private func startNetworkTransitionMonitoring() {
@@ -670,8 +1006,8 @@ public class TunnelAdapter {
 
         // Create and configure the monitor
         let monitor = NetworkTransitionMonitor()
-        monitor.onRebindRequired = { [weak self] in
-            self?.handleNetworkTransition()
+        monitor.onPathChanged = { [weak self] path in
+            self?.reportNetworkPath(path)
         }
         monitor.onSystemDNSChanged = { [weak self] servers in
             self?.reportSystemDNS(servers)
@@ -706,7 +1042,7 @@ public class TunnelAdapter {
             return
         }
         let message = String(cString: result)
-        result.deallocate()
+        PangolinGo.freeCString(result)
         os_log("setSystemDNS result: %{public}@", log: logger, type: .debug, message)
     }
 
@@ -716,21 +1052,34 @@ public class TunnelAdapter {
         networkTransitionMonitor = nil
     }
 
-    private func handleNetworkTransition() {
-        os_log("Handling network transition - rebinding socket", log: logger, type: .info)
-
-        guard let result = PangolinGo.rebindSocket() else {
-            os_log("rebindSocket returned nil", log: logger, type: .error)
+    /// Forwards a path update to Go, which records the path's attributes and network and
+    /// applies its reassert policy when the interface changed or the network came back.
+    private func reportNetworkPath(_ path: [String: Any]) {
+        guard let jsonData = try? JSONSerialization.data(withJSONObject: path),
+            let jsonString = String(data: jsonData, encoding: .utf8)
+        else {
+            os_log("Failed to serialize network path to JSON", log: logger, type: .error)
             return
         }
+        let jsonCString = jsonString.utf8CString
 
+        let jsonPtr = UnsafeMutablePointer<CChar>.allocate(capacity: jsonCString.count)
+        jsonCString.withUnsafeBufferPointer { buffer in
+            jsonPtr.initialize(from: buffer.baseAddress!, count: buffer.count)
+        }
+        defer { jsonPtr.deallocate() }
+
+        guard let result = PangolinGo.notifyNetworkChange(jsonPtr) else {
+            os_log("Failed to call Go notifyNetworkChange function (returned nil)", log: logger, type: .error)
+            return
+        }
         let message = String(cString: result)
-        result.deallocate()
+        PangolinGo.freeCString(result)
 
-        if message.lowercased().contains("error") || message.lowercased().contains("fail") {
-            os_log("Failed to rebind socket: %{public}@", log: logger, type: .error, message)
+        if message.hasPrefix("Error") {
+            os_log("Failed to handle network change: %{public}@", log: logger, type: .error, message)
         } else {
-            os_log("Successfully rebound socket after network transition: %{public}@", log: logger, type: .info, message)
+            os_log("notifyNetworkChange result: %{public}@", log: logger, type: .info, message)
         }
     }
 }
@@ -0,0 +1,198 @@
+package main
+
+import "C"
+import (
+	"encoding/json"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/fosrl/newt/network"
+)
+
+// Address conflict states reported by getAddressConflicts
+const (
+	AddressConflictStateUnknown  = "unknown"
+	AddressConflictStateOK       = "ok"
+	AddressConflictStateConflict = "conflict"
+)
+
+// Kinds of AddressConflict
+const (
+	// ConflictDuplicateAddress: a local interface already has the tunnel
+	// address, so replies to it may never reach the tunnel
+	ConflictDuplicateAddress = "duplicateAddress"
+	// ConflictAddressInLocalSubnet: the tunnel address lies inside a local
+	// subnet, so LAN hosts with that address become unreachable
+	ConflictAddressInLocalSubnet = "addressInLocalSubnet"
+	// ConflictRouteOverlapsLocalSubnet: an included route covers part of a
+	// local subnet, so some LAN traffic goes into the tunnel
+	ConflictRouteOverlapsLocalSubnet = "routeOverlapsLocalSubnet"
+)
+
+// AddressConflict is one collision between the tunnel settings and the
+// device's own networks
+type AddressConflict struct {
+	Kind      string `json:"kind"`
+	Tunnel    string `json:"tunnel"` // tunnel address or included route
+	Interface string `json:"interface"`
+	Local     string `json:"local"` // local address with its prefix length
+}
+
+// AddressConflictStatus is the JSON returned by getAddressConflicts
+type AddressConflictStatus struct {
+	State     string            `json:"state"`
+	Conflicts []AddressConflict `json:"conflicts,omitempty"`
+	CheckedAt time.Time         `json:"checkedAt,omitempty"`
+}
+
+var (
+	addressConflictMutex  sync.Mutex
+	addressConflictStatus = AddressConflictStatus{State: AddressConflictStateUnknown}
+)
+
+type localPrefix struct {
+	iface  string
+	prefix netip.Prefix
+}
+
+// localPrefixes lists the addresses of the device's other interfaces. The
+// tunnel's own interface, loopback and link-local addresses cannot conflict
+// in a way that matters and are left out.
+func localPrefixes(tunnelIface string) []localPrefix {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		appLogger.Debug("Failed to list interfaces: %v", err)
+		return nil
+	}
+
+	var out []localPrefix
+	for _, iface := range ifaces {
+		if iface.Name == tunnelIface || iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			ip, ok := netip.AddrFromSlice(ipNet.IP)
+			ip = ip.Unmap()
+			bits, _ := ipNet.Mask.Size()
+			if !ok || ip.IsLinkLocalUnicast() || bits > ip.BitLen() {
+				continue
+			}
+			out = append(out, localPrefix{iface: iface.Name, prefix: netip.PrefixFrom(ip, bits)})
+		}
+	}
+	return out
+}
+
+// includedRoutePrefixes returns the included routes other than the default
+// route, which is meant to cover everything and leaves the LAN to its more
+// specific interface route
+func includedRoutePrefixes(settings network.NetworkSettings) []netip.Prefix {
+	var out []netip.Prefix
+	for _, route := range settings.IPv4IncludedRoutes {
+		if prefix, err := netip.ParsePrefix(ipv4RouteCIDR(route)); !route.IsDefault && err == nil && prefix.Bits() > 0 {
+			out = append(out, prefix.Masked())
+		}
+	}
+	for _, route := range settings.IPv6IncludedRoutes {
+		if prefix, err := netip.ParsePrefix(ipv6RouteCIDR(route)); !route.IsDefault && err == nil && prefix.Bits() > 0 {
+			out = append(out, prefix.Masked())
+		}
+	}
+	return out
+}
+
+// findAddressConflicts compares the tunnel addresses and included routes
+// against the local interfaces
+func findAddressConflicts(settings network.NetworkSettings, locals []localPrefix) []AddressConflict {
+	var conflicts []AddressConflict
+	for _, addr := range tunnelAddresses(settings) {
+		for _, local := range locals {
+			switch {
+			case local.prefix.Addr() == addr:
+				conflicts = append(conflicts, AddressConflict{ConflictDuplicateAddress, addr.String(), local.iface, local.prefix.String()})
+			case local.prefix.Masked().Contains(addr):
+				conflicts = append(conflicts, AddressConflict{ConflictAddressInLocalSubnet, addr.String(), local.iface, local.prefix.String()})
+			}
+		}
+	}
+	for _, route := range includedRoutePrefixes(settings) {
+		for _, local := range locals {
+			if route.Overlaps(local.prefix.Masked()) {
+				conflicts = append(conflicts, AddressConflict{ConflictRouteOverlapsLocalSubnet, route.String(), local.iface, local.prefix.String()})
+			}
+		}
+	}
+	return conflicts
+}
+
+// checkAddressConflicts updates the conflict state for the settings about
+// to be published. The settings are published either way; a conflict is
+// for the app to explain, not a reason to keep the tunnel down.
+func checkAddressConflicts(settings network.NetworkSettings) {
+	conflicts := findAddressConflicts(settings, localPrefixes(trafficInterfaceName()))
+	state := AddressConflictStateOK
+	if len(conflicts) > 0 {
+		state = AddressConflictStateConflict
+	}
+
+	addressConflictMutex.Lock()
+	changed := !slices.Equal(conflicts, addressConflictStatus.Conflicts)
+	addressConflictStatus = AddressConflictStatus{State: state, Conflicts: conflicts, CheckedAt: time.Now()}
+	addressConflictMutex.Unlock()
+
+	if !changed {
+		return
+	}
+	for _, conflict := range conflicts {
+		appLogger.Warn("Tunnel %s conflicts with %s on %s (%s)", conflict.Tunnel, conflict.Local, conflict.Interface, conflict.Kind)
+	}
+	if len(conflicts) == 0 {
+		appLogger.Info("Tunnel addresses no longer conflict with the local network")
+	}
+	recordEvent(EventSettings, "address conflicts: %d", len(conflicts))
+}
+
+// recheckAddressConflicts repeats the check after the local network changed
+func recheckAddressConflicts() {
+	tunnelMutex.Lock()
+	running := tunnelRunning
+	tunnelMutex.Unlock()
+	if running {
+		checkAddressConflicts(effectiveNetworkSettings())
+	}
+}
+
+// resetAddressConflicts forgets the state when the tunnel stops
+func resetAddressConflicts() {
+	addressConflictMutex.Lock()
+	addressConflictStatus = AddressConflictStatus{State: AddressConflictStateUnknown}
+	addressConflictMutex.Unlock()
+}
+
+// getAddressConflicts returns whether the tunnel addresses or routes collide
+// with the local network, as JSON
+//
+//export getAddressConflicts
+func getAddressConflicts() *C.char {
+	addressConflictMutex.Lock()
+	status := addressConflictStatus
+	addressConflictMutex.Unlock()
+
+	data, err := json.Marshal(status)
+	if err != nil {
+		appLogger.Error("Failed to marshal address conflicts: %v", err)
+		return exportString(`{"state":"unknown"}`)
+	}
+	return exportString(string(data))
+}
@@ -0,0 +1,63 @@
+package main
+
+import "github.com/fosrl/newt/network"
+
+// AppleServicesPolicy lets the server or user override which Apple services
+// bypass a full tunnel. A nil field keeps the default, which is to exclude.
+type AppleServicesPolicy struct {
+	ExcludeAPNs                *bool `json:"excludeAPNs"`
+	ExcludeCellularServices    *bool `json:"excludeCellularServices"`
+	ExcludeDeviceCommunication *bool `json:"excludeDeviceCommunication"`
+}
+
+// AppleServiceExclusions mirrors NETunnelProviderProtocol's excludeAPNs,
+// excludeCellularServices and excludeDeviceCommunication
+type AppleServiceExclusions struct {
+	FullTunnel                 bool `json:"fullTunnel"`
+	ExcludeAPNs                bool `json:"excludeAPNs"`
+	ExcludeCellularServices    bool `json:"excludeCellularServices"`
+	ExcludeDeviceCommunication bool `json:"excludeDeviceCommunication"`
+}
+
+// isFullTunnel reports whether the settings route all traffic into the tunnel
+func isFullTunnel(settings network.NetworkSettings) bool {
+	for _, route := range settings.IPv4IncludedRoutes {
+		if route.IsDefault || ipv4RouteCIDR(route) == "0.0.0.0/0" {
+			return true
+		}
+	}
+	for _, route := range settings.IPv6IncludedRoutes {
+		if route.IsDefault || ipv6RouteCIDR(route) == "::/0" {
+			return true
+		}
+	}
+	return false
+}
+
+// appleServiceExclusions computes which Apple services should bypass the
+// tunnel. Push notifications, carrier services (VoLTE, MMS, visual
+// voicemail) and Continuity/AirDrop break when captured by a full tunnel,
+// so they are excluded unless the policy explicitly says otherwise. Split
+// tunnels never capture them, so everything stays excluded there.
+func appleServiceExclusions(settings network.NetworkSettings, policy *AppleServicesPolicy) *AppleServiceExclusions {
+	exclusions := &AppleServiceExclusions{
+		FullTunnel:                 isFullTunnel(settings),
+		ExcludeAPNs:                true,
+		ExcludeCellularServices:    true,
+		ExcludeDeviceCommunication: true,
+	}
+	if !exclusions.FullTunnel || policy == nil {
+		return exclusions
+	}
+
+	if policy.ExcludeAPNs != nil {
+		exclusions.ExcludeAPNs = *policy.ExcludeAPNs
+	}
+	if policy.ExcludeCellularServices != nil {
+		exclusions.ExcludeCellularServices = *policy.ExcludeCellularServices
+	}
+	if policy.ExcludeDeviceCommunication != nil {
+		exclusions.ExcludeDeviceCommunication = *policy.ExcludeDeviceCommunication
+	}
+	return exclusions
+}
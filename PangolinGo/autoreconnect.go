@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// The reconnect supervisor restarts olm's tunnel under the interface when it
+// is stuck: no site has a working handshake and olm has not connected,
+// registered or completed a handshake within the grace period. Losing only
+// the control plane is left alone, since olm reconnects its websocket itself
+// and the offline cache keeps the sites up meanwhile. Attempts back off
+// exponentially with jitter and start over once the tunnel connects.
+
+const (
+	autoReconnectJob      = "autoReconnect"
+	autoReconnectInterval = 5 * time.Second
+
+	defaultReconnectGrace          = 45 * time.Second
+	defaultReconnectInitialBackoff = 2 * time.Second
+	defaultReconnectMaxBackoff     = 5 * time.Minute
+)
+
+// AutoReconnectPolicy tunes the reconnect supervisor; zero values take the
+// defaults
+type AutoReconnectPolicy struct {
+	// Enabled turns the supervisor off when false; unset means on
+	Enabled *bool `json:"enabled"`
+	// GraceSeconds is how long the tunnel may be without a site before it
+	// counts as failed
+	GraceSeconds int `json:"graceSeconds"`
+	// InitialBackoffSeconds and MaxBackoffSeconds bound the wait between
+	// attempts, which doubles with every attempt
+	InitialBackoffSeconds int `json:"initialBackoffSeconds"`
+	MaxBackoffSeconds     int `json:"maxBackoffSeconds"`
+}
+
+var (
+	reconnectMutex   sync.Mutex
+	reconnectEnabled bool
+	reconnectGrace   time.Duration
+	reconnectInitial time.Duration
+	reconnectMax     time.Duration
+	// reconnectAttempts counts attempts since the tunnel was last connected
+	reconnectAttempts int
+	// reconnectNext is when the next attempt may be made
+	reconnectNext time.Time
+)
+
+// setAutoReconnectPolicy checks and applies a policy; nil restores the
+// defaults
+func setAutoReconnectPolicy(policy *AutoReconnectPolicy) error {
+	p := AutoReconnectPolicy{}
+	if policy != nil {
+		p = *policy
+	}
+	if p.GraceSeconds < 0 || p.InitialBackoffSeconds < 0 || p.MaxBackoffSeconds < 0 {
+		return fmt.Errorf("durations must not be negative")
+	}
+	grace, initial, maxBackoff := defaultReconnectGrace, defaultReconnectInitialBackoff, defaultReconnectMaxBackoff
+	if p.GraceSeconds > 0 {
+		grace = time.Duration(p.GraceSeconds) * time.Second
+	}
+	if p.InitialBackoffSeconds > 0 {
+		initial = time.Duration(p.InitialBackoffSeconds) * time.Second
+	}
+	if p.MaxBackoffSeconds > 0 {
+		maxBackoff = time.Duration(p.MaxBackoffSeconds) * time.Second
+	}
+	if maxBackoff < initial {
+		return fmt.Errorf("maxBackoffSeconds must not be shorter than initialBackoffSeconds")
+	}
+
+	reconnectMutex.Lock()
+	reconnectEnabled = p.Enabled == nil || *p.Enabled
+	reconnectGrace, reconnectInitial, reconnectMax = grace, initial, maxBackoff
+	reconnectMutex.Unlock()
+	return nil
+}
+
+// reconnectBackoff returns the wait after an attempt: the initial backoff
+// doubled for every earlier attempt, capped, and then picked at random from
+// its upper half so clients that failed together do not retry together
+func reconnectBackoff(attempt int, initial, maxBackoff time.Duration) time.Duration {
+	backoff := initial
+	for i := 1; i < attempt && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, maxBackoff)
+	return backoff/2 + time.Duration(rand.Int64N(int64(backoff/2)+1))
+}
+
+// reconnectStatus returns the attempts since the tunnel was last connected
+// and when the next may be made
+func reconnectStatus() (int, time.Time) {
+	reconnectMutex.Lock()
+	defer reconnectMutex.Unlock()
+	return reconnectAttempts, reconnectNext
+}
+
+// checkAutoReconnect restarts olm's tunnel when it has been stuck for the
+// grace period and the backoff has passed
+func checkAutoReconnect(context.Context) {
+	pauseMutex.Lock()
+	paused := tunnelPaused
+	pauseMutex.Unlock()
+	if paused {
+		return
+	}
+
+	updateTunnelState()
+	tunnelStatusMutex.Lock()
+	state, since, connectedSites := tunnelStatus.State, tunnelStatus.Since, tunnelStatus.ConnectedSites
+	tunnelStatusMutex.Unlock()
+
+	reconnectMutex.Lock()
+	if state == TunnelStateConnected {
+		attempts := reconnectAttempts
+		reconnectAttempts, reconnectNext = 0, time.Time{}
+		reconnectMutex.Unlock()
+		if attempts > 0 {
+			appLogger.Info("Tunnel connected again after %d reconnect attempt(s)", attempts)
+			recordEvent(EventState, "reconnected after %d attempt(s)", attempts)
+		}
+		return
+	}
+
+	var reason string
+	switch {
+	case connectedSites > 0:
+	case state == TunnelStateConnecting || state == TunnelStateReconnecting:
+		reason = "control plane unreachable"
+	case state == TunnelStateHandshaking:
+		reason = "no site completed a handshake"
+	}
+	if !reconnectEnabled || reason == "" || time.Since(since) < reconnectGrace || time.Now().Before(reconnectNext) {
+		reconnectMutex.Unlock()
+		return
+	}
+	reconnectAttempts++
+	attempt := reconnectAttempts
+	delay := reconnectBackoff(attempt, reconnectInitial, reconnectMax)
+	reconnectNext = time.Now().Add(delay)
+	stuck := time.Since(since).Round(time.Second)
+	reconnectMutex.Unlock()
+
+	appLogger.Warn("Tunnel %s for %v; reconnect attempt %d, next no sooner than in %v", reason, stuck, attempt, delay.Round(time.Second))
+	publishEvent(BridgeEvent{Type: BridgeEventReconnect, Attempt: attempt, Message: reason})
+
+	tunnelMutex.Lock()
+	defer tunnelMutex.Unlock()
+	if err := restartOlmTunnel(fmt.Sprintf("reconnect attempt %d: %s for %v", attempt, reason, stuck)); err != nil {
+		appLogger.Error("Reconnect attempt %d failed: %v", attempt, err)
+	}
+}
+
+// startAutoReconnect begins watching the running tunnel
+func startAutoReconnect() {
+	stopAutoReconnect()
+	scheduleJob(autoReconnectJob, false, func() time.Duration { return quietScaledInterval(autoReconnectInterval) }, checkAutoReconnect)
+}
+
+// stopAutoReconnect stops watching and forgets the attempts
+func stopAutoReconnect() {
+	cancelJob(autoReconnectJob)
+
+	reconnectMutex.Lock()
+	reconnectAttempts, reconnectNext = 0, time.Time{}
+	reconnectMutex.Unlock()
+}
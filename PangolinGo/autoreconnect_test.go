@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReconnectBackoff(t *testing.T) {
+	tests := []struct {
+		name             string
+		attempt          int
+		initial, max     time.Duration
+		wantBeforeJitter time.Duration
+	}{
+		{name: "first attempt", attempt: 1, initial: time.Second, max: time.Minute, wantBeforeJitter: time.Second},
+		{name: "zeroth attempt", attempt: 0, initial: time.Second, max: time.Minute, wantBeforeJitter: time.Second},
+		{name: "doubles", attempt: 3, initial: time.Second, max: time.Minute, wantBeforeJitter: 4 * time.Second},
+		{name: "capped", attempt: 10, initial: time.Second, max: time.Minute, wantBeforeJitter: time.Minute},
+		{name: "initial above cap", attempt: 1, initial: 2 * time.Minute, max: time.Minute, wantBeforeJitter: time.Minute},
+		{name: "no overflow", attempt: 1000, initial: time.Second, max: time.Hour, wantBeforeJitter: time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for range 100 {
+				got := reconnectBackoff(tt.attempt, tt.initial, tt.max)
+				if got < tt.wantBeforeJitter/2 || got > tt.wantBeforeJitter {
+					t.Fatalf("reconnectBackoff = %v, want between %v and %v", got, tt.wantBeforeJitter/2, tt.wantBeforeJitter)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import "C"
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fosrl/newt/holepunch"
+)
+
+const (
+	// backgroundMultiplier stretches every scheduled job in background mode,
+	// on top of the power and idle scaling
+	backgroundMultiplier = 8
+	// backgroundBatchWindow is how far ahead a background wakeup that runs a
+	// due job pulls other jobs, so periodic work runs in a few batches
+	// instead of spread out
+	backgroundBatchWindow = 5 * time.Minute
+	// backgroundHolepunchInterval replaces olm's hole punch interval, which
+	// wakes the extension every few seconds; a wake punches right away
+	// instead
+	backgroundHolepunchInterval = 5 * time.Minute
+)
+
+// BackgroundStats is the JSON returned by getBackgroundStats. The counters
+// cover the extension's lifetime.
+type BackgroundStats struct {
+	Enabled bool `json:"enabled"`
+	// Since is when background mode was last entered
+	Since time.Time `json:"since,omitempty"`
+	// Wakeups counts scheduler wakeups while in background mode, and
+	// JobRuns the jobs they ran between them
+	Wakeups uint64 `json:"wakeups"`
+	JobRuns uint64 `json:"jobRuns"`
+	// SystemWakes counts the times the system woke the extension
+	SystemWakes  uint64    `json:"systemWakes"`
+	LastWakeupAt time.Time `json:"lastWakeupAt,omitempty"`
+}
+
+var (
+	// backgroundMode is read on every scheduler wakeup; the counters are
+	// under backgroundMutex
+	backgroundMode  atomic.Bool
+	backgroundMutex sync.Mutex
+	backgroundStats BackgroundStats
+)
+
+// backgroundScaledInterval stretches an interval in background mode
+func backgroundScaledInterval(interval time.Duration) time.Duration {
+	if backgroundMode.Load() {
+		return interval * backgroundMultiplier
+	}
+	return interval
+}
+
+// schedulerWindow is how far ahead the scheduler pulls jobs into a wakeup
+func schedulerWindow() time.Duration {
+	if backgroundMode.Load() {
+		return backgroundBatchWindow
+	}
+	return schedulerCoalesceWindow
+}
+
+// noteSchedulerWakeup counts a scheduler wakeup that ran jobs in background
+// mode
+func noteSchedulerWakeup(jobs int) {
+	if jobs == 0 || !backgroundMode.Load() {
+		return
+	}
+	backgroundMutex.Lock()
+	backgroundStats.Wakeups++
+	backgroundStats.JobRuns += uint64(jobs)
+	backgroundStats.LastWakeupAt = time.Now()
+	backgroundMutex.Unlock()
+}
+
+// syncHolepunchInterval gives olm's hole punching the interval the mode
+// calls for
+func syncHolepunchInterval(hp *holepunch.Manager) {
+	if backgroundMode.Load() {
+		hp.SetServerHolepunchInterval(backgroundHolepunchInterval, backgroundHolepunchInterval)
+	} else {
+		hp.ResetServerHolepunchInterval()
+	}
+}
+
+// setBackgroundModeEnabled switches background mode, in which periodic work
+// runs rarely and in batches so the system does not throttle the extension.
+// Work that cannot wait is left to the next system wake.
+func setBackgroundModeEnabled(enabled bool) {
+	if backgroundMode.Swap(enabled) == enabled {
+		return
+	}
+
+	backgroundMutex.Lock()
+	backgroundStats.Enabled = enabled
+	if enabled {
+		backgroundStats.Since = time.Now()
+	} else {
+		backgroundStats.SystemWakes++
+		backgroundStats.Since = time.Time{}
+	}
+	backgroundMutex.Unlock()
+
+	if hp := (*holepunch.Manager)(olmPointerField("holePunchManager", reflect.TypeOf((*holepunch.Manager)(nil)))); hp != nil {
+		syncHolepunchInterval(hp)
+		if !enabled {
+			// The NAT mappings may have expired while punching was rare
+			if err := hp.TriggerHolePunch(); err != nil {
+				appLogger.Debug("Failed to trigger hole punch: %v", err)
+			}
+		}
+	}
+	rescheduleAllJobs()
+
+	if enabled {
+		appLogger.Info("Background mode on, batching periodic work")
+		recordEvent(EventState, "background mode on")
+	} else {
+		appLogger.Info("Background mode off")
+		recordEvent(EventState, "background mode off")
+		armFirstByte("wake")
+		warmRecentNames("wake")
+	}
+}
+
+// setBackgroundMode turns background mode on or off. Swift turns it on when
+// the system puts the extension to sleep and off when it wakes.
+//
+//export setBackgroundMode
+func setBackgroundMode(enabled C.int) *C.char {
+	setBackgroundModeEnabled(enabled != 0)
+	return exportString(fmt.Sprintf("Background mode set: %t", enabled != 0))
+}
+
+// getBackgroundStats returns the background wakeup counters as JSON
+//
+//export getBackgroundStats
+func getBackgroundStats() *C.char {
+	backgroundMutex.Lock()
+	stats := backgroundStats
+	backgroundMutex.Unlock()
+
+	data, err := json.Marshal(stats)
+	if err != nil {
+		appLogger.Error("Failed to marshal background stats: %v", err)
+		return exportString(`{"enabled":false}`)
+	}
+	return exportString(string(data))
+}
@@ -0,0 +1,170 @@
+package main
+
+import "C"
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	bandwidthJob = "bandwidth"
+	// bandwidthInterval is how often the counters are sampled while the
+	// rates are watched
+	bandwidthInterval = time.Second
+	// bandwidthWatchWindow is how long sampling goes on after the last
+	// getBandwidthStats, so an idle menu does not keep the extension awake
+	bandwidthWatchWindow = 2 * time.Minute
+)
+
+// bandwidthWindows are the windows rates are averaged over
+var bandwidthWindows = []time.Duration{time.Second, 10 * time.Second, time.Minute}
+
+// BandwidthRate is the average throughput over one window. Right after
+// sampling starts the samples cover less than the window, which
+// CoveredSeconds tells.
+type BandwidthRate struct {
+	WindowSeconds    int     `json:"windowSeconds"`
+	CoveredSeconds   float64 `json:"coveredSeconds"`
+	RxBytesPerSecond float64 `json:"rxBytesPerSecond"`
+	TxBytesPerSecond float64 `json:"txBytesPerSecond"`
+}
+
+// BandwidthStats is the JSON returned by getBandwidthStats
+type BandwidthStats struct {
+	RxBytes   uint64          `json:"rxBytes"`
+	TxBytes   uint64          `json:"txBytes"`
+	Rates     []BandwidthRate `json:"rates"`
+	SampledAt time.Time       `json:"sampledAt"`
+}
+
+type bandwidthSample struct {
+	at     time.Time
+	rx, tx uint64
+}
+
+var (
+	bandwidthMutex   sync.Mutex
+	bandwidthSamples []bandwidthSample
+	bandwidthWatched time.Time
+	bandwidthActive  bool
+)
+
+// recordBandwidthSample samples the counters and drops samples older than
+// the longest window needs
+func recordBandwidthSample() {
+	totals, ok := sampleTrafficCounters()
+	if !ok {
+		return
+	}
+
+	bandwidthMutex.Lock()
+	defer bandwidthMutex.Unlock()
+	if n := len(bandwidthSamples); n > 0 && (totals.RxBytes < bandwidthSamples[n-1].rx || totals.TxBytes < bandwidthSamples[n-1].tx) {
+		// The totals were reset by a new start
+		bandwidthSamples = nil
+	}
+	bandwidthSamples = append(bandwidthSamples, bandwidthSample{at: totals.SampledAt, rx: totals.RxBytes, tx: totals.TxBytes})
+
+	cutoff := totals.SampledAt.Add(-bandwidthWindows[len(bandwidthWindows)-1] - bandwidthInterval)
+	drop := 0
+	for drop < len(bandwidthSamples)-2 && bandwidthSamples[drop+1].at.Before(cutoff) {
+		drop++
+	}
+	bandwidthSamples = bandwidthSamples[drop:]
+}
+
+// bandwidthRateLocked averages over window, from the newest sample at least
+// window old, or the oldest one. Caller must hold bandwidthMutex.
+func bandwidthRateLocked(window time.Duration) BandwidthRate {
+	rate := BandwidthRate{WindowSeconds: int(window / time.Second)}
+	n := len(bandwidthSamples)
+	if n < 2 {
+		return rate
+	}
+	last := bandwidthSamples[n-1]
+	from := bandwidthSamples[0]
+	for _, sample := range bandwidthSamples[:n-1] {
+		if last.at.Sub(sample.at) < window {
+			break
+		}
+		from = sample
+	}
+	elapsed := last.at.Sub(from.at).Seconds()
+	if elapsed <= 0 {
+		return rate
+	}
+	rate.CoveredSeconds = elapsed
+	rate.RxBytesPerSecond = float64(last.rx-from.rx) / elapsed
+	rate.TxBytesPerSecond = float64(last.tx-from.tx) / elapsed
+	return rate
+}
+
+// watchBandwidth samples every second, less on battery or while the tunnel
+// is quiet, while the rates are being asked for
+func watchBandwidth() {
+	bandwidthMutex.Lock()
+	bandwidthWatched = time.Now()
+	start := !bandwidthActive
+	bandwidthActive = true
+	bandwidthMutex.Unlock()
+	if !start {
+		return
+	}
+
+	scheduleJob(bandwidthJob, false, func() time.Duration { return quietScaledInterval(bandwidthInterval) }, func(context.Context) {
+		bandwidthMutex.Lock()
+		if time.Since(bandwidthWatched) >= bandwidthWatchWindow {
+			// Cancelled under the lock, so a call starting a new job
+			// cannot slip in between
+			cancelJob(bandwidthJob)
+			bandwidthActive = false
+			bandwidthSamples = nil
+			bandwidthMutex.Unlock()
+			return
+		}
+		bandwidthMutex.Unlock()
+		recordBandwidthSample()
+	})
+}
+
+// stopBandwidthStats stops sampling when the tunnel stops
+func stopBandwidthStats() {
+	cancelJob(bandwidthJob)
+	bandwidthMutex.Lock()
+	bandwidthActive = false
+	bandwidthSamples = nil
+	bandwidthMutex.Unlock()
+}
+
+// getBandwidthStats returns the tunnel's total bytes and its throughput
+// averaged over the last 1, 10 and 60 seconds, as JSON. The counters are
+// sampled every second for a while after each call, so the first call after
+// a pause has little to average over; callers polling for a live graph get
+// full windows from then on.
+//
+//export getBandwidthStats
+func getBandwidthStats() *C.char {
+	watchBandwidth()
+	recordBandwidthSample()
+
+	bandwidthMutex.Lock()
+	stats := BandwidthStats{Rates: make([]BandwidthRate, 0, len(bandwidthWindows))}
+	if n := len(bandwidthSamples); n > 0 {
+		last := bandwidthSamples[n-1]
+		stats.RxBytes, stats.TxBytes, stats.SampledAt = last.rx, last.tx, last.at
+	}
+	for _, window := range bandwidthWindows {
+		stats.Rates = append(stats.Rates, bandwidthRateLocked(window))
+	}
+	bandwidthMutex.Unlock()
+
+	data, err := json.Marshal(stats)
+	if err != nil {
+		appLogger.Error("Failed to marshal bandwidth stats: %v", err)
+		return exportString(fmt.Sprintf("Error: Failed to marshal bandwidth stats: %v", err))
+	}
+	return exportString(string(data))
+}
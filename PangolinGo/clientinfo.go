@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"runtime/debug"
+	"strings"
+	"sync"
+)
+
+// bridgeVersion identifies this build of the bridge. Release builds set it
+// with -ldflags "-X main.bridgeVersion=<version>".
+var bridgeVersion = "dev"
+
+// clientInfoHeader carries ClientInfo as JSON on control plane requests, for
+// servers that gate features by client version
+const clientInfoHeader = "X-Pangolin-Client"
+
+// ClientInfo identifies the client to the control plane
+type ClientInfo struct {
+	AppVersion    string `json:"appVersion"`
+	BridgeVersion string `json:"bridgeVersion"`
+	OlmVersion    string `json:"olmVersion"`
+	// Agent is the platform name Swift passes, e.g. "Pangolin iOS"
+	Agent       string `json:"agent"`
+	OSVersion   string `json:"osVersion,omitempty"`
+	DeviceModel string `json:"deviceModel,omitempty"`
+}
+
+var (
+	clientInfoMutex sync.Mutex
+	clientInfo      ClientInfo
+	// clientInfoJSON and clientUserAgent are rendered once per init
+	clientInfoJSON  string
+	clientUserAgent string
+)
+
+// dependencyVersion returns the version of a module linked into the bridge
+func dependencyVersion(path string) string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == path {
+			if dep.Replace != nil {
+				return dep.Replace.Version
+			}
+			return dep.Version
+		}
+	}
+	return ""
+}
+
+// setClientInfo records who the client is from the init config
+func setClientInfo(config InitOlmConfig) {
+	info := ClientInfo{
+		AppVersion:    config.Version,
+		BridgeVersion: bridgeVersion,
+		OlmVersion:    dependencyVersion("github.com/fosrl/olm"),
+		Agent:         config.Agent,
+		OSVersion:     config.OSVersion,
+		DeviceModel:   config.DeviceModel,
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		appLogger.Error("Failed to marshal client info: %v", err)
+	}
+
+	// e.g. "Pangolin-iOS/1.4.0 (18.1; iPhone16,2) pangolin-bridge/dev olm/v1.8.0"
+	product := strings.ReplaceAll(strings.TrimSpace(info.Agent), " ", "-")
+	if product == "" {
+		product = "Pangolin"
+	}
+	userAgent := product
+	if info.AppVersion != "" {
+		userAgent += "/" + info.AppVersion
+	}
+	var comments []string
+	for _, comment := range []string{info.OSVersion, info.DeviceModel} {
+		if comment = strings.NewReplacer("(", "", ")", "", ";", "").Replace(comment); comment != "" {
+			comments = append(comments, comment)
+		}
+	}
+	if len(comments) > 0 {
+		userAgent += " (" + strings.Join(comments, "; ") + ")"
+	}
+	userAgent += " pangolin-bridge/" + info.BridgeVersion
+	if info.OlmVersion != "" {
+		userAgent += " olm/" + info.OlmVersion
+	}
+
+	clientInfoMutex.Lock()
+	clientInfo, clientInfoJSON, clientUserAgent = info, string(data), userAgent
+	clientInfoMutex.Unlock()
+	appLogger.Info("Client identifies as %s", userAgent)
+}
+
+// clientHeaders returns the User-Agent and client info header values, empty
+// before initOlm ran
+func clientHeaders() (userAgent, infoJSON string) {
+	clientInfoMutex.Lock()
+	defer clientInfoMutex.Unlock()
+	return clientUserAgent, clientInfoJSON
+}
+
+// clientFingerprint adds the client's versions and IPv6 address to the
+// fingerprint olm sends at registration and with every ping. Keys the app
+// already filled in are left alone.
+func clientFingerprint(fingerprint map[string]any) map[string]any {
+	clientInfoMutex.Lock()
+	info := clientInfo
+	clientInfoMutex.Unlock()
+
+	out := maps.Clone(fingerprint)
+	if out == nil {
+		out = map[string]any{}
+	}
+	for key, value := range map[string]string{
+		"appVersion":    info.AppVersion,
+		"bridgeVersion": info.BridgeVersion,
+		"olmVersion":    info.OlmVersion,
+		"osVersion":     info.OSVersion,
+		"deviceModel":   info.DeviceModel,
+		// Sites only deliver to the ULA once the server allows it for them
+		"tunnelIPv6": currentTunnelULA(),
+	} {
+		if _, ok := out[key]; !ok && value != "" {
+			out[key] = value
+		}
+	}
+	return out
+}
@@ -0,0 +1,150 @@
+package main
+
+import "C"
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultClockSkewThreshold is how far the local clock may drift from the
+// server's before tokens start looking expired or not-yet-valid
+const defaultClockSkewThreshold = 2 * time.Minute
+
+// ErrorCodeClockSkew is reported instead of a generic authentication failure
+// when the server rejects us while the local clock is known to be off
+const ErrorCodeClockSkew = "CLOCK_SKEW"
+
+// ClockSkewStatus is the JSON returned by getClockSkew
+type ClockSkewStatus struct {
+	State            string    `json:"state"` // "unknown", "ok" or "skewed"
+	SkewSeconds      float64   `json:"skewSeconds"`
+	ThresholdSeconds float64   `json:"thresholdSeconds"`
+	ServerTime       time.Time `json:"serverTime,omitempty"`
+	CheckedAt        time.Time `json:"checkedAt,omitempty"`
+	ErrorCode        string    `json:"errorCode,omitempty"`
+	ErrorMessage     string    `json:"errorMessage,omitempty"`
+}
+
+var (
+	clockSkewMutex     sync.Mutex
+	clockSkewThreshold = defaultClockSkewThreshold
+	clockSkew          time.Duration
+	clockSkewKnown     bool
+	clockSkewServer    time.Time
+	clockSkewCheckedAt time.Time
+	clockSkewErrorMsg  string
+)
+
+// observeServerDate updates the skew estimate from an HTTP Date header. The
+// server's timestamp is compared against the midpoint of the request so that
+// round trip time is not counted as skew.
+func observeServerDate(header string, sent, received time.Time) {
+	if header == "" {
+		return
+	}
+	serverTime, err := http.ParseTime(header)
+	if err != nil {
+		return
+	}
+
+	local := sent.Add(received.Sub(sent) / 2)
+	skew := serverTime.Sub(local)
+
+	clockSkewMutex.Lock()
+	wasSkewed := clockSkewKnown && absDuration(clockSkew) > clockSkewThreshold
+	clockSkew = skew
+	clockSkewKnown = true
+	clockSkewServer = serverTime
+	clockSkewCheckedAt = received
+	isSkewed := absDuration(skew) > clockSkewThreshold
+	threshold := clockSkewThreshold
+	if !isSkewed {
+		clockSkewErrorMsg = ""
+	}
+	clockSkewMutex.Unlock()
+
+	if isSkewed && !wasSkewed {
+		appLogger.Warn("Local clock differs from server by %v (threshold %v)", skew.Round(time.Second), threshold)
+	} else if !isSkewed && wasSkewed {
+		appLogger.Info("Local clock is back within %v of the server", threshold)
+	}
+}
+
+// setClockSkewThreshold sets the maximum tolerated skew; zero restores the default
+func setClockSkewThreshold(threshold time.Duration) {
+	if threshold <= 0 {
+		threshold = defaultClockSkewThreshold
+	}
+	clockSkewMutex.Lock()
+	clockSkewThreshold = threshold
+	clockSkewMutex.Unlock()
+}
+
+// clockSkewExceeded reports whether the last observed skew is over the threshold
+func clockSkewExceeded() (time.Duration, bool) {
+	clockSkewMutex.Lock()
+	defer clockSkewMutex.Unlock()
+	return clockSkew, clockSkewKnown && absDuration(clockSkew) > clockSkewThreshold
+}
+
+// handleAuthError is registered as olm's OnAuthError callback. When the local
+// clock is known to be off, the rejection is almost certainly caused by it, so
+// it is recorded as a clock skew error rather than a plain "Unauthorized".
+func handleAuthError(statusCode int, message string) {
+	skew, skewed := clockSkewExceeded()
+	if !skewed {
+		appLogger.Error("Authentication failed (status %d): %s", statusCode, message)
+		noteTunnelError(ErrorCodeAuthFailed, fmt.Sprintf("Authentication failed (status %d)", statusCode))
+		return
+	}
+
+	errMsg := fmt.Sprintf("Authentication failed because the device clock is off by %v; check the date and time settings", skew.Round(time.Second))
+	appLogger.Error("%s (status %d)", errMsg, statusCode)
+
+	clockSkewMutex.Lock()
+	clockSkewErrorMsg = errMsg
+	clockSkewMutex.Unlock()
+	noteTunnelError(ErrorCodeClockSkew, errMsg)
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// getClockSkew returns the current clock skew estimate as a JSON string
+//
+//export getClockSkew
+func getClockSkew() *C.char {
+	clockSkewMutex.Lock()
+	status := ClockSkewStatus{
+		State:            "unknown",
+		SkewSeconds:      clockSkew.Seconds(),
+		ThresholdSeconds: clockSkewThreshold.Seconds(),
+		ServerTime:       clockSkewServer,
+		CheckedAt:        clockSkewCheckedAt,
+	}
+	if clockSkewKnown {
+		status.State = "ok"
+		if absDuration(clockSkew) > clockSkewThreshold {
+			status.State = "skewed"
+		}
+	}
+	if clockSkewErrorMsg != "" {
+		status.ErrorCode = ErrorCodeClockSkew
+		status.ErrorMessage = clockSkewErrorMsg
+	}
+	clockSkewMutex.Unlock()
+
+	data, err := json.Marshal(status)
+	if err != nil {
+		appLogger.Error("Failed to marshal clock skew status: %v", err)
+		return exportString("{}")
+	}
+	return exportString(string(data))
+}
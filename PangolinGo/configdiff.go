@@ -0,0 +1,154 @@
+package main
+
+import "C"
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// How a config change takes effect
+const (
+	// ConfigApplyHot: an export applies it to the running tunnel without
+	// interrupting traffic
+	ConfigApplyHot = "hot"
+	// ConfigApplyReconnect: an export applies it by restarting olm's tunnel
+	// under the interface, which drops connections briefly
+	ConfigApplyReconnect = "reconnect"
+	// ConfigApplyRestart: only a new startTunnel picks it up
+	ConfigApplyRestart = "restart"
+)
+
+// configAppliers names the export that applies a field at runtime, keyed by
+// JSON name. Fields not listed need a restart.
+var configAppliers = map[string]struct{ export, apply string }{
+	"upstreamDNS":         {"setUpstreamDNS", ConfigApplyHot},
+	"pingIntervalSeconds": {"setPingParameters", ConfigApplyHot},
+	"pingTimeoutSeconds":  {"setPingParameters", ConfigApplyHot},
+	"featureFlags":        {"setFeatureFlags", ConfigApplyHot},
+	"firewall":            {"setFirewallRules", ConfigApplyHot},
+	"inboundExposure":     {"setInboundExposure", ConfigApplyHot},
+	"bandwidthLimit":      {"setBandwidthLimits", ConfigApplyHot},
+	"dscp":                {"setDSCP", ConfigApplyHot},
+	"routeVia":            {"setRoutesVia", ConfigApplyHot},
+	"domainRoutes":        {"setRoutesByDomain", ConfigApplyHot},
+	"dnsRoutes":           {"setDNSRoutes", ConfigApplyHot},
+	"routeMtus":           {"setRouteMTUs", ConfigApplyHot},
+	"exitNodeLanAccess":   {"setExitNodeLANAllowed", ConfigApplyHot},
+	"sourcePolicy":        {"setSourcePolicy", ConfigApplyHot},
+	"standby":             {"setStandbyServer", ConfigApplyHot},
+	"orgId":               {"updateTunnelConfig", ConfigApplyReconnect},
+	"mtu":                 {"updateTunnelConfig", ConfigApplyReconnect},
+}
+
+// configDiffIgnored are fields that are not settings of the tunnel
+var configDiffIgnored = map[string]bool{
+	"resumeState": true,
+}
+
+// ConfigChange is one differing field in diffTunnelConfig. Values are left
+// out since some fields are secrets.
+type ConfigChange struct {
+	Field string `json:"field"`
+	Apply string `json:"apply"`
+	// ApplyWith is the export that applies the change at runtime
+	ApplyWith string `json:"applyWith,omitempty"`
+}
+
+// ConfigDiff is the JSON returned by diffTunnelConfig
+type ConfigDiff struct {
+	Running bool           `json:"running"`
+	Changes []ConfigChange `json:"changes"`
+	// Disconnects is whether applying the changes to the running tunnel
+	// interrupts traffic
+	Disconnects     bool `json:"disconnects"`
+	RequiresRestart bool `json:"requiresRestart"`
+}
+
+// configValuesEqual compares two field values, treating nil and empty
+// slices and maps alike
+func configValuesEqual(a, b reflect.Value) bool {
+	switch a.Kind() {
+	case reflect.Slice, reflect.Map:
+		if a.Len() == 0 && b.Len() == 0 {
+			return true
+		}
+	}
+	return reflect.DeepEqual(a.Interface(), b.Interface())
+}
+
+// diffConfigs lists the fields of proposed that differ from active, in
+// declaration order
+func diffConfigs(active, proposed StartTunnelConfig) []ConfigChange {
+	changes := []ConfigChange{}
+	activeValue, proposedValue := reflect.ValueOf(active), reflect.ValueOf(proposed)
+	fields := activeValue.Type()
+	for i := range fields.NumField() {
+		name, _, _ := strings.Cut(fields.Field(i).Tag.Get("json"), ",")
+		if name == "" || configDiffIgnored[name] {
+			continue
+		}
+		if configValuesEqual(activeValue.Field(i), proposedValue.Field(i)) {
+			continue
+		}
+		change := ConfigChange{Field: name, Apply: ConfigApplyRestart}
+		if applier, ok := configAppliers[name]; ok {
+			change.Apply, change.ApplyWith = applier.apply, applier.export
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// parseProposedConfig decodes a startTunnel config the way startTunnel
+// would, with the managed configuration applied
+func parseProposedConfig(configStr string) (StartTunnelConfig, error) {
+	var proposed StartTunnelConfig
+	data, _, err := applyManagedConfig([]byte(configStr))
+	if err != nil {
+		return proposed, err
+	}
+	err = decodeCompatJSON(data, &proposed, "tunnel config")
+	return proposed, err
+}
+
+// diffTunnelConfig compares a proposed startTunnel config, under the managed
+// configuration, with the one the tunnel runs with, including changes made
+// at runtime, and says how each
+// differing field would take effect. The app can tell from it whether
+// saving would interrupt the tunnel.
+//
+//export diffTunnelConfig
+func diffTunnelConfig(proposedJSON *C.char) *C.char {
+	proposed, err := parseProposedConfig(C.GoString(proposedJSON))
+	if err != nil {
+		appLogger.Error("Failed to parse proposed tunnel config: %v", err)
+		return exportString(fmt.Sprintf("Error: Failed to parse config JSON: %v", err))
+	}
+
+	tunnelMutex.Lock()
+	running := tunnelRunning
+	active := activeTunnelConfig
+	tunnelMutex.Unlock()
+
+	diff := ConfigDiff{Running: running, Changes: diffConfigs(active, proposed)}
+	if running {
+		for _, change := range diff.Changes {
+			switch change.Apply {
+			case ConfigApplyRestart:
+				diff.RequiresRestart = true
+				diff.Disconnects = true
+			case ConfigApplyReconnect:
+				diff.Disconnects = true
+			}
+		}
+	}
+
+	data, err := json.Marshal(diff)
+	if err != nil {
+		appLogger.Error("Failed to marshal config diff: %v", err)
+		return exportString(fmt.Sprintf("Error: Failed to marshal config diff: %v", err))
+	}
+	return exportString(string(data))
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestDiffConfigs(t *testing.T) {
+	base := StartTunnelConfig{Endpoint: "https://pangolin.example", ID: "client", Secret: "secret", MTU: 1280, OrgID: "org"}
+
+	tests := []struct {
+		name   string
+		change func(*StartTunnelConfig)
+		want   []ConfigChange
+	}{
+		{name: "unchanged", change: func(*StartTunnelConfig) {}, want: []ConfigChange{}},
+		{name: "nil and empty slices are equal", change: func(c *StartTunnelConfig) { c.UpstreamDNS = []string{} }, want: []ConfigChange{}},
+		{name: "resume state ignored", change: func(c *StartTunnelConfig) { c.ResumeState = json.RawMessage(`{}`) }, want: []ConfigChange{}},
+		{name: "hot", change: func(c *StartTunnelConfig) { c.UpstreamDNS = []string{"1.1.1.1:53"} }, want: []ConfigChange{
+			{Field: "upstreamDNS", Apply: ConfigApplyHot, ApplyWith: "setUpstreamDNS"},
+		}},
+		{name: "reconnect", change: func(c *StartTunnelConfig) { c.OrgID = "other" }, want: []ConfigChange{
+			{Field: "orgId", Apply: ConfigApplyReconnect, ApplyWith: "updateTunnelConfig"},
+		}},
+		{name: "restart", change: func(c *StartTunnelConfig) { c.Secret = "rotated" }, want: []ConfigChange{
+			{Field: "secret", Apply: ConfigApplyRestart},
+		}},
+		{name: "declaration order", change: func(c *StartTunnelConfig) {
+			c.OrgID = "other"
+			c.Endpoint = "https://other.example"
+			c.MTU = 1400
+		}, want: []ConfigChange{
+			{Field: "endpoint", Apply: ConfigApplyRestart},
+			{Field: "mtu", Apply: ConfigApplyReconnect, ApplyWith: "updateTunnelConfig"},
+			{Field: "orgId", Apply: ConfigApplyReconnect, ApplyWith: "updateTunnelConfig"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proposed := base
+			tt.change(&proposed)
+			if got := diffConfigs(base, proposed); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("diffConfigs = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import "C"
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// ConfigUpdateFailure is a field updateTunnelConfig could not apply
+type ConfigUpdateFailure struct {
+	Field string `json:"field"`
+	Error string `json:"error"`
+}
+
+// ConfigUpdate is the JSON returned by updateTunnelConfig
+type ConfigUpdate struct {
+	Applied []ConfigChange        `json:"applied"`
+	Failed  []ConfigUpdateFailure `json:"failed"`
+	// NeedsRestart are fields only a new startTunnel picks up. They are left
+	// as they are; the app decides whether the change is worth a
+	// disconnect.
+	NeedsRestart []ConfigChange `json:"needsRestart"`
+	// Reconnected is whether olm's tunnel was restarted under the
+	// interface, for a new MTU or organization
+	Reconnected bool `json:"reconnected"`
+}
+
+// configHotAppliers apply a proposed config through what the export
+// configAppliers names does, keyed by that export
+var configHotAppliers = map[string]func(StartTunnelConfig) error{
+	"setUpstreamDNS": func(c StartTunnelConfig) error { return setUpstreamOverride(c.UpstreamDNS) },
+	"setPingParameters": func(c StartTunnelConfig) error {
+		_, _, err := updatePingParameters(c.PingIntervalSeconds, c.PingTimeoutSeconds)
+		return err
+	},
+	"setFeatureFlags":    func(c StartTunnelConfig) error { return updateFeatureFlags(c.FeatureFlags) },
+	"setFirewallRules":   func(c StartTunnelConfig) error { return updateFirewallRules(c.Firewall) },
+	"setInboundExposure": func(c StartTunnelConfig) error { return updateInboundExposure(c.InboundExposure) },
+	"setBandwidthLimits": func(c StartTunnelConfig) error { return updateBandwidthLimits(c.BandwidthLimit) },
+	"setDSCP":            func(c StartTunnelConfig) error { return updateDSCP(c.DSCP) },
+	"setRoutesVia":       func(c StartTunnelConfig) error { return updateRoutesVia(c.RouteVia) },
+	"setRoutesByDomain":  func(c StartTunnelConfig) error { return updateRoutesByDomain(c.DomainRoutes) },
+	"setDNSRoutes":       func(c StartTunnelConfig) error { return updateDNSRoutes(c.DNSRoutes) },
+	"setRouteMTUs":       func(c StartTunnelConfig) error { return updateRouteMTUs(c.RouteMTUs) },
+	"setExitNodeLANAllowed": func(c StartTunnelConfig) error {
+		updateExitNodeLANAllowed(c.ExitNodeLANAccess)
+		return nil
+	},
+	"setSourcePolicy": func(c StartTunnelConfig) error { return updateSourcePolicy(c.SourcePolicy) },
+	"setStandbyServer": func(c StartTunnelConfig) error {
+		_, err := updateStandbyServer(c.Standby)
+		return err
+	},
+}
+
+// reconnectWithConfig restarts olm's tunnel once for every reconnect field
+// that changed: the MTU and the organization
+func reconnectWithConfig(proposed StartTunnelConfig, changes []ConfigChange) error {
+	var fields []string
+	for _, change := range changes {
+		fields = append(fields, change.Field)
+	}
+	if err := checkManagedLock(fields...); err != nil {
+		return err
+	}
+	if proposed.MTU < 0 {
+		return fmt.Errorf("MTU must not be negative")
+	}
+
+	tunnelMutex.Lock()
+	defer tunnelMutex.Unlock()
+
+	previous := olmTunnelConfig
+	if proposed.OrgID == "" && previous.OrgID != "" {
+		return fmt.Errorf("organization ID is required")
+	}
+	olmTunnelConfig.MTU, olmTunnelConfig.OrgID = proposed.MTU, proposed.OrgID
+	if err := restartOlmTunnel(fmt.Sprintf("applying config changes to %s", strings.Join(fields, ", "))); err != nil {
+		olmTunnelConfig = previous
+		return err
+	}
+	activeTunnelConfig.MTU, activeTunnelConfig.OrgID = proposed.MTU, proposed.OrgID
+	if proposed.OrgID != previous.OrgID {
+		setSnapshotState(SnapshotStateConnecting, activeTunnelConfig.Endpoint, proposed.OrgID)
+	}
+	bumpSettingsVersion()
+	return nil
+}
+
+// updateTunnelConfig applies a new startTunnel config, under the managed
+// configuration, to the running tunnel. Fields diffTunnelConfig reports as
+// hot go through their exports without interrupting traffic; a new MTU or
+// organization restarts olm's tunnel under the interface once; fields that
+// need a restart are reported and left alone. Returns a ConfigUpdate.
+//
+//export updateTunnelConfig
+func updateTunnelConfig(configJSON *C.char) *C.char {
+	proposed, err := parseProposedConfig(C.GoString(configJSON))
+	if err != nil {
+		appLogger.Error("Failed to parse updated tunnel config: %v", err)
+		return exportString(fmt.Sprintf("Error: Failed to parse config JSON: %v", err))
+	}
+
+	tunnelMutex.Lock()
+	running := tunnelRunning
+	active := activeTunnelConfig
+	tunnelMutex.Unlock()
+
+	if !running {
+		appLogger.Warn("Tunnel is not running")
+		return exportString("Error: Tunnel not running")
+	}
+
+	update := ConfigUpdate{Applied: []ConfigChange{}, Failed: []ConfigUpdateFailure{}, NeedsRestart: []ConfigChange{}}
+	results := map[string]error{}
+	var reconnect []ConfigChange
+	for _, change := range diffConfigs(active, proposed) {
+		switch change.Apply {
+		case ConfigApplyRestart:
+			update.NeedsRestart = append(update.NeedsRestart, change)
+			continue
+		case ConfigApplyReconnect:
+			reconnect = append(reconnect, change)
+			continue
+		}
+
+		// Fields that share an export are applied by one call
+		err, done := results[change.ApplyWith]
+		if !done {
+			err = configHotAppliers[change.ApplyWith](proposed)
+			results[change.ApplyWith] = err
+		}
+		if err != nil {
+			appLogger.Error("Failed to apply %s: %v", change.Field, err)
+			update.Failed = append(update.Failed, ConfigUpdateFailure{Field: change.Field, Error: err.Error()})
+		} else {
+			update.Applied = append(update.Applied, change)
+		}
+	}
+
+	if len(reconnect) > 0 {
+		if err := reconnectWithConfig(proposed, reconnect); err != nil {
+			appLogger.Error("Failed to apply config changes: %v", err)
+			for _, change := range reconnect {
+				update.Failed = append(update.Failed, ConfigUpdateFailure{Field: change.Field, Error: err.Error()})
+			}
+		} else {
+			update.Applied = append(update.Applied, reconnect...)
+			update.Reconnected = true
+		}
+	}
+
+	appLogger.Info("Config update: %d applied, %d failed, %d need a restart", len(update.Applied), len(update.Failed), len(update.NeedsRestart))
+	recordEvent(EventState, "config updated: %d applied, %d failed, %d need a restart", len(update.Applied), len(update.Failed), len(update.NeedsRestart))
+
+	data, err := json.Marshal(update)
+	if err != nil {
+		appLogger.Error("Failed to marshal config update: %v", err)
+		return exportString(fmt.Sprintf("Error: Failed to marshal config update: %v", err))
+	}
+	return exportString(string(data))
+}
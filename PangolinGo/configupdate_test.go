@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestHotApplierSettlesDSCP(t *testing.T) {
+	tunnelMutex.Lock()
+	saved := activeTunnelConfig
+	dscp := 46
+	activeTunnelConfig = StartTunnelConfig{DSCP: &dscp}
+	tunnelMutex.Unlock()
+	t.Cleanup(func() {
+		_ = setDSCPValue(-1)
+		tunnelMutex.Lock()
+		activeTunnelConfig = saved
+		tunnelMutex.Unlock()
+	})
+
+	// A config without a codepoint turns marking off, as it does at
+	// startTunnel, and the next diff has nothing left to apply
+	proposed := StartTunnelConfig{}
+	if err := configHotAppliers["setDSCP"](proposed); err != nil {
+		t.Fatalf("setDSCP: %v", err)
+	}
+	dscpMutex.Lock()
+	value := dscpValue
+	dscpMutex.Unlock()
+	if value != -1 {
+		t.Errorf("DSCP = %d, want -1", value)
+	}
+	tunnelMutex.Lock()
+	active := activeTunnelConfig
+	tunnelMutex.Unlock()
+	if changes := diffConfigs(active, proposed); len(changes) != 0 {
+		t.Errorf("changes after applying = %+v, want none", changes)
+	}
+
+	bad := 64
+	if err := configHotAppliers["setDSCP"](StartTunnelConfig{DSCP: &bad}); err == nil {
+		t.Error("out of range DSCP applied")
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import "C"
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+const (
+	connectionHistoryFile = "connection-history.json"
+	// connectionHistoryLimit keeps a few weeks of typical use
+	connectionHistoryLimit = 500
+)
+
+// ConnectionRecord is one period the tunnel was connected
+type ConnectionRecord struct {
+	ConnectedAt time.Time `json:"connectedAt"`
+	// DisconnectedAt is unset while the connection is up
+	DisconnectedAt  *time.Time `json:"disconnectedAt,omitempty"`
+	Reason          string     `json:"reason,omitempty"`
+	DurationSeconds int64      `json:"durationSeconds"`
+	RxBytes         uint64     `json:"rxBytes"`
+	TxBytes         uint64     `json:"txBytes"`
+	Endpoint        string     `json:"endpoint,omitempty"`
+	OrgID           string     `json:"orgId,omitempty"`
+	// LastSeenAt is when the open record was last saved, so one cut short by
+	// the extension exiting can be closed at the right time on the next load
+	LastSeenAt *time.Time `json:"lastSeenAt,omitempty"`
+}
+
+var (
+	historyMutex      sync.Mutex
+	connectionHistory []ConnectionRecord
+	// connectionOpen is set while the last record is the current connection
+	connectionOpen bool
+	historySavedAt time.Time
+	// pendingDisconnectReason explains the next disconnect, when the bridge
+	// caused it
+	pendingDisconnectReason string
+)
+
+// loadConnectionHistory restores the history, closing a record the previous
+// process left open
+func loadConnectionHistory() {
+	data, err := readStateFile(connectionHistoryFile)
+	if err != nil || data == nil {
+		return
+	}
+
+	var saved []ConnectionRecord
+	if err := json.Unmarshal(data, &saved); err != nil {
+		appLogger.Debug("Ignoring unreadable connection history: %v", err)
+		return
+	}
+
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+	for i := range saved {
+		if record := &saved[i]; record.DisconnectedAt == nil {
+			end := record.ConnectedAt
+			if record.LastSeenAt != nil {
+				end = *record.LastSeenAt
+			}
+			closeConnectionRecord(record, end, "extension exited")
+		}
+	}
+	connectionHistory = saved
+}
+
+func closeConnectionRecord(record *ConnectionRecord, at time.Time, reason string) {
+	at = at.UTC()
+	record.DisconnectedAt = &at
+	record.Reason = reason
+	record.DurationSeconds = int64(at.Sub(record.ConnectedAt).Seconds())
+	record.LastSeenAt = nil
+}
+
+func saveConnectionHistoryLocked() {
+	data, err := json.Marshal(connectionHistory)
+	if err != nil {
+		appLogger.Error("Failed to marshal connection history: %v", err)
+		return
+	}
+	if err := writeStateFile(connectionHistoryFile, data); err != nil {
+		appLogger.Debug("Failed to write connection history: %v", err)
+		return
+	}
+	historySavedAt = time.Now()
+}
+
+// noteDisconnectReason records why the bridge is about to drop the
+// connection, for the record it ends
+func noteDisconnectReason(reason string) {
+	historyMutex.Lock()
+	pendingDisconnectReason = reason
+	historyMutex.Unlock()
+}
+
+// disconnectReason describes a move out of the connected state
+func disconnectReason(state string) string {
+	switch state {
+	case SnapshotStateConnecting:
+		return "connection lost"
+	case SnapshotStateTerminated:
+		return "terminated by server"
+	case SnapshotStateSuperseded:
+		return "superseded by another session"
+	case SnapshotStateIncompatible:
+		return "incompatible server version"
+	}
+	return "disconnected"
+}
+
+// noteConnectionState opens a record when the tunnel connects and closes it
+// when it leaves the connected state
+func noteConnectionState(from, to, endpoint, orgID string) {
+	if from == to || (from != SnapshotStateConnected && to != SnapshotStateConnected) {
+		return
+	}
+	if to == SnapshotStateConnected {
+		noteTunnelEstablished()
+		warmRecentNames("connect")
+	}
+
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+
+	now := time.Now().UTC()
+	if from == SnapshotStateConnected && connectionOpen {
+		reason := pendingDisconnectReason
+		if reason == "" {
+			reason = disconnectReason(to)
+		}
+		closeConnectionRecord(&connectionHistory[len(connectionHistory)-1], now, reason)
+		connectionOpen = false
+	}
+	pendingDisconnectReason = ""
+
+	if to == SnapshotStateConnected {
+		connectionHistory = append(connectionHistory, ConnectionRecord{
+			ConnectedAt: now,
+			Endpoint:    endpoint,
+			OrgID:       orgID,
+			LastSeenAt:  &now,
+		})
+		if len(connectionHistory) > connectionHistoryLimit {
+			connectionHistory = append([]ConnectionRecord(nil), connectionHistory[len(connectionHistory)-connectionHistoryLimit:]...)
+		}
+		connectionOpen = true
+	}
+	saveConnectionHistoryLocked()
+}
+
+// noteConnectionTraffic adds traffic to the open record. It is saved at
+// the status snapshot's pace, so a crash loses about a minute.
+func noteConnectionTraffic(rx, tx uint64) {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+	if !connectionOpen {
+		return
+	}
+	now := time.Now().UTC()
+	record := &connectionHistory[len(connectionHistory)-1]
+	record.RxBytes += rx
+	record.TxBytes += tx
+	record.LastSeenAt = &now
+	record.DurationSeconds = int64(now.Sub(record.ConnectedAt).Seconds())
+	if time.Since(historySavedAt) >= statusSnapshotMinWrite {
+		saveConnectionHistoryLocked()
+	}
+}
+
+// getConnectionHistory returns the connection history as a JSON array,
+// oldest first. The current connection, if any, is last and has no
+// disconnectedAt.
+//
+//export getConnectionHistory
+func getConnectionHistory() *C.char {
+	historyMutex.Lock()
+	records := append([]ConnectionRecord{}, connectionHistory...)
+	historyMutex.Unlock()
+
+	data, err := json.Marshal(records)
+	if err != nil {
+		appLogger.Error("Failed to marshal connection history: %v", err)
+		return exportString("[]")
+	}
+	return exportString(string(data))
+}
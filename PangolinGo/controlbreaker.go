@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// breakerFailureThreshold consecutive failures open the circuit
+	breakerFailureThreshold = 5
+	// breakerBaseCooldown is how long the first trip keeps requests off the
+	// server; each trip that fails its probe doubles it
+	breakerBaseCooldown = 30 * time.Second
+	breakerMaxCooldown  = 10 * time.Minute
+
+	// Every success earns retryBudgetRatio of a retry, up to retryBudgetMax,
+	// so retries stay a small share of the requests even when every request
+	// fails
+	retryBudgetMax   = 10.0
+	retryBudgetRatio = 0.1
+	retryMaxAttempts = 2
+	retryBaseDelay   = 500 * time.Millisecond
+	retryMaxDelay    = 8 * time.Second
+)
+
+// Circuit breaker states reported in server health
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "halfOpen"
+)
+
+// errCircuitOpen is returned without touching the network while the server
+// is being left alone
+var errCircuitOpen = errors.New("control plane circuit open")
+
+// CircuitBreakerStatus is the breaker's state as shown in getServerHealth
+type CircuitBreakerStatus struct {
+	State               string    `json:"state"`
+	ConsecutiveFailures int       `json:"consecutiveFailures"`
+	OpenUntil           time.Time `json:"openUntil,omitempty"`
+	// Trips counts how often the circuit opened since the extension started
+	Trips       uint64  `json:"trips"`
+	RetryBudget float64 `json:"retryBudget"`
+	LastError   string  `json:"lastError,omitempty"`
+}
+
+// The breaker is shared by the bridge's own HTTPS requests and olm's
+// websocket dials, all of which go to the control plane. olm's token
+// request uses a client of its own and bypasses it.
+var (
+	breakerMutex    sync.Mutex
+	breakerStatus   = CircuitBreakerStatus{State: CircuitClosed, RetryBudget: retryBudgetMax}
+	breakerCooldown = breakerBaseCooldown
+	// breakerProbing is set while the one request allowed in half-open is
+	// in flight
+	breakerProbing bool
+)
+
+// backoffJitter spreads a delay over [d/2, d] so clients that failed
+// together do not come back together
+func backoffJitter(d time.Duration) time.Duration {
+	return d/2 + rand.N(d/2+1)
+}
+
+// breakerAllow reports whether a request may go out now. After the cooldown
+// a single request probes the server while the others keep failing fast.
+func breakerAllow() error {
+	breakerMutex.Lock()
+	defer breakerMutex.Unlock()
+	switch breakerStatus.State {
+	case CircuitOpen:
+		if time.Now().Before(breakerStatus.OpenUntil) {
+			return fmt.Errorf("%w until %s", errCircuitOpen, breakerStatus.OpenUntil.Format(time.RFC3339))
+		}
+		breakerStatus.State = CircuitHalfOpen
+		breakerProbing = true
+		return nil
+	case CircuitHalfOpen:
+		if breakerProbing {
+			return fmt.Errorf("%w while probing", errCircuitOpen)
+		}
+		breakerProbing = true
+	}
+	return nil
+}
+
+// breakerRecord feeds a request's outcome into the breaker and the retry
+// budget
+func breakerRecord(err error) {
+	breakerMutex.Lock()
+	defer breakerMutex.Unlock()
+	breakerProbing = false
+
+	if err == nil {
+		if breakerStatus.State != CircuitClosed {
+			appLogger.Info("Control plane answers again, closing circuit")
+			recordEvent(EventState, "control plane circuit closed")
+		}
+		breakerStatus.State = CircuitClosed
+		breakerStatus.ConsecutiveFailures = 0
+		breakerStatus.OpenUntil = time.Time{}
+		breakerStatus.RetryBudget = min(retryBudgetMax, breakerStatus.RetryBudget+retryBudgetRatio)
+		breakerCooldown = breakerBaseCooldown
+		return
+	}
+
+	breakerStatus.ConsecutiveFailures++
+	breakerStatus.LastError = err.Error()
+	switch breakerStatus.State {
+	case CircuitOpen:
+		return
+	case CircuitClosed:
+		if breakerStatus.ConsecutiveFailures < breakerFailureThreshold {
+			return
+		}
+	case CircuitHalfOpen:
+		breakerCooldown = min(breakerCooldown*2, breakerMaxCooldown)
+	}
+	breakerStatus.State = CircuitOpen
+	breakerStatus.OpenUntil = time.Now().Add(backoffJitter(breakerCooldown))
+	breakerStatus.Trips++
+	appLogger.Warn("Control plane failing (%v), leaving it alone until %s", err, breakerStatus.OpenUntil.Format(time.RFC3339))
+	recordEvent(EventState, "control plane circuit open")
+}
+
+// breakerAbandon releases a probe the caller gave up on, which says nothing
+// about the server
+func breakerAbandon() {
+	breakerMutex.Lock()
+	breakerProbing = false
+	breakerMutex.Unlock()
+}
+
+// withdrawRetry spends one retry from the shared budget
+func withdrawRetry() bool {
+	breakerMutex.Lock()
+	defer breakerMutex.Unlock()
+	if breakerStatus.RetryBudget < 1 {
+		return false
+	}
+	breakerStatus.RetryBudget--
+	return true
+}
+
+// circuitBreakerStatus returns a copy of the breaker's state
+func circuitBreakerStatus() CircuitBreakerStatus {
+	breakerMutex.Lock()
+	defer breakerMutex.Unlock()
+	return breakerStatus
+}
+
+// responseFailure turns a response the server could not handle into an
+// error; other statuses mean the server is up
+func responseFailure(resp *http.Response) error {
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= http.StatusInternalServerError:
+		return fmt.Errorf("server returned %s", resp.Status)
+	}
+	return nil
+}
+
+// retryDelay is the jittered backoff for an attempt, or what the server asked
+// for in Retry-After when that is longer
+func retryDelay(attempt int, resp *http.Response) time.Duration {
+	delay := backoffJitter(min(retryBaseDelay<<attempt, retryMaxDelay))
+	if resp != nil {
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			delay = max(delay, min(time.Duration(seconds)*time.Second, retryMaxDelay))
+		}
+	}
+	return delay
+}
+
+// breakerRoundTrip sends a request through the breaker, retrying failures
+// while the budget lasts. Only requests whose body can be sent again are
+// retried.
+func breakerRoundTrip(base http.RoundTripper, req *http.Request) (*http.Response, error) {
+	replayable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+	for attempt := 0; ; attempt++ {
+		if err := breakerAllow(); err != nil {
+			return nil, err
+		}
+		resp, err := base.RoundTrip(req)
+		failure := err
+		if err == nil {
+			failure = responseFailure(resp)
+		}
+		if errors.Is(err, context.Canceled) {
+			breakerAbandon()
+			return nil, err
+		}
+		breakerRecord(failure)
+
+		if failure == nil || !replayable || attempt >= retryMaxAttempts || !withdrawRetry() {
+			return resp, err
+		}
+		delay := retryDelay(attempt, resp)
+		if resp != nil {
+			resp.Body.Close()
+		}
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+		appLogger.Debug("Retrying %s %s in %v: %v", req.Method, req.URL.Host, delay, failure)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// breakerDialContext wraps the websocket dialer so olm's reconnect loop
+// fails fast instead of reaching the server while the circuit is open
+func breakerDialContext(dial func(ctx context.Context, network, address string) (net.Conn, error)) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		if err := breakerAllow(); err != nil {
+			return nil, err
+		}
+		conn, err := dial(ctx, network, address)
+		if errors.Is(err, context.Canceled) {
+			breakerAbandon()
+			return nil, err
+		}
+		breakerRecord(err)
+		return conn, err
+	}
+}
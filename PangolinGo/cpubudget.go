@@ -0,0 +1,184 @@
+package main
+
+/*
+#include <time.h>
+
+// pangolin_thread_cpu_ns returns the CPU time the calling thread has used
+static inline long long pangolin_thread_cpu_ns(void) {
+	struct timespec ts;
+	if (clock_gettime(CLOCK_THREAD_CPUTIME_ID, &ts) != 0) {
+		return -1;
+	}
+	return (long long)ts.tv_sec * 1000000000LL + ts.tv_nsec;
+}
+*/
+import "C"
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Auxiliary jobs share a CPU budget, so bookkeeping cannot compete with
+// packet forwarding on devices with few cores. The budget is a token bucket
+// refilled at the budgeted share of one core. A job that finds it empty is
+// put off until it refills, but never for longer than cpuMaxDeferral, so
+// nothing starves. Only the job's own goroutine is measured; logging and
+// olm's own work run on their callers' goroutines and are not covered.
+
+const (
+	// defaultCPUBudgetPercent is the share of one core auxiliary jobs get
+	defaultCPUBudgetPercent = 5
+	// cpuBudgetBurst is how much unused budget can be saved up, as time at
+	// the budgeted rate
+	cpuBudgetBurst = time.Second
+	// cpuMaxDeferral is the longest a job is put off for the budget
+	cpuMaxDeferral = 30 * time.Second
+)
+
+// auxiliaryJobs are the scheduler jobs that count against the budget: stats,
+// probes and cache upkeep. Jobs that keep the data path working are not
+// held back.
+var auxiliaryJobs = map[string]bool{
+	statusSnapshotJob: true,
+	serverHealthJob:   true,
+	dnsLeakJob:        true,
+	bandwidthJob:      true,
+	standbyJob:        true,
+	offlinePeersJob:   true,
+	selfTestJob:       true,
+}
+
+// CPUBudgetStats is the JSON returned by getCPUBudgetStats. The counters
+// cover the extension's lifetime.
+type CPUBudgetStats struct {
+	// BudgetPercent is the share of one core; zero means no budget
+	BudgetPercent int `json:"budgetPercent"`
+	// AvailableMs is the CPU time auxiliary jobs may use right now, negative
+	// while they are paying off an overrun
+	AvailableMs float64 `json:"availableMs"`
+	UsedMs      float64 `json:"usedMs"`
+	Runs        uint64  `json:"runs"`
+	// Deferrals counts runs put off for the budget and ForcedRuns those that
+	// ran anyway after cpuMaxDeferral
+	Deferrals  uint64 `json:"deferrals"`
+	ForcedRuns uint64 `json:"forcedRuns"`
+}
+
+var (
+	cpuBudgetMutex    sync.Mutex
+	cpuBudgetPercent  = defaultCPUBudgetPercent
+	cpuBudgetTokens   = cpuBudgetBurstTokens(defaultCPUBudgetPercent)
+	cpuBudgetRefilled = time.Now()
+	cpuBudgetStats    CPUBudgetStats
+)
+
+// cpuBudgetBurstTokens is the most CPU time the bucket holds
+func cpuBudgetBurstTokens(percent int) time.Duration {
+	return cpuBudgetBurst * time.Duration(percent) / 100
+}
+
+// refillCPUBudgetLocked adds the budget earned since the last refill. Caller
+// must hold cpuBudgetMutex.
+func refillCPUBudgetLocked(now time.Time) {
+	earned := now.Sub(cpuBudgetRefilled) * time.Duration(cpuBudgetPercent) / 100
+	cpuBudgetTokens = min(cpuBudgetTokens+earned, cpuBudgetBurstTokens(cpuBudgetPercent))
+	cpuBudgetRefilled = now
+}
+
+// cpuBudgetDeferral reports how long a due job should be put off, or zero to
+// run it now. deferredSince is when the job was first put off, if it was.
+// Called by the scheduler with schedulerMutex held.
+func cpuBudgetDeferral(name string, now, deferredSince time.Time) time.Duration {
+	if !auxiliaryJobs[name] {
+		return 0
+	}
+	cpuBudgetMutex.Lock()
+	defer cpuBudgetMutex.Unlock()
+	if cpuBudgetPercent == 0 {
+		return 0
+	}
+	refillCPUBudgetLocked(now)
+	if cpuBudgetTokens > 0 {
+		return 0
+	}
+	if !deferredSince.IsZero() && now.Sub(deferredSince) >= cpuMaxDeferral {
+		cpuBudgetStats.ForcedRuns++
+		return 0
+	}
+	cpuBudgetStats.Deferrals++
+	// Until the bucket holds something again
+	wait := (-cpuBudgetTokens)*100/time.Duration(cpuBudgetPercent) + time.Millisecond
+	return min(wait, cpuMaxDeferral)
+}
+
+// threadCPUTime returns the CPU time of the current thread, or -1 when the
+// system cannot tell
+func threadCPUTime() time.Duration {
+	return time.Duration(C.pangolin_thread_cpu_ns())
+}
+
+// measureJobCPU runs fn pinned to one thread and charges the CPU time it used
+// to the budget when the job is auxiliary
+func measureJobCPU(name string, fn func()) {
+	if !auxiliaryJobs[name] {
+		fn()
+		return
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	start := threadCPUTime()
+	defer func() {
+		if start < 0 {
+			return
+		}
+		used := threadCPUTime() - start
+		cpuBudgetMutex.Lock()
+		refillCPUBudgetLocked(time.Now())
+		cpuBudgetTokens -= used
+		cpuBudgetStats.UsedMs += milliseconds(used)
+		cpuBudgetStats.Runs++
+		cpuBudgetMutex.Unlock()
+	}()
+	fn()
+}
+
+// setCPUBudget sets the share of one core, in percent, that auxiliary
+// bookkeeping may use; 0 removes the limit. The default is 5.
+//
+//export setCPUBudget
+func setCPUBudget(percent C.int) *C.char {
+	if percent < 0 || percent > 100 {
+		return exportString(fmt.Sprintf("Error: Invalid CPU budget %d%%", int(percent)))
+	}
+	cpuBudgetMutex.Lock()
+	refillCPUBudgetLocked(time.Now())
+	cpuBudgetPercent = int(percent)
+	cpuBudgetTokens = min(cpuBudgetTokens, cpuBudgetBurstTokens(cpuBudgetPercent))
+	cpuBudgetMutex.Unlock()
+
+	appLogger.Info("CPU budget for auxiliary work set to %d%%", int(percent))
+	return exportString("CPU budget set")
+}
+
+// getCPUBudgetStats returns the budget for auxiliary work and how it was
+// spent, as JSON
+//
+//export getCPUBudgetStats
+func getCPUBudgetStats() *C.char {
+	cpuBudgetMutex.Lock()
+	refillCPUBudgetLocked(time.Now())
+	stats := cpuBudgetStats
+	stats.BudgetPercent = cpuBudgetPercent
+	stats.AvailableMs = milliseconds(cpuBudgetTokens)
+	cpuBudgetMutex.Unlock()
+
+	data, err := json.Marshal(stats)
+	if err != nil {
+		appLogger.Error("Failed to marshal CPU budget stats: %v", err)
+		return exportString(fmt.Sprintf("Error: Failed to marshal CPU budget stats: %v", err))
+	}
+	return exportString(string(data))
+}
@@ -0,0 +1,117 @@
+package main
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+import (
+	"encoding/json"
+	"sync"
+	"unsafe"
+)
+
+// Ownership of the strings crossing the bridge:
+//
+//   - Every *C.char an export returns is malloc'd by exportString and owned
+//     by the caller, who must release it with freeCString exactly once.
+//     None is ever NULL.
+//   - *C.char arguments stay owned by the caller. Go copies them before
+//     returning and keeps no pointer to them.
+//   - The event string handed to an event callback is owned by Go and only
+//     valid during the call.
+
+// CStringStats is the JSON returned by getCStringStats
+type CStringStats struct {
+	Tracking bool `json:"tracking"`
+	// Allocated and Freed count the strings since tracking was turned on
+	Allocated int `json:"allocated"`
+	Freed     int `json:"freed"`
+	// Outstanding strings were returned and not freed yet; a number that
+	// keeps growing is a leak on the Swift side
+	Outstanding      int `json:"outstanding"`
+	OutstandingBytes int `json:"outstandingBytes"`
+	// UntrackedFrees were allocated before tracking was turned on
+	UntrackedFrees int `json:"untrackedFrees"`
+}
+
+var (
+	cStringMutex    sync.Mutex
+	cStringTracking bool
+	// cStringSizes holds every outstanding string while tracking
+	cStringSizes = map[unsafe.Pointer]int{}
+	cStringStats CStringStats
+)
+
+// exportString copies s to C memory for an export to return. The caller
+// owns it and releases it with freeCString.
+func exportString(s string) *C.char {
+	p := C.CString(s)
+	cStringMutex.Lock()
+	if cStringTracking {
+		cStringSizes[unsafe.Pointer(p)] = len(s) + 1
+		cStringStats.Allocated++
+	}
+	cStringMutex.Unlock()
+	return p
+}
+
+// freeCString releases a string returned by any export. NULL is ignored.
+//
+//export freeCString
+func freeCString(p *C.char) {
+	if p == nil {
+		return
+	}
+	cStringMutex.Lock()
+	if cStringTracking {
+		if _, ok := cStringSizes[unsafe.Pointer(p)]; ok {
+			delete(cStringSizes, unsafe.Pointer(p))
+			cStringStats.Freed++
+		} else {
+			cStringStats.UntrackedFrees++
+		}
+	}
+	cStringMutex.Unlock()
+	C.free(unsafe.Pointer(p))
+}
+
+// setCStringTracking turns counting of returned strings on or off. Turning
+// it on starts the counts afresh. It costs a map entry per string, so it is
+// meant for debug builds and leak hunting.
+//
+//export setCStringTracking
+func setCStringTracking(enabled C.int) *C.char {
+	cStringMutex.Lock()
+	cStringTracking = enabled != 0
+	cStringSizes = map[unsafe.Pointer]int{}
+	cStringStats = CStringStats{}
+	cStringMutex.Unlock()
+
+	if enabled != 0 {
+		appLogger.Info("Tracking returned C strings")
+		return exportString("C string tracking enabled")
+	}
+	return exportString("C string tracking disabled")
+}
+
+// getCStringStats returns the counts of returned strings as JSON. The
+// string it returns is itself counted once it is handed out.
+//
+//export getCStringStats
+func getCStringStats() *C.char {
+	cStringMutex.Lock()
+	stats := cStringStats
+	stats.Tracking = cStringTracking
+	stats.Outstanding = len(cStringSizes)
+	for _, size := range cStringSizes {
+		stats.OutstandingBytes += size
+	}
+	cStringMutex.Unlock()
+
+	data, err := json.Marshal(stats)
+	if err != nil {
+		appLogger.Error("Failed to marshal C string stats: %v", err)
+		return exportString("{}")
+	}
+	return exportString(string(data))
+}
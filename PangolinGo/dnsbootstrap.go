@@ -0,0 +1,293 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	bootstrapTimeout = 2 * time.Second
+	// bootstrapMinTTL keeps a resolved upstream at least this long, so a
+	// short TTL does not send every apply back to the bootstrap resolvers
+	bootstrapMinTTL = 5 * time.Minute
+	// bootstrapRetry is how long a name that did not resolve is left alone
+	bootstrapRetry = 30 * time.Second
+)
+
+// DNSBootstrap resolves upstream resolvers given by name. Once the system
+// resolver points at the tunnel, looking such a name up the usual way would
+// ask the resolver that is waiting for it, so the names are resolved here,
+// from the extension's own sockets.
+type DNSBootstrap struct {
+	// Servers are plain DNS resolvers by address. Without them the
+	// resolvers of the underlying network, as reported by setSystemDNS,
+	// are used.
+	Servers []string `json:"servers"`
+	// Hints are fixed addresses by upstream name, used without a lookup
+	Hints map[string][]string `json:"hints"`
+}
+
+type bootstrapEntry struct {
+	addrs   []netip.Addr
+	expires time.Time
+	err     error
+}
+
+var (
+	bootstrapMutex   sync.Mutex
+	bootstrapServers []string
+	bootstrapHints   map[string][]netip.Addr
+	bootstrapCache   = map[string]*bootstrapEntry{}
+	// bootstrapPending are the names being resolved in the background
+	bootstrapPending = map[string]bool{}
+)
+
+// setDNSBootstrap checks and applies a bootstrap configuration; nil removes
+// it
+func setDNSBootstrap(config *DNSBootstrap) error {
+	var servers []string
+	hints := map[string][]netip.Addr{}
+	if config != nil {
+		for _, server := range config.Servers {
+			normalized, err := normalizeDNSServer(server)
+			if err != nil {
+				return err
+			}
+			if _, err := netip.ParseAddrPort(normalized); err != nil {
+				return fmt.Errorf("bootstrap server %q must be an address", server)
+			}
+			servers = append(servers, normalized)
+		}
+		for name, values := range config.Hints {
+			if len(values) == 0 {
+				return fmt.Errorf("hint for %q has no addresses", name)
+			}
+			for _, value := range values {
+				addr, err := netip.ParseAddr(value)
+				if err != nil {
+					return fmt.Errorf("hint for %q: invalid address %q", name, value)
+				}
+				hints[dns.CanonicalName(name)] = append(hints[dns.CanonicalName(name)], addr)
+			}
+		}
+	}
+
+	bootstrapMutex.Lock()
+	bootstrapServers, bootstrapHints = servers, hints
+	bootstrapCache = map[string]*bootstrapEntry{}
+	bootstrapMutex.Unlock()
+	return nil
+}
+
+// upstreamHost splits an upstream into its name and port. ok is false for
+// upstreams given by address, which need no bootstrap.
+func upstreamHost(server string) (name, port string, ok bool) {
+	host, port, err := net.SplitHostPort(server)
+	if err != nil {
+		host, port = server, "53"
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return "", "", false
+	}
+	return dns.CanonicalName(host), port, true
+}
+
+// bootstrapResolvers returns the resolvers names are looked up with: the
+// configured ones, or else the underlying network's, never olm's own
+func bootstrapResolvers() []string {
+	bootstrapMutex.Lock()
+	servers := slices.Clone(bootstrapServers)
+	bootstrapMutex.Unlock()
+	if len(servers) > 0 {
+		return servers
+	}
+
+	proxy, _ := olmDNSProxyAddr()
+	dnsConfigMutex.Lock()
+	defer dnsConfigMutex.Unlock()
+	for _, server := range reportedSystemDNS {
+		if addrPort, err := netip.ParseAddrPort(server); err == nil && addrPort.Addr() != proxy {
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
+
+// bootstrapLookup resolves an upstream name through the bootstrap resolvers
+func bootstrapLookup(name string) ([]netip.Addr, time.Duration, error) {
+	resolvers := bootstrapResolvers()
+	if len(resolvers) == 0 {
+		return nil, 0, fmt.Errorf("no bootstrap resolver for %s", name)
+	}
+
+	client := upstreamDNSClient(bootstrapTimeout)
+	var lastErr error
+	for _, resolver := range resolvers {
+		var addrs []netip.Addr
+		ttl := bootstrapMinTTL
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			query := new(dns.Msg)
+			query.SetQuestion(name, qtype)
+			reply, _, err := client.Exchange(query, resolver)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			for _, rr := range reply.Answer {
+				var ip net.IP
+				switch rr := rr.(type) {
+				case *dns.A:
+					ip = rr.A
+				case *dns.AAAA:
+					ip = rr.AAAA
+				default:
+					continue
+				}
+				if addr, ok := netip.AddrFromSlice(ip); ok {
+					addrs = append(addrs, addr.Unmap())
+					ttl = max(ttl, time.Duration(rr.Header().Ttl)*time.Second)
+				}
+			}
+		}
+		if len(addrs) > 0 {
+			return addrs, ttl, nil
+		}
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("%s has no addresses", name)
+	}
+	return nil, 0, lastErr
+}
+
+// bootstrapName resolves one upstream name and caches the result
+func bootstrapName(name string) {
+	addrs, ttl, err := bootstrapLookup(name)
+	entry := &bootstrapEntry{addrs: addrs, expires: time.Now().Add(ttl), err: err}
+	noteTelemetryDNSQuery(err != nil)
+	if err != nil {
+		appLogger.Warn("Failed to bootstrap upstream DNS %s: %v", name, err)
+		publishEvent(BridgeEvent{Type: BridgeEventDNSFailure, Message: fmt.Sprintf("failed to resolve upstream DNS %s: %v", name, err)})
+		entry.expires = time.Now().Add(bootstrapRetry)
+	} else {
+		appLogger.Debug("Bootstrapped upstream DNS %s: %v", name, addrs)
+	}
+
+	bootstrapMutex.Lock()
+	bootstrapCache[name] = entry
+	delete(bootstrapPending, name)
+	bootstrapMutex.Unlock()
+}
+
+// resolveUpstreams replaces upstreams given by name with their addresses.
+// Names without a fresh answer are resolved in the background, after which
+// the upstreams are applied again; with wait set they are resolved first.
+// Names that cannot be resolved are left out. Site resolvers, and plain
+// addresses the sites' routes cover, are replaced by the address olm
+// reaches them through.
+func resolveUpstreams(servers []string, wait bool) []string {
+	sites := map[string]string{}
+	for _, server := range servers {
+		switch {
+		case isSiteResolver(server):
+			sites[server] = siteResolverUpstream(server)
+		case tunnelRoutedUpstream(server):
+			sites[server] = siteResolverUpstream(siteResolverScheme + server)
+		}
+	}
+
+	var resolved, missing []string
+	bootstrapMutex.Lock()
+	for _, server := range servers {
+		if upstream, ok := sites[server]; ok {
+			if upstream != "" {
+				resolved = append(resolved, upstream)
+			}
+			continue
+		}
+		server = strings.TrimPrefix(server, physicalUpstreamScheme)
+		name, port, ok := upstreamHost(server)
+		if !ok {
+			resolved = append(resolved, server)
+			continue
+		}
+		addrs := bootstrapHints[name]
+		if entry := bootstrapCache[name]; len(addrs) == 0 && entry != nil {
+			addrs = entry.addrs
+			if time.Now().After(entry.expires) && !bootstrapPending[name] {
+				missing = append(missing, name)
+			}
+		} else if len(addrs) == 0 && !bootstrapPending[name] {
+			missing = append(missing, name)
+		}
+		for _, addr := range addrs {
+			resolved = append(resolved, net.JoinHostPort(addr.String(), port))
+		}
+	}
+	for _, name := range missing {
+		bootstrapPending[name] = true
+	}
+	bootstrapMutex.Unlock()
+
+	if len(missing) == 0 {
+		return resolved
+	}
+	if wait {
+		var wg sync.WaitGroup
+		for _, name := range missing {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				superviseBootstrap(name)
+			}()
+		}
+		wg.Wait()
+		return resolveUpstreams(servers, false)
+	}
+	go func() {
+		defer dumpOnPanic()
+		for _, name := range missing {
+			superviseBootstrap(name)
+		}
+		applyUpstreamDNS()
+	}()
+	return resolved
+}
+
+// superviseBootstrap resolves a name in the DNS subsystem. A panic leaves
+// the name to be tried again rather than pending forever.
+func superviseBootstrap(name string) {
+	if !superviseSubsystem(SubsystemDNS, "upstream DNS bootstrap", func() { bootstrapName(name) }) {
+		bootstrapMutex.Lock()
+		delete(bootstrapPending, name)
+		bootstrapMutex.Unlock()
+	}
+}
+
+// bootstrappedUpstreams returns the addresses each upstream name resolved
+// to, for getDNSConfig
+func bootstrappedUpstreams() map[string][]string {
+	bootstrapMutex.Lock()
+	defer bootstrapMutex.Unlock()
+	out := map[string][]string{}
+	for name, addrs := range bootstrapHints {
+		for _, addr := range addrs {
+			out[name] = append(out[name], addr.String())
+		}
+	}
+	for name, entry := range bootstrapCache {
+		if _, hinted := out[name]; hinted || len(entry.addrs) == 0 {
+			continue
+		}
+		for _, addr := range entry.addrs {
+			out[name] = append(out[name], addr.String())
+		}
+	}
+	return out
+}
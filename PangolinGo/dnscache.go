@@ -0,0 +1,307 @@
+package main
+
+import "C"
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	olmdns "github.com/fosrl/olm/dns"
+	"github.com/miekg/dns"
+)
+
+// Answers from the upstreams are cached for as long as their TTLs allow,
+// so repeated lookups do not cross a slow tunnel or load a small internal
+// resolver again. The cache is a loopback forwarder in front of the others,
+// which olm's proxy forwards to; names olm answers itself never reach it.
+// Like the other forwarders it is left out while olm queries through the
+// tunnel itself.
+
+const (
+	// dnsCacheMaxEntries bounds the cache; expired entries go first, then
+	// those closest to expiring
+	dnsCacheMaxEntries = 4096
+	// dnsCacheMaxTTL caps how long any answer is kept
+	dnsCacheMaxTTL = time.Hour
+	// dnsCacheMaxNegativeTTL caps how long a missing name is remembered
+	dnsCacheMaxNegativeTTL = 5 * time.Minute
+)
+
+// DNSCacheStats is the cache part of getDNSConfig
+type DNSCacheStats struct {
+	Entries int    `json:"entries"`
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+}
+
+type dnsCacheEntry struct {
+	reply   *dns.Msg
+	stored  time.Time
+	expires time.Time
+}
+
+// cacheForwarder answers olm's queries from the cache and forwards the rest
+type cacheForwarder struct {
+	server  *loopbackDNS
+	addr    string
+	mutex   sync.Mutex
+	servers []string
+}
+
+var (
+	dnsCacheMutex   sync.Mutex
+	dnsCacheEntries = map[string]*dnsCacheEntry{}
+	dnsCacheStats   DNSCacheStats
+	dnsCache        *cacheForwarder
+	dnsCacheProxy   *olmdns.DNSProxy
+	// dnsCacheUpstreams are the upstreams the cached answers came from
+	dnsCacheUpstreams []string
+)
+
+// dnsCacheKey identifies a question. The DNSSEC bits are part of it since
+// they change the answer.
+func dnsCacheKey(query *dns.Msg) (string, bool) {
+	if len(query.Question) != 1 {
+		return "", false
+	}
+	q := query.Question[0]
+	do := false
+	if opt := query.IsEdns0(); opt != nil {
+		do = opt.Do()
+	}
+	return fmt.Sprintf("%s/%d/%d/%t/%t", strings.ToLower(q.Name), q.Qtype, q.Qclass, do, query.CheckingDisabled), true
+}
+
+// dnsCacheTTL is how long a reply may be kept: its lowest TTL, or for a
+// missing name or type the negative TTL of its SOA (RFC 2308). Zero means
+// it must not be cached.
+func dnsCacheTTL(reply *dns.Msg) time.Duration {
+	if reply.Truncated || (reply.Rcode != dns.RcodeSuccess && reply.Rcode != dns.RcodeNameError) {
+		return 0
+	}
+	if reply.Rcode == dns.RcodeNameError || len(reply.Answer) == 0 {
+		for _, rr := range reply.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				ttl := time.Duration(min(soa.Hdr.Ttl, soa.Minttl)) * time.Second
+				return min(ttl, dnsCacheMaxNegativeTTL)
+			}
+		}
+		return 0
+	}
+	lowest := dnsCacheMaxTTL
+	for _, section := range [][]dns.RR{reply.Answer, reply.Ns, reply.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			lowest = min(lowest, time.Duration(rr.Header().Ttl)*time.Second)
+		}
+	}
+	return lowest
+}
+
+// cachedReply returns a cached answer with its TTLs counted down by the
+// time it spent in the cache
+func cachedReply(query *dns.Msg) *dns.Msg {
+	key, ok := dnsCacheKey(query)
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	dnsCacheMutex.Lock()
+	defer dnsCacheMutex.Unlock()
+	entry := dnsCacheEntries[key]
+	if entry == nil || !now.Before(entry.expires) {
+		delete(dnsCacheEntries, key)
+		dnsCacheStats.Misses++
+		return nil
+	}
+	dnsCacheStats.Hits++
+
+	reply := entry.reply.Copy()
+	aged := uint32(now.Sub(entry.stored) / time.Second)
+	for _, section := range [][]dns.RR{reply.Answer, reply.Ns, reply.Extra} {
+		for _, rr := range section {
+			if header := rr.Header(); header.Rrtype != dns.TypeOPT {
+				header.Ttl -= min(aged, header.Ttl)
+			}
+		}
+	}
+	reply.Id = query.Id
+	return reply
+}
+
+// storeReply caches an upstream answer for as long as its TTLs allow
+func storeReply(query, reply *dns.Msg) {
+	key, ok := dnsCacheKey(query)
+	if !ok {
+		return
+	}
+	ttl := dnsCacheTTL(reply)
+	if ttl <= 0 {
+		return
+	}
+	now := time.Now()
+	dnsCacheMutex.Lock()
+	defer dnsCacheMutex.Unlock()
+	if _, ok := dnsCacheEntries[key]; !ok && len(dnsCacheEntries) >= dnsCacheMaxEntries {
+		evictDNSCacheLocked(now)
+	}
+	dnsCacheEntries[key] = &dnsCacheEntry{reply: reply.Copy(), stored: now, expires: now.Add(ttl)}
+}
+
+// evictDNSCacheLocked makes room for one entry. Caller must hold
+// dnsCacheMutex.
+func evictDNSCacheLocked(now time.Time) {
+	for key, entry := range dnsCacheEntries {
+		if !now.Before(entry.expires) {
+			delete(dnsCacheEntries, key)
+		}
+	}
+	if len(dnsCacheEntries) < dnsCacheMaxEntries {
+		return
+	}
+	var soonest string
+	for key, entry := range dnsCacheEntries {
+		if soonest == "" || entry.expires.Before(dnsCacheEntries[soonest].expires) {
+			soonest = key
+		}
+	}
+	delete(dnsCacheEntries, soonest)
+}
+
+// flushDNSCacheEntries empties the cache and returns how many answers it
+// held
+func flushDNSCacheEntries() int {
+	dnsCacheMutex.Lock()
+	defer dnsCacheMutex.Unlock()
+	flushed := len(dnsCacheEntries)
+	dnsCacheEntries = map[string]*dnsCacheEntry{}
+	return flushed
+}
+
+// currentDNSCacheStats returns the cache's size and hit counts
+func currentDNSCacheStats() DNSCacheStats {
+	dnsCacheMutex.Lock()
+	defer dnsCacheMutex.Unlock()
+	stats := dnsCacheStats
+	stats.Entries = len(dnsCacheEntries)
+	return stats
+}
+
+// forward answers from the cache, or asks the first two upstreams and
+// caches what they say
+func (f *cacheForwarder) forward(w dns.ResponseWriter, query *dns.Msg) {
+	if reply, ok := linkLocalReply(query); ok {
+		writeDNSReply(w, query, reply)
+		return
+	}
+	if reply := cachedReply(query); reply != nil {
+		recordDNSQuery(query, DNSQueryLogUpstreamCache, time.Now(), reply, nil)
+		writeDNSReply(w, query, reply)
+		return
+	}
+
+	f.mutex.Lock()
+	servers := f.servers
+	f.mutex.Unlock()
+	var reply *dns.Msg
+	for i, server := range servers {
+		if i == 2 {
+			break
+		}
+		var err error
+		if reply, err = exchange(query, server); err == nil {
+			break
+		}
+		appLogger.Debug("DNS cache forward to %s failed: %v", server, err)
+	}
+	if reply == nil {
+		reply = new(dns.Msg)
+		reply.SetRcode(query, dns.RcodeServerFailure)
+	} else {
+		storeReply(query, reply)
+	}
+	writeDNSReply(w, query, reply)
+}
+
+// startCacheForwarder listens on a free loopback port
+func startCacheForwarder() (*cacheForwarder, error) {
+	f := &cacheForwarder{}
+	server, err := startLoopbackDNS("DNS cache", f.forward)
+	if err != nil {
+		return nil, err
+	}
+	f.server, f.addr = server, server.addr
+	return f, nil
+}
+
+// applyDNSCache puts the cache in front of olm's upstreams and returns what
+// olm should use instead. Answers from other upstreams are flushed.
+func applyDNSCache(proxy *olmdns.DNSProxy, upstreams []string) []string {
+	dnsCacheMutex.Lock()
+	defer dnsCacheMutex.Unlock()
+	dnsCacheProxy = proxy
+	if len(upstreams) == 0 || siteResolverDirect.Load() {
+		return upstreams
+	}
+	// Reordering by latency keeps the answers
+	if sorted := slices.Sorted(slices.Values(upstreams)); !slices.Equal(sorted, dnsCacheUpstreams) {
+		dnsCacheEntries = map[string]*dnsCacheEntry{}
+		dnsCacheUpstreams = sorted
+	}
+	if dnsCache == nil {
+		f, err := startCacheForwarder()
+		if err != nil {
+			appLogger.Warn("Failed to start DNS cache, forwarding uncached: %v", err)
+			return upstreams
+		}
+		dnsCache = f
+		appLogger.Debug("Caching DNS answers on %s", f.addr)
+	}
+	dnsCache.mutex.Lock()
+	dnsCache.servers = slices.Clone(upstreams)
+	dnsCache.mutex.Unlock()
+	return []string{dnsCache.addr}
+}
+
+// syncDNSCache puts the cache back in front when olm starts a new proxy,
+// which begins with the real upstreams
+func syncDNSCache() {
+	proxy := (*olmdns.DNSProxy)(olmPointerField("dnsProxy", reflect.TypeOf((*olmdns.DNSProxy)(nil))))
+	dnsCacheMutex.Lock()
+	changed := proxy != nil && proxy != dnsCacheProxy
+	if changed {
+		// Noted here too, or a tunnel without upstreams would retry each tick
+		dnsCacheProxy = proxy
+	}
+	dnsCacheMutex.Unlock()
+	if changed {
+		applyUpstreamDNS()
+	}
+}
+
+// stopDNSCache shuts the cache down and empties it when the tunnel stops
+func stopDNSCache() {
+	dnsCacheMutex.Lock()
+	defer dnsCacheMutex.Unlock()
+	if dnsCache != nil {
+		dnsCache.server.shutdown()
+	}
+	dnsCache, dnsCacheProxy, dnsCacheUpstreams = nil, nil, nil
+	dnsCacheEntries = map[string]*dnsCacheEntry{}
+	dnsCacheStats = DNSCacheStats{}
+}
+
+// flushDNSCache drops every cached answer, e.g. after a record changed
+// behind a site, and returns how many there were
+//
+//export flushDNSCache
+func flushDNSCache() *C.char {
+	flushed := flushDNSCacheEntries()
+	appLogger.Info("Flushed %d cached DNS answer(s)", flushed)
+	return exportString(fmt.Sprintf("Flushed %d cached DNS answers", flushed))
+}
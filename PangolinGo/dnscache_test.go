@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func testDNSQuery(name string) *dns.Msg {
+	query := new(dns.Msg)
+	query.SetQuestion(name, dns.TypeA)
+	return query
+}
+
+func testDNSReply(query *dns.Msg, ttl uint32) *dns.Msg {
+	reply := new(dns.Msg)
+	reply.SetReply(query)
+	reply.Answer = append(reply.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: query.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+		A:   net.ParseIP("10.0.0.7"),
+	})
+	return reply
+}
+
+func TestDNSCacheTTL(t *testing.T) {
+	query := testDNSQuery("app.example.")
+
+	soa := func(ttl, minTTL uint32) dns.RR {
+		return &dns.SOA{Hdr: dns.RR_Header{Name: "example.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl}, Minttl: minTTL}
+	}
+	lowest := testDNSReply(query, 300)
+	lowest.Ns = append(lowest.Ns, &dns.NS{Hdr: dns.RR_Header{Name: "example.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60}, Ns: "ns.example."})
+	missing := new(dns.Msg)
+	missing.SetRcode(query, dns.RcodeNameError)
+	missing.Ns = append(missing.Ns, soa(3600, 30))
+	longMissing := new(dns.Msg)
+	longMissing.SetRcode(query, dns.RcodeNameError)
+	longMissing.Ns = append(longMissing.Ns, soa(86400, 86400))
+	noSOA := new(dns.Msg)
+	noSOA.SetRcode(query, dns.RcodeNameError)
+	failed := new(dns.Msg)
+	failed.SetRcode(query, dns.RcodeServerFailure)
+	truncated := testDNSReply(query, 300)
+	truncated.Truncated = true
+
+	tests := []struct {
+		name  string
+		reply *dns.Msg
+		want  time.Duration
+	}{
+		{name: "lowest ttl of any section", reply: lowest, want: time.Minute},
+		{name: "capped", reply: testDNSReply(query, 86400), want: dnsCacheMaxTTL},
+		{name: "negative from soa", reply: missing, want: 30 * time.Second},
+		{name: "negative capped", reply: longMissing, want: dnsCacheMaxNegativeTTL},
+		{name: "negative without soa", reply: noSOA, want: 0},
+		{name: "server failure", reply: failed, want: 0},
+		{name: "truncated", reply: truncated, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := dnsCacheTTL(tt.reply); got != tt.want {
+				t.Errorf("dnsCacheTTL = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDNSCacheStoreAndAge(t *testing.T) {
+	flushDNSCacheEntries()
+	t.Cleanup(func() { flushDNSCacheEntries() })
+
+	query := testDNSQuery("App.Example.")
+	storeReply(query, testDNSReply(query, 300))
+
+	// Names are matched without regard to case, and the reply takes the
+	// new query's ID
+	again := testDNSQuery("app.example.")
+	reply := cachedReply(again)
+	if reply == nil {
+		t.Fatal("stored answer not found")
+	}
+	if reply.Id != again.Id {
+		t.Errorf("reply ID = %d, want %d", reply.Id, again.Id)
+	}
+
+	key, _ := dnsCacheKey(again)
+	dnsCacheMutex.Lock()
+	dnsCacheEntries[key].stored = dnsCacheEntries[key].stored.Add(-100 * time.Second)
+	dnsCacheMutex.Unlock()
+	if reply := cachedReply(again); reply == nil || reply.Answer[0].Header().Ttl != 200 {
+		t.Errorf("aged answer = %v, want a TTL of 200", reply)
+	}
+
+	withDO := testDNSQuery("app.example.")
+	withDO.SetEdns0(1232, true)
+	if cachedReply(withDO) != nil {
+		t.Error("answer without DNSSEC records served to a query asking for them")
+	}
+
+	dnsCacheMutex.Lock()
+	dnsCacheEntries[key].expires = time.Now()
+	dnsCacheMutex.Unlock()
+	if cachedReply(again) != nil {
+		t.Error("expired answer served")
+	}
+	if stats := currentDNSCacheStats(); stats.Entries != 0 {
+		t.Errorf("expired answer still counted: %+v", stats)
+	}
+}
+
+func TestDNSCacheEviction(t *testing.T) {
+	flushDNSCacheEntries()
+	t.Cleanup(func() { flushDNSCacheEntries() })
+
+	now := time.Now()
+	dnsCacheMutex.Lock()
+	for i := range dnsCacheMaxEntries {
+		dnsCacheEntries[fmt.Sprintf("old%d", i)] = &dnsCacheEntry{reply: new(dns.Msg), stored: now, expires: now.Add(time.Hour + time.Duration(i)*time.Second)}
+	}
+	dnsCacheMutex.Unlock()
+
+	query := testDNSQuery("new.example.")
+	storeReply(query, testDNSReply(query, 300))
+	if stats := currentDNSCacheStats(); stats.Entries != dnsCacheMaxEntries {
+		t.Errorf("entries = %d, want %d", stats.Entries, dnsCacheMaxEntries)
+	}
+	if cachedReply(query) == nil {
+		t.Error("new answer was not stored")
+	}
+	dnsCacheMutex.Lock()
+	_, kept := dnsCacheEntries["old0"]
+	dnsCacheMutex.Unlock()
+	if kept {
+		t.Error("the answer closest to expiring was kept")
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import "C"
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+
+	olmdns "github.com/fosrl/olm/dns"
+	"github.com/miekg/dns"
+)
+
+// Where the upstream resolvers in DNSConfig come from
+const (
+	UpstreamFromConfig  = "config"
+	UpstreamFromRuntime = "runtime"
+	UpstreamFromProfile = "profile"
+	UpstreamFromSystem  = "system"
+)
+
+// DNSConfig is the resolver's effective configuration, as returned by
+// getDNSConfig
+type DNSConfig struct {
+	UpstreamDNS []string `json:"upstreamDNS"`
+	// UpstreamSource says whether the upstreams were configured at connect,
+	// changed with setUpstreamDNS, come from the current network's profile
+	// or follow the system's resolvers
+	UpstreamSource string `json:"upstreamSource"`
+	// NetworkProfile is the DNS profile selected for the current network
+	NetworkProfile string   `json:"networkProfile,omitempty"`
+	SystemDNS      []string `json:"systemDNS"`
+	TunnelDNS      bool     `json:"tunnelDNS"`
+	MatchDomains   []string `json:"matchDomains"`
+	OverrideScope  string   `json:"overrideScope"`
+	ProxyAddress   string   `json:"proxyAddress,omitempty"`
+	SelfHostname   string   `json:"selfHostname,omitempty"`
+	// Privacy is what is removed from queries to public resolvers
+	Privacy *DNSPrivacy `json:"privacy,omitempty"`
+	// Bootstrapped are the addresses of the upstreams given by name
+	Bootstrapped map[string][]string `json:"bootstrapped,omitempty"`
+	// UpstreamStats are the latest latency measurements, in the order
+	// queries try the upstreams
+	UpstreamStats []UpstreamDNSStats `json:"upstreamStats"`
+	// SiteResolvers are the upstreams reached through the tunnel
+	SiteResolvers []SiteResolver `json:"siteResolvers,omitempty"`
+	// UpstreamPaths say whether each upstream is queried through the
+	// tunnel or over the physical network
+	UpstreamPaths []UpstreamPath `json:"upstreamPaths"`
+	// DNSRoutes are the upstreams of names under each routed suffix
+	DNSRoutes map[string][]string `json:"dnsRoutes,omitempty"`
+	// SearchDomains complete single-label names, in the order tried
+	SearchDomains []string `json:"searchDomains,omitempty"`
+	// MDNSPassthrough is set while .local and link-local names are left to
+	// multicast DNS
+	MDNSPassthrough bool `json:"mdnsPassthrough"`
+	// Cache is the size of the DNS cache and how often it answered
+	Cache DNSCacheStats `json:"cache"`
+}
+
+var (
+	dnsConfigMutex sync.Mutex
+	// upstreamOverride replaces the configured upstreams until the tunnel
+	// stops
+	upstreamOverride []string
+	// profileUpstream is the upstream set of the current network's DNS
+	// profile, if it has one
+	profileUpstream []string
+	// reportedSystemDNS is the last list passed to setSystemDNS
+	reportedSystemDNS []string
+)
+
+// normalizeDNSServer turns "1.1.1.1", "2606:4700::1111", "1.1.1.1:5353" or
+// "dns.example.com" into the host:port form olm's resolver expects. Names
+// are resolved through the bootstrap before olm sees them. Site resolvers,
+// "tunnel://[site@]address[:port]", and physical upstreams,
+// "physical://server", are kept in that form.
+func normalizeDNSServer(server string) (string, error) {
+	server = strings.TrimSpace(server)
+	if isSiteResolver(server) {
+		return normalizeSiteResolver(server)
+	}
+	if isPhysicalUpstream(server) {
+		return normalizePhysicalUpstream(server)
+	}
+	if addrPort, err := netip.ParseAddrPort(server); err == nil {
+		return addrPort.String(), nil
+	}
+	if addr, err := netip.ParseAddr(strings.Trim(server, "[]")); err == nil {
+		return netip.AddrPortFrom(addr, 53).String(), nil
+	}
+	host, port, err := net.SplitHostPort(server)
+	if err != nil {
+		host, port = server, "53"
+	}
+	if _, ok := dns.IsDomainName(host); !ok || host == "" || strings.Trim(port, "0123456789") != "" {
+		return "", fmt.Errorf("invalid DNS server %q", server)
+	}
+	return net.JoinHostPort(strings.TrimSuffix(host, "."), port), nil
+}
+
+func normalizeDNSServers(servers []string) ([]string, error) {
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("at least one upstream DNS server is required")
+	}
+	normalized := make([]string, 0, len(servers))
+	for _, server := range servers {
+		value, err := normalizeDNSServer(server)
+		if err != nil {
+			return nil, err
+		}
+		normalized = append(normalized, value)
+	}
+	return normalized, nil
+}
+
+// setUpstreamOverride replaces the upstream resolvers of the running
+// tunnel. olm's proxy forwards new queries to them right away.
+func setUpstreamOverride(servers []string) error {
+	normalized, err := normalizeDNSServers(servers)
+	if err != nil {
+		return err
+	}
+
+	before := currentSiteResolvers()
+	dnsConfigMutex.Lock()
+	upstreamOverride = normalized
+	dnsConfigMutex.Unlock()
+
+	tunnelMutex.Lock()
+	activeTunnelConfig.UpstreamDNS = normalized
+	tunnelMutex.Unlock()
+
+	applyUpstreamDNS()
+	noteSiteResolversChanged(before)
+	appLogger.Info("Upstream DNS set to %v", normalized)
+	recordEvent(EventDNS, "upstream DNS %v", normalized)
+	return nil
+}
+
+func clearUpstreamOverride() {
+	dnsConfigMutex.Lock()
+	upstreamOverride = nil
+	dnsConfigMutex.Unlock()
+}
+
+// pinnedUpstreamDNS returns the upstreams that take precedence over the
+// configured ones: a runtime override, then the current network's profile
+func pinnedUpstreamDNS() ([]string, string) {
+	dnsConfigMutex.Lock()
+	defer dnsConfigMutex.Unlock()
+	if len(upstreamOverride) > 0 {
+		return upstreamOverride, UpstreamFromRuntime
+	}
+	if len(profileUpstream) > 0 {
+		return profileUpstream, UpstreamFromProfile
+	}
+	return nil, ""
+}
+
+// upstreamServers returns the addresses of the pinned upstreams, or else of
+// the configured or system ones
+func upstreamServers() []string {
+	if pinned, _ := pinnedUpstreamDNS(); len(pinned) > 0 {
+		return resolveUpstreams(pinned, false)
+	}
+	tunnelMutex.Lock()
+	configured := activeTunnelConfig.UpstreamDNS
+	tunnelMutex.Unlock()
+	if len(configured) > 0 {
+		return resolveUpstreams(configured, false)
+	}
+	dnsConfigMutex.Lock()
+	defer dnsConfigMutex.Unlock()
+	return reportedSystemDNS
+}
+
+// applyUpstreamDNS points olm's current resolver at the pinned upstreams,
+// or back at the configured or system ones, fastest first. olm resets the
+// upstreams of a resolver that follows the system's when the system DNS
+// changes, so this also runs after every setSystemDNS.
+func applyUpstreamDNS() {
+	pinned, _ := pinnedUpstreamDNS()
+
+	// Restarts reuse the pinned list and treat it as configured, so olm
+	// stops following the system's resolvers while it applies
+	tunnelMutex.Lock()
+	upstreams := activeTunnelConfig.UpstreamDNS
+	tunnelMutex.Unlock()
+	if len(pinned) > 0 {
+		upstreams = pinned
+	}
+	upstreams = resolveUpstreams(upstreams, false)
+	tunnelMutex.Lock()
+	olmTunnelConfig.UpstreamDNS = upstreams
+	tunnelMutex.Unlock()
+
+	servers := upstreamServers()
+	if len(servers) == 0 {
+		return
+	}
+
+	if proxy := (*olmdns.DNSProxy)(olmPointerField("dnsProxy", reflect.TypeOf((*olmdns.DNSProxy)(nil)))); proxy != nil {
+		proxy.SetUpstreamDNS(applyDNSCache(proxy, applySplitDNS(proxy, applyDNSPrivacy(proxy, orderUpstreamsByLatency(servers)))))
+	}
+}
+
+func noteSystemDNS(servers []string) {
+	dnsConfigMutex.Lock()
+	reportedSystemDNS = servers
+	dnsConfigMutex.Unlock()
+}
+
+// currentDNSConfig describes what the resolver is doing for config
+func currentDNSConfig(config StartTunnelConfig) DNSConfig {
+	pinned, source := pinnedUpstreamDNS()
+	dnsConfigMutex.Lock()
+	system := slices.Clone(reportedSystemDNS)
+	dnsConfigMutex.Unlock()
+
+	dnsConfig := DNSConfig{
+		SystemDNS:      system,
+		TunnelDNS:      config.TunnelDNS,
+		MatchDomains:   config.MatchDomains,
+		OverrideScope:  dnsOverrideScope(config),
+		SelfHostname:   currentSelfHostname(),
+		NetworkProfile: currentDNSProfile(),
+		Privacy:        config.DNSPrivacy,
+		DNSRoutes:      config.DNSRoutes,
+	}
+	switch {
+	case len(pinned) > 0:
+		dnsConfig.UpstreamDNS, dnsConfig.UpstreamSource = slices.Clone(pinned), source
+	case len(config.UpstreamDNS) > 0:
+		dnsConfig.UpstreamDNS, dnsConfig.UpstreamSource = config.UpstreamDNS, UpstreamFromConfig
+	default:
+		dnsConfig.UpstreamDNS, dnsConfig.UpstreamSource = system, UpstreamFromSystem
+	}
+	if addr, ok := olmDNSProxyAddr(); ok && addr.IsValid() {
+		dnsConfig.ProxyAddress = addr.String()
+	}
+	if dnsConfig.UpstreamDNS == nil {
+		dnsConfig.UpstreamDNS = []string{}
+	}
+	dnsConfig.UpstreamStats = upstreamDNSStats(resolveUpstreams(dnsConfig.UpstreamDNS, false))
+	dnsConfig.SiteResolvers = siteResolverStatus(dnsConfig.UpstreamDNS)
+	dnsConfig.UpstreamPaths = upstreamPaths(dnsConfig.UpstreamDNS)
+	dnsConfig.Cache = currentDNSCacheStats()
+	dnsConfig.SearchDomains = currentSearchDomains()
+	dnsConfig.MDNSPassthrough = mdnsPassthrough.Load()
+	if bootstrapped := bootstrappedUpstreams(); len(bootstrapped) > 0 {
+		dnsConfig.Bootstrapped = bootstrapped
+	}
+	if dnsConfig.SystemDNS == nil {
+		dnsConfig.SystemDNS = []string{}
+	}
+	if dnsConfig.MatchDomains == nil {
+		dnsConfig.MatchDomains = []string{}
+	}
+	return dnsConfig
+}
+
+// getDNSConfig returns the resolver's effective configuration as JSON
+//
+//export getDNSConfig
+func getDNSConfig() *C.char {
+	tunnelMutex.Lock()
+	config := activeTunnelConfig
+	tunnelMutex.Unlock()
+
+	data, err := json.Marshal(currentDNSConfig(config))
+	if err != nil {
+		appLogger.Error("Failed to marshal DNS config: %v", err)
+		return exportString(fmt.Sprintf("Error: Failed to marshal DNS config: %v", err))
+	}
+	return exportString(string(data))
+}
+
+// setUpstreamDNS replaces the upstream resolvers of the running tunnel
+// without reconnecting. serversJSON is a JSON array of addresses or names,
+// with or without a port, e.g. ["1.1.1.1", "[2606:4700::1111]:53",
+// "dns.example.com"], or of site resolvers such as "tunnel://3@10.0.0.53",
+// which are queried through the tunnel and routed into it. Plain addresses
+// inside the sites' routes are queried through the tunnel too, unless given
+// as "physical://192.168.1.1".
+//
+//export setUpstreamDNS
+func setUpstreamDNS(serversJSON *C.char) *C.char {
+	if locked := managedLockResult("upstreamDNS"); locked != nil {
+		return locked
+	}
+	var servers []string
+	if err := json.Unmarshal([]byte(C.GoString(serversJSON)), &servers); err != nil {
+		appLogger.Error("Failed to parse upstream DNS JSON: %v", err)
+		return exportString(fmt.Sprintf("Error: Failed to parse upstream DNS JSON: %v", err))
+	}
+
+	tunnelMutex.Lock()
+	running := tunnelRunning
+	tunnelMutex.Unlock()
+	if !running {
+		return exportString("Error: Tunnel not running")
+	}
+
+	if err := setUpstreamOverride(servers); err != nil {
+		appLogger.Error("Invalid upstream DNS: %v", err)
+		return exportString(fmt.Sprintf("Error: %v", err))
+	}
+	return exportString("Upstream DNS updated")
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	dnsProbeInterval = 30 * time.Second
+	dnsProbeTimeout  = 2 * time.Second
+	// dnsLatencyWeight is how much a new measurement moves the rolling
+	// average
+	dnsLatencyWeight = 0.3
+	// dnsProbeFailures marks an upstream unhealthy after this many failed
+	// probes in a row
+	dnsProbeFailures = 2
+	// dnsSwitchMargin keeps the primary upstream until another is clearly
+	// faster, so similar upstreams do not trade places on every probe
+	dnsSwitchMargin = 0.8
+)
+
+// UpstreamDNSStats reports the measurements for one upstream
+type UpstreamDNSStats struct {
+	Server   string  `json:"server"`
+	RTTMs    float64 `json:"rttMs"`
+	Healthy  bool    `json:"healthy"`
+	Measured bool    `json:"measured"`
+}
+
+type upstreamLatency struct {
+	rtt      time.Duration
+	failures int
+	measured bool
+}
+
+var (
+	dnsLatencyMutex sync.Mutex
+	dnsLatency      = map[string]*upstreamLatency{}
+	// dnsPrimary is the upstream olm currently tries first
+	dnsPrimary     string
+	dnsProbing     bool
+	dnsLastProbeAt time.Time
+)
+
+func (l *upstreamLatency) healthy() bool {
+	return l.failures < dnsProbeFailures
+}
+
+// orderUpstreamsByLatency puts the fastest healthy upstream first. olm only
+// ever tries the first two entries, so the order decides which resolvers
+// answer. Unmeasured upstreams keep their configured position.
+func orderUpstreamsByLatency(servers []string) []string {
+	dnsLatencyMutex.Lock()
+	defer dnsLatencyMutex.Unlock()
+
+	ordered := slices.Clone(servers)
+	if len(ordered) < 2 {
+		return ordered
+	}
+	better := func(a, b string) bool {
+		la, lb := dnsLatency[a], dnsLatency[b]
+		if la == nil || lb == nil || !la.measured || !lb.measured {
+			return false
+		}
+		if la.healthy() != lb.healthy() {
+			return la.healthy()
+		}
+		return la.rtt < lb.rtt
+	}
+	slices.SortStableFunc(ordered, func(a, b string) int {
+		switch {
+		case better(a, b):
+			return -1
+		case better(b, a):
+			return 1
+		}
+		return 0
+	})
+
+	// Keep the current primary unless it failed or the new one wins by a margin
+	if current := slices.Index(ordered, dnsPrimary); current > 0 {
+		primary, best := dnsLatency[dnsPrimary], dnsLatency[ordered[0]]
+		if primary != nil && primary.healthy() && best != nil &&
+			float64(best.rtt) > float64(primary.rtt)*dnsSwitchMargin {
+			ordered = append([]string{dnsPrimary}, slices.Delete(ordered, current, current+1)...)
+		}
+	}
+	if ordered[0] != dnsPrimary {
+		if dnsPrimary != "" {
+			appLogger.Info("Preferring upstream DNS %s", ordered[0])
+		}
+		dnsPrimary = ordered[0]
+	}
+	return ordered
+}
+
+func upstreamDNSStats(servers []string) []UpstreamDNSStats {
+	dnsLatencyMutex.Lock()
+	defer dnsLatencyMutex.Unlock()
+
+	stats := make([]UpstreamDNSStats, 0, len(servers))
+	for _, server := range servers {
+		entry := UpstreamDNSStats{Server: server, Healthy: true}
+		if latency := dnsLatency[server]; latency != nil {
+			entry.RTTMs = float64(latency.rtt.Microseconds()) / 1000
+			entry.Healthy = latency.healthy()
+			entry.Measured = latency.measured
+		}
+		stats = append(stats, entry)
+	}
+	return stats
+}
+
+// probeUpstream times a query for the root's NS records, which every
+// resolver can answer from cache
+func probeUpstream(server string) (time.Duration, error) {
+	query := new(dns.Msg)
+	query.SetQuestion(".", dns.TypeNS)
+	client := upstreamDNSClient(dnsProbeTimeout)
+	_, rtt, err := client.Exchange(query, server)
+	return rtt, err
+}
+
+func recordUpstreamProbe(server string, rtt time.Duration, err error) {
+	noteTelemetryDNSQuery(err != nil)
+	dnsLatencyMutex.Lock()
+	defer dnsLatencyMutex.Unlock()
+
+	latency := dnsLatency[server]
+	if latency == nil {
+		latency = &upstreamLatency{}
+		dnsLatency[server] = latency
+	}
+	if err != nil {
+		latency.failures++
+		if latency.failures == dnsProbeFailures {
+			appLogger.Warn("Upstream DNS %s is not answering: %v", server, err)
+			publishEvent(BridgeEvent{Type: BridgeEventDNSFailure, Message: fmt.Sprintf("upstream DNS %s is not answering: %v", server, err)})
+		}
+		return
+	}
+	if latency.measured {
+		latency.rtt = time.Duration(float64(latency.rtt)*(1-dnsLatencyWeight) + float64(rtt)*dnsLatencyWeight)
+	} else {
+		latency.rtt = rtt
+	}
+	latency.failures = 0
+	latency.measured = true
+}
+
+// syncDNSLatency re-probes the upstreams every dnsProbeInterval and
+// reorders them when the fastest one changes. Probes leave from the
+// extension itself, which the tunnel does not capture, so they are skipped
+// when olm sends DNS through the tunnel and the measurement would describe
+// the wrong path. An idle tunnel makes no queries worth speeding up, so
+// probing also pauses while the data path is quiet.
+func syncDNSLatency() {
+	tunnelMutex.Lock()
+	tunnelDNS := activeTunnelConfig.TunnelDNS
+	tunnelMutex.Unlock()
+	if tunnelDNS || pathCostly() || dataPathQuiet.Load() {
+		return
+	}
+
+	servers := upstreamServers()
+	if len(servers) < 2 {
+		return
+	}
+
+	dnsLatencyMutex.Lock()
+	due := !dnsProbing && time.Since(dnsLastProbeAt) >= powerScaledInterval(dnsProbeInterval)
+	if due {
+		dnsProbing = true
+		dnsLastProbeAt = time.Now()
+	}
+	dnsLatencyMutex.Unlock()
+	if !due {
+		return
+	}
+
+	go func() {
+		defer dumpOnPanic()
+
+		var wg sync.WaitGroup
+		for _, server := range servers {
+			wg.Add(1)
+			go func(server string) {
+				defer wg.Done()
+				superviseSubsystem(SubsystemDNS, "upstream DNS probe", func() {
+					rtt, err := probeUpstream(server)
+					recordUpstreamProbe(server, rtt, err)
+				})
+			}(server)
+		}
+		wg.Wait()
+
+		dnsLatencyMutex.Lock()
+		dnsProbing = false
+		primary := dnsPrimary
+		dnsLatencyMutex.Unlock()
+
+		if ordered := orderUpstreamsByLatency(servers); ordered[0] != primary {
+			applyUpstreamDNS()
+		}
+	}()
+}
@@ -0,0 +1,237 @@
+package main
+
+import "C"
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	dnsLeakJob      = "dnsLeak"
+	dnsLeakInterval = 10 * time.Minute
+	dnsLeakTimeout  = 5 * time.Second
+	// dnsCanaryLabel starts every canary name, so it is easy to spot in
+	// resolver logs
+	dnsCanaryLabel = "pangolin-canary-"
+)
+
+// DNS leak states reported by getDNSLeakStatus
+const (
+	DNSLeakUnknown = "unknown"
+	DNSLeakOK      = "ok"
+	// DNSLeakDetected: the system answered a canary query that never reached
+	// the tunnel's resolver
+	DNSLeakDetected = "leak"
+)
+
+// DNSLeakStatus is the JSON returned by getDNSLeakStatus
+type DNSLeakStatus struct {
+	State        string `json:"state"`
+	CanaryDomain string `json:"canaryDomain,omitempty"`
+	// TunnelQueries counts DNS queries sent to the tunnel's resolver,
+	// OtherQueries those sent through the tunnel to any other server
+	TunnelQueries     uint64    `json:"tunnelQueries"`
+	OtherQueries      uint64    `json:"otherQueries"`
+	LastTunnelQueryAt time.Time `json:"lastTunnelQueryAt,omitempty"`
+	CheckedAt         time.Time `json:"checkedAt,omitempty"`
+	Detail            string    `json:"detail,omitempty"`
+}
+
+var (
+	// dnsLeakWatching is read on every packet; the rest is under
+	// dnsLeakMutex
+	dnsLeakWatching atomic.Bool
+	dnsLeakMutex    sync.Mutex
+	dnsLeakStatus   = DNSLeakStatus{State: DNSLeakUnknown}
+	// dnsCanaryName is the canary being resolved and dnsCanarySeen whether
+	// the tunnel's resolver was asked for it
+	dnsCanaryName string
+	dnsCanarySeen bool
+)
+
+// noteDNSQuery accounts for a DNS query the host sends into the tunnel.
+// Only UDP is inspected; the system resolver only falls back to TCP for
+// truncated answers, which a canary never gets.
+func noteDNSQuery(packet []byte) {
+	if !dnsLeakWatching.Load() {
+		return
+	}
+	ip, ok := parseIPPacket(packet)
+	if !ok || ip.Protocol != ipProtoUDP || len(ip.Payload) < 8 ||
+		(ip.Version == 4 && !ipv4IsFirstFragment(packet)) ||
+		binary.BigEndian.Uint16(ip.Payload[2:4]) != 53 {
+		return
+	}
+
+	proxy, _ := olmDNSProxyAddr()
+	var query dns.Msg
+	parsed := query.Unpack(ip.Payload[8:]) == nil && len(query.Question) > 0
+
+	dnsLeakMutex.Lock()
+	defer dnsLeakMutex.Unlock()
+	if ip.Dst != proxy {
+		dnsLeakStatus.OtherQueries++
+		return
+	}
+	dnsLeakStatus.TunnelQueries++
+	dnsLeakStatus.LastTunnelQueryAt = time.Now()
+	if parsed && dnsCanaryName != "" && strings.EqualFold(query.Question[0].Name, dnsCanaryName) {
+		dnsCanarySeen = true
+	}
+}
+
+// dnsCanaryDomain picks the domain canary names go under: the configured
+// one, or else the server's, whose resolver answers for random names too
+func dnsCanaryDomain(config StartTunnelConfig) string {
+	if config.DNSLeakCanaryDomain != "" {
+		return strings.Trim(config.DNSLeakCanaryDomain, ".")
+	}
+	u, err := url.Parse(serverHealthURL(config.Endpoint))
+	if err != nil {
+		return ""
+	}
+	if _, err := netip.ParseAddr(u.Hostname()); err == nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// checkDNSLeak resolves a fresh canary name through the system resolver. The
+// system resolver runs outside this process, so with DNS overridden its
+// query has to come back in through the tunnel; an answer for a name the
+// tunnel's resolver never saw came from somewhere else.
+func checkDNSLeak(ctx context.Context, domain string) {
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		appLogger.Error("Failed to generate DNS canary: %v", err)
+		return
+	}
+	name := dnsCanaryLabel + hex.EncodeToString(nonce) + "." + domain
+
+	dnsLeakMutex.Lock()
+	dnsCanaryName = dns.Fqdn(name)
+	dnsCanarySeen = false
+	dnsLeakMutex.Unlock()
+
+	lookupCtx, cancel := context.WithTimeout(ctx, dnsLeakTimeout)
+	defer cancel()
+	_, err := net.DefaultResolver.LookupHost(lookupCtx, name)
+	var dnsErr *net.DNSError
+	answered := err == nil || (errors.As(err, &dnsErr) && dnsErr.IsNotFound)
+
+	dnsLeakMutex.Lock()
+	seen := dnsCanarySeen
+	dnsCanaryName = ""
+	if ctx.Err() != nil || (!answered && !seen) {
+		// No answer from anywhere says nothing about where queries go
+		dnsLeakMutex.Unlock()
+		if err != nil && ctx.Err() == nil {
+			appLogger.Debug("DNS canary %s inconclusive: %v", name, err)
+		}
+		return
+	}
+	previous := dnsLeakStatus.State
+	dnsLeakStatus.CheckedAt = time.Now()
+	if seen {
+		dnsLeakStatus.State = DNSLeakOK
+		dnsLeakStatus.Detail = ""
+	} else {
+		dnsLeakStatus.State = DNSLeakDetected
+		dnsLeakStatus.Detail = fmt.Sprintf("canary %s was answered without reaching the tunnel resolver", name)
+	}
+	status := dnsLeakStatus
+	dnsLeakMutex.Unlock()
+
+	if status.State == previous {
+		return
+	}
+	if status.State == DNSLeakDetected {
+		appLogger.Warn("DNS leak detected: %s", status.Detail)
+	} else {
+		appLogger.Info("DNS queries go through the tunnel")
+	}
+	recordEvent(EventSettings, "DNS leak check %s -> %s", previous, status.State)
+}
+
+// startDNSLeakCheck watches for DNS queries escaping the tunnel while it
+// overrides all DNS. Other scopes leave most queries outside the tunnel on
+// purpose.
+func startDNSLeakCheck(config StartTunnelConfig) {
+	stopDNSLeakCheck()
+	if dnsOverrideScope(config) != DNSScopeAlways {
+		return
+	}
+	domain := dnsCanaryDomain(config)
+
+	dnsLeakMutex.Lock()
+	dnsLeakStatus.CanaryDomain = domain
+	dnsLeakMutex.Unlock()
+
+	// Accounting needs to see every packet
+	wrapTunnelDevice()
+	dnsLeakWatching.Store(true)
+	if domain == "" {
+		appLogger.Info("No DNS canary domain, counting DNS queries only")
+		return
+	}
+
+	// The first check waits one interval, so the settings are applied first
+	scheduleJob(dnsLeakJob, false, func() time.Duration {
+		return quietScaledInterval(dnsLeakInterval)
+	}, func(ctx context.Context) {
+		checkDNSLeak(ctx, domain)
+	})
+}
+
+// stopDNSLeakCheck stops checking and forgets the results
+func stopDNSLeakCheck() {
+	cancelJob(dnsLeakJob)
+	dnsLeakWatching.Store(false)
+
+	dnsLeakMutex.Lock()
+	dnsLeakStatus = DNSLeakStatus{State: DNSLeakUnknown}
+	dnsCanaryName = ""
+	dnsLeakMutex.Unlock()
+}
+
+// dnsLeakWarning describes a detected leak for the health status, or is
+// empty
+func dnsLeakWarning() string {
+	dnsLeakMutex.Lock()
+	defer dnsLeakMutex.Unlock()
+	if dnsLeakStatus.State != DNSLeakDetected {
+		return ""
+	}
+	return "DNS leak detected: " + dnsLeakStatus.Detail
+}
+
+// getDNSLeakStatus returns the DNS leak check's result and query counts as
+// JSON
+//
+//export getDNSLeakStatus
+func getDNSLeakStatus() *C.char {
+	dnsLeakMutex.Lock()
+	status := dnsLeakStatus
+	dnsLeakMutex.Unlock()
+
+	data, err := json.Marshal(status)
+	if err != nil {
+		appLogger.Error("Failed to marshal DNS leak status: %v", err)
+		return exportString(fmt.Sprintf(`{"state":%q}`, DNSLeakUnknown))
+	}
+	return exportString(string(data))
+}
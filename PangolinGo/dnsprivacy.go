@@ -0,0 +1,253 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+
+	olmdns "github.com/fosrl/olm/dns"
+	"github.com/miekg/dns"
+)
+
+// dnsPrivacyTimeout bounds one upstream attempt. olm gives a resolver two
+// seconds, and the forwarder tries two upstreams within that.
+const dnsPrivacyTimeout = 900 * time.Millisecond
+
+// DNSPrivacy limits what queries forwarded off the tunnel tell public
+// resolvers. Resolvers on private addresses get the queries unchanged.
+type DNSPrivacy struct {
+	// MinimizeQueries sends only the question: a fresh ID, no EDNS options
+	// and nothing else in the additional section. The name itself has to go
+	// out in full; minimizing it label by label toward the authoritative
+	// servers is the public resolver's QNAME minimization.
+	MinimizeQueries bool `json:"minimizeQueries"`
+	// StripClientSubnet removes EDNS client subnet options and asks the
+	// resolver not to add one from this device's address
+	StripClientSubnet bool `json:"stripClientSubnet"`
+}
+
+func (p DNSPrivacy) enabled() bool {
+	return p.MinimizeQueries || p.StripClientSubnet
+}
+
+// privacyForwarder is a resolver on the loopback interface that olm's proxy
+// forwards to in place of the real upstreams, so the queries can be
+// rewritten on the way out
+type privacyForwarder struct {
+	server  *loopbackDNS
+	addr    string
+	mutex   sync.Mutex
+	servers []string
+}
+
+var (
+	dnsPrivacyMutex sync.Mutex
+	// privacyUpstream stands in for the upstreams, privacyLocal for the
+	// system resolvers that get queries outside the match domains
+	privacyUpstream *privacyForwarder
+	privacyLocal    *privacyForwarder
+	privacyProxy    *olmdns.DNSProxy
+)
+
+// currentDNSPrivacy returns the running tunnel's privacy options
+func currentDNSPrivacy() DNSPrivacy {
+	tunnelMutex.Lock()
+	defer tunnelMutex.Unlock()
+	if activeTunnelConfig.DNSPrivacy == nil {
+		return DNSPrivacy{}
+	}
+	return *activeTunnelConfig.DNSPrivacy
+}
+
+// publicResolver reports whether a host:port resolver is on the internet
+// rather than on a private or local network
+func publicResolver(server string) bool {
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		host = server
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	return addr.IsGlobalUnicast() && !addr.IsPrivate() && !cgnatPrefix.Contains(addr)
+}
+
+var cgnatPrefix = netip.MustParsePrefix("100.64.0.0/10")
+
+// privatizeQuery returns the query as it may be sent to a public resolver
+func privatizeQuery(query *dns.Msg, privacy DNSPrivacy) *dns.Msg {
+	out := query.Copy()
+	opt := out.IsEdns0()
+
+	if privacy.MinimizeQueries {
+		out.Id = dns.Id()
+		if len(out.Question) > 1 {
+			out.Question = out.Question[:1]
+		}
+		out.Extra = nil
+		if opt != nil {
+			// Keep what the answer depends on: the buffer size and DNSSEC
+			opt = &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+			opt.SetUDPSize(query.IsEdns0().UDPSize())
+			opt.SetDo(query.IsEdns0().Do())
+			out.Extra = append(out.Extra, opt)
+		}
+	}
+
+	if privacy.StripClientSubnet {
+		if opt == nil {
+			out.SetEdns0(dns.MinMsgSize, false)
+			opt = out.IsEdns0()
+		}
+		opt.Option = slices.DeleteFunc(opt.Option, func(option dns.EDNS0) bool {
+			return option.Option() == dns.EDNS0SUBNET
+		})
+		// A source prefix of zero tells the resolver to send no client
+		// address upstream at all (RFC 7871)
+		opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+			Code:    dns.EDNS0SUBNET,
+			Family:  1,
+			Address: net.IPv4zero,
+		})
+	}
+	return out
+}
+
+// exchange sends a query to one upstream, over TCP when the UDP answer was
+// truncated
+func exchange(query *dns.Msg, server string) (*dns.Msg, error) {
+	started := time.Now()
+	client := upstreamDNSClient(dnsPrivacyTimeout)
+	reply, _, err := client.Exchange(query, server)
+	if err == nil && reply.Truncated {
+		client.Net = "tcp"
+		reply, _, err = client.Exchange(query, server)
+	}
+	recordDNSQuery(query, server, started, reply, err)
+	return reply, err
+}
+
+// forward answers a query from olm's proxy using the first two upstreams,
+// the same failover olm applies
+func (f *privacyForwarder) forward(w dns.ResponseWriter, query *dns.Msg) {
+	f.mutex.Lock()
+	servers := f.servers
+	f.mutex.Unlock()
+	privacy := currentDNSPrivacy()
+
+	var reply *dns.Msg
+	for i, server := range servers {
+		if i == 2 {
+			break
+		}
+		out := query
+		if publicResolver(server) {
+			out = privatizeQuery(query, privacy)
+		}
+		var err error
+		if reply, err = exchange(out, server); err == nil {
+			break
+		}
+		appLogger.Debug("Private DNS forward to %s failed: %v", server, err)
+	}
+	if reply == nil {
+		reply = new(dns.Msg)
+		reply.SetRcode(query, dns.RcodeServerFailure)
+	}
+	writeDNSReply(w, query, reply)
+}
+
+// setServers replaces the resolvers a forwarder sends to
+func (f *privacyForwarder) setServers(servers []string) {
+	f.mutex.Lock()
+	f.servers = slices.Clone(servers)
+	f.mutex.Unlock()
+}
+
+// startPrivacyForwarder listens on a free loopback port
+func startPrivacyForwarder() (*privacyForwarder, error) {
+	f := &privacyForwarder{}
+	server, err := startLoopbackDNS("private DNS forwarder", f.forward)
+	if err != nil {
+		return nil, err
+	}
+	f.server, f.addr = server, server.addr
+	return f, nil
+}
+
+// privateResolvers puts a forwarder in front of the given resolvers when
+// the privacy options call for it and returns what olm should use instead.
+// Caller must hold dnsPrivacyMutex.
+func privateResolvers(forwarder **privacyForwarder, servers []string) []string {
+	if len(servers) == 0 {
+		return servers
+	}
+	if *forwarder == nil {
+		f, err := startPrivacyForwarder()
+		if err != nil {
+			appLogger.Warn("Failed to start private DNS forwarder, forwarding unchanged: %v", err)
+			return servers
+		}
+		*forwarder = f
+	}
+	(*forwarder).setServers(servers)
+	return []string{(*forwarder).addr}
+}
+
+// applyDNSPrivacy points olm's proxy at the privacy forwarders. Upstream
+// queries sent through the tunnel are left alone: they cannot reach the
+// loopback forwarder, and the exit site forwards them anyway.
+func applyDNSPrivacy(proxy *olmdns.DNSProxy, upstreams []string) []string {
+	privacy := currentDNSPrivacy()
+	if !privacy.enabled() {
+		return upstreams
+	}
+	tunnelMutex.Lock()
+	tunnelDNS := activeTunnelConfig.TunnelDNS
+	tunnelMutex.Unlock()
+
+	local := hostResolvers()
+
+	dnsPrivacyMutex.Lock()
+	defer dnsPrivacyMutex.Unlock()
+	privacyProxy = proxy
+	if len(local) > 0 {
+		proxy.SetLocalDNS(privateResolvers(&privacyLocal, local))
+	}
+	if tunnelDNS {
+		return upstreams
+	}
+	return privateResolvers(&privacyUpstream, upstreams)
+}
+
+// syncDNSPrivacy redoes the forwarding when olm starts a new proxy, which
+// begins with the real resolvers
+func syncDNSPrivacy() {
+	if !currentDNSPrivacy().enabled() {
+		return
+	}
+	proxy := (*olmdns.DNSProxy)(olmPointerField("dnsProxy", reflect.TypeOf((*olmdns.DNSProxy)(nil))))
+	dnsPrivacyMutex.Lock()
+	changed := proxy != nil && proxy != privacyProxy
+	dnsPrivacyMutex.Unlock()
+	if changed {
+		applyUpstreamDNS()
+	}
+}
+
+// stopDNSPrivacy shuts the forwarders down when the tunnel stops
+func stopDNSPrivacy() {
+	dnsPrivacyMutex.Lock()
+	defer dnsPrivacyMutex.Unlock()
+	for _, f := range []*privacyForwarder{privacyUpstream, privacyLocal} {
+		if f != nil {
+			f.server.shutdown()
+		}
+	}
+	privacyUpstream, privacyLocal, privacyProxy = nil, nil, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import "C"
+import (
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// DNSProfile picks the upstream resolvers to use while the device is on a
+// particular network, e.g. the office resolver only answers on the office
+// LAN. Network is the identifier Swift reports for the underlying network.
+// Networks without a profile use the configured upstreams.
+type DNSProfile struct {
+	Name        string   `json:"name"`
+	Network     string   `json:"network"`
+	UpstreamDNS []string `json:"upstreamDNS"`
+}
+
+var (
+	dnsProfilesMutex sync.Mutex
+	dnsProfiles      []DNSProfile
+	// currentNetworkID is the last identifier passed to setNetworkIdentifier
+	currentNetworkID string
+	activeDNSProfile string
+)
+
+// setDNSProfiles replaces the profiles and selects the one for the current
+// network
+func setDNSProfiles(profiles []DNSProfile) error {
+	parsed := make([]DNSProfile, 0, len(profiles))
+	for i, profile := range profiles {
+		if profile.Network == "" {
+			return fmt.Errorf("profile %d has no network", i)
+		}
+		if slices.ContainsFunc(parsed, func(p DNSProfile) bool { return p.Network == profile.Network }) {
+			return fmt.Errorf("network %q has more than one profile", profile.Network)
+		}
+		servers, err := normalizeDNSServers(profile.UpstreamDNS)
+		if err != nil {
+			return fmt.Errorf("profile for network %q: %w", profile.Network, err)
+		}
+		if profile.Name == "" {
+			profile.Name = profile.Network
+		}
+		profile.UpstreamDNS = servers
+		parsed = append(parsed, profile)
+	}
+
+	dnsProfilesMutex.Lock()
+	dnsProfiles = parsed
+	dnsProfilesMutex.Unlock()
+
+	selectDNSProfile()
+	return nil
+}
+
+func currentDNSProfile() string {
+	dnsProfilesMutex.Lock()
+	defer dnsProfilesMutex.Unlock()
+	return activeDNSProfile
+}
+
+// selectDNSProfile makes the current network's profile, or none, the source
+// of the pinned upstreams. It reports whether the selection changed.
+func selectDNSProfile() bool {
+	dnsProfilesMutex.Lock()
+	var selected *DNSProfile
+	for i := range dnsProfiles {
+		if dnsProfiles[i].Network == currentNetworkID {
+			selected = &dnsProfiles[i]
+			break
+		}
+	}
+	name := ""
+	var servers []string
+	if selected != nil {
+		name, servers = selected.Name, selected.UpstreamDNS
+	}
+	changed := name != activeDNSProfile
+	activeDNSProfile = name
+	dnsProfilesMutex.Unlock()
+
+	dnsConfigMutex.Lock()
+	changed = changed || !slices.Equal(servers, profileUpstream)
+	profileUpstream = servers
+	dnsConfigMutex.Unlock()
+
+	if changed {
+		if name != "" {
+			appLogger.Info("Using DNS profile %q: %v", name, servers)
+		} else {
+			appLogger.Info("No DNS profile for this network, using the configured upstreams")
+		}
+		recordEvent(EventDNS, "DNS profile %q", name)
+	}
+	return changed
+}
+
+// setNetworkIdentifier tells the bridge which network the device is on, so
+// the matching DNS profile is used and link flaps can be told from network
+// changes. Swift calls it on every path change; an empty identifier means the
+// network is unknown.
+//
+//export setNetworkIdentifier
+func setNetworkIdentifier(networkID *C.char) *C.char {
+	applyNetworkIdentifier(C.GoString(networkID))
+	return exportString("Network identifier set")
+}
+
+// applyNetworkIdentifier switches to the network's DNS profile and follows
+// outages for the reassert policy
+func applyNetworkIdentifier(id string) {
+	dnsProfilesMutex.Lock()
+	changed := id != currentNetworkID
+	currentNetworkID = id
+	dnsProfilesMutex.Unlock()
+
+	if changed {
+		appLogger.Debug("Network identifier is now %q", id)
+	}
+	noteNetworkChange(id)
+	before := currentSiteResolvers()
+	if selectDNSProfile() {
+		applyUpstreamDNS()
+		noteSiteResolversChanged(before)
+	}
+	if changed {
+		recheckAddressConflicts()
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import "C"
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dnsQueryLogSize is how many queries the log keeps
+const dnsQueryLogSize = 1000
+
+// DNSQueryLogUpstreamCache is the upstream of a query the DNS cache answered
+const DNSQueryLogUpstreamCache = "cache"
+
+// DNSQueryLogEntry is one query in getDNSQueryLog. Each upstream tried is an
+// entry of its own, so a failover shows as a failed entry followed by the
+// one that answered.
+type DNSQueryLogEntry struct {
+	At        time.Time `json:"at"`
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	Upstream  string    `json:"upstream"`
+	LatencyMs float64   `json:"latencyMs"`
+	// Rcode is empty when no answer came back, and Error says why
+	Rcode     string `json:"rcode,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Truncated bool   `json:"truncated,omitempty"`
+}
+
+var (
+	// dnsQueryLogOn is the opt-in; names are only kept while it is set
+	dnsQueryLogOn      atomic.Bool
+	dnsQueryLogMutex   sync.Mutex
+	dnsQueryLogEntries [dnsQueryLogSize]DNSQueryLogEntry
+	dnsQueryLogNext    int
+	dnsQueryLogFull    bool
+)
+
+// loopbackUpstream reports whether a server is one of the bridge's own
+// forwarders, whose queries are logged where they leave the device
+func loopbackUpstream(server string) bool {
+	addrPort, err := netip.ParseAddrPort(server)
+	return err == nil && addrPort.Addr().IsLoopback()
+}
+
+// recordDNSQuery logs a query sent to an upstream while the log is on
+func recordDNSQuery(query *dns.Msg, upstream string, started time.Time, reply *dns.Msg, err error) {
+	if !dnsQueryLogOn.Load() || len(query.Question) == 0 || loopbackUpstream(upstream) {
+		return
+	}
+	question := query.Question[0]
+	entry := DNSQueryLogEntry{
+		At:        started,
+		Name:      strings.TrimSuffix(question.Name, "."),
+		Type:      dns.TypeToString[question.Qtype],
+		Upstream:  upstream,
+		LatencyMs: milliseconds(time.Since(started)),
+	}
+	if entry.Type == "" {
+		entry.Type = fmt.Sprintf("TYPE%d", question.Qtype)
+	}
+	switch {
+	case err != nil:
+		entry.Error = err.Error()
+	case reply != nil:
+		entry.Rcode = dns.RcodeToString[reply.Rcode]
+		entry.Truncated = reply.Truncated
+	}
+
+	dnsQueryLogMutex.Lock()
+	dnsQueryLogEntries[dnsQueryLogNext] = entry
+	dnsQueryLogNext = (dnsQueryLogNext + 1) % dnsQueryLogSize
+	if dnsQueryLogNext == 0 {
+		dnsQueryLogFull = true
+	}
+	dnsQueryLogMutex.Unlock()
+}
+
+// clearDNSQueryLog forgets every logged query
+func clearDNSQueryLog() {
+	dnsQueryLogMutex.Lock()
+	dnsQueryLogEntries = [dnsQueryLogSize]DNSQueryLogEntry{}
+	dnsQueryLogNext, dnsQueryLogFull = 0, false
+	dnsQueryLogMutex.Unlock()
+}
+
+// recentDNSQueries returns up to maxEntries of the newest queries, oldest
+// first
+func recentDNSQueries(maxEntries int) []DNSQueryLogEntry {
+	dnsQueryLogMutex.Lock()
+	defer dnsQueryLogMutex.Unlock()
+
+	count := dnsQueryLogNext
+	if dnsQueryLogFull {
+		count = dnsQueryLogSize
+	}
+	count = min(count, maxEntries)
+	entries := make([]DNSQueryLogEntry, count)
+	for i := range count {
+		entries[count-1-i] = dnsQueryLogEntries[(dnsQueryLogNext-1-i+dnsQueryLogSize)%dnsQueryLogSize]
+	}
+	return entries
+}
+
+// setDNSQueryLogEnabled opts in to or out of the DNS query log. It holds the
+// names looked up, so it is off by default, only kept in memory and cleared
+// when turned off.
+//
+//export setDNSQueryLogEnabled
+func setDNSQueryLogEnabled(enabled C.int) *C.char {
+	on := enabled != 0
+	if dnsQueryLogOn.Swap(on) == on {
+		return exportString("DNS query log unchanged")
+	}
+	if on {
+		appLogger.Info("DNS query log enabled")
+		return exportString("DNS query log enabled")
+	}
+	clearDNSQueryLog()
+	appLogger.Info("DNS query log disabled and cleared")
+	return exportString("DNS query log disabled")
+}
+
+// getDNSQueryLog returns the newest queries sent upstream, oldest first, as
+// a JSON array of {"at", "name", "type", "upstream", "latencyMs", "rcode"}
+// objects. Queries olm answers from its own records, or sends through the
+// tunnel itself, do not pass the bridge and are not logged. maxEntries of
+// zero or less returns all that are kept.
+//
+//export getDNSQueryLog
+func getDNSQueryLog(maxEntries C.int) *C.char {
+	limit := int(maxEntries)
+	if limit <= 0 {
+		limit = dnsQueryLogSize
+	}
+	data, err := json.Marshal(recentDNSQueries(limit))
+	if err != nil {
+		appLogger.Error("Failed to marshal DNS query log: %v", err)
+		return exportString(fmt.Sprintf("Error: Failed to marshal DNS query log: %v", err))
+	}
+	return exportString(string(data))
+}
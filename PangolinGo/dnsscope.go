@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"reflect"
+	"strings"
+	"sync"
+
+	olmdns "github.com/fosrl/olm/dns"
+)
+
+// DNS override scopes
+const (
+	// DNSScopeNever leaves the system's DNS alone
+	DNSScopeNever = "never"
+	// DNSScopeMatchDomains sends only queries under MatchDomains to olm's
+	// resolver
+	DNSScopeMatchDomains = "matchDomains"
+	// DNSScopeAlways makes olm's resolver the resolver for every domain
+	DNSScopeAlways = "always"
+)
+
+var (
+	dnsProxyMutex sync.Mutex
+	dnsProxyAddr  netip.Addr
+)
+
+// dnsOverrideScope returns the scope a config asks for. Configs that predate
+// DNSOverrideScope map OverrideDNS onto always or never.
+func dnsOverrideScope(config StartTunnelConfig) string {
+	if config.DNSOverrideScope != "" {
+		return config.DNSOverrideScope
+	}
+	if config.OverrideDNS {
+		return DNSScopeAlways
+	}
+	return DNSScopeNever
+}
+
+// validateDNSOverrideScope rejects unknown scopes and a match-domains scope
+// with nothing to match
+func validateDNSOverrideScope(config StartTunnelConfig) error {
+	switch dnsOverrideScope(config) {
+	case DNSScopeNever, DNSScopeAlways:
+		return nil
+	case DNSScopeMatchDomains:
+		if len(resolverMatchDomains(config.MatchDomains)) == 0 {
+			return fmt.Errorf("scope %q needs at least one match domain", DNSScopeMatchDomains)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown DNS override scope %q", config.DNSOverrideScope)
+}
+
+// resolverMatchDomains turns olm's wildcard patterns into the domain
+// suffixes NEDNSSettings matches on. "*.corp.example" and "corp.example"
+// both become "corp.example"; patterns with wildcards elsewhere cannot be
+// expressed and are skipped.
+func resolverMatchDomains(patterns []string) []string {
+	var domains []string
+	seen := map[string]bool{}
+	for _, pattern := range patterns {
+		domain := strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(pattern), "*."), ".")
+		if domain == "" || strings.ContainsAny(domain, "*?") {
+			continue
+		}
+		domain = strings.ToLower(domain)
+		if !seen[domain] {
+			seen[domain] = true
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+// olmDNSProxyAddr returns the address olm's DNS proxy answers on, once it
+// is running
+func olmDNSProxyAddr() (netip.Addr, bool) {
+	proxy := (*olmdns.DNSProxy)(olmPointerField("dnsProxy", reflect.TypeOf((*olmdns.DNSProxy)(nil))))
+	if proxy == nil {
+		return netip.Addr{}, false
+	}
+	return proxy.GetProxyIP(), true
+}
+
+// syncDNSProxyAddr notices olm's DNS proxy coming and going. olm only
+// publishes the proxy as a DNS server when it overrides all DNS itself, so
+// for the match-domains scope the bridge publishes it and has to tell Swift
+// when it changes.
+func syncDNSProxyAddr() {
+	addr, _ := olmDNSProxyAddr()
+
+	dnsProxyMutex.Lock()
+	changed := addr != dnsProxyAddr
+	dnsProxyAddr = addr
+	dnsProxyMutex.Unlock()
+
+	if changed {
+		appLogger.Debug("DNS proxy address is now %v", addr)
+		bumpSettingsVersion()
+	}
+}
+
+// tunnelDNSSettings builds the DNS part of the network settings for the
+// config's override scope
+func tunnelDNSSettings(servers []string, config StartTunnelConfig) *TunnelDNSSettings {
+	switch scope := dnsOverrideScope(config); scope {
+	case DNSScopeAlways:
+		if len(servers) == 0 {
+			return nil
+		}
+		// An empty match domain makes this the resolver for all domains
+		return &TunnelDNSSettings{Servers: servers, SearchDomains: withoutLinkLocal(currentSearchDomains()), MatchDomains: []string{""}, OverrideScope: scope}
+	case DNSScopeMatchDomains:
+		dnsProxyMutex.Lock()
+		addr := dnsProxyAddr
+		dnsProxyMutex.Unlock()
+		if !addr.IsValid() {
+			return nil
+		}
+		return &TunnelDNSSettings{
+			Servers:       []string{addr.String()},
+			SearchDomains: withoutLinkLocal(currentSearchDomains()),
+			MatchDomains:  withoutLinkLocal(append(append(resolverMatchDomains(config.MatchDomains), domainMatchDomains()...), dnsRouteDomains()...)),
+			OverrideScope: scope,
+		}
+	}
+	return nil
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	olmdevice "github.com/fosrl/olm/device"
+	olmdns "github.com/fosrl/olm/dns"
+	"github.com/miekg/dns"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+)
+
+// Answers too large for UDP come back truncated, and the asker retries over
+// TCP. The loopback forwarders cut their UDP answers to the size the query
+// allows, so olm's proxy hands the truncation on rather than failing to
+// read the answer, and take TCP on the same port for the forwarder in front
+// of them. olm's proxy only speaks UDP, so TCP to its address is answered
+// here: the query is passed to the proxy over UDP inside its own netstack,
+// allowing the largest answer, which keeps olm's local records and domain
+// matching. A proxy that queries through the tunnel itself still gets UDP
+// answers only as large as its upstreams send.
+
+// magicDNSTCPTimeout bounds one query relayed to olm's proxy, which tries
+// two upstreams for up to two seconds each
+const magicDNSTCPTimeout = 5 * time.Second
+
+// loopbackDNS is a forwarder's resolver on the loopback interface, over UDP
+// and TCP on the same port
+type loopbackDNS struct {
+	addr string
+	udp  *dns.Server
+	tcp  *dns.Server
+}
+
+// magicDNSTCP accepts DNS over TCP on olm's proxy address
+type magicDNSTCP struct {
+	proxy  *olmdns.DNSProxy
+	dev    *olmdevice.MiddleDevice
+	addr   netip.Addr
+	stack  *stack.Stack
+	ep     *channel.Endpoint
+	server *dns.Server
+	cancel context.CancelFunc
+	// closed makes the packet rule, which stays with the device, let
+	// packets pass once this server stopped
+	closed atomic.Bool
+}
+
+var (
+	magicTCPMutex sync.Mutex
+	magicTCP      *magicDNSTCP
+	// magicTCPProxy and magicTCPDev are what magicTCP was last started
+	// for, so a failed start is not retried every tick
+	magicTCPProxy *olmdns.DNSProxy
+	magicTCPDev   *olmdevice.MiddleDevice
+)
+
+// dnsUDPSize is the largest UDP answer a query allows
+func dnsUDPSize(query *dns.Msg) int {
+	if opt := query.IsEdns0(); opt != nil && opt.UDPSize() > dns.MinMsgSize {
+		return int(opt.UDPSize())
+	}
+	return dns.MinMsgSize
+}
+
+// writeDNSReply answers a query, truncated to what the asker allows when it
+// asked over UDP
+func writeDNSReply(w dns.ResponseWriter, query, reply *dns.Msg) {
+	reply.Id = query.Id
+	if w.LocalAddr().Network() == "udp" {
+		reply.Truncate(dnsUDPSize(query))
+	}
+	_ = w.WriteMsg(reply)
+}
+
+// startLoopbackDNS listens on a free loopback port. Without TCP, which only
+// fails if another process took the port, large answers stay truncated.
+func startLoopbackDNS(what string, handler dns.HandlerFunc) (*loopbackDNS, error) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &loopbackDNS{addr: conn.LocalAddr().String()}
+	s.udp = &dns.Server{PacketConn: conn, Handler: supervisedDNSHandler(what, handler)}
+	servers := []*dns.Server{s.udp}
+	if listener, err := net.Listen("tcp", s.addr); err == nil {
+		s.tcp = &dns.Server{Listener: listener, Handler: supervisedDNSHandler(what, handler)}
+		servers = append(servers, s.tcp)
+	} else {
+		appLogger.Warn("No TCP for %s on %s: %v", what, s.addr, err)
+	}
+	for _, server := range servers {
+		go func() {
+			defer dumpOnPanic()
+			if err := server.ActivateAndServe(); err != nil {
+				appLogger.Debug("Loopback %s on %s stopped: %v", what, s.addr, err)
+			}
+		}()
+	}
+	return s, nil
+}
+
+// shutdown stops both listeners
+func (s *loopbackDNS) shutdown() {
+	for _, server := range []*dns.Server{s.udp, s.tcp} {
+		if server != nil {
+			_ = server.Shutdown()
+		}
+	}
+}
+
+// olmProxyStack returns the netstack olm's proxy answers queries in
+func olmProxyStack(proxy *olmdns.DNSProxy) (*stack.Stack, error) {
+	field := reflect.ValueOf(proxy).Elem().FieldByName("stack")
+	if !field.IsValid() || field.Type() != reflect.TypeOf((*stack.Stack)(nil)) {
+		return nil, fmt.Errorf("DNS proxy is not supported by this olm version")
+	}
+	s := (*stack.Stack)(unsafe.Pointer(field.Pointer()))
+	if s == nil {
+		return nil, fmt.Errorf("DNS proxy has no netstack")
+	}
+	return s, nil
+}
+
+// startMagicDNSTCP listens for TCP on the proxy's address in a netstack of
+// its own, fed from olm's packet path
+func startMagicDNSTCP(proxy *olmdns.DNSProxy, dev *olmdevice.MiddleDevice, mtu int) (*magicDNSTCP, error) {
+	addr := proxy.GetProxyIP()
+	if !addr.Is4() {
+		return nil, fmt.Errorf("DNS proxy has no IPv4 address")
+	}
+	if _, err := olmProxyStack(proxy); err != nil {
+		return nil, err
+	}
+
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol},
+		HandleLocal:        true,
+	})
+	ep := channel.New(256, uint32(mtu), "")
+	if err := s.CreateNIC(1, ep); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("failed to create NIC: %v", err)
+	}
+	protoAddr := tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddrFrom4(addr.As4()).WithPrefix(),
+	}
+	if err := s.AddProtocolAddress(1, protoAddr, stack.AddressProperties{}); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("failed to add address: %v", err)
+	}
+	s.AddRoute(tcpip.Route{Destination: header.IPv4EmptySubnet, NIC: 1})
+
+	listener, err := gonet.ListenTCP(s, tcpip.FullAddress{NIC: 1, Addr: tcpip.AddrFrom4(addr.As4()), Port: 53}, ipv4.ProtocolNumber)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &magicDNSTCP{proxy: proxy, dev: dev, addr: addr, stack: s, ep: ep, cancel: cancel}
+	m.server = &dns.Server{Listener: listener, Net: "tcp", Handler: supervisedDNSHandler("DNS over TCP", m.answer)}
+	go func() {
+		defer dumpOnPanic()
+		if err := m.server.ActivateAndServe(); err != nil {
+			appLogger.Debug("DNS over TCP on %s stopped: %v", addr, err)
+		}
+	}()
+	go m.sendPackets(ctx)
+	dev.AddRule(addr, m.handlePacket)
+	return m, nil
+}
+
+// handlePacket takes TCP to port 53 off olm's packet path. olm's own rule
+// for the address comes first and takes the UDP.
+func (m *magicDNSTCP) handlePacket(packet []byte) bool {
+	if m.closed.Load() {
+		return false
+	}
+	ip, ok := parseIPPacket(packet)
+	if !ok || ip.Version != 4 || ip.Protocol != ipProtoTCP || ip.Dst != m.addr || len(ip.Payload) < tcpHeaderMinLen {
+		return false
+	}
+	if binary.BigEndian.Uint16(ip.Payload[2:4]) != 53 {
+		return false
+	}
+	pkb := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(packet)})
+	m.ep.InjectInbound(ipv4.ProtocolNumber, pkb)
+	pkb.DecRef()
+	return true
+}
+
+// sendPackets writes the netstack's replies to the tunnel interface the way
+// olm's proxy does
+func (m *magicDNSTCP) sendPackets(ctx context.Context) {
+	defer dumpOnPanic()
+	// Room for WireGuard's transport header, which olm's device expects
+	const offset = 16
+	for {
+		pkt := m.ep.ReadContext(ctx)
+		if pkt == nil {
+			return
+		}
+		var size int
+		for _, slice := range pkt.AsSlices() {
+			size += len(slice)
+		}
+		buf := make([]byte, offset, offset+size)
+		for _, slice := range pkt.AsSlices() {
+			buf = append(buf, slice...)
+		}
+		pkt.DecRef()
+		if _, err := m.dev.WriteToTun([][]byte{buf}, offset); err != nil {
+			appLogger.Debug("Failed to write DNS over TCP reply: %v", err)
+		}
+	}
+}
+
+// answer relays a TCP query to olm's proxy
+func (m *magicDNSTCP) answer(w dns.ResponseWriter, query *dns.Msg) {
+	reply, err := m.relay(query)
+	if err != nil {
+		appLogger.Debug("DNS over TCP query failed: %v", err)
+		reply = new(dns.Msg)
+		reply.SetRcode(query, dns.RcodeServerFailure)
+	}
+	writeDNSReply(w, query, reply)
+}
+
+// relay asks olm's proxy over UDP from inside its netstack, allowing the
+// largest answer so the forwarders behind it send it whole
+func (m *magicDNSTCP) relay(query *dns.Msg) (*dns.Msg, error) {
+	s, err := olmProxyStack(m.proxy)
+	if err != nil {
+		return nil, err
+	}
+	out := query.Copy()
+	edns := out.IsEdns0() != nil
+	if edns {
+		out.IsEdns0().SetUDPSize(dns.MaxMsgSize)
+	} else {
+		out.SetEdns0(dns.MaxMsgSize, false)
+	}
+
+	local := tcpip.AddrFrom4(m.addr.As4())
+	conn, err := gonet.DialUDP(s, &tcpip.FullAddress{NIC: 1, Addr: local}, &tcpip.FullAddress{NIC: 1, Addr: local, Port: 53}, ipv4.ProtocolNumber)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(magicDNSTCPTimeout))
+
+	dnsConn := &dns.Conn{Conn: conn, UDPSize: dns.MaxMsgSize}
+	if err := dnsConn.WriteMsg(out); err != nil {
+		return nil, err
+	}
+	reply, err := dnsConn.ReadMsg()
+	if err != nil {
+		return nil, err
+	}
+	if !edns {
+		// The asker did not speak EDNS, so neither does the answer
+		extra := reply.Extra[:0]
+		for _, rr := range reply.Extra {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				extra = append(extra, rr)
+			}
+		}
+		reply.Extra = extra
+	}
+	return reply, nil
+}
+
+// stop closes the listener and netstack
+func (m *magicDNSTCP) stop() {
+	m.closed.Store(true)
+	_ = m.server.Shutdown()
+	m.cancel()
+	m.stack.Close()
+}
+
+// syncMagicDNSTCP follows olm's proxy and packet path. It runs on every olm
+// sync.
+func syncMagicDNSTCP() {
+	proxy := (*olmdns.DNSProxy)(olmPointerField("dnsProxy", reflect.TypeOf((*olmdns.DNSProxy)(nil))))
+	dev := olmMiddleDevice()
+
+	magicTCPMutex.Lock()
+	defer magicTCPMutex.Unlock()
+	if proxy == magicTCPProxy && dev == magicTCPDev {
+		return
+	}
+	if magicTCP != nil {
+		magicTCP.stop()
+		magicTCP = nil
+	}
+	magicTCPProxy, magicTCPDev = proxy, dev
+	if proxy == nil || dev == nil {
+		return
+	}
+
+	tunnelMutex.Lock()
+	mtu := olmTunnelConfig.MTU
+	tunnelMutex.Unlock()
+	if mtu <= 0 {
+		mtu = 1280
+	}
+	m, err := startMagicDNSTCP(proxy, dev, mtu)
+	if err != nil {
+		appLogger.Warn("DNS over TCP not available: %v", err)
+		return
+	}
+	magicTCP = m
+	appLogger.Info("Accepting DNS over TCP on %s", m.addr)
+}
+
+// stopMagicDNSTCP stops accepting TCP when the tunnel stops
+func stopMagicDNSTCP() {
+	magicTCPMutex.Lock()
+	defer magicTCPMutex.Unlock()
+	if magicTCP != nil {
+		magicTCP.stop()
+	}
+	magicTCP, magicTCPProxy, magicTCPDev = nil, nil, nil
+}
@@ -0,0 +1,340 @@
+package main
+
+import "C"
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fosrl/newt/network"
+	"github.com/fosrl/olm/peers"
+	"github.com/miekg/dns"
+	wgdevice "golang.zx2c4.com/wireguard/device"
+)
+
+const (
+	// domainRouteMinTTL keeps a route at least this long, so answers with
+	// tiny TTLs do not churn the routing table
+	domainRouteMinTTL = time.Minute
+	// domainRouteMaxTTL caps how long an address stays routed after its
+	// last answer
+	domainRouteMaxTTL = 24 * time.Hour
+	// maxDomainRouteAddrs bounds the routes a busy domain can add
+	maxDomainRouteAddrs = 1024
+)
+
+// DomainRoute sends the addresses a domain and its subdomains resolve to
+// through the tunnel, for split tunneling by name rather than by subnet.
+// ViaSiteID picks the site that carries them; zero leaves that to the sites'
+// own routes, e.g. an exit node.
+type DomainRoute struct {
+	Domain    string `json:"domain"`
+	ViaSiteID int    `json:"viaSiteId,omitempty"`
+}
+
+// DomainRouteEntry is one address routed for a domain
+type DomainRouteEntry struct {
+	Address   string    `json:"address"`
+	Domain    string    `json:"domain"`
+	Name      string    `json:"name"`
+	ViaSiteID int       `json:"viaSiteId,omitempty"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type domainRouteAddr struct {
+	rule    int
+	name    string
+	expires time.Time
+	// assigned is set once the address is on the site's WireGuard peer
+	assigned bool
+}
+
+var (
+	domainRoutesMutex sync.Mutex
+	domainRules       []DomainRoute
+	domainRouteAddrs  = map[netip.Addr]*domainRouteAddr{}
+	// domainRoutesOn skips the packet inspection while there are no rules
+	domainRoutesOn atomic.Bool
+)
+
+// parseDomainRoutes checks the rules and puts the domains in canonical form
+func parseDomainRoutes(rules []DomainRoute) ([]DomainRoute, error) {
+	parsed := make([]DomainRoute, 0, len(rules))
+	for _, rule := range rules {
+		domain := strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(rule.Domain), "*."), "."))
+		if _, ok := dns.IsDomainName(domain); !ok || domain == "" || !strings.Contains(domain, ".") {
+			return nil, fmt.Errorf("invalid domain %q", rule.Domain)
+		}
+		if rule.ViaSiteID < 0 {
+			return nil, fmt.Errorf("domain %s has an invalid site", domain)
+		}
+		if slices.ContainsFunc(parsed, func(r DomainRoute) bool { return r.Domain == domain }) {
+			return nil, fmt.Errorf("domain %s is listed more than once", domain)
+		}
+		parsed = append(parsed, DomainRoute{Domain: domain, ViaSiteID: rule.ViaSiteID})
+	}
+	return parsed, nil
+}
+
+// setDomainRoutes replaces the rules. Addresses routed for a removed rule
+// are dropped right away.
+func setDomainRoutes(rules []DomainRoute) error {
+	parsed, err := parseDomainRoutes(rules)
+	if err != nil {
+		return err
+	}
+
+	domainRoutesMutex.Lock()
+	domainRules = parsed
+	domainRouteAddrs = map[netip.Addr]*domainRouteAddr{}
+	domainRoutesMutex.Unlock()
+	domainRoutesOn.Store(len(parsed) > 0)
+
+	if len(parsed) > 0 {
+		// The answers are read off the tunnel device
+		wrapTunnelDevice()
+	}
+	for _, rule := range parsed {
+		appLogger.Info("Routing %s by name", rule.Domain)
+	}
+	return nil
+}
+
+// domainRuleFor returns the rule matching a name. Caller must hold
+// domainRoutesMutex.
+func domainRuleFor(name string) (int, bool) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for i, rule := range domainRules {
+		if name == rule.Domain || strings.HasSuffix(name, "."+rule.Domain) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// noteDomainRouteAnswer routes the addresses in an answer from olm's
+// resolver for a name a rule covers. The route follows the answer, so the
+// very first connection can still leave outside the tunnel.
+func noteDomainRouteAnswer(packet []byte) {
+	if !domainRoutesOn.Load() {
+		return
+	}
+	ip, ok := parseIPPacket(packet)
+	if !ok {
+		return
+	}
+	payload, ok := dnsPayload(packet, ip, false)
+	if !ok {
+		return
+	}
+	dnsProxyMutex.Lock()
+	proxy := dnsProxyAddr
+	dnsProxyMutex.Unlock()
+	var reply dns.Msg
+	if ip.Src != proxy || reply.Unpack(payload) != nil || len(reply.Question) == 0 || len(reply.Answer) == 0 {
+		return
+	}
+
+	domainRoutesMutex.Lock()
+	defer domainRoutesMutex.Unlock()
+	rule, ok := domainRuleFor(reply.Question[0].Name)
+	if !ok {
+		return
+	}
+	added := 0
+	now := time.Now()
+	for _, rr := range reply.Answer {
+		var addr netip.Addr
+		switch rr := rr.(type) {
+		case *dns.A:
+			addr, _ = netip.AddrFromSlice(rr.A.To4())
+		case *dns.AAAA:
+			addr, _ = netip.AddrFromSlice(rr.AAAA)
+		}
+		if !addr.IsValid() || addr.IsLoopback() || addr.IsUnspecified() {
+			continue
+		}
+		ttl := min(max(time.Duration(rr.Header().Ttl)*time.Second, domainRouteMinTTL), domainRouteMaxTTL)
+		if entry := domainRouteAddrs[addr]; entry != nil {
+			if expires := now.Add(ttl); expires.After(entry.expires) {
+				entry.expires = expires
+			}
+			continue
+		}
+		if len(domainRouteAddrs) >= maxDomainRouteAddrs {
+			continue
+		}
+		domainRouteAddrs[addr] = &domainRouteAddr{rule: rule, name: strings.TrimSuffix(reply.Question[0].Name, "."), expires: now.Add(ttl)}
+		added++
+	}
+	if added > 0 {
+		recordEvent(EventSettings, "%d address(es) routed for %s", added, domainRules[rule].Domain)
+		bumpSettingsVersion()
+	}
+}
+
+// applyDomainRoutes adds a host route into the tunnel for every address
+// routed by name
+func applyDomainRoutes(settings network.NetworkSettings) network.NetworkSettings {
+	domainRoutesMutex.Lock()
+	addrs := make([]netip.Addr, 0, len(domainRouteAddrs))
+	for addr := range domainRouteAddrs {
+		addrs = append(addrs, addr)
+	}
+	domainRoutesMutex.Unlock()
+	slices.SortFunc(addrs, netip.Addr.Compare)
+
+	for _, addr := range addrs {
+		cidr := netip.PrefixFrom(addr, addr.BitLen()).String()
+		if addr.Is4() {
+			if !slices.ContainsFunc(settings.IPv4IncludedRoutes, func(r network.IPv4Route) bool { return ipv4RouteCIDR(r) == cidr }) {
+				settings.IPv4IncludedRoutes = append(settings.IPv4IncludedRoutes, network.IPv4Route{
+					DestinationAddress: addr.String(),
+					SubnetMask:         net.IP(net.CIDRMask(32, 32)).String(),
+				})
+			}
+		} else if !slices.ContainsFunc(settings.IPv6IncludedRoutes, func(r network.IPv6Route) bool { return ipv6RouteCIDR(r) == cidr }) {
+			settings.IPv6IncludedRoutes = append(settings.IPv6IncludedRoutes, network.IPv6Route{
+				DestinationAddress:  addr.String(),
+				NetworkPrefixLength: 128,
+			})
+		}
+	}
+	return settings
+}
+
+// domainMatchDomains are the rule domains, which the resolver has to see
+// queries for when it only answers for the match domains
+func domainMatchDomains() []string {
+	domainRoutesMutex.Lock()
+	defer domainRoutesMutex.Unlock()
+	domains := make([]string, 0, len(domainRules))
+	for _, rule := range domainRules {
+		domains = append(domains, rule.Domain)
+	}
+	return domains
+}
+
+// syncDomainRoutes expires addresses whose answers ran out and assigns new
+// ones to their site's WireGuard peer. It runs on every olm sync, and with
+// the packet path sampler so answers expire on time.
+func syncDomainRoutes() {
+	if !domainRoutesOn.Load() {
+		return
+	}
+
+	domainRoutesMutex.Lock()
+	defer domainRoutesMutex.Unlock()
+
+	expired := 0
+	now := time.Now()
+	for addr, entry := range domainRouteAddrs {
+		if now.After(entry.expires) {
+			delete(domainRouteAddrs, addr)
+			expired++
+		}
+	}
+	if expired > 0 {
+		appLogger.Debug("%d route(s) by name expired", expired)
+		bumpSettingsVersion()
+	}
+
+	pm := (*peers.PeerManager)(olmPointerField("peerManager", reflect.TypeOf((*peers.PeerManager)(nil))))
+	dev := (*wgdevice.Device)(olmPointerField("dev", reflect.TypeOf((*wgdevice.Device)(nil))))
+	if pm == nil || dev == nil {
+		return
+	}
+	for addr, entry := range domainRouteAddrs {
+		via := domainRules[entry.rule].ViaSiteID
+		if entry.assigned || via == 0 {
+			continue
+		}
+		site, ok := pm.GetPeer(via)
+		if !ok {
+			continue
+		}
+		// Like the routes via a site, an expired address keeps its
+		// assignment; without the route no traffic reaches it
+		if err := peers.AddAllowedIP(dev, site.PublicKey, netip.PrefixFrom(addr, addr.BitLen()).String()); err != nil {
+			appLogger.Warn("Failed to route %s through site %d: %v", addr, via, err)
+			continue
+		}
+		entry.assigned = true
+	}
+}
+
+// resetDomainRoutes forgets the routed addresses when the tunnel stops
+func resetDomainRoutes() {
+	domainRoutesMutex.Lock()
+	domainRouteAddrs = map[netip.Addr]*domainRouteAddr{}
+	domainRoutesMutex.Unlock()
+}
+
+// setRoutesByDomain replaces the rules that route domains through the
+// tunnel at runtime. Takes a JSON array of {"domain", "viaSiteId"} objects;
+// an empty array removes them.
+//
+//export setRoutesByDomain
+func setRoutesByDomain(rulesJSON *C.char) *C.char {
+	if locked := managedLockResult("domainRoutes"); locked != nil {
+		return locked
+	}
+	var rules []DomainRoute
+	if err := decodeCompatJSON([]byte(C.GoString(rulesJSON)), &rules, "routes by domain"); err != nil {
+		appLogger.Error("Failed to parse domain routes: %v", err)
+		return exportString(fmt.Sprintf("Error: Failed to parse domain routes: %v", err))
+	}
+	if err := updateRoutesByDomain(rules); err != nil {
+		appLogger.Error("Invalid domain routes: %v", err)
+		return exportString(fmt.Sprintf("Error: Invalid domain routes: %v", err))
+	}
+	return exportString("Domain routes updated")
+}
+
+// updateRoutesByDomain replaces the running tunnel's routes by domain
+func updateRoutesByDomain(rules []DomainRoute) error {
+	if err := setDomainRoutes(rules); err != nil {
+		return err
+	}
+	tunnelMutex.Lock()
+	activeTunnelConfig.DomainRoutes = rules
+	tunnelMutex.Unlock()
+
+	bumpSettingsVersion()
+	return nil
+}
+
+// getRoutesByDomain returns the addresses currently routed by name, soonest
+// to expire first, as JSON
+//
+//export getRoutesByDomain
+func getRoutesByDomain() *C.char {
+	domainRoutesMutex.Lock()
+	entries := make([]DomainRouteEntry, 0, len(domainRouteAddrs))
+	for addr, entry := range domainRouteAddrs {
+		rule := domainRules[entry.rule]
+		entries = append(entries, DomainRouteEntry{
+			Address:   addr.String(),
+			Domain:    rule.Domain,
+			Name:      entry.name,
+			ViaSiteID: rule.ViaSiteID,
+			ExpiresAt: entry.expires,
+		})
+	}
+	domainRoutesMutex.Unlock()
+	slices.SortFunc(entries, func(a, b DomainRouteEntry) int { return a.ExpiresAt.Compare(b.ExpiresAt) })
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		appLogger.Error("Failed to marshal domain routes: %v", err)
+		return exportString("[]")
+	}
+	return exportString(string(data))
+}
@@ -0,0 +1,221 @@
+package main
+
+import "C"
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+const (
+	drainJob           = "drain"
+	drainCheckInterval = time.Second
+	// drainIdleAfter ends a drain early once no connection has carried
+	// traffic for this long, e.g. because the transfer it waited for is done
+	drainIdleAfter = 5 * time.Second
+	// maxDrainSeconds bounds how long a stop can be put off
+	maxDrainSeconds = 600
+)
+
+// DrainStatus is the JSON returned by getDrainStatus
+type DrainStatus struct {
+	Draining         bool      `json:"draining"`
+	StartedAt        time.Time `json:"startedAt,omitempty"`
+	RemainingSeconds int       `json:"remainingSeconds"`
+	// ActiveConnections is the number of TCP connections that carried
+	// traffic within the last few seconds
+	ActiveConnections int `json:"activeConnections"`
+	// RefusedConnections counts new connections turned away so far
+	RefusedConnections int `json:"refusedConnections"`
+}
+
+// drainFlow identifies a TCP connection, local side first
+type drainFlow struct {
+	local, remote netip.AddrPort
+}
+
+var (
+	// drainActive is read on every packet; the rest is under drainMutex
+	drainActive      atomic.Bool
+	drainMutex       sync.Mutex
+	drainStartedAt   time.Time
+	drainDeadline    time.Time
+	drainLastTraffic time.Time
+	drainFlows       map[drainFlow]time.Time
+	drainRefused     int
+)
+
+// startDrain stops the tunnel once existing connections have finished or
+// after seconds, whichever comes first. Until then new TCP connections are
+// refused in both directions; everything else keeps flowing, since there is
+// no telling a new UDP conversation from an old one. Caller must hold
+// tunnelMutex.
+func startDrain(seconds int) {
+	now := time.Now()
+	drainMutex.Lock()
+	drainStartedAt = now
+	drainDeadline = now.Add(time.Duration(min(seconds, maxDrainSeconds)) * time.Second)
+	drainLastTraffic = now
+	drainFlows = make(map[drainFlow]time.Time)
+	drainRefused = 0
+	drainMutex.Unlock()
+
+	// Refusing connections needs to see every packet
+	wrapTunnelDevice()
+	drainActive.Store(true)
+
+	appLogger.Info("Draining the tunnel for up to %v before stopping", drainDeadline.Sub(now))
+	recordEvent(EventState, "tunnel draining")
+	scheduleJob(drainJob, false, func() time.Duration { return drainCheckInterval }, checkDrain)
+}
+
+// cancelDrain abandons a drain without stopping the tunnel. It reports
+// whether one was running.
+func cancelDrain() bool {
+	cancelJob(drainJob)
+	return drainActive.Swap(false)
+}
+
+// checkDrain stops the tunnel when the drain is done
+func checkDrain(ctx context.Context) {
+	now := time.Now()
+	drainMutex.Lock()
+	done := !now.Before(drainDeadline) ||
+		(now.Sub(drainStartedAt) >= drainIdleAfter && now.Sub(drainLastTraffic) >= drainIdleAfter)
+	drainMutex.Unlock()
+	if !done {
+		return
+	}
+
+	status := currentDrainStatus()
+	tunnelMutex.Lock()
+	defer tunnelMutex.Unlock()
+	if ctx.Err() != nil || !cancelDrain() || !tunnelRunning {
+		return
+	}
+
+	appLogger.Info("Drain finished with %d active connections, stopping the tunnel", status.ActiveConnections)
+	shutdownTunnel(defaultStopDeadline, drainJob)
+}
+
+func currentDrainStatus() DrainStatus {
+	if !drainActive.Load() {
+		return DrainStatus{}
+	}
+
+	drainMutex.Lock()
+	defer drainMutex.Unlock()
+	now := time.Now()
+	status := DrainStatus{
+		Draining:           true,
+		StartedAt:          drainStartedAt,
+		RemainingSeconds:   int(max(drainDeadline.Sub(now), 0).Round(time.Second).Seconds()),
+		RefusedConnections: drainRefused,
+	}
+	for _, seen := range drainFlows {
+		if now.Sub(seen) < drainIdleAfter {
+			status.ActiveConnections++
+		}
+	}
+	return status
+}
+
+// drainAdmits decides whether a packet may pass while draining. A packet
+// that opens a TCP connection is refused; one the host sent is answered with
+// a reset so the application fails right away instead of timing out.
+func drainAdmits(dev tun.Device, packet []byte, offset int, outbound bool) bool {
+	if !drainActive.Load() {
+		return true
+	}
+	ip, ok := parseIPPacket(packet)
+	if !ok || ip.Protocol != ipProtoTCP || len(ip.Payload) < tcpHeaderMinLen ||
+		(ip.Version == 4 && !ipv4IsFirstFragment(packet)) {
+		return true
+	}
+
+	tcp := ip.Payload
+	flags := tcp[13]
+	src := netip.AddrPortFrom(ip.Src, binary.BigEndian.Uint16(tcp[0:2]))
+	dst := netip.AddrPortFrom(ip.Dst, binary.BigEndian.Uint16(tcp[2:4]))
+	flow := drainFlow{local: src, remote: dst}
+	if !outbound {
+		flow = drainFlow{local: dst, remote: src}
+	}
+
+	if flags&tcpFlagSYN != 0 && flags&tcpFlagACK == 0 {
+		drainMutex.Lock()
+		drainRefused++
+		drainMutex.Unlock()
+		if outbound {
+			if err := writeToHost(dev, tcpResetFor(ip), offset); err != nil {
+				appLogger.Debug("Failed to refuse connection to %s: %v", dst, err)
+			}
+		}
+		return false
+	}
+
+	now := time.Now()
+	drainMutex.Lock()
+	drainLastTraffic = now
+	if flags&tcpFlagRST != 0 {
+		delete(drainFlows, flow)
+	} else {
+		drainFlows[flow] = now
+	}
+	drainMutex.Unlock()
+	return true
+}
+
+// tcpResetFor builds the RST that refuses the connection a SYN opens
+func tcpResetFor(syn ipPacket) []byte {
+	headerLen := ipv4HeaderMinLen
+	if syn.Version == 6 {
+		headerLen = ipv6HeaderLen
+	}
+	reply := make([]byte, headerLen+tcpHeaderMinLen)
+
+	if syn.Version == 4 {
+		reply[0] = 0x45
+		binary.BigEndian.PutUint16(reply[2:4], uint16(len(reply)))
+		reply[8] = 64 // TTL
+		reply[9] = ipProtoTCP
+		copy(reply[12:16], syn.Dst.AsSlice())
+		copy(reply[16:20], syn.Src.AsSlice())
+		setIPv4HeaderChecksum(reply)
+	} else {
+		reply[0] = 0x60
+		binary.BigEndian.PutUint16(reply[4:6], tcpHeaderMinLen)
+		reply[6] = ipProtoTCP
+		reply[7] = 64 // hop limit
+		copy(reply[8:24], syn.Dst.AsSlice())
+		copy(reply[24:40], syn.Src.AsSlice())
+	}
+
+	tcp := reply[headerLen:]
+	copy(tcp[0:2], syn.Payload[2:4])
+	copy(tcp[2:4], syn.Payload[0:2])
+	binary.BigEndian.PutUint32(tcp[8:12], binary.BigEndian.Uint32(syn.Payload[4:8])+1)
+	tcp[12] = (tcpHeaderMinLen / 4) << 4
+	tcp[13] = tcpFlagRST | tcpFlagACK
+	sum := pseudoHeaderSum(syn.Dst, syn.Src, ipProtoTCP, len(tcp))
+	binary.BigEndian.PutUint16(tcp[16:18], checksumFinish(checksumAdd(sum, tcp)))
+	return reply
+}
+
+// getDrainStatus reports the progress of a draining stop as JSON
+//
+//export getDrainStatus
+func getDrainStatus() *C.char {
+	data, err := json.Marshal(currentDrainStatus())
+	if err != nil {
+		appLogger.Error("Failed to marshal drain status: %v", err)
+		return exportString(`{"draining":false}`)
+	}
+	return exportString(string(data))
+}
@@ -0,0 +1,127 @@
+package main
+
+import "C"
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"syscall"
+
+	"github.com/fosrl/newt/bind"
+)
+
+var (
+	dscpMutex sync.Mutex
+	// dscpValue is the DSCP codepoint for the tunnel's UDP packets, or -1 to
+	// leave the system default alone
+	dscpValue = -1
+	dscpConn  *net.UDPConn
+)
+
+// setDSCPValue changes the codepoint
+func setDSCPValue(value int) error {
+	if value < -1 || value > 63 {
+		return fmt.Errorf("DSCP must be between 0 and 63, or -1 to disable")
+	}
+
+	dscpMutex.Lock()
+	changed := value != dscpValue
+	dscpValue = value
+	if changed {
+		// Remark the socket on the next sync
+		dscpConn = nil
+	}
+	dscpMutex.Unlock()
+
+	if changed {
+		requestOlmSync()
+		if value < 0 {
+			appLogger.Info("DSCP marking disabled")
+		} else {
+			appLogger.Info("Marking tunnel packets with DSCP %d", value)
+		}
+	}
+	return nil
+}
+
+// markSocketDSCP sets the traffic class of every packet sent on conn. The
+// socket may be IPv4, IPv6 or dual-stack, so both options are tried.
+func markSocketDSCP(conn *net.UDPConn, dscp int) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	tos := dscp << 2
+	var v4Err, v6Err error
+	if err := raw.Control(func(fd uintptr) {
+		v4Err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+		v6Err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos)
+	}); err != nil {
+		return err
+	}
+	if v4Err != nil && v6Err != nil {
+		return v4Err
+	}
+	return nil
+}
+
+// syncDSCPMarking marks olm's UDP socket. olm replaces the socket when it
+// rebinds after a network change and on every tunnel start, so this runs
+// on every olm sync.
+func syncDSCPMarking() {
+	sharedBind := (*bind.SharedBind)(olmPointerField("sharedBind", reflect.TypeOf((*bind.SharedBind)(nil))))
+	if sharedBind == nil {
+		return
+	}
+	conn := sharedBind.GetUDPConn()
+
+	dscpMutex.Lock()
+	defer dscpMutex.Unlock()
+
+	if conn == nil || conn == dscpConn {
+		return
+	}
+	// Without a value the socket keeps the system default, which is 0
+	value := max(dscpValue, 0)
+	if err := markSocketDSCP(conn, value); err != nil {
+		appLogger.Warn("Failed to set DSCP on the tunnel socket: %v", err)
+	}
+	dscpConn = conn
+}
+
+// setDSCP changes the DSCP codepoint of the tunnel's UDP packets at runtime.
+// -1 disables marking. Every encapsulated packet carries this one value;
+// the DSCP of the packets inside is not copied out, as wireguard-go sends
+// them all on one socket without a per-packet hook where the outer header
+// could take it.
+//
+//export setDSCP
+func setDSCP(value C.int) *C.char {
+	if locked := managedLockResult("dscp"); locked != nil {
+		return locked
+	}
+	dscp := int(value)
+	if err := updateDSCP(&dscp); err != nil {
+		appLogger.Error("Invalid DSCP value: %v", err)
+		return exportString(fmt.Sprintf("Error: %v", err))
+	}
+	return exportString("DSCP updated")
+}
+
+// updateDSCP changes the running tunnel's codepoint. nil disables marking,
+// as a config without one does at startTunnel.
+func updateDSCP(dscp *int) error {
+	value := -1
+	if dscp != nil {
+		value = *dscp
+	}
+	if err := setDSCPValue(value); err != nil {
+		return err
+	}
+	tunnelMutex.Lock()
+	activeTunnelConfig.DSCP = dscp
+	tunnelMutex.Unlock()
+	return nil
+}
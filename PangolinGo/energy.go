@@ -0,0 +1,203 @@
+package main
+
+import "C"
+import (
+	"bufio"
+	"encoding/json"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	wgdevice "golang.zx2c4.com/wireguard/device"
+)
+
+const (
+	// energyHours is how many completed hours are kept for comparison
+	energyHours = 24
+	// keepaliveSampleInterval is how often WireGuard's counters are read to
+	// account for keepalives
+	keepaliveSampleInterval = time.Minute
+	// keepaliveWireSize is a keepalive on the wire: an empty transport
+	// message plus the UDP and IPv4 headers
+	keepaliveWireSize = 32 + 28
+)
+
+// EnergyHour holds the energy counters of one hour
+type EnergyHour struct {
+	Start time.Time `json:"start"`
+	// Wakeups counts scheduler wakeups, and TimerFires the periodic jobs
+	// they ran
+	Wakeups    uint64 `json:"wakeups"`
+	TimerFires uint64 `json:"timerFires"`
+	// CgoCalls counts calls from Go into C, mostly log messages and strings
+	// handed to Swift
+	CgoCalls uint64 `json:"cgoCalls"`
+	// KeepaliveBytes estimates WireGuard keepalive traffic. A keepalive is
+	// counted per interval only while the peer sent no more than keepalives.
+	KeepaliveBytes uint64 `json:"keepaliveBytes"`
+}
+
+// EnergyStats is the JSON returned by getEnergyStats
+type EnergyStats struct {
+	Since time.Time `json:"since"`
+	// PerHour averages the counters over the time since Since
+	PerHour EnergyRates `json:"perHour"`
+	Current EnergyHour  `json:"current"`
+	// Hours are the completed hours, oldest first
+	Hours []EnergyHour `json:"hours"`
+}
+
+// EnergyRates are counters per hour
+type EnergyRates struct {
+	Wakeups        float64 `json:"wakeups"`
+	TimerFires     float64 `json:"timerFires"`
+	CgoCalls       float64 `json:"cgoCalls"`
+	KeepaliveBytes float64 `json:"keepaliveBytes"`
+}
+
+var (
+	energyMutex   sync.Mutex
+	energySince   = time.Now()
+	energyCurrent = EnergyHour{Start: time.Now()}
+	energyHistory []EnergyHour
+	energyTotals  EnergyHour
+	// energyCgoBase is runtime.NumCgoCall at the last roll
+	energyCgoBase = runtime.NumCgoCall()
+	// keepaliveTx is each peer's tx_bytes at the last keepalive sample
+	keepaliveTx       = map[string]uint64{}
+	keepaliveSampleAt time.Time
+)
+
+// rollEnergyHour closes the current hour once it is over. Caller must hold
+// energyMutex.
+func rollEnergyHour(now time.Time) {
+	cgo := runtime.NumCgoCall()
+	energyCurrent.CgoCalls += uint64(cgo - energyCgoBase)
+	energyTotals.CgoCalls += uint64(cgo - energyCgoBase)
+	energyCgoBase = cgo
+
+	if now.Sub(energyCurrent.Start) < time.Hour {
+		return
+	}
+	energyHistory = append(energyHistory, energyCurrent)
+	if len(energyHistory) > energyHours {
+		energyHistory = energyHistory[len(energyHistory)-energyHours:]
+	}
+	energyCurrent = EnergyHour{Start: now}
+}
+
+// noteEnergyWakeup counts one scheduler wakeup and the jobs it ran
+func noteEnergyWakeup(jobs int) {
+	energyMutex.Lock()
+	defer energyMutex.Unlock()
+	rollEnergyHour(time.Now())
+	energyCurrent.Wakeups++
+	energyCurrent.TimerFires += uint64(jobs)
+	energyTotals.Wakeups++
+	energyTotals.TimerFires += uint64(jobs)
+}
+
+// peerKeepalives reads each peer's keepalive interval and sent bytes
+func peerKeepalives(dev *wgdevice.Device) (intervals map[string]time.Duration, tx map[string]uint64, err error) {
+	config, err := dev.IpcGet()
+	if err != nil {
+		return nil, nil, err
+	}
+	intervals, tx = map[string]time.Duration{}, map[string]uint64{}
+	var peer string
+	scanner := bufio.NewScanner(strings.NewReader(config))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "public_key":
+			peer = value
+		case "persistent_keepalive_interval":
+			if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+				intervals[peer] = time.Duration(seconds) * time.Second
+			}
+		case "tx_bytes":
+			tx[peer], _ = strconv.ParseUint(value, 10, 64)
+		}
+	}
+	return intervals, tx, nil
+}
+
+// syncEnergy accounts for the keepalives sent since the last sample. It
+// runs with the packet path sampler but reads WireGuard only once a minute.
+func syncEnergy() {
+	energyMutex.Lock()
+	defer energyMutex.Unlock()
+	now := time.Now()
+	if now.Sub(keepaliveSampleAt) < keepaliveSampleInterval {
+		return
+	}
+	dev := (*wgdevice.Device)(olmPointerField("dev", reflect.TypeOf((*wgdevice.Device)(nil))))
+	if dev == nil {
+		return
+	}
+	intervals, tx, err := peerKeepalives(dev)
+	if err != nil {
+		return
+	}
+
+	elapsed := now.Sub(keepaliveSampleAt)
+	var keepalives uint64
+	for peer, interval := range intervals {
+		last, ok := keepaliveTx[peer]
+		if !ok || tx[peer] < last {
+			continue
+		}
+		// A peer that sent data needed no keepalives for that stretch
+		sent := (tx[peer] - last) / 32
+		keepalives += min(uint64(elapsed/interval), sent)
+	}
+	keepaliveTx, keepaliveSampleAt = tx, now
+
+	rollEnergyHour(now)
+	energyCurrent.KeepaliveBytes += keepalives * keepaliveWireSize
+	energyTotals.KeepaliveBytes += keepalives * keepaliveWireSize
+}
+
+// resetKeepaliveSample forgets the peers' counters when the tunnel stops;
+// the next device starts from zero
+func resetKeepaliveSample() {
+	energyMutex.Lock()
+	keepaliveTx, keepaliveSampleAt = map[string]uint64{}, time.Time{}
+	energyMutex.Unlock()
+}
+
+// getEnergyStats returns the wakeups, timer fires, cgo calls and keepalive
+// bytes per hour as JSON, so battery regressions between releases show up
+// as numbers
+//
+//export getEnergyStats
+func getEnergyStats() *C.char {
+	energyMutex.Lock()
+	now := time.Now()
+	rollEnergyHour(now)
+	stats := EnergyStats{Since: energySince, Current: energyCurrent, Hours: append([]EnergyHour{}, energyHistory...)}
+	totals := energyTotals
+	energyMutex.Unlock()
+
+	if hours := now.Sub(energySince).Hours(); hours > 0 {
+		stats.PerHour = EnergyRates{
+			Wakeups:        float64(totals.Wakeups) / hours,
+			TimerFires:     float64(totals.TimerFires) / hours,
+			CgoCalls:       float64(totals.CgoCalls) / hours,
+			KeepaliveBytes: float64(totals.KeepaliveBytes) / hours,
+		}
+	}
+
+	data, err := json.Marshal(stats)
+	if err != nil {
+		appLogger.Error("Failed to marshal energy stats: %v", err)
+		return exportString(`{"hours":[]}`)
+	}
+	return exportString(string(data))
+}
@@ -0,0 +1,187 @@
+package main
+
+/*
+#include <stdint.h>
+#include <stdlib.h>
+
+// pangolin_event_callback receives one event as a JSON object. The string is
+// only valid for the duration of the call.
+typedef void (*pangolin_event_callback)(const char *event, void *context);
+
+static inline void pangolin_call_event_callback(pangolin_event_callback callback, const char *event, void *context) {
+	callback(event, context);
+}
+*/
+import "C"
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// Event types pushed to registered callbacks
+const (
+	// BridgeEventState: the tunnel state reported by getTunnelStatus changed
+	BridgeEventState = "state"
+	// BridgeEventSettings: the network settings token moved; Version is what
+	// getNetworkSettingsVersion now returns
+	BridgeEventSettings = "settings"
+	// BridgeEventHandshake: the first site completed its handshake since the
+	// tunnel started
+	BridgeEventHandshake = "handshake"
+	BridgeEventPeerUp    = "peer_up"
+	BridgeEventPeerDown  = "peer_down"
+	// BridgeEventDNSFailure: an upstream DNS server stopped answering or
+	// could not be resolved
+	BridgeEventDNSFailure = "dns_failure"
+	// BridgeEventSubsystemRestart: a supervised subsystem recovered from a
+	// panic; see getSubsystemHealth
+	BridgeEventSubsystemRestart = "subsystem_restart"
+	// BridgeEventReconnect: the reconnect supervisor is restarting a stuck
+	// tunnel; Attempt counts since it was last connected
+	BridgeEventReconnect = "reconnect"
+)
+
+// eventQueueSize bounds the events waiting for slow callbacks; beyond it new
+// events are dropped
+const eventQueueSize = 256
+
+// BridgeEvent is the JSON passed to event callbacks. Fields that do not apply
+// to the type are omitted.
+type BridgeEvent struct {
+	Type      string    `json:"type"`
+	At        time.Time `json:"at"`
+	State     string    `json:"state,omitempty"`
+	SiteID    int       `json:"siteId,omitempty"`
+	Version   int       `json:"version,omitempty"`
+	Subsystem string    `json:"subsystem,omitempty"`
+	Attempt   int       `json:"attempt,omitempty"`
+	Message   string    `json:"message,omitempty"`
+	// settingsMoved is a settings event published without a token, which
+	// is read when the event is delivered and dropped if it did not move
+	settingsMoved bool
+}
+
+type eventCallback struct {
+	callback C.pangolin_event_callback
+	context  unsafe.Pointer
+}
+
+var (
+	// eventCallbacksMutex is held for reading while callbacks run, so
+	// unregisterEventCallback returns only once its callback is done
+	eventCallbacksMutex sync.RWMutex
+	eventCallbacks      = map[int]eventCallback{}
+	eventNextID         = 1
+	eventDropped        atomic.Int64
+
+	eventQueue        = make(chan BridgeEvent, eventQueueSize)
+	eventDispatchOnce sync.Once
+	// eventSettingsToken is the token of the last settings event delivered;
+	// only the dispatcher touches it
+	eventSettingsToken = -1
+)
+
+// hasEventCallbacks reports whether anyone is listening
+func hasEventCallbacks() bool {
+	eventCallbacksMutex.RLock()
+	defer eventCallbacksMutex.RUnlock()
+	return len(eventCallbacks) > 0
+}
+
+// publishEvent queues an event for the registered callbacks. It never
+// blocks, so it is safe to call with locks held.
+func publishEvent(event BridgeEvent) {
+	if !hasEventCallbacks() {
+		return
+	}
+	event.At = time.Now()
+	select {
+	case eventQueue <- event:
+	default:
+		if dropped := eventDropped.Add(1); dropped == 1 || dropped%100 == 0 {
+			appLogger.Warn("Event callbacks are not keeping up; %d event(s) dropped", dropped)
+		}
+	}
+}
+
+// publishSettingsMoved queues a settings event for notifySettingsChanged.
+// The token is read on delivery rather than here, since the caller may hold
+// tunnelMutex.
+func publishSettingsMoved() {
+	publishEvent(BridgeEvent{Type: BridgeEventSettings, settingsMoved: true})
+}
+
+// dispatchEvents hands queued events to the callbacks, one at a time and in
+// order
+func dispatchEvents() {
+	for event := range eventQueue {
+		if event.Type == BridgeEventSettings {
+			if event.settingsMoved {
+				event.Version = settingsChangeToken()
+				if event.Version == eventSettingsToken {
+					continue
+				}
+			}
+			eventSettingsToken = event.Version
+		}
+		data, err := json.Marshal(event)
+		if err != nil {
+			appLogger.Error("Failed to marshal event: %v", err)
+			continue
+		}
+		cEvent := C.CString(string(data))
+		eventCallbacksMutex.RLock()
+		for _, cb := range eventCallbacks {
+			C.pangolin_call_event_callback(cb.callback, cEvent, cb.context)
+		}
+		eventCallbacksMutex.RUnlock()
+		C.free(unsafe.Pointer(cEvent))
+	}
+}
+
+// registerEventCallback registers a C function that Go calls with every
+// event as JSON, along with context, which Go passes through untouched.
+// Events are delivered in order on a Go thread, one at a time; a callback
+// should hand them off rather than block. Registering pushes a "settings"
+// event with the current token, so Swift can register and then rely on
+// events alone. Returns an ID for unregisterEventCallback, or 0 if callback
+// is NULL.
+//
+//export registerEventCallback
+func registerEventCallback(callback C.pangolin_event_callback, context unsafe.Pointer) C.int {
+	if callback == nil {
+		return 0
+	}
+	eventDispatchOnce.Do(func() { go dispatchEvents() })
+
+	eventCallbacksMutex.Lock()
+	id := eventNextID
+	eventNextID++
+	eventCallbacks[id] = eventCallback{callback: callback, context: context}
+	eventCallbacksMutex.Unlock()
+
+	appLogger.Debug("Registered event callback %d", id)
+	publishEvent(BridgeEvent{Type: BridgeEventSettings, Version: settingsChangeToken()})
+	return C.int(id)
+}
+
+// unregisterEventCallback removes a callback. Once it returns the callback
+// is not running and will not be called again, so its context can be freed.
+// It must not be called from within a callback.
+//
+//export unregisterEventCallback
+func unregisterEventCallback(id C.int) *C.char {
+	eventCallbacksMutex.Lock()
+	_, ok := eventCallbacks[int(id)]
+	delete(eventCallbacks, int(id))
+	eventCallbacksMutex.Unlock()
+
+	if !ok {
+		return exportString("Error: Unknown event callback")
+	}
+	appLogger.Debug("Unregistered event callback %d", id)
+	return exportString("Event callback unregistered")
+}
@@ -0,0 +1,181 @@
+package main
+
+import "C"
+import (
+	"net/netip"
+	"reflect"
+	"slices"
+	"sync"
+
+	"github.com/fosrl/newt/network"
+	"github.com/fosrl/olm/peers"
+)
+
+const exitLANHook = "exitlan"
+
+var (
+	exitLANMutex sync.RWMutex
+	// exitLANAllowed lets the client reach the LAN of the site it uses as
+	// its exit node; when false that site only carries internet traffic
+	exitLANAllowed = true
+	// exitLANRanges are the exit site's LAN subnets while they are blocked
+	exitLANRanges []netip.Prefix
+)
+
+// setExitNodeLANAccess changes the policy for the exit site's LAN
+func setExitNodeLANAccess(allowed bool) {
+	exitLANMutex.Lock()
+	changed := allowed != exitLANAllowed
+	exitLANAllowed = allowed
+	if allowed {
+		exitLANRanges = nil
+	}
+	exitLANMutex.Unlock()
+
+	if allowed {
+		unregisterPacketHook(exitLANHook)
+	} else {
+		registerPacketHook(exitLANHook, hookPriorityExitLAN, installExitLAN)
+	}
+	if changed {
+		if allowed {
+			appLogger.Info("Exit node LAN access allowed")
+		} else {
+			appLogger.Info("Exit node limited to internet traffic")
+		}
+		bumpSettingsVersion()
+	}
+}
+
+func blockedExitLANRanges() []netip.Prefix {
+	exitLANMutex.RLock()
+	defer exitLANMutex.RUnlock()
+	return exitLANRanges
+}
+
+func isDefaultRoute(cidr string) bool {
+	return cidr == "0.0.0.0/0" || cidr == "::/0"
+}
+
+// exitSiteLANRanges returns the subnets published by the sites that carry a
+// default route
+func exitSiteLANRanges(sites []peers.SiteConfig) []netip.Prefix {
+	var ranges []netip.Prefix
+	for _, site := range sites {
+		if !slices.ContainsFunc(site.AllowedIps, isDefaultRoute) && !slices.ContainsFunc(site.RemoteSubnets, isDefaultRoute) {
+			continue
+		}
+		for _, subnet := range site.RemoteSubnets {
+			if isDefaultRoute(subnet) {
+				continue
+			}
+			if prefix, err := netip.ParsePrefix(subnet); err == nil {
+				ranges = append(ranges, prefix.Masked())
+			}
+		}
+	}
+	return ranges
+}
+
+// syncExitNodeLAN tracks which subnets belong to the exit site. Sites are
+// added and updated while the tunnel runs, so this runs on every olm sync.
+func syncExitNodeLAN() {
+	exitLANMutex.RLock()
+	allowed := exitLANAllowed
+	exitLANMutex.RUnlock()
+	if allowed {
+		return
+	}
+
+	pm := (*peers.PeerManager)(olmPointerField("peerManager", reflect.TypeOf((*peers.PeerManager)(nil))))
+	if pm == nil {
+		return
+	}
+	ranges := exitSiteLANRanges(pm.GetAllPeers())
+
+	exitLANMutex.Lock()
+	changed := !exitLANAllowed && !slices.Equal(ranges, exitLANRanges)
+	if changed {
+		exitLANRanges = ranges
+	}
+	exitLANMutex.Unlock()
+
+	if changed {
+		appLogger.Info("Blocking exit site LAN ranges: %v", ranges)
+		recordEvent(EventSettings, "exit site LAN ranges blocked: %v", ranges)
+		bumpSettingsVersion()
+	}
+}
+
+func exitLANBlocks(addr netip.Addr) bool {
+	for _, prefix := range blockedExitLANRanges() {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyExitLANRoutes drops the routes olm publishes for the exit site's LAN
+// while the default route sends everything else through it
+func applyExitLANRoutes(settings network.NetworkSettings) network.NetworkSettings {
+	if len(blockedExitLANRanges()) == 0 {
+		return settings
+	}
+
+	var v4 []network.IPv4Route
+	for _, route := range settings.IPv4IncludedRoutes {
+		if prefix, err := netip.ParsePrefix(ipv4RouteCIDR(route)); route.IsDefault || err != nil || !exitLANBlocks(prefix.Addr()) {
+			v4 = append(v4, route)
+		}
+	}
+	settings.IPv4IncludedRoutes = v4
+
+	var v6 []network.IPv6Route
+	for _, route := range settings.IPv6IncludedRoutes {
+		if prefix, err := netip.ParsePrefix(ipv6RouteCIDR(route)); route.IsDefault || err != nil || !exitLANBlocks(prefix.Addr()) {
+			v6 = append(v6, route)
+		}
+	}
+	settings.IPv6IncludedRoutes = v6
+
+	return settings
+}
+
+// installExitLAN drops traffic from the exit site's LAN. Packets for those
+// ranges still leave through the default route, so like the firewall this
+// blocks conversations through their return traffic.
+func installExitLAN(dev *hookDevice, settings network.NetworkSettings) {
+	for _, addr := range tunnelAddresses(settings) {
+		dev.AddRule(addr, func(packet []byte) bool {
+			ip, ok := parseIPPacket(packet)
+			return ok && exitLANBlocks(ip.Src)
+		})
+	}
+}
+
+// setExitNodeLANAllowed changes whether the client may reach the LAN of the
+// site it uses as exit node. allowed is 0 to limit that site to internet
+// traffic and non-zero to allow its LAN.
+//
+//export setExitNodeLANAllowed
+func setExitNodeLANAllowed(allowed C.int) *C.char {
+	if locked := managedLockResult("exitNodeLanAccess"); locked != nil {
+		return locked
+	}
+	value := allowed != 0
+	updateExitNodeLANAllowed(&value)
+	if value {
+		return exportString("Exit node LAN access allowed")
+	}
+	return exportString("Exit node LAN access blocked")
+}
+
+// updateExitNodeLANAllowed changes the running tunnel's LAN access through
+// an exit node; nil allows it, as at startTunnel
+func updateExitNodeLANAllowed(allowed *bool) {
+	setExitNodeLANAccess(allowed == nil || *allowed)
+	tunnelMutex.Lock()
+	activeTunnelConfig.ExitNodeLANAccess = allowed
+	tunnelMutex.Unlock()
+}
@@ -0,0 +1,229 @@
+package main
+
+import "C"
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/fosrl/newt/network"
+)
+
+const exposureHook = "exposure"
+
+// InboundExposure controls which local services peers can reach over the
+// tunnel when the server policy lets them connect to this client at all
+type InboundExposure struct {
+	// Enabled shares local services; when false every connection a peer
+	// starts is dropped
+	Enabled bool `json:"enabled"`
+	// AllowedPorts limits sharing to the given ports, written as "22",
+	// "8000-8100", or with a protocol as "tcp/22" or "udp/5353". Empty
+	// shares every port.
+	AllowedPorts []string `json:"allowedPorts"`
+}
+
+// InboundExposureStatus is what getInboundExposure reports and the status
+// snapshot carries
+type InboundExposureStatus struct {
+	Enabled      bool     `json:"enabled"`
+	AllowedPorts []string `json:"allowedPorts"`
+	// AllPorts is set when sharing is on without a port list
+	AllPorts bool   `json:"allPorts"`
+	Accepted uint64 `json:"accepted"`
+	Blocked  uint64 `json:"blocked"`
+}
+
+type exposedPorts struct {
+	protocol int // 0 for tcp and udp
+	low      uint16
+	high     uint16
+}
+
+type exposurePolicy struct {
+	config   InboundExposure
+	ports    []exposedPorts
+	accepted atomic.Uint64
+	blocked  atomic.Uint64
+}
+
+var (
+	exposureMutex  sync.RWMutex
+	activeExposure *exposurePolicy
+)
+
+// parseExposedPorts parses one AllowedPorts entry
+func parseExposedPorts(entry string) (exposedPorts, error) {
+	var ports exposedPorts
+	protocol, portRange, hasProtocol := strings.Cut(entry, "/")
+	if !hasProtocol {
+		portRange = protocol
+	} else {
+		switch strings.ToLower(protocol) {
+		case "tcp":
+			ports.protocol = ipProtoTCP
+		case "udp":
+			ports.protocol = ipProtoUDP
+		default:
+			return ports, fmt.Errorf("unknown protocol in %q", entry)
+		}
+	}
+	if portRange == "" {
+		return ports, fmt.Errorf("missing port in %q", entry)
+	}
+
+	var err error
+	ports.low, ports.high, err = parsePortRange(portRange)
+	return ports, err
+}
+
+// setInboundExposureConfig replaces the exposure policy. A nil config leaves
+// inbound connections to the server policy alone.
+func setInboundExposureConfig(config *InboundExposure) error {
+	var policy *exposurePolicy
+	if config != nil {
+		policy = &exposurePolicy{config: *config}
+		for _, entry := range config.AllowedPorts {
+			ports, err := parseExposedPorts(entry)
+			if err != nil {
+				return err
+			}
+			policy.ports = append(policy.ports, ports)
+		}
+	}
+
+	exposureMutex.Lock()
+	activeExposure = policy
+	exposureMutex.Unlock()
+
+	if policy != nil {
+		// Telling answers from new conversations needs the outbound side
+		wrapTunnelDevice()
+		registerPacketHook(exposureHook, hookPriorityExposure, installExposure)
+		if !config.Enabled {
+			appLogger.Info("Inbound sharing disabled")
+		} else if len(policy.ports) == 0 {
+			appLogger.Info("Sharing all local services with peers")
+		} else {
+			appLogger.Info("Sharing local ports with peers: %s", strings.Join(config.AllowedPorts, ", "))
+		}
+	} else {
+		unregisterPacketHook(exposureHook)
+	}
+	setSnapshotExposure(inboundExposureStatus())
+	return nil
+}
+
+func currentExposure() *exposurePolicy {
+	exposureMutex.RLock()
+	defer exposureMutex.RUnlock()
+	return activeExposure
+}
+
+// installExposure gates connections peers start with the client's tunnel
+// addresses. Return traffic and pings are left to the other hooks.
+func installExposure(dev *hookDevice, settings network.NetworkSettings) {
+	for _, addr := range tunnelAddresses(settings) {
+		dev.AddRule(addr, func(packet []byte) bool {
+			policy := currentExposure()
+			if policy == nil {
+				return false
+			}
+			return !policy.admit(packet)
+		})
+	}
+}
+
+// admit reports whether a packet arriving at the client may pass
+func (p *exposurePolicy) admit(packet []byte) bool {
+	flow, inbound := classifyInbound(packet)
+	if !inbound || !flow.portKnown {
+		return true
+	}
+
+	if p.config.Enabled && p.exposes(flow) {
+		p.accepted.Add(1)
+		return true
+	}
+	if p.blocked.Add(1) == 1 {
+		appLogger.Info("Blocked inbound connection from %s to local port %d", flow.key.remote, flow.key.localPort)
+	}
+	return false
+}
+
+func (p *exposurePolicy) exposes(flow firewallFlow) bool {
+	if len(p.ports) == 0 {
+		return true
+	}
+	for _, ports := range p.ports {
+		if ports.protocol != 0 && ports.protocol != flow.key.protocol {
+			continue
+		}
+		if flow.key.localPort >= ports.low && flow.key.localPort <= ports.high {
+			return true
+		}
+	}
+	return false
+}
+
+// inboundExposureStatus describes what is currently shared. Without a
+// policy everything the server lets through is reachable.
+func inboundExposureStatus() InboundExposureStatus {
+	status := InboundExposureStatus{Enabled: true, AllowedPorts: []string{}, AllPorts: true}
+	if policy := currentExposure(); policy != nil {
+		status.Enabled = policy.config.Enabled
+		status.AllPorts = policy.config.Enabled && len(policy.ports) == 0
+		if policy.config.Enabled && len(policy.config.AllowedPorts) > 0 {
+			status.AllowedPorts = policy.config.AllowedPorts
+		}
+		status.Accepted = policy.accepted.Load()
+		status.Blocked = policy.blocked.Load()
+	}
+	return status
+}
+
+// setInboundExposure changes which local services peers can reach, from
+// JSON shaped like InboundExposure. "null" removes the policy.
+//
+//export setInboundExposure
+func setInboundExposure(configJSON *C.char) *C.char {
+	if locked := managedLockResult("inboundExposure"); locked != nil {
+		return locked
+	}
+	var config *InboundExposure
+	if err := decodeCompatJSON([]byte(C.GoString(configJSON)), &config, "inbound exposure"); err != nil {
+		appLogger.Error("Failed to parse inbound exposure JSON: %v", err)
+		return exportString(fmt.Sprintf("Error: Failed to parse inbound exposure JSON: %v", err))
+	}
+	if err := updateInboundExposure(config); err != nil {
+		appLogger.Error("Invalid inbound exposure: %v", err)
+		return exportString(fmt.Sprintf("Error: %v", err))
+	}
+	return exportString("Inbound exposure updated")
+}
+
+// updateInboundExposure replaces the running tunnel's inbound exposure
+func updateInboundExposure(config *InboundExposure) error {
+	if err := setInboundExposureConfig(config); err != nil {
+		return err
+	}
+	tunnelMutex.Lock()
+	activeTunnelConfig.InboundExposure = config
+	tunnelMutex.Unlock()
+	return nil
+}
+
+// getInboundExposure returns what local services are shared with peers as
+// JSON
+//
+//export getInboundExposure
+func getInboundExposure() *C.char {
+	data, err := json.Marshal(inboundExposureStatus())
+	if err != nil {
+		appLogger.Error("Failed to marshal inbound exposure: %v", err)
+		return exportString("{}")
+	}
+	return exportString(string(data))
+}
@@ -0,0 +1,181 @@
+package main
+
+import "C"
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	tunnelFDJob           = "tunnelFD"
+	tunnelFDCheckInterval = 5 * time.Second
+)
+
+// Tunnel fd states reported by getTunnelFdState
+const (
+	TunnelFDStateUnknown = "unknown"
+	TunnelFDStateHealthy = "healthy"
+	// TunnelFDStateRevoked means the descriptor or its interface is gone,
+	// e.g. because the system tore the utun interface down. Swift should
+	// hand over a new descriptor with replaceTunnelFd or stop the tunnel.
+	TunnelFDStateRevoked = "revoked"
+)
+
+// TunnelFDStatus is the JSON returned by getTunnelFdState
+type TunnelFDStatus struct {
+	State     string    `json:"state"`
+	Errno     string    `json:"errno,omitempty"` // "EBADF" or "ENXIO"
+	Error     string    `json:"error,omitempty"`
+	Interface string    `json:"interface,omitempty"`
+	CheckedAt time.Time `json:"checkedAt,omitempty"`
+}
+
+var (
+	tunnelFDMutex  sync.Mutex
+	tunnelFDStatus = TunnelFDStatus{State: TunnelFDStateUnknown}
+)
+
+// checkTunnelFD verifies the descriptor is still open and, when its interface
+// name is known, that the interface still exists
+func checkTunnelFD(fd int, iface string) (errno string, err error) {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		if errors.Is(err, syscall.EBADF) {
+			return "EBADF", err
+		}
+		return "", err
+	}
+	if iface != "" {
+		if _, err := net.InterfaceByName(iface); err != nil {
+			return "ENXIO", fmt.Errorf("interface %s is gone: %w", iface, err)
+		}
+	}
+	return "", nil
+}
+
+func setTunnelFDStatus(status TunnelFDStatus) {
+	tunnelFDMutex.Lock()
+	previous := tunnelFDStatus.State
+	tunnelFDStatus = status
+	tunnelFDMutex.Unlock()
+
+	if status.State == previous {
+		return
+	}
+	recordEvent(EventState, "tunnel fd %s -> %s %s", previous, status.State, status.Errno)
+	if status.State == TunnelFDStateRevoked {
+		appLogger.Error("Tunnel file descriptor revoked (%s): %s", status.Errno, status.Error)
+	} else {
+		appLogger.Info("Tunnel file descriptor state: %s", status.State)
+	}
+}
+
+// startTunnelFDMonitor begins checking the tunnel descriptor periodically,
+// replacing any previous monitor
+func startTunnelFDMonitor() {
+	stopTunnelFDMonitor()
+
+	scheduleJob(tunnelFDJob, true, func() time.Duration {
+		return quietScaledInterval(tunnelFDCheckInterval)
+	}, checkTunnelFDOnce)
+}
+
+// stopTunnelFDMonitor stops checking and resets the state to unknown
+func stopTunnelFDMonitor() {
+	cancelJob(tunnelFDJob)
+
+	tunnelFDMutex.Lock()
+	tunnelFDStatus = TunnelFDStatus{State: TunnelFDStateUnknown}
+	tunnelFDMutex.Unlock()
+}
+
+func checkTunnelFDOnce(ctx context.Context) {
+	tunnelMutex.Lock()
+	fd := tunnelFD
+	tunnelMutex.Unlock()
+	if fd == 0 {
+		return
+	}
+
+	iface := trafficInterfaceName()
+	status := TunnelFDStatus{State: TunnelFDStateHealthy, Interface: iface, CheckedAt: time.Now()}
+	if errno, err := checkTunnelFD(fd, iface); err != nil {
+		status.State = TunnelFDStateRevoked
+		status.Errno = errno
+		status.Error = err.Error()
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	setTunnelFDStatus(status)
+}
+
+// getTunnelFdState returns the health of the tunnel file descriptor as JSON
+//
+//export getTunnelFdState
+func getTunnelFdState() *C.char {
+	tunnelFDMutex.Lock()
+	status := tunnelFDStatus
+	tunnelFDMutex.Unlock()
+
+	data, err := json.Marshal(status)
+	if err != nil {
+		appLogger.Error("Failed to marshal tunnel fd state: %v", err)
+		return exportString("{}")
+	}
+	return exportString(string(data))
+}
+
+// replaceTunnelFd hands olm a new utun descriptor for the running tunnel,
+// swapping the device under the existing WireGuard session instead of
+// restarting it. The caller keeps ownership of newFd, as with startTunnel.
+//
+//export replaceTunnelFd
+func replaceTunnelFd(newFd C.int) *C.char {
+	appLogger.Debug("Replacing tunnel file descriptor")
+
+	tunnelMutex.Lock()
+	defer tunnelMutex.Unlock()
+
+	if !tunnelRunning {
+		appLogger.Warn("Tunnel is not running")
+		return exportString("Error: Tunnel not running")
+	}
+	if newFd <= 0 {
+		return exportString("Error: Invalid file descriptor")
+	}
+	if _, err := checkTunnelFD(int(newFd), ""); err != nil {
+		appLogger.Error("New tunnel file descriptor is not usable: %v", err)
+		return exportString(fmt.Sprintf("Error: New file descriptor is not usable: %v", err))
+	}
+
+	// olm takes ownership of the descriptor it is given
+	dupFD, err := syscall.Dup(int(newFd))
+	if err != nil {
+		appLogger.Error("Failed to duplicate tunnel file descriptor: %v", err)
+		return exportString(fmt.Sprintf("Error: Failed to duplicate file descriptor: %v", err))
+	}
+	if err := olm.AddDevice(uint32(dupFD)); err != nil {
+		syscall.Close(dupFD)
+		appLogger.Error("Failed to replace tunnel device: %v", err)
+		return exportString(fmt.Sprintf("Error: %v", err))
+	}
+
+	tunnelFD = int(newFd)
+	shaperDeviceReplaced()
+	startTrafficCounters(tunnelFD)
+	setTunnelFDStatus(TunnelFDStatus{
+		State:     TunnelFDStateHealthy,
+		Interface: trafficInterfaceName(),
+		CheckedAt: time.Now(),
+	})
+
+	appLogger.Info("Tunnel file descriptor replaced")
+	return exportString("Tunnel file descriptor replaced")
+}
@@ -0,0 +1,171 @@
+package main
+
+import "C"
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Feature flag names understood by the Go layer. The control plane sends the
+// flag set in its token answer when the tunnel registers, and the app may
+// pass one it got from the control plane itself; the last set delivered wins
+// and all are cleared when the tunnel stops. The control plane may send
+// flags that this build does not know about; those are kept and reported back
+// through getFeatureFlags but never gate anything. A flag the set leaves out
+// takes its default from featureFlagDefaults.
+const (
+	// FeatureRelaySelection lets the relay balancer move relayed sites
+	// between relays; turned off, the balancer only reports the
+	// assignments. It is on unless the flag set turns it off.
+	FeatureRelaySelection = "relaySelection"
+)
+
+// knownFeatureFlags lists every flag this build can act on
+var knownFeatureFlags = []string{
+	FeatureRelaySelection,
+}
+
+// featureFlagDefaults are the flags that are on until a flag set turns them
+// off
+var featureFlagDefaults = map[string]bool{
+	FeatureRelaySelection: true,
+}
+
+// FeatureFlagsResponse is the JSON returned by getFeatureFlags
+type FeatureFlagsResponse struct {
+	Flags    map[string]bool `json:"flags"`
+	Defaults map[string]bool `json:"defaults"`
+	Known    []string        `json:"known"`
+	Unknown  []string        `json:"unknown,omitempty"`
+}
+
+var (
+	featureFlags      = map[string]bool{}
+	featureFlagsMutex sync.RWMutex
+)
+
+// parseFeatureFlags decodes a control plane flag set. Both a JSON object of
+// name -> bool and a JSON array of enabled flag names are accepted.
+func parseFeatureFlags(data []byte) (map[string]bool, error) {
+	flags := map[string]bool{}
+	if len(data) == 0 || string(data) == "null" {
+		return flags, nil
+	}
+
+	if err := json.Unmarshal(data, &flags); err == nil {
+		return flags, nil
+	}
+
+	var enabled []string
+	if err := json.Unmarshal(data, &enabled); err != nil {
+		return nil, fmt.Errorf("feature flags must be an object or an array of names: %w", err)
+	}
+	flags = map[string]bool{}
+	for _, name := range enabled {
+		flags[name] = true
+	}
+	return flags, nil
+}
+
+// applyFeatureFlags replaces the active flag set
+func applyFeatureFlags(flags map[string]bool) {
+	featureFlagsMutex.Lock()
+	featureFlags = flags
+	featureFlagsMutex.Unlock()
+
+	for name, enabled := range flags {
+		if !isKnownFeatureFlag(name) {
+			appLogger.Debug("Ignoring unknown feature flag %s=%v", name, enabled)
+			continue
+		}
+		appLogger.Info("Feature flag %s=%v", name, enabled)
+	}
+}
+
+// resetFeatureFlags turns every flag off when the tunnel stops, so the next
+// tunnel starts from what its server delivers
+func resetFeatureFlags() {
+	featureFlagsMutex.Lock()
+	featureFlags = map[string]bool{}
+	featureFlagsMutex.Unlock()
+}
+
+// featureEnabled reports whether the named behavior is on: as the flag set
+// says, or else by its default, which is off for most flags
+func featureEnabled(name string) bool {
+	featureFlagsMutex.RLock()
+	defer featureFlagsMutex.RUnlock()
+	if enabled, ok := featureFlags[name]; ok {
+		return enabled
+	}
+	return featureFlagDefaults[name]
+}
+
+func isKnownFeatureFlag(name string) bool {
+	for _, known := range knownFeatureFlags {
+		if known == name {
+			return true
+		}
+	}
+	return false
+}
+
+// setFeatureFlags replaces the active feature flag set with one delivered by
+// the control plane. flagsJSON is either an object of name -> bool or an array
+// of enabled flag names.
+//
+//export setFeatureFlags
+func setFeatureFlags(flagsJSON *C.char) *C.char {
+	if locked := managedLockResult("featureFlags"); locked != nil {
+		return locked
+	}
+	if err := updateFeatureFlags(json.RawMessage(C.GoString(flagsJSON))); err != nil {
+		appLogger.Error("Failed to parse feature flags JSON: %v", err)
+		return exportString(fmt.Sprintf("Error: Failed to parse feature flags JSON: %v", err))
+	}
+	return exportString("Feature flags updated")
+}
+
+// updateFeatureFlags replaces the active flag set with the raw flags, which
+// the running config keeps as they were given
+func updateFeatureFlags(raw json.RawMessage) error {
+	flags, err := parseFeatureFlags(raw)
+	if err != nil {
+		return err
+	}
+	applyFeatureFlags(flags)
+
+	tunnelMutex.Lock()
+	activeTunnelConfig.FeatureFlags = raw
+	tunnelMutex.Unlock()
+	return nil
+}
+
+// getFeatureFlags returns the active feature flag set as a JSON string
+//
+//export getFeatureFlags
+func getFeatureFlags() *C.char {
+	featureFlagsMutex.RLock()
+	resp := FeatureFlagsResponse{
+		Flags:    make(map[string]bool, len(featureFlags)),
+		Defaults: featureFlagDefaults,
+		Known:    knownFeatureFlags,
+	}
+	for name, enabled := range featureFlags {
+		resp.Flags[name] = enabled
+		if !isKnownFeatureFlag(name) {
+			resp.Unknown = append(resp.Unknown, name)
+		}
+	}
+	featureFlagsMutex.RUnlock()
+	sort.Strings(resp.Unknown)
+
+	data, err := json.Marshal(resp)
+	if err != nil {
+		appLogger.Error("Failed to marshal feature flags: %v", err)
+		return exportString("{}")
+	}
+	return exportString(string(data))
+}
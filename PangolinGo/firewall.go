@@ -0,0 +1,568 @@
+package main
+
+import "C"
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fosrl/newt/network"
+)
+
+const firewallHook = "firewall"
+
+// Firewall rule fields
+const (
+	FirewallAllow = "allow"
+	FirewallDeny  = "deny"
+
+	FirewallIn  = "in"
+	FirewallOut = "out"
+	FirewallAny = "any"
+)
+
+// FirewallRule is one entry of the ordered rule list. The first rule that
+// matches a packet decides its fate.
+type FirewallRule struct {
+	Action string `json:"action"` // "allow" or "deny"
+	// Direction is "in" for conversations a peer starts with this client,
+	// "out" for conversations this client starts, or "any"
+	Direction string `json:"direction"`
+	// CIDR is the remote side; empty matches everything
+	CIDR string `json:"cidr"`
+	// Ports is a port or "low-high" range: the local port for inbound
+	// conversations and the remote port for outbound ones. Empty matches
+	// every port.
+	Ports    string `json:"ports"`
+	Protocol string `json:"protocol"` // "tcp", "udp", "icmp" or "any"
+}
+
+// FirewallConfig is the complete firewall configuration
+type FirewallConfig struct {
+	Rules []FirewallRule `json:"rules"`
+	// DefaultInbound applies to inbound conversations no rule matched.
+	// "deny" blocks other peers from connecting to this client.
+	DefaultInbound string `json:"defaultInbound"`
+}
+
+type firewallRule struct {
+	FirewallRule
+	allow    bool
+	prefix   netip.Prefix
+	anyAddr  bool
+	portLow  uint16
+	portHigh uint16
+	protocol int // 0 for any
+	hits     atomic.Uint64
+}
+
+// firewall holds the parsed rules. It is replaced wholesale on every change
+// so the packet path never sees a partial update.
+type firewall struct {
+	rules       []*firewallRule
+	denyInbound bool
+	defaultIn   atomic.Uint64
+	defaultOut  atomic.Uint64
+	allowed     atomic.Uint64
+	dropped     atomic.Uint64
+}
+
+// FirewallRuleStats reports a rule and how many packets it matched
+type FirewallRuleStats struct {
+	FirewallRule
+	Hits uint64 `json:"hits"`
+}
+
+// FirewallStats is the JSON returned by getFirewallStats
+type FirewallStats struct {
+	Enabled        bool                `json:"enabled"`
+	DefaultInbound string              `json:"defaultInbound"`
+	Rules          []FirewallRuleStats `json:"rules"`
+	DefaultInHits  uint64              `json:"defaultInHits"`
+	DefaultOutHits uint64              `json:"defaultOutHits"`
+	AllowedPackets uint64              `json:"allowedPackets"`
+	DroppedPackets uint64              `json:"droppedPackets"`
+}
+
+var (
+	firewallMutex  sync.RWMutex
+	activeFirewall *firewall
+)
+
+func parseFirewallProtocol(value string) (int, error) {
+	switch strings.ToLower(value) {
+	case "", FirewallAny:
+		return 0, nil
+	case "tcp":
+		return ipProtoTCP, nil
+	case "udp":
+		return ipProtoUDP, nil
+	case "icmp":
+		return ipProtoICMP, nil
+	}
+	return 0, fmt.Errorf("unknown protocol %q", value)
+}
+
+func parsePortRange(value string) (uint16, uint16, error) {
+	if value == "" {
+		return 0, 65535, nil
+	}
+	lowStr, highStr, isRange := strings.Cut(value, "-")
+	low, err := strconv.ParseUint(strings.TrimSpace(lowStr), 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port %q", value)
+	}
+	high := low
+	if isRange {
+		if high, err = strconv.ParseUint(strings.TrimSpace(highStr), 10, 16); err != nil {
+			return 0, 0, fmt.Errorf("invalid port range %q", value)
+		}
+	}
+	if high < low {
+		return 0, 0, fmt.Errorf("invalid port range %q", value)
+	}
+	return uint16(low), uint16(high), nil
+}
+
+// parseFirewallConfig validates a configuration
+func parseFirewallConfig(config FirewallConfig) (*firewall, error) {
+	fw := &firewall{}
+
+	switch config.DefaultInbound {
+	case "", FirewallAllow:
+	case FirewallDeny:
+		fw.denyInbound = true
+	default:
+		return nil, fmt.Errorf("defaultInbound must be %q or %q", FirewallAllow, FirewallDeny)
+	}
+
+	for i, rule := range config.Rules {
+		parsed := &firewallRule{FirewallRule: rule}
+
+		switch rule.Action {
+		case FirewallAllow:
+			parsed.allow = true
+		case FirewallDeny:
+		default:
+			return nil, fmt.Errorf("rule %d: action must be %q or %q", i, FirewallAllow, FirewallDeny)
+		}
+
+		switch rule.Direction {
+		case "":
+			parsed.Direction = FirewallAny
+		case FirewallIn, FirewallOut, FirewallAny:
+		default:
+			return nil, fmt.Errorf("rule %d: direction must be %q, %q or %q", i, FirewallIn, FirewallOut, FirewallAny)
+		}
+
+		if rule.CIDR == "" {
+			parsed.anyAddr = true
+		} else {
+			prefix, err := netip.ParsePrefix(rule.CIDR)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: invalid CIDR: %w", i, err)
+			}
+			parsed.prefix = prefix.Masked()
+		}
+
+		var err error
+		if parsed.portLow, parsed.portHigh, err = parsePortRange(rule.Ports); err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i, err)
+		}
+		if parsed.protocol, err = parseFirewallProtocol(rule.Protocol); err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i, err)
+		}
+
+		fw.rules = append(fw.rules, parsed)
+	}
+	return fw, nil
+}
+
+// setFirewallConfig replaces the active firewall. A nil config disables it.
+func setFirewallConfig(config *FirewallConfig) error {
+	var fw *firewall
+	if config != nil {
+		var err error
+		if fw, err = parseFirewallConfig(*config); err != nil {
+			return err
+		}
+	}
+
+	firewallMutex.Lock()
+	activeFirewall = fw
+	firewallMutex.Unlock()
+
+	if fw != nil {
+		// Outbound packets only pass through the wrapped device
+		wrapTunnelDevice()
+		registerPacketHook(firewallHook, hookPriorityFirewall, installFirewall)
+		appLogger.Info("Firewall enabled with %d rule(s), default inbound %s", len(fw.rules), config.DefaultInbound)
+	} else {
+		unregisterPacketHook(firewallHook)
+	}
+	return nil
+}
+
+func currentFirewall() *firewall {
+	firewallMutex.RLock()
+	defer firewallMutex.RUnlock()
+	return activeFirewall
+}
+
+// installFirewall filters everything arriving for the client's tunnel
+// addresses. Outbound packets are filtered by the wrapped tunnel device,
+// which also records the conversations they belong to.
+func installFirewall(dev *hookDevice, settings network.NetworkSettings) {
+	for _, addr := range tunnelAddresses(settings) {
+		dev.AddRule(addr, func(packet []byte) bool {
+			fw := currentFirewall()
+			if fw == nil {
+				return false
+			}
+			return !fw.allowInbound(packet)
+		})
+	}
+}
+
+// firewallAdmitsOutbound is called by the wrapped tunnel device for every
+// packet the host sends into the tunnel. Without a firewall the
+// conversations are still tracked for the inbound exposure policy.
+func firewallAdmitsOutbound(packet []byte) bool {
+	if fw := currentFirewall(); fw != nil {
+		return fw.allowOutbound(packet)
+	}
+	if currentExposure() != nil {
+		if flow, started := classifyOutbound(packet); started {
+			trackFlow(flow.key, false, time.Now())
+		}
+	}
+	return true
+}
+
+// firewallFlowKey identifies a conversation as seen from this client. For
+// ICMP echo the identifier takes the place of the local port.
+type firewallFlowKey struct {
+	remote     netip.Addr
+	protocol   int
+	localPort  uint16
+	remotePort uint16
+}
+
+// firewallFlow is the part of a packet the rules look at
+type firewallFlow struct {
+	key firewallFlowKey
+	// opens is set on packets that start a conversation: a bare TCP SYN
+	// or an ICMP echo request
+	opens bool
+	// related is set on ICMP errors and other messages that report on
+	// traffic rather than start or continue a conversation
+	related   bool
+	portKnown bool
+}
+
+// parseFirewallFlow reads the conversation a packet belongs to; outbound
+// packets come from this client, inbound ones are addressed to it
+func parseFirewallFlow(packet []byte, outbound bool) (firewallFlow, bool) {
+	ip, ok := parseIPPacket(packet)
+	if !ok {
+		return firewallFlow{}, false
+	}
+	flow := firewallFlow{key: firewallFlowKey{remote: ip.Src, protocol: ip.Protocol}}
+	if outbound {
+		flow.key.remote = ip.Dst
+	}
+	if ip.Protocol == ipProtoICMPv6 {
+		flow.key.protocol = ipProtoICMP
+	}
+
+	transport := ip.Version == 6 || ipv4IsFirstFragment(packet)
+	switch {
+	case (ip.Protocol == ipProtoTCP && len(ip.Payload) >= tcpHeaderMinLen || ip.Protocol == ipProtoUDP && len(ip.Payload) >= 8) && transport:
+		srcPort := binary.BigEndian.Uint16(ip.Payload[0:2])
+		dstPort := binary.BigEndian.Uint16(ip.Payload[2:4])
+		flow.key.localPort, flow.key.remotePort = dstPort, srcPort
+		if outbound {
+			flow.key.localPort, flow.key.remotePort = srcPort, dstPort
+		}
+		flow.portKnown = true
+		if ip.Protocol == ipProtoTCP {
+			flags := ip.Payload[13]
+			flow.opens = flags&tcpFlagSYN != 0 && flags&tcpFlagACK == 0
+		}
+	case (ip.Protocol == ipProtoICMP || ip.Protocol == ipProtoICMPv6) && len(ip.Payload) >= 8:
+		switch ip.Payload[0] {
+		case icmpEchoRequest, icmpv6EchoRequest:
+			flow.opens = true
+		case icmpEchoReply, icmpv6EchoReply:
+		default:
+			flow.related = true
+			return flow, true
+		}
+		flow.key.localPort = binary.BigEndian.Uint16(ip.Payload[4:6])
+	case ip.Protocol == ipProtoICMP || ip.Protocol == ipProtoICMPv6:
+		flow.related = true
+	}
+	return flow, true
+}
+
+// The firewall tracks conversations so that traffic answering one is
+// recognised whichever side started it. Entries expire after their idle
+// timeout; when the table is full, new conversations are filtered without
+// being tracked, so the answers to an untracked outbound UDP exchange are
+// filtered as inbound.
+const (
+	firewallTCPIdle  = time.Hour
+	firewallFlowIdle = 2 * time.Minute
+	firewallMaxFlows = 8192
+)
+
+// trackedFlow is a conversation the firewall let through
+type trackedFlow struct {
+	// inbound is set when the remote side started it
+	inbound bool
+	seen    time.Time
+}
+
+var (
+	firewallFlowsMutex sync.Mutex
+	firewallFlows      = map[firewallFlowKey]*trackedFlow{}
+)
+
+func firewallIdleTimeout(key firewallFlowKey) time.Duration {
+	if key.protocol == ipProtoTCP {
+		return firewallTCPIdle
+	}
+	return firewallFlowIdle
+}
+
+// lookupFlow returns whether a conversation is tracked and which side
+// started it, and marks it as seen
+func lookupFlow(key firewallFlowKey, now time.Time) (inbound, tracked bool) {
+	firewallFlowsMutex.Lock()
+	defer firewallFlowsMutex.Unlock()
+	flow := firewallFlows[key]
+	if flow == nil {
+		return false, false
+	}
+	if now.Sub(flow.seen) > firewallIdleTimeout(key) {
+		delete(firewallFlows, key)
+		return false, false
+	}
+	flow.seen = now
+	return flow.inbound, true
+}
+
+// trackFlow records a conversation the firewall let through
+func trackFlow(key firewallFlowKey, inbound bool, now time.Time) {
+	firewallFlowsMutex.Lock()
+	defer firewallFlowsMutex.Unlock()
+	if flow := firewallFlows[key]; flow != nil {
+		flow.seen = now
+		return
+	}
+	if len(firewallFlows) >= firewallMaxFlows {
+		for k, flow := range firewallFlows {
+			if now.Sub(flow.seen) > firewallIdleTimeout(k) {
+				delete(firewallFlows, k)
+			}
+		}
+		if len(firewallFlows) >= firewallMaxFlows {
+			return
+		}
+	}
+	firewallFlows[key] = &trackedFlow{inbound: inbound, seen: now}
+}
+
+// resetFirewallFlows forgets every tracked conversation when the tunnel stops
+func resetFirewallFlows() {
+	firewallFlowsMutex.Lock()
+	firewallFlows = map[firewallFlowKey]*trackedFlow{}
+	firewallFlowsMutex.Unlock()
+}
+
+// matches reports whether a rule applies to the first packet of a
+// conversation; the port is the local one for inbound conversations and the
+// remote one for outbound ones
+func (r *firewallRule) matches(flow firewallFlow, inbound bool) bool {
+	if r.Direction == FirewallIn && !inbound || r.Direction == FirewallOut && inbound {
+		return false
+	}
+	if r.protocol != 0 && r.protocol != flow.key.protocol {
+		return false
+	}
+	if !r.anyAddr && !r.prefix.Contains(flow.key.remote) {
+		return false
+	}
+	if r.portLow != 0 || r.portHigh != 65535 {
+		port := flow.key.remotePort
+		if inbound {
+			port = flow.key.localPort
+		}
+		if !flow.portKnown || port < r.portLow || port > r.portHigh {
+			return false
+		}
+	}
+	return true
+}
+
+// decide evaluates the rules for a conversation one side is starting
+func (fw *firewall) decide(flow firewallFlow, inbound bool) bool {
+	for _, rule := range fw.rules {
+		if rule.matches(flow, inbound) {
+			rule.hits.Add(1)
+			if rule.allow {
+				fw.allowed.Add(1)
+			} else {
+				fw.dropped.Add(1)
+			}
+			return rule.allow
+		}
+	}
+
+	if inbound {
+		fw.defaultIn.Add(1)
+		if fw.denyInbound {
+			fw.dropped.Add(1)
+			return false
+		}
+	} else {
+		fw.defaultOut.Add(1)
+	}
+	fw.allowed.Add(1)
+	return true
+}
+
+// classifyOutbound parses a packet the host sends into the tunnel and
+// reports whether it belongs to a conversation this client starts, rather
+// than answering one a peer started
+func classifyOutbound(packet []byte) (firewallFlow, bool) {
+	flow, ok := parseFirewallFlow(packet, true)
+	if !ok || flow.related {
+		return flow, false
+	}
+	inbound, tracked := lookupFlow(flow.key, time.Now())
+	return flow, !tracked || !inbound
+}
+
+// classifyInbound parses a packet arriving for the client and reports
+// whether it belongs to a conversation a peer starts, rather than answering
+// one this client started. TCP segments other than a bare SYN cannot open a
+// connection, so they never count as inbound: the host answers one outside
+// any connection with a reset.
+func classifyInbound(packet []byte) (firewallFlow, bool) {
+	flow, ok := parseFirewallFlow(packet, false)
+	if !ok || flow.related {
+		return flow, false
+	}
+	if inbound, tracked := lookupFlow(flow.key, time.Now()); tracked && !inbound {
+		return flow, false
+	}
+	if flow.key.protocol == ipProtoTCP && !flow.opens {
+		return flow, false
+	}
+	return flow, true
+}
+
+// allowOutbound filters a packet the host sends into the tunnel. Answers in
+// a conversation a peer started pass; anything else is an outbound
+// conversation and goes through the rules.
+func (fw *firewall) allowOutbound(packet []byte) bool {
+	flow, started := classifyOutbound(packet)
+	if !started {
+		fw.allowed.Add(1)
+		return true
+	}
+	if !fw.decide(flow, false) {
+		return false
+	}
+	trackFlow(flow.key, false, time.Now())
+	return true
+}
+
+// allowInbound filters a packet arriving for the client. Answers in a
+// conversation this client started pass; anything else is an inbound
+// conversation and goes through the rules.
+func (fw *firewall) allowInbound(packet []byte) bool {
+	flow, started := classifyInbound(packet)
+	if !started {
+		fw.allowed.Add(1)
+		return true
+	}
+	if !fw.decide(flow, true) {
+		return false
+	}
+	trackFlow(flow.key, true, time.Now())
+	return true
+}
+
+// setFirewallRules replaces the firewall configuration of the running tunnel
+// from JSON shaped like FirewallConfig. "null" disables the firewall. Hit
+// counters start over.
+//
+//export setFirewallRules
+func setFirewallRules(configJSON *C.char) *C.char {
+	if locked := managedLockResult("firewall"); locked != nil {
+		return locked
+	}
+	var config *FirewallConfig
+	if err := decodeCompatJSON([]byte(C.GoString(configJSON)), &config, "firewall rules"); err != nil {
+		appLogger.Error("Failed to parse firewall JSON: %v", err)
+		return exportString(fmt.Sprintf("Error: Failed to parse firewall JSON: %v", err))
+	}
+	if err := updateFirewallRules(config); err != nil {
+		appLogger.Error("Invalid firewall rules: %v", err)
+		return exportString(fmt.Sprintf("Error: %v", err))
+	}
+	if config == nil {
+		return exportString("Firewall disabled")
+	}
+	return exportString(fmt.Sprintf("Firewall set with %d rule(s)", len(config.Rules)))
+}
+
+// getFirewallStats returns the firewall rules with their hit counters as JSON
+//
+//export getFirewallStats
+func getFirewallStats() *C.char {
+	stats := FirewallStats{
+		DefaultInbound: FirewallAllow,
+		Rules:          []FirewallRuleStats{},
+	}
+
+	if fw := currentFirewall(); fw != nil {
+		stats.Enabled = true
+		if fw.denyInbound {
+			stats.DefaultInbound = FirewallDeny
+		}
+		for _, rule := range fw.rules {
+			stats.Rules = append(stats.Rules, FirewallRuleStats{FirewallRule: rule.FirewallRule, Hits: rule.hits.Load()})
+		}
+		stats.DefaultInHits = fw.defaultIn.Load()
+		stats.DefaultOutHits = fw.defaultOut.Load()
+		stats.AllowedPackets = fw.allowed.Load()
+		stats.DroppedPackets = fw.dropped.Load()
+	}
+
+	data, err := json.Marshal(stats)
+	if err != nil {
+		appLogger.Error("Failed to marshal firewall stats: %v", err)
+		return exportString("{}")
+	}
+	return exportString(string(data))
+}
+
+// updateFirewallRules replaces the running tunnel's firewall; nil disables it
+func updateFirewallRules(config *FirewallConfig) error {
+	if err := setFirewallConfig(config); err != nil {
+		return err
+	}
+	tunnelMutex.Lock()
+	activeTunnelConfig.Firewall = config
+	tunnelMutex.Unlock()
+	return nil
+}
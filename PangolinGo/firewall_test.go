@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+const (
+	testClientAddr = "fd00::1"
+	testPeerAddr   = "fd00::2"
+)
+
+// testTCP builds an IPv6 TCP segment between the given ports
+func testTCP(src, dst string, srcPort, dstPort uint16, flags byte) []byte {
+	tcp := make([]byte, tcpHeaderMinLen)
+	binary.BigEndian.PutUint16(tcp[0:2], srcPort)
+	binary.BigEndian.PutUint16(tcp[2:4], dstPort)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	return testIPv6(src, dst, ipProtoTCP, tcp)
+}
+
+// testUDP builds an IPv6 UDP datagram between the given ports
+func testUDP(src, dst string, srcPort, dstPort uint16) []byte {
+	udp := make([]byte, 8)
+	binary.BigEndian.PutUint16(udp[0:2], srcPort)
+	binary.BigEndian.PutUint16(udp[2:4], dstPort)
+	binary.BigEndian.PutUint16(udp[4:6], 8)
+	return testIPv6(src, dst, ipProtoUDP, udp)
+}
+
+// testEcho builds an ICMPv6 echo request or reply
+func testEcho(src, dst string, icmpType byte, id uint16) []byte {
+	icmp := make([]byte, 8)
+	icmp[0] = icmpType
+	binary.BigEndian.PutUint16(icmp[4:6], id)
+	return testIPv6(src, dst, ipProtoICMPv6, icmp)
+}
+
+func testFirewall(t *testing.T, config FirewallConfig) *firewall {
+	t.Helper()
+	resetFirewallFlows()
+	t.Cleanup(resetFirewallFlows)
+	fw, err := parseFirewallConfig(config)
+	if err != nil {
+		t.Fatalf("parseFirewallConfig: %v", err)
+	}
+	return fw
+}
+
+func TestFirewallDefaultDenyInbound(t *testing.T) {
+	fw := testFirewall(t, FirewallConfig{DefaultInbound: FirewallDeny})
+
+	// A peer sending to a high local port is still starting a conversation
+	if fw.allowInbound(testUDP(testPeerAddr, testClientAddr, 53, 50000)) {
+		t.Error("unsolicited UDP to a high port passed")
+	}
+	if fw.allowInbound(testTCP(testPeerAddr, testClientAddr, 40000, 22, tcpFlagSYN)) {
+		t.Error("inbound SYN passed")
+	}
+	if fw.allowInbound(testEcho(testPeerAddr, testClientAddr, icmpv6EchoRequest, 7)) {
+		t.Error("inbound echo request passed")
+	}
+	if !fw.allowInbound(testTCP(testPeerAddr, testClientAddr, 40000, 22, tcpFlagACK)) {
+		t.Error("TCP segment that cannot open a connection was dropped")
+	}
+	if got := fw.dropped.Load(); got != 3 {
+		t.Errorf("dropped = %d, want 3", got)
+	}
+}
+
+func TestFirewallAnswersToOutbound(t *testing.T) {
+	fw := testFirewall(t, FirewallConfig{DefaultInbound: FirewallDeny})
+
+	// The local port is below the ephemeral range, which used to make the
+	// answer look like an inbound conversation
+	if !fw.allowOutbound(testUDP(testClientAddr, testPeerAddr, 5353, 53)) {
+		t.Fatal("outbound UDP was dropped")
+	}
+	if !fw.allowInbound(testUDP(testPeerAddr, testClientAddr, 53, 5353)) {
+		t.Error("answer to outbound UDP was dropped")
+	}
+	if fw.allowInbound(testUDP(testPeerAddr, testClientAddr, 54, 5353)) {
+		t.Error("UDP from another remote port passed")
+	}
+
+	if !fw.allowOutbound(testEcho(testClientAddr, testPeerAddr, icmpv6EchoRequest, 9)) {
+		t.Fatal("outbound echo request was dropped")
+	}
+	if !fw.allowInbound(testEcho(testPeerAddr, testClientAddr, icmpv6EchoReply, 9)) {
+		t.Error("echo reply was dropped")
+	}
+}
+
+func TestFirewallOutboundRules(t *testing.T) {
+	fw := testFirewall(t, FirewallConfig{Rules: []FirewallRule{
+		{Action: FirewallDeny, Direction: FirewallOut, CIDR: testPeerAddr + "/128", Ports: "22", Protocol: "tcp"},
+		{Action: FirewallDeny, Direction: FirewallOut, Protocol: "udp"},
+	}})
+
+	if fw.allowOutbound(testTCP(testClientAddr, testPeerAddr, 50000, 22, tcpFlagSYN)) {
+		t.Error("outbound SYN to a denied port passed")
+	}
+	if !fw.allowOutbound(testTCP(testClientAddr, testPeerAddr, 50001, 443, tcpFlagSYN)) {
+		t.Error("outbound SYN to an allowed port was dropped")
+	}
+	if fw.allowOutbound(testUDP(testClientAddr, testPeerAddr, 50000, 53)) {
+		t.Error("outbound UDP passed a deny rule")
+	}
+	if fw.rules[0].hits.Load() != 1 || fw.rules[1].hits.Load() != 1 {
+		t.Errorf("hits = %d, %d, want 1, 1", fw.rules[0].hits.Load(), fw.rules[1].hits.Load())
+	}
+}
+
+func TestFirewallAnswersToInbound(t *testing.T) {
+	fw := testFirewall(t, FirewallConfig{
+		DefaultInbound: FirewallDeny,
+		Rules: []FirewallRule{
+			{Action: FirewallAllow, Direction: FirewallIn, Ports: "22", Protocol: "tcp"},
+			{Action: FirewallDeny, Direction: FirewallOut},
+		},
+	})
+
+	if !fw.allowInbound(testTCP(testPeerAddr, testClientAddr, 40000, 22, tcpFlagSYN)) {
+		t.Fatal("inbound SYN to an allowed port was dropped")
+	}
+	// Answering the peer is not an outbound conversation
+	if !fw.allowOutbound(testTCP(testClientAddr, testPeerAddr, 22, 40000, tcpFlagSYN|tcpFlagACK)) {
+		t.Error("answer to an allowed inbound connection was dropped")
+	}
+	if fw.allowOutbound(testTCP(testClientAddr, testPeerAddr, 50000, 40000, tcpFlagSYN)) {
+		t.Error("new outbound connection passed a deny rule")
+	}
+}
@@ -0,0 +1,481 @@
+package main
+
+import "C"
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"net/netip"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	wgdevice "golang.zx2c4.com/wireguard/device"
+)
+
+const (
+	// firstByteWindow is how long after a connect or wake first contacts
+	// with resources are timed
+	firstByteWindow = time.Minute
+	// firstByteWorst is how many resources getFirstByteStats reports
+	firstByteWorst = 10
+	// firstByteMaxResources bounds the per-resource table
+	firstByteMaxResources = 256
+)
+
+// What made a first contact slow
+const (
+	FirstByteCauseDNS       = "dns"
+	FirstByteCauseHandshake = "handshake"
+	FirstByteCauseService   = "service"
+)
+
+// FirstByteSample times one resource's first contact after a connect or wake
+type FirstByteSample struct {
+	At          time.Time `json:"at"`
+	Trigger     string    `json:"trigger"`
+	Destination string    `json:"destination"`
+	// TotalMs runs from the first packet to the resource to its first reply
+	TotalMs float64 `json:"totalMs"`
+	// DNSMs is the tunnel lookup that returned the destination, before the
+	// first packet
+	DNSMs float64 `json:"dnsMs,omitempty"`
+	// HandshakeMs is the part of TotalMs spent waiting for the site's
+	// WireGuard handshake
+	HandshakeMs float64 `json:"handshakeMs,omitempty"`
+	// ServiceMs is the rest of TotalMs: the network path and the service
+	ServiceMs float64 `json:"serviceMs"`
+	Cause     string  `json:"cause"`
+}
+
+// ResourceFirstByte collects the first contact timings of one included route
+type ResourceFirstByte struct {
+	Resource string `json:"resource"`
+	Samples  int    `json:"samples"`
+	// Unanswered counts windows in which the first packet got no reply
+	Unanswered int              `json:"unanswered"`
+	Worst      *FirstByteSample `json:"worst,omitempty"`
+	Last       *FirstByteSample `json:"last,omitempty"`
+}
+
+// FirstByteStats is the JSON returned by getFirstByteStats
+type FirstByteStats struct {
+	Measuring bool      `json:"measuring"`
+	Trigger   string    `json:"trigger,omitempty"`
+	ArmedAt   time.Time `json:"armedAt,omitempty"`
+	// Resources are the slowest resources, worst first
+	Resources []ResourceFirstByte `json:"resources"`
+}
+
+// firstContact is a resource's first packet in the current window
+type firstContact struct {
+	dst      netip.Addr
+	out, in  time.Time
+	dnsStart time.Time
+	dnsEnd   time.Time
+}
+
+// dnsLookup is when a tunnel lookup that returned an address went out and
+// came back
+type dnsLookup struct {
+	sent, answered time.Time
+}
+
+var (
+	// firstByteArmed gates the packet path, which does nothing outside a
+	// window
+	firstByteArmed atomic.Bool
+
+	firstByteMutex sync.Mutex
+	// firstByteRunning is set while a tunnel runs, so a wake without one
+	// does not start a window
+	firstByteRunning bool
+	firstByteTrigger string
+	firstByteArmedAt time.Time
+	// firstByteRoutes are the included routes, longest first
+	firstByteRoutes  []netip.Prefix
+	firstByteVersion int
+	firstByteProxy   netip.Addr
+	firstByteWaiting = map[string]*firstContact{}
+	firstByteQueries = map[uint16]time.Time{}
+	firstByteLookups = map[netip.Addr]dnsLookup{}
+	firstByteStats   = map[string]*ResourceFirstByte{}
+)
+
+// armFirstByte starts a window in which each resource's first contact is
+// timed
+func armFirstByte(trigger string) {
+	firstByteMutex.Lock()
+	if !firstByteRunning {
+		firstByteMutex.Unlock()
+		return
+	}
+	firstByteTrigger, firstByteArmedAt = trigger, time.Now()
+	firstByteWaiting = map[string]*firstContact{}
+	firstByteQueries = map[uint16]time.Time{}
+	firstByteLookups = map[netip.Addr]dnsLookup{}
+	firstByteMutex.Unlock()
+	firstByteArmed.Store(true)
+}
+
+// firstByteResource names the included route a destination falls under.
+// Full-tunnel traffic is keyed by host, so the default route does not lump
+// every service together. Caller must hold firstByteMutex.
+func firstByteResource(addr netip.Addr) (string, bool) {
+	for _, prefix := range firstByteRoutes {
+		if prefix.Contains(addr) {
+			if prefix.Bits() == 0 {
+				return addr.String(), true
+			}
+			return prefix.String(), true
+		}
+	}
+	return "", false
+}
+
+// dnsPayload returns the DNS message of a UDP packet on port 53
+func dnsPayload(packet []byte, ip ipPacket, outbound bool) ([]byte, bool) {
+	if ip.Protocol != ipProtoUDP || len(ip.Payload) < 8 || (ip.Version == 4 && !ipv4IsFirstFragment(packet)) {
+		return nil, false
+	}
+	port := binary.BigEndian.Uint16(ip.Payload[2:4])
+	if !outbound {
+		port = binary.BigEndian.Uint16(ip.Payload[0:2])
+	}
+	return ip.Payload[8:], port == 53
+}
+
+// noteFirstByteOutbound sees a packet leaving the device into the tunnel
+func noteFirstByteOutbound(packet []byte) {
+	if !firstByteArmed.Load() {
+		return
+	}
+	ip, ok := parseIPPacket(packet)
+	if !ok {
+		return
+	}
+	now := time.Now()
+
+	firstByteMutex.Lock()
+	defer firstByteMutex.Unlock()
+	if ip.Dst == firstByteProxy {
+		if payload, ok := dnsPayload(packet, ip, true); ok && len(payload) >= 2 {
+			firstByteQueries[binary.BigEndian.Uint16(payload)] = now
+		}
+		return
+	}
+	resource, ok := firstByteResource(ip.Dst)
+	if _, seen := firstByteWaiting[resource]; !ok || seen {
+		return
+	}
+	contact := &firstContact{dst: ip.Dst, out: now}
+	if lookup, ok := firstByteLookups[ip.Dst]; ok {
+		contact.dnsStart, contact.dnsEnd = lookup.sent, lookup.answered
+	}
+	firstByteWaiting[resource] = contact
+}
+
+// noteFirstByteInbound sees a packet coming out of the tunnel to the device
+func noteFirstByteInbound(packet []byte) {
+	if !firstByteArmed.Load() {
+		return
+	}
+	ip, ok := parseIPPacket(packet)
+	if !ok {
+		return
+	}
+	now := time.Now()
+
+	firstByteMutex.Lock()
+	defer firstByteMutex.Unlock()
+	if ip.Src == firstByteProxy {
+		payload, ok := dnsPayload(packet, ip, false)
+		var reply dns.Msg
+		if !ok || reply.Unpack(payload) != nil {
+			return
+		}
+		sent, ok := firstByteQueries[reply.Id]
+		if !ok {
+			return
+		}
+		delete(firstByteQueries, reply.Id)
+		for _, rr := range reply.Answer {
+			var addr netip.Addr
+			switch rr := rr.(type) {
+			case *dns.A:
+				addr, _ = netip.AddrFromSlice(rr.A.To4())
+			case *dns.AAAA:
+				addr, _ = netip.AddrFromSlice(rr.AAAA)
+			}
+			if addr.IsValid() {
+				firstByteLookups[addr] = dnsLookup{sent: sent, answered: now}
+			}
+		}
+		return
+	}
+	resource, ok := firstByteResource(ip.Src)
+	if !ok {
+		return
+	}
+	if contact := firstByteWaiting[resource]; contact != nil && contact.in.IsZero() && contact.dst == ip.Src {
+		contact.in = now
+	}
+}
+
+// wireGuardHandshakes maps each allowed IP on dev to the last handshake of
+// the peer it is assigned to
+func wireGuardHandshakes(dev *wgdevice.Device) (map[netip.Prefix]time.Time, error) {
+	config, err := dev.IpcGet()
+	if err != nil {
+		return nil, err
+	}
+
+	handshakes := map[netip.Prefix]time.Time{}
+	var allowed []netip.Prefix
+	var sec, nsec int64
+	flush := func() {
+		if sec == 0 {
+			return
+		}
+		for _, prefix := range allowed {
+			handshakes[prefix] = time.Unix(sec, nsec)
+		}
+	}
+	scanner := bufio.NewScanner(strings.NewReader(config))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "public_key":
+			flush()
+			allowed, sec, nsec = nil, 0, 0
+		case "allowed_ip":
+			if prefix, err := netip.ParsePrefix(value); err == nil {
+				allowed = append(allowed, prefix)
+			}
+		case "last_handshake_time_sec":
+			sec, _ = strconv.ParseInt(value, 10, 64)
+		case "last_handshake_time_nsec":
+			nsec, _ = strconv.ParseInt(value, 10, 64)
+		}
+	}
+	flush()
+	return handshakes, nil
+}
+
+// handshakeFor returns the last handshake of the peer that carries addr
+func handshakeFor(handshakes map[netip.Prefix]time.Time, addr netip.Addr) time.Time {
+	var best netip.Prefix
+	var at time.Time
+	for prefix, t := range handshakes {
+		if prefix.Contains(addr) && (!best.IsValid() || prefix.Bits() > best.Bits()) {
+			best, at = prefix, t
+		}
+	}
+	return at
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// firstByteSample splits a first contact into the lookup, the handshake the
+// packet had to wait for and the rest
+func firstByteSample(contact *firstContact, trigger string, handshake time.Time) FirstByteSample {
+	sample := FirstByteSample{
+		At:          contact.out,
+		Trigger:     trigger,
+		Destination: contact.dst.String(),
+		TotalMs:     milliseconds(contact.in.Sub(contact.out)),
+	}
+	if !contact.dnsStart.IsZero() {
+		sample.DNSMs = milliseconds(contact.dnsEnd.Sub(contact.dnsStart))
+	}
+	// A handshake that completed after the first packet held it back
+	if handshake.After(contact.out) && !handshake.After(contact.in) {
+		sample.HandshakeMs = milliseconds(handshake.Sub(contact.out))
+	}
+	sample.ServiceMs = max(0, sample.TotalMs-sample.HandshakeMs)
+
+	sample.Cause = FirstByteCauseService
+	if sample.HandshakeMs > sample.ServiceMs && sample.HandshakeMs >= sample.DNSMs {
+		sample.Cause = FirstByteCauseHandshake
+	} else if sample.DNSMs > sample.ServiceMs {
+		sample.Cause = FirstByteCauseDNS
+	}
+	return sample
+}
+
+// resourceFirstByte returns a resource's stats entry, or nil when the table
+// is full. Caller must hold firstByteMutex.
+func resourceFirstByte(resource string) *ResourceFirstByte {
+	stats := firstByteStats[resource]
+	if stats == nil && len(firstByteStats) < firstByteMaxResources {
+		stats = &ResourceFirstByte{Resource: resource}
+		firstByteStats[resource] = stats
+	}
+	return stats
+}
+
+// syncFirstByte keeps the route table current and records the first
+// contacts that got a reply. It runs with the packet path sampler, which
+// keeps the IPC call for the handshake times off the packet path.
+func syncFirstByte() {
+	if version := networkSettingsVersion(); version != firstByteRouteVersion() {
+		settings := effectiveNetworkSettings()
+		var routes []netip.Prefix
+		for _, route := range settings.IPv4IncludedRoutes {
+			if prefix, err := netip.ParsePrefix(ipv4RouteCIDR(route)); err == nil {
+				routes = append(routes, prefix)
+			}
+		}
+		for _, route := range settings.IPv6IncludedRoutes {
+			if prefix, err := netip.ParsePrefix(ipv6RouteCIDR(route)); err == nil {
+				routes = append(routes, prefix)
+			}
+		}
+		slices.SortStableFunc(routes, func(a, b netip.Prefix) int { return b.Bits() - a.Bits() })
+
+		firstByteMutex.Lock()
+		firstByteRoutes, firstByteVersion = routes, version
+		firstByteMutex.Unlock()
+	}
+	proxy, _ := olmDNSProxyAddr()
+
+	if !firstByteArmed.Load() {
+		firstByteMutex.Lock()
+		firstByteProxy = proxy
+		firstByteMutex.Unlock()
+		return
+	}
+
+	var handshakes map[netip.Prefix]time.Time
+	if dev := (*wgdevice.Device)(olmPointerField("dev", reflect.TypeOf((*wgdevice.Device)(nil)))); dev != nil {
+		var err error
+		if handshakes, err = wireGuardHandshakes(dev); err != nil {
+			appLogger.Debug("Failed to read WireGuard handshakes: %v", err)
+		}
+	}
+
+	firstByteMutex.Lock()
+	defer firstByteMutex.Unlock()
+	firstByteProxy = proxy
+	expired := time.Since(firstByteArmedAt) >= firstByteWindow
+	for resource, contact := range firstByteWaiting {
+		if contact == nil {
+			continue
+		}
+		stats := resourceFirstByte(resource)
+		switch {
+		case !contact.in.IsZero():
+			sample := firstByteSample(contact, firstByteTrigger, handshakeFor(handshakes, contact.dst))
+			if stats != nil {
+				stats.Samples++
+				stats.Last = &sample
+				if stats.Worst == nil || sample.TotalMs > stats.Worst.TotalMs {
+					stats.Worst = &sample
+				}
+			}
+			appLogger.Debug("First reply from %s after %.0fms (%s)", resource, sample.TotalMs, sample.Cause)
+		case expired:
+			if stats != nil {
+				stats.Unanswered++
+			}
+		default:
+			continue
+		}
+		// Keep the key so later packets in the window are not timed again
+		firstByteWaiting[resource] = nil
+	}
+	if expired {
+		firstByteArmed.Store(false)
+		firstByteWaiting = map[string]*firstContact{}
+		firstByteQueries = map[uint16]time.Time{}
+		firstByteLookups = map[netip.Addr]dnsLookup{}
+	}
+}
+
+func firstByteRouteVersion() int {
+	firstByteMutex.Lock()
+	defer firstByteMutex.Unlock()
+	return firstByteVersion
+}
+
+// startFirstByteMetrics times first contacts from the tunnel start on
+func startFirstByteMetrics() {
+	stopFirstByteMetrics()
+	// Timing needs to see every packet
+	wrapTunnelDevice()
+	firstByteMutex.Lock()
+	firstByteRunning = true
+	firstByteMutex.Unlock()
+	armFirstByte("connect")
+}
+
+// stopFirstByteMetrics stops timing and forgets the results
+func stopFirstByteMetrics() {
+	firstByteArmed.Store(false)
+	firstByteMutex.Lock()
+	firstByteRunning = false
+	firstByteTrigger, firstByteArmedAt = "", time.Time{}
+	firstByteRoutes, firstByteVersion, firstByteProxy = nil, 0, netip.Addr{}
+	firstByteWaiting = map[string]*firstContact{}
+	firstByteQueries = map[uint16]time.Time{}
+	firstByteLookups = map[netip.Addr]dnsLookup{}
+	firstByteStats = map[string]*ResourceFirstByte{}
+	firstByteMutex.Unlock()
+}
+
+// getFirstByteStats returns the resources slowest to answer their first
+// packet after a connect or wake, as JSON
+//
+//export getFirstByteStats
+func getFirstByteStats() *C.char {
+	firstByteMutex.Lock()
+	stats := FirstByteStats{
+		Measuring: firstByteArmed.Load(),
+		Trigger:   firstByteTrigger,
+		ArmedAt:   firstByteArmedAt,
+		Resources: make([]ResourceFirstByte, 0, len(firstByteStats)),
+	}
+	for _, resource := range firstByteStats {
+		stats.Resources = append(stats.Resources, *resource)
+	}
+	firstByteMutex.Unlock()
+
+	worst := func(r ResourceFirstByte) float64 {
+		if r.Worst == nil {
+			return 0
+		}
+		return r.Worst.TotalMs
+	}
+	slices.SortFunc(stats.Resources, func(a, b ResourceFirstByte) int {
+		if c := b.Unanswered - a.Unanswered; c != 0 {
+			return c
+		}
+		if wa, wb := worst(a), worst(b); wa != wb {
+			if wa > wb {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a.Resource, b.Resource)
+	})
+	if len(stats.Resources) > firstByteWorst {
+		stats.Resources = stats.Resources[:firstByteWorst]
+	}
+
+	data, err := json.Marshal(stats)
+	if err != nil {
+		appLogger.Error("Failed to marshal first byte stats: %v", err)
+		return exportString(`{"measuring":false,"resources":[]}`)
+	}
+	return exportString(string(data))
+}
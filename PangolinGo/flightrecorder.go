@@ -0,0 +1,142 @@
+package main
+
+import "C"
+import (
+	"fmt"
+	"os"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// flightRecorderSize bounds memory use; at the rates below it holds well
+	// over flightRecorderWindow of history
+	flightRecorderSize = 1024
+	// flightRecorderWindow is how far back a dump reaches
+	flightRecorderWindow = 2 * time.Minute
+
+	flightRecorderFile = "flightrecorder.log"
+	crashOutputFile    = "crash.log"
+)
+
+// Flight recorder event kinds
+const (
+	EventState     = "state"
+	EventHandshake = "handshake"
+	EventSettings  = "settings"
+	EventDNS       = "dns"
+	EventLog       = "log"
+	EventPanic     = "panic"
+)
+
+type flightEvent struct {
+	at      time.Time
+	kind    string
+	message string
+}
+
+var (
+	flightMutex  sync.Mutex
+	flightEvents [flightRecorderSize]flightEvent
+	flightNext   int
+	flightFull   bool
+)
+
+// recordEvent appends an event to the in-memory ring. Formatting is the only
+// real cost, so callers on hot paths should not use it.
+func recordEvent(kind, format string, args ...interface{}) {
+	message := format
+	if len(args) > 0 {
+		message = fmt.Sprintf(format, args...)
+	}
+	now := time.Now()
+
+	flightMutex.Lock()
+	flightEvents[flightNext] = flightEvent{at: now, kind: kind, message: message}
+	flightNext = (flightNext + 1) % flightRecorderSize
+	if flightNext == 0 {
+		flightFull = true
+	}
+	flightMutex.Unlock()
+}
+
+// recordOlmLog picks out the olm log lines worth keeping. WireGuard only logs
+// handshakes at debug level, so those show up when debug logging is on.
+func recordOlmLog(message string) {
+	lower := strings.ToLower(message)
+	switch {
+	case strings.Contains(lower, "handshake"):
+		recordEvent(EventHandshake, "%s", message)
+	case strings.Contains(lower, "dns"):
+		recordEvent(EventDNS, "%s", message)
+	}
+}
+
+// flightRecorderText renders the events of the last flightRecorderWindow,
+// oldest first, one per line with microsecond timestamps
+func flightRecorderText() string {
+	flightMutex.Lock()
+	var events []flightEvent
+	if flightFull {
+		events = append(events, flightEvents[flightNext:]...)
+	}
+	events = append(events, flightEvents[:flightNext]...)
+	flightMutex.Unlock()
+
+	cutoff := time.Now().Add(-flightRecorderWindow)
+	var b strings.Builder
+	for _, event := range events {
+		if event.at.Before(cutoff) {
+			continue
+		}
+		fmt.Fprintf(&b, "%s %-9s %s\n", event.at.UTC().Format("2006-01-02T15:04:05.000000Z"), event.kind, event.message)
+	}
+	return b.String()
+}
+
+// dumpFlightRecorder writes the recent events to the state directory, where
+// the diagnostics bundle picks them up
+func dumpFlightRecorder(reason string) {
+	text := fmt.Sprintf("# %s at %s\n%s", reason, time.Now().UTC().Format(time.RFC3339), flightRecorderText())
+	if err := writeStateFile(flightRecorderFile, []byte(text)); err != nil {
+		appLogger.Debug("Failed to write flight recorder: %v", err)
+	}
+}
+
+// dumpOnPanic is deferred at the top of the bridge's goroutines so a crash
+// leaves the events leading up to it behind. The panic is re-raised.
+func dumpOnPanic() {
+	if r := recover(); r != nil {
+		recordEvent(EventPanic, "%v", r)
+		dumpFlightRecorder(fmt.Sprintf("panic: %v", r))
+		panic(r)
+	}
+}
+
+// enableCrashOutput sends the runtime's fatal error output, including panics
+// in olm's own goroutines, to a file in the state directory
+func enableCrashOutput() {
+	path := statePath(crashOutputFile)
+	if path == "" {
+		return
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		appLogger.Debug("Failed to open crash output: %v", err)
+		return
+	}
+	defer file.Close()
+	if err := debug.SetCrashOutput(file, debug.CrashOptions{}); err != nil {
+		appLogger.Debug("Failed to set crash output: %v", err)
+	}
+}
+
+// getFlightRecorder returns the recent internal events as text, for the
+// diagnostics bundle
+//
+//export getFlightRecorder
+func getFlightRecorder() *C.char {
+	return exportString(flightRecorderText())
+}
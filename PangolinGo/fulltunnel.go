@@ -0,0 +1,80 @@
+package main
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/fosrl/newt/network"
+)
+
+var (
+	fullTunnelMutex sync.Mutex
+	// fullTunnelMode forces the default routes in when true and out when
+	// false; nil leaves them to the server
+	fullTunnelMode *bool
+)
+
+// setFullTunnelMode changes whether all traffic goes into the tunnel
+func setFullTunnelMode(mode *bool) {
+	fullTunnelMutex.Lock()
+	changed := (mode == nil) != (fullTunnelMode == nil) || (mode != nil && *mode != *fullTunnelMode)
+	fullTunnelMode = mode
+	fullTunnelMutex.Unlock()
+
+	if !changed {
+		return
+	}
+	switch {
+	case mode == nil:
+		appLogger.Info("Full tunnel left to the server's routes")
+	case *mode:
+		appLogger.Info("Full tunnel on: all traffic goes into the tunnel")
+	default:
+		appLogger.Info("Full tunnel off: only the sites' routes go into the tunnel")
+	}
+	bumpSettingsVersion()
+}
+
+// applyFullTunnelRoutes adds or drops the default routes as the full tunnel
+// mode says. An IPv6 default route is only added with an IPv6 address to
+// carry it.
+func applyFullTunnelRoutes(settings network.NetworkSettings) network.NetworkSettings {
+	fullTunnelMutex.Lock()
+	mode := fullTunnelMode
+	fullTunnelMutex.Unlock()
+	if mode == nil {
+		return settings
+	}
+
+	if *mode {
+		if !slices.ContainsFunc(settings.IPv4IncludedRoutes, func(r network.IPv4Route) bool { return ipv4RouteCIDR(r) == "0.0.0.0/0" }) {
+			settings.IPv4IncludedRoutes = append(settings.IPv4IncludedRoutes, network.IPv4Route{
+				DestinationAddress: "0.0.0.0",
+				SubnetMask:         "0.0.0.0",
+				IsDefault:          true,
+			})
+		}
+		if len(settings.IPv6Addresses) > 0 && !slices.ContainsFunc(settings.IPv6IncludedRoutes, func(r network.IPv6Route) bool { return ipv6RouteCIDR(r) == "::/0" }) {
+			settings.IPv6IncludedRoutes = append(settings.IPv6IncludedRoutes, network.IPv6Route{
+				DestinationAddress: "::",
+				IsDefault:          true,
+			})
+		}
+		return settings
+	}
+
+	var v4 []network.IPv4Route
+	for _, route := range settings.IPv4IncludedRoutes {
+		if ipv4RouteCIDR(route) != "0.0.0.0/0" {
+			v4 = append(v4, route)
+		}
+	}
+	var v6 []network.IPv6Route
+	for _, route := range settings.IPv6IncludedRoutes {
+		if ipv6RouteCIDR(route) != "::/0" {
+			v6 = append(v6, route)
+		}
+	}
+	settings.IPv4IncludedRoutes, settings.IPv6IncludedRoutes = v4, v6
+	return settings
+}
@@ -0,0 +1,63 @@
+package main
+
+import "C"
+import (
+	"fmt"
+	"runtime"
+	"time"
+)
+
+const (
+	goroutineDumpFile = "goroutines.log"
+	// maxGoroutineDump bounds the stack buffer; a dump this large is cut
+	// short rather than grow without end
+	maxGoroutineDump = 16 << 20
+	// hangTimeout is how long an export may take before its goroutines are
+	// dumped on the assumption that it hangs
+	hangTimeout = 20 * time.Second
+)
+
+// goroutineStacks returns the stacks of all goroutines
+func goroutineStacks() []byte {
+	buf := make([]byte, 256<<10)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) || len(buf) >= maxGoroutineDump {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// writeGoroutineDump writes all goroutine stacks to the state directory,
+// where the diagnostics bundle picks them up, and returns them
+func writeGoroutineDump(reason string) string {
+	text := fmt.Sprintf("# %s at %s, %d goroutines\n%s", reason, time.Now().UTC().Format(time.RFC3339),
+		runtime.NumGoroutine(), goroutineStacks())
+	if err := writeStateFile(goroutineDumpFile, []byte(text)); err != nil {
+		appLogger.Debug("Failed to write goroutine dump: %v", err)
+	}
+	return text
+}
+
+// watchForHang dumps the goroutines if the returned function is not called
+// within hangTimeout. It runs on its own timer, so it still fires when the
+// scheduler is what is stuck.
+func watchForHang(name string) func() {
+	timer := time.AfterFunc(hangTimeout, func() {
+		appLogger.Error("%s has not returned after %v, dumping goroutines", name, hangTimeout)
+		recordEvent(EventState, "%s hung", name)
+		writeGoroutineDump(name + " hung")
+		dumpFlightRecorder(name + " hung")
+	})
+	return func() { timer.Stop() }
+}
+
+// dumpGoroutines returns a stack dump of every goroutine and writes it to
+// the state directory, for diagnosing hangs in the field
+//
+//export dumpGoroutines
+func dumpGoroutines() *C.char {
+	appLogger.Info("Dumping goroutines on request")
+	return exportString(writeGoroutineDump("requested"))
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// connectionAttemptDelay staggers the racing connection attempts
+	// (RFC 8305 section 5)
+	connectionAttemptDelay = 250 * time.Millisecond
+	controlDialTimeout     = 30 * time.Second
+)
+
+// installHappyEyeballs makes olm's websocket, dialed over gorilla's
+// DefaultDialer, race every resolved address instead of trying them one at
+// a time, and counts its connections, see trackControlConns; the bridge's
+// own requests race through controlBaseTransport.
+// olm's token request builds its own client and the initial UDP path is
+// dialed by WireGuard inside olm, so neither can be changed from here.
+func installHappyEyeballs() {
+	websocket.DefaultDialer.NetDialContext = trackControlConns(breakerDialContext(raceDialContext))
+}
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// raceDialContext resolves address and connects to the resolved addresses
+// alternating between IPv6 and IPv4, starting a new attempt whenever the
+// previous one fails or connectionAttemptDelay passes. The first connection
+// to succeed is returned and the others are abandoned.
+func raceDialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer, err := controlDialer()
+	if err != nil {
+		return nil, err
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return dialer.DialContext(ctx, network, address)
+	}
+
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	addrs = interleaveAddressFamilies(addrs)
+	if len(addrs) == 1 {
+		return dialer.DialContext(ctx, network, net.JoinHostPort(addrs[0].String(), port))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, controlDialTimeout)
+	defer cancel()
+
+	results := make(chan dialResult, len(addrs))
+	attempt := func(addr netip.Addr) {
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(addr.Unmap().String(), port))
+		results <- dialResult{conn, err}
+	}
+
+	next, pending := 0, 0
+	var errs []error
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			if next < len(addrs) {
+				go attempt(addrs[next])
+				next++
+				pending++
+				timer.Reset(connectionAttemptDelay)
+			}
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				// Close whatever else connects before the cancel lands
+				go func(remaining int) {
+					for ; remaining > 0; remaining-- {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				appLogger.Debug("Connected to %s via %s", address, result.conn.RemoteAddr())
+				return result.conn, nil
+			}
+			errs = append(errs, result.err)
+			if next < len(addrs) {
+				// Do not wait out the delay after a failure
+				timer.Reset(0)
+			} else if pending == 0 {
+				return nil, errors.Join(errs...)
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// interleaveAddressFamilies orders addresses IPv6 first, alternating
+// families, keeping the resolver's order within each family
+func interleaveAddressFamilies(addrs []netip.Addr) []netip.Addr {
+	var v4, v6 []netip.Addr
+	for _, addr := range addrs {
+		if addr.Unmap().Is4() {
+			v4 = append(v4, addr)
+		} else {
+			v6 = append(v6, addr)
+		}
+	}
+
+	ordered := make([]netip.Addr, 0, len(addrs))
+	for i := 0; i < len(v4) || i < len(v6); i++ {
+		if i < len(v6) {
+			ordered = append(ordered, v6[i])
+		}
+		if i < len(v4) {
+			ordered = append(ordered, v4[i])
+		}
+	}
+	return ordered
+}
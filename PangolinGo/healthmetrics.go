@@ -0,0 +1,297 @@
+package main
+
+import "C"
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+
+	olmapi "github.com/fosrl/olm/api"
+	wgdevice "golang.zx2c4.com/wireguard/device"
+)
+
+// Health levels, from best to worst
+const (
+	HealthOK       = "ok"
+	HealthWarning  = "warning"
+	HealthCritical = "critical"
+)
+
+// Health warnings on a peer
+const (
+	HealthWarnHighLatency = "highLatency"
+	HealthWarnHighJitter  = "highJitter"
+	// HealthWarnHandshakeOverdue: WireGuard should have rekeyed by now
+	HealthWarnHandshakeOverdue = "handshakeOverdue"
+	// HealthWarnHandshakeStale: the session expired, nothing gets through
+	HealthWarnHandshakeStale = "handshakeStale"
+	HealthWarnNoHandshake    = "noHandshake"
+	// HealthWarnNotAnswering: olm's pings went unanswered for longer than
+	// the ping timeout
+	HealthWarnNotAnswering = "notAnswering"
+)
+
+// Diagnoses of an unhealthy peer
+const (
+	// HealthDiagnosisHandshake: WireGuard cannot reach the peer, so the
+	// endpoint or the UDP path is the problem
+	HealthDiagnosisHandshake = "handshake"
+	// HealthDiagnosisRouting: the session is up but pings do not come back,
+	// so the problem is past the tunnel, in routes or the site itself
+	HealthDiagnosisRouting = "routing"
+)
+
+// rttSampleCount is how many RTT samples are kept per peer
+const rttSampleCount = 20
+
+// HealthThresholds are the limits past which a peer is flagged
+type HealthThresholds struct {
+	RTTWarningMs    float64 `json:"rttWarningMs"`
+	JitterWarningMs float64 `json:"jitterWarningMs"`
+	// HandshakeWarningSeconds is WireGuard's rekey time with some slack
+	HandshakeWarningSeconds float64 `json:"handshakeWarningSeconds"`
+	// HandshakeCriticalSeconds is when WireGuard stops using the session
+	HandshakeCriticalSeconds float64 `json:"handshakeCriticalSeconds"`
+	// NotAnsweringSeconds is the ping timeout
+	NotAnsweringSeconds float64 `json:"notAnsweringSeconds"`
+}
+
+var healthThresholds = HealthThresholds{
+	RTTWarningMs:             250,
+	JitterWarningMs:          50,
+	HandshakeWarningSeconds:  150,
+	HandshakeCriticalSeconds: handshakeAliveWindow.Seconds(),
+}
+
+// PeerHealth is one peer in getHealthMetrics. RTTs are from olm's pings;
+// they are absent until the peer has answered one.
+type PeerHealth struct {
+	SiteID     int     `json:"siteId"`
+	Name       string  `json:"name,omitempty"`
+	Connected  bool    `json:"connected"`
+	RTTMs      float64 `json:"rttMs,omitempty"`
+	AvgRTTMs   float64 `json:"avgRttMs,omitempty"`
+	MinRTTMs   float64 `json:"minRttMs,omitempty"`
+	MaxRTTMs   float64 `json:"maxRttMs,omitempty"`
+	JitterMs   float64 `json:"jitterMs,omitempty"`
+	RTTSamples int     `json:"rttSamples"`
+	// LastSeenSeconds is how long ago the peer last answered a ping
+	LastSeenSeconds *float64 `json:"lastSeenSeconds,omitempty"`
+	// HandshakeAgeSeconds is how old the WireGuard session is
+	HandshakeAgeSeconds *float64 `json:"handshakeAgeSeconds,omitempty"`
+	Status              string   `json:"status"`
+	Warnings            []string `json:"warnings"`
+	Diagnosis           string   `json:"diagnosis,omitempty"`
+}
+
+// HealthMetrics is the JSON returned by getHealthMetrics
+type HealthMetrics struct {
+	// Status is the worst status of any peer
+	Status     string           `json:"status"`
+	Peers      []PeerHealth     `json:"peers"`
+	Thresholds HealthThresholds `json:"thresholds"`
+	SampledAt  time.Time        `json:"sampledAt"`
+}
+
+// peerRTTs are the recent RTT samples of one peer, oldest first
+type peerRTTs struct {
+	samples  []time.Duration
+	lastSeen time.Time
+}
+
+var (
+	healthMutex sync.Mutex
+	healthRTTs  = map[int]*peerRTTs{}
+)
+
+// recordPeerRTTs keeps the RTT of every peer that answered a ping since the
+// last sample. Called by the ping monitor.
+func recordPeerRTTs(statuses map[int]*olmapi.PeerStatus) {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	for siteID, peer := range statuses {
+		if peer == nil || !peer.Connected || peer.RTT <= 0 {
+			continue
+		}
+		rtts := healthRTTs[siteID]
+		if rtts == nil {
+			rtts = &peerRTTs{}
+			healthRTTs[siteID] = rtts
+		}
+		if !peer.LastSeen.After(rtts.lastSeen) {
+			// No new answer since the last sample
+			continue
+		}
+		rtts.lastSeen = peer.LastSeen
+		rtts.samples = append(rtts.samples, peer.RTT)
+		if len(rtts.samples) > rttSampleCount {
+			rtts.samples = rtts.samples[len(rtts.samples)-rttSampleCount:]
+		}
+	}
+	for siteID := range healthRTTs {
+		if _, ok := statuses[siteID]; !ok {
+			delete(healthRTTs, siteID)
+		}
+	}
+}
+
+// resetPeerRTTs forgets the samples of a previous tunnel
+func resetPeerRTTs() {
+	healthMutex.Lock()
+	healthRTTs = map[int]*peerRTTs{}
+	healthMutex.Unlock()
+}
+
+// fillRTTs summarizes a peer's samples. Jitter is the mean difference
+// between consecutive samples.
+func (h *PeerHealth) fillRTTs(samples []time.Duration) {
+	h.RTTSamples = len(samples)
+	if len(samples) == 0 {
+		return
+	}
+	var sum, jitter time.Duration
+	for i, rtt := range samples {
+		sum += rtt
+		if i > 0 {
+			jitter += time.Duration(math.Abs(float64(rtt - samples[i-1])))
+		}
+	}
+	h.RTTMs = milliseconds(samples[len(samples)-1])
+	h.AvgRTTMs = milliseconds(sum / time.Duration(len(samples)))
+	h.MinRTTMs = milliseconds(slices.Min(samples))
+	h.MaxRTTMs = milliseconds(slices.Max(samples))
+	if len(samples) > 1 {
+		h.JitterMs = milliseconds(jitter / time.Duration(len(samples)-1))
+	}
+}
+
+// assess sets the peer's warnings, status and diagnosis. Without
+// handshakesKnown a missing handshake age is not held against the peer.
+func (h *PeerHealth) assess(thresholds HealthThresholds, handshakesKnown bool) {
+	h.Warnings = []string{}
+	h.Status = HealthOK
+	flag := func(warning, level string) {
+		h.Warnings = append(h.Warnings, warning)
+		if level == HealthCritical || h.Status == HealthOK {
+			h.Status = level
+		}
+	}
+
+	if h.RTTSamples > 0 && h.AvgRTTMs > thresholds.RTTWarningMs {
+		flag(HealthWarnHighLatency, HealthWarning)
+	}
+	if h.RTTSamples > 1 && h.JitterMs > thresholds.JitterWarningMs {
+		flag(HealthWarnHighJitter, HealthWarning)
+	}
+
+	handshakeDown := false
+	switch age := h.HandshakeAgeSeconds; {
+	case age == nil && !handshakesKnown:
+		// Unknown rather than missing
+	case age == nil:
+		handshakeDown = true
+		flag(HealthWarnNoHandshake, HealthCritical)
+	case *age >= thresholds.HandshakeCriticalSeconds:
+		handshakeDown = true
+		flag(HealthWarnHandshakeStale, HealthCritical)
+	case *age >= thresholds.HandshakeWarningSeconds:
+		flag(HealthWarnHandshakeOverdue, HealthWarning)
+	}
+
+	notAnswering := !h.Connected || h.LastSeenSeconds == nil || *h.LastSeenSeconds > thresholds.NotAnsweringSeconds
+	if notAnswering {
+		flag(HealthWarnNotAnswering, HealthCritical)
+	}
+
+	switch {
+	case handshakeDown:
+		h.Diagnosis = HealthDiagnosisHandshake
+	case notAnswering:
+		h.Diagnosis = HealthDiagnosisRouting
+	}
+}
+
+// worseHealth returns the worse of two health levels
+func worseHealth(a, b string) string {
+	rank := map[string]int{HealthOK: 0, HealthWarning: 1, HealthCritical: 2}
+	if rank[b] > rank[a] {
+		return b
+	}
+	return a
+}
+
+// getHealthMetrics returns each site's RTT from olm's pings, its handshake
+// age and the warnings they raise, as JSON. A peer whose handshake is stale
+// is diagnosed as unreachable over WireGuard; one with a live session that
+// does not answer pings as a routing problem past the tunnel.
+//
+//export getHealthMetrics
+func getHealthMetrics() *C.char {
+	metrics := HealthMetrics{Status: HealthOK, Peers: []PeerHealth{}, SampledAt: time.Now()}
+	_, timeout := peerPingMonitor.parameters()
+	thresholds := healthThresholds
+	thresholds.NotAnsweringSeconds = timeout.Seconds()
+	metrics.Thresholds = thresholds
+
+	status, err := fetchOlmStatus()
+	if err != nil {
+		// Nothing to report before the tunnel is up
+		appLogger.Debug("Health metrics could not read olm status: %v", err)
+	}
+
+	handshakes := map[int]time.Time{}
+	handshakesKnown := false
+	if dev := (*wgdevice.Device)(olmPointerField("dev", reflect.TypeOf((*wgdevice.Device)(nil)))); dev != nil {
+		if stats, err := wireGuardPeerStats(dev); err == nil {
+			handshakesKnown = true
+			matchPeerSites(stats)
+			for _, peer := range stats {
+				if peer.SiteID != 0 && peer.LastHandshake != nil {
+					handshakes[peer.SiteID] = *peer.LastHandshake
+				}
+			}
+		} else {
+			appLogger.Debug("Health metrics could not read WireGuard peers: %v", err)
+		}
+	}
+
+	if status != nil {
+		healthMutex.Lock()
+		for siteID, peer := range status.PeerStatuses {
+			if peer == nil {
+				continue
+			}
+			health := PeerHealth{SiteID: siteID, Name: peer.Name, Connected: peer.Connected}
+			if rtts := healthRTTs[siteID]; rtts != nil {
+				health.fillRTTs(rtts.samples)
+			}
+			if !peer.LastSeen.IsZero() {
+				seen := metrics.SampledAt.Sub(peer.LastSeen).Seconds()
+				health.LastSeenSeconds = &seen
+			}
+			if at, ok := handshakes[siteID]; ok {
+				age := metrics.SampledAt.Sub(at).Seconds()
+				health.HandshakeAgeSeconds = &age
+			}
+			metrics.Peers = append(metrics.Peers, health)
+		}
+		healthMutex.Unlock()
+	}
+
+	for i := range metrics.Peers {
+		metrics.Peers[i].assess(thresholds, handshakesKnown)
+		metrics.Status = worseHealth(metrics.Status, metrics.Peers[i].Status)
+	}
+	slices.SortFunc(metrics.Peers, func(a, b PeerHealth) int { return a.SiteID - b.SiteID })
+
+	data, err := json.Marshal(metrics)
+	if err != nil {
+		appLogger.Error("Failed to marshal health metrics: %v", err)
+		return exportString(fmt.Sprintf("Error: Failed to marshal health metrics: %v", err))
+	}
+	return exportString(string(data))
+}
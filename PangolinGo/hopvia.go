@@ -0,0 +1,227 @@
+package main
+
+import "C"
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/netip"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/fosrl/newt/network"
+	"github.com/fosrl/olm/peers"
+	wgdevice "golang.zx2c4.com/wireguard/device"
+)
+
+// RouteVia sends a subnet through an intermediate site instead of the site
+// that publishes it, for networks only that site has a path to. The client
+// only picks the WireGuard peer; the intermediate site has to forward the
+// traffic onwards, so its own routes must cover the subnet.
+type RouteVia struct {
+	CIDR      string `json:"cidr"`
+	ViaSiteID int    `json:"viaSiteId"`
+}
+
+type hopRoute struct {
+	prefix netip.Prefix
+	via    int
+}
+
+var (
+	hopMutex  sync.Mutex
+	hopRoutes []hopRoute
+	// hopReleased holds subnets whose override was removed and that still
+	// need to go back to the site olm assigned them to
+	hopReleased []netip.Prefix
+)
+
+// parseRouteVia validates the per-route overrides
+func parseRouteVia(routes []RouteVia) ([]hopRoute, error) {
+	var parsed []hopRoute
+	for _, route := range routes {
+		prefix, err := netip.ParsePrefix(route.CIDR)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subnet %q: %w", route.CIDR, err)
+		}
+		prefix = prefix.Masked()
+		if prefix.Bits() == 0 {
+			return nil, fmt.Errorf("the default route cannot be sent through a site")
+		}
+		if route.ViaSiteID <= 0 {
+			return nil, fmt.Errorf("subnet %s has no intermediate site", prefix)
+		}
+		for _, other := range parsed {
+			if other.prefix == prefix {
+				return nil, fmt.Errorf("subnet %s is listed more than once", prefix)
+			}
+		}
+		parsed = append(parsed, hopRoute{prefix: prefix, via: route.ViaSiteID})
+	}
+	return parsed, nil
+}
+
+// setRouteVia replaces the overrides. Subnets that lose their override are
+// handed back to their original site on the next sync.
+func setRouteVia(routes []RouteVia) error {
+	parsed, err := parseRouteVia(routes)
+	if err != nil {
+		return err
+	}
+
+	hopMutex.Lock()
+	for _, old := range hopRoutes {
+		if !slices.ContainsFunc(parsed, func(r hopRoute) bool { return r.prefix == old.prefix }) {
+			hopReleased = append(hopReleased, old.prefix)
+		}
+	}
+	hopRoutes = parsed
+	hopMutex.Unlock()
+
+	for _, route := range parsed {
+		appLogger.Info("Routing %s through site %d", route.prefix, route.via)
+	}
+	bumpSettingsVersion()
+	return nil
+}
+
+func currentHopRoutes() []hopRoute {
+	hopMutex.Lock()
+	defer hopMutex.Unlock()
+	return hopRoutes
+}
+
+// applyHopRoutes makes sure the overridden subnets are routed into the
+// tunnel, including ones no site publishes itself
+func applyHopRoutes(settings network.NetworkSettings) network.NetworkSettings {
+	for _, route := range currentHopRoutes() {
+		cidr := route.prefix.String()
+		if route.prefix.Addr().Is4() {
+			if !slices.ContainsFunc(settings.IPv4IncludedRoutes, func(r network.IPv4Route) bool { return ipv4RouteCIDR(r) == cidr }) {
+				settings.IPv4IncludedRoutes = append(settings.IPv4IncludedRoutes, network.IPv4Route{
+					DestinationAddress: route.prefix.Addr().String(),
+					SubnetMask:         net.IP(net.CIDRMask(route.prefix.Bits(), 32)).String(),
+				})
+			}
+		} else if !slices.ContainsFunc(settings.IPv6IncludedRoutes, func(r network.IPv6Route) bool { return ipv6RouteCIDR(r) == cidr }) {
+			settings.IPv6IncludedRoutes = append(settings.IPv6IncludedRoutes, network.IPv6Route{
+				DestinationAddress:  route.prefix.Addr().String(),
+				NetworkPrefixLength: route.prefix.Bits(),
+			})
+		}
+	}
+	return settings
+}
+
+// wireGuardAllowedIPOwners maps each allowed IP on dev to the hex public key
+// of the peer it is assigned to
+func wireGuardAllowedIPOwners(dev *wgdevice.Device) (map[string]string, error) {
+	config, err := dev.IpcGet()
+	if err != nil {
+		return nil, err
+	}
+
+	owners := map[string]string{}
+	var peer string
+	scanner := bufio.NewScanner(strings.NewReader(config))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "public_key":
+			peer = value
+		case "allowed_ip":
+			owners[value] = peer
+		}
+	}
+	return owners, nil
+}
+
+// syncHopRoutes assigns each overridden subnet to its intermediate site's
+// WireGuard peer. olm reassigns allowed IPs when peers are added, updated or
+// re-ranked, so this runs on every olm sync and moves them back.
+func syncHopRoutes() {
+	hopMutex.Lock()
+	defer hopMutex.Unlock()
+	if len(hopRoutes) == 0 && len(hopReleased) == 0 {
+		return
+	}
+
+	pm := (*peers.PeerManager)(olmPointerField("peerManager", reflect.TypeOf((*peers.PeerManager)(nil))))
+	dev := (*wgdevice.Device)(olmPointerField("dev", reflect.TypeOf((*wgdevice.Device)(nil))))
+	if pm == nil || dev == nil {
+		return
+	}
+	owners, err := wireGuardAllowedIPOwners(dev)
+	if err != nil {
+		return
+	}
+
+	for _, route := range hopRoutes {
+		site, ok := pm.GetPeer(route.via)
+		if !ok {
+			continue
+		}
+		key, err := decodeWireGuardKey(site.PublicKey)
+		if err != nil || owners[route.prefix.String()] == key {
+			continue
+		}
+		if err := peers.AddAllowedIP(dev, site.PublicKey, route.prefix.String()); err != nil {
+			appLogger.Warn("Failed to route %s through site %d: %v", route.prefix, route.via, err)
+			continue
+		}
+		appLogger.Debug("Assigned %s to site %d", route.prefix, route.via)
+		recordEvent(EventSettings, "%s routed through site %d", route.prefix, route.via)
+	}
+
+	// Hand released subnets back to a site that publishes them. With none
+	// left the route is gone from the system too, so a stale assignment on
+	// the intermediate peer carries no traffic.
+	for _, prefix := range hopReleased {
+		cidr := prefix.String()
+		for _, site := range pm.GetAllPeers() {
+			if slices.Contains(site.AllowedIps, cidr) {
+				if err := peers.AddAllowedIP(dev, site.PublicKey, cidr); err != nil {
+					appLogger.Warn("Failed to return %s to site %d: %v", cidr, site.SiteId, err)
+				}
+				break
+			}
+		}
+	}
+	hopReleased = nil
+}
+
+// setRoutesVia replaces the per-route intermediate sites at runtime. Takes a
+// JSON array of {"cidr", "viaSiteId"} objects; an empty array removes them.
+//
+//export setRoutesVia
+func setRoutesVia(routesJSON *C.char) *C.char {
+	if locked := managedLockResult("routeVia"); locked != nil {
+		return locked
+	}
+	var routes []RouteVia
+	if err := decodeCompatJSON([]byte(C.GoString(routesJSON)), &routes, "routes via"); err != nil {
+		appLogger.Error("Failed to parse routes: %v", err)
+		return exportString(fmt.Sprintf("Error: Failed to parse routes: %v", err))
+	}
+	if err := updateRoutesVia(routes); err != nil {
+		appLogger.Error("Invalid routes: %v", err)
+		return exportString(fmt.Sprintf("Error: Invalid routes: %v", err))
+	}
+	return exportString("Routes updated")
+}
+
+// updateRoutesVia replaces the running tunnel's routes through a site
+func updateRoutesVia(routes []RouteVia) error {
+	if err := setRouteVia(routes); err != nil {
+		return err
+	}
+	tunnelMutex.Lock()
+	activeTunnelConfig.RouteVia = routes
+	tunnelMutex.Unlock()
+	return nil
+}
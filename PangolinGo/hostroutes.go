@@ -0,0 +1,232 @@
+package main
+
+import "C"
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fosrl/newt/network"
+)
+
+// Kinds of RouteConflict
+const (
+	// ConflictOverlapsVPNRoute: another VPN routes some of the same
+	// addresses, and whichever route the system prefers wins
+	ConflictOverlapsVPNRoute = "overlapsVpnRoute"
+	// ConflictShadowedByHostRoute: a more specific host route sends part of
+	// an included route somewhere other than the tunnel
+	ConflictShadowedByHostRoute = "shadowedByHostRoute"
+)
+
+// HostRoute is one entry of the host routing table as Swift reports it
+type HostRoute struct {
+	Destination string `json:"destination"` // CIDR
+	Interface   string `json:"interface"`
+	Gateway     string `json:"gateway,omitempty"`
+}
+
+// RouteConflict is one included route that the host routing table may send
+// elsewhere
+type RouteConflict struct {
+	Kind      string `json:"kind"`
+	Route     string `json:"route"`
+	HostRoute string `json:"hostRoute"`
+	Interface string `json:"interface"`
+}
+
+// SettingsWarning explains a problem with the published settings
+type SettingsWarning struct {
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
+// SettingsWarnings is the JSON returned by getSettingsWarnings
+type SettingsWarnings struct {
+	Warnings       []SettingsWarning `json:"warnings"`
+	RouteConflicts []RouteConflict   `json:"routeConflicts,omitempty"`
+	CheckedAt      time.Time         `json:"checkedAt,omitempty"`
+}
+
+var (
+	hostRoutesMutex sync.Mutex
+	// hostRoutes is the last routing table snapshot, nil until Swift sends one
+	hostRoutes     []hostRoute
+	routeConflicts []RouteConflict
+	routeCheckedAt time.Time
+)
+
+type hostRoute struct {
+	prefix netip.Prefix
+	iface  string
+}
+
+// vpnInterface reports whether an interface belongs to a VPN, as far as the
+// name tells
+func vpnInterface(name string) bool {
+	for _, prefix := range []string{"utun", "ipsec", "ppp", "tun", "tap", "wg"} {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseHostRoutes checks a routing table snapshot. Default routes are left
+// out; every VPN and the LAN have one and they say nothing about overlaps.
+func parseHostRoutes(routes []HostRoute) ([]hostRoute, error) {
+	out := make([]hostRoute, 0, len(routes))
+	for _, route := range routes {
+		destination := route.Destination
+		if !strings.Contains(destination, "/") {
+			if addr, err := netip.ParseAddr(destination); err == nil {
+				destination = netip.PrefixFrom(addr, addr.BitLen()).String()
+			}
+		}
+		prefix, err := netip.ParsePrefix(destination)
+		if err != nil {
+			return nil, fmt.Errorf("invalid destination %q: %w", route.Destination, err)
+		}
+		if route.Interface == "" {
+			return nil, fmt.Errorf("route %s has no interface", route.Destination)
+		}
+		if prefix.Bits() == 0 {
+			continue
+		}
+		out = append(out, hostRoute{prefix: prefix.Masked(), iface: route.Interface})
+	}
+	return out, nil
+}
+
+// findRouteConflicts compares the included routes against the host routes on
+// other interfaces. Host routes to single addresses outside VPNs are mostly
+// the neighbor cache and are ignored.
+func findRouteConflicts(settings network.NetworkSettings, routes []hostRoute, tunnelIface string) []RouteConflict {
+	var conflicts []RouteConflict
+	for _, included := range includedRoutePrefixes(settings) {
+		for _, host := range routes {
+			if host.iface == tunnelIface || !included.Overlaps(host.prefix) {
+				continue
+			}
+			switch {
+			case vpnInterface(host.iface):
+				conflicts = append(conflicts, RouteConflict{ConflictOverlapsVPNRoute, included.String(), host.prefix.String(), host.iface})
+			case host.prefix.Bits() > included.Bits() && host.prefix.Bits() < host.prefix.Addr().BitLen():
+				conflicts = append(conflicts, RouteConflict{ConflictShadowedByHostRoute, included.String(), host.prefix.String(), host.iface})
+			}
+		}
+	}
+	return conflicts
+}
+
+// checkRouteConflicts updates the route conflicts for the settings about to
+// be published
+func checkRouteConflicts(settings network.NetworkSettings) {
+	tunnelIface := trafficInterfaceName()
+
+	hostRoutesMutex.Lock()
+	defer hostRoutesMutex.Unlock()
+	if hostRoutes == nil {
+		return
+	}
+	conflicts := findRouteConflicts(settings, hostRoutes, tunnelIface)
+	changed := !slices.Equal(conflicts, routeConflicts)
+	routeConflicts, routeCheckedAt = conflicts, time.Now()
+
+	if !changed {
+		return
+	}
+	for _, conflict := range conflicts {
+		appLogger.Warn("Included route %s conflicts with %s on %s (%s)", conflict.Route, conflict.HostRoute, conflict.Interface, conflict.Kind)
+	}
+	recordEvent(EventSettings, "route conflicts: %d", len(conflicts))
+}
+
+// resetRouteConflicts forgets the conflicts when the tunnel stops. The
+// routing table snapshot is kept for the next start.
+func resetRouteConflicts() {
+	hostRoutesMutex.Lock()
+	routeConflicts, routeCheckedAt = nil, time.Time{}
+	hostRoutesMutex.Unlock()
+}
+
+// routeConflictMessage explains a conflict to the user
+func routeConflictMessage(conflict RouteConflict) string {
+	if conflict.Kind == ConflictOverlapsVPNRoute {
+		return fmt.Sprintf("%s overlaps another VPN's route %s on %s; traffic to it may not use this tunnel",
+			conflict.Route, conflict.HostRoute, conflict.Interface)
+	}
+	return fmt.Sprintf("%s is partly routed to %s by the more specific route %s; traffic there bypasses this tunnel",
+		conflict.Route, conflict.Interface, conflict.HostRoute)
+}
+
+// setHostRoutes accepts a snapshot of the host routing table from Swift as
+// a JSON array of routes, e.g. [{"destination":"10.8.0.0/16",
+// "interface":"utun5"}], and checks the included routes against it
+//
+//export setHostRoutes
+func setHostRoutes(routesJSON *C.char) *C.char {
+	var routes []HostRoute
+	if err := decodeCompatJSON([]byte(C.GoString(routesJSON)), &routes, "host routes"); err != nil {
+		appLogger.Error("Failed to parse host routes JSON: %v", err)
+		return exportString(fmt.Sprintf("Error: Failed to parse host routes JSON: %v", err))
+	}
+	parsed, err := parseHostRoutes(routes)
+	if err != nil {
+		appLogger.Error("Invalid host routes: %v", err)
+		return exportString(fmt.Sprintf("Error: Invalid host routes: %v", err))
+	}
+
+	hostRoutesMutex.Lock()
+	hostRoutes = parsed
+	hostRoutesMutex.Unlock()
+
+	tunnelMutex.Lock()
+	running := tunnelRunning
+	tunnelMutex.Unlock()
+	if running {
+		checkRouteConflicts(effectiveNetworkSettings())
+	}
+	return exportString(fmt.Sprintf("Host routes set: %d", len(parsed)))
+}
+
+// getSettingsWarnings returns what may keep the published settings from
+// working as intended, as JSON: conflicts with the local network and with
+// the host routing table
+//
+//export getSettingsWarnings
+func getSettingsWarnings() *C.char {
+	out := SettingsWarnings{Warnings: []SettingsWarning{}}
+
+	addressConflictMutex.Lock()
+	addresses := addressConflictStatus
+	addressConflictMutex.Unlock()
+	for _, conflict := range addresses.Conflicts {
+		out.Warnings = append(out.Warnings, SettingsWarning{
+			Kind:    conflict.Kind,
+			Message: fmt.Sprintf("%s conflicts with %s on %s", conflict.Tunnel, conflict.Local, conflict.Interface),
+		})
+	}
+	out.CheckedAt = addresses.CheckedAt
+
+	hostRoutesMutex.Lock()
+	out.RouteConflicts = slices.Clone(routeConflicts)
+	if routeCheckedAt.After(out.CheckedAt) {
+		out.CheckedAt = routeCheckedAt
+	}
+	hostRoutesMutex.Unlock()
+	for _, conflict := range out.RouteConflicts {
+		out.Warnings = append(out.Warnings, SettingsWarning{Kind: conflict.Kind, Message: routeConflictMessage(conflict)})
+	}
+
+	data, err := json.Marshal(out)
+	if err != nil {
+		appLogger.Error("Failed to marshal settings warnings: %v", err)
+		return exportString(`{"warnings":[]}`)
+	}
+	return exportString(string(data))
+}
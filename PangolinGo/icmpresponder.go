@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/binary"
+
+	"github.com/fosrl/newt/network"
+)
+
+const (
+	icmpEchoReply     = 0
+	icmpEchoRequest   = 8
+	icmpv6EchoRequest = 128
+	icmpv6EchoReply   = 129
+)
+
+const icmpResponderHook = "icmpResponder"
+
+// setICMPResponder enables or disables answering pings to the client's
+// tunnel addresses from inside the packet path. The replies never touch the
+// host's network stack, so they work even when the macOS firewall is in
+// stealth mode.
+func setICMPResponder(enabled bool) {
+	if enabled {
+		registerPacketHook(icmpResponderHook, hookPriorityResponder, installICMPResponder)
+	} else {
+		unregisterPacketHook(icmpResponderHook)
+	}
+}
+
+func installICMPResponder(dev *hookDevice, settings network.NetworkSettings) {
+	for _, addr := range tunnelAddresses(settings) {
+		dev.AddRule(addr, func(packet []byte) bool {
+			reply := icmpEchoReplyFor(packet)
+			if reply == nil {
+				return false
+			}
+			dev.InjectOutbound(reply)
+			return true
+		})
+	}
+}
+
+// icmpEchoReplyFor builds the reply to an ICMP or ICMPv6 echo request, or
+// returns nil if packet is anything else
+func icmpEchoReplyFor(packet []byte) []byte {
+	ip, ok := parseIPPacket(packet)
+	if !ok || len(ip.Payload) < 8 {
+		return nil
+	}
+
+	switch {
+	case ip.Version == 4 && ip.Protocol == ipProtoICMP && ip.Payload[0] == icmpEchoRequest:
+		// Drop fragments and options; an echo reply does not need them
+		reply := make([]byte, ipv4HeaderMinLen+len(ip.Payload))
+		copy(reply, packet[:ipv4HeaderMinLen])
+		reply[0] = 0x45
+		binary.BigEndian.PutUint16(reply[2:4], uint16(len(reply)))
+		reply[6], reply[7] = 0, 0 // flags and fragment offset
+		reply[8] = 64             // TTL
+		copy(reply[12:16], packet[16:20])
+		copy(reply[16:20], packet[12:16])
+		setIPv4HeaderChecksum(reply)
+
+		icmp := reply[ipv4HeaderMinLen:]
+		copy(icmp, ip.Payload)
+		icmp[0] = icmpEchoReply
+		icmp[2], icmp[3] = 0, 0
+		binary.BigEndian.PutUint16(icmp[2:4], checksumFinish(checksumAdd(0, icmp)))
+		return reply
+
+	case ip.Version == 6 && ip.Protocol == ipProtoICMPv6 && ip.Payload[0] == icmpv6EchoRequest:
+		reply := make([]byte, ipv6HeaderLen+len(ip.Payload))
+		copy(reply, packet[:ipv6HeaderLen])
+		reply[7] = 64 // hop limit
+		copy(reply[8:24], packet[24:40])
+		copy(reply[24:40], packet[8:24])
+
+		icmp := reply[ipv6HeaderLen:]
+		copy(icmp, ip.Payload)
+		icmp[0] = icmpv6EchoReply
+		icmp[2], icmp[3] = 0, 0
+		sum := pseudoHeaderSum(ip.Dst, ip.Src, ipProtoICMPv6, len(icmp))
+		binary.BigEndian.PutUint16(icmp[2:4], checksumFinish(checksumAdd(sum, icmp)))
+		return reply
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// dataPathQuietAfter is how long the tunnel has to carry no traffic
+	// before the bridge quiets its optional periodic work
+	dataPathQuietAfter = 5 * time.Minute
+	// quietMultiplier stretches bridge timers while the data path is quiet
+	quietMultiplier = 4
+)
+
+// dataPathQuiet is set while the tunnel has been idle for dataPathQuietAfter
+var dataPathQuiet atomic.Bool
+
+// quietScaledInterval stretches a periodic timer's interval while the device
+// is power constrained and again while the tunnel is idle, so an idle laptop
+// is woken less often. The scheduler adds background mode on top.
+func quietScaledInterval(interval time.Duration) time.Duration {
+	interval = powerScaledInterval(interval)
+	if dataPathQuiet.Load() {
+		return interval * quietMultiplier
+	}
+	return interval
+}
+
+// syncDataPathQuiet enters the quiet state once the tunnel has been idle for
+// long enough and leaves it as soon as traffic moves. The status snapshot
+// samples the counters often enough to notice idleness; while quiet it
+// samples less, so the counters are also read here, on a wakeup that
+// happens anyway, to notice traffic resuming right away.
+func syncDataPathQuiet() {
+	if dataPathQuiet.Load() {
+		sampleTrafficCounters()
+	}
+	quiet := trafficInterfaceName() != "" && trafficIdleFor() >= dataPathQuietAfter
+	if dataPathQuiet.Swap(quiet) == quiet {
+		return
+	}
+
+	if quiet {
+		appLogger.Debug("Tunnel idle for %v, quieting periodic work", dataPathQuietAfter)
+		recordEvent(EventState, "data path quiet")
+	} else {
+		appLogger.Debug("Traffic resumed, periodic work back to normal")
+		recordEvent(EventState, "data path active")
+	}
+	peerPingMonitor.refresh()
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// rawInterfaceCounters are the kernel's per-interface counters. Darwin only
+// exposes 32-bit values through getifaddrs, so they wrap every 4 GiB.
+type rawInterfaceCounters struct {
+	rxBytes   uint32
+	txBytes   uint32
+	rxPackets uint32
+	txPackets uint32
+}
+
+// TrafficCounters are 64-bit totals for the tunnel interface since the
+// tunnel was started
+type TrafficCounters struct {
+	RxBytes   uint64    `json:"rxBytes"`
+	TxBytes   uint64    `json:"txBytes"`
+	RxPackets uint64    `json:"rxPackets"`
+	TxPackets uint64    `json:"txPackets"`
+	SampledAt time.Time `json:"sampledAt"`
+}
+
+var (
+	trafficMutex    sync.Mutex
+	trafficIface    string
+	trafficLast     rawInterfaceCounters
+	trafficTotals   TrafficCounters
+	trafficLastMove time.Time
+)
+
+// startTrafficCounters resolves the utun interface behind fd and resets the
+// totals. Counting is disabled when the interface cannot be determined.
+func startTrafficCounters(fd int) {
+	trafficMutex.Lock()
+	defer trafficMutex.Unlock()
+
+	trafficIface = ""
+	trafficTotals = TrafficCounters{}
+	trafficLastMove = time.Now()
+
+	if fd == 0 {
+		return
+	}
+	name, err := tunnelInterfaceName(fd)
+	if err != nil {
+		appLogger.Warn("Traffic counters disabled: %v", err)
+		return
+	}
+	raw, err := readInterfaceCounters(name)
+	if err != nil {
+		appLogger.Warn("Traffic counters disabled: %v", err)
+		return
+	}
+
+	trafficIface = name
+	trafficLast = raw
+	trafficTotals.SampledAt = time.Now()
+	appLogger.Debug("Tracking traffic counters for %s", name)
+}
+
+// trafficInterfaceName returns the utun interface being counted, or "" when
+// counting is disabled
+func trafficInterfaceName() string {
+	trafficMutex.Lock()
+	defer trafficMutex.Unlock()
+	return trafficIface
+}
+
+// sampleTrafficCounters reads the interface counters and folds the deltas
+// into the 64-bit totals. ok is false when counters are unavailable.
+func sampleTrafficCounters() (totals TrafficCounters, ok bool) {
+	trafficMutex.Lock()
+	defer trafficMutex.Unlock()
+
+	if trafficIface == "" {
+		return trafficTotals, false
+	}
+	raw, err := readInterfaceCounters(trafficIface)
+	if err != nil {
+		appLogger.Debug("Failed to read counters for %s: %v", trafficIface, err)
+		return trafficTotals, false
+	}
+
+	// Unsigned subtraction yields the right delta across a single wrap
+	rxBytes := uint64(raw.rxBytes - trafficLast.rxBytes)
+	txBytes := uint64(raw.txBytes - trafficLast.txBytes)
+	trafficTotals.RxBytes += rxBytes
+	trafficTotals.TxBytes += txBytes
+	trafficTotals.RxPackets += uint64(raw.rxPackets - trafficLast.rxPackets)
+	trafficTotals.TxPackets += uint64(raw.txPackets - trafficLast.txPackets)
+	trafficTotals.SampledAt = time.Now()
+	trafficLast = raw
+
+	if rxBytes != 0 || txBytes != 0 {
+		trafficLastMove = trafficTotals.SampledAt
+	}
+	return trafficTotals, true
+}
+
+// trafficIdleFor returns how long the tunnel interface has carried no
+// traffic, as of the most recent sample
+func trafficIdleFor() time.Duration {
+	trafficMutex.Lock()
+	defer trafficMutex.Unlock()
+	return time.Since(trafficLastMove)
+}
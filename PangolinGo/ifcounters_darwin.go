@@ -0,0 +1,80 @@
+//go:build darwin
+
+package main
+
+/*
+#include <stdint.h>
+#include <stdlib.h>
+#include <string.h>
+#include <sys/types.h>
+#include <sys/socket.h>
+#include <sys/sys_domain.h>
+#include <net/if.h>
+#include <ifaddrs.h>
+
+// UTUN_OPT_IFNAME from <net/if_utun.h>, which is not part of the iOS SDK
+#define PANGOLIN_UTUN_OPT_IFNAME 2
+
+static int pangolinUtunName(int fd, char *name, socklen_t len) {
+	return getsockopt(fd, SYSPROTO_CONTROL, PANGOLIN_UTUN_OPT_IFNAME, name, &len);
+}
+
+static int pangolinInterfaceCounters(const char *name, uint32_t *ibytes, uint32_t *obytes,
+                                     uint32_t *ipackets, uint32_t *opackets) {
+	struct ifaddrs *addrs;
+	if (getifaddrs(&addrs) != 0) {
+		return -1;
+	}
+
+	int found = -1;
+	for (struct ifaddrs *ifa = addrs; ifa != NULL; ifa = ifa->ifa_next) {
+		if (ifa->ifa_addr == NULL || ifa->ifa_addr->sa_family != AF_LINK || ifa->ifa_data == NULL) {
+			continue;
+		}
+		if (strcmp(ifa->ifa_name, name) != 0) {
+			continue;
+		}
+		struct if_data *data = (struct if_data *)ifa->ifa_data;
+		*ibytes = data->ifi_ibytes;
+		*obytes = data->ifi_obytes;
+		*ipackets = data->ifi_ipackets;
+		*opackets = data->ifi_opackets;
+		found = 0;
+		break;
+	}
+
+	freeifaddrs(addrs);
+	return found;
+}
+*/
+import "C"
+import (
+	"fmt"
+	"unsafe"
+)
+
+// tunnelInterfaceName asks the utun control socket for its interface name
+func tunnelInterfaceName(fd int) (string, error) {
+	var buf [C.IFNAMSIZ]C.char
+	if rc, err := C.pangolinUtunName(C.int(fd), &buf[0], C.socklen_t(len(buf))); rc != 0 {
+		return "", fmt.Errorf("failed to read utun interface name: %v", err)
+	}
+	return C.GoString(&buf[0]), nil
+}
+
+// readInterfaceCounters reads the kernel's 32-bit interface counters
+func readInterfaceCounters(name string) (rawInterfaceCounters, error) {
+	cName := C.CString(name)
+	defer C.free(unsafe.Pointer(cName))
+
+	var ibytes, obytes, ipackets, opackets C.uint32_t
+	if rc := C.pangolinInterfaceCounters(cName, &ibytes, &obytes, &ipackets, &opackets); rc != 0 {
+		return rawInterfaceCounters{}, fmt.Errorf("interface %s not found", name)
+	}
+	return rawInterfaceCounters{
+		rxBytes:   uint32(ibytes),
+		txBytes:   uint32(obytes),
+		rxPackets: uint32(ipackets),
+		txPackets: uint32(opackets),
+	}, nil
+}
@@ -0,0 +1,15 @@
+//go:build !darwin
+
+package main
+
+import "fmt"
+
+// tunnelInterfaceName is only implemented for utun descriptors
+func tunnelInterfaceName(fd int) (string, error) {
+	return "", fmt.Errorf("tunnel interface lookup is not supported on this platform")
+}
+
+// readInterfaceCounters is only implemented on Apple platforms
+func readInterfaceCounters(name string) (rawInterfaceCounters, error) {
+	return rawInterfaceCounters{}, fmt.Errorf("interface counters are not supported on this platform")
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/sha256"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/fosrl/newt/network"
+)
+
+// ulaPrefixLength is the prefix published with the client's ULA; the /64
+// holds only this client
+const ulaPrefixLength = 64
+
+var (
+	ipv6Mutex sync.Mutex
+	// tunnelULA is the client's IPv6 address when the server assigns none
+	tunnelULA netip.Addr
+)
+
+// clientULA derives a stable unique local address (RFC 4193) from the
+// client's identity. The hash stands in for the RFC's random global ID, so
+// the client keeps its address across restarts and networks.
+func clientULA(config StartTunnelConfig) netip.Addr {
+	sum := sha256.Sum256([]byte("ula\x00" + config.ID + "\x00" + config.Endpoint))
+	var b [16]byte
+	b[0] = 0xfd
+	copy(b[1:6], sum[:5])
+	// Subnet ID zero, then a 64-bit interface ID
+	copy(b[8:], sum[5:13])
+	return netip.AddrFrom16(b)
+}
+
+// setTunnelULA picks the client's ULA for a tunnel start
+func setTunnelULA(config StartTunnelConfig) {
+	addr := clientULA(config)
+	ipv6Mutex.Lock()
+	tunnelULA = addr
+	ipv6Mutex.Unlock()
+	appLogger.Debug("Client IPv6 address is %s", addr)
+}
+
+func clearTunnelULA() {
+	ipv6Mutex.Lock()
+	tunnelULA = netip.Addr{}
+	ipv6Mutex.Unlock()
+}
+
+// currentTunnelULA returns the client's ULA, or "" when no tunnel runs
+func currentTunnelULA() string {
+	ipv6Mutex.Lock()
+	defer ipv6Mutex.Unlock()
+	if !tunnelULA.IsValid() {
+		return ""
+	}
+	return tunnelULA.String()
+}
+
+// misfiledIPv6 parses an IPv6 destination and mask that olm stored as an
+// IPv4 route. olm files every remote subnet under IPv4, writing an IPv6 mask
+// in place of the dotted quad.
+func misfiledIPv6(destination, mask string) (netip.Addr, int, bool) {
+	addr, err := netip.ParseAddr(destination)
+	if err != nil || !addr.Is6() || addr.Is4In6() {
+		return netip.Addr{}, 0, false
+	}
+	bits := 128
+	if maskAddr, err := netip.ParseAddr(mask); err == nil && maskAddr.Is6() {
+		if ones, size := net.IPMask(maskAddr.AsSlice()).Size(); size == 128 {
+			bits = ones
+		}
+	} else if n, err := strconv.Atoi(mask); err == nil && n >= 0 && n <= 128 {
+		bits = n
+	}
+	return addr, bits, true
+}
+
+// splitIPv6Routes moves IPv6 routes out of an IPv4 route list
+func splitIPv6Routes(routes []network.IPv4Route) (v4 []network.IPv4Route, v6 []network.IPv6Route) {
+	for _, route := range routes {
+		if addr, bits, ok := misfiledIPv6(route.DestinationAddress, route.SubnetMask); ok {
+			v6 = append(v6, network.IPv6Route{
+				DestinationAddress:  netip.PrefixFrom(addr, bits).Masked().Addr().String(),
+				NetworkPrefixLength: bits,
+				IsDefault:           bits == 0,
+			})
+			continue
+		}
+		v4 = append(v4, route)
+	}
+	return v4, v6
+}
+
+// applyIPv6Settings gives IPv6 resources routes of their own and the client
+// an IPv6 address to reach them from. A server-assigned IPv6 address wins
+// over the ULA, which the server learns from the fingerprint.
+func applyIPv6Settings(settings network.NetworkSettings) network.NetworkSettings {
+	var moved4, moved6 []network.IPv6Route
+	settings.IPv4IncludedRoutes, moved4 = splitIPv6Routes(settings.IPv4IncludedRoutes)
+	settings.IPv4ExcludedRoutes, moved6 = splitIPv6Routes(settings.IPv4ExcludedRoutes)
+	settings.IPv6IncludedRoutes = append(slices.Clone(settings.IPv6IncludedRoutes), moved4...)
+	settings.IPv6ExcludedRoutes = append(slices.Clone(settings.IPv6ExcludedRoutes), moved6...)
+
+	var addrs4, masks4 []string
+	addrs6, prefixes6 := slices.Clone(settings.IPv6Addresses), slices.Clone(settings.IPv6NetworkPrefixes)
+	for i, address := range settings.IPv4Addresses {
+		mask := ""
+		if i < len(settings.IPv4SubnetMasks) {
+			mask = settings.IPv4SubnetMasks[i]
+		}
+		host, bits := splitCIDR(address)
+		if bits != "" && mask == "" {
+			mask = bits
+		}
+		if addr, prefix, ok := misfiledIPv6(host, mask); ok {
+			addrs6 = append(addrs6, addr.String())
+			prefixes6 = append(prefixes6, strconv.Itoa(prefix))
+			continue
+		}
+		addrs4 = append(addrs4, address)
+		masks4 = append(masks4, mask)
+	}
+	if len(addrs6) > len(settings.IPv6Addresses) {
+		settings.IPv4Addresses, settings.IPv4SubnetMasks = addrs4, masks4
+	}
+
+	if ula := currentTunnelULA(); len(addrs6) == 0 && ula != "" && len(settings.IPv4Addresses) > 0 {
+		addrs6, prefixes6 = []string{ula}, []string{strconv.Itoa(ulaPrefixLength)}
+	}
+	settings.IPv6Addresses, settings.IPv6NetworkPrefixes = addrs6, prefixes6
+	return settings
+}
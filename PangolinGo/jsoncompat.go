@@ -0,0 +1,224 @@
+package main
+
+import "C"
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// JSON casing modes for setJSONCasing
+const (
+	// JSONCasingLenient accepts a field in the other casing and logs it as
+	// deprecated
+	JSONCasingLenient = "lenient"
+	// JSONCasingStrict rejects a field in the other casing
+	JSONCasingStrict = "strict"
+)
+
+var (
+	jsonCasingMutex sync.Mutex
+	jsonCasingMode  = JSONCasingLenient
+	// jsonCasingWarned keeps each deprecated field to one warning
+	jsonCasingWarned = map[string]bool{}
+)
+
+// snakeToCamel turns tunnel_dns into tunnelDns. encoding/json matches names
+// case-insensitively, so the casing of acronyms does not matter.
+func snakeToCamel(name string) string {
+	var b strings.Builder
+	upper := false
+	for _, r := range name {
+		switch {
+		case r == '_':
+			upper = b.Len() > 0
+		case upper:
+			b.WriteRune(unicode.ToUpper(r))
+			upper = false
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// camelToSnake turns tunnelDNS into tunnel_dns
+func camelToSnake(name string) string {
+	runes := []rune(name)
+	var b strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			lowerBefore := i > 0 && !unicode.IsUpper(runes[i-1])
+			acronymEnd := i > 0 && i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if lowerBefore || acronymEnd {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// jsonFieldTypes maps the JSON names of a struct's fields, including those
+// of embedded structs, to their types
+func jsonFieldTypes(t reflect.Type, fields map[string]reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" {
+			if ft := derefType(field.Type); ft.Kind() == reflect.Struct {
+				jsonFieldTypes(ft, fields)
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields[name] = field.Type
+	}
+}
+
+func derefType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t
+}
+
+// lookupField finds a JSON name the way encoding/json does, ignoring case
+func lookupField(fields map[string]reflect.Type, key string) (string, reflect.Type, bool) {
+	if t, ok := fields[key]; ok {
+		return key, t, true
+	}
+	for name, t := range fields {
+		if strings.EqualFold(name, key) {
+			return name, t, true
+		}
+	}
+	return "", nil, false
+}
+
+// normalizeJSONKeys renames the object keys of a decoded JSON value that
+// match a field of t only in the other casing. It reports the renames as
+// "old -> new" paths.
+func normalizeJSONKeys(value any, t reflect.Type, path string) (renamed []string) {
+	t = derefType(t)
+	switch t.Kind() {
+	case reflect.Struct:
+		object, ok := value.(map[string]any)
+		if !ok {
+			return nil
+		}
+		fields := map[string]reflect.Type{}
+		jsonFieldTypes(t, fields)
+		for _, key := range slices.Collect(maps.Keys(object)) {
+			child := object[key]
+			name, ft, ok := lookupField(fields, key)
+			if !ok {
+				alt := camelToSnake(key)
+				if strings.Contains(key, "_") {
+					alt = snakeToCamel(key)
+				}
+				if name, ft, ok = lookupField(fields, alt); !ok {
+					continue
+				}
+				if _, both := object[name]; both {
+					continue
+				}
+				delete(object, key)
+				object[name] = child
+				renamed = append(renamed, fmt.Sprintf("%s%s -> %s%s", path, key, path, name))
+			}
+			renamed = append(renamed, normalizeJSONKeys(child, ft, path+name+".")...)
+		}
+	case reflect.Slice, reflect.Array:
+		items, ok := value.([]any)
+		if !ok {
+			return nil
+		}
+		for _, item := range items {
+			renamed = append(renamed, normalizeJSONKeys(item, t.Elem(), path+"[].")...)
+		}
+	case reflect.Map:
+		object, ok := value.(map[string]any)
+		if !ok {
+			return nil
+		}
+		for key, child := range object {
+			renamed = append(renamed, normalizeJSONKeys(child, t.Elem(), path+key+".")...)
+		}
+	}
+	return renamed
+}
+
+// decodeCompatJSON decodes JSON from Swift into v, accepting camelCase for
+// snake_case fields and the other way round. The conventions are mixed,
+// camelCase configs and snake_case settings, and a field in the wrong one
+// would otherwise be dropped without a word. what names the JSON in logs.
+func decodeCompatJSON(data []byte, v any, what string) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var raw any
+	if err := decoder.Decode(&raw); err != nil {
+		return err
+	}
+	renamed := normalizeJSONKeys(raw, reflect.TypeOf(v), "")
+	if len(renamed) == 0 {
+		return json.Unmarshal(data, v)
+	}
+
+	jsonCasingMutex.Lock()
+	strict := jsonCasingMode == JSONCasingStrict
+	var fresh []string
+	for _, rename := range renamed {
+		if !jsonCasingWarned[what+" "+rename] {
+			jsonCasingWarned[what+" "+rename] = true
+			fresh = append(fresh, rename)
+		}
+	}
+	jsonCasingMutex.Unlock()
+
+	if strict {
+		return fmt.Errorf("fields in the wrong casing: %s", strings.Join(renamed, ", "))
+	}
+	for _, rename := range fresh {
+		appLogger.Warn("Deprecated field casing in %s: %s", what, rename)
+	}
+	normalized, err := json.Marshal(raw)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(normalized, v)
+}
+
+// setJSONCasing picks how JSON with fields in the other casing is treated:
+// "lenient" accepts it with a deprecation warning, "strict" rejects it so
+// drift on the Swift side fails in development instead of going unnoticed
+//
+//export setJSONCasing
+func setJSONCasing(mode *C.char) *C.char {
+	m := C.GoString(mode)
+	if m != JSONCasingLenient && m != JSONCasingStrict {
+		appLogger.Error("Unknown JSON casing mode %q", m)
+		return exportString(fmt.Sprintf("Error: Unknown JSON casing mode %q", m))
+	}
+	jsonCasingMutex.Lock()
+	jsonCasingMode = m
+	jsonCasingMutex.Unlock()
+	appLogger.Info("JSON casing mode: %s", m)
+	return exportString(fmt.Sprintf("JSON casing mode set: %s", m))
+}
@@ -0,0 +1,257 @@
+package main
+
+import "C"
+import (
+	"encoding/json"
+	"net/netip"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+
+	olmdns "github.com/fosrl/olm/dns"
+	"github.com/miekg/dns"
+)
+
+const (
+	// keepWarmNames is how many recently used names are kept warm
+	keepWarmNames = 16
+	// keepWarmMaxAge drops names not used for this long from a warmup
+	keepWarmMaxAge  = time.Hour
+	keepWarmTimeout = 2 * time.Second
+)
+
+// Where a warmed answer came from
+const (
+	KeepWarmSourceLocal    = "local"
+	KeepWarmSourceUpstream = "upstream"
+)
+
+// KeepWarmEntry is one recently used name and its last warmup
+type KeepWarmEntry struct {
+	Name       string    `json:"name"`
+	Type       string    `json:"type"`
+	LastUsedAt time.Time `json:"lastUsedAt"`
+	WarmedAt   time.Time `json:"warmedAt,omitempty"`
+	Source     string    `json:"source,omitempty"`
+	Answers    []string  `json:"answers,omitempty"`
+	// Changed is set when the warmup found a different answer than the one
+	// before, i.e. the cached one was stale
+	Changed bool   `json:"changed,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// KeepWarmStatus is the JSON returned by getKeepWarmStatus
+type KeepWarmStatus struct {
+	Trigger  string          `json:"trigger,omitempty"`
+	WarmedAt time.Time       `json:"warmedAt,omitempty"`
+	Names    []KeepWarmEntry `json:"names"`
+}
+
+type keepWarmKey struct {
+	name  string
+	qtype uint16
+}
+
+var (
+	keepWarmMutex sync.Mutex
+	// keepWarmEntries outlive a tunnel, so a restart warms what the last
+	// session used. They are never written to disk.
+	keepWarmEntries = map[keepWarmKey]*KeepWarmEntry{}
+	keepWarmProxy   netip.Addr
+	keepWarmRunning bool
+	keepWarmTrigger string
+	keepWarmLastRun time.Time
+)
+
+// noteRecentDNSQuery remembers the names the device looks up through olm's
+// resolver
+func noteRecentDNSQuery(packet []byte) {
+	ip, ok := parseIPPacket(packet)
+	if !ok {
+		return
+	}
+	payload, ok := dnsPayload(packet, ip, true)
+	if !ok {
+		return
+	}
+	keepWarmMutex.Lock()
+	proxy := keepWarmProxy
+	keepWarmMutex.Unlock()
+	var query dns.Msg
+	if ip.Dst != proxy || query.Unpack(payload) != nil || len(query.Question) == 0 {
+		return
+	}
+	question := query.Question[0]
+	if question.Qtype != dns.TypeA && question.Qtype != dns.TypeAAAA {
+		return
+	}
+
+	key := keepWarmKey{dns.CanonicalName(question.Name), question.Qtype}
+	keepWarmMutex.Lock()
+	defer keepWarmMutex.Unlock()
+	if entry := keepWarmEntries[key]; entry != nil {
+		entry.LastUsedAt = time.Now()
+		return
+	}
+	if len(keepWarmEntries) >= keepWarmNames {
+		var oldest keepWarmKey
+		for k, entry := range keepWarmEntries {
+			if oldest.name == "" || entry.LastUsedAt.Before(keepWarmEntries[oldest].LastUsedAt) {
+				oldest = k
+			}
+		}
+		delete(keepWarmEntries, oldest)
+	}
+	keepWarmEntries[key] = &KeepWarmEntry{Name: key.name, Type: dns.TypeToString[key.qtype], LastUsedAt: time.Now()}
+}
+
+// warmName looks a name up the way olm's resolver would: from the local
+// records, or else from the first upstream that answers
+func warmName(key keepWarmKey, proxy *olmdns.DNSProxy, upstreams []string) (source string, answers []string, err error) {
+	if proxy != nil {
+		if ips, ok := proxy.GetDNSRecords(key.name, olmdns.RecordType(key.qtype)); ok {
+			for _, ip := range ips {
+				answers = append(answers, ip.String())
+			}
+			return KeepWarmSourceLocal, answers, nil
+		}
+	}
+
+	query := new(dns.Msg)
+	query.SetQuestion(key.name, key.qtype)
+	client := upstreamDNSClient(keepWarmTimeout)
+	for i, server := range upstreams {
+		if i == 2 {
+			break
+		}
+		var reply *dns.Msg
+		if reply, _, err = client.Exchange(query, server); err != nil {
+			continue
+		}
+		for _, rr := range reply.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				answers = append(answers, rr.A.String())
+			case *dns.AAAA:
+				answers = append(answers, rr.AAAA.String())
+			}
+		}
+		return KeepWarmSourceUpstream, answers, nil
+	}
+	return "", nil, err
+}
+
+// warmRecentNames looks the recently used names up again after a wake or
+// reconnect, so the upstream caches are warm and stale answers are noticed
+// before the first connection needs them. Upstream lookups leave from the
+// extension and are skipped when olm sends DNS through the tunnel.
+func warmRecentNames(trigger string) {
+	keepWarmMutex.Lock()
+	if keepWarmRunning || len(keepWarmEntries) == 0 {
+		keepWarmMutex.Unlock()
+		return
+	}
+	keepWarmRunning = true
+	var keys []keepWarmKey
+	for key, entry := range keepWarmEntries {
+		if time.Since(entry.LastUsedAt) < keepWarmMaxAge {
+			keys = append(keys, key)
+		}
+	}
+	keepWarmMutex.Unlock()
+
+	go func() {
+		defer dumpOnPanic()
+
+		proxy := (*olmdns.DNSProxy)(olmPointerField("dnsProxy", reflect.TypeOf((*olmdns.DNSProxy)(nil))))
+		tunnelMutex.Lock()
+		tunnelDNS := activeTunnelConfig.TunnelDNS
+		tunnelMutex.Unlock()
+		var upstreams []string
+		if !tunnelDNS {
+			upstreams = orderUpstreamsByLatency(upstreamServers())
+		}
+
+		type result struct {
+			key      keepWarmKey
+			source   string
+			answers  []string
+			err      error
+			warmedAt time.Time
+		}
+		results := make([]result, len(keys))
+		var wg sync.WaitGroup
+		for i, key := range keys {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				// A name whose warmup panicked keeps its previous entry
+				superviseSubsystem(SubsystemDNS, "DNS keep-warm", func() {
+					source, answers, err := warmName(key, proxy, upstreams)
+					slices.Sort(answers)
+					results[i] = result{key, source, answers, err, time.Now()}
+				})
+			}()
+		}
+		wg.Wait()
+
+		keepWarmMutex.Lock()
+		defer keepWarmMutex.Unlock()
+		changed := 0
+		for _, r := range results {
+			entry := keepWarmEntries[r.key]
+			if entry == nil || (r.source == "" && r.err == nil) {
+				continue
+			}
+			entry.WarmedAt = r.warmedAt
+			entry.Error = ""
+			if r.err != nil {
+				entry.Error = r.err.Error()
+				continue
+			}
+			entry.Changed = entry.Source != "" && !slices.Equal(entry.Answers, r.answers)
+			if entry.Changed {
+				changed++
+			}
+			entry.Source, entry.Answers = r.source, r.answers
+		}
+		keepWarmRunning, keepWarmTrigger, keepWarmLastRun = false, trigger, time.Now()
+		appLogger.Debug("Warmed %d DNS name(s) after %s, %d changed", len(results), trigger, changed)
+	}()
+}
+
+// startKeepWarm has the device wrapped so the queries can be seen
+func startKeepWarm() {
+	// Tracking needs to see every packet
+	wrapTunnelDevice()
+}
+
+// syncKeepWarm follows olm's resolver address for the query tracking
+func syncKeepWarm() {
+	proxy, _ := olmDNSProxyAddr()
+	keepWarmMutex.Lock()
+	keepWarmProxy = proxy
+	keepWarmMutex.Unlock()
+}
+
+// getKeepWarmStatus returns the names kept warm and their last warmup, most
+// recently used first, as JSON
+//
+//export getKeepWarmStatus
+func getKeepWarmStatus() *C.char {
+	keepWarmMutex.Lock()
+	status := KeepWarmStatus{Trigger: keepWarmTrigger, WarmedAt: keepWarmLastRun, Names: make([]KeepWarmEntry, 0, len(keepWarmEntries))}
+	for _, entry := range keepWarmEntries {
+		status.Names = append(status.Names, *entry)
+	}
+	keepWarmMutex.Unlock()
+	slices.SortFunc(status.Names, func(a, b KeepWarmEntry) int { return b.LastUsedAt.Compare(a.LastUsedAt) })
+
+	data, err := json.Marshal(status)
+	if err != nil {
+		appLogger.Error("Failed to marshal keep-warm status: %v", err)
+		return exportString(`{"names":[]}`)
+	}
+	return exportString(string(data))
+}
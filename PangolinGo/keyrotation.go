@@ -0,0 +1,139 @@
+package main
+
+import "C"
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	keyRotationJob           = "keyRotation"
+	keyRotationCheckInterval = time.Minute
+	// keyRotationGrace is how long a due rotation waits for the tunnel to go
+	// idle before it happens anyway
+	keyRotationGrace = time.Hour
+)
+
+var (
+	keyRotationMutex sync.Mutex
+	// keyGeneratedAt is when olm last generated the device keypair, which it
+	// does on every tunnel start
+	keyGeneratedAt time.Time
+	// keyRotationCodes are the olm error codes with which the server asks
+	// for a new device key. olm/error is the one message olm hands on to the
+	// bridge, and the server has no rotation code of its own, so they come
+	// from the start config and are empty by default.
+	keyRotationCodes []string
+)
+
+// noteKeyGenerated records that olm is about to generate a new keypair
+func noteKeyGenerated() {
+	keyRotationMutex.Lock()
+	keyGeneratedAt = time.Now()
+	keyRotationMutex.Unlock()
+}
+
+func keyAge() time.Duration {
+	keyRotationMutex.Lock()
+	defer keyRotationMutex.Unlock()
+	if keyGeneratedAt.IsZero() {
+		return 0
+	}
+	return time.Since(keyGeneratedAt)
+}
+
+// rotateDeviceKey restarts olm's tunnel, which generates a new keypair and
+// registers it with the control plane before re-handshaking with every peer
+func rotateDeviceKey(reason string) error {
+	age := keyAge()
+
+	tunnelMutex.Lock()
+	err := restartOlmTunnel("key rotation: " + reason)
+	tunnelMutex.Unlock()
+
+	if err != nil {
+		appLogger.Error("Key rotation failed: %v", err)
+		return err
+	}
+	appLogger.Info("Rotated device key (%s) after %v", reason, age.Round(time.Minute))
+	recordEvent(EventState, "device key rotated (%s) after %v", reason, age.Round(time.Second))
+	return nil
+}
+
+// startKeyRotation rotates the device key every interval, replacing any
+// previous schedule, and whenever the server sends one of codes. Zero
+// disables scheduled rotation; rotateKey still rotates on demand.
+func startKeyRotation(interval time.Duration, codes []string) {
+	stopKeyRotation()
+	keyRotationMutex.Lock()
+	keyRotationCodes = nil
+	for _, code := range codes {
+		keyRotationCodes = append(keyRotationCodes, strings.ToUpper(code))
+	}
+	keyRotationMutex.Unlock()
+	if interval <= 0 {
+		return
+	}
+
+	appLogger.Info("Device key rotates every %v", interval)
+	scheduleJob(keyRotationJob, false, func() time.Duration { return keyRotationCheckInterval }, func(ctx context.Context) {
+		runKeyRotation(ctx, interval)
+	})
+}
+
+// stopKeyRotation stops the schedule without waiting for it, so it is safe
+// to call while holding tunnelMutex
+func stopKeyRotation() {
+	cancelJob(keyRotationJob)
+}
+
+func runKeyRotation(ctx context.Context, interval time.Duration) {
+	age := keyAge()
+	if age < interval {
+		return
+	}
+	// Prefer a quiet moment, like scheduled maintenance does, but do
+	// not let a busy tunnel keep its key indefinitely
+	if age < interval+keyRotationGrace {
+		if powerConstrained() || pathCostly() {
+			return
+		}
+		if _, ok := sampleTrafficCounters(); ok && trafficIdleFor() < defaultMaintenanceIdle {
+			return
+		}
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	_ = rotateDeviceKey("scheduled")
+}
+
+// noteKeyRotationError is called with every error olm reports through its
+// OnOlmError callback. It reports whether the error asks for a new device
+// key, which it then rotates.
+func noteKeyRotationError(code, message string) bool {
+	keyRotationMutex.Lock()
+	requested := code != "" && slices.Contains(keyRotationCodes, strings.ToUpper(code))
+	keyRotationMutex.Unlock()
+	if !requested {
+		return false
+	}
+	appLogger.Info("Server asked for a new device key: %s", message)
+	_ = rotateDeviceKey("server request")
+	return true
+}
+
+// rotateKey rotates the device key right away, for a rotation the app asks
+// for rather than the server.
+//
+//export rotateKey
+func rotateKey() *C.char {
+	if err := rotateDeviceKey("requested"); err != nil {
+		return exportString(fmt.Sprintf("Error: %v", err))
+	}
+	return exportString("Device key rotated")
+}
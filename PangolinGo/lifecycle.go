@@ -0,0 +1,227 @@
+package main
+
+import "C"
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+const (
+	// Per-command timeouts, counted from when the command is queued. A
+	// command that times out keeps running; only its caller stops waiting.
+	startTunnelTimeout   = 45 * time.Second
+	stopTunnelTimeout    = 30 * time.Second
+	restartTunnelTimeout = 45 * time.Second
+
+	// lifecycleHistorySize is how many finished commands getLifecycleStatus
+	// reports
+	lifecycleHistorySize = 16
+)
+
+// lifecycleCommand is one queued startTunnel, stopTunnel or restartTunnel
+type lifecycleCommand struct {
+	name string
+	// key identifies the command with its arguments; an identical command
+	// queued right behind it joins it instead of running again
+	key       string
+	run       func() string
+	queuedAt  time.Time
+	startedAt time.Time
+	waiters   int
+	abandoned bool
+	result    string
+	done      chan struct{}
+}
+
+// LifecycleCommandStatus describes a command in getLifecycleStatus
+type LifecycleCommandStatus struct {
+	Command    string     `json:"command"`
+	QueuedAt   time.Time  `json:"queuedAt"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	// Callers is how many calls the command answered
+	Callers int `json:"callers"`
+	// Result is what the command returned, also when its callers timed out
+	Result    json.RawMessage `json:"result,omitempty"`
+	TimedOut  bool            `json:"timedOut,omitempty"`
+	Completed bool            `json:"completed"`
+}
+
+// LifecycleStatus is the JSON returned by getLifecycleStatus
+type LifecycleStatus struct {
+	Running *LifecycleCommandStatus  `json:"running,omitempty"`
+	Queued  []LifecycleCommandStatus `json:"queued"`
+	Recent  []LifecycleCommandStatus `json:"recent"`
+}
+
+var (
+	lifecycleMutex   sync.Mutex
+	lifecycleQueue   []*lifecycleCommand
+	lifecycleRunning *lifecycleCommand
+	lifecycleHistory []LifecycleCommandStatus
+	lifecycleWake    = make(chan struct{}, 1)
+	lifecycleOnce    sync.Once
+)
+
+// runLifecycleCommand queues a lifecycle command and waits for its result.
+// Commands run one at a time in the order they were called, so rapid
+// toggling cannot interleave a start with a stop. A call identical to the
+// command queued last joins it and gets the same result. If the result does
+// not arrive within timeout the caller gets an error and the command
+// finishes on its own; getLifecycleStatus reports how it ended.
+func runLifecycleCommand(name, key string, timeout time.Duration, run func() *C.char) *C.char {
+	result, ok := queueLifecycleCommand(name, key, timeout, func() string {
+		result := run()
+		defer freeCString(result)
+		return C.GoString(result)
+	})
+	if !ok {
+		return lifecycleFailure(LifecycleErrorTimeout, true, "%s did not finish within %v; getLifecycleStatus reports its result", name, timeout)
+	}
+	return exportString(result)
+}
+
+// queueLifecycleCommand is runLifecycleCommand without the C strings. It
+// returns false when the result did not arrive within timeout.
+func queueLifecycleCommand(name, key string, timeout time.Duration, run func() string) (string, bool) {
+	lifecycleOnce.Do(func() { go runLifecycleQueue() })
+
+	lifecycleMutex.Lock()
+	var cmd *lifecycleCommand
+	if n := len(lifecycleQueue); n > 0 && lifecycleQueue[n-1].key == key {
+		cmd = lifecycleQueue[n-1]
+		appLogger.Debug("Joining the %s already queued", name)
+	} else {
+		cmd = &lifecycleCommand{name: name, key: key, run: run, queuedAt: time.Now(), done: make(chan struct{})}
+		if ahead := len(lifecycleQueue); ahead > 0 || lifecycleRunning != nil {
+			if lifecycleRunning != nil {
+				ahead++
+			}
+			appLogger.Info("Queued %s behind %d lifecycle command(s)", name, ahead)
+		}
+		lifecycleQueue = append(lifecycleQueue, cmd)
+	}
+	cmd.waiters++
+	lifecycleMutex.Unlock()
+
+	select {
+	case lifecycleWake <- struct{}{}:
+	default:
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-cmd.done:
+		return cmd.result, true
+	case <-timer.C:
+		lifecycleMutex.Lock()
+		cmd.abandoned = true
+		lifecycleMutex.Unlock()
+		appLogger.Error("%s did not finish within %v", name, timeout)
+		recordEvent(EventState, "%s timed out", name)
+		return "", false
+	}
+}
+
+// runLifecycleQueue runs queued commands one at a time
+func runLifecycleQueue() {
+	defer dumpOnPanic()
+
+	for range lifecycleWake {
+		for {
+			lifecycleMutex.Lock()
+			if len(lifecycleQueue) == 0 {
+				lifecycleMutex.Unlock()
+				break
+			}
+			cmd := lifecycleQueue[0]
+			lifecycleQueue = lifecycleQueue[1:]
+			cmd.startedAt = time.Now()
+			lifecycleRunning = cmd
+			lifecycleMutex.Unlock()
+
+			text := cmd.run()
+
+			lifecycleMutex.Lock()
+			cmd.result = text
+			lifecycleRunning = nil
+			status := cmd.status()
+			status.Completed = true
+			finishedAt := time.Now()
+			status.FinishedAt = &finishedAt
+			lifecycleHistory = append(lifecycleHistory, status)
+			if len(lifecycleHistory) > lifecycleHistorySize {
+				lifecycleHistory = lifecycleHistory[len(lifecycleHistory)-lifecycleHistorySize:]
+			}
+			lifecycleMutex.Unlock()
+			close(cmd.done)
+		}
+	}
+}
+
+// status describes the command. Caller must hold lifecycleMutex.
+func (cmd *lifecycleCommand) status() LifecycleCommandStatus {
+	status := LifecycleCommandStatus{
+		Command:  cmd.name,
+		QueuedAt: cmd.queuedAt,
+		Callers:  cmd.waiters,
+		TimedOut: cmd.abandoned,
+	}
+	if cmd.result != "" {
+		status.Result = json.RawMessage(cmd.result)
+	}
+	if !cmd.startedAt.IsZero() {
+		startedAt := cmd.startedAt
+		status.StartedAt = &startedAt
+	}
+	return status
+}
+
+// restartTunnel restarts olm's tunnel on the same interface and config,
+// without tearing down the network settings. It runs on the lifecycle queue
+// and returns a LifecycleResult as JSON.
+//
+//export restartTunnel
+func restartTunnel() *C.char {
+	return runLifecycleCommand("restartTunnel", "restart", restartTunnelTimeout, func() *C.char {
+		defer watchForHang("restartTunnel")()
+
+		tunnelMutex.Lock()
+		defer tunnelMutex.Unlock()
+		if !tunnelRunning {
+			appLogger.Warn("Tunnel is not running")
+			return lifecycleFailure(LifecycleErrorNotRunning, false, "Tunnel not running")
+		}
+		if err := restartOlmTunnel("requested by Swift"); err != nil {
+			return lifecycleFailure(LifecycleErrorRestartFailed, true, "Failed to restart tunnel: %v", err)
+		}
+		return lifecycleOK("Tunnel restarted")
+	})
+}
+
+// getLifecycleStatus returns the lifecycle command running, those queued
+// behind it and the results of the last ones, as JSON
+//
+//export getLifecycleStatus
+func getLifecycleStatus() *C.char {
+	lifecycleMutex.Lock()
+	status := LifecycleStatus{Queued: []LifecycleCommandStatus{}}
+	if lifecycleRunning != nil {
+		running := lifecycleRunning.status()
+		status.Running = &running
+	}
+	for _, cmd := range lifecycleQueue {
+		status.Queued = append(status.Queued, cmd.status())
+	}
+	status.Recent = append([]LifecycleCommandStatus{}, lifecycleHistory...)
+	lifecycleMutex.Unlock()
+
+	data, err := json.Marshal(status)
+	if err != nil {
+		appLogger.Error("Failed to marshal lifecycle status: %v", err)
+		return exportString(`{"queued":[],"recent":[]}`)
+	}
+	return exportString(string(data))
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitForLifecycle polls until cond holds under lifecycleMutex
+func waitForLifecycle(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		lifecycleMutex.Lock()
+		ok := cond()
+		lifecycleMutex.Unlock()
+		if ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("lifecycle queue did not get there")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// blockLifecycle runs a command that holds the queue until release is closed
+func blockLifecycle(t *testing.T, key string) (release chan struct{}, done chan struct{}) {
+	t.Helper()
+	release, done = make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		queueLifecycleCommand("block", key, time.Minute, func() string {
+			<-release
+			return `{"blocked":true}`
+		})
+	}()
+	waitForLifecycle(t, func() bool { return lifecycleRunning != nil && lifecycleRunning.key == key })
+	return release, done
+}
+
+func TestLifecycleRunsOneAtATimeInOrder(t *testing.T) {
+	release, blocked := blockLifecycle(t, "order-block")
+
+	var (
+		mutex   sync.Mutex
+		order   []int
+		running atomic.Int32
+		overlap atomic.Bool
+		wg      sync.WaitGroup
+	)
+	for i := range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			queueLifecycleCommand("step", fmt.Sprint("order", i), time.Minute, func() string {
+				if running.Add(1) > 1 {
+					overlap.Store(true)
+				}
+				time.Sleep(5 * time.Millisecond)
+				mutex.Lock()
+				order = append(order, i)
+				mutex.Unlock()
+				running.Add(-1)
+				return fmt.Sprintf(`{"step":%d}`, i)
+			})
+		}()
+		// Queue each behind the previous one
+		waitForLifecycle(t, func() bool { return len(lifecycleQueue) == i+1 })
+	}
+	close(release)
+	wg.Wait()
+	<-blocked
+
+	if overlap.Load() {
+		t.Error("commands ran at the same time")
+	}
+	if fmt.Sprint(order) != "[0 1 2]" {
+		t.Errorf("order = %v, want [0 1 2]", order)
+	}
+}
+
+func TestLifecycleJoinsIdenticalCommand(t *testing.T) {
+	release, blocked := blockLifecycle(t, "join-block")
+
+	var runs atomic.Int32
+	results := make([]string, 2)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], _ = queueLifecycleCommand("joined", "join", time.Minute, func() string {
+				return fmt.Sprintf(`{"run":%d}`, runs.Add(1))
+			})
+		}()
+	}
+	waitForLifecycle(t, func() bool { return len(lifecycleQueue) == 1 && lifecycleQueue[0].waiters == 2 })
+	close(release)
+	wg.Wait()
+	<-blocked
+
+	if runs.Load() != 1 {
+		t.Errorf("command ran %d times, want once", runs.Load())
+	}
+	if results[0] != `{"run":1}` || results[1] != results[0] {
+		t.Errorf("results = %q, want both {\"run\":1}", results)
+	}
+}
+
+func TestLifecycleTimeoutLeavesCommandRunning(t *testing.T) {
+	release := make(chan struct{})
+	finished := make(chan struct{})
+	_, ok := queueLifecycleCommand("slow", "slow", 20*time.Millisecond, func() string {
+		defer close(finished)
+		<-release
+		return `{"slow":true}`
+	})
+	if ok {
+		t.Fatal("result arrived before the command finished")
+	}
+	close(release)
+	<-finished
+
+	waitForLifecycle(t, func() bool { return lifecycleRunning == nil })
+	lifecycleMutex.Lock()
+	last := lifecycleHistory[len(lifecycleHistory)-1]
+	lifecycleMutex.Unlock()
+	if last.Command != "slow" || !last.TimedOut || !last.Completed || string(last.Result) != `{"slow":true}` {
+		t.Errorf("history = %+v, want the timed out command with its result", last)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import "C"
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Error codes in the results of initOlm, startTunnel, stopTunnel and
+// restartTunnel
+const (
+	LifecycleErrorNotInitialized = "NOT_INITIALIZED"
+	LifecycleErrorAlreadyRunning = "ALREADY_RUNNING"
+	LifecycleErrorNotRunning     = "NOT_RUNNING"
+	// LifecycleErrorInvalidConfig: the config was rejected; retrying it
+	// unchanged fails again
+	LifecycleErrorInvalidConfig = "INVALID_CONFIG"
+	LifecycleErrorInitFailed    = "INIT_FAILED"
+	LifecycleErrorRestartFailed = "RESTART_FAILED"
+	// LifecycleErrorTimeout: the command did not finish in time and may
+	// still take effect; getLifecycleStatus reports how it ended
+	LifecycleErrorTimeout = "TIMEOUT"
+)
+
+// LifecycleError is the error of a failed lifecycle command
+type LifecycleError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Retryable says whether the same call may succeed later
+	Retryable bool `json:"retryable"`
+}
+
+// LifecycleResult is the JSON returned by the lifecycle exports. Error is
+// set exactly when OK is false.
+type LifecycleResult struct {
+	OK      bool            `json:"ok"`
+	Message string          `json:"message,omitempty"`
+	Error   *LifecycleError `json:"error,omitempty"`
+}
+
+func lifecycleResultJSON(result LifecycleResult) *C.char {
+	data, err := json.Marshal(result)
+	if err != nil {
+		// Cannot happen with these field types
+		appLogger.Error("Failed to marshal lifecycle result: %v", err)
+		return exportString(`{"ok":false,"error":{"code":"INTERNAL","message":"unreadable result","retryable":false}}`)
+	}
+	return exportString(string(data))
+}
+
+// lifecycleOK returns a success result
+func lifecycleOK(message string) *C.char {
+	return lifecycleResultJSON(LifecycleResult{OK: true, Message: message})
+}
+
+// lifecycleFailure returns an error result
+func lifecycleFailure(code string, retryable bool, format string, args ...any) *C.char {
+	return lifecycleResultJSON(LifecycleResult{Error: &LifecycleError{
+		Code:      code,
+		Message:   fmt.Sprintf(format, args...),
+		Retryable: retryable,
+	}})
+}
+
+// lifecycleErrorMessage returns the message of an error result, or "" for
+// a success
+func lifecycleErrorMessage(result string) string {
+	var parsed LifecycleResult
+	if err := json.Unmarshal([]byte(result), &parsed); err != nil {
+		return result
+	}
+	if parsed.Error == nil {
+		return ""
+	}
+	return parsed.Error.Message
+}
@@ -8,6 +8,9 @@ package main
 import "C"
 import (
 	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 	"unsafe"
 
@@ -26,30 +29,32 @@ const (
 
 // Logger provides formatted logging functionality
 type Logger struct {
-	prefix    string
-	logLevel  LogLevel
+	prefix string
+	// logLevel is a LogLevel; it changes at runtime through setLogLevel
+	logLevel  atomic.Int32
 	subsystem *C.char
 	category  *C.char
 }
 
 // NewLogger creates a new logger instance
 func NewLogger(prefix string) *Logger {
-	return &Logger{
+	l := &Logger{
 		prefix:    prefix,
-		logLevel:  LogLevelInfo,
 		subsystem: C.CString("net.pangolin.Pangolin.PacketTunnel"),
 		category:  C.CString("PangolinGo"),
 	}
+	l.logLevel.Store(int32(LogLevelInfo))
+	return l
 }
 
 // SetLevel sets the minimum log level
 func (l *Logger) SetLevel(level LogLevel) {
-	l.logLevel = level
+	l.logLevel.Store(int32(level))
 }
 
 // GetLevel returns the current log level
 func (l *Logger) GetLevel() LogLevel {
-	return l.logLevel
+	return LogLevel(l.logLevel.Load())
 }
 
 // formatMessage formats a log message with timestamp, level, prefix, and caller info
@@ -62,11 +67,16 @@ func (l *Logger) formatMessage(level string, format string, args ...interface{})
 
 // logToOSLog sends a log message to os.log via the C bridge
 func (l *Logger) logToOSLog(level LogLevel, levelName string, format string, args ...interface{}) {
-	if l.logLevel > level {
+	// Warnings and errors always reach the flight recorder, whatever the level
+	if level >= LogLevelWarn {
+		recordEvent(EventLog, "%s %s", levelName, l.formatMessage(levelName, format, args...))
+	}
+	if l.GetLevel() > level {
 		return
 	}
 
 	message := l.formatMessage(levelName, format, args...)
+	storeLogLine(level, message)
 	cMessage := C.CString(message)
 	defer C.free(unsafe.Pointer(cMessage))
 
@@ -131,6 +141,11 @@ func (w *OSLogWriter) Write(level logger.LogLevel, timestamp time.Time, message
 		ourLevel = LogLevelInfo
 	}
 
+	// Warnings and errors are recorded by our logger itself
+	if ourLevel < LogLevelWarn {
+		recordOlmLog(message)
+	}
+
 	// Call the appropriate method on our logger
 	switch ourLevel {
 	case LogLevelDebug:
@@ -158,12 +173,40 @@ func init() {
 	appLogger.Info("Logger initialized")
 }
 
-// setLogLevel sets the log level for the Go logger
-// level: 0=DEBUG, 1=INFO, 2=WARN, 3=ERROR
+// parseLogLevel reads a level name, or its number for older callers
+func parseLogLevel(name string) (LogLevel, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "debug":
+		return LogLevelDebug, nil
+	case "info":
+		return LogLevelInfo, nil
+	case "warn", "warning":
+		return LogLevelWarn, nil
+	case "error":
+		return LogLevelError, nil
+	}
+	if n, err := strconv.Atoi(name); err == nil && n >= int(LogLevelDebug) && n <= int(LogLevelError) {
+		return LogLevel(n), nil
+	}
+	return LogLevelInfo, fmt.Errorf("unknown log level %q", name)
+}
+
+// setLogLevel sets the log level of the bridge and of olm, which follows it
+// right away, also while a tunnel runs. level is "debug", "info", "warn" or
+// "error".
 //
 //export setLogLevel
-func setLogLevel(level C.int) {
-	appLogger.SetLevel(LogLevel(level))
+func setLogLevel(level *C.char) *C.char {
+	parsed, err := parseLogLevel(C.GoString(level))
+	if err != nil {
+		appLogger.Error("Invalid log level: %v", err)
+		return exportString(fmt.Sprintf("Error: Invalid log level: %v", err))
+	}
+	appLogger.SetLevel(parsed)
+	// olm logs through the newt logger, which filters before our writer
+	logger.GetLogger().SetLevel(logLevelToNewtLoggerLevel(parsed))
+	appLogger.Info("Log level set to %s", logLevelToString(parsed))
+	return exportString("Log level set to " + logLevelToString(parsed))
 }
 
 // getCurrentLogLevel returns the current log level from appLogger
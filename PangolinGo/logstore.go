@@ -0,0 +1,100 @@
+package main
+
+import "C"
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// logStoreSize is how many log lines are kept in memory for getRecentLogs
+const logStoreSize = 5000
+
+// LogLine is one entry returned by getRecentLogs
+type LogLine struct {
+	At      time.Time `json:"at"`
+	Level   string    `json:"level"`
+	Message string    `json:"message"`
+}
+
+type storedLogLine struct {
+	at      time.Time
+	level   LogLevel
+	message string
+}
+
+var (
+	logStoreMutex sync.Mutex
+	logStoreLines [logStoreSize]storedLogLine
+	logStoreNext  int
+	logStoreFull  bool
+)
+
+// storeLogLine appends a line that passed the log level to the ring. It must
+// not log.
+func storeLogLine(level LogLevel, message string) {
+	now := time.Now()
+	logStoreMutex.Lock()
+	logStoreLines[logStoreNext] = storedLogLine{at: now, level: level, message: message}
+	logStoreNext = (logStoreNext + 1) % logStoreSize
+	if logStoreNext == 0 {
+		logStoreFull = true
+	}
+	logStoreMutex.Unlock()
+}
+
+// recentLogLines returns up to maxLines of the newest lines at minLevel or
+// above, oldest first
+func recentLogLines(maxLines int, minLevel LogLevel) []LogLine {
+	logStoreMutex.Lock()
+	defer logStoreMutex.Unlock()
+
+	count := logStoreNext
+	if logStoreFull {
+		count = logStoreSize
+	}
+	lines := []LogLine{}
+	// Walk back from the newest line, then put them in order
+	for i := 0; i < count && len(lines) < maxLines; i++ {
+		line := logStoreLines[(logStoreNext-1-i+logStoreSize)%logStoreSize]
+		if line.level < minLevel {
+			continue
+		}
+		lines = append(lines, LogLine{At: line.at, Level: logLevelToString(line.level), Message: line.message})
+	}
+	for i, j := 0, len(lines)-1; i < j; i, j = i+1, j-1 {
+		lines[i], lines[j] = lines[j], lines[i]
+	}
+	return lines
+}
+
+// getRecentLogs returns the newest log lines of the bridge and olm, oldest
+// first, as a JSON array of {"at", "level", "message"} objects, so the app
+// can show them without Console or log stream. Only lines that passed the
+// log level at the time are kept, the last few thousand. maxLines of zero or
+// less returns all of them; minLevel is "debug", "info", "warn" or "error",
+// empty for all.
+//
+//export getRecentLogs
+func getRecentLogs(maxLines C.int, minLevel *C.char) *C.char {
+	level := LogLevelDebug
+	if name := C.GoString(minLevel); name != "" {
+		parsed, err := parseLogLevel(name)
+		if err != nil {
+			return exportString(fmt.Sprintf("Error: Invalid log level: %v", err))
+		}
+		level = parsed
+	}
+	limit := int(maxLines)
+	if limit <= 0 {
+		limit = logStoreSize
+	}
+
+	data, err := json.Marshal(recentLogLines(limit, level))
+	if err != nil {
+		appLogger.Error("Failed to marshal recent logs: %v", err)
+		return exportString(fmt.Sprintf("Error: Failed to marshal recent logs: %v", err))
+	}
+	return exportString(string(data))
+}
@@ -9,7 +9,9 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"strings"
 	"sync"
+	"syscall"
 
 	olmpkg "github.com/fosrl/olm/olm"
 )
@@ -22,26 +24,97 @@ type InitOlmConfig struct {
 	LogLevel   string `json:"logLevel"`
 	Version    string `json:"version"`
 	Agent      string `json:"agent"`
+	StateDir   string `json:"stateDir"`
+	// StatusFilePath, if set, is where the status is written for
+	// third-party tooling
+	StatusFilePath string `json:"statusFilePath"`
+	// OSVersion and DeviceModel identify the device to the control plane
+	OSVersion   string `json:"osVersion"`
+	DeviceModel string `json:"deviceModel"`
+	// SessionCookieName is the server's session cookie name, for servers
+	// that change server.session_cookie_name; unset means p_session_token
+	SessionCookieName string `json:"sessionCookieName"`
 }
 
 // StartTunnelConfig represents the JSON configuration for startTunnel
 type StartTunnelConfig struct {
-	Endpoint            string         `json:"endpoint"`
-	ID                  string         `json:"id"`
-	Secret              string         `json:"secret"`
-	MTU                 int            `json:"mtu"`
-	DNS                 string         `json:"dns"`
-	Holepunch           bool           `json:"holepunch"`
-	PingIntervalSeconds int            `json:"pingIntervalSeconds"`
-	PingTimeoutSeconds  int            `json:"pingTimeoutSeconds"`
-	UserToken           string         `json:"userToken"`
-	OrgID               string         `json:"orgId"`
-	UpstreamDNS         []string       `json:"upstreamDNS"`
-	MatchDomains        []string       `json:"matchDomains"`
-	OverrideDNS         bool           `json:"overrideDNS"`
-	TunnelDNS           bool           `json:"tunnelDNS"`
-	Fingerprint         map[string]any `json:"fingerprint"`
-	Postures            map[string]any `json:"postures"`
+	Endpoint            string               `json:"endpoint"`
+	ID                  string               `json:"id"`
+	Secret              string               `json:"secret"`
+	MTU                 int                  `json:"mtu"`
+	DNS                 string               `json:"dns"`
+	Holepunch           bool                 `json:"holepunch"`
+	PingIntervalSeconds int                  `json:"pingIntervalSeconds"`
+	PingTimeoutSeconds  int                  `json:"pingTimeoutSeconds"`
+	UserToken           string               `json:"userToken"`
+	OrgID               string               `json:"orgId"`
+	UpstreamDNS         []string             `json:"upstreamDNS"`
+	MatchDomains        []string             `json:"matchDomains"`
+	OverrideDNS         bool                 `json:"overrideDNS"`
+	DNSOverrideScope    string               `json:"dnsOverrideScope"`
+	TunnelDNS           bool                 `json:"tunnelDNS"`
+	Fingerprint         map[string]any       `json:"fingerprint"`
+	Postures            map[string]any       `json:"postures"`
+	FeatureFlags        json.RawMessage      `json:"featureFlags"`
+	ClockSkewThreshold  int                  `json:"clockSkewThresholdSeconds"`
+	MaintenanceWindow   *MaintenanceWindow   `json:"maintenanceWindow"`
+	AppleServices       *AppleServicesPolicy `json:"appleServices"`
+	RespondToPing       *bool                `json:"respondToPing"`
+	NATMappings         []NATMapping         `json:"natMappings"`
+	Firewall            *FirewallConfig      `json:"firewall"`
+	InboundExposure     *InboundExposure     `json:"inboundExposure"`
+	DeviceName          string               `json:"deviceName"`
+	SelfDomain          string               `json:"selfDomain"`
+	BandwidthLimit      *BandwidthLimit      `json:"bandwidthLimit"`
+	DSCP                *int                 `json:"dscp"`
+	PresharedKey        string               `json:"presharedKey"`
+	PeerPresharedKeys   map[string]string    `json:"peerPresharedKeys"`
+	KeyRotationHours    int                  `json:"keyRotationHours"`
+	RouteVia            []RouteVia           `json:"routeVia"`
+	DomainRoutes        []DomainRoute        `json:"domainRoutes"`
+	RouteMTUs           []RouteMTU           `json:"routeMtus"`
+	ExitNodeLANAccess   *bool                `json:"exitNodeLanAccess"`
+	DNSProfiles         []DNSProfile         `json:"dnsProfiles"`
+	DNSLeakCanaryDomain string               `json:"dnsLeakCanaryDomain"`
+	DNSPrivacy          *DNSPrivacy          `json:"dnsPrivacy"`
+	// RelayWeights are relative relay weights by exit node endpoint
+	RelayWeights map[string]int `json:"relayWeights"`
+	// ReassertPolicy picks what network transitions do to the tunnel
+	ReassertPolicy *ReassertPolicy `json:"reassertPolicy"`
+	// AutoReconnect tunes how a stuck tunnel is restarted
+	AutoReconnect *AutoReconnectPolicy `json:"autoReconnect"`
+	// DNSBootstrap resolves upstream resolvers given by name
+	DNSBootstrap *DNSBootstrap `json:"dnsBootstrap"`
+	// ForceTakeover takes the session back when the same olm ID connects
+	// from another device or process, instead of giving way to it
+	ForceTakeover bool `json:"forceTakeover"`
+	// SupersededCodes are the olm error codes the server sends when this
+	// olm ID registered from another device or process
+	SupersededCodes []string `json:"supersededCodes"`
+	// KeyRotationCodes are the olm error codes the server sends to ask
+	// for a new device key
+	KeyRotationCodes []string `json:"keyRotationCodes"`
+	// ServerVersions overrides the Pangolin versions the tunnel accepts
+	ServerVersions *ServerVersionRange `json:"serverVersions"`
+	// SourcePolicy pins the bridge's own control plane and DNS traffic to
+	// an interface
+	SourcePolicy *SourcePolicy `json:"sourcePolicy"`
+	// Standby is an alternate server kept warm to move the tunnel to
+	Standby *StandbyConfig `json:"standby"`
+	// DNSRoutes maps domain suffixes to the upstreams that resolve names
+	// under them; other names go to the usual upstreams
+	DNSRoutes map[string][]string `json:"dnsRoutes"`
+	// FullTunnel sends all traffic into the tunnel when true and only the
+	// sites' routes when false, whatever the server sends; unset leaves it
+	// to the server
+	FullTunnel *bool `json:"fullTunnel"`
+	// MDNSPassthrough leaves .local and link-local names to multicast DNS
+	// instead of the tunnel's resolver; unset means on
+	MDNSPassthrough *bool `json:"mdnsPassthrough"`
+	// SessionCookieName overrides the init config's session cookie name
+	SessionCookieName string `json:"sessionCookieName"`
+	// ResumeState is what exportSessionState returned before a restart
+	ResumeState json.RawMessage `json:"resumeState"`
 }
 
 var (
@@ -49,8 +122,26 @@ var (
 	tunnelMutex   sync.Mutex
 	olm           *olmpkg.Olm
 	olmContext    context.Context
+
+	// activeTunnelConfig is the config the running tunnel was started with,
+	// updated in place by exports that change it at runtime
+	activeTunnelConfig StartTunnelConfig
+
+	// tunnelFD is the utun descriptor Swift handed to startTunnel. olm closes
+	// the descriptor it is given when its tunnel stops early, so it only ever
+	// gets a duplicate; that lets the bridge restart olm's tunnel on the same
+	// interface.
+	tunnelFD int
+	// olmTunnelConfig is the config olm's tunnel was last started with
+	olmTunnelConfig olmpkg.TunnelConfig
+	// tunnelGeneration is bumped every time olm's tunnel is (re)started so a
+	// finished tunnel goroutine does not clear the state of its replacement
+	tunnelGeneration int
 )
 
+// initOlm creates olm from the JSON init configuration. Returns a
+// LifecycleResult as JSON.
+//
 //export initOlm
 func initOlm(configJSON *C.char) *C.char {
 	appLogger.Debug("Initializing with config")
@@ -58,13 +149,40 @@ func initOlm(configJSON *C.char) *C.char {
 	// Parse JSON configuration
 	configStr := C.GoString(configJSON)
 	var config InitOlmConfig
-	if err := json.Unmarshal([]byte(configStr), &config); err != nil {
+	if err := decodeCompatJSON([]byte(configStr), &config, "init config"); err != nil {
 		appLogger.Error("Failed to parse init config JSON: %v", err)
-		return C.CString(fmt.Sprintf("Error: Failed to parse config JSON: %v", err))
+		return lifecycleFailure(LifecycleErrorInvalidConfig, false, "Failed to parse config JSON: %v", err)
 	}
 
 	// Initialize OLM logger with current log level
 	InitOLMLogger()
+	setClientInfo(config)
+	setDefaultSessionCookieName(config.SessionCookieName)
+
+	installHappyEyeballs()
+	registerPacketHook(peerProbeHook, hookPriorityProbe, installPeerProbe)
+
+	if config.EnableAPI {
+		setOlmSocketPath(config.SocketPath)
+	}
+
+	// Restore state persisted by previous sessions
+	setStateDir(config.StateDir)
+	enableCrashOutput()
+	loadRouteOverrides()
+	loadStatusSnapshot()
+	loadConnectionHistory()
+	loadSafeMode()
+	loadTelemetry()
+	if err := setStatusFile(config.StatusFilePath); err != nil {
+		appLogger.Warn("Not writing a status file: %v", err)
+	}
+
+	// The bridge reads olm's internals; refuse an olm that no longer has
+	// them rather than run with features silently missing
+	if missing := checkOlmHooks(); len(missing) > 0 {
+		return lifecycleFailure(LifecycleErrorInitFailed, true, "olm hooks not found: %s", strings.Join(missing, ", "))
+	}
 
 	// Create context for OLM
 	olmContext = context.Background()
@@ -76,26 +194,74 @@ func initOlm(configJSON *C.char) *C.char {
 		SocketPath: config.SocketPath,
 		Version:    config.Version,
 		Agent:      config.Agent,
+		OnAuthError: func(statusCode int, message string) {
+			dropOlmObjects()
+			handleAuthError(statusCode, message)
+			// olm clears its settings before reporting the error
+			requestOlmSync()
+		},
+		OnRegistered: func() {
+			refreshStatusSnapshot()
+			requestOlmSync()
+		},
+		OnConnected: func() {
+			captureOlmObjects()
+			requestOlmSync()
+		},
+		OnOlmError: func(code, message string) {
+			if noteKeyRotationError(code, message) {
+				return
+			}
+			noteSessionError(code, message, false)
+		},
+		OnTerminated: func() {
+			dropOlmObjects()
+			code, message := terminationError()
+			if noteSessionError(code, message, true) {
+				return
+			}
+			recordEvent(EventState, "olm terminated")
+			noteTunnelError(ErrorCodeTerminated, message)
+			stopStatusSnapshots(SnapshotStateTerminated)
+			dumpFlightRecorder("olm terminated")
+		},
 	}
 
 	// Initialize OLM with context and GlobalConfig
 	o, err := olmpkg.Init(olmContext, olmConfig)
 	if err != nil {
-		return C.CString(fmt.Sprintf("Error: Failed to initialize olm: %v", err))
+		return lifecycleFailure(LifecycleErrorInitFailed, true, "Failed to initialize olm: %v", err)
 	}
 	olm = o
+	captureOlmObjects()
 
 	appLogger.Debug("Init completed successfully")
-	return C.CString("Init completed successfully")
+	return lifecycleOK("Init completed successfully")
 }
 
+// startTunnel starts the tunnel on the utun descriptor fd with the given
+// JSON configuration. It runs on the lifecycle queue; see
+// runLifecycleCommand. Returns a LifecycleResult as JSON.
+//
 //export startTunnel
 func startTunnel(fd C.int, configJSON *C.char) *C.char {
+	configStr := C.GoString(configJSON)
+	key := fmt.Sprintf("start %d %s", int(fd), configStr)
+	return runLifecycleCommand("startTunnel", key, startTunnelTimeout, func() *C.char {
+		return runStartTunnel(fd, configStr)
+	})
+}
+
+// runStartTunnel is startTunnel's work, run from the lifecycle queue
+func runStartTunnel(fd C.int, configStr string) (result *C.char) {
 	if olm == nil {
-		return C.CString("Error: olm has not been initialized yet!")
+		return lifecycleFailure(LifecycleErrorNotInitialized, true, "olm has not been initialized yet")
 	}
 
 	appLogger.Debug("Starting tunnel")
+	defer watchForHang("startTunnel")()
+
+	srvConfigured, srvResolved := startEndpointSRV(configStr)
 
 	tunnelMutex.Lock()
 	defer tunnelMutex.Unlock()
@@ -103,37 +269,245 @@ func startTunnel(fd C.int, configJSON *C.char) *C.char {
 	// Check if tunnel is already running
 	if tunnelRunning {
 		appLogger.Warn("Tunnel is already running")
-		return C.CString("Error: Tunnel already running")
+		return lifecycleFailure(LifecycleErrorAlreadyRunning, false, "Tunnel already running")
 	}
 
 	tunnelRunning = true
+	recordEvent(EventState, "tunnel starting")
+	noteTunnelStarting()
+	defer func() {
+		if !tunnelRunning {
+			noteTunnelError(ErrorCodeStartFailed, lifecycleErrorMessage(C.GoString(result)))
+		}
+	}()
+
+	// Layer the managed configuration over the app's
+	configData, sources, err := applyManagedConfig([]byte(configStr))
+	if err != nil {
+		appLogger.Error("Failed to parse tunnel config JSON: %v", err)
+		tunnelRunning = false
+		return lifecycleFailure(LifecycleErrorInvalidConfig, false, "Failed to parse config JSON: %v", err)
+	}
 
 	// Parse JSON configuration
-	configStr := C.GoString(configJSON)
 	var config StartTunnelConfig
-	if err := json.Unmarshal([]byte(configStr), &config); err != nil {
+	if err := decodeCompatJSON(configData, &config, "tunnel config"); err != nil {
 		appLogger.Error("Failed to parse tunnel config JSON: %v", err)
 		tunnelRunning = false
-		return C.CString(fmt.Sprintf("Error: Failed to parse config JSON: %v", err))
+		return lifecycleFailure(LifecycleErrorInvalidConfig, false, "Failed to parse config JSON: %v", err)
+	}
+
+	// After repeated failures start with a minimal config
+	var safeMode bool
+	config, safeMode = beginEstablish(config)
+	defer func() {
+		if !tunnelRunning {
+			noteEstablishFailure("start rejected")
+			endSafeMode()
+		}
+	}()
+
+	// Apply the feature flags the control plane delivered alongside the config
+	if len(config.FeatureFlags) > 0 {
+		flags, err := parseFeatureFlags(config.FeatureFlags)
+		if err != nil {
+			appLogger.Warn("Ignoring invalid feature flags in tunnel config: %v", err)
+		} else {
+			applyFeatureFlags(flags)
+		}
+	}
+
+	setClockSkewThreshold(time.Duration(config.ClockSkewThreshold) * time.Second)
+
+	if err := validateDNSOverrideScope(config); err != nil {
+		appLogger.Error("Invalid DNS override scope: %v", err)
+		tunnelRunning = false
+		return lifecycleFailure(LifecycleErrorInvalidConfig, false, "Invalid DNS override scope: %v", err)
+	}
+
+	if err := setDNSProfiles(config.DNSProfiles); err != nil {
+		appLogger.Error("Invalid DNS profiles: %v", err)
+		tunnelRunning = false
+		return lifecycleFailure(LifecycleErrorInvalidConfig, false, "Invalid DNS profiles: %v", err)
+	}
+
+	if err := setNATMappings(config.NATMappings); err != nil {
+		appLogger.Error("Invalid NAT mappings: %v", err)
+		tunnelRunning = false
+		return lifecycleFailure(LifecycleErrorInvalidConfig, false, "Invalid NAT mappings: %v", err)
+	}
+
+	if err := setRouteVia(config.RouteVia); err != nil {
+		appLogger.Error("Invalid routes: %v", err)
+		tunnelRunning = false
+		return lifecycleFailure(LifecycleErrorInvalidConfig, false, "Invalid routes: %v", err)
+	}
+
+	if err := setDomainRoutes(config.DomainRoutes); err != nil {
+		appLogger.Error("Invalid domain routes: %v", err)
+		tunnelRunning = false
+		return lifecycleFailure(LifecycleErrorInvalidConfig, false, "Invalid domain routes: %v", err)
+	}
+
+	dnsRoutes, err := normalizeDNSRoutes(config.DNSRoutes)
+	if err == nil && len(dnsRoutes) > 0 && config.TunnelDNS {
+		err = fmt.Errorf("they need tunnelDNS off; give internal resolvers as tunnel:// upstreams")
+	}
+	if err != nil {
+		appLogger.Error("Invalid DNS routes: %v", err)
+		tunnelRunning = false
+		return lifecycleFailure(LifecycleErrorInvalidConfig, false, "Invalid DNS routes: %v", err)
+	}
+	config.DNSRoutes = dnsRoutes
+	setDNSRouteTable(dnsRoutes)
+
+	if err := setRouteMTUOverrides(config.RouteMTUs); err != nil {
+		appLogger.Error("Invalid route MTUs: %v", err)
+		tunnelRunning = false
+		return lifecycleFailure(LifecycleErrorInvalidConfig, false, "Invalid route MTUs: %v", err)
+	}
+
+	if err := setFirewallConfig(config.Firewall); err != nil {
+		appLogger.Error("Invalid firewall rules: %v", err)
+		tunnelRunning = false
+		return lifecycleFailure(LifecycleErrorInvalidConfig, false, "Invalid firewall rules: %v", err)
+	}
+
+	if err := setInboundExposureConfig(config.InboundExposure); err != nil {
+		appLogger.Error("Invalid inbound exposure: %v", err)
+		tunnelRunning = false
+		return lifecycleFailure(LifecycleErrorInvalidConfig, false, "Invalid inbound exposure: %v", err)
+	}
+
+	var bandwidthLimit BandwidthLimit
+	if config.BandwidthLimit != nil {
+		bandwidthLimit = *config.BandwidthLimit
+	}
+	if err := setBandwidthLimit(bandwidthLimit); err != nil {
+		appLogger.Error("Invalid bandwidth limits: %v", err)
+		tunnelRunning = false
+		return lifecycleFailure(LifecycleErrorInvalidConfig, false, "Invalid bandwidth limits: %v", err)
+	}
+
+	dscp := -1
+	if config.DSCP != nil {
+		dscp = *config.DSCP
+	}
+	if err := setDSCPValue(dscp); err != nil {
+		appLogger.Error("Invalid DSCP value: %v", err)
+		tunnelRunning = false
+		return lifecycleFailure(LifecycleErrorInvalidConfig, false, "Invalid DSCP value: %v", err)
+	}
+
+	if err := setPresharedKeys(config.PresharedKey, config.PeerPresharedKeys); err != nil {
+		appLogger.Error("Invalid preshared keys: %v", err)
+		tunnelRunning = false
+		return lifecycleFailure(LifecycleErrorInvalidConfig, false, "Invalid preshared keys: %v", err)
+	}
+
+	if err := setRelayWeights(config.RelayWeights); err != nil {
+		appLogger.Error("Invalid relay weights: %v", err)
+		tunnelRunning = false
+		return lifecycleFailure(LifecycleErrorInvalidConfig, false, "Invalid relay weights: %v", err)
+	}
+
+	if err := setReassertPolicy(config.ReassertPolicy); err != nil {
+		appLogger.Error("Invalid reassert policy: %v", err)
+		tunnelRunning = false
+		return lifecycleFailure(LifecycleErrorInvalidConfig, false, "Invalid reassert policy: %v", err)
+	}
+
+	if err := setAutoReconnectPolicy(config.AutoReconnect); err != nil {
+		appLogger.Error("Invalid auto reconnect policy: %v", err)
+		tunnelRunning = false
+		return lifecycleFailure(LifecycleErrorInvalidConfig, false, "Invalid auto reconnect policy: %v", err)
 	}
 
+	if err := setDNSBootstrap(config.DNSBootstrap); err != nil {
+		appLogger.Error("Invalid DNS bootstrap: %v", err)
+		tunnelRunning = false
+		return lifecycleFailure(LifecycleErrorInvalidConfig, false, "Invalid DNS bootstrap: %v", err)
+	}
+
+	if err := setServerVersionRange(config.ServerVersions); err != nil {
+		appLogger.Error("Invalid server versions: %v", err)
+		tunnelRunning = false
+		return lifecycleFailure(LifecycleErrorInvalidConfig, false, "Invalid server versions: %v", err)
+	}
+
+	if err := setSourcePaths(config.SourcePolicy); err != nil {
+		appLogger.Error("Invalid source policy: %v", err)
+		tunnelRunning = false
+		return lifecycleFailure(LifecycleErrorInvalidConfig, false, "Invalid source policy: %v", err)
+	}
+
+	standby, err := parseStandby(config.Standby)
+	if err != nil {
+		appLogger.Error("Invalid standby server: %v", err)
+		tunnelRunning = false
+		return lifecycleFailure(LifecycleErrorInvalidConfig, false, "Invalid standby server: %v", err)
+	}
+	config.Standby = standby
+
+	// State that does not check out only costs the fast path, not the start
+	var resume *SessionState
+	if len(config.ResumeState) > 0 {
+		if state, err := parseSessionState(config.ResumeState, config); err != nil {
+			appLogger.Warn("Not resuming session: %v", err)
+		} else {
+			resume = &state
+		}
+		config.ResumeState = nil
+	}
+
+	activeTunnelConfig = config
+	noteConfigSources(config, sources)
+	setSelfHostname(config.DeviceName, config.SelfDomain)
+	setMDNSPassthrough(config.MDNSPassthrough == nil || *config.MDNSPassthrough)
+	clearUpstreamOverride()
+
+	// The current network's DNS profile wins over the configured upstreams.
+	// Names are resolved now; olm looking them up itself would ask the
+	// resolver it is about to take over.
+	upstreamDNS := config.UpstreamDNS
+	if pinned, _ := pinnedUpstreamDNS(); len(pinned) > 0 {
+		upstreamDNS = pinned
+	}
+	setSiteResolverDirect(config.TunnelDNS || dnsThroughTunnel())
+	if len(upstreamDNS) > 0 {
+		if upstreamDNS = resolveUpstreams(upstreamDNS, true); len(upstreamDNS) == 0 {
+			appLogger.Warn("No upstream DNS server could be bootstrapped, following the system's")
+		}
+	}
+
+	// A resumed session already knows where the server is
+	endpoint := config.Endpoint
+	if resume != nil {
+		endpoint = resume.ResolvedEndpoint
+	} else if srvResolved != "" && config.Endpoint == srvConfigured {
+		endpoint = srvResolved
+	}
+	setSessionCookie(config.SessionCookieName, config.UserToken, endpoint)
+
+	setTunnelULA(config)
+	resetSession(config.ForceTakeover, config.SupersededCodes)
+
 	// Create OLM Config with tunnel parameters
 	tunnelConfig := olmpkg.TunnelConfig{
-		Endpoint:             config.Endpoint,
+		Endpoint:             endpoint,
 		ID:                   config.ID,
 		Secret:               config.Secret,
 		MTU:                  config.MTU,
 		Holepunch:            config.Holepunch,
 		PingIntervalDuration: time.Duration(config.PingIntervalSeconds) * time.Second,
 		PingTimeoutDuration:  time.Duration(config.PingTimeoutSeconds) * time.Second,
-		FileDescriptorTun:    uint32(fd),
 		UserToken:            config.UserToken,
-		OverrideDNS:          config.OverrideDNS,
-		TunnelDNS:            config.TunnelDNS,
-		UpstreamDNS:          config.UpstreamDNS,
-		MatchDomains:         config.MatchDomains,
+		OverrideDNS:          dnsOverrideScope(config) == DNSScopeAlways,
+		TunnelDNS:            config.TunnelDNS || dnsThroughTunnel(),
+		UpstreamDNS:          upstreamDNS,
+		MatchDomains:         olmMatchDomains(config.MatchDomains),
 		OrgID:                config.OrgID,
-		InitialFingerprint:   config.Fingerprint,
+		InitialFingerprint:   clientFingerprint(config.Fingerprint),
 		InitialPostures:      config.Postures,
 	}
 
@@ -144,23 +518,65 @@ func startTunnel(fd C.int, configJSON *C.char) *C.char {
 
 	// Start OLM tunnel with config
 	appLogger.Info("Starting OLM tunnel...")
-	go func() {
-		olm.StartTunnel(tunnelConfig)
-		appLogger.Info("OLM tunnel stopped")
-
-		// Update tunnel state when OLM stops
-		tunnelMutex.Lock()
+	tunnelFD = int(fd)
+	if err := launchOlmTunnel(tunnelConfig); err != nil {
+		appLogger.Error("Failed to start OLM tunnel: %v", err)
+		_ = olm.StopApi()
 		tunnelRunning = false
-		tunnelMutex.Unlock()
-	}()
+		return lifecycleFailure(LifecycleErrorInitFailed, true, "Failed to start OLM tunnel: %v", err)
+	}
+
+	peerPingMonitor.start(tunnelConfig.PingIntervalDuration, tunnelConfig.PingTimeoutDuration)
+	startTrafficCounters(tunnelFD)
+	startTunnelFDMonitor()
+	startMaintenanceScheduler(config.MaintenanceWindow)
+	startKeyRotation(time.Duration(config.KeyRotationHours)*time.Hour, config.KeyRotationCodes)
+	startStatusSnapshots(config.Endpoint, config.OrgID)
+	startServerHealth(config.Endpoint)
+	startStandby(config.Standby)
+	startDNSLeakCheck(config)
+	startRelayBalancer()
+	startOfflinePeers()
+	startAutoReconnect()
+	startFirstByteMetrics()
+	startKeepWarm()
+	setICMPResponder(config.RespondToPing == nil || *config.RespondToPing)
+	setExitNodeLANAccess(config.ExitNodeLANAccess == nil || *config.ExitNodeLANAccess)
+	setFullTunnelMode(config.FullTunnel)
+	startPacketHooks()
+	if resume != nil {
+		resumeSession(*resume)
+	}
+
+	notifySettingsChanged()
 
 	appLogger.Debug("Start tunnel completed successfully")
-	return C.CString("Tunnel started")
+	if safeMode {
+		return lifecycleOK("Tunnel started in safe mode")
+	}
+	return lifecycleOK("Tunnel started")
 }
 
+// stopTunnel stops the tunnel. With a positive drainSeconds it first lets
+// existing connections finish for up to that long, refusing new ones, and
+// returns right away; getDrainStatus reports the progress. A stop without
+// draining also ends a drain in progress, and gives queued packets, olm and
+// the cancelled jobs up to timeoutSeconds (0 for the default) to finish
+// before returning with what did not. It runs on the lifecycle queue and
+// returns a StopTunnelResult as JSON.
+//
 //export stopTunnel
-func stopTunnel() *C.char {
+func stopTunnel(drainSeconds C.int, timeoutSeconds C.int) *C.char {
+	key := fmt.Sprintf("stop %d %d", int(drainSeconds), int(timeoutSeconds))
+	return runLifecycleCommand("stopTunnel", key, stopTunnelTimeout, func() *C.char {
+		return runStopTunnel(drainSeconds, stopDeadline(int(timeoutSeconds)))
+	})
+}
+
+// runStopTunnel is stopTunnel's work, run from the lifecycle queue
+func runStopTunnel(drainSeconds C.int, deadline time.Duration) *C.char {
 	appLogger.Debug("Stopping tunnel")
+	defer watchForHang("stopTunnel")()
 
 	tunnelMutex.Lock()
 	defer tunnelMutex.Unlock()
@@ -168,53 +584,214 @@ func stopTunnel() *C.char {
 	// Check if tunnel is not running
 	if !tunnelRunning {
 		appLogger.Warn("Tunnel is not running")
-		return C.CString("Error: Tunnel not running")
+		return lifecycleFailure(LifecycleErrorNotRunning, false, "Tunnel not running")
 	}
 
-	// Stop OLM tunnel
-	_ = olm.StopTunnel()
-	_ = olm.StopApi()
+	if drainSeconds > 0 {
+		if currentDrainStatus().Draining {
+			return lifecycleOK("Tunnel already draining")
+		}
+		startDrain(int(drainSeconds))
+		return lifecycleOK("Tunnel draining")
+	}
+	cancelDrain()
+
+	report := shutdownTunnel(deadline, "")
+	if report.TimedOut {
+		return stopTunnelResultJSON("Tunnel stopped; shutdown did not finish within the deadline", report)
+	}
+	return stopTunnelResultJSON("Tunnel stopped", report)
+}
+
+// shutdownTunnel stops olm and everything running alongside it, giving it
+// all up to deadline, and reports how that went. selfJob names the job
+// calling it, which is not waited for. Caller must hold tunnelMutex.
+func shutdownTunnel(deadline time.Duration, selfJob string) ShutdownReport {
+	startedAt := time.Now()
+	stopBy := startedAt.Add(deadline)
+	recordEvent(EventState, "tunnel stopping")
+	noteDisconnectReason("stopped")
+	noteTunnelStopped()
+
+	// Let packets already queued leave before the device closes
+	var report ShutdownReport
+	report.PendingPackets = flushPacketQueues(min(deadline/4, maxFlushTime))
+	report.Flushed = report.PendingPackets == 0
+
+	resetTunnelState()
+	report.ForceCancelled = cancelledJobsRunning(selfJob)
+	report.DeviceClosed = stopOlm(stopBy)
+	report.StillRunning = waitForCancelledJobs(stopBy, selfJob)
+	if !report.DeviceClosed && time.Now().After(stopBy) {
+		report.StillRunning = append(report.StillRunning, olmStopTaskName)
+	}
+	report.TimedOut = len(report.StillRunning) > 0
+	report.DurationMs = milliseconds(time.Since(startedAt))
 
 	tunnelRunning = false
-	appLogger.Debug("Tunnel stopped successfully")
-	return C.CString("Tunnel stopped")
+	notifySettingsChanged()
+	logShutdownReport(report)
+	return report
+}
+
+// resetTunnelState stops everything that runs alongside olm's tunnel and
+// forgets the state it kept, on every path that ends the tunnel. Caller must
+// hold tunnelMutex.
+func resetTunnelState() {
+	cancelDrain()
+	stopMaintenanceScheduler()
+	stopKeyRotation()
+	stopTunnelFDMonitor()
+	resetAddressConflicts()
+	resetRouteConflicts()
+	stopStatusSnapshots(SnapshotStateDisconnected)
+	stopServerHealth()
+	stopStandby()
+	stopBandwidthStats()
+	stopDNSLeakCheck()
+	stopRelayBalancer()
+	stopOfflinePeers()
+	stopAutoReconnect()
+	stopDNSPrivacy()
+	stopSplitDNS()
+	stopDNSCache()
+	stopMagicDNSTCP()
+	resetUpstreamPaths()
+	resetSearchDomains()
+	resetSessionCookie()
+	resetFeatureFlags()
+	resetFirewallFlows()
+	resetPause()
+	resetNetworkPath()
+	stopSiteResolvers()
+	stopFirstByteMetrics()
+	resetKeepaliveSample()
+	resetDomainRoutes()
+	clearTunnelULA()
+	endSafeMode()
+	resetSettingsApply()
+	clearResumedSettings()
+	forgetPublishedSettings()
+	stopPacketHooks()
+	peerPingMonitor.stop()
+}
+
+// launchOlmTunnel starts olm's tunnel in the background on a duplicate of
+// tunnelFD. Caller must hold tunnelMutex.
+func launchOlmTunnel(config olmpkg.TunnelConfig) error {
+	olmTunnelConfig = config
+
+	// olm closes the descriptor it was given when it stops before its device
+	// is up, so it never gets the one Swift handed over
+	if tunnelFD != 0 {
+		dupFD, err := syscall.Dup(tunnelFD)
+		if err != nil {
+			return fmt.Errorf("failed to duplicate tunnel file descriptor: %w", err)
+		}
+		config.FileDescriptorTun = uint32(dupFD)
+	}
+
+	tunnelGeneration++
+	generation := tunnelGeneration
+	noteKeyGenerated()
+
+	recordEvent(EventState, "olm tunnel %d starting", generation)
+	go checkServerRegistration(generation, config)
+
+	stopping := olmStopping
+	go func() {
+		defer dumpOnPanic()
+
+		waitForOlmStop(stopping)
+		olm.StartTunnel(config)
+		appLogger.Info("OLM tunnel stopped")
+		recordEvent(EventState, "olm tunnel %d stopped", generation)
+
+		// Update tunnel state when OLM stops, unless the tunnel has been
+		// restarted or stopped in the meantime
+		tunnelMutex.Lock()
+		defer tunnelMutex.Unlock()
+		if generation != tunnelGeneration {
+			return
+		}
+		dumpFlightRecorder("olm tunnel stopped unexpectedly")
+		noteDisconnectReason("tunnel stopped unexpectedly")
+		noteEstablishFailure("tunnel stopped unexpectedly")
+		noteTunnelError(ErrorCodeTunnelStopped, "olm's tunnel stopped unexpectedly")
+		resetTunnelState()
+		tunnelRunning = false
+		notifySettingsChanged()
+	}()
+	return nil
+}
+
+// restartOlmTunnel stops olm's tunnel and starts it again with the same
+// config on the same interface. olm generates a new WireGuard key and fetches
+// a fresh token on every start, so this re-registers and re-handshakes with
+// every peer. Caller must hold tunnelMutex.
+func restartOlmTunnel(reason string) error {
+	if !tunnelRunning {
+		return fmt.Errorf("tunnel not running")
+	}
+
+	appLogger.Info("Restarting OLM tunnel: %s", reason)
+	noteDisconnectReason(reason)
+	noteTunnelRestarting()
+	recordEvent(EventState, "restarting olm tunnel: %s", reason)
+
+	peerPingMonitor.stop()
+	dropOlmObjects()
+	_ = olm.StopTunnel()
+
+	if err := launchOlmTunnel(olmTunnelConfig); err != nil {
+		tunnelRunning = false
+		notifySettingsChanged()
+		return err
+	}
+
+	interval, timeout := peerPingMonitor.parameters()
+	peerPingMonitor.start(interval, timeout)
+	return nil
 }
 
 // getNetworkSettingsVersion returns the current network settings version number
 //
 //export getNetworkSettingsVersion
 func getNetworkSettingsVersion() C.long {
-	tunnelMutex.Lock()
-	running := tunnelRunning
-	tunnelMutex.Unlock()
-
-	if !running {
-		return C.long(0)
-	}
+	return C.long(settingsChangeToken())
+}
 
-	incrementor := olmpkg.GetNetworkSettingsIncrementor()
-	return C.long(incrementor)
+// waitForSettingsChange blocks until the network settings token differs from
+// lastToken, or timeoutMs passes, and returns the current token. Starting
+// and stopping the tunnel also change the token, so a caller waiting on its
+// own thread is released when the tunnel goes away.
+//
+//export waitForSettingsChange
+func waitForSettingsChange(lastToken C.long, timeoutMs C.int) C.long {
+	return C.long(waitSettingsChange(int(lastToken), time.Duration(timeoutMs)*time.Millisecond))
 }
 
 // getNetworkSettings returns the current network settings as a JSON string
+// shaped like NEPacketTunnelNetworkSettings; see NetworkSettingsSchema
 //
 //export getNetworkSettings
 func getNetworkSettings() *C.char {
 	tunnelMutex.Lock()
 	running := tunnelRunning
+	config := activeTunnelConfig
 	tunnelMutex.Unlock()
 
 	if !running {
-		return C.CString("{}")
+		return exportString("{}")
 	}
 
-	settingsJSON, err := olmpkg.GetNetworkSettingsJSON()
+	settingsJSON, err := effectiveNetworkSettingsJSON(config)
 	if err != nil {
 		appLogger.Error("Failed to get network settings JSON: %v", err)
-		return C.CString("{}")
+		return exportString("{}")
 	}
 
-	return C.CString(settingsJSON)
+	return exportString(settingsJSON)
 }
 
 //export setPowerMode
@@ -227,13 +804,13 @@ func setPowerMode(mode *C.char) *C.char {
 
 	if !running {
 		appLogger.Warn("Tunnel is not running")
-		return C.CString("Error: Tunnel not running")
+		return exportString("Error: Tunnel not running")
 	}
 
 	modeStr := C.GoString(mode)
 	// olm.SetPowerMode(modeStr)
 	appLogger.Info("Power mode set to: %s", modeStr)
-	return C.CString(fmt.Sprintf("Power mode set to: %s", modeStr))
+	return exportString(fmt.Sprintf("Power mode set to: %s", modeStr))
 }
 
 //export rebindSocket
@@ -246,17 +823,19 @@ func rebindSocket() *C.char {
 
 	if !running {
 		appLogger.Warn("Tunnel is not running")
-		return C.CString("Error: Tunnel not running")
+		return exportString("Error: Tunnel not running")
 	}
 
 	err := olm.RebindSocket()
 	if err != nil {
 		appLogger.Error("Failed to rebind socket: %v", err)
-		return C.CString(fmt.Sprintf("Error: %v", err))
+		return exportString(fmt.Sprintf("Error: %v", err))
 	}
+	// The new socket needs marking again
+	requestOlmSync()
 
 	appLogger.Info("Socket rebound successfully")
-	return C.CString("Socket rebound successfully")
+	return exportString("Socket rebound successfully")
 }
 
 // setSystemDNS reports DNS servers observed by the app/extension (via
@@ -267,17 +846,22 @@ func rebindSocket() *C.char {
 //export setSystemDNS
 func setSystemDNS(serversJSON *C.char) *C.char {
 	if olm == nil {
-		return C.CString("Error: olm has not been initialized yet!")
+		return exportString("Error: olm has not been initialized yet!")
 	}
 
 	var servers []string
 	if err := json.Unmarshal([]byte(C.GoString(serversJSON)), &servers); err != nil {
 		appLogger.Error("Failed to parse system DNS JSON: %v", err)
-		return C.CString(fmt.Sprintf("Error: Failed to parse system DNS JSON: %v", err))
+		return exportString(fmt.Sprintf("Error: Failed to parse system DNS JSON: %v", err))
 	}
 
+	recordEvent(EventDNS, "system DNS %v", servers)
+	noteSystemDNS(servers)
 	olm.SetSystemDNS(servers)
-	return C.CString("System DNS updated")
+	applyUpstreamDNS()
+	// olm may publish the new servers in its settings
+	requestOlmSync()
+	return exportString("System DNS updated")
 }
 
 // We need an entry point; it's ok for this to be empty
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	defaultMaintenanceDuration = 60 * time.Minute
+	defaultMaintenanceIdle     = 2 * time.Minute
+	maintenanceJob             = "maintenance"
+	maintenanceCheckInterval   = time.Minute
+)
+
+// MaintenanceWindow is a recurring local-time window in which the tunnel is
+// restarted once, while idle, to refresh its token and WireGuard key ahead of
+// time instead of in the middle of a call
+type MaintenanceWindow struct {
+	// Days limits the window to the given weekdays ("mon".."sun"); empty means
+	// every day
+	Days []string `json:"days"`
+	// Start is the local start time as "HH:MM"
+	Start           string `json:"start"`
+	DurationMinutes int    `json:"durationMinutes"`
+	// IdleSeconds is how long the tunnel must have carried no traffic before
+	// the refresh runs
+	IdleSeconds int `json:"idleSeconds"`
+}
+
+// maintenanceSchedule is a parsed MaintenanceWindow
+type maintenanceSchedule struct {
+	days     map[time.Weekday]bool
+	hour     int
+	minute   int
+	duration time.Duration
+	idle     time.Duration
+}
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// parseMaintenanceWindow validates a window and fills in defaults
+func parseMaintenanceWindow(window MaintenanceWindow) (maintenanceSchedule, error) {
+	schedule := maintenanceSchedule{
+		duration: defaultMaintenanceDuration,
+		idle:     defaultMaintenanceIdle,
+	}
+
+	start, err := time.Parse("15:04", window.Start)
+	if err != nil {
+		return schedule, fmt.Errorf("invalid start time %q, expected HH:MM", window.Start)
+	}
+	schedule.hour, schedule.minute = start.Hour(), start.Minute()
+
+	if len(window.Days) > 0 {
+		schedule.days = make(map[time.Weekday]bool, len(window.Days))
+		for _, day := range window.Days {
+			key := strings.ToLower(day)
+			if len(key) > 3 {
+				key = key[:3]
+			}
+			weekday, ok := weekdayNames[key]
+			if !ok {
+				return schedule, fmt.Errorf("invalid day %q", day)
+			}
+			schedule.days[weekday] = true
+		}
+	}
+
+	if window.DurationMinutes > 0 {
+		schedule.duration = time.Duration(window.DurationMinutes) * time.Minute
+	}
+	if schedule.duration > 24*time.Hour {
+		return schedule, fmt.Errorf("duration must not exceed 24 hours")
+	}
+	if window.IdleSeconds > 0 {
+		schedule.idle = time.Duration(window.IdleSeconds) * time.Second
+	}
+	return schedule, nil
+}
+
+// occurrence returns the start of the window containing now, if any. Windows
+// may run past midnight, so yesterday's occurrence is checked too.
+func (s maintenanceSchedule) occurrence(now time.Time) (time.Time, bool) {
+	for _, offset := range []int{0, -1} {
+		day := now.AddDate(0, 0, offset)
+		start := time.Date(day.Year(), day.Month(), day.Day(), s.hour, s.minute, 0, 0, now.Location())
+		if s.days != nil && !s.days[start.Weekday()] {
+			continue
+		}
+		if !now.Before(start) && now.Before(start.Add(s.duration)) {
+			return start, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// startMaintenanceScheduler begins watching for the configured window,
+// replacing any previous scheduler. A nil window disables maintenance.
+func startMaintenanceScheduler(window *MaintenanceWindow) {
+	stopMaintenanceScheduler()
+	if window == nil {
+		return
+	}
+
+	schedule, err := parseMaintenanceWindow(*window)
+	if err != nil {
+		appLogger.Warn("Ignoring maintenance window: %v", err)
+		return
+	}
+
+	appLogger.Info("Maintenance window scheduled at %02d:%02d for %v", schedule.hour, schedule.minute, schedule.duration)
+	var lastRun time.Time
+	scheduleJob(maintenanceJob, false, func() time.Duration { return maintenanceCheckInterval }, func(ctx context.Context) {
+		if start, ok := runMaintenance(ctx, schedule, lastRun); ok {
+			lastRun = start
+		}
+	})
+}
+
+// stopMaintenanceScheduler stops the scheduler without waiting for it, so it
+// is safe to call while holding tunnelMutex
+func stopMaintenanceScheduler() {
+	cancelJob(maintenanceJob)
+}
+
+// runMaintenance refreshes the tunnel if a window is open and has not been
+// used yet. It reports the start of the window it used.
+func runMaintenance(ctx context.Context, schedule maintenanceSchedule, lastRun time.Time) (time.Time, bool) {
+	start, ok := schedule.occurrence(time.Now())
+	if !ok || start.Equal(lastRun) {
+		return time.Time{}, false
+	}
+
+	// Refreshing costs radio time and data; leave it for a later
+	// occurrence rather than spend battery or a metered plan
+	if powerConstrained() || pathCostly() {
+		return time.Time{}, false
+	}
+
+	// Without interface counters there is no way to tell whether the
+	// tunnel is idle; the window itself is then the only guard
+	if _, ok := sampleTrafficCounters(); ok && trafficIdleFor() < schedule.idle {
+		return time.Time{}, false
+	}
+
+	tunnelMutex.Lock()
+	if ctx.Err() != nil {
+		tunnelMutex.Unlock()
+		return time.Time{}, false
+	}
+	err := restartOlmTunnel("scheduled maintenance")
+	tunnelMutex.Unlock()
+
+	if err != nil {
+		appLogger.Error("Scheduled maintenance failed: %v", err)
+	}
+	return start, true
+}
@@ -0,0 +1,312 @@
+package main
+
+import "C"
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// A managed configuration comes from an MDM profile, which Swift reads from
+// the VPN payload's vendor configuration and hands over before startTunnel.
+// It is a layer over the config the app passes: enforced fields replace the
+// app's values, defaults fill the fields it leaves out, and both enforced
+// and locked fields refuse changes through the runtime exports. Values take
+// effect at the next start; locks at once.
+
+// Where a field of the effective config came from
+const (
+	ConfigSourceManaged        = "managed"
+	ConfigSourceManagedDefault = "managedDefault"
+	ConfigSourceUser           = "user"
+	// ConfigSourceRuntime: an export changed it after the start
+	ConfigSourceRuntime = "runtime"
+)
+
+// ManagedConfig is the JSON setManagedConfig takes. Field names are those of
+// the startTunnel config, in either casing.
+type ManagedConfig struct {
+	Enforced map[string]json.RawMessage `json:"enforced"`
+	Defaults map[string]json.RawMessage `json:"defaults"`
+	// Locked fields keep the value they started with
+	Locked []string `json:"locked"`
+}
+
+// ConfigSource is one field in getEffectiveConfigSources
+type ConfigSource struct {
+	Field  string `json:"field"`
+	Source string `json:"source"`
+	Locked bool   `json:"locked,omitempty"`
+}
+
+// EffectiveConfigSources is the JSON returned by getEffectiveConfigSources
+type EffectiveConfigSources struct {
+	Managed bool `json:"managed"`
+	Running bool `json:"running"`
+	// Fields lists the fields the running tunnel has a value for, in
+	// declaration order; with no tunnel running it is empty
+	Fields []ConfigSource `json:"fields"`
+}
+
+// managedExempt are fields a managed configuration cannot set
+var managedExempt = map[string]bool{
+	"resumeState": true,
+}
+
+var (
+	managedMutex  sync.Mutex
+	managedConfig *ManagedConfig
+	// startSources and startedConfig are where each field of the running
+	// tunnel's config came from and the config it started with, to tell
+	// runtime changes apart
+	startSources  map[string]string
+	startedConfig StartTunnelConfig
+)
+
+// configFieldKey folds a field name so both casings of it compare equal
+func configFieldKey(name string) string {
+	return strings.ToLower(strings.ReplaceAll(name, "_", ""))
+}
+
+// configFieldNames maps folded names to the JSON names of StartTunnelConfig
+func configFieldNames() map[string]string {
+	names := map[string]string{}
+	fields := reflect.TypeOf(StartTunnelConfig{})
+	for i := range fields.NumField() {
+		name, _, _ := strings.Cut(fields.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			names[configFieldKey(name)] = name
+		}
+	}
+	return names
+}
+
+// parseManagedConfig checks a managed configuration and renames its fields
+// to their JSON names. Values are checked by decoding them as a config.
+func parseManagedConfig(data []byte) (*ManagedConfig, error) {
+	var raw ManagedConfig
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	names := configFieldNames()
+	canonical := func(field string) (string, error) {
+		name, ok := names[configFieldKey(field)]
+		if !ok {
+			return "", fmt.Errorf("unknown field %q", field)
+		}
+		if managedExempt[name] {
+			return "", fmt.Errorf("field %q cannot be managed", field)
+		}
+		return name, nil
+	}
+
+	config := &ManagedConfig{Enforced: map[string]json.RawMessage{}, Defaults: map[string]json.RawMessage{}}
+	for _, layer := range []struct {
+		from map[string]json.RawMessage
+		to   map[string]json.RawMessage
+	}{{raw.Enforced, config.Enforced}, {raw.Defaults, config.Defaults}} {
+		for field, value := range layer.from {
+			name, err := canonical(field)
+			if err != nil {
+				return nil, err
+			}
+			layer.to[name] = value
+		}
+	}
+	for name := range config.Enforced {
+		if _, ok := config.Defaults[name]; ok {
+			return nil, fmt.Errorf("field %q is both enforced and defaulted", name)
+		}
+	}
+	for _, field := range raw.Locked {
+		name, err := canonical(field)
+		if err != nil {
+			return nil, err
+		}
+		if !slices.Contains(config.Locked, name) {
+			config.Locked = append(config.Locked, name)
+		}
+	}
+
+	for _, values := range []map[string]json.RawMessage{config.Enforced, config.Defaults} {
+		encoded, err := json.Marshal(values)
+		if err != nil {
+			return nil, err
+		}
+		var check StartTunnelConfig
+		if err := json.Unmarshal(encoded, &check); err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+// applyManagedConfig layers the managed configuration over a startTunnel
+// config and says where each field present in the result came from
+func applyManagedConfig(configJSON []byte) ([]byte, map[string]string, error) {
+	var user map[string]json.RawMessage
+	if err := json.Unmarshal(configJSON, &user); err != nil {
+		return nil, nil, err
+	}
+
+	names := configFieldNames()
+	merged := map[string]json.RawMessage{}
+	sources := map[string]string{}
+	for field, value := range user {
+		merged[field] = value
+		if name, ok := names[configFieldKey(field)]; ok && string(value) != "null" {
+			sources[name] = ConfigSourceUser
+		}
+	}
+
+	managedMutex.Lock()
+	managed := managedConfig
+	managedMutex.Unlock()
+	if managed == nil {
+		return configJSON, sources, nil
+	}
+
+	// The app's value may be in the other casing, so it is replaced by name
+	replace := func(name string, value json.RawMessage) {
+		for field := range merged {
+			if configFieldKey(field) == configFieldKey(name) {
+				delete(merged, field)
+			}
+		}
+		merged[name] = value
+	}
+	for name, value := range managed.Enforced {
+		replace(name, value)
+		sources[name] = ConfigSourceManaged
+	}
+	for name, value := range managed.Defaults {
+		if _, set := sources[name]; !set {
+			replace(name, value)
+			sources[name] = ConfigSourceManagedDefault
+		}
+	}
+
+	data, err := json.Marshal(merged)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, sources, nil
+}
+
+// noteConfigSources records where the running tunnel's config came from.
+// Called by runStartTunnel with the config it started with.
+func noteConfigSources(config StartTunnelConfig, sources map[string]string) {
+	managedMutex.Lock()
+	startedConfig = config
+	startSources = sources
+	managedMutex.Unlock()
+}
+
+// managedLocked reports whether a field refuses runtime changes
+func managedLocked(name string) bool {
+	managedMutex.Lock()
+	defer managedMutex.Unlock()
+	if managedConfig == nil {
+		return false
+	}
+	if _, ok := managedConfig.Enforced[name]; ok {
+		return true
+	}
+	return slices.Contains(managedConfig.Locked, name)
+}
+
+// checkManagedLock returns an error naming the first of fields the managed
+// configuration locks
+func checkManagedLock(fields ...string) error {
+	for _, field := range fields {
+		if managedLocked(field) {
+			return fmt.Errorf("%s is locked by the managed configuration", field)
+		}
+	}
+	return nil
+}
+
+// managedLockResult is what an export returns when it would change a locked
+// field, or nil to go ahead
+func managedLockResult(fields ...string) *C.char {
+	if err := checkManagedLock(fields...); err != nil {
+		appLogger.Warn("Refusing change: %v", err)
+		return exportString(fmt.Sprintf("Error: %v", err))
+	}
+	return nil
+}
+
+// setManagedConfig takes the managed configuration as a JSON object
+// {"enforced": {...}, "defaults": {...}, "locked": [...]}, or an empty
+// string to remove it. Locks apply at once; values at the next startTunnel,
+// and diffTunnelConfig shows what that start would change.
+//
+//export setManagedConfig
+func setManagedConfig(configJSON *C.char) *C.char {
+	data := strings.TrimSpace(C.GoString(configJSON))
+	var config *ManagedConfig
+	if data != "" {
+		var err error
+		if config, err = parseManagedConfig([]byte(data)); err != nil {
+			appLogger.Error("Invalid managed configuration: %v", err)
+			return exportString(fmt.Sprintf("Error: Invalid managed configuration: %v", err))
+		}
+	}
+
+	managedMutex.Lock()
+	managedConfig = config
+	managedMutex.Unlock()
+
+	if config == nil {
+		appLogger.Info("Managed configuration removed")
+		return exportString("Managed configuration removed")
+	}
+	appLogger.Info("Managed configuration set: %d enforced, %d defaulted, %d locked fields",
+		len(config.Enforced), len(config.Defaults), len(config.Locked))
+	return exportString("Managed configuration set")
+}
+
+// getEffectiveConfigSources returns, for each field the running tunnel has a
+// value for, whether it came from the managed configuration, the app or a
+// runtime export, and whether it is locked, as JSON
+//
+//export getEffectiveConfigSources
+func getEffectiveConfigSources() *C.char {
+	tunnelMutex.Lock()
+	running := tunnelRunning
+	active := activeTunnelConfig
+	tunnelMutex.Unlock()
+
+	managedMutex.Lock()
+	out := EffectiveConfigSources{Managed: managedConfig != nil, Running: running, Fields: []ConfigSource{}}
+	sources := maps.Clone(startSources)
+	started := startedConfig
+	managedMutex.Unlock()
+	if sources == nil {
+		sources = map[string]string{}
+	}
+
+	if running {
+		for _, change := range diffConfigs(started, active) {
+			sources[change.Field] = ConfigSourceRuntime
+		}
+		fields := reflect.TypeOf(StartTunnelConfig{})
+		for i := range fields.NumField() {
+			name, _, _ := strings.Cut(fields.Field(i).Tag.Get("json"), ",")
+			if source, ok := sources[name]; ok {
+				out.Fields = append(out.Fields, ConfigSource{Field: name, Source: source, Locked: managedLocked(name)})
+			}
+		}
+	}
+
+	data, err := json.Marshal(out)
+	if err != nil {
+		appLogger.Error("Failed to marshal config sources: %v", err)
+		return exportString(fmt.Sprintf("Error: Failed to marshal config sources: %v", err))
+	}
+	return exportString(string(data))
+}
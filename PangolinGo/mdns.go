@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// Names under .local and the link-local reverse zones belong to multicast
+// DNS: printers, AirPlay receivers and other devices on the local network
+// answer them themselves. With passthrough on, which is the default, they
+// are kept out of the match and search domains the tunnel publishes, so the
+// system keeps resolving them with mDNS, and out of olm's match patterns, so
+// olm leaves them to the system's resolvers. Under the always scope the
+// system may still send them to olm's proxy, and the DNS cache then asks
+// the system's resolvers instead of the tunnel's upstreams.
+
+// linkLocalDomains are the zones multicast DNS answers (RFC 6762)
+var linkLocalDomains = []string{
+	"local",
+	"254.169.in-addr.arpa",
+	"8.e.f.ip6.arpa",
+	"9.e.f.ip6.arpa",
+	"a.e.f.ip6.arpa",
+	"b.e.f.ip6.arpa",
+}
+
+// mdnsPassthrough is set while link-local names are left to the system
+var mdnsPassthrough atomic.Bool
+
+// setMDNSPassthrough changes whether link-local names are left to the
+// system
+func setMDNSPassthrough(enabled bool) {
+	if mdnsPassthrough.Swap(enabled) == enabled {
+		return
+	}
+	if enabled {
+		appLogger.Info("Leaving .local and link-local names to multicast DNS")
+	} else {
+		appLogger.Info("Resolving .local and link-local names through the tunnel")
+	}
+	bumpSettingsVersion()
+}
+
+// isLinkLocalName reports whether a name or domain pattern falls under a
+// multicast DNS zone
+func isLinkLocalName(name string) bool {
+	name = strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(name), "*."), "."))
+	return slices.ContainsFunc(linkLocalDomains, func(zone string) bool {
+		return name == zone || strings.HasSuffix(name, "."+zone)
+	})
+}
+
+// withoutLinkLocal drops link-local domains or patterns while passthrough is
+// on
+func withoutLinkLocal(domains []string) []string {
+	if !mdnsPassthrough.Load() {
+		return domains
+	}
+	return slices.DeleteFunc(slices.Clone(domains), isLinkLocalName)
+}
+
+// olmLinkLocalPatterns keeps link-local names out of olm's match patterns.
+// Without patterns olm matches every name, so patterns that are all
+// link-local are kept rather than emptied.
+func olmLinkLocalPatterns(patterns []string) []string {
+	filtered := withoutLinkLocal(patterns)
+	if len(filtered) == 0 && len(patterns) > 0 {
+		appLogger.Warn("Match domains %v are all link-local; olm still resolves them", patterns)
+		return patterns
+	}
+	return filtered
+}
+
+// hostResolvers are the system's resolvers, without olm's proxy in case the
+// system already points at it
+func hostResolvers() []string {
+	dnsConfigMutex.Lock()
+	system := slices.Clone(reportedSystemDNS)
+	dnsConfigMutex.Unlock()
+	proxyAddr, _ := olmDNSProxyAddr()
+
+	var servers []string
+	for _, server := range system {
+		normalized, err := normalizeDNSServer(server)
+		if err != nil {
+			continue
+		}
+		if host, _, _ := net.SplitHostPort(normalized); host == proxyAddr.String() {
+			continue
+		}
+		servers = append(servers, normalized)
+	}
+	return servers
+}
+
+// linkLocalReply answers a link-local query from the system's resolvers
+// while passthrough is on, the way olm answers names outside its match
+// patterns. It reports false for queries that go upstream as usual.
+func linkLocalReply(query *dns.Msg) (*dns.Msg, bool) {
+	if !mdnsPassthrough.Load() || len(query.Question) == 0 || !isLinkLocalName(query.Question[0].Name) {
+		return nil, false
+	}
+	for _, server := range hostResolvers() {
+		reply, err := exchange(query, server)
+		if err == nil {
+			return reply, true
+		}
+		appLogger.Debug("Link-local query to %s failed: %v", server, err)
+	}
+	reply := new(dns.Msg)
+	reply.SetRcode(query, dns.RcodeServerFailure)
+	return reply, true
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+
+	"github.com/fosrl/newt/network"
+)
+
+const natHook = "nat"
+
+// olm's packet path matches filter rules by exact destination address, so
+// every alias address costs one rule that is checked for each packet. The
+// limits keep that scan short.
+const (
+	natMinPrefixBits = 24
+	natMaxAddresses  = 1024
+)
+
+// NATMapping maps a remote IPv4 subnet that collides with the local LAN onto
+// an alias subnet of the same size. The client reaches remote host
+// 192.168.1.20 as e.g. 10.251.1.20, and the remote host sees traffic from
+// the client's tunnel address unchanged.
+type NATMapping struct {
+	Remote string `json:"remote"`
+	Alias  string `json:"alias"`
+	// RewriteDNS rewrites A records inside the remote subnet to their alias
+	// in DNS answers from resolvers reached through the tunnel. Answers olm's
+	// own DNS proxy writes to the interface bypass the packet hooks and are
+	// not rewritten. Defaults to true.
+	RewriteDNS *bool `json:"rewriteDNS"`
+}
+
+type natRule struct {
+	remote     netip.Prefix
+	alias      netip.Prefix
+	rewriteDNS bool
+}
+
+var (
+	natMutex sync.RWMutex
+	natRules []natRule
+)
+
+// parseNATMappings validates mappings
+func parseNATMappings(mappings []NATMapping) ([]natRule, error) {
+	var rules []natRule
+	total := 0
+	for _, mapping := range mappings {
+		remote, err := netip.ParsePrefix(mapping.Remote)
+		if err != nil {
+			return nil, fmt.Errorf("invalid remote subnet %q: %w", mapping.Remote, err)
+		}
+		alias, err := netip.ParsePrefix(mapping.Alias)
+		if err != nil {
+			return nil, fmt.Errorf("invalid alias subnet %q: %w", mapping.Alias, err)
+		}
+		remote, alias = remote.Masked(), alias.Masked()
+
+		if !remote.Addr().Is4() || !alias.Addr().Is4() {
+			return nil, fmt.Errorf("only IPv4 subnets can be mapped: %s -> %s", remote, alias)
+		}
+		if remote.Bits() != alias.Bits() {
+			return nil, fmt.Errorf("subnets must be the same size: %s -> %s", remote, alias)
+		}
+		if remote.Bits() < natMinPrefixBits {
+			return nil, fmt.Errorf("subnet %s is larger than /%d", remote, natMinPrefixBits)
+		}
+		if remote.Overlaps(alias) {
+			return nil, fmt.Errorf("alias %s overlaps remote %s", alias, remote)
+		}
+		for _, rule := range rules {
+			if rule.alias.Overlaps(alias) || rule.remote.Overlaps(remote) {
+				return nil, fmt.Errorf("mapping %s -> %s overlaps another mapping", remote, alias)
+			}
+		}
+
+		total += 1 << (32 - remote.Bits())
+		if total > natMaxAddresses {
+			return nil, fmt.Errorf("mappings cover more than %d addresses", natMaxAddresses)
+		}
+
+		rules = append(rules, natRule{
+			remote:     remote,
+			alias:      alias,
+			rewriteDNS: mapping.RewriteDNS == nil || *mapping.RewriteDNS,
+		})
+	}
+	return rules, nil
+}
+
+// setNATMappings replaces the active mappings and updates routes and packet
+// hooks to match
+func setNATMappings(mappings []NATMapping) error {
+	rules, err := parseNATMappings(mappings)
+	if err != nil {
+		return err
+	}
+
+	natMutex.Lock()
+	natRules = rules
+	natMutex.Unlock()
+
+	if len(rules) > 0 {
+		registerPacketHook(natHook, hookPriorityNAT, installNAT)
+		for _, rule := range rules {
+			appLogger.Info("Mapping remote subnet %s to %s", rule.remote, rule.alias)
+		}
+	} else {
+		unregisterPacketHook(natHook)
+	}
+	bumpSettingsVersion()
+	return nil
+}
+
+func currentNATRules() []natRule {
+	natMutex.RLock()
+	defer natMutex.RUnlock()
+	return natRules
+}
+
+// translatePrefixAddr moves addr from one prefix to the same host offset in
+// another prefix of the same size
+func translatePrefixAddr(addr netip.Addr, from, to netip.Prefix) netip.Addr {
+	a := addr.As4()
+	f := from.Addr().As4()
+	t := to.Addr().As4()
+	host := binary.BigEndian.Uint32(a[:]) - binary.BigEndian.Uint32(f[:])
+	var out [4]byte
+	binary.BigEndian.PutUint32(out[:], binary.BigEndian.Uint32(t[:])+host)
+	return netip.AddrFrom4(out)
+}
+
+// applyNATRoutes routes the alias subnets into the tunnel instead of the
+// remote subnets they stand in for, which stay on the local LAN
+func applyNATRoutes(settings network.NetworkSettings) network.NetworkSettings {
+	rules := currentNATRules()
+	if len(rules) == 0 {
+		return settings
+	}
+
+	routes := make([]network.IPv4Route, 0, len(settings.IPv4IncludedRoutes)+len(rules))
+	for _, route := range settings.IPv4IncludedRoutes {
+		prefix, err := netip.ParsePrefix(ipv4RouteCIDR(route))
+		masked := false
+		if err == nil && !route.IsDefault {
+			for _, rule := range rules {
+				if rule.remote.Contains(prefix.Addr()) && prefix.Bits() >= rule.remote.Bits() {
+					masked = true
+					break
+				}
+			}
+		}
+		if !masked {
+			routes = append(routes, route)
+		}
+	}
+	for _, rule := range rules {
+		routes = append(routes, network.IPv4Route{
+			DestinationAddress: rule.alias.Addr().String(),
+			SubnetMask:         net.IP(net.CIDRMask(rule.alias.Bits(), 32)).String(),
+		})
+	}
+	settings.IPv4IncludedRoutes = routes
+	return settings
+}
+
+// installNAT adds a rule per alias address that rewrites outbound packets to
+// the remote address, and a rule on each tunnel address that rewrites
+// replies back to the alias
+func installNAT(dev *hookDevice, settings network.NetworkSettings) {
+	rules := currentNATRules()
+
+	for _, rule := range rules {
+		rule := rule
+		for addr := rule.alias.Addr(); rule.alias.Contains(addr); addr = addr.Next() {
+			dev.AddRule(addr, func(packet []byte) bool {
+				natOutbound(packet, rule)
+				return false
+			})
+		}
+	}
+
+	for _, addr := range tunnelAddresses(settings) {
+		if !addr.Is4() {
+			continue
+		}
+		dev.AddRule(addr, func(packet []byte) bool {
+			natInbound(packet, rules)
+			return false
+		})
+	}
+}
+
+// natOutbound rewrites the destination of a packet headed for an alias
+func natOutbound(packet []byte, rule natRule) {
+	ip, ok := parseIPPacket(packet)
+	if !ok || ip.Version != 4 || !rule.alias.Contains(ip.Dst) {
+		return
+	}
+	rewriteIPv4Addr(packet, 16, translatePrefixAddr(ip.Dst, rule.alias, rule.remote))
+}
+
+// natInbound rewrites the source of a packet from a mapped remote subnet and
+// mapped addresses in DNS answers arriving through the tunnel
+func natInbound(packet []byte, rules []natRule) {
+	ip, ok := parseIPPacket(packet)
+	if !ok || ip.Version != 4 {
+		return
+	}
+
+	for _, rule := range rules {
+		if rule.remote.Contains(ip.Src) {
+			rewriteIPv4Addr(packet, 12, translatePrefixAddr(ip.Src, rule.remote, rule.alias))
+			break
+		}
+	}
+
+	// The resolver answering may sit anywhere behind the tunnel, not only
+	// inside a mapped subnet
+	rewriteDNSAnswer(packet, rules)
+}
+
+// rewriteDNSAnswer maps A records inside remote subnets to their aliases in a
+// UDP DNS response, in place so the packet size does not change
+func rewriteDNSAnswer(packet []byte, rules []natRule) {
+	ip, ok := parseIPPacket(packet)
+	if !ok || ip.Protocol != ipProtoUDP || !ipv4IsFirstFragment(packet) || len(ip.Payload) < 8 {
+		return
+	}
+	if binary.BigEndian.Uint16(ip.Payload[0:2]) != 53 {
+		return
+	}
+
+	changed := false
+	forEachDNSARecord(ip.Payload[8:], func(rdata []byte) {
+		addr := netip.AddrFrom4([4]byte(rdata))
+		for _, rule := range rules {
+			if rule.rewriteDNS && rule.remote.Contains(addr) {
+				alias := translatePrefixAddr(addr, rule.remote, rule.alias).As4()
+				copy(rdata, alias[:])
+				changed = true
+				return
+			}
+		}
+	})
+
+	if changed {
+		setUDPChecksum(packet, ip)
+	}
+}
+
+// forEachDNSARecord calls fn with the 4-byte data of every A record in a DNS
+// message. Malformed messages are left alone.
+func forEachDNSARecord(msg []byte, fn func(rdata []byte)) {
+	if len(msg) < 12 || msg[2]&0x80 == 0 {
+		return // too short, or a query
+	}
+	questions := int(binary.BigEndian.Uint16(msg[4:6]))
+	records := int(binary.BigEndian.Uint16(msg[6:8])) +
+		int(binary.BigEndian.Uint16(msg[8:10])) +
+		int(binary.BigEndian.Uint16(msg[10:12]))
+
+	offset := 12
+	for i := 0; i < questions; i++ {
+		if offset = skipDNSName(msg, offset); offset < 0 || offset+4 > len(msg) {
+			return
+		}
+		offset += 4
+	}
+	for i := 0; i < records; i++ {
+		if offset = skipDNSName(msg, offset); offset < 0 || offset+10 > len(msg) {
+			return
+		}
+		rrType := binary.BigEndian.Uint16(msg[offset:])
+		rrClass := binary.BigEndian.Uint16(msg[offset+2:])
+		length := int(binary.BigEndian.Uint16(msg[offset+8:]))
+		offset += 10
+		if offset+length > len(msg) {
+			return
+		}
+		if rrType == 1 && rrClass == 1 && length == 4 {
+			fn(msg[offset : offset+4])
+		}
+		offset += length
+	}
+}
+
+// skipDNSName returns the offset just past the name at offset, or -1
+func skipDNSName(msg []byte, offset int) int {
+	for offset < len(msg) {
+		length := int(msg[offset])
+		switch {
+		case length == 0:
+			return offset + 1
+		case length&0xc0 == 0xc0:
+			// Compression pointer ends the name
+			if offset+2 > len(msg) {
+				return -1
+			}
+			return offset + 2
+		case length&0xc0 != 0:
+			return -1
+		}
+		offset += 1 + length
+	}
+	return -1
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func testNATRules(t *testing.T, mappings ...NATMapping) []natRule {
+	t.Helper()
+	rules, err := parseNATMappings(mappings)
+	if err != nil {
+		t.Fatalf("parseNATMappings: %v", err)
+	}
+	return rules
+}
+
+// testDNSAnswer builds a UDP DNS response from port 53 carrying A records
+func testDNSAnswer(t *testing.T, src, dst string, addrs ...string) []byte {
+	t.Helper()
+	msg := new(dns.Msg)
+	msg.SetQuestion("nas.example.", dns.TypeA)
+	msg.Response = true
+	for _, addr := range addrs {
+		msg.Answer = append(msg.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: "nas.example.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP(addr),
+		})
+	}
+	payload, err := msg.Pack()
+	if err != nil {
+		t.Fatalf("pack: %v", err)
+	}
+	packet := testIPv4UDP(src, dst, payload)
+	ip, _ := parseIPPacket(packet)
+	binary.BigEndian.PutUint16(ip.Payload[0:2], 53)
+	binary.BigEndian.PutUint16(ip.Payload[2:4], 5353)
+	setUDPChecksum(packet, ip)
+	return packet
+}
+
+func TestParseNATMappings(t *testing.T) {
+	tests := []struct {
+		name     string
+		mappings []NATMapping
+		ok       bool
+	}{
+		{name: "valid", mappings: []NATMapping{{Remote: "192.168.1.0/24", Alias: "10.251.1.0/24"}}, ok: true},
+		{name: "sizes differ", mappings: []NATMapping{{Remote: "192.168.1.0/24", Alias: "10.251.0.0/23"}}},
+		{name: "too large", mappings: []NATMapping{{Remote: "192.168.0.0/16", Alias: "10.251.0.0/16"}}},
+		{name: "ipv6", mappings: []NATMapping{{Remote: "fd00:1::/120", Alias: "fd00:2::/120"}}},
+		{name: "alias overlaps remote", mappings: []NATMapping{{Remote: "192.168.1.0/24", Alias: "192.168.1.128/25"}}},
+		{name: "aliases overlap", mappings: []NATMapping{
+			{Remote: "192.168.1.0/24", Alias: "10.251.1.0/24"},
+			{Remote: "192.168.2.0/24", Alias: "10.251.1.0/24"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseNATMappings(tt.mappings); (err == nil) != tt.ok {
+				t.Errorf("err = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestNATRewritesAddresses(t *testing.T) {
+	rules := testNATRules(t, NATMapping{Remote: "192.168.1.0/24", Alias: "10.251.1.0/24"})
+
+	out := testIPv4UDP("100.90.0.5", "10.251.1.20", []byte("query"))
+	natOutbound(out, rules[0])
+	if ip, _ := parseIPPacket(out); ip.Dst != netip.MustParseAddr("192.168.1.20") || ip.Src != netip.MustParseAddr("100.90.0.5") {
+		t.Errorf("outbound %v -> %v, want 100.90.0.5 -> 192.168.1.20", ip.Src, ip.Dst)
+	}
+	if !validIPv4UDP(t, out) {
+		t.Error("outbound checksums do not hold")
+	}
+
+	in := testIPv4UDP("192.168.1.20", "100.90.0.5", []byte("answer"))
+	natInbound(in, rules)
+	if ip, _ := parseIPPacket(in); ip.Src != netip.MustParseAddr("10.251.1.20") || ip.Dst != netip.MustParseAddr("100.90.0.5") {
+		t.Errorf("inbound %v -> %v, want 10.251.1.20 -> 100.90.0.5", ip.Src, ip.Dst)
+	}
+	if !validIPv4UDP(t, in) {
+		t.Error("inbound checksums do not hold")
+	}
+
+	unmapped := testIPv4UDP("172.16.0.1", "100.90.0.5", []byte("answer"))
+	natInbound(unmapped, rules)
+	if ip, _ := parseIPPacket(unmapped); ip.Src != netip.MustParseAddr("172.16.0.1") {
+		t.Errorf("unmapped source rewritten to %v", ip.Src)
+	}
+}
+
+func TestNATRewritesDNSAnswers(t *testing.T) {
+	rewrite := false
+	rules := testNATRules(t,
+		NATMapping{Remote: "192.168.1.0/24", Alias: "10.251.1.0/24"},
+		NATMapping{Remote: "192.168.2.0/24", Alias: "10.251.2.0/24", RewriteDNS: &rewrite},
+	)
+
+	packet := testDNSAnswer(t, "100.100.100.100", "100.90.0.5", "192.168.1.20", "192.168.2.20", "172.16.0.1")
+	natInbound(packet, rules)
+	if !validIPv4UDP(t, packet) {
+		t.Fatal("checksums do not hold after the rewrite")
+	}
+
+	ip, _ := parseIPPacket(packet)
+	msg := new(dns.Msg)
+	if err := msg.Unpack(ip.Payload[8:]); err != nil {
+		t.Fatalf("unpack: %v", err)
+	}
+	want := []string{"10.251.1.20", "192.168.2.20", "172.16.0.1"}
+	if len(msg.Answer) != len(want) {
+		t.Fatalf("%d answers, want %d", len(msg.Answer), len(want))
+	}
+	for i, rr := range msg.Answer {
+		if got := rr.(*dns.A).A.String(); got != want[i] {
+			t.Errorf("answer %d = %s, want %s", i, got, want[i])
+		}
+	}
+}
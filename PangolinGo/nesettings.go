@@ -0,0 +1,350 @@
+package main
+
+import "C"
+import (
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/fosrl/newt/network"
+)
+
+// NetworkSettingsSchemaVersion is bumped whenever the shape of the settings
+// JSON changes incompatibly
+const NetworkSettingsSchemaVersion = 1
+
+// NetworkSettingsSchema documents the JSON returned by getNetworkSettings. Its
+// objects mirror NEPacketTunnelNetworkSettings and its NEIPv4Settings,
+// NEIPv6Settings, NEDNSSettings and NEProxySettings members property for
+// property, so Swift can build them without translating values. A missing
+// subobject means "unchanged"; Swift keeps whatever it applied before.
+const NetworkSettingsSchema = `{
+  "$schema": "https://json-schema.org/draft/2020-12/schema",
+  "title": "NEPacketTunnelNetworkSettings",
+  "type": "object",
+  "required": ["schemaVersion"],
+  "properties": {
+    "schemaVersion": {"const": 1},
+    "changes": {
+      "type": "array",
+      "items": {"enum": ["full", "addresses-changed", "routes-added", "routes-removed", "dns-changed", "mtu-changed", "remote-address-changed", "proxy-changed", "exclusions-changed"]},
+      "description": "what differs from the settings fetched last; [\"full\"] means apply everything, [] that nothing changed"
+    },
+    "tunnelRemoteAddress": {"type": "string"},
+    "mtu": {"type": "integer"},
+    "ipv4Settings": {
+      "title": "NEIPv4Settings",
+      "type": "object",
+      "required": ["addresses", "subnetMasks"],
+      "properties": {
+        "addresses": {"type": "array", "items": {"type": "string", "format": "ipv4"}},
+        "subnetMasks": {"type": "array", "items": {"type": "string", "format": "ipv4"}, "description": "dotted-quad, one per address"},
+        "includedRoutes": {"type": "array", "items": {"$ref": "#/$defs/NEIPv4Route"}},
+        "excludedRoutes": {"type": "array", "items": {"$ref": "#/$defs/NEIPv4Route"}}
+      }
+    },
+    "ipv6Settings": {
+      "title": "NEIPv6Settings",
+      "type": "object",
+      "required": ["addresses", "networkPrefixLengths"],
+      "properties": {
+        "addresses": {"type": "array", "items": {"type": "string", "format": "ipv6"}},
+        "networkPrefixLengths": {"type": "array", "items": {"type": "integer", "minimum": 0, "maximum": 128}, "description": "one per address"},
+        "includedRoutes": {"type": "array", "items": {"$ref": "#/$defs/NEIPv6Route"}},
+        "excludedRoutes": {"type": "array", "items": {"$ref": "#/$defs/NEIPv6Route"}}
+      }
+    },
+    "dnsSettings": {
+      "title": "NEDNSSettings",
+      "type": "object",
+      "required": ["servers"],
+      "properties": {
+        "servers": {"type": "array", "items": {"type": "string"}},
+        "searchDomains": {"type": "array", "items": {"type": "string"}},
+        "matchDomains": {"type": "array", "items": {"type": "string"}, "description": "[\"\"] matches all domains"},
+        "matchDomainsNoSearch": {"type": "boolean"},
+        "overrideScope": {"enum": ["matchDomains", "always"], "description": "informational; which DNS override scope produced these settings"}
+      }
+    },
+    "appleServiceExclusions": {
+      "title": "NETunnelProviderProtocol exclusions",
+      "type": "object",
+      "required": ["fullTunnel", "excludeAPNs", "excludeCellularServices", "excludeDeviceCommunication"],
+      "properties": {
+        "fullTunnel": {"type": "boolean", "description": "an IPv4 or IPv6 default route is included"},
+        "excludeAPNs": {"type": "boolean"},
+        "excludeCellularServices": {"type": "boolean"},
+        "excludeDeviceCommunication": {"type": "boolean"}
+      }
+    },
+    "proxySettings": {
+      "title": "NEProxySettings",
+      "type": "object",
+      "properties": {
+        "autoProxyConfigurationEnabled": {"type": "boolean"},
+        "proxyAutoConfigurationURL": {"type": "string"},
+        "httpEnabled": {"type": "boolean"},
+        "httpServer": {"$ref": "#/$defs/NEProxyServer"},
+        "httpsEnabled": {"type": "boolean"},
+        "httpsServer": {"$ref": "#/$defs/NEProxyServer"},
+        "excludeSimpleHostnames": {"type": "boolean"},
+        "exceptionList": {"type": "array", "items": {"type": "string"}},
+        "matchDomains": {"type": "array", "items": {"type": "string"}}
+      }
+    }
+  },
+  "$defs": {
+    "NEIPv4Route": {
+      "type": "object",
+      "required": ["destinationAddress", "subnetMask"],
+      "properties": {
+        "destinationAddress": {"type": "string", "format": "ipv4"},
+        "subnetMask": {"type": "string", "format": "ipv4"},
+        "gatewayAddress": {"type": "string", "format": "ipv4"},
+        "isDefault": {"type": "boolean", "description": "use NEIPv4Route.default()"}
+      }
+    },
+    "NEIPv6Route": {
+      "type": "object",
+      "required": ["destinationAddress", "networkPrefixLength"],
+      "properties": {
+        "destinationAddress": {"type": "string", "format": "ipv6"},
+        "networkPrefixLength": {"type": "integer", "minimum": 0, "maximum": 128},
+        "gatewayAddress": {"type": "string", "format": "ipv6"},
+        "isDefault": {"type": "boolean", "description": "use NEIPv6Route.default()"}
+      }
+    },
+    "NEProxyServer": {
+      "type": "object",
+      "required": ["address", "port"],
+      "properties": {
+        "address": {"type": "string"},
+        "port": {"type": "integer"}
+      }
+    }
+  }
+}`
+
+// Defaults used when olm leaves a mask or prefix length out
+const (
+	defaultIPv4AddressMask = "255.255.255.0"
+	defaultIPv4RouteMask   = "255.255.255.255"
+	defaultIPv6PrefixLen   = 64
+	defaultIPv6RoutePrefix = 128
+)
+
+// TunnelNetworkSettings mirrors NEPacketTunnelNetworkSettings
+type TunnelNetworkSettings struct {
+	SchemaVersion       int                  `json:"schemaVersion"`
+	TunnelRemoteAddress string               `json:"tunnelRemoteAddress,omitempty"`
+	MTU                 *int                 `json:"mtu,omitempty"`
+	IPv4Settings        *TunnelIPv4Settings  `json:"ipv4Settings,omitempty"`
+	IPv6Settings        *TunnelIPv6Settings  `json:"ipv6Settings,omitempty"`
+	DNSSettings         *TunnelDNSSettings   `json:"dnsSettings,omitempty"`
+	ProxySettings       *TunnelProxySettings `json:"proxySettings,omitempty"`
+	// AppleServiceExclusions are NETunnelProviderProtocol properties rather
+	// than per-connection settings; the app applies them to the profile
+	AppleServiceExclusions *AppleServiceExclusions `json:"appleServiceExclusions,omitempty"`
+	// Changes says what differs from the settings fetched last; see
+	// SettingsChangeFull and friends. An empty list means nothing did.
+	Changes []string `json:"changes"`
+}
+
+// TunnelIPv4Settings mirrors NEIPv4Settings
+type TunnelIPv4Settings struct {
+	Addresses      []string          `json:"addresses"`
+	SubnetMasks    []string          `json:"subnetMasks"`
+	IncludedRoutes []TunnelIPv4Route `json:"includedRoutes"`
+	ExcludedRoutes []TunnelIPv4Route `json:"excludedRoutes"`
+}
+
+// TunnelIPv4Route mirrors NEIPv4Route
+type TunnelIPv4Route struct {
+	DestinationAddress string `json:"destinationAddress"`
+	SubnetMask         string `json:"subnetMask"`
+	GatewayAddress     string `json:"gatewayAddress,omitempty"`
+	IsDefault          bool   `json:"isDefault,omitempty"`
+}
+
+// TunnelIPv6Settings mirrors NEIPv6Settings
+type TunnelIPv6Settings struct {
+	Addresses            []string          `json:"addresses"`
+	NetworkPrefixLengths []int             `json:"networkPrefixLengths"`
+	IncludedRoutes       []TunnelIPv6Route `json:"includedRoutes"`
+	ExcludedRoutes       []TunnelIPv6Route `json:"excludedRoutes"`
+}
+
+// TunnelIPv6Route mirrors NEIPv6Route
+type TunnelIPv6Route struct {
+	DestinationAddress  string `json:"destinationAddress"`
+	NetworkPrefixLength int    `json:"networkPrefixLength"`
+	GatewayAddress      string `json:"gatewayAddress,omitempty"`
+	IsDefault           bool   `json:"isDefault,omitempty"`
+}
+
+// TunnelDNSSettings mirrors NEDNSSettings
+type TunnelDNSSettings struct {
+	Servers              []string `json:"servers"`
+	SearchDomains        []string `json:"searchDomains,omitempty"`
+	MatchDomains         []string `json:"matchDomains,omitempty"`
+	MatchDomainsNoSearch bool     `json:"matchDomainsNoSearch,omitempty"`
+	// OverrideScope is informational; see DNSScopeNever and friends
+	OverrideScope string `json:"overrideScope,omitempty"`
+}
+
+// TunnelProxySettings mirrors NEProxySettings. olm does not push proxy
+// configuration today, so it is only ever omitted.
+type TunnelProxySettings struct {
+	AutoProxyConfigurationEnabled bool               `json:"autoProxyConfigurationEnabled,omitempty"`
+	ProxyAutoConfigurationURL     string             `json:"proxyAutoConfigurationURL,omitempty"`
+	HTTPEnabled                   bool               `json:"httpEnabled,omitempty"`
+	HTTPServer                    *TunnelProxyServer `json:"httpServer,omitempty"`
+	HTTPSEnabled                  bool               `json:"httpsEnabled,omitempty"`
+	HTTPSServer                   *TunnelProxyServer `json:"httpsServer,omitempty"`
+	ExcludeSimpleHostnames        bool               `json:"excludeSimpleHostnames,omitempty"`
+	ExceptionList                 []string           `json:"exceptionList,omitempty"`
+	MatchDomains                  []string           `json:"matchDomains,omitempty"`
+}
+
+// TunnelProxyServer mirrors NEProxyServer
+type TunnelProxyServer struct {
+	Address string `json:"address"`
+	Port    int    `json:"port"`
+}
+
+// ipv4Mask turns a dotted-quad mask or a prefix length into a dotted-quad mask
+func ipv4Mask(value, fallback string) string {
+	value = strings.TrimPrefix(strings.TrimSpace(value), "/")
+	if value == "" {
+		return fallback
+	}
+	if bits, err := strconv.Atoi(value); err == nil {
+		if bits < 0 || bits > 32 {
+			return fallback
+		}
+		return net.IP(net.CIDRMask(bits, 32)).String()
+	}
+	if ip := net.ParseIP(value).To4(); ip != nil {
+		return ip.String()
+	}
+	return fallback
+}
+
+// ipv6PrefixLength parses a prefix length, tolerating a leading slash
+func ipv6PrefixLength(value string, fallback int) int {
+	bits, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(value), "/"))
+	if err != nil || bits < 0 || bits > 128 {
+		return fallback
+	}
+	return bits
+}
+
+// splitCIDR separates "addr/bits" into its parts; bits is "" without a slash
+func splitCIDR(value string) (addr, bits string) {
+	if prefix, err := netip.ParsePrefix(value); err == nil {
+		return prefix.Addr().String(), strconv.Itoa(prefix.Bits())
+	}
+	return value, ""
+}
+
+func tunnelIPv4Routes(routes []network.IPv4Route) []TunnelIPv4Route {
+	out := make([]TunnelIPv4Route, 0, len(routes))
+	for _, route := range routes {
+		if route.IsDefault {
+			out = append(out, TunnelIPv4Route{DestinationAddress: "0.0.0.0", SubnetMask: "0.0.0.0", IsDefault: true})
+			continue
+		}
+		addr, bits := splitCIDR(route.DestinationAddress)
+		mask := route.SubnetMask
+		if mask == "" {
+			mask = bits
+		}
+		out = append(out, TunnelIPv4Route{
+			DestinationAddress: addr,
+			SubnetMask:         ipv4Mask(mask, defaultIPv4RouteMask),
+			GatewayAddress:     route.GatewayAddress,
+		})
+	}
+	return out
+}
+
+func tunnelIPv6Routes(routes []network.IPv6Route) []TunnelIPv6Route {
+	out := make([]TunnelIPv6Route, 0, len(routes))
+	for _, route := range routes {
+		if route.IsDefault {
+			out = append(out, TunnelIPv6Route{DestinationAddress: "::", NetworkPrefixLength: 0, IsDefault: true})
+			continue
+		}
+		addr, bits := splitCIDR(route.DestinationAddress)
+		prefix := route.NetworkPrefixLength
+		if prefix == 0 {
+			prefix = ipv6PrefixLength(bits, defaultIPv6RoutePrefix)
+		}
+		out = append(out, TunnelIPv6Route{
+			DestinationAddress:  addr,
+			NetworkPrefixLength: prefix,
+			GatewayAddress:      route.GatewayAddress,
+		})
+	}
+	return out
+}
+
+// tunnelNetworkSettings converts olm's flat settings into the NetworkExtension
+// object model. Every address gets exactly one mask or prefix length, so
+// Swift never has to pair up or guess them.
+func tunnelNetworkSettings(settings network.NetworkSettings, config StartTunnelConfig) TunnelNetworkSettings {
+	out := TunnelNetworkSettings{
+		SchemaVersion:       NetworkSettingsSchemaVersion,
+		TunnelRemoteAddress: settings.TunnelRemoteAddress,
+		MTU:                 settings.MTU,
+	}
+
+	if len(settings.IPv4Addresses) > 0 {
+		ipv4 := &TunnelIPv4Settings{
+			IncludedRoutes: tunnelIPv4Routes(settings.IPv4IncludedRoutes),
+			ExcludedRoutes: tunnelIPv4Routes(settings.IPv4ExcludedRoutes),
+		}
+		for i, address := range settings.IPv4Addresses {
+			addr, bits := splitCIDR(address)
+			mask := bits
+			if i < len(settings.IPv4SubnetMasks) {
+				mask = settings.IPv4SubnetMasks[i]
+			}
+			ipv4.Addresses = append(ipv4.Addresses, addr)
+			ipv4.SubnetMasks = append(ipv4.SubnetMasks, ipv4Mask(mask, defaultIPv4AddressMask))
+		}
+		out.IPv4Settings = ipv4
+	}
+
+	if len(settings.IPv6Addresses) > 0 {
+		ipv6 := &TunnelIPv6Settings{
+			IncludedRoutes: tunnelIPv6Routes(settings.IPv6IncludedRoutes),
+			ExcludedRoutes: tunnelIPv6Routes(settings.IPv6ExcludedRoutes),
+		}
+		for i, address := range settings.IPv6Addresses {
+			addr, bits := splitCIDR(address)
+			prefix := bits
+			if i < len(settings.IPv6NetworkPrefixes) {
+				prefix = settings.IPv6NetworkPrefixes[i]
+			}
+			ipv6.Addresses = append(ipv6.Addresses, addr)
+			ipv6.NetworkPrefixLengths = append(ipv6.NetworkPrefixLengths, ipv6PrefixLength(prefix, defaultIPv6PrefixLen))
+		}
+		out.IPv6Settings = ipv6
+	}
+
+	out.DNSSettings = tunnelDNSSettings(settings.DNSServers, config)
+
+	out.AppleServiceExclusions = appleServiceExclusions(settings, config.AppleServices)
+
+	return out
+}
+
+// getNetworkSettingsSchema returns the JSON schema of the getNetworkSettings
+// payload
+//
+//export getNetworkSettingsSchema
+func getNetworkSettingsSchema() *C.char {
+	return exportString(NetworkSettingsSchema)
+}
@@ -0,0 +1,124 @@
+package main
+
+import "C"
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// NWPath statuses Swift reports in NetworkPath.Status
+const (
+	PathStatusSatisfied          = "satisfied"
+	PathStatusUnsatisfied        = "unsatisfied"
+	PathStatusRequiresConnection = "requiresConnection"
+)
+
+// NetworkPath is an NWPathMonitor update as Swift forwards it to
+// notifyNetworkChange
+type NetworkPath struct {
+	Status string `json:"status"`
+	// InterfaceType is the type of the path's first interface, e.g. "wifi"
+	// or "cellular"
+	InterfaceType string `json:"interfaceType"`
+	Expensive     bool   `json:"expensive"`
+	Constrained   bool   `json:"constrained"`
+	SupportsIPv4  bool   `json:"supportsIPv4"`
+	SupportsIPv6  bool   `json:"supportsIPv6"`
+	// NetworkID is what setNetworkIdentifier takes, empty while the path
+	// is down
+	NetworkID string `json:"networkId"`
+}
+
+var (
+	networkPathMutex sync.Mutex
+	// lastNetworkPath is the path last reported, valid once networkPathKnown
+	lastNetworkPath  NetworkPath
+	networkPathKnown bool
+)
+
+// networkPathTransition returns the reassert transition between two paths,
+// or "" when the tunnel can stay as it is. A path that gained or lost an
+// address family counts as an interface change, since the socket's source
+// address may be gone.
+func networkPathTransition(previous, current NetworkPath) string {
+	switch {
+	case current.Status != PathStatusSatisfied:
+		return ""
+	case previous.Status != PathStatusSatisfied:
+		return TransitionNetworkRestored
+	case previous.InterfaceType != current.InterfaceType,
+		previous.SupportsIPv4 != current.SupportsIPv4,
+		previous.SupportsIPv6 != current.SupportsIPv6:
+		return TransitionInterfaceChanged
+	}
+	return ""
+}
+
+// notifyNetworkChange takes an NWPathMonitor update as a JSON NetworkPath.
+// It records the path's attributes and network, and when the path moved to
+// another interface or came back, it applies the reassert policy right away:
+// the UDP socket is rebound and, if the policy says so, every site
+// re-handshakes, instead of waiting for pings to time out. It replaces setPathAttributes, setNetworkIdentifier and
+// reassertNetwork for Swift code that forwards every update.
+//
+//export notifyNetworkChange
+func notifyNetworkChange(pathJSON *C.char) *C.char {
+	var path NetworkPath
+	if err := json.Unmarshal([]byte(C.GoString(pathJSON)), &path); err != nil {
+		appLogger.Error("Failed to parse network path JSON: %v", err)
+		return exportString(fmt.Sprintf("Error: Failed to parse network path JSON: %v", err))
+	}
+	switch path.Status {
+	case PathStatusSatisfied, PathStatusUnsatisfied, PathStatusRequiresConnection:
+	default:
+		return exportString(fmt.Sprintf("Error: Unknown path status %q", path.Status))
+	}
+
+	applyPathAttributes(PathAttributes{Expensive: path.Expensive, Constrained: path.Constrained})
+	applyNetworkIdentifier(path.NetworkID)
+
+	networkPathMutex.Lock()
+	previous, known := lastNetworkPath, networkPathKnown
+	lastNetworkPath, networkPathKnown = path, true
+	networkPathMutex.Unlock()
+
+	if previous != path {
+		appLogger.Debug("Network path: %+v", path)
+	}
+	var transition string
+	if known {
+		transition = networkPathTransition(previous, path)
+	}
+	if transition == "" {
+		return exportString("Network path recorded")
+	}
+
+	tunnelMutex.Lock()
+	running := tunnelRunning
+	tunnelMutex.Unlock()
+	pauseMutex.Lock()
+	paused := tunnelPaused
+	pauseMutex.Unlock()
+
+	switch {
+	case !running:
+		return exportString("Network path recorded; tunnel not running")
+	case paused:
+		// resumeTunnel rebinds and re-handshakes anyway
+		return exportString("Network path recorded; tunnel paused")
+	}
+
+	message, err := reassertTunnel(transition)
+	if err != nil {
+		return exportString(fmt.Sprintf("Error: %v", err))
+	}
+	return exportString(message)
+}
+
+// resetNetworkPath forgets the last path, for a tunnel that starts over
+func resetNetworkPath() {
+	networkPathMutex.Lock()
+	lastNetworkPath, networkPathKnown = NetworkPath{}, false
+	networkPathMutex.Unlock()
+}
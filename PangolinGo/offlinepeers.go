@@ -0,0 +1,281 @@
+package main
+
+import "C"
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/fosrl/newt/holepunch"
+	olmapi "github.com/fosrl/olm/api"
+	"github.com/fosrl/olm/peers"
+	olmws "github.com/fosrl/olm/websocket"
+)
+
+const (
+	offlinePeersJob      = "offlinePeers"
+	offlinePeersInterval = 15 * time.Second
+	// offlineGrace is how long the control plane has to be gone before the
+	// cached descriptors are used, so a websocket reconnect does not count
+	offlineGrace = 30 * time.Second
+	// offlineUnrelayMessage tells the server a site went direct, the same
+	// message olm's peer monitor sends
+	offlineUnrelayMessage = "olm/wg/unrelay"
+)
+
+// OfflinePeer is one cached site in getOfflineStatus
+type OfflinePeer struct {
+	SiteID     int      `json:"siteId"`
+	Name       string   `json:"name,omitempty"`
+	Endpoint   string   `json:"endpoint"`
+	AllowedIPs []string `json:"allowedIps,omitempty"`
+	// Restored is set when the site was re-established from the cache while
+	// the control plane was unreachable
+	Restored bool `json:"restored"`
+}
+
+// OfflineStatus is the JSON returned by getOfflineStatus
+type OfflineStatus struct {
+	ControlPlaneConnected bool          `json:"controlPlaneConnected"`
+	OfflineSince          time.Time     `json:"offlineSince,omitempty"`
+	CachedAt              time.Time     `json:"cachedAt,omitempty"`
+	Peers                 []OfflinePeer `json:"peers"`
+}
+
+// The cache is kept in memory only: olm generates a new key on every tunnel
+// start, so descriptors from an earlier process would not be accepted by the
+// sites anyway.
+var (
+	offlineMutex    sync.Mutex
+	offlinePeers    map[int]peers.SiteConfig
+	offlineCachedAt time.Time
+	offlineSince    time.Time
+	// offlineRestored are the sites changed from the cache, which the server
+	// is told about once it is back
+	offlineRestored = map[int]bool{}
+)
+
+var (
+	controlConnMutex sync.Mutex
+	// controlConns counts the open connections olm's websocket dialed
+	controlConns int
+)
+
+// trackControlConns wraps the dialer of olm's websocket so the bridge sees
+// its connection come up and go away: olm has no disconnect callback, and
+// whether its client is connected is unexported
+func trackControlConns(dial func(ctx context.Context, network, address string) (net.Conn, error)) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		noteControlConn(1)
+		return &controlConn{Conn: conn}, nil
+	}
+}
+
+// controlConn is a connection of olm's websocket, counted until it closes
+type controlConn struct {
+	net.Conn
+	closeOnce sync.Once
+}
+
+func (c *controlConn) Close() error {
+	c.closeOnce.Do(func() { noteControlConn(-1) })
+	return c.Conn.Close()
+}
+
+// noteControlConn counts a control connection opening or closing
+func noteControlConn(delta int) {
+	controlConnMutex.Lock()
+	controlConns += delta
+	connected := controlConns > 0
+	controlConnMutex.Unlock()
+	noteControlConnection(connected)
+}
+
+// controlPlaneConnected reports whether olm's websocket to the server is up
+func controlPlaneConnected() bool {
+	controlConnMutex.Lock()
+	defer controlConnMutex.Unlock()
+	return controlConns > 0
+}
+
+// cachePeerDescriptors records the sites olm knows while the server can be
+// reached. Sites without a key are JIT placeholders with nothing to connect.
+// Caller must hold offlineMutex.
+func cachePeerDescriptors(pm *peers.PeerManager) {
+	cached := map[int]peers.SiteConfig{}
+	for _, site := range pm.GetAllPeers() {
+		if site.PublicKey == "" || site.Endpoint == "" {
+			continue
+		}
+		site.AllowedIps = slices.Clone(site.AllowedIps)
+		site.RemoteSubnets = slices.Clone(site.RemoteSubnets)
+		cached[site.SiteId] = site
+	}
+	offlinePeers = cached
+	offlineCachedAt = time.Now()
+}
+
+// restoreOfflinePeers re-establishes sites straight to their cached
+// endpoints: sites olm lost are added back, and relayed sites that dropped
+// are taken off the relay, which runs on the unreachable server. Caller must
+// hold offlineMutex.
+func restoreOfflinePeers(pm *peers.PeerManager, status *olmapi.StatusResponse) {
+	api := (*olmapi.API)(olmPointerField("apiServer", reflect.TypeOf((*olmapi.API)(nil))))
+	for siteID, site := range offlinePeers {
+		if _, ok := pm.GetPeer(siteID); !ok {
+			appLogger.Info("Control plane unreachable, adding site %d back from its cached descriptor", siteID)
+			if err := pm.AddPeer(site); err != nil {
+				appLogger.Warn("Failed to add site %d from cache: %v", siteID, err)
+				continue
+			}
+			recordEvent(EventHandshake, "site %d restored from cache", siteID)
+			offlineRestored[siteID] = true
+			continue
+		}
+
+		peer := status.PeerStatuses[siteID]
+		if peer == nil || peer.Connected || !peer.IsRelay {
+			continue
+		}
+		appLogger.Info("Control plane unreachable, moving site %d off its relay to %s", siteID, site.Endpoint)
+		if err := pm.UnRelayPeer(siteID, site.Endpoint); err != nil {
+			appLogger.Warn("Failed to move site %d off its relay: %v", siteID, err)
+			continue
+		}
+		if api != nil {
+			api.UpdatePeerRelayStatus(siteID, site.Endpoint, false)
+		}
+		recordEvent(EventHandshake, "site %d direct to %s while offline", siteID, site.Endpoint)
+		offlineRestored[siteID] = true
+	}
+}
+
+// syncRestoredPeers tells the returning server about the sites changed while
+// it was gone and punches again so it learns the current NAT mappings. Sites
+// the server no longer has are removed by olm's next sync. Caller must hold
+// offlineMutex.
+func syncRestoredPeers() {
+	client := (*olmws.Client)(olmPointerField("websocket", reflect.TypeOf((*olmws.Client)(nil))))
+	for siteID := range offlineRestored {
+		if client != nil {
+			err := client.SendMessage(offlineUnrelayMessage, map[string]any{
+				"siteId":  siteID,
+				"chainId": fmt.Sprintf("offline-%d-%d", siteID, time.Now().UnixNano()),
+			})
+			if err != nil {
+				appLogger.Warn("Failed to tell the server about site %d: %v", siteID, err)
+				continue
+			}
+		}
+		delete(offlineRestored, siteID)
+	}
+	if hp := (*holepunch.Manager)(olmPointerField("holePunchManager", reflect.TypeOf((*holepunch.Manager)(nil)))); hp != nil {
+		if err := hp.TriggerHolePunch(); err != nil {
+			appLogger.Debug("Failed to trigger hole punch: %v", err)
+		}
+	}
+}
+
+// checkOfflinePeers caches the sites while the control plane is up and falls
+// back to the cache once it has been gone for offlineGrace
+func checkOfflinePeers(ctx context.Context) {
+	pm := (*peers.PeerManager)(olmPointerField("peerManager", reflect.TypeOf((*peers.PeerManager)(nil))))
+	connected := controlPlaneConnected()
+	if pm == nil || ctx.Err() != nil {
+		return
+	}
+
+	offlineMutex.Lock()
+	defer offlineMutex.Unlock()
+
+	if connected {
+		if !offlineSince.IsZero() {
+			appLogger.Info("Control plane is back after %v, syncing %d restored sites", time.Since(offlineSince).Round(time.Second), len(offlineRestored))
+			recordEvent(EventState, "control plane back")
+			offlineSince = time.Time{}
+		}
+		if len(offlineRestored) > 0 {
+			syncRestoredPeers()
+		}
+		cachePeerDescriptors(pm)
+		return
+	}
+
+	if offlineSince.IsZero() {
+		offlineSince = time.Now()
+		appLogger.Warn("Control plane unreachable, keeping %d cached sites", len(offlinePeers))
+		recordEvent(EventState, "control plane unreachable")
+	}
+	if time.Since(offlineSince) < offlineGrace || len(offlinePeers) == 0 {
+		return
+	}
+	status, err := fetchOlmStatus()
+	if err != nil {
+		appLogger.Debug("Offline reconnect could not read olm status: %v", err)
+		return
+	}
+	restoreOfflinePeers(pm, status)
+}
+
+// startOfflinePeers begins caching site descriptors while the tunnel runs
+func startOfflinePeers() {
+	stopOfflinePeers()
+	scheduleJob(offlinePeersJob, false, func() time.Duration {
+		return quietScaledInterval(offlinePeersInterval)
+	}, checkOfflinePeers)
+}
+
+// stopOfflinePeers stops checking and drops the cache
+func stopOfflinePeers() {
+	cancelJob(offlinePeersJob)
+
+	offlineMutex.Lock()
+	offlinePeers = nil
+	offlineCachedAt = time.Time{}
+	offlineSince = time.Time{}
+	offlineRestored = map[int]bool{}
+	offlineMutex.Unlock()
+}
+
+// getOfflineStatus returns whether the control plane is reachable and the
+// site descriptors cached for when it is not, as JSON
+//
+//export getOfflineStatus
+func getOfflineStatus() *C.char {
+	connected := controlPlaneConnected()
+
+	offlineMutex.Lock()
+	status := OfflineStatus{
+		ControlPlaneConnected: connected,
+		OfflineSince:          offlineSince,
+		CachedAt:              offlineCachedAt,
+		Peers:                 make([]OfflinePeer, 0, len(offlinePeers)),
+	}
+	for siteID, site := range offlinePeers {
+		status.Peers = append(status.Peers, OfflinePeer{
+			SiteID:     siteID,
+			Name:       site.Name,
+			Endpoint:   site.Endpoint,
+			AllowedIPs: site.AllowedIps,
+			Restored:   offlineRestored[siteID],
+		})
+	}
+	offlineMutex.Unlock()
+
+	slices.SortFunc(status.Peers, func(a, b OfflinePeer) int { return a.SiteID - b.SiteID })
+	data, err := json.Marshal(status)
+	if err != nil {
+		appLogger.Error("Failed to marshal offline status: %v", err)
+		return exportString(`{"controlPlaneConnected":false,"peers":[]}`)
+	}
+	return exportString(string(data))
+}
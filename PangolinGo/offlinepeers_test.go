@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestTrackControlConns(t *testing.T) {
+	resetSession(false, nil)
+	var peers []net.Conn
+	dial := trackControlConns(func(context.Context, string, string) (net.Conn, error) {
+		conn, peer := net.Pipe()
+		peers = append(peers, peer)
+		return conn, nil
+	})
+	t.Cleanup(func() {
+		for _, peer := range peers {
+			peer.Close()
+		}
+	})
+
+	if controlPlaneConnected() {
+		t.Fatal("connected before anything was dialed")
+	}
+	first, _ := dial(context.Background(), "tcp", "server:443")
+	second, _ := dial(context.Background(), "tcp", "server:443")
+	if !controlPlaneConnected() {
+		t.Error("not connected with connections open")
+	}
+
+	// Closing twice must not count the connection twice
+	first.Close()
+	first.Close()
+	if !controlPlaneConnected() {
+		t.Error("not connected with one connection still open")
+	}
+	second.Close()
+	if controlPlaneConnected() {
+		t.Error("connected after every connection closed")
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/fosrl/newt/bind"
+	"github.com/fosrl/newt/holepunch"
+	olmapi "github.com/fosrl/olm/api"
+	olmdevice "github.com/fosrl/olm/device"
+	olmdns "github.com/fosrl/olm/dns"
+	olmpkg "github.com/fosrl/olm/olm"
+	"github.com/fosrl/olm/peers"
+	olmws "github.com/fosrl/olm/websocket"
+	wgdevice "golang.zx2c4.com/wireguard/device"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// The bridge reaches into unexported fields of olm, its DNS proxy, peer
+// monitor and middle device, and of wireguard-go's device. Those fields are
+// not an API: they are read by name and type for the olm version pinned in
+// go.mod (v1.8.0). checkOlmHooks runs before olm is initialized and initOlm
+// refuses to go on when a hook is gone, so an olm bump that renames a field
+// fails at startup instead of leaving a feature that quietly stopped
+// working. olm's own objects are read from a snapshot taken in its
+// callbacks, see captureOlmObjects. Each of these belongs upstream as an
+// exported accessor on olm; a hook is dropped from olmHooks once olm exports
+// what it reads.
+
+// olmHook is an unexported field the bridge reads. The path walks through
+// pointers from owner; typ is the field's type, or nil when only its kind
+// is checked.
+type olmHook struct {
+	owner reflect.Type
+	path  []string
+	typ   reflect.Type
+	kind  reflect.Kind
+	// uses names what stops working without the field
+	uses string
+}
+
+var olmHooks = []olmHook{
+	{owner: reflect.TypeOf(olmpkg.Olm{}), path: []string{"middleDev"}, typ: reflect.TypeOf((*olmdevice.MiddleDevice)(nil)), uses: "packet hooks"},
+	{owner: reflect.TypeOf(olmpkg.Olm{}), path: []string{"dev"}, typ: reflect.TypeOf((*wgdevice.Device)(nil)), uses: "peer stats, PSK and routing"},
+	{owner: reflect.TypeOf(olmpkg.Olm{}), path: []string{"dnsProxy"}, typ: reflect.TypeOf((*olmdns.DNSProxy)(nil)), uses: "DNS settings"},
+	{owner: reflect.TypeOf(olmpkg.Olm{}), path: []string{"websocket"}, typ: reflect.TypeOf((*olmws.Client)(nil)), uses: "offline peers"},
+	{owner: reflect.TypeOf(olmpkg.Olm{}), path: []string{"peerManager"}, typ: reflect.TypeOf((*peers.PeerManager)(nil)), uses: "site routing and probes"},
+	{owner: reflect.TypeOf(olmpkg.Olm{}), path: []string{"holePunchManager"}, typ: reflect.TypeOf((*holepunch.Manager)(nil)), uses: "relay balancing and reconnects"},
+	{owner: reflect.TypeOf(olmpkg.Olm{}), path: []string{"apiServer"}, typ: reflect.TypeOf((*olmapi.API)(nil)), uses: "status reporting"},
+	{owner: reflect.TypeOf(olmpkg.Olm{}), path: []string{"sharedBind"}, typ: reflect.TypeOf((*bind.SharedBind)(nil)), uses: "DSCP marking"},
+	{owner: reflect.TypeOf(olmdns.DNSProxy{}), path: []string{"stack"}, typ: reflect.TypeOf((*stack.Stack)(nil)), uses: "DNS over TCP"},
+	{owner: reflect.TypeOf(olmdevice.MiddleDevice{}), path: []string{"readCh"}, kind: reflect.Chan, uses: "queue depths"},
+	{owner: reflect.TypeOf(olmdevice.MiddleDevice{}), path: []string{"injectCh"}, kind: reflect.Chan, uses: "queue depths"},
+	{owner: reflect.TypeOf(wgdevice.Device{}), path: []string{"queue", "encryption", "c"}, kind: reflect.Chan, uses: "queue depths"},
+	{owner: reflect.TypeOf(wgdevice.Device{}), path: []string{"queue", "decryption", "c"}, kind: reflect.Chan, uses: "queue depths"},
+}
+
+// find returns the hook's field type, or false when the path is gone
+func (h olmHook) find() (reflect.Type, bool) {
+	t := h.owner
+	for _, name := range h.path {
+		for t.Kind() == reflect.Pointer {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct {
+			return nil, false
+		}
+		field, ok := t.FieldByName(name)
+		if !ok {
+			return nil, false
+		}
+		t = field.Type
+	}
+	return t, true
+}
+
+func (h olmHook) String() string {
+	return h.owner.String() + "." + strings.Join(h.path, ".")
+}
+
+// checkOlmHooks logs every hook olm's types no longer have and returns them
+func checkOlmHooks() []string {
+	var missing []string
+	for _, h := range olmHooks {
+		t, ok := h.find()
+		switch {
+		case !ok:
+			appLogger.Warn("olm hook %s not found; %s will not work", h, h.uses)
+		case h.typ != nil && t != h.typ:
+			appLogger.Warn("olm hook %s is a %s, not a %s; %s will not work", h, t, h.typ, h.uses)
+		case h.typ == nil && t.Kind() != h.kind:
+			appLogger.Warn("olm hook %s is a %s, not a %s; %s will not work", h, t, h.kind, h.uses)
+		default:
+			continue
+		}
+		missing = append(missing, h.String())
+	}
+	return missing
+}
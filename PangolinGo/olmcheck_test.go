@@ -0,0 +1,11 @@
+package main
+
+import "testing"
+
+// TestOlmHooks fails when the olm in go.mod no longer has a field the
+// bridge reads, so a version bump cannot drop a hook unnoticed
+func TestOlmHooks(t *testing.T) {
+	if missing := checkOlmHooks(); len(missing) > 0 {
+		t.Errorf("olm hooks not found: %v", missing)
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"net/netip"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/fosrl/newt/network"
+	olmdevice "github.com/fosrl/olm/device"
+	olmpkg "github.com/fosrl/olm/olm"
+	"github.com/fosrl/olm/peers"
+)
+
+const (
+	// packetPathJob samples the packet path while the tunnel runs; the
+	// hooks themselves follow olm's events instead, see requestOlmSync
+	packetPathJob = "packetPath"
+	// packetPathInterval is the sampling interval of an active tunnel on
+	// power; see quietScaledInterval
+	packetPathInterval = time.Second
+)
+
+// packetHook installs filter rules on olm's packet path for the current
+// settings
+type packetHook func(dev *hookDevice, settings network.NetworkSettings)
+
+// hookDevice is olm's MiddleDevice as the hooks see it. Their rules are
+// collected rather than added to olm: olm can only remove every rule for an
+// address, its own included, so the bridge adds one rule per address once
+// and swaps the handlers behind it, see dispatchHookRules.
+type hookDevice struct {
+	dev   *olmdevice.MiddleDevice
+	rules map[netip.Addr][]olmdevice.PacketHandler
+}
+
+// AddRule adds a handler for packets to destIP after the ones added before
+func (d *hookDevice) AddRule(destIP netip.Addr, handler olmdevice.PacketHandler) {
+	d.rules[destIP] = append(d.rules[destIP], handler)
+}
+
+// InjectOutbound hands a packet to WireGuard as if the host had sent it
+func (d *hookDevice) InjectOutbound(packet []byte) {
+	d.dev.InjectOutbound(packet)
+}
+
+// Hook priorities. olm runs the rules for an address in the order they were
+// added and stops at the first one that drops the packet, so filtering has to
+// come before anything that answers or rewrites.
+const (
+	hookPriorityProbe     = 1
+	hookPriorityExposure  = 5
+	hookPriorityExitLAN   = 8
+	hookPriorityFirewall  = 10
+	hookPriorityNAT       = 20
+	hookPriorityResponder = 30
+)
+
+type registeredHook struct {
+	priority int
+	install  packetHook
+}
+
+var (
+	packetHooksMutex sync.Mutex
+	packetHooks      = map[string]registeredHook{}
+	// hooksDirty forces a reinstall on the next check
+	hooksDirty    bool
+	hookedDevice  *olmdevice.MiddleDevice
+	hookedVersion int
+	// hookedAddrs are the addresses hookedDevice has a dispatching rule for
+	hookedAddrs map[netip.Addr]bool
+	// hookRules are the handlers the dispatching rules run, by address
+	hookRules atomic.Pointer[map[netip.Addr][]olmdevice.PacketHandler]
+
+	// olmSyncActive is set while the tunnel runs; requests outside it are
+	// dropped
+	olmSyncActive   atomic.Bool
+	olmSyncRequests = make(chan struct{}, 1)
+	olmSyncOnce     sync.Once
+)
+
+var (
+	olmObjectsMutex sync.RWMutex
+	// olmObjects holds olm's objects the bridge uses, by field name. olm
+	// writes those fields from its own goroutines without a lock, so they
+	// are read once, when olm hands control back, instead of on every use.
+	olmObjects map[string]unsafe.Pointer
+)
+
+// readOlmField reads an unexported pointer field of olm by name and type, or
+// returns nil if an olm upgrade changed either. olm must not be writing its
+// fields at the time: it is called from olm's callbacks, which olm starts
+// after it built what they report, and after olm's stop returned.
+func readOlmField(name string, typ reflect.Type) unsafe.Pointer {
+	if olm == nil {
+		return nil
+	}
+	field := reflect.ValueOf(olm).Elem().FieldByName(name)
+	if !field.IsValid() || field.Type() != typ {
+		return nil
+	}
+	return unsafe.Pointer(field.Pointer())
+}
+
+// captureOlmObjects takes a new snapshot of olm's objects. It runs at init,
+// for the API server olm never replaces, and in olm's connected callback,
+// once olm has built the tunnel.
+func captureOlmObjects() {
+	objects := map[string]unsafe.Pointer{}
+	for _, h := range olmHooks {
+		if h.owner != reflect.TypeOf(olmpkg.Olm{}) || len(h.path) != 1 {
+			continue
+		}
+		if p := readOlmField(h.path[0], h.typ); p != nil {
+			objects[h.path[0]] = p
+		}
+	}
+	olmObjectsMutex.Lock()
+	olmObjects = objects
+	olmObjectsMutex.Unlock()
+}
+
+// dropOlmObjects forgets olm's tunnel objects before olm closes them. The API
+// server is kept.
+func dropOlmObjects() {
+	olmObjectsMutex.Lock()
+	defer olmObjectsMutex.Unlock()
+	objects := map[string]unsafe.Pointer{}
+	if p, ok := olmObjects["apiServer"]; ok {
+		objects["apiServer"] = p
+	}
+	olmObjects = objects
+}
+
+// olmPointerField returns one of olm's objects by field name and type from
+// the last snapshot, or nil while olm has not built it or after an olm
+// upgrade changed the field; the feature relying on it is then simply not
+// available
+func olmPointerField(name string, typ reflect.Type) unsafe.Pointer {
+	olmObjectsMutex.RLock()
+	defer olmObjectsMutex.RUnlock()
+	p := olmObjects[name]
+	if p == nil {
+		return nil
+	}
+	for _, h := range olmHooks {
+		if len(h.path) == 1 && h.path[0] == name && h.typ == typ {
+			return p
+		}
+	}
+	return nil
+}
+
+// olmMiddleDevice returns the MiddleDevice olm routes every packet through,
+// the same filter point olm's own DNS proxy hooks into
+func olmMiddleDevice() *olmdevice.MiddleDevice {
+	return (*olmdevice.MiddleDevice)(olmPointerField("middleDev", reflect.TypeOf((*olmdevice.MiddleDevice)(nil))))
+}
+
+// registerPacketHook adds or replaces a named hook. Hooks are (re)installed
+// in priority order whenever olm creates a new packet path or the network
+// settings change.
+func registerPacketHook(name string, priority int, hook packetHook) {
+	packetHooksMutex.Lock()
+	packetHooks[name] = registeredHook{priority: priority, install: hook}
+	hooksDirty = true
+	packetHooksMutex.Unlock()
+	requestOlmSync()
+}
+
+// unregisterPacketHook removes a named hook; its rules are dropped on the next
+// sync
+func unregisterPacketHook(name string) {
+	packetHooksMutex.Lock()
+	if _, ok := packetHooks[name]; ok {
+		delete(packetHooks, name)
+		hooksDirty = true
+	}
+	packetHooksMutex.Unlock()
+	requestOlmSync()
+}
+
+// syncPacketHooks installs the hooks on olm's current packet path if it or
+// the settings changed since the last install
+func syncPacketHooks() {
+	dev := olmMiddleDevice()
+	version := networkSettingsVersion()
+
+	packetHooksMutex.Lock()
+	defer packetHooksMutex.Unlock()
+
+	if dev == nil {
+		hookedDevice, hookedAddrs = nil, nil
+		hookRules.Store(nil)
+		return
+	}
+	if dev == hookedDevice && version == hookedVersion && !hooksDirty {
+		return
+	}
+
+	if version != hookedVersion {
+		recordEvent(EventSettings, "network settings version %d -> %d", hookedVersion, version)
+	}
+
+	hooks := make([]registeredHook, 0, len(packetHooks))
+	for _, hook := range packetHooks {
+		hooks = append(hooks, hook)
+	}
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].priority < hooks[j].priority })
+
+	settings := effectiveNetworkSettings()
+	hd := &hookDevice{dev: dev, rules: map[netip.Addr][]olmdevice.PacketHandler{}}
+	for _, hook := range hooks {
+		hook.install(hd, settings)
+	}
+	hookRules.Store(&hd.rules)
+
+	if dev != hookedDevice {
+		hookedAddrs = map[netip.Addr]bool{}
+	}
+	for addr := range hd.rules {
+		if !hookedAddrs[addr] {
+			dev.AddRule(addr, dispatchHookRules(addr))
+			hookedAddrs[addr] = true
+		}
+	}
+
+	hookedDevice, hookedVersion, hooksDirty = dev, version, false
+	appLogger.Debug("Installed packet hooks for %d address(es)", len(hd.rules))
+}
+
+// dispatchHookRules is the rule the bridge adds to olm for an address. It
+// runs the hooks' current handlers for it in order and stops at the first
+// that handles the packet; an address no hook uses any more keeps its rule,
+// which then does nothing.
+func dispatchHookRules(addr netip.Addr) olmdevice.PacketHandler {
+	return func(packet []byte) bool {
+		rules := hookRules.Load()
+		if rules == nil {
+			return false
+		}
+		for _, handler := range (*rules)[addr] {
+			if handler(packet) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// requestOlmSync brings the bridge's additions in line with olm's current
+// objects and settings: the packet hooks, the DNS forwarders and the
+// WireGuard peer tweaks. olm has no change notification, so this is called on
+// everything that can change them: olm's registered and connected callbacks,
+// its settings or sites moving (see watchOlmChanges), socket rebinds and the
+// bridge's own setters. It
+// never blocks, so it is safe to call with locks held; requests made while a
+// sync is queued share it.
+func requestOlmSync() {
+	olmSyncOnce.Do(func() { go runOlmSync() })
+	select {
+	case olmSyncRequests <- struct{}{}:
+	default:
+	}
+}
+
+func runOlmSync() {
+	defer dumpOnPanic()
+	for range olmSyncRequests {
+		if olmSyncActive.Load() {
+			superviseSubsystem(SubsystemSync, "olm sync", syncOlmState)
+		}
+	}
+}
+
+// syncOlmState is one sync pass; see requestOlmSync. Each step only acts on
+// what changed since the last pass.
+func syncOlmState() {
+	noteOlmSettingsVersion()
+	syncPacketHooks()
+	syncDNSProxyAddr()
+	syncDNSPrivacy()
+	syncSplitDNS()
+	syncDNSCache()
+	syncMagicDNSTCP()
+	syncUpstreamPaths()
+	syncKeepWarm()
+	syncSelfRecord()
+	syncTrafficShaper()
+	syncDSCPMarking()
+	syncPresharedKeys()
+	syncHopRoutes()
+	syncDomainRoutes()
+	syncSiteResolvers()
+	syncServerSearchDomains()
+	syncExitNodeLAN()
+}
+
+// startPacketHooks keeps the hooks installed while the tunnel runs, and
+// starts sampling the packet path
+func startPacketHooks() {
+	stopPacketHooks()
+
+	olmSyncActive.Store(true)
+	requestOlmSync()
+	startPacketPathSampler()
+}
+
+// startPacketPathSampler samples the data path's activity, DNS latency,
+// first contacts, energy and queue depths, and watches olm for changes. It
+// runs less often on battery
+// and while the tunnel is quiet, and not at all while it is paused.
+func startPacketPathSampler() {
+	scheduleJob(packetPathJob, false, func() time.Duration { return quietScaledInterval(packetPathInterval) }, func(context.Context) {
+		syncDataPathQuiet()
+		syncDNSLatency()
+		syncFirstByte()
+		syncEnergy()
+		syncTunQueues()
+		syncDomainRoutes()
+		watchOlmChanges()
+	})
+}
+
+// stopPacketPathSampler stops the sampling while the tunnel is paused
+func stopPacketPathSampler() {
+	cancelJob(packetPathJob)
+}
+
+// stopPacketHooks stops maintaining the hooks and empties the rules. olm
+// drops them along with its packet path when the tunnel stops.
+func stopPacketHooks() {
+	olmSyncActive.Store(false)
+	stopPacketPathSampler()
+
+	packetHooksMutex.Lock()
+	hookedDevice, hookedAddrs = nil, nil
+	hookRules.Store(nil)
+	packetHooksMutex.Unlock()
+}
+
+// tunnelAddresses returns the client's own tunnel addresses
+func tunnelAddresses(settings network.NetworkSettings) []netip.Addr {
+	var addrs []netip.Addr
+	for _, address := range append(append([]string{}, settings.IPv4Addresses...), settings.IPv6Addresses...) {
+		host, _ := splitCIDR(address)
+		if addr, err := netip.ParseAddr(host); err == nil {
+			addrs = append(addrs, addr.Unmap())
+		}
+	}
+	return addrs
+}
+
+var (
+	olmChangeMutex sync.Mutex
+	// olmChangeSeen is olm's settings version and a hash of its sites as of
+	// the last watchOlmChanges
+	olmChangeSeen struct {
+		version int
+		sites   uint64
+	}
+)
+
+// watchOlmChanges requests a sync when olm's settings or sites moved since
+// it last looked. olm applies control plane messages without telling anyone,
+// so this runs with the packet path sampler and compares what olm exports.
+func watchOlmChanges() {
+	version := olmpkg.GetNetworkSettingsIncrementor()
+	var sites uint64
+	if pm := (*peers.PeerManager)(olmPointerField("peerManager", reflect.TypeOf((*peers.PeerManager)(nil)))); pm != nil {
+		all := pm.GetAllPeers()
+		sort.Slice(all, func(i, j int) bool { return all[i].SiteId < all[j].SiteId })
+		data, err := json.Marshal(all)
+		if err != nil {
+			return
+		}
+		h := fnv.New64a()
+		h.Write(data)
+		sites = h.Sum64()
+	}
+
+	olmChangeMutex.Lock()
+	changed := version != olmChangeSeen.version || sites != olmChangeSeen.sites
+	olmChangeSeen.version, olmChangeSeen.sites = version, sites
+	olmChangeMutex.Unlock()
+	if changed {
+		requestOlmSync()
+	}
+}
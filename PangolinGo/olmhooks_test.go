@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+
+	olmdevice "github.com/fosrl/olm/device"
+)
+
+func TestDispatchHookRules(t *testing.T) {
+	t.Cleanup(func() { hookRules.Store(nil) })
+	addr := netip.MustParseAddr("100.90.0.5")
+
+	var ran []string
+	dev := &hookDevice{rules: map[netip.Addr][]olmdevice.PacketHandler{}}
+	dev.AddRule(addr, func([]byte) bool { ran = append(ran, "rewrite"); return false })
+	dev.AddRule(addr, func([]byte) bool { ran = append(ran, "drop"); return true })
+	dev.AddRule(addr, func([]byte) bool { ran = append(ran, "answer"); return true })
+	hookRules.Store(&dev.rules)
+
+	if !dispatchHookRules(addr)(nil) {
+		t.Error("packet was not handled")
+	}
+	if len(ran) != 2 || ran[0] != "rewrite" || ran[1] != "drop" {
+		t.Errorf("ran %v, want [rewrite drop]", ran)
+	}
+	if dispatchHookRules(netip.MustParseAddr("100.90.0.6"))(nil) {
+		t.Error("packet to an address without handlers was handled")
+	}
+
+	// The rule stays on olm's device after the hooks are gone
+	hookRules.Store(nil)
+	if dispatchHookRules(addr)(nil) {
+		t.Error("packet was handled after the hooks stopped")
+	}
+}
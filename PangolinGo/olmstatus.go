@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	olmapi "github.com/fosrl/olm/api"
+)
+
+// olmStatusTimeout bounds a single status request over the API socket
+const olmStatusTimeout = 2 * time.Second
+
+var (
+	olmSocketPath   string
+	olmStatusClient *http.Client
+	olmStatusMutex  sync.Mutex
+)
+
+// setOlmSocketPath records the API socket olm was initialized with so the
+// bridge can read olm's status the same way the app does
+func setOlmSocketPath(path string) {
+	olmStatusMutex.Lock()
+	defer olmStatusMutex.Unlock()
+
+	olmSocketPath = path
+	olmStatusClient = &http.Client{
+		Timeout: olmStatusTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+	}
+}
+
+// fetchOlmStatus reads olm's status over its API socket. Unlike
+// Olm.GetStatus, the socket handler copies the peer map under olm's status
+// lock, so this is safe to call while peers are being updated.
+func fetchOlmStatus() (*olmapi.StatusResponse, error) {
+	olmStatusMutex.Lock()
+	client := olmStatusClient
+	olmStatusMutex.Unlock()
+
+	if client == nil {
+		return nil, fmt.Errorf("olm API socket is not configured")
+	}
+
+	resp, err := client.Get("http://olm/status")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query olm status: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("olm status returned %d", resp.StatusCode)
+	}
+
+	var status olmapi.StatusResponse
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("failed to decode olm status: %w", err)
+	}
+	return &status, nil
+}
@@ -0,0 +1,12 @@
+package main
+
+// The PacketTunnel target defines goLogToOSLog in GoLoggerBridge.m. This
+// weak definition stands in when the package is linked on its own, as go
+// test does, and drops the message; wherever the target's definition is
+// linked it wins. It lives apart from logger.go because a cgo preamble of a
+// file with //export comments may only declare functions.
+
+/*
+__attribute__((weak)) void goLogToOSLog(const char* subsystem, const char* category, int level, const char* message) {}
+*/
+import "C"
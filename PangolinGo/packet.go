@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/binary"
+	"net/netip"
+)
+
+// IP protocol numbers the bridge looks at
+const (
+	ipProtoICMP   = 1
+	ipProtoTCP    = 6
+	ipProtoUDP    = 17
+	ipProtoICMPv6 = 58
+)
+
+const (
+	ipv4HeaderMinLen = 20
+	ipv6HeaderLen    = 40
+	tcpHeaderMinLen  = 20
+)
+
+// TCP header flags
+const (
+	tcpFlagFIN = 0x01
+	tcpFlagSYN = 0x02
+	tcpFlagRST = 0x04
+	tcpFlagACK = 0x10
+)
+
+// ipPacket is a parsed view of an IPv4 or IPv6 packet. Payload aliases the
+// original buffer.
+type ipPacket struct {
+	Version  int
+	Src      netip.Addr
+	Dst      netip.Addr
+	Protocol int
+	// HeaderLen is the length of the IP header; for IPv6 only the fixed
+	// header is understood and extension headers are left in the payload
+	HeaderLen int
+	Payload   []byte
+}
+
+// parseIPPacket parses the IP header of a raw packet as it travels through
+// olm's packet path (no link-layer or utun prefix)
+func parseIPPacket(packet []byte) (ipPacket, bool) {
+	if len(packet) < 1 {
+		return ipPacket{}, false
+	}
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < ipv4HeaderMinLen {
+			return ipPacket{}, false
+		}
+		headerLen := int(packet[0]&0x0f) * 4
+		totalLen := int(binary.BigEndian.Uint16(packet[2:4]))
+		if headerLen < ipv4HeaderMinLen || totalLen < headerLen || totalLen > len(packet) {
+			return ipPacket{}, false
+		}
+		return ipPacket{
+			Version:   4,
+			Src:       netip.AddrFrom4([4]byte(packet[12:16])),
+			Dst:       netip.AddrFrom4([4]byte(packet[16:20])),
+			Protocol:  int(packet[9]),
+			HeaderLen: headerLen,
+			Payload:   packet[headerLen:totalLen],
+		}, true
+	case 6:
+		if len(packet) < ipv6HeaderLen {
+			return ipPacket{}, false
+		}
+		payloadLen := int(binary.BigEndian.Uint16(packet[4:6]))
+		if ipv6HeaderLen+payloadLen > len(packet) {
+			return ipPacket{}, false
+		}
+		return ipPacket{
+			Version:   6,
+			Src:       netip.AddrFrom16([16]byte(packet[8:24])),
+			Dst:       netip.AddrFrom16([16]byte(packet[24:40])),
+			Protocol:  int(packet[6]),
+			HeaderLen: ipv6HeaderLen,
+			Payload:   packet[ipv6HeaderLen : ipv6HeaderLen+payloadLen],
+		}, true
+	}
+	return ipPacket{}, false
+}
+
+// checksumAdd folds data into a running ones' complement sum
+func checksumAdd(sum uint32, data []byte) uint32 {
+	for len(data) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(data))
+		data = data[2:]
+	}
+	if len(data) == 1 {
+		sum += uint32(data[0]) << 8
+	}
+	return sum
+}
+
+// checksumFinish folds the carries and returns the ones' complement
+func checksumFinish(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+// pseudoHeaderSum is the checksum contribution of the IPv4 or IPv6 pseudo
+// header used by TCP, UDP and ICMPv6
+func pseudoHeaderSum(src, dst netip.Addr, protocol, length int) uint32 {
+	sum := checksumAdd(0, src.AsSlice())
+	sum = checksumAdd(sum, dst.AsSlice())
+	sum += uint32(protocol)
+	sum += uint32(length)
+	return sum
+}
+
+// setIPv4HeaderChecksum recomputes the header checksum of an IPv4 packet
+func setIPv4HeaderChecksum(packet []byte) {
+	headerLen := int(packet[0]&0x0f) * 4
+	packet[10], packet[11] = 0, 0
+	binary.BigEndian.PutUint16(packet[10:12], checksumFinish(checksumAdd(0, packet[:headerLen])))
+}
+
+// checksumUpdate adjusts a checksum for a change from oldData to newData
+// (RFC 1624). Both must have the same even length.
+func checksumUpdate(checksum uint16, oldData, newData []byte) uint16 {
+	sum := uint32(^checksum)
+	for i := 0; i+1 < len(oldData); i += 2 {
+		sum += uint32(^binary.BigEndian.Uint16(oldData[i:]))
+		sum += uint32(binary.BigEndian.Uint16(newData[i:]))
+	}
+	return checksumFinish(sum)
+}
+
+// ipv4IsFirstFragment reports whether the transport header is present, i.e.
+// the packet is unfragmented or the first fragment
+func ipv4IsFirstFragment(packet []byte) bool {
+	return binary.BigEndian.Uint16(packet[6:8])&0x1fff == 0
+}
+
+// rewriteIPv4Addr replaces the source (offset 12) or destination (offset 16)
+// address of an IPv4 packet in place, fixing the IP header checksum and the
+// TCP or UDP checksum that covers it
+func rewriteIPv4Addr(packet []byte, offset int, addr netip.Addr) {
+	newAddr := addr.As4()
+	oldAddr := [4]byte(packet[offset : offset+4])
+
+	binary.BigEndian.PutUint16(packet[10:12], checksumUpdate(binary.BigEndian.Uint16(packet[10:12]), oldAddr[:], newAddr[:]))
+	copy(packet[offset:offset+4], newAddr[:])
+
+	if !ipv4IsFirstFragment(packet) {
+		return
+	}
+	headerLen := int(packet[0]&0x0f) * 4
+	var checksumOffset int
+	switch packet[9] {
+	case ipProtoTCP:
+		checksumOffset = headerLen + 16
+	case ipProtoUDP:
+		checksumOffset = headerLen + 6
+	default:
+		return
+	}
+	if len(packet) < checksumOffset+2 {
+		return
+	}
+	old := binary.BigEndian.Uint16(packet[checksumOffset:])
+	if packet[9] == ipProtoUDP && old == 0 {
+		// UDP over IPv4 may omit the checksum
+		return
+	}
+	binary.BigEndian.PutUint16(packet[checksumOffset:], checksumUpdate(old, oldAddr[:], newAddr[:]))
+}
+
+// setUDPChecksum recomputes the checksum of the UDP datagram in an IPv4
+// packet
+func setUDPChecksum(packet []byte, ip ipPacket) {
+	udp := ip.Payload
+	udp[6], udp[7] = 0, 0
+	sum := checksumFinish(checksumAdd(pseudoHeaderSum(ip.Src, ip.Dst, ipProtoUDP, len(udp)), udp))
+	if sum == 0 {
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(udp[6:8], sum)
+}
+
+// buildIPv4UDP builds an IPv4 UDP datagram with valid checksums
+func buildIPv4UDP(src, dst netip.AddrPort, payload []byte) []byte {
+	packet := make([]byte, ipv4HeaderMinLen+8+len(payload))
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[2:4], uint16(len(packet)))
+	packet[8] = 64
+	packet[9] = ipProtoUDP
+	s, d := src.Addr().As4(), dst.Addr().As4()
+	copy(packet[12:16], s[:])
+	copy(packet[16:20], d[:])
+	udp := packet[ipv4HeaderMinLen:]
+	binary.BigEndian.PutUint16(udp[0:2], src.Port())
+	binary.BigEndian.PutUint16(udp[2:4], dst.Port())
+	binary.BigEndian.PutUint16(udp[4:6], uint16(len(udp)))
+	copy(udp[8:], payload)
+	setIPv4HeaderChecksum(packet)
+	ip, _ := parseIPPacket(packet)
+	setUDPChecksum(packet, ip)
+	return packet
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+)
+
+// testIPv4UDP builds an IPv4 UDP packet with valid checksums
+func testIPv4UDP(src, dst string, payload []byte) []byte {
+	return buildIPv4UDP(netip.AddrPortFrom(netip.MustParseAddr(src), 5353), netip.AddrPortFrom(netip.MustParseAddr(dst), 53), payload)
+}
+
+// testIPv6 builds an IPv6 packet carrying payload
+func testIPv6(src, dst string, protocol int, payload []byte) []byte {
+	packet := make([]byte, ipv6HeaderLen+len(payload))
+	packet[0] = 0x60
+	binary.BigEndian.PutUint16(packet[4:6], uint16(len(payload)))
+	packet[6] = byte(protocol)
+	packet[7] = 64
+	s, d := netip.MustParseAddr(src).As16(), netip.MustParseAddr(dst).As16()
+	copy(packet[8:24], s[:])
+	copy(packet[24:40], d[:])
+	copy(packet[40:], payload)
+	return packet
+}
+
+func TestParseIPPacket(t *testing.T) {
+	v4 := testIPv4UDP("10.0.0.1", "10.0.0.2", []byte("hello"))
+	v6 := testIPv6("fd00::1", "fd00::2", ipProtoTCP, make([]byte, tcpHeaderMinLen))
+
+	tests := []struct {
+		name       string
+		packet     []byte
+		ok         bool
+		version    int
+		src, dst   string
+		protocol   int
+		headerLen  int
+		payloadLen int
+	}{
+		{name: "empty", packet: nil},
+		{name: "unknown version", packet: append([]byte{0x50}, make([]byte, 39)...)},
+		{name: "ipv4", packet: v4, ok: true, version: 4, src: "10.0.0.1", dst: "10.0.0.2", protocol: ipProtoUDP, headerLen: 20, payloadLen: 13},
+		{name: "ipv4 trailing padding", packet: append(append([]byte{}, v4...), 0, 0, 0), ok: true, version: 4, src: "10.0.0.1", dst: "10.0.0.2", protocol: ipProtoUDP, headerLen: 20, payloadLen: 13},
+		{name: "ipv4 short header", packet: v4[:ipv4HeaderMinLen-1]},
+		{name: "ipv4 truncated", packet: v4[:len(v4)-1]},
+		{name: "ipv4 header length below minimum", packet: append([]byte{0x44}, v4[1:]...)},
+		{name: "ipv6", packet: v6, ok: true, version: 6, src: "fd00::1", dst: "fd00::2", protocol: ipProtoTCP, headerLen: 40, payloadLen: tcpHeaderMinLen},
+		{name: "ipv6 short header", packet: v6[:ipv6HeaderLen-1]},
+		{name: "ipv6 truncated", packet: v6[:len(v6)-1]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip, ok := parseIPPacket(tt.packet)
+			if ok != tt.ok {
+				t.Fatalf("ok = %v, want %v", ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			if ip.Version != tt.version || ip.Src != netip.MustParseAddr(tt.src) || ip.Dst != netip.MustParseAddr(tt.dst) ||
+				ip.Protocol != tt.protocol || ip.HeaderLen != tt.headerLen || len(ip.Payload) != tt.payloadLen {
+				t.Errorf("got %+v", ip)
+			}
+		})
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want uint16
+	}{
+		// RFC 1071, section 3
+		{name: "rfc 1071", data: []byte{0x00, 0x01, 0xf2, 0x03, 0xf4, 0xf5, 0xf6, 0xf7}, want: ^uint16(0xddf2)},
+		{name: "odd length pads with zero", data: []byte{0x01, 0x02, 0x03}, want: ^uint16(0x0402)},
+		{name: "empty", data: nil, want: 0xffff},
+		{name: "carry folds twice", data: []byte{0xff, 0xff, 0xff, 0xff, 0x00, 0x02}, want: ^uint16(0x0002)},
+		{name: "ipv4 header", data: []byte{
+			0x45, 0x00, 0x00, 0x73, 0x00, 0x00, 0x40, 0x00, 0x40, 0x11,
+			0x00, 0x00, 0xc0, 0xa8, 0x00, 0x01, 0xc0, 0xa8, 0x00, 0xc7,
+		}, want: 0xb861},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := checksumFinish(checksumAdd(0, tt.data)); got != tt.want {
+				t.Errorf("checksum = %#04x, want %#04x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChecksumUpdate(t *testing.T) {
+	tests := []struct {
+		name     string
+		old, new []byte
+	}{
+		{name: "address", old: []byte{10, 0, 0, 1}, new: []byte{192, 168, 1, 20}},
+		{name: "unchanged", old: []byte{10, 0, 0, 1}, new: []byte{10, 0, 0, 1}},
+		{name: "to zero", old: []byte{0xff, 0xff, 0x12, 0x34}, new: []byte{0, 0, 0, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := []byte{0x45, 0x00, 0x00, 0x1c, 0, 0, 0, 0}
+			data = append(data, tt.old...)
+			checksum := checksumFinish(checksumAdd(0, data))
+			copy(data[8:], tt.new)
+			want := checksumFinish(checksumAdd(0, data))
+			if got := checksumUpdate(checksum, tt.old, tt.new); got != want {
+				t.Errorf("checksumUpdate = %#04x, want %#04x", got, want)
+			}
+		})
+	}
+}
+
+// validIPv4UDP reports whether both checksums of an IPv4 UDP packet hold
+func validIPv4UDP(t *testing.T, packet []byte) bool {
+	t.Helper()
+	ip, ok := parseIPPacket(packet)
+	if !ok {
+		t.Fatal("packet does not parse")
+	}
+	header := checksumFinish(checksumAdd(0, packet[:ip.HeaderLen]))
+	udp := checksumFinish(checksumAdd(pseudoHeaderSum(ip.Src, ip.Dst, ipProtoUDP, len(ip.Payload)), ip.Payload))
+	return header == 0 && udp == 0
+}
+
+func TestRewriteIPv4Addr(t *testing.T) {
+	tests := []struct {
+		name   string
+		offset int
+		addr   string
+	}{
+		{name: "source", offset: 12, addr: "100.64.0.9"},
+		{name: "destination", offset: 16, addr: "192.168.77.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			packet := testIPv4UDP("10.0.0.1", "10.0.0.2", []byte("payload"))
+			if !validIPv4UDP(t, packet) {
+				t.Fatal("test packet has bad checksums")
+			}
+			rewriteIPv4Addr(packet, tt.offset, netip.MustParseAddr(tt.addr))
+			if got := netip.AddrFrom4([4]byte(packet[tt.offset : tt.offset+4])); got != netip.MustParseAddr(tt.addr) {
+				t.Errorf("address = %v, want %v", got, tt.addr)
+			}
+			if !validIPv4UDP(t, packet) {
+				t.Error("checksums do not hold after the rewrite")
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import "C"
+import (
+	"fmt"
+	"sync"
+)
+
+// PathAttributes mirrors the NWPath flags Swift reports for the current
+// underlying network
+type PathAttributes struct {
+	// Expensive is set for cellular and personal hotspot paths
+	Expensive bool `json:"expensive"`
+	// Constrained is set when the user enabled Low Data Mode
+	Constrained bool `json:"constrained"`
+}
+
+var (
+	pathAttributesMutex   sync.RWMutex
+	currentPathAttributes PathAttributes
+)
+
+// pathCostly reports whether optional network work should be skipped to
+// save data on the current path
+func pathCostly() bool {
+	pathAttributesMutex.RLock()
+	defer pathAttributesMutex.RUnlock()
+	return currentPathAttributes.Expensive || currentPathAttributes.Constrained
+}
+
+// setPathAttributes records whether the current path is expensive and/or
+// constrained. Non-zero means set. Optional traffic the bridge originates,
+// such as scheduled maintenance reconnects, is held back while either is set.
+//
+//export setPathAttributes
+func setPathAttributes(expensive C.int, constrained C.int) *C.char {
+	attrs := PathAttributes{
+		Expensive:   expensive != 0,
+		Constrained: constrained != 0,
+	}
+	applyPathAttributes(attrs)
+	return exportString(fmt.Sprintf("Path attributes set: expensive=%t constrained=%t", attrs.Expensive, attrs.Constrained))
+}
+
+// applyPathAttributes records the current path's flags
+func applyPathAttributes(attrs PathAttributes) {
+	pathAttributesMutex.Lock()
+	changed := currentPathAttributes != attrs
+	currentPathAttributes = attrs
+	pathAttributesMutex.Unlock()
+
+	if changed {
+		appLogger.Info("Path attributes changed: expensive=%t constrained=%t", attrs.Expensive, attrs.Constrained)
+	}
+}
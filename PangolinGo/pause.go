@@ -0,0 +1,109 @@
+package main
+
+import "C"
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Pausing is for system sleep. olm's low power mode closes the websocket,
+// which stops its pings, turns off the peers' keepalives and slows its peer
+// and hole punch monitors, so the WireGuard device goes quiet without being
+// torn down; the bridge's ping monitor and packet path sampler stop as well.
+// The device itself is left up because bringing it down releases olm's
+// shared UDP bind. On wake the socket bound before sleep is usually stale, so
+// resuming rebinds it and re-handshakes every site instead of waiting for the
+// pings to time out.
+
+var (
+	pauseMutex sync.Mutex
+	// tunnelPaused is set between pauseTunnel and resumeTunnel
+	tunnelPaused bool
+	pausedAt     time.Time
+)
+
+// resetPause forgets a pause when the tunnel stops
+func resetPause() {
+	pauseMutex.Lock()
+	tunnelPaused, pausedAt = false, time.Time{}
+	pauseMutex.Unlock()
+}
+
+// pauseTunnel quiesces the running tunnel for system sleep
+//
+//export pauseTunnel
+func pauseTunnel() *C.char {
+	tunnelMutex.Lock()
+	running := tunnelRunning
+	tunnelMutex.Unlock()
+
+	if !running {
+		appLogger.Warn("Tunnel is not running")
+		return exportString("Error: Tunnel not running")
+	}
+
+	pauseMutex.Lock()
+	defer pauseMutex.Unlock()
+	if tunnelPaused {
+		return exportString("Tunnel already paused")
+	}
+
+	if err := olm.SetPowerMode("low"); err != nil {
+		appLogger.Error("Failed to pause tunnel: %v", err)
+		return exportString(fmt.Sprintf("Error: %v", err))
+	}
+	peerPingMonitor.stop()
+	stopPacketPathSampler()
+	tunnelPaused, pausedAt = true, time.Now()
+
+	appLogger.Info("Tunnel paused")
+	recordEvent(EventState, "tunnel paused")
+	return exportString("Tunnel paused")
+}
+
+// resumeTunnel wakes a paused tunnel: olm reconnects its websocket and
+// restores keepalives, the UDP socket is rebound and every site
+// re-handshakes
+//
+//export resumeTunnel
+func resumeTunnel() *C.char {
+	tunnelMutex.Lock()
+	running := tunnelRunning
+	tunnelMutex.Unlock()
+
+	if !running {
+		appLogger.Warn("Tunnel is not running")
+		return exportString("Error: Tunnel not running")
+	}
+
+	pauseMutex.Lock()
+	defer pauseMutex.Unlock()
+	if !tunnelPaused {
+		return exportString("Tunnel not paused")
+	}
+
+	// olm waits a few seconds before leaving low power mode, in case the
+	// device goes straight back to sleep
+	if err := olm.SetPowerMode("normal"); err != nil {
+		appLogger.Error("Failed to resume tunnel: %v", err)
+		return exportString(fmt.Sprintf("Error: %v", err))
+	}
+	slept := time.Since(pausedAt).Round(time.Second)
+	tunnelPaused, pausedAt = false, time.Time{}
+	peerPingMonitor.start(peerPingMonitor.parameters())
+	startPacketPathSampler()
+	appLogger.Info("Tunnel resumed after %v", slept)
+	recordEvent(EventState, "tunnel resumed after %v", slept)
+
+	if err := olm.RebindSocket(); err != nil {
+		appLogger.Error("Failed to rebind socket: %v", err)
+		return exportString(fmt.Sprintf("Error: %v", err))
+	}
+	requestOlmSync()
+	if err := rehandshakeAllSites(); err != nil {
+		appLogger.Warn("Failed to re-handshake sites: %v", err)
+		return exportString(fmt.Sprintf("Tunnel resumed; sites not re-handshaken: %v", err))
+	}
+	return exportString("Tunnel resumed")
+}
@@ -0,0 +1,313 @@
+package main
+
+import "C"
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fosrl/newt/network"
+	olmdevice "github.com/fosrl/olm/device"
+	"github.com/fosrl/olm/peers"
+)
+
+// The site's connection tester protocol, as olm's peer monitor speaks it: a
+// magic number, a packet type and a timestamp the site copies into its reply
+const (
+	probeMagic        uint32 = 0xDEADBEEF
+	probeTypeRequest  byte   = 1
+	probeTypeResponse byte   = 2
+	probeHeaderSize          = 13
+)
+
+const (
+	// maxProbePayload keeps a probe within one packet on the tunnel MTU
+	maxProbePayload = 1380
+	maxProbeCount   = 100
+	// probeSpacing paces the probes so they measure the path, not a burst
+	probeSpacing = 20 * time.Millisecond
+	// probeGrace is how long replies are awaited after the last probe
+	probeGrace = 2 * time.Second
+	// Probe sockets take a local port from the top of the dynamic range,
+	// above what the host hands out
+	probePortBase  = 61000
+	probePortCount = 4000
+)
+
+// PeerProbeResult is the JSON returned by probePeer
+type PeerProbeResult struct {
+	SiteID      int     `json:"siteId"`
+	Name        string  `json:"name"`
+	Target      string  `json:"target"`
+	Relayed     bool    `json:"relayed"`
+	PayloadSize int     `json:"payloadSize"`
+	Sent        int     `json:"sent"`
+	Received    int     `json:"received"`
+	LossPercent float64 `json:"lossPercent"`
+	RTTMinMs    float64 `json:"rttMinMs,omitempty"`
+	RTTAvgMs    float64 `json:"rttAvgMs,omitempty"`
+	RTTMaxMs    float64 `json:"rttMaxMs,omitempty"`
+	// ThroughputBps counts the payload bytes the site acknowledged. Sites
+	// reply with the header only, so it measures the direction towards the
+	// site.
+	ThroughputBps float64 `json:"throughputBps"`
+}
+
+// peerProbeHook takes the replies to the bridge's probes off olm's packet
+// path
+const peerProbeHook = "peerProbe"
+
+// probeConn is the bridge's own UDP socket to a site's tester. Its datagrams
+// are injected into olm's packet path from the client's tunnel address, so
+// they take the same WireGuard path as olm's own checks, and the replies are
+// handed over by the probe hook.
+type probeConn struct {
+	dev     *olmdevice.MiddleDevice
+	local   netip.AddrPort
+	remote  netip.AddrPort
+	replies chan []byte
+}
+
+var (
+	probeConnsMutex sync.Mutex
+	// probeConns are the open probe sockets by local port
+	probeConns = map[uint16]*probeConn{}
+)
+
+// installPeerProbe hands UDP for an open probe socket to it. It runs before
+// the other hooks: the packets answer the bridge's own.
+func installPeerProbe(dev *hookDevice, settings network.NetworkSettings) {
+	for _, addr := range tunnelAddresses(settings) {
+		if !addr.Is4() {
+			continue
+		}
+		dev.AddRule(addr, func(packet []byte) bool {
+			ip, ok := parseIPPacket(packet)
+			if !ok || ip.Protocol != ipProtoUDP || len(ip.Payload) < 8 || !ipv4IsFirstFragment(packet) {
+				return false
+			}
+			src := netip.AddrPortFrom(ip.Src, binary.BigEndian.Uint16(ip.Payload[0:2]))
+			probeConnsMutex.Lock()
+			conn := probeConns[binary.BigEndian.Uint16(ip.Payload[2:4])]
+			probeConnsMutex.Unlock()
+			if conn == nil || conn.remote != src {
+				return false
+			}
+			select {
+			case conn.replies <- slices.Clone(ip.Payload[8:]):
+			default:
+			}
+			return true
+		})
+	}
+}
+
+// dialProbe opens a probe socket from the client's IPv4 tunnel address to
+// the site's tester
+func dialProbe(target netip.AddrPort) (*probeConn, error) {
+	dev := olmMiddleDevice()
+	if dev == nil {
+		return nil, fmt.Errorf("tunnel has no packet path yet")
+	}
+	var local netip.Addr
+	for _, addr := range tunnelAddresses(effectiveNetworkSettings()) {
+		if addr.Is4() {
+			local = addr
+			break
+		}
+	}
+	if !local.IsValid() {
+		return nil, fmt.Errorf("tunnel has no IPv4 address")
+	}
+
+	probeConnsMutex.Lock()
+	defer probeConnsMutex.Unlock()
+	for range 16 {
+		port := uint16(probePortBase + rand.IntN(probePortCount))
+		if probeConns[port] != nil {
+			continue
+		}
+		conn := &probeConn{dev: dev, local: netip.AddrPortFrom(local, port), remote: target, replies: make(chan []byte, maxProbeCount)}
+		probeConns[port] = conn
+		return conn, nil
+	}
+	return nil, fmt.Errorf("no free probe port")
+}
+
+// Write sends one datagram to the tester
+func (c *probeConn) Write(payload []byte) {
+	c.dev.InjectOutbound(buildIPv4UDP(c.local, c.remote, payload))
+}
+
+// Close stops taking replies for the socket
+func (c *probeConn) Close() {
+	probeConnsMutex.Lock()
+	if probeConns[c.local.Port()] == c {
+		delete(probeConns, c.local.Port())
+	}
+	probeConnsMutex.Unlock()
+}
+
+// runPeerProbe sends count probes of payloadSize bytes to the site's tester
+// and times the replies
+func runPeerProbe(conn *probeConn, payloadSize, count int) (sent int, rtts []time.Duration, elapsed time.Duration) {
+	var mutex sync.Mutex
+	pending := map[uint64]time.Time{}
+	done := make(chan struct{})
+	allSent := make(chan struct{})
+	var last time.Time
+
+	go func() {
+		defer close(done)
+		sending := allSent
+		var grace <-chan time.Time
+		for {
+			var reply []byte
+			select {
+			case reply = <-conn.replies:
+			case <-sending:
+				sending = nil
+				grace = time.After(probeGrace)
+				continue
+			case <-grace:
+				return
+			}
+			if len(reply) != probeHeaderSize || binary.BigEndian.Uint32(reply) != probeMagic || reply[4] != probeTypeResponse {
+				continue
+			}
+			now := time.Now()
+			mutex.Lock()
+			id := binary.BigEndian.Uint64(reply[5:])
+			if sentAt, ok := pending[id]; ok {
+				delete(pending, id)
+				rtts = append(rtts, now.Sub(sentAt))
+				last = now
+			}
+			finished := sent == count && len(pending) == 0
+			mutex.Unlock()
+			if finished {
+				return
+			}
+		}
+	}()
+
+	start := time.Now()
+	for i := 0; i < count; i++ {
+		packet := make([]byte, payloadSize)
+		binary.BigEndian.PutUint32(packet, probeMagic)
+		packet[4] = probeTypeRequest
+		now := time.Now()
+		id := uint64(now.UnixNano())
+		binary.BigEndian.PutUint64(packet[5:], id)
+		mutex.Lock()
+		pending[id] = now
+		mutex.Unlock()
+		conn.Write(packet)
+		if i < count-1 {
+			time.Sleep(probeSpacing)
+		}
+	}
+	mutex.Lock()
+	sent = count
+	mutex.Unlock()
+	close(allSent)
+
+	<-done
+	mutex.Lock()
+	defer mutex.Unlock()
+	if !last.IsZero() {
+		elapsed = last.Sub(start)
+	}
+	return sent, rtts, elapsed
+}
+
+// probePeer exchanges test packets with one site over its WireGuard path and
+// reports loss, round trip times and throughput as JSON, to tell which site
+// of a mesh is the bad hop. The probes go to the site's connection tester,
+// which answers olm's own health checks.
+//
+//export probePeer
+func probePeer(siteID C.int, payloadSize C.int, count C.int) *C.char {
+	tunnelMutex.Lock()
+	running := tunnelRunning
+	tunnelMutex.Unlock()
+
+	if !running {
+		appLogger.Warn("Tunnel is not running")
+		return exportString("Error: Tunnel not running")
+	}
+	size, n := int(payloadSize), int(count)
+	if size < probeHeaderSize || size > maxProbePayload {
+		return exportString(fmt.Sprintf("Error: Payload size must be between %d and %d", probeHeaderSize, maxProbePayload))
+	}
+	if n < 1 || n > maxProbeCount {
+		return exportString(fmt.Sprintf("Error: Count must be between 1 and %d", maxProbeCount))
+	}
+
+	pm := (*peers.PeerManager)(olmPointerField("peerManager", reflect.TypeOf((*peers.PeerManager)(nil))))
+	if pm == nil {
+		return exportString("Error: Tunnel has no peers yet")
+	}
+	site, ok := pm.GetPeer(int(siteID))
+	if !ok {
+		return exportString(fmt.Sprintf("Error: Site %d not found", int(siteID)))
+	}
+	// The site's tester listens on the port after its WireGuard port
+	addr, err := netip.ParseAddr(strings.Split(site.ServerIP, "/")[0])
+	if err != nil || !addr.Is4() {
+		return exportString(fmt.Sprintf("Error: Site %d has no IPv4 tunnel address", int(siteID)))
+	}
+	target := netip.AddrPortFrom(addr, uint16(site.ServerPort+1))
+
+	conn, err := dialProbe(target)
+	if err != nil {
+		appLogger.Error("Failed to open probe to site %d: %v", int(siteID), err)
+		return exportString(fmt.Sprintf("Error: %v", err))
+	}
+	defer conn.Close()
+
+	appLogger.Info("Probing site %d (%s) at %s with %d x %d bytes", site.SiteId, site.Name, target, n, size)
+	sent, rtts, elapsed := runPeerProbe(conn, size, n)
+
+	result := PeerProbeResult{
+		SiteID:      site.SiteId,
+		Name:        site.Name,
+		Target:      net.JoinHostPort(addr.String(), strconv.Itoa(int(target.Port()))),
+		PayloadSize: size,
+		Sent:        sent,
+		Received:    len(rtts),
+		LossPercent: 100 * float64(sent-len(rtts)) / float64(sent),
+	}
+	_, result.Relayed, _ = pm.GetPeerMonitor().GetConnectionQuality(site.SiteId)
+	if len(rtts) > 0 {
+		var total time.Duration
+		minRTT, maxRTT := rtts[0], rtts[0]
+		for _, rtt := range rtts {
+			total += rtt
+			minRTT, maxRTT = min(minRTT, rtt), max(maxRTT, rtt)
+		}
+		result.RTTMinMs = milliseconds(minRTT)
+		result.RTTAvgMs = milliseconds(total / time.Duration(len(rtts)))
+		result.RTTMaxMs = milliseconds(maxRTT)
+	}
+	if elapsed > 0 {
+		result.ThroughputBps = float64(len(rtts)*size) / elapsed.Seconds()
+	}
+	recordEvent(EventState, "site %d probed: %d/%d replies", site.SiteId, result.Received, sent)
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		appLogger.Error("Failed to marshal probe result: %v", err)
+		return exportString(fmt.Sprintf("Error: %v", err))
+	}
+	return exportString(string(data))
+}
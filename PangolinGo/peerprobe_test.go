@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/fosrl/newt/network"
+	olmdevice "github.com/fosrl/olm/device"
+)
+
+func TestPeerProbeTakesReplies(t *testing.T) {
+	local := netip.MustParseAddrPort("100.90.0.5:61001")
+	tester := netip.MustParseAddrPort("100.90.1.1:51821")
+	conn := &probeConn{local: local, remote: tester, replies: make(chan []byte, 1)}
+	probeConnsMutex.Lock()
+	probeConns[local.Port()] = conn
+	probeConnsMutex.Unlock()
+	t.Cleanup(conn.Close)
+
+	dev := &hookDevice{rules: map[netip.Addr][]olmdevice.PacketHandler{}}
+	installPeerProbe(dev, network.NetworkSettings{IPv4Addresses: []string{"100.90.0.5/32"}})
+	handlers := dev.rules[local.Addr()]
+	if len(handlers) != 1 {
+		t.Fatalf("%d handlers for the tunnel address, want 1", len(handlers))
+	}
+
+	if handlers[0](buildIPv4UDP(netip.MustParseAddrPort("100.90.1.1:53"), local, []byte("dns"))) {
+		t.Error("UDP from another port of the site was taken")
+	}
+	if handlers[0](buildIPv4UDP(tester, netip.AddrPortFrom(local.Addr(), 61002), []byte("other"))) {
+		t.Error("UDP to a port without a probe was taken")
+	}
+	if !handlers[0](buildIPv4UDP(tester, local, []byte("reply"))) {
+		t.Fatal("reply from the tester was not taken")
+	}
+	if got := string(<-conn.replies); got != "reply" {
+		t.Errorf("payload = %q, want %q", got, "reply")
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import "C"
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fosrl/olm/peers"
+	wgdevice "golang.zx2c4.com/wireguard/device"
+)
+
+// handshakeAliveWindow is how old a handshake can be before WireGuard stops
+// using its session (RejectAfterTime), so a peer past it is not carrying
+// traffic until the next handshake
+const handshakeAliveWindow = 180 * time.Second
+
+// PeerStats is one WireGuard peer in getPeerStats
+type PeerStats struct {
+	// SiteID and Name are zero and empty for a peer olm does not know as a
+	// site
+	SiteID    int    `json:"siteId,omitempty"`
+	Name      string `json:"name,omitempty"`
+	PublicKey string `json:"publicKey"`
+	Endpoint  string `json:"endpoint,omitempty"`
+	RxBytes   uint64 `json:"rxBytes"`
+	TxBytes   uint64 `json:"txBytes"`
+	// LastHandshake is unset until the first handshake
+	LastHandshake *time.Time `json:"lastHandshake,omitempty"`
+	// HandshakeAlive is set while the last handshake is recent enough for
+	// WireGuard to use its session
+	HandshakeAlive   bool     `json:"handshakeAlive"`
+	KeepaliveSeconds int      `json:"keepaliveSeconds,omitempty"`
+	AllowedIPs       []string `json:"allowedIps"`
+}
+
+// wireGuardPeerStats reads every peer's counters from dev, with hex
+// public keys, in the order WireGuard lists them
+func wireGuardPeerStats(dev *wgdevice.Device) ([]*PeerStats, error) {
+	config, err := dev.IpcGet()
+	if err != nil {
+		return nil, err
+	}
+
+	var stats []*PeerStats
+	var peer *PeerStats
+	var sec, nsec int64
+	flush := func() {
+		if peer == nil {
+			return
+		}
+		if sec != 0 {
+			at := time.Unix(sec, nsec)
+			peer.LastHandshake = &at
+			peer.HandshakeAlive = time.Since(at) < handshakeAliveWindow
+		}
+		stats = append(stats, peer)
+	}
+	scanner := bufio.NewScanner(strings.NewReader(config))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+		if key == "public_key" {
+			flush()
+			peer, sec, nsec = &PeerStats{PublicKey: value, AllowedIPs: []string{}}, 0, 0
+			continue
+		}
+		if peer == nil {
+			// Interface lines come before the first peer
+			continue
+		}
+		switch key {
+		case "endpoint":
+			peer.Endpoint = value
+		case "rx_bytes":
+			peer.RxBytes, _ = strconv.ParseUint(value, 10, 64)
+		case "tx_bytes":
+			peer.TxBytes, _ = strconv.ParseUint(value, 10, 64)
+		case "last_handshake_time_sec":
+			sec, _ = strconv.ParseInt(value, 10, 64)
+		case "last_handshake_time_nsec":
+			nsec, _ = strconv.ParseInt(value, 10, 64)
+		case "persistent_keepalive_interval":
+			peer.KeepaliveSeconds, _ = strconv.Atoi(value)
+		case "allowed_ip":
+			peer.AllowedIPs = append(peer.AllowedIPs, value)
+		}
+	}
+	flush()
+	return stats, nil
+}
+
+// matchPeerSites fills in the site of every peer olm knows by public key
+func matchPeerSites(stats []*PeerStats) {
+	pm := (*peers.PeerManager)(olmPointerField("peerManager", reflect.TypeOf((*peers.PeerManager)(nil))))
+	if pm == nil {
+		return
+	}
+	sites := map[string]peers.SiteConfig{}
+	for _, site := range pm.GetAllPeers() {
+		if key, err := decodeWireGuardKey(site.PublicKey); err == nil {
+			sites[key] = site
+		}
+	}
+	for _, peer := range stats {
+		if site, ok := sites[peer.PublicKey]; ok {
+			peer.SiteID, peer.Name = site.SiteId, site.Name
+		}
+	}
+}
+
+// getPeerStats returns each WireGuard peer's transfer counters, last
+// handshake, endpoint and keepalive as a JSON array, read from olm's device
+// on every call. Peers are matched to their site by public key, which is
+// given in hex as WireGuard reports it.
+//
+//export getPeerStats
+func getPeerStats() *C.char {
+	dev := (*wgdevice.Device)(olmPointerField("dev", reflect.TypeOf((*wgdevice.Device)(nil))))
+	if dev == nil {
+		return exportString("[]")
+	}
+	stats, err := wireGuardPeerStats(dev)
+	if err != nil {
+		appLogger.Error("Failed to read WireGuard peers: %v", err)
+		return exportString(fmt.Sprintf("Error: Failed to read WireGuard peers: %v", err))
+	}
+
+	matchPeerSites(stats)
+	slices.SortStableFunc(stats, func(a, b *PeerStats) int { return a.SiteID - b.SiteID })
+
+	if stats == nil {
+		stats = []*PeerStats{}
+	}
+	data, err := json.Marshal(stats)
+	if err != nil {
+		appLogger.Error("Failed to marshal peer stats: %v", err)
+		return exportString(fmt.Sprintf("Error: Failed to marshal peer stats: %v", err))
+	}
+	return exportString(string(data))
+}
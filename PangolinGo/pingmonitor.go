@@ -0,0 +1,185 @@
+package main
+
+import "C"
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Defaults mirror the values olm falls back to when none are configured
+const (
+	pingMonitorJob      = "pingMonitor"
+	defaultPingInterval = 3 * time.Second
+	defaultPingTimeout  = 5 * time.Second
+)
+
+// pingMonitor samples olm's peer status every ping interval and marks a peer
+// stale once it has not been seen for longer than the ping timeout. Both
+// values can be changed while the tunnel is running. Sampling slows down
+// while the device is power constrained or the tunnel is idle.
+type pingMonitor struct {
+	mu       sync.Mutex
+	interval time.Duration
+	timeout  time.Duration
+	stale    map[int]bool
+}
+
+var peerPingMonitor = &pingMonitor{
+	interval: defaultPingInterval,
+	timeout:  defaultPingTimeout,
+	stale:    make(map[int]bool),
+}
+
+// normalizePingParameters fills in defaults for unset values
+func normalizePingParameters(interval, timeout time.Duration) (time.Duration, time.Duration) {
+	if interval <= 0 {
+		interval = defaultPingInterval
+	}
+	if timeout <= 0 {
+		timeout = defaultPingTimeout
+	}
+	return interval, timeout
+}
+
+// start begins sampling with the given parameters, replacing any previous run
+func (m *pingMonitor) start(interval, timeout time.Duration) {
+	m.stop()
+
+	interval, timeout = normalizePingParameters(interval, timeout)
+
+	m.mu.Lock()
+	m.interval = interval
+	m.timeout = timeout
+	m.stale = make(map[int]bool)
+	m.mu.Unlock()
+	resetPeerRTTs()
+
+	scheduleJob(pingMonitorJob, false, func() time.Duration {
+		interval, _ := m.parameters()
+		return quietScaledInterval(interval)
+	}, func(context.Context) {
+		m.sample()
+	})
+}
+
+// stop ends sampling; safe to call when not running
+func (m *pingMonitor) stop() {
+	cancelJob(pingMonitorJob)
+}
+
+// setParameters applies new parameters to the running monitor
+func (m *pingMonitor) setParameters(interval, timeout time.Duration) {
+	m.mu.Lock()
+	m.interval = interval
+	m.timeout = timeout
+	m.mu.Unlock()
+
+	m.refresh()
+}
+
+// refresh makes the running monitor pick up its current interval
+func (m *pingMonitor) refresh() {
+	rescheduleJob(pingMonitorJob)
+}
+
+func (m *pingMonitor) parameters() (time.Duration, time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.interval, m.timeout
+}
+
+// sample checks every peer's last-seen time against the ping timeout
+func (m *pingMonitor) sample() {
+	status, err := fetchOlmStatus()
+	if err != nil {
+		appLogger.Debug("Ping monitor could not read olm status: %v", err)
+		return
+	}
+
+	recordPeerRTTs(status.PeerStatuses)
+
+	_, timeout := m.parameters()
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for siteID, peer := range status.PeerStatuses {
+		if peer == nil {
+			continue
+		}
+		stale := !peer.Connected || now.Sub(peer.LastSeen) > timeout
+		if stale != m.stale[siteID] {
+			recordEvent(EventHandshake, "peer %d (%s) connected=%v last seen %v", siteID, peer.Name, peer.Connected, peer.LastSeen.Format(time.RFC3339))
+			if stale {
+				appLogger.Warn("Peer %d (%s) has not answered within %v", siteID, peer.Name, timeout)
+			} else {
+				appLogger.Info("Peer %d (%s) is responding again", siteID, peer.Name)
+			}
+		}
+		m.stale[siteID] = stale
+	}
+
+	for siteID := range m.stale {
+		if _, ok := status.PeerStatuses[siteID]; !ok {
+			delete(m.stale, siteID)
+		}
+	}
+}
+
+// setPingParameters changes the interval and timeout of the bridge's ping
+// monitor on the running tunnel, which decides when a site counts as stale.
+// Both values are in seconds; zero keeps the default. olm's own peer and
+// websocket pings are not affected: olm takes the values in its tunnel
+// config but never reads them, so no reconnect would change them either.
+//
+//export setPingParameters
+func setPingParameters(intervalSeconds C.int, timeoutSeconds C.int) *C.char {
+	if locked := managedLockResult("pingIntervalSeconds", "pingTimeoutSeconds"); locked != nil {
+		return locked
+	}
+	appLogger.Debug("Setting ping parameters")
+
+	tunnelMutex.Lock()
+	running := tunnelRunning
+	tunnelMutex.Unlock()
+
+	if !running {
+		appLogger.Warn("Tunnel is not running")
+		return exportString("Error: Tunnel not running")
+	}
+
+	interval, timeout, err := updatePingParameters(int(intervalSeconds), int(timeoutSeconds))
+	if err != nil {
+		return exportString(fmt.Sprintf("Error: %v", err))
+	}
+	return exportString(fmt.Sprintf("Ping monitor set to interval=%v timeout=%v; olm's own pings are unchanged", interval, timeout))
+}
+
+// updatePingParameters changes the running ping monitor and returns the
+// interval and timeout it uses, after defaults
+func updatePingParameters(intervalSeconds, timeoutSeconds int) (time.Duration, time.Duration, error) {
+	if intervalSeconds < 0 || timeoutSeconds < 0 {
+		return 0, 0, fmt.Errorf("ping interval and timeout must not be negative")
+	}
+
+	interval, timeout := normalizePingParameters(
+		time.Duration(intervalSeconds)*time.Second,
+		time.Duration(timeoutSeconds)*time.Second,
+	)
+	if timeout < interval {
+		return 0, 0, fmt.Errorf("ping timeout (%v) must not be shorter than the interval (%v)", timeout, interval)
+	}
+
+	peerPingMonitor.setParameters(interval, timeout)
+
+	tunnelMutex.Lock()
+	activeTunnelConfig.PingIntervalSeconds = int(interval / time.Second)
+	activeTunnelConfig.PingTimeoutSeconds = int(timeout / time.Second)
+	tunnelMutex.Unlock()
+
+	appLogger.Info("Ping monitor set to interval=%v timeout=%v", interval, timeout)
+	return interval, timeout, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import "C"
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// lowBatteryThreshold is the battery level below which an unplugged
+	// device is treated as power constrained
+	lowBatteryThreshold = 0.2
+	// powerSaveMultiplier stretches bridge timers while power constrained
+	powerSaveMultiplier = 4
+)
+
+// PowerState carries the device power hints Swift reports
+type PowerState struct {
+	LowPowerMode bool `json:"lowPowerMode"`
+	// BatteryLevel is 0.0-1.0, or negative when unknown (e.g. on a Mac
+	// without a battery)
+	BatteryLevel float64 `json:"batteryLevel"`
+	Charging     bool    `json:"charging"`
+}
+
+var (
+	powerStateMutex   sync.RWMutex
+	currentPowerState = PowerState{BatteryLevel: -1}
+)
+
+// constrained reports whether the bridge should save power
+func (s PowerState) constrained() bool {
+	if s.LowPowerMode {
+		return true
+	}
+	return !s.Charging && s.BatteryLevel >= 0 && s.BatteryLevel < lowBatteryThreshold
+}
+
+func powerConstrained() bool {
+	powerStateMutex.RLock()
+	defer powerStateMutex.RUnlock()
+	return currentPowerState.constrained()
+}
+
+// powerScaledInterval stretches a periodic timer's interval while the device
+// is power constrained
+func powerScaledInterval(interval time.Duration) time.Duration {
+	if powerConstrained() {
+		return interval * powerSaveMultiplier
+	}
+	return interval
+}
+
+// setPowerState accepts low-power-mode and battery hints from Swift as JSON.
+// While the device is constrained the bridge's periodic work runs less often
+// and scheduled maintenance is deferred. It does not touch olm's own power
+// mode, which disconnects the control plane and is meant for sleep.
+//
+//export setPowerState
+func setPowerState(stateJSON *C.char) *C.char {
+	appLogger.Debug("Setting power state")
+
+	state := PowerState{BatteryLevel: -1}
+	if err := decodeCompatJSON([]byte(C.GoString(stateJSON)), &state, "power state"); err != nil {
+		appLogger.Error("Failed to parse power state JSON: %v", err)
+		return exportString(fmt.Sprintf("Error: Failed to parse power state JSON: %v", err))
+	}
+	if state.BatteryLevel > 1 {
+		return exportString("Error: Battery level must be between 0 and 1")
+	}
+
+	powerStateMutex.Lock()
+	wasConstrained := currentPowerState.constrained()
+	currentPowerState = state
+	powerStateMutex.Unlock()
+
+	constrained := state.constrained()
+	if constrained != wasConstrained {
+		peerPingMonitor.refresh()
+		if constrained {
+			appLogger.Info("Power constrained, slowing down background work")
+		} else {
+			appLogger.Info("Power no longer constrained, resuming normal schedule")
+		}
+	}
+
+	return exportString(fmt.Sprintf("Power state set: lowPowerMode=%t batteryLevel=%.2f charging=%t",
+		state.LowPowerMode, state.BatteryLevel, state.Charging))
+}
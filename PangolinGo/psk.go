@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	wgdevice "golang.zx2c4.com/wireguard/device"
+)
+
+var (
+	pskMutex sync.Mutex
+	// defaultPSK applies to every peer without its own key; both are hex, as
+	// WireGuard's configuration protocol expects
+	defaultPSK string
+	peerPSKs   map[string]string // peer public key (hex) -> preshared key (hex)
+)
+
+// decodeWireGuardKey converts a base64 WireGuard key to hex
+func decodeWireGuardKey(key string) (string, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(key))
+	if err != nil || len(raw) != wgdevice.NoisePublicKeySize {
+		return "", fmt.Errorf("not a base64 encoded 32 byte key")
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+// setPresharedKeys configures the optional preshared keys, in base64: one
+// for every peer and overrides keyed by peer public key. The peers' side has
+// to be configured with the same key or handshakes will fail.
+func setPresharedKeys(psk string, perPeer map[string]string) error {
+	var defaultHex string
+	if psk != "" {
+		var err error
+		if defaultHex, err = decodeWireGuardKey(psk); err != nil {
+			return fmt.Errorf("presharedKey: %w", err)
+		}
+	}
+
+	peers := make(map[string]string, len(perPeer))
+	for publicKey, key := range perPeer {
+		publicHex, err := decodeWireGuardKey(publicKey)
+		if err != nil {
+			return fmt.Errorf("peer %q: %w", publicKey, err)
+		}
+		keyHex, err := decodeWireGuardKey(key)
+		if err != nil {
+			return fmt.Errorf("preshared key for peer %q: %w", publicKey, err)
+		}
+		peers[publicHex] = keyHex
+	}
+
+	pskMutex.Lock()
+	defaultPSK, peerPSKs = defaultHex, peers
+	pskMutex.Unlock()
+	requestOlmSync()
+
+	if defaultHex != "" || len(peers) > 0 {
+		appLogger.Info("Using preshared keys (%d peer override(s))", len(peers))
+	}
+	return nil
+}
+
+func presharedKeyFor(publicKeyHex string) string {
+	if key, ok := peerPSKs[publicKeyHex]; ok {
+		return key
+	}
+	return defaultPSK
+}
+
+// pskPeer is a WireGuard peer as IpcGet lists it, keeping the lines needed
+// to add it again
+type pskPeer struct {
+	publicKey string
+	psk       string
+	config    []string
+}
+
+// syncPresharedKeys applies the preshared keys to olm's WireGuard peers.
+// olm adds peers without one and its first handshake has already gone out by
+// the time the bridge sees the peer, so a peer missing its key is removed and
+// added again with the key, endpoint, allowed IPs and keepalive in a single
+// IpcSet. The re-added peer starts a fresh handshake with the key in place
+// instead of waiting out the retry of the one that failed. It runs on every
+// olm sync, which follows olm adding a peer.
+func syncPresharedKeys() {
+	pskMutex.Lock()
+	defer pskMutex.Unlock()
+	if defaultPSK == "" && len(peerPSKs) == 0 {
+		return
+	}
+
+	dev := (*wgdevice.Device)(olmPointerField("dev", reflect.TypeOf((*wgdevice.Device)(nil))))
+	if dev == nil {
+		return
+	}
+	config, err := dev.IpcGet()
+	if err != nil {
+		return
+	}
+	update := presharedKeyUpdate(config)
+	if update == "" {
+		return
+	}
+	if err := dev.IpcSet(update); err != nil {
+		appLogger.Warn("Failed to set preshared keys: %v", err)
+		return
+	}
+	appLogger.Debug("Re-added WireGuard peers with their preshared keys")
+}
+
+// presharedKeyUpdate returns the IpcSet that re-adds every peer in config,
+// an IpcGet listing, whose preshared key is not the one it should have.
+// Caller must hold pskMutex.
+func presharedKeyUpdate(config string) string {
+	var update strings.Builder
+	var peer *pskPeer
+	flush := func() {
+		if peer == nil {
+			return
+		}
+		want := presharedKeyFor(peer.publicKey)
+		if want == "" || want == peer.psk {
+			return
+		}
+		fmt.Fprintf(&update, "public_key=%s\nremove=true\n", peer.publicKey)
+		fmt.Fprintf(&update, "public_key=%s\npreshared_key=%s\n", peer.publicKey, want)
+		for _, line := range peer.config {
+			update.WriteString(line + "\n")
+		}
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(config))
+	for scanner.Scan() {
+		line := scanner.Text()
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "public_key":
+			flush()
+			peer = &pskPeer{publicKey: value}
+		case "preshared_key":
+			if peer != nil {
+				peer.psk = value
+			}
+		case "endpoint", "allowed_ip", "persistent_keepalive_interval":
+			if peer != nil {
+				peer.config = append(peer.config, line)
+			}
+		}
+	}
+	flush()
+	return update.String()
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPresharedKeyUpdate(t *testing.T) {
+	key := func(b string) string { return strings.Repeat(b, 64) }
+	config := strings.Join([]string{
+		"private_key=" + key("1"),
+		"public_key=" + key("a"),
+		"preshared_key=" + key("0"),
+		"protocol_version=1",
+		"endpoint=192.0.2.1:51820",
+		"tx_bytes=148",
+		"persistent_keepalive_interval=5",
+		"allowed_ip=100.90.128.1/32",
+		"allowed_ip=10.0.0.0/24",
+		"public_key=" + key("b"),
+		"preshared_key=" + key("c"),
+		"endpoint=192.0.2.2:51820",
+		"public_key=" + key("d"),
+		"preshared_key=" + key("0"),
+		"endpoint=192.0.2.3:51820",
+	}, "\n")
+
+	pskMutex.Lock()
+	defaultPSK, peerPSKs = key("c"), map[string]string{key("d"): key("e")}
+	got := presharedKeyUpdate(config)
+	defaultPSK, peerPSKs = "", nil
+	pskMutex.Unlock()
+
+	want := strings.Join([]string{
+		"public_key=" + key("a"),
+		"remove=true",
+		"public_key=" + key("a"),
+		"preshared_key=" + key("c"),
+		"endpoint=192.0.2.1:51820",
+		"persistent_keepalive_interval=5",
+		"allowed_ip=100.90.128.1/32",
+		"allowed_ip=10.0.0.0/24",
+		"public_key=" + key("d"),
+		"remove=true",
+		"public_key=" + key("d"),
+		"preshared_key=" + key("e"),
+		"endpoint=192.0.2.3:51820",
+	}, "\n") + "\n"
+	if got != want {
+		t.Errorf("update =\n%s\nwant\n%s", got, want)
+	}
+}
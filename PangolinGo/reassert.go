@@ -0,0 +1,191 @@
+package main
+
+import "C"
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/fosrl/olm/peers"
+)
+
+// Reassertion actions
+const (
+	// ReassertRehandshake rebinds the socket and restarts every site's
+	// handshake
+	ReassertRehandshake = "rehandshake"
+	// ReassertRebind only moves the socket to the new path
+	ReassertRebind = "rebind"
+	// ReassertNone leaves the tunnel alone
+	ReassertNone = "none"
+)
+
+// Network transitions Swift reports to reassertNetwork
+const (
+	TransitionInterfaceChanged = "interfaceChanged"
+	TransitionNetworkRestored  = "networkRestored"
+)
+
+// defaultFlapSeconds is the longest outage on the same network that counts
+// as a link flap when the policy does not say
+const defaultFlapSeconds = 10
+
+// ReassertPolicy picks what a network transition does to the tunnel. Every
+// action defaults to a rebind, which is what a transition always did.
+type ReassertPolicy struct {
+	// InterfaceChange applies when the path moved to another interface
+	// type, e.g. from Wi-Fi to cellular
+	InterfaceChange string `json:"interfaceChange"`
+	// NetworkRestored applies when the network came back after an outage
+	NetworkRestored string `json:"networkRestored"`
+	// LinkFlap applies instead of NetworkRestored when the same network
+	// was gone for at most FlapSeconds, e.g. a dock renegotiating its link
+	LinkFlap    string `json:"linkFlap"`
+	FlapSeconds int    `json:"flapSeconds"`
+}
+
+var (
+	reassertMutex  sync.Mutex
+	reassertPolicy ReassertPolicy
+	// reassertNetworkID is the last known network, kept through an outage
+	reassertNetworkID string
+	// networkDownSince is when the network went away, zero while it is up
+	networkDownSince time.Time
+	// lastOutage and lastOutageSameNetwork describe the most recent return
+	lastOutage            time.Duration
+	lastOutageSameNetwork bool
+)
+
+func validReassertAction(action string) bool {
+	switch action {
+	case "", ReassertRehandshake, ReassertRebind, ReassertNone:
+		return true
+	}
+	return false
+}
+
+// setReassertPolicy checks and applies a policy; nil restores the defaults
+func setReassertPolicy(policy *ReassertPolicy) error {
+	p := ReassertPolicy{}
+	if policy != nil {
+		p = *policy
+	}
+	for _, action := range []string{p.InterfaceChange, p.NetworkRestored, p.LinkFlap} {
+		if !validReassertAction(action) {
+			return fmt.Errorf("unknown action %q", action)
+		}
+	}
+	if p.FlapSeconds < 0 {
+		return fmt.Errorf("flapSeconds must not be negative")
+	}
+	if p.FlapSeconds == 0 {
+		p.FlapSeconds = defaultFlapSeconds
+	}
+
+	reassertMutex.Lock()
+	reassertPolicy = p
+	reassertMutex.Unlock()
+	return nil
+}
+
+// noteNetworkChange follows the network identifier Swift reports to time
+// outages. An empty identifier means the network is gone.
+func noteNetworkChange(id string) {
+	reassertMutex.Lock()
+	defer reassertMutex.Unlock()
+	if id == "" {
+		if networkDownSince.IsZero() {
+			networkDownSince = time.Now()
+		}
+		return
+	}
+	if !networkDownSince.IsZero() {
+		lastOutage = time.Since(networkDownSince)
+		lastOutageSameNetwork = id == reassertNetworkID
+		networkDownSince = time.Time{}
+	}
+	reassertNetworkID = id
+}
+
+// reassertAction picks the action for a transition under the current policy
+func reassertAction(transition string) (action, why string) {
+	reassertMutex.Lock()
+	defer reassertMutex.Unlock()
+	p := reassertPolicy
+
+	switch {
+	case transition == TransitionInterfaceChanged:
+		action, why = p.InterfaceChange, "interface changed"
+	case lastOutageSameNetwork && lastOutage <= time.Duration(p.FlapSeconds)*time.Second:
+		action, why = p.LinkFlap, fmt.Sprintf("link flapped for %v", lastOutage.Round(100*time.Millisecond))
+	default:
+		action, why = p.NetworkRestored, "network restored"
+	}
+	if action == "" {
+		action = ReassertRebind
+	}
+	return action, why
+}
+
+// rehandshakeAllSites restarts the handshake with every site
+func rehandshakeAllSites() error {
+	pm := (*peers.PeerManager)(olmPointerField("peerManager", reflect.TypeOf((*peers.PeerManager)(nil))))
+	if pm == nil {
+		return fmt.Errorf("tunnel has no peers yet")
+	}
+	for _, site := range pm.GetAllPeers() {
+		if err := reconnectSite(site.SiteId); err != nil {
+			appLogger.Warn("Failed to re-handshake site %d: %v", site.SiteId, err)
+		}
+	}
+	return nil
+}
+
+// reassertNetwork applies the reassertion policy to a network transition
+// Swift observed: "interfaceChanged" or "networkRestored"
+//
+//export reassertNetwork
+func reassertNetwork(transition *C.char) *C.char {
+	tunnelMutex.Lock()
+	running := tunnelRunning
+	tunnelMutex.Unlock()
+
+	if !running {
+		appLogger.Warn("Tunnel is not running")
+		return exportString("Error: Tunnel not running")
+	}
+
+	message, err := reassertTunnel(C.GoString(transition))
+	if err != nil {
+		return exportString(fmt.Sprintf("Error: %v", err))
+	}
+	return exportString(message)
+}
+
+// reassertTunnel applies the reassertion policy to a transition of the
+// running tunnel. The control plane's websocket is left to olm, which
+// notices a dead connection in its read loop and redials on its own;
+// disconnecting it from here races that redial.
+func reassertTunnel(transition string) (string, error) {
+	action, why := reassertAction(transition)
+	appLogger.Info("Network transition (%s): %s", why, action)
+	recordEvent(EventState, "network transition (%s): %s", why, action)
+
+	if action == ReassertNone {
+		return fmt.Sprintf("Left tunnel alone: %s", why), nil
+	}
+	if err := olm.RebindSocket(); err != nil {
+		appLogger.Error("Failed to rebind socket: %v", err)
+		return "", err
+	}
+	requestOlmSync()
+	if action == ReassertRehandshake {
+		if err := rehandshakeAllSites(); err != nil {
+			appLogger.Error("Failed to re-handshake sites: %v", err)
+			return "", err
+		}
+		return fmt.Sprintf("Socket rebound and sites re-handshaking: %s", why), nil
+	}
+	return fmt.Sprintf("Socket rebound: %s", why), nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import "C"
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/fosrl/newt/holepunch"
+	"github.com/fosrl/olm/peers"
+)
+
+// reconnectSite rebuilds one site's session while the others keep running.
+// Removing the WireGuard peer drops its keys and endpoint, so adding it back
+// starts a fresh handshake, and olm re-tests the direct path and falls back
+// to the relay as it does for a new site. Bridge adjustments such as
+// preshared keys and hop routes are reapplied by the next sync.
+func reconnectSite(siteID int) error {
+	pm := (*peers.PeerManager)(olmPointerField("peerManager", reflect.TypeOf((*peers.PeerManager)(nil))))
+	if pm == nil {
+		return fmt.Errorf("tunnel has no peers yet")
+	}
+	site, ok := pm.GetPeer(siteID)
+	if !ok {
+		return fmt.Errorf("site %d not found", siteID)
+	}
+
+	appLogger.Info("Reconnecting site %d (%s)", siteID, site.Name)
+	recordEvent(EventHandshake, "site %d reconnecting", siteID)
+
+	if err := pm.RemovePeer(siteID); err != nil {
+		return fmt.Errorf("failed to remove site %d: %w", siteID, err)
+	}
+	if err := pm.AddPeer(site); err != nil {
+		return fmt.Errorf("failed to add site %d back: %w", siteID, err)
+	}
+
+	// Punch again right away instead of waiting for the next interval, so
+	// the site's NAT mapping is fresh for the new handshake
+	if hp := (*holepunch.Manager)(olmPointerField("holePunchManager", reflect.TypeOf((*holepunch.Manager)(nil)))); hp != nil {
+		if err := hp.TriggerHolePunch(); err != nil {
+			appLogger.Debug("Failed to trigger hole punch: %v", err)
+		}
+		syncHolepunchInterval(hp)
+	}
+	return nil
+}
+
+// reconnectPeer tears down and re-establishes the session with one site,
+// for when that site alone has become unreachable
+//
+//export reconnectPeer
+func reconnectPeer(siteID C.int) *C.char {
+	tunnelMutex.Lock()
+	running := tunnelRunning
+	tunnelMutex.Unlock()
+
+	if !running {
+		appLogger.Warn("Tunnel is not running")
+		return exportString("Error: Tunnel not running")
+	}
+
+	if err := reconnectSite(int(siteID)); err != nil {
+		appLogger.Error("Failed to reconnect site %d: %v", int(siteID), err)
+		return exportString(fmt.Sprintf("Error: %v", err))
+	}
+	return exportString(fmt.Sprintf("Site %d reconnecting", int(siteID)))
+}
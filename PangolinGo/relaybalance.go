@@ -0,0 +1,328 @@
+package main
+
+import "C"
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/fosrl/newt/holepunch"
+	olmapi "github.com/fosrl/olm/api"
+	"github.com/fosrl/olm/peers"
+)
+
+const (
+	relayBalanceJob      = "relayBalance"
+	relayBalanceInterval = 30 * time.Second
+	// relayFailureCooldown keeps a relay that lost a peer out of rotation
+	relayFailureCooldown = 2 * time.Minute
+	// relaySwitchMargin keeps a site on its relay until another relay's
+	// share is clearly lighter, so sites do not hop back and forth
+	relaySwitchMargin = 1.5
+	// relayRTTWeight is how much a new RTT sample moves a relay's average
+	relayRTTWeight = 0.3
+)
+
+// RelayAssignment is one relayed site in getRelayAssignments
+type RelayAssignment struct {
+	SiteID int    `json:"siteId"`
+	Name   string `json:"name,omitempty"`
+	Relay  string `json:"relay"`
+	// Candidates is how many relays serve the site; with one there is
+	// nothing to balance
+	Candidates int     `json:"candidates"`
+	Weight     int     `json:"weight"`
+	RTTMs      float64 `json:"rttMs,omitempty"`
+	Healthy    bool    `json:"healthy"`
+}
+
+// relayState is what the balancer learned about one relay
+type relayState struct {
+	rtt       time.Duration
+	failedAt  time.Time
+	connected bool
+}
+
+var (
+	relayMutex   sync.Mutex
+	relayWeights map[string]int
+	relayStates  = map[string]*relayState{}
+	// relayOf is the relay each relayed site uses, by exit node endpoint
+	relayOf          = map[int]string{}
+	relayAssignments []RelayAssignment
+)
+
+// setRelayWeights sets how much traffic each relay should take relative to
+// the others, by exit node endpoint. Relays without a weight get 1.
+func setRelayWeights(weights map[string]int) error {
+	for endpoint, weight := range weights {
+		if weight < 0 {
+			return fmt.Errorf("weight of relay %s must not be negative", endpoint)
+		}
+	}
+	relayMutex.Lock()
+	relayWeights = weights
+	relayMutex.Unlock()
+	return nil
+}
+
+// relayWeight returns a relay's weight; zero takes it out of rotation.
+// Caller must hold relayMutex.
+func relayWeight(endpoint string) int {
+	if weight, ok := relayWeights[endpoint]; ok {
+		return weight
+	}
+	return 1
+}
+
+// relayHealthy reports whether a relay may take sites. Caller must hold
+// relayMutex.
+func relayHealthy(endpoint string, now time.Time) bool {
+	state := relayStates[endpoint]
+	return state == nil || now.Sub(state.failedAt) >= relayFailureCooldown
+}
+
+// relayMatches reports whether olm's peer endpoint is the given exit node
+func relayMatches(peerEndpoint string, node holepunch.ExitNode) bool {
+	host, _, err := net.SplitHostPort(node.Endpoint)
+	if err != nil {
+		host = node.Endpoint
+	}
+	if peerEndpoint == host || peerEndpoint == node.Endpoint {
+		return true
+	}
+	peerHost, _, err := net.SplitHostPort(peerEndpoint)
+	return err == nil && peerHost == host
+}
+
+// resolveRelayHost returns the address RelayPeer expects for an exit node
+func resolveRelayHost(ctx context.Context, endpoint string) (string, error) {
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		host = endpoint
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return addr.String(), nil
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return "", err
+	}
+	if len(addrs) == 0 {
+		return "", fmt.Errorf("no addresses for %s", host)
+	}
+	return addrs[0].Unmap().String(), nil
+}
+
+// observeRelays updates the relays' RTT and health from olm's peer status
+// and returns the relay each relayed site is on. Caller must hold
+// relayMutex.
+func observeRelays(status *olmapi.StatusResponse, nodes []holepunch.ExitNode, now time.Time) map[int]string {
+	current := map[int]string{}
+	for siteID, peer := range status.PeerStatuses {
+		if peer == nil || !peer.IsRelay {
+			continue
+		}
+		endpoint := relayOf[siteID]
+		if endpoint == "" {
+			for _, node := range nodes {
+				if relayMatches(peer.Endpoint, node) {
+					endpoint = node.Endpoint
+					break
+				}
+			}
+		}
+		if endpoint == "" {
+			continue
+		}
+		current[siteID] = endpoint
+
+		state := relayStates[endpoint]
+		if state == nil {
+			state = &relayState{}
+			relayStates[endpoint] = state
+		}
+		if !peer.Connected {
+			if state.connected || state.failedAt.IsZero() {
+				appLogger.Warn("Relay %s lost site %d, moving its sites elsewhere", endpoint, siteID)
+				recordEvent(EventHandshake, "relay %s failed", endpoint)
+			}
+			state.failedAt = now
+			state.connected = false
+			continue
+		}
+		state.connected = true
+		if peer.RTT > 0 {
+			if state.rtt == 0 {
+				state.rtt = peer.RTT
+			} else {
+				state.rtt += time.Duration(relayRTTWeight * float64(peer.RTT-state.rtt))
+			}
+		}
+	}
+	return current
+}
+
+// balanceRelays spreads the relayed sites over the relays that serve them,
+// in proportion to the relays' weights, and moves sites off relays that
+// failed. Relays the server did not say serve a site are never used for it.
+// Sites are moved unless the control plane turns FeatureRelaySelection off;
+// then olm's choice stands and is reported.
+func balanceRelays(ctx context.Context) {
+	hp := (*holepunch.Manager)(olmPointerField("holePunchManager", reflect.TypeOf((*holepunch.Manager)(nil))))
+	pm := (*peers.PeerManager)(olmPointerField("peerManager", reflect.TypeOf((*peers.PeerManager)(nil))))
+	if hp == nil || pm == nil {
+		return
+	}
+	nodes := hp.GetExitNodes()
+	if len(nodes) == 0 {
+		return
+	}
+	status, err := fetchOlmStatus()
+	if err != nil {
+		appLogger.Debug("Relay balancer could not read olm status: %v", err)
+		return
+	}
+
+	type move struct {
+		siteID int
+		node   holepunch.ExitNode
+	}
+	var moves []move
+	now := time.Now()
+	selection := featureEnabled(FeatureRelaySelection)
+
+	relayMutex.Lock()
+	current := observeRelays(status, nodes, now)
+	sites := make([]int, 0, len(current))
+	for siteID := range current {
+		sites = append(sites, siteID)
+	}
+	slices.Sort(sites)
+
+	// Greedily give each site the relay with the lightest share, keeping
+	// it where it is unless that relay failed or is clearly heavier
+	load := map[string]int{}
+	share := func(endpoint string) float64 {
+		return float64(load[endpoint]+1) / float64(relayWeight(endpoint))
+	}
+	rtt := func(endpoint string) time.Duration {
+		if state := relayStates[endpoint]; state != nil {
+			return state.rtt
+		}
+		return 0
+	}
+	assignments := make([]RelayAssignment, 0, len(sites))
+	for _, siteID := range sites {
+		var candidates []holepunch.ExitNode
+		for _, node := range nodes {
+			if slices.Contains(node.SiteIds, siteID) && relayWeight(node.Endpoint) > 0 && relayHealthy(node.Endpoint, now) {
+				candidates = append(candidates, node)
+			}
+		}
+
+		chosen := current[siteID]
+		if len(candidates) > 0 {
+			best := candidates[0]
+			for _, node := range candidates[1:] {
+				// Equal shares go to the faster relay
+				if share(node.Endpoint) < share(best.Endpoint) ||
+					(share(node.Endpoint) == share(best.Endpoint) && rtt(node.Endpoint) < rtt(best.Endpoint)) {
+					best = node
+				}
+			}
+			stay := slices.ContainsFunc(candidates, func(node holepunch.ExitNode) bool { return node.Endpoint == chosen }) &&
+				share(chosen) <= share(best.Endpoint)*relaySwitchMargin
+			if !stay && selection {
+				chosen = best.Endpoint
+				moves = append(moves, move{siteID, best})
+			}
+		}
+		load[chosen]++
+		relayOf[siteID] = chosen
+
+		assignment := RelayAssignment{
+			SiteID:     siteID,
+			Relay:      chosen,
+			Candidates: len(candidates),
+			Weight:     relayWeight(chosen),
+			Healthy:    relayHealthy(chosen, now),
+		}
+		if peer := status.PeerStatuses[siteID]; peer != nil {
+			assignment.Name = peer.Name
+		}
+		assignment.RTTMs = float64(rtt(chosen).Microseconds()) / 1000
+		assignments = append(assignments, assignment)
+	}
+	for siteID := range relayOf {
+		if _, ok := current[siteID]; !ok {
+			delete(relayOf, siteID)
+		}
+	}
+	relayAssignments = assignments
+	relayMutex.Unlock()
+
+	api := (*olmapi.API)(olmPointerField("apiServer", reflect.TypeOf((*olmapi.API)(nil))))
+	for _, m := range moves {
+		if ctx.Err() != nil {
+			return
+		}
+		host, err := resolveRelayHost(ctx, m.node.Endpoint)
+		if err != nil {
+			appLogger.Warn("Failed to resolve relay %s: %v", m.node.Endpoint, err)
+			continue
+		}
+		appLogger.Info("Moving site %d to relay %s", m.siteID, m.node.Endpoint)
+		recordEvent(EventHandshake, "site %d relayed through %s", m.siteID, m.node.Endpoint)
+		pm.RelayPeer(m.siteID, host, m.node.RelayPort)
+		if api != nil {
+			// Keeps the relay in olm's peer status, which the app shows
+			api.UpdatePeerRelayStatus(m.siteID, host, true)
+		}
+	}
+}
+
+// startRelayBalancer begins balancing relayed sites while the tunnel runs
+func startRelayBalancer() {
+	stopRelayBalancer()
+	scheduleJob(relayBalanceJob, false, func() time.Duration {
+		return quietScaledInterval(relayBalanceInterval)
+	}, balanceRelays)
+}
+
+// stopRelayBalancer stops balancing and forgets what it learned
+func stopRelayBalancer() {
+	cancelJob(relayBalanceJob)
+
+	relayMutex.Lock()
+	relayStates = map[string]*relayState{}
+	relayOf = map[int]string{}
+	relayAssignments = nil
+	relayMutex.Unlock()
+}
+
+// getRelayAssignments returns which relay each relayed site uses, with the
+// relay's weight and round-trip time, as JSON
+//
+//export getRelayAssignments
+func getRelayAssignments() *C.char {
+	relayMutex.Lock()
+	assignments := slices.Clone(relayAssignments)
+	relayMutex.Unlock()
+
+	if assignments == nil {
+		assignments = []RelayAssignment{}
+	}
+	data, err := json.Marshal(assignments)
+	if err != nil {
+		appLogger.Error("Failed to marshal relay assignments: %v", err)
+		return exportString("[]")
+	}
+	return exportString(string(data))
+}
@@ -0,0 +1,298 @@
+package main
+
+import "C"
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"sync"
+
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// Fragmentation policies for packets larger than a route's MTU
+const (
+	// RouteFragmentSignal drops the packet and tells the sender its path MTU
+	// with ICMP, so it sends smaller packets from then on
+	RouteFragmentSignal = "signal"
+	// RouteFragmentAllow clears the don't-fragment bit of IPv4 packets so the
+	// constrained hop can fragment them. IPv6 is never fragmented on the way
+	// and is signalled instead.
+	RouteFragmentAllow = "allow"
+)
+
+const (
+	minRouteMTUv4 = 576
+	minRouteMTUv6 = 1280
+
+	icmpDestUnreachable   = 3
+	icmpFragNeeded        = 4
+	icmpv6PacketTooBig    = 2
+	tcpOptionMSS          = 2
+	ipv4FlagDontFragment  = 0x40
+	icmpv6PacketTooBigMax = minRouteMTUv6 - ipv6HeaderLen - 8
+)
+
+// RouteMTU holds traffic to a subnet to a smaller MTU than the tunnel's, for
+// a path that adds its own encapsulation further on, e.g. a site behind a
+// second tunnel. The rest of the tunnel keeps its MTU.
+type RouteMTU struct {
+	CIDR string `json:"cidr"`
+	MTU  int    `json:"mtu"`
+	// Fragment is RouteFragmentSignal (the default) or RouteFragmentAllow
+	Fragment string `json:"fragment"`
+}
+
+type routeMTU struct {
+	prefix        netip.Prefix
+	mtu           int
+	allowFragment bool
+}
+
+var (
+	routeMTUMutex sync.RWMutex
+	routeMTUs     []routeMTU
+)
+
+// parseRouteMTUs validates the per-route MTUs
+func parseRouteMTUs(routes []RouteMTU) ([]routeMTU, error) {
+	var parsed []routeMTU
+	for _, route := range routes {
+		prefix, err := netip.ParsePrefix(route.CIDR)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subnet %q: %w", route.CIDR, err)
+		}
+		prefix = prefix.Masked()
+
+		minMTU := minRouteMTUv4
+		if prefix.Addr().Is6() {
+			minMTU = minRouteMTUv6
+		}
+		if route.MTU < minMTU || route.MTU > 65535 {
+			return nil, fmt.Errorf("MTU %d for %s must be between %d and 65535", route.MTU, prefix, minMTU)
+		}
+
+		var allowFragment bool
+		switch route.Fragment {
+		case "", RouteFragmentSignal:
+		case RouteFragmentAllow:
+			allowFragment = true
+		default:
+			return nil, fmt.Errorf("invalid fragment policy %q for %s", route.Fragment, prefix)
+		}
+
+		for _, other := range parsed {
+			if other.prefix == prefix {
+				return nil, fmt.Errorf("subnet %s is listed more than once", prefix)
+			}
+		}
+		parsed = append(parsed, routeMTU{prefix: prefix, mtu: route.MTU, allowFragment: allowFragment})
+	}
+	return parsed, nil
+}
+
+// setRouteMTUOverrides replaces the per-route MTUs. Enforcing them needs to
+// see every packet, so the tunnel device is wrapped once any are set.
+func setRouteMTUOverrides(routes []RouteMTU) error {
+	parsed, err := parseRouteMTUs(routes)
+	if err != nil {
+		return err
+	}
+
+	routeMTUMutex.Lock()
+	routeMTUs = parsed
+	routeMTUMutex.Unlock()
+
+	if len(parsed) > 0 {
+		wrapTunnelDevice()
+		appLogger.Info("Using a smaller MTU for %d routes", len(parsed))
+	}
+	return nil
+}
+
+// routeMTUFor returns the most specific override covering addr
+func routeMTUFor(addr netip.Addr) (routeMTU, bool) {
+	routeMTUMutex.RLock()
+	defer routeMTUMutex.RUnlock()
+
+	var best routeMTU
+	found := false
+	for _, route := range routeMTUs {
+		if route.prefix.Contains(addr) && (!found || route.prefix.Bits() > best.prefix.Bits()) {
+			best, found = route, true
+		}
+	}
+	return best, found
+}
+
+// tcpMSSFor is the largest TCP segment that fits in mtu
+func tcpMSSFor(version, mtu int) int {
+	if version == 4 {
+		return mtu - ipv4HeaderMinLen - tcpHeaderMinLen
+	}
+	return mtu - ipv6HeaderLen - tcpHeaderMinLen
+}
+
+// clampTCPMSS lowers the MSS option of a TCP SYN to mss, fixing the TCP
+// checksum
+func clampTCPMSS(packet []byte, ip ipPacket, mss int) {
+	if ip.Protocol != ipProtoTCP || (ip.Version == 4 && !ipv4IsFirstFragment(packet)) {
+		return
+	}
+	tcp := ip.Payload
+	if len(tcp) < tcpHeaderMinLen || tcp[13]&tcpFlagSYN == 0 {
+		return
+	}
+	headerLen := int(tcp[12]>>4) * 4
+	if headerLen < tcpHeaderMinLen || headerLen > len(tcp) {
+		return
+	}
+
+	for i := tcpHeaderMinLen; i < headerLen; {
+		kind := tcp[i]
+		if kind == 0 {
+			return
+		}
+		if kind == 1 {
+			i++
+			continue
+		}
+		if i+1 >= headerLen || tcp[i+1] < 2 {
+			return
+		}
+		length := int(tcp[i+1])
+		if kind == tcpOptionMSS && length == 4 && i+4 <= headerLen {
+			if int(binary.BigEndian.Uint16(tcp[i+2:])) <= mss {
+				return
+			}
+			// The checksum update works on 16-bit words, and the option is
+			// not necessarily aligned to one
+			start := (i + 2) &^ 1
+			end := start + 2
+			if (i+2)%2 != 0 {
+				end = start + 4
+			}
+			old := append([]byte(nil), tcp[start:end]...)
+			binary.BigEndian.PutUint16(tcp[i+2:], uint16(mss))
+			binary.BigEndian.PutUint16(tcp[16:18], checksumUpdate(binary.BigEndian.Uint16(tcp[16:18]), old, tcp[start:end]))
+			return
+		}
+		i += length
+	}
+}
+
+// packetTooBig builds the ICMP error that tells the sender of packet to use
+// at most mtu for its destination
+func packetTooBig(packet []byte, ip ipPacket, mtu int) []byte {
+	if ip.Version == 4 {
+		quoted := packet[:min(len(packet), ip.HeaderLen+8)]
+		reply := make([]byte, ipv4HeaderMinLen+8+len(quoted))
+		reply[0] = 0x45
+		binary.BigEndian.PutUint16(reply[2:4], uint16(len(reply)))
+		reply[8] = 64 // TTL
+		reply[9] = ipProtoICMP
+		copy(reply[12:16], packet[16:20])
+		copy(reply[16:20], packet[12:16])
+		setIPv4HeaderChecksum(reply)
+
+		icmp := reply[ipv4HeaderMinLen:]
+		icmp[0], icmp[1] = icmpDestUnreachable, icmpFragNeeded
+		binary.BigEndian.PutUint16(icmp[6:8], uint16(mtu))
+		copy(icmp[8:], quoted)
+		binary.BigEndian.PutUint16(icmp[2:4], checksumFinish(checksumAdd(0, icmp)))
+		return reply
+	}
+
+	quoted := packet[:min(len(packet), icmpv6PacketTooBigMax)]
+	reply := make([]byte, ipv6HeaderLen+8+len(quoted))
+	reply[0] = 0x60
+	binary.BigEndian.PutUint16(reply[4:6], uint16(8+len(quoted)))
+	reply[6] = ipProtoICMPv6
+	reply[7] = 64 // hop limit
+	copy(reply[8:24], packet[24:40])
+	copy(reply[24:40], packet[8:24])
+
+	icmp := reply[ipv6HeaderLen:]
+	icmp[0] = icmpv6PacketTooBig
+	binary.BigEndian.PutUint32(icmp[4:8], uint32(mtu))
+	copy(icmp[8:], quoted)
+	sum := pseudoHeaderSum(ip.Dst, ip.Src, ipProtoICMPv6, len(icmp))
+	binary.BigEndian.PutUint16(icmp[2:4], checksumFinish(checksumAdd(sum, icmp)))
+	return reply
+}
+
+// applyRouteMTUOutbound holds a packet leaving this device to its route's
+// MTU. It returns false when the packet has to be dropped, after answering
+// the sender through dev.
+func applyRouteMTUOutbound(dev tun.Device, packet []byte, offset int) bool {
+	ip, ok := parseIPPacket(packet)
+	if !ok {
+		return true
+	}
+	route, ok := routeMTUFor(ip.Dst)
+	if !ok {
+		return true
+	}
+
+	clampTCPMSS(packet, ip, tcpMSSFor(ip.Version, route.mtu))
+	if len(packet) <= route.mtu {
+		return true
+	}
+
+	if ip.Version == 4 && packet[6]&ipv4FlagDontFragment == 0 {
+		return true
+	}
+	if ip.Version == 4 && route.allowFragment {
+		packet[6] &^= ipv4FlagDontFragment
+		setIPv4HeaderChecksum(packet)
+		return true
+	}
+
+	if err := writeToHost(dev, packetTooBig(packet, ip, route.mtu), offset); err != nil {
+		appLogger.Debug("Failed to signal the MTU for %s: %v", ip.Dst, err)
+	}
+	return false
+}
+
+// applyRouteMTUInbound clamps the MSS a host behind a constrained route
+// offers, so this device's segments to it fit
+func applyRouteMTUInbound(packet []byte) {
+	ip, ok := parseIPPacket(packet)
+	if !ok {
+		return
+	}
+	if route, ok := routeMTUFor(ip.Src); ok {
+		clampTCPMSS(packet, ip, tcpMSSFor(ip.Version, route.mtu))
+	}
+}
+
+// setRouteMTUs replaces the per-route MTUs at runtime. Takes a JSON array of
+// {"cidr", "mtu", "fragment"} objects; an empty array removes them all.
+//
+//export setRouteMTUs
+func setRouteMTUs(routesJSON *C.char) *C.char {
+	if locked := managedLockResult("routeMtus"); locked != nil {
+		return locked
+	}
+	var routes []RouteMTU
+	if err := decodeCompatJSON([]byte(C.GoString(routesJSON)), &routes, "route MTUs"); err != nil {
+		appLogger.Error("Failed to parse route MTUs: %v", err)
+		return exportString(fmt.Sprintf("Error: Failed to parse route MTUs: %v", err))
+	}
+	if err := updateRouteMTUs(routes); err != nil {
+		appLogger.Error("Invalid route MTUs: %v", err)
+		return exportString(fmt.Sprintf("Error: Invalid route MTUs: %v", err))
+	}
+	return exportString("Route MTUs updated")
+}
+
+// updateRouteMTUs replaces the running tunnel's per-route MTUs
+func updateRouteMTUs(routes []RouteMTU) error {
+	if err := setRouteMTUOverrides(routes); err != nil {
+		return err
+	}
+	tunnelMutex.Lock()
+	activeTunnelConfig.RouteMTUs = routes
+	tunnelMutex.Unlock()
+	return nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import "C"
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+
+	"github.com/fosrl/newt/network"
+)
+
+// routeOverridesFile holds the CIDRs the user has disabled on this client
+const routeOverridesFile = "route-overrides.json"
+
+// EffectiveRoute describes one server-pushed route and whether the client
+// currently installs it
+type EffectiveRoute struct {
+	CIDR      string `json:"cidr"`
+	Family    string `json:"family"` // "ipv4" or "ipv6"
+	Included  bool   `json:"included"`
+	Enabled   bool   `json:"enabled"`
+	IsDefault bool   `json:"isDefault,omitempty"`
+}
+
+// EffectiveRoutesResponse is the JSON returned by getEffectiveRoutes
+type EffectiveRoutesResponse struct {
+	Routes []EffectiveRoute `json:"routes"`
+	// DisabledCIDRs lists every override, including ones for routes the
+	// server is not currently pushing
+	DisabledCIDRs []string `json:"disabledCidrs"`
+}
+
+var (
+	disabledRoutes      = map[string]bool{}
+	disabledRoutesMutex sync.RWMutex
+)
+
+// normalizeCIDR parses a CIDR and returns it in canonical masked form
+func normalizeCIDR(cidr string) (string, error) {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return "", err
+	}
+	return prefix.Masked().String(), nil
+}
+
+// ipv4RouteCIDR converts an IPv4 route from olm into CIDR notation
+func ipv4RouteCIDR(route network.IPv4Route) string {
+	if route.IsDefault {
+		return "0.0.0.0/0"
+	}
+	bits := 32
+	if route.SubnetMask != "" {
+		if mask := net.ParseIP(route.SubnetMask).To4(); mask != nil {
+			bits, _ = net.IPMask(mask).Size()
+		}
+	}
+	cidr, err := normalizeCIDR(fmt.Sprintf("%s/%d", route.DestinationAddress, bits))
+	if err != nil {
+		return route.DestinationAddress
+	}
+	return cidr
+}
+
+// ipv6RouteCIDR converts an IPv6 route from olm into CIDR notation
+func ipv6RouteCIDR(route network.IPv6Route) string {
+	if route.IsDefault {
+		return "::/0"
+	}
+	bits := route.NetworkPrefixLength
+	if bits == 0 {
+		bits = 128
+	}
+	cidr, err := normalizeCIDR(fmt.Sprintf("%s/%d", route.DestinationAddress, bits))
+	if err != nil {
+		return route.DestinationAddress
+	}
+	return cidr
+}
+
+func routeDisabled(cidr string) bool {
+	disabledRoutesMutex.RLock()
+	defer disabledRoutesMutex.RUnlock()
+	return disabledRoutes[cidr]
+}
+
+// applyRouteOverrides drops included routes the user has disabled
+func applyRouteOverrides(settings network.NetworkSettings) network.NetworkSettings {
+	var v4 []network.IPv4Route
+	for _, route := range settings.IPv4IncludedRoutes {
+		if !routeDisabled(ipv4RouteCIDR(route)) {
+			v4 = append(v4, route)
+		}
+	}
+	settings.IPv4IncludedRoutes = v4
+
+	var v6 []network.IPv6Route
+	for _, route := range settings.IPv6IncludedRoutes {
+		if !routeDisabled(ipv6RouteCIDR(route)) {
+			v6 = append(v6, route)
+		}
+	}
+	settings.IPv6IncludedRoutes = v6
+
+	return settings
+}
+
+// loadRouteOverrides restores persisted route overrides from the state directory
+func loadRouteOverrides() {
+	data, err := readStateFile(routeOverridesFile)
+	if err != nil {
+		appLogger.Error("Failed to read route overrides: %v", err)
+		return
+	}
+	if data == nil {
+		return
+	}
+
+	var cidrs []string
+	if err := json.Unmarshal(data, &cidrs); err != nil {
+		appLogger.Error("Failed to parse route overrides: %v", err)
+		return
+	}
+
+	disabledRoutesMutex.Lock()
+	disabledRoutes = make(map[string]bool, len(cidrs))
+	for _, cidr := range cidrs {
+		disabledRoutes[cidr] = true
+	}
+	disabledRoutesMutex.Unlock()
+
+	appLogger.Info("Loaded %d disabled route(s)", len(cidrs))
+}
+
+// disabledRouteList returns the disabled CIDRs in sorted order
+func disabledRouteList() []string {
+	disabledRoutesMutex.RLock()
+	defer disabledRoutesMutex.RUnlock()
+	cidrs := make([]string, 0, len(disabledRoutes))
+	for cidr := range disabledRoutes {
+		cidrs = append(cidrs, cidr)
+	}
+	sort.Strings(cidrs)
+	return cidrs
+}
+
+func saveRouteOverrides() {
+	data, err := json.Marshal(disabledRouteList())
+	if err != nil {
+		appLogger.Error("Failed to marshal route overrides: %v", err)
+		return
+	}
+	if err := writeStateFile(routeOverridesFile, data); err != nil {
+		appLogger.Error("Failed to persist route overrides: %v", err)
+	}
+}
+
+// setRouteEnabled enables or disables a server-pushed route on this client.
+// enabled is 0 to drop the route and non-zero to restore it. The override is
+// persisted and survives reconnects until it is cleared.
+//
+//export setRouteEnabled
+func setRouteEnabled(cidr *C.char, enabled C.int) *C.char {
+	normalized, err := normalizeCIDR(C.GoString(cidr))
+	if err != nil {
+		appLogger.Error("Invalid route CIDR: %v", err)
+		return exportString(fmt.Sprintf("Error: Invalid CIDR: %v", err))
+	}
+
+	disabledRoutesMutex.Lock()
+	changed := disabledRoutes[normalized] == (enabled != 0)
+	if enabled != 0 {
+		delete(disabledRoutes, normalized)
+	} else {
+		disabledRoutes[normalized] = true
+	}
+	disabledRoutesMutex.Unlock()
+
+	if !changed {
+		return exportString(fmt.Sprintf("Route %s unchanged", normalized))
+	}
+
+	saveRouteOverrides()
+	bumpSettingsVersion()
+
+	if enabled != 0 {
+		appLogger.Info("Route %s enabled", normalized)
+		return exportString(fmt.Sprintf("Route %s enabled", normalized))
+	}
+	appLogger.Info("Route %s disabled", normalized)
+	return exportString(fmt.Sprintf("Route %s disabled", normalized))
+}
+
+// getEffectiveRoutes returns every route olm has published along with whether
+// the client installs it, as a JSON string
+//
+//export getEffectiveRoutes
+func getEffectiveRoutes() *C.char {
+	settings := network.GetSettings()
+	resp := EffectiveRoutesResponse{
+		Routes:        []EffectiveRoute{},
+		DisabledCIDRs: disabledRouteList(),
+	}
+
+	addV4 := func(routes []network.IPv4Route, included bool) {
+		for _, route := range routes {
+			cidr := ipv4RouteCIDR(route)
+			resp.Routes = append(resp.Routes, EffectiveRoute{
+				CIDR:      cidr,
+				Family:    "ipv4",
+				Included:  included,
+				Enabled:   !included || !routeDisabled(cidr),
+				IsDefault: route.IsDefault,
+			})
+		}
+	}
+	addV6 := func(routes []network.IPv6Route, included bool) {
+		for _, route := range routes {
+			cidr := ipv6RouteCIDR(route)
+			resp.Routes = append(resp.Routes, EffectiveRoute{
+				CIDR:      cidr,
+				Family:    "ipv6",
+				Included:  included,
+				Enabled:   !included || !routeDisabled(cidr),
+				IsDefault: route.IsDefault,
+			})
+		}
+	}
+	addV4(settings.IPv4IncludedRoutes, true)
+	addV4(settings.IPv4ExcludedRoutes, false)
+	addV6(settings.IPv6IncludedRoutes, true)
+	addV6(settings.IPv6ExcludedRoutes, false)
+
+	data, err := json.Marshal(resp)
+	if err != nil {
+		appLogger.Error("Failed to marshal effective routes: %v", err)
+		return exportString("{}")
+	}
+	return exportString(string(data))
+}
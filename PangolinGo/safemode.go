@@ -0,0 +1,247 @@
+package main
+
+import "C"
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/fosrl/newt/network"
+)
+
+const (
+	// safeModeFile keeps the failure count across extension launches, since
+	// the system relaunches the extension for every attempt
+	safeModeFile = "safemode.json"
+	// safeModeThreshold consecutive failed starts put the next start in
+	// safe mode
+	safeModeThreshold = 3
+	// establishTimeout is how long a start has to connect before it counts
+	// as failed
+	establishTimeout = 90 * time.Second
+	establishJob     = "establishTimeout"
+)
+
+// SafeModeStatus is the JSON returned by getSafeModeStatus
+type SafeModeStatus struct {
+	// Active is set while the running tunnel was started in safe mode
+	Active              bool      `json:"active"`
+	ConsecutiveFailures int       `json:"consecutiveFailures"`
+	LastFailure         string    `json:"lastFailure,omitempty"`
+	LastFailureAt       time.Time `json:"lastFailureAt,omitempty"`
+	EnteredAt           time.Time `json:"enteredAt,omitempty"`
+}
+
+var (
+	safeModeMutex  sync.Mutex
+	safeModeStatus SafeModeStatus
+	// establishing is set from a start until it connects or its failure is
+	// counted, so one attempt never counts twice
+	establishing bool
+	// safeModeLogLevel is the level to go back to when safe mode ends
+	safeModeLogLevel LogLevel
+)
+
+// loadSafeMode restores the failure count from earlier launches
+func loadSafeMode() {
+	data, err := readStateFile(safeModeFile)
+	if err != nil || data == nil {
+		return
+	}
+
+	var saved SafeModeStatus
+	if err := json.Unmarshal(data, &saved); err != nil {
+		appLogger.Debug("Ignoring unreadable safe mode state: %v", err)
+		return
+	}
+
+	safeModeMutex.Lock()
+	safeModeStatus.ConsecutiveFailures = saved.ConsecutiveFailures
+	safeModeStatus.LastFailure = saved.LastFailure
+	safeModeStatus.LastFailureAt = saved.LastFailureAt
+	safeModeMutex.Unlock()
+}
+
+func saveSafeModeLocked() {
+	data, err := json.Marshal(SafeModeStatus{
+		ConsecutiveFailures: safeModeStatus.ConsecutiveFailures,
+		LastFailure:         safeModeStatus.LastFailure,
+		LastFailureAt:       safeModeStatus.LastFailureAt,
+	})
+	if err != nil {
+		appLogger.Error("Failed to marshal safe mode state: %v", err)
+		return
+	}
+	if err := writeStateFile(safeModeFile, data); err != nil {
+		appLogger.Debug("Failed to write safe mode state: %v", err)
+	}
+}
+
+// safeModeConfig strips a config down to what is needed to reach the sites:
+// no DNS override, no bridge-side routes and no resumed state, any of which
+// may be what keeps the tunnel from coming up
+func safeModeConfig(config StartTunnelConfig) StartTunnelConfig {
+	off := false
+	config.DNSOverrideScope = DNSScopeNever
+	config.OverrideDNS = false
+	config.TunnelDNS = false
+	config.DNSProfiles = nil
+	config.DNSPrivacy = nil
+	config.DNSRoutes = nil
+	config.NATMappings = nil
+	config.RouteVia = nil
+	config.RouteMTUs = nil
+	config.ExitNodeLANAccess = &off
+	config.InboundExposure = nil
+	config.ResumeState = nil
+	return config
+}
+
+// beginEstablish starts timing a tunnel start and switches it to safe mode
+// after repeated failures. It returns the config to start with.
+func beginEstablish(config StartTunnelConfig) (StartTunnelConfig, bool) {
+	safeModeMutex.Lock()
+	establishing = true
+	safe := safeModeStatus.ConsecutiveFailures >= safeModeThreshold
+	failures := safeModeStatus.ConsecutiveFailures
+	if safe && !safeModeStatus.Active {
+		safeModeStatus.Active = true
+		safeModeStatus.EnteredAt = time.Now()
+		safeModeLogLevel = appLogger.GetLevel()
+	}
+	safeModeMutex.Unlock()
+
+	scheduleJob(establishJob, false, func() time.Duration { return establishTimeout }, func(context.Context) {
+		noteEstablishFailure(fmt.Sprintf("not connected within %v", establishTimeout))
+	})
+
+	if !safe {
+		return config, false
+	}
+	appLogger.SetLevel(LogLevelDebug)
+	InitOLMLogger()
+	appLogger.Warn("Tunnel failed to come up %d times in a row, starting in safe mode", failures)
+	recordEvent(EventState, "safe mode on after %d failed starts", failures)
+	setSnapshotSafeMode(true)
+	return safeModeConfig(config), true
+}
+
+// noteEstablishFailure counts the current start as failed
+func noteEstablishFailure(reason string) {
+	cancelJob(establishJob)
+
+	safeModeMutex.Lock()
+	defer safeModeMutex.Unlock()
+	if !establishing {
+		return
+	}
+	establishing = false
+	safeModeStatus.ConsecutiveFailures++
+	safeModeStatus.LastFailure = reason
+	safeModeStatus.LastFailureAt = time.Now()
+	saveSafeModeLocked()
+
+	appLogger.Warn("Tunnel start failed (%d in a row): %s", safeModeStatus.ConsecutiveFailures, reason)
+	recordEvent(EventState, "tunnel start failed: %s", reason)
+}
+
+// noteTunnelEstablished resets the failure count once a start connects
+func noteTunnelEstablished() {
+	cancelJob(establishJob)
+
+	safeModeMutex.Lock()
+	defer safeModeMutex.Unlock()
+	if !establishing {
+		return
+	}
+	establishing = false
+	if safeModeStatus.ConsecutiveFailures > 0 {
+		safeModeStatus.ConsecutiveFailures = 0
+		saveSafeModeLocked()
+	}
+	if safeModeStatus.Active {
+		appLogger.Info("Connected in safe mode; the next start uses the full configuration again")
+	}
+}
+
+// endSafeMode stops timing the start without counting it and restores the
+// log level. A stop before connecting is the user's, not a failure.
+func endSafeMode() {
+	cancelJob(establishJob)
+
+	safeModeMutex.Lock()
+	establishing = false
+	active := safeModeStatus.Active
+	safeModeStatus.Active = false
+	safeModeStatus.EnteredAt = time.Time{}
+	level := safeModeLogLevel
+	safeModeMutex.Unlock()
+
+	if active {
+		appLogger.SetLevel(level)
+		InitOLMLogger()
+		recordEvent(EventState, "safe mode off")
+		setSnapshotSafeMode(false)
+	}
+}
+
+func safeModeActive() bool {
+	safeModeMutex.Lock()
+	defer safeModeMutex.Unlock()
+	return safeModeStatus.Active
+}
+
+// applySafeModeRoutes drops default routes in safe mode, so only the sites'
+// resources go through the tunnel and everything else keeps working locally
+func applySafeModeRoutes(settings network.NetworkSettings) network.NetworkSettings {
+	if !safeModeActive() {
+		return settings
+	}
+	var v4 []network.IPv4Route
+	for _, route := range settings.IPv4IncludedRoutes {
+		if ipv4RouteCIDR(route) != "0.0.0.0/0" {
+			v4 = append(v4, route)
+		}
+	}
+	var v6 []network.IPv6Route
+	for _, route := range settings.IPv6IncludedRoutes {
+		if ipv6RouteCIDR(route) != "::/0" {
+			v6 = append(v6, route)
+		}
+	}
+	settings.IPv4IncludedRoutes, settings.IPv6IncludedRoutes = v4, v6
+	return settings
+}
+
+// getSafeModeStatus returns whether the tunnel runs in safe mode and the
+// failed starts that led there, as JSON
+//
+//export getSafeModeStatus
+func getSafeModeStatus() *C.char {
+	safeModeMutex.Lock()
+	status := safeModeStatus
+	safeModeMutex.Unlock()
+
+	data, err := json.Marshal(status)
+	if err != nil {
+		appLogger.Error("Failed to marshal safe mode status: %v", err)
+		return exportString(`{"active":false}`)
+	}
+	return exportString(string(data))
+}
+
+// resetSafeMode forgets the failed starts, e.g. after the user changed the
+// configuration. A tunnel running in safe mode stays so until it restarts.
+//
+//export resetSafeMode
+func resetSafeMode() *C.char {
+	safeModeMutex.Lock()
+	safeModeStatus.ConsecutiveFailures = 0
+	safeModeStatus.LastFailure = ""
+	safeModeStatus.LastFailureAt = time.Time{}
+	saveSafeModeLocked()
+	safeModeMutex.Unlock()
+	return exportString("Safe mode reset")
+}
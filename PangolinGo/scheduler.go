@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// schedulerCoalesceWindow pulls jobs due shortly after a wakeup forward
+	// into it, so they share the wakeup instead of taking their own
+	schedulerCoalesceWindow = time.Second
+	// schedulerJitter spreads each job's interval by up to this fraction
+	// either way, so clients do not act in lockstep
+	schedulerJitter = 0.1
+	// jobPollInterval is how often waitForCancelledJobs checks on runs
+	jobPollInterval = 10 * time.Millisecond
+)
+
+// scheduledJob is one periodic task of the shared scheduler
+type scheduledJob struct {
+	name string
+	// subsystem contains panics of a supervised job; see supervisedJobs
+	subsystem string
+	interval  func() time.Duration
+	run       func(ctx context.Context)
+	ctx       context.Context
+	cancel    context.CancelFunc
+	lastRun   time.Time
+	next      time.Time
+	running   bool
+	// deferredSince is when the CPU budget first put off the due run
+	deferredSince time.Time
+}
+
+var (
+	schedulerMutex sync.Mutex
+	scheduledJobs  = map[string]*scheduledJob{}
+	// runningJobs are the jobs with a run in progress, including cancelled
+	// ones no longer in scheduledJobs
+	runningJobs   = map[*scheduledJob]struct{}{}
+	schedulerWake = make(chan struct{}, 1)
+	schedulerOnce sync.Once
+)
+
+func jittered(interval time.Duration) time.Duration {
+	spread := float64(interval) * schedulerJitter
+	return interval + time.Duration((rand.Float64()*2-1)*spread)
+}
+
+func wakeScheduler() {
+	select {
+	case schedulerWake <- struct{}{}:
+	default:
+	}
+}
+
+// scheduleJob runs run every interval() on the shared scheduler, replacing
+// any job with the same name. The interval is read again before every run,
+// so it can follow power and idle state; background mode stretches every
+// job's interval on top. With immediate set the first run
+// happens right away instead of after one interval. Runs of one job never
+// overlap; a run still going when the next is due skips that turn.
+func scheduleJob(name string, immediate bool, interval func() time.Duration, run func(ctx context.Context)) {
+	schedulerOnce.Do(func() { go runScheduler() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &scheduledJob{name: name, subsystem: supervisedJobs[name], interval: interval, run: run, ctx: ctx, cancel: cancel, lastRun: time.Now()}
+	job.next = job.lastRun.Add(jittered(job.scaledInterval()))
+	if immediate {
+		job.next = job.lastRun
+	}
+
+	schedulerMutex.Lock()
+	if old := scheduledJobs[name]; old != nil {
+		old.cancel()
+	}
+	scheduledJobs[name] = job
+	schedulerMutex.Unlock()
+
+	wakeScheduler()
+}
+
+// cancelJob removes a job and cancels a run in progress without waiting
+// for it. It reports whether the job was scheduled.
+func cancelJob(name string) bool {
+	schedulerMutex.Lock()
+	job := scheduledJobs[name]
+	delete(scheduledJobs, name)
+	schedulerMutex.Unlock()
+
+	if job == nil {
+		return false
+	}
+	job.cancel()
+	return true
+}
+
+// rescheduleJob recomputes when a job next runs, for a job whose interval
+// changed
+func rescheduleJob(name string) {
+	schedulerMutex.Lock()
+	if job := scheduledJobs[name]; job != nil {
+		job.next = job.lastRun.Add(jittered(job.scaledInterval()))
+	}
+	schedulerMutex.Unlock()
+
+	wakeScheduler()
+}
+
+// rescheduleAllJobs recomputes when every job next runs, after a change that
+// affects all intervals
+func rescheduleAllJobs() {
+	schedulerMutex.Lock()
+	for _, job := range scheduledJobs {
+		job.next = job.lastRun.Add(jittered(job.scaledInterval()))
+	}
+	schedulerMutex.Unlock()
+
+	wakeScheduler()
+}
+
+// scaledInterval is the job's interval as the scheduler applies it
+func (job *scheduledJob) scaledInterval() time.Duration {
+	return backgroundScaledInterval(job.interval())
+}
+
+// jobDue reports whether a job next due at next runs on a wakeup at now.
+// Jobs due within the window are pulled forward only into a wakeup that
+// runs a job that is actually due, so batching never wakes the process by
+// itself.
+func jobDue(next, now time.Time, window time.Duration, batching bool) bool {
+	if !next.After(now) {
+		return true
+	}
+	return batching && !next.After(now.Add(window))
+}
+
+// anyJobDue reports whether a job that is not already running is due at
+// now. Caller must hold schedulerMutex.
+func anyJobDue(now time.Time) bool {
+	for _, job := range scheduledJobs {
+		if !job.running && !job.next.After(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// runScheduler is the one timer behind every periodic job. Each wakeup runs
+// every job that is due, and those about to be along with them, then sleeps
+// until the next one. In background mode "about to be" reaches much further
+// ahead.
+func runScheduler() {
+	defer dumpOnPanic()
+
+	timer := time.NewTimer(time.Hour)
+	for {
+		select {
+		case <-timer.C:
+		case <-schedulerWake:
+		}
+
+		now := time.Now()
+		window := schedulerWindow()
+		ran := 0
+		var next time.Time
+		schedulerMutex.Lock()
+		batching := anyJobDue(now)
+		for _, job := range scheduledJobs {
+			due := jobDue(job.next, now, window, batching)
+			if due && !job.running {
+				// An auxiliary job waits for the CPU budget to refill
+				if wait := cpuBudgetDeferral(job.name, now, job.deferredSince); wait > 0 {
+					if job.deferredSince.IsZero() {
+						job.deferredSince = now
+					}
+					job.next = now.Add(wait)
+					due = false
+				}
+			}
+			if due {
+				job.deferredSince = time.Time{}
+				job.lastRun = now
+				job.next = now.Add(jittered(job.scaledInterval()))
+				if !job.running {
+					job.running = true
+					runningJobs[job] = struct{}{}
+					ran++
+					go runJob(job)
+				}
+			}
+			if next.IsZero() || job.next.Before(next) {
+				next = job.next
+			}
+		}
+		schedulerMutex.Unlock()
+		noteSchedulerWakeup(ran)
+		noteEnergyWakeup(ran)
+
+		wait := time.Hour
+		if !next.IsZero() {
+			wait = max(time.Until(next), 0)
+		}
+		timer.Reset(wait)
+	}
+}
+
+func runJob(job *scheduledJob) {
+	defer dumpOnPanic()
+	defer func() {
+		schedulerMutex.Lock()
+		job.running = false
+		delete(runningJobs, job)
+		schedulerMutex.Unlock()
+	}()
+	if job.subsystem != "" {
+		// The job runs again on its next turn
+		defer recoverSubsystem(job.subsystem, job.name)
+	}
+
+	if job.ctx.Err() == nil {
+		measureJobCPU(job.name, func() { job.run(job.ctx) })
+	}
+}
+
+// cancelledJobsRunning returns the jobs cancelled in the middle of a run
+// that have not returned yet, leaving out except
+func cancelledJobsRunning(except string) []string {
+	schedulerMutex.Lock()
+	defer schedulerMutex.Unlock()
+	names := []string{}
+	for job := range runningJobs {
+		if job.ctx.Err() != nil && job.name != except {
+			names = append(names, job.name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// waitForCancelledJobs waits until every cancelled run but except has
+// returned or the deadline passes, and returns those still running
+func waitForCancelledJobs(deadline time.Time, except string) []string {
+	for {
+		names := cancelledJobsRunning(except)
+		if len(names) == 0 || !time.Now().Before(deadline) {
+			return names
+		}
+		time.Sleep(min(jobPollInterval, time.Until(deadline)))
+	}
+}
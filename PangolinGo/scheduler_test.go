@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJobDue(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		next     time.Time
+		window   time.Duration
+		batching bool
+		want     bool
+	}{
+		{name: "overdue", next: now.Add(-time.Second), window: time.Second, want: true},
+		{name: "due now", next: now, window: time.Second, want: true},
+		{name: "within window without batching", next: now.Add(500 * time.Millisecond), window: time.Second, want: false},
+		{name: "within window with batching", next: now.Add(500 * time.Millisecond), window: time.Second, batching: true, want: true},
+		{name: "window edge", next: now.Add(time.Second), window: time.Second, batching: true, want: true},
+		{name: "beyond window", next: now.Add(2 * time.Second), window: time.Second, batching: true, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := jobDue(tt.next, now, tt.window, tt.batching); got != tt.want {
+				t.Errorf("jobDue = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAnyJobDue(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name string
+		jobs []*scheduledJob
+		want bool
+	}{
+		{name: "no jobs", want: false},
+		{name: "none due", jobs: []*scheduledJob{{name: "a", next: now.Add(time.Second)}}, want: false},
+		{name: "one due", jobs: []*scheduledJob{{name: "a", next: now.Add(time.Second)}, {name: "b", next: now}}, want: true},
+		{name: "due but running", jobs: []*scheduledJob{{name: "a", next: now.Add(-time.Second), running: true}}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schedulerMutex.Lock()
+			saved := scheduledJobs
+			scheduledJobs = map[string]*scheduledJob{}
+			for _, job := range tt.jobs {
+				scheduledJobs[job.name] = job
+			}
+			got := anyJobDue(now)
+			scheduledJobs = saved
+			schedulerMutex.Unlock()
+
+			if got != tt.want {
+				t.Errorf("anyJobDue = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
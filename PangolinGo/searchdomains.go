@@ -0,0 +1,140 @@
+package main
+
+import "C"
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/fosrl/olm/peers"
+	"github.com/miekg/dns"
+)
+
+// Search domains complete single-label names, so "ssh host" reaches
+// host.internal.example.com. They go out in NEDNSSettings.searchDomains.
+// The server sends the organization's domains as the alias names of its
+// sites; the domain each alias sits in becomes a search domain. Swift can
+// add its own through setSearchDomains, which are tried first. newt's
+// NetworkSettings has no field for them, so they are kept here and added
+// where the settings are turned into Swift's; where an expanded name is
+// resolved is still up to the match domains.
+
+var (
+	searchDomainsMutex sync.Mutex
+	// userSearchDomains are set by Swift, serverSearchDomains come from
+	// the sites' aliases
+	userSearchDomains   []string
+	serverSearchDomains []string
+)
+
+// normalizeSearchDomains puts domains in lower case without trailing dot,
+// dropping invalid ones and repeats but keeping the order, which is the
+// order they are tried in
+func normalizeSearchDomains(domains []string) []string {
+	var out []string
+	for _, domain := range domains {
+		domain = strings.ToLower(strings.Trim(strings.TrimSpace(domain), "."))
+		if _, ok := dns.IsDomainName(domain); !ok || domain == "" {
+			appLogger.Warn("Skipping invalid search domain %q", domain)
+			continue
+		}
+		if !slices.Contains(out, domain) {
+			out = append(out, domain)
+		}
+	}
+	return out
+}
+
+// SetSearchDomains replaces the search domains set by Swift and republishes
+// the network settings when they changed
+func SetSearchDomains(domains []string) {
+	normalized := normalizeSearchDomains(domains)
+	searchDomainsMutex.Lock()
+	changed := !slices.Equal(normalized, userSearchDomains)
+	userSearchDomains = normalized
+	searchDomainsMutex.Unlock()
+	if !changed {
+		return
+	}
+	appLogger.Info("Set search domains: %v", normalized)
+	recordEvent(EventDNS, "search domains %v", normalized)
+	bumpSettingsVersion()
+}
+
+// aliasSearchDomains returns the domains the sites' aliases sit in, by site
+// ID and then in the order the server lists the aliases
+func aliasSearchDomains(sites []peers.SiteConfig) []string {
+	sites = slices.Clone(sites)
+	slices.SortFunc(sites, func(a, b peers.SiteConfig) int { return cmp.Compare(a.SiteId, b.SiteId) })
+	var domains []string
+	for _, site := range sites {
+		for _, alias := range site.Aliases {
+			name := strings.Trim(strings.TrimSpace(alias.Alias), ".")
+			if _, parent, ok := strings.Cut(name, "."); ok && parent != "" {
+				domains = append(domains, parent)
+			}
+		}
+	}
+	return normalizeSearchDomains(domains)
+}
+
+// syncServerSearchDomains follows the sites olm has, republishing the
+// network settings when their domains changed
+func syncServerSearchDomains() {
+	pm := (*peers.PeerManager)(olmPointerField("peerManager", reflect.TypeOf((*peers.PeerManager)(nil))))
+	if pm == nil {
+		return
+	}
+	domains := aliasSearchDomains(pm.GetAllPeers())
+	searchDomainsMutex.Lock()
+	changed := !slices.Equal(domains, serverSearchDomains)
+	serverSearchDomains = domains
+	searchDomainsMutex.Unlock()
+	if !changed {
+		return
+	}
+	appLogger.Info("Search domains from the server: %v", domains)
+	recordEvent(EventDNS, "server search domains %v", domains)
+	bumpSettingsVersion()
+}
+
+// currentSearchDomains returns the search domains in the order they are
+// tried: Swift's, then the server's
+func currentSearchDomains() []string {
+	searchDomainsMutex.Lock()
+	defer searchDomainsMutex.Unlock()
+	domains := slices.Clone(userSearchDomains)
+	for _, domain := range serverSearchDomains {
+		if !slices.Contains(domains, domain) {
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+// resetSearchDomains forgets the search domains when the tunnel stops
+func resetSearchDomains() {
+	searchDomainsMutex.Lock()
+	userSearchDomains = nil
+	serverSearchDomains = nil
+	searchDomainsMutex.Unlock()
+}
+
+// setSearchDomains replaces the search domains Swift adds to the server's.
+// domainsJSON is a JSON array of domain names, tried in order. The
+// network settings are republished when they changed.
+//
+//export setSearchDomains
+func setSearchDomains(domainsJSON *C.char) *C.char {
+	var domains []string
+	if err := json.Unmarshal([]byte(C.GoString(domainsJSON)), &domains); err != nil {
+		appLogger.Error("Failed to parse search domains JSON: %v", err)
+		return exportString(fmt.Sprintf("Error: Failed to parse search domains JSON: %v", err))
+	}
+	SetSearchDomains(domains)
+	return exportString("Search domains updated")
+}
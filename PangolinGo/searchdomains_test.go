@@ -0,0 +1,53 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/fosrl/olm/peers"
+)
+
+func TestNormalizeSearchDomains(t *testing.T) {
+	tests := []struct {
+		name    string
+		domains []string
+		want    []string
+	}{
+		{name: "none", domains: nil, want: nil},
+		{name: "lower case without dots", domains: []string{" Corp.Example.COM. ", ".lab.example"}, want: []string{"corp.example.com", "lab.example"}},
+		{name: "repeats dropped in order", domains: []string{"b.example", "a.example", "B.example."}, want: []string{"b.example", "a.example"}},
+		{name: "invalid dropped", domains: []string{"", ".", "bad..example", "ok.example"}, want: []string{"ok.example"}},
+		{name: "single label", domains: []string{"internal"}, want: []string{"internal"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := normalizeSearchDomains(tt.domains); !slices.Equal(got, tt.want) {
+				t.Errorf("normalizeSearchDomains(%q) = %q, want %q", tt.domains, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAliasSearchDomains(t *testing.T) {
+	sites := []peers.SiteConfig{
+		{SiteId: 2, Aliases: []peers.Alias{{Alias: "db.Lab.Example."}, {Alias: "nas.internal.example.com"}}},
+		{SiteId: 1, Aliases: []peers.Alias{{Alias: "host.internal.example.com"}, {Alias: "printer"}, {Alias: "*.dev.example.com"}}},
+	}
+	want := []string{"internal.example.com", "dev.example.com", "lab.example"}
+	if got := aliasSearchDomains(sites); !slices.Equal(got, want) {
+		t.Errorf("aliasSearchDomains = %q, want %q", got, want)
+	}
+}
+
+func TestCurrentSearchDomainsMerges(t *testing.T) {
+	t.Cleanup(resetSearchDomains)
+	searchDomainsMutex.Lock()
+	userSearchDomains = []string{"corp.example", "internal.example.com"}
+	serverSearchDomains = []string{"internal.example.com", "lab.example"}
+	searchDomainsMutex.Unlock()
+
+	want := []string{"corp.example", "internal.example.com", "lab.example"}
+	if got := currentSearchDomains(); !slices.Equal(got, want) {
+		t.Errorf("currentSearchDomains = %q, want %q", got, want)
+	}
+}
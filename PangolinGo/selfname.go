@@ -0,0 +1,134 @@
+package main
+
+import "C"
+import (
+	"net"
+	"net/netip"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+
+	olmdns "github.com/fosrl/olm/dns"
+)
+
+// defaultSelfDomain is the zone the client's own name is served under
+const defaultSelfDomain = "olm.internal"
+
+var (
+	selfNameMutex sync.Mutex
+	// selfHostname is the FQDN (without trailing dot) the client answers to
+	selfHostname string
+	selfProxy    *olmdns.DNSProxy
+	selfAddrs    []netip.Addr
+)
+
+// hostnameLabel turns a device name like "Jane's MacBook Pro" into a DNS
+// label like "janes-macbook-pro"
+func hostnameLabel(name string) string {
+	name = strings.TrimSuffix(strings.ToLower(name), ".local")
+	var b strings.Builder
+	dash := false
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			b.WriteRune(r)
+			dash = false
+		case r == '\'' || r == '’':
+		default:
+			if !dash && b.Len() > 0 {
+				b.WriteByte('-')
+				dash = true
+			}
+		}
+	}
+	label := strings.TrimSuffix(b.String(), "-")
+	if len(label) > 63 {
+		label = strings.TrimSuffix(label[:63], "-")
+	}
+	return label
+}
+
+// setSelfHostname picks the name the embedded resolver serves for this
+// device. An empty deviceName falls back to the system hostname.
+func setSelfHostname(deviceName, domain string) {
+	if deviceName == "" {
+		deviceName, _ = os.Hostname()
+	}
+	if domain == "" {
+		domain = defaultSelfDomain
+	}
+
+	hostname := ""
+	if label := hostnameLabel(deviceName); label != "" {
+		hostname = label + "." + strings.Trim(strings.ToLower(domain), ".")
+	}
+
+	selfNameMutex.Lock()
+	defer selfNameMutex.Unlock()
+	if hostname != selfHostname {
+		removeSelfRecordsLocked()
+		selfHostname = hostname
+		requestOlmSync()
+	}
+	if hostname != "" {
+		appLogger.Info("This device resolves as %s over the tunnel", hostname)
+	}
+}
+
+func currentSelfHostname() string {
+	selfNameMutex.Lock()
+	defer selfNameMutex.Unlock()
+	return selfHostname
+}
+
+func removeSelfRecordsLocked() {
+	if selfProxy != nil {
+		for _, addr := range selfAddrs {
+			selfProxy.RemoveDNSRecord(selfHostname, net.IP(addr.AsSlice()))
+		}
+	}
+	selfProxy, selfAddrs = nil, nil
+}
+
+// syncSelfRecord keeps the A/AAAA records for the device's own name in
+// olm's resolver, re-adding them when olm starts a new resolver or the
+// tunnel addresses change
+func syncSelfRecord() {
+	proxy := (*olmdns.DNSProxy)(olmPointerField("dnsProxy", reflect.TypeOf((*olmdns.DNSProxy)(nil))))
+	var addrs []netip.Addr
+	if proxy != nil {
+		addrs = tunnelAddresses(effectiveNetworkSettings())
+	}
+
+	selfNameMutex.Lock()
+	defer selfNameMutex.Unlock()
+
+	if selfHostname == "" || (proxy == selfProxy && slices.Equal(addrs, selfAddrs)) {
+		return
+	}
+	if proxy == selfProxy {
+		removeSelfRecordsLocked()
+	}
+	selfProxy, selfAddrs = nil, nil
+	if proxy == nil {
+		return
+	}
+
+	for _, addr := range addrs {
+		if err := proxy.AddDNSRecord(selfHostname, net.IP(addr.AsSlice()), 0); err != nil {
+			appLogger.Warn("Failed to add DNS record for %s: %v", selfHostname, err)
+		}
+	}
+	selfProxy, selfAddrs = proxy, addrs
+	setSnapshotHostname(selfHostname)
+	appLogger.Debug("Serving %s for %v", selfHostname, addrs)
+}
+
+// getSelfHostname returns the name this device resolves as over the tunnel
+//
+//export getSelfHostname
+func getSelfHostname() *C.char {
+	return exportString(currentSelfHostname())
+}
@@ -0,0 +1,197 @@
+package main
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+	"unsafe"
+
+	"github.com/fosrl/newt/logger"
+	"github.com/fosrl/newt/network"
+	"github.com/miekg/dns"
+)
+
+const (
+	selfTestJob     = "selfTest"
+	selfTestTimeout = 2 * time.Second
+	// selfTestName is what the loopback resolver answers for
+	selfTestName = "selftest.pangolin.invalid."
+)
+
+// SelfTestResult is one check of runSelfTest
+type SelfTestResult struct {
+	Name       string  `json:"name"`
+	Passed     bool    `json:"passed"`
+	DurationMs float64 `json:"durationMs"`
+	Detail     string  `json:"detail,omitempty"`
+}
+
+// SelfTestReport is the JSON returned by runSelfTest
+type SelfTestReport struct {
+	Passed bool             `json:"passed"`
+	Tests  []SelfTestResult `json:"tests"`
+}
+
+// selfTestJSON round-trips a tunnel config and converts sample settings
+// into the schema Swift consumes
+func selfTestJSON() error {
+	config := StartTunnelConfig{
+		Endpoint:     "https://pangolin.example",
+		ID:           "self-test",
+		UpstreamDNS:  []string{"1.1.1.1:53"},
+		MatchDomains: []string{"*.corp.example"},
+		RouteVia:     []RouteVia{{CIDR: "10.0.0.0/8", ViaSiteID: 1}},
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		return fmt.Errorf("marshal config: %w", err)
+	}
+	var parsed StartTunnelConfig
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return fmt.Errorf("unmarshal config: %w", err)
+	}
+	again, err := json.Marshal(parsed)
+	if err != nil {
+		return fmt.Errorf("marshal parsed config: %w", err)
+	}
+	if string(again) != string(data) {
+		return fmt.Errorf("config changed in a round trip")
+	}
+
+	settings := tunnelNetworkSettings(network.NetworkSettings{
+		IPv4Addresses:      []string{"100.90.128.1/20"},
+		IPv4IncludedRoutes: []network.IPv4Route{{DestinationAddress: "10.0.0.0", SubnetMask: "255.0.0.0"}},
+	}, config)
+	if settings.IPv4Settings == nil || settings.IPv4Settings.SubnetMasks[0] != "255.255.240.0" {
+		return fmt.Errorf("unexpected IPv4 settings %+v", settings.IPv4Settings)
+	}
+	if _, err := json.Marshal(settings); err != nil {
+		return fmt.Errorf("marshal settings: %w", err)
+	}
+	return nil
+}
+
+// selfTestLogger passes a message through the C string conversions and
+// both of the paths into os_log
+func selfTestLogger() error {
+	message := "self-test: Grüße über cgo ✓"
+	cMessage := C.CString(message)
+	back := C.GoString(cMessage)
+	C.free(unsafe.Pointer(cMessage))
+	if back != message {
+		return fmt.Errorf("C string round trip returned %q", back)
+	}
+
+	appLogger.Info("Self-test message from the bridge logger")
+	NewOSLogWriter(appLogger).Write(logger.INFO, time.Now(), "Self-test message from olm's logger")
+	return nil
+}
+
+// selfTestCallbacks checks that registered callbacks get called: a job on
+// the shared scheduler and, once initOlm ran, olm's field access
+func selfTestCallbacks() error {
+	ran := make(chan struct{}, 1)
+	scheduleJob(selfTestJob, true, func() time.Duration { return time.Hour }, func(context.Context) {
+		ran <- struct{}{}
+	})
+	defer cancelJob(selfTestJob)
+
+	select {
+	case <-ran:
+	case <-time.After(selfTestTimeout):
+		return fmt.Errorf("scheduled job did not run within %v", selfTestTimeout)
+	}
+
+	if olm == nil {
+		return fmt.Errorf("olm has not been initialized")
+	}
+	if missing := checkOlmHooks(); len(missing) > 0 {
+		return fmt.Errorf("olm's internals changed; missing %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// selfTestDNS resolves a name against a resolver on the loopback interface,
+// which exercises sockets and the DNS library inside the extension
+func selfTestDNS() error {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+	want := net.ParseIP("192.0.2.1")
+	server := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		reply := new(dns.Msg)
+		reply.SetReply(r)
+		reply.Answer = append(reply.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 0},
+			A:   want,
+		})
+		_ = w.WriteMsg(reply)
+	})}
+	go func() { _ = server.ActivateAndServe() }()
+	defer server.Shutdown()
+
+	query := new(dns.Msg)
+	query.SetQuestion(selfTestName, dns.TypeA)
+	client := &dns.Client{Timeout: selfTestTimeout}
+	reply, _, err := client.Exchange(query, conn.LocalAddr().String())
+	if err != nil {
+		return fmt.Errorf("query: %w", err)
+	}
+	if len(reply.Answer) != 1 {
+		return fmt.Errorf("got %d answers", len(reply.Answer))
+	}
+	if a, ok := reply.Answer[0].(*dns.A); !ok || !a.A.Equal(want) {
+		return fmt.Errorf("unexpected answer %v", reply.Answer[0])
+	}
+	return nil
+}
+
+// runSelfTest exercises the bridge without connecting anywhere, so an
+// installer or first run can tell a broken build from a network problem.
+// It returns a report as JSON.
+//
+//export runSelfTest
+func runSelfTest() *C.char {
+	tests := []struct {
+		name string
+		run  func() error
+	}{
+		{"json", selfTestJSON},
+		{"logger", selfTestLogger},
+		{"callbacks", selfTestCallbacks},
+		{"dns", selfTestDNS},
+	}
+
+	report := SelfTestReport{Passed: true}
+	for _, test := range tests {
+		start := time.Now()
+		err := test.run()
+		result := SelfTestResult{
+			Name:       test.name,
+			Passed:     err == nil,
+			DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+		}
+		if err != nil {
+			result.Detail = err.Error()
+			report.Passed = false
+			appLogger.Warn("Self-test %s failed: %v", test.name, err)
+		}
+		report.Tests = append(report.Tests, result)
+	}
+	appLogger.Info("Self-test finished, passed: %t", report.Passed)
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		appLogger.Error("Failed to marshal self-test report: %v", err)
+		return exportString(fmt.Sprintf("Error: %v", err))
+	}
+	return exportString(string(data))
+}
@@ -0,0 +1,230 @@
+package main
+
+import "C"
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	serverHealthJob      = "serverHealth"
+	serverHealthInterval = time.Minute
+	serverHealthTimeout  = 10 * time.Second
+	// serverHealthPath answers without authentication on every Pangolin
+	// server
+	serverHealthPath = "/api/v1/"
+)
+
+// Diagnoses reported by getServerHealth. The HTTPS probe goes straight to
+// the server, not through the tunnel, so comparing it with the tunnel state
+// tells a server outage apart from a broken path to the sites.
+const (
+	ServerHealthUnknown = "unknown"
+	// ServerHealthOK: the server answers and the tunnel is connected
+	ServerHealthOK = "ok"
+	// ServerHealthServerDown: the server answers with an error, or cannot be
+	// reached while the tunnel still carries traffic
+	ServerHealthServerDown = "serverDown"
+	// ServerHealthPathBroken: the server answers but the tunnel is not
+	// connected, e.g. because the network blocks WireGuard's UDP
+	ServerHealthPathBroken = "pathBroken"
+	// ServerHealthOffline: neither the server nor the tunnel can be reached,
+	// which points at the local network
+	ServerHealthOffline = "offline"
+	// ServerHealthSettingsNotApplied: the tunnel is up but the system
+	// rejected its latest network settings, so routes or DNS may be stale
+	ServerHealthSettingsNotApplied = "settingsNotApplied"
+)
+
+// ServerHealth is the JSON returned by getServerHealth
+type ServerHealth struct {
+	Diagnosis string `json:"diagnosis"`
+	// Reachable is set when the server answered the probe at all
+	Reachable       bool    `json:"reachable"`
+	StatusCode      int     `json:"statusCode,omitempty"`
+	LatencyMs       float64 `json:"latencyMs,omitempty"`
+	Error           string  `json:"error,omitempty"`
+	TunnelConnected bool    `json:"tunnelConnected"`
+	// SettingsApplyError is why the last network settings were not applied
+	SettingsApplyError string `json:"settingsApplyError,omitempty"`
+	// Warnings lists problems that do not change the diagnosis, such as a
+	// DNS leak
+	Warnings []string `json:"warnings,omitempty"`
+	// CircuitBreaker shows whether requests to the server are being held
+	// back after repeated failures
+	CircuitBreaker *CircuitBreakerStatus `json:"circuitBreaker,omitempty"`
+	CheckedAt      time.Time             `json:"checkedAt,omitempty"`
+}
+
+var (
+	serverHealthMutex  sync.Mutex
+	serverHealthStatus = ServerHealth{Diagnosis: ServerHealthUnknown}
+)
+
+// serverURL turns the configured endpoint into the URL of a path on it
+func serverURL(endpoint, path string) string {
+	endpoint = strings.TrimRight(endpoint, "/")
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	return endpoint + path
+}
+
+// serverHealthURL turns the configured endpoint into the probe URL
+func serverHealthURL(endpoint string) string {
+	return serverURL(endpoint, serverHealthPath)
+}
+
+// diagnoseServerHealth combines the probe result with the tunnel state
+func diagnoseServerHealth(health ServerHealth) string {
+	switch {
+	case health.Reachable && health.StatusCode >= http.StatusInternalServerError:
+		return ServerHealthServerDown
+	case health.Reachable && health.TunnelConnected && health.SettingsApplyError != "":
+		return ServerHealthSettingsNotApplied
+	case health.Reachable && health.TunnelConnected:
+		return ServerHealthOK
+	case health.Reachable:
+		return ServerHealthPathBroken
+	case health.TunnelConnected:
+		return ServerHealthServerDown
+	}
+	return ServerHealthOffline
+}
+
+// probeServerHealth requests the health endpoint once. Requests go through
+// controlHTTPClient, so they also refresh the clock skew estimate.
+func probeServerHealth(ctx context.Context, url string) {
+	probeCtx, cancel := context.WithTimeout(ctx, serverHealthTimeout)
+	defer cancel()
+
+	health := ServerHealth{CheckedAt: time.Now()}
+	req, err := http.NewRequestWithContext(probeCtx, http.MethodGet, url, nil)
+	if err != nil {
+		appLogger.Error("Invalid server health URL %s: %v", url, err)
+		return
+	}
+	sent := time.Now()
+	resp, err := controlHTTPClient.Do(req)
+	if errors.Is(err, errCircuitOpen) {
+		// The breaker already knows the server is failing; the last real
+		// probe still describes it
+		return
+	}
+	if err != nil {
+		health.Error = err.Error()
+	} else {
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+		resp.Body.Close()
+		health.Reachable = true
+		health.StatusCode = resp.StatusCode
+		health.LatencyMs = float64(time.Since(sent).Microseconds()) / 1000
+	}
+	if ctx.Err() != nil {
+		return
+	}
+
+	snapshotMutex.Lock()
+	health.TunnelConnected = snapshot.State == SnapshotStateConnected
+	snapshotMutex.Unlock()
+	health.SettingsApplyError = settingsApplyFailure()
+	health.Diagnosis = diagnoseServerHealth(health)
+
+	serverHealthMutex.Lock()
+	previous := serverHealthStatus.Diagnosis
+	serverHealthStatus = health
+	serverHealthMutex.Unlock()
+
+	reportServerHealthChange(previous, health)
+}
+
+// refreshServerHealthDiagnosis re-diagnoses the last probe after the network
+// settings were applied or failed to apply
+func refreshServerHealthDiagnosis() {
+	serverHealthMutex.Lock()
+	health := serverHealthStatus
+	if health.CheckedAt.IsZero() {
+		// Nothing probed yet; the first probe picks up the apply state
+		serverHealthMutex.Unlock()
+		return
+	}
+	previous := health.Diagnosis
+	health.SettingsApplyError = settingsApplyFailure()
+	health.Diagnosis = diagnoseServerHealth(health)
+	serverHealthStatus = health
+	serverHealthMutex.Unlock()
+
+	reportServerHealthChange(previous, health)
+}
+
+// reportServerHealthChange logs and publishes a change of diagnosis
+func reportServerHealthChange(previous string, health ServerHealth) {
+	if health.Diagnosis == previous {
+		return
+	}
+	if health.Diagnosis == ServerHealthOK {
+		appLogger.Info("Server health: %s", health.Diagnosis)
+	} else {
+		appLogger.Warn("Server health: %s (status %d, %s)", health.Diagnosis, health.StatusCode, health.Error)
+	}
+	recordEvent(EventState, "server health %s -> %s", previous, health.Diagnosis)
+	setSnapshotHealth(health.Diagnosis)
+}
+
+// startServerHealth begins probing the server's health endpoint while the
+// tunnel runs
+func startServerHealth(endpoint string) {
+	stopServerHealth()
+	if endpoint == "" {
+		return
+	}
+
+	// The first probe waits one interval, so the tunnel is not judged while
+	// it is still connecting
+	url := serverHealthURL(endpoint)
+	scheduleJob(serverHealthJob, false, func() time.Duration {
+		return quietScaledInterval(serverHealthInterval)
+	}, func(ctx context.Context) {
+		probeServerHealth(ctx, url)
+	})
+}
+
+// stopServerHealth stops probing and forgets the last result
+func stopServerHealth() {
+	cancelJob(serverHealthJob)
+
+	serverHealthMutex.Lock()
+	serverHealthStatus = ServerHealth{Diagnosis: ServerHealthUnknown}
+	serverHealthMutex.Unlock()
+	setSnapshotHealth("")
+}
+
+// getServerHealth returns the latest server health probe and what it says
+// about the failure, if any, as JSON
+//
+//export getServerHealth
+func getServerHealth() *C.char {
+	serverHealthMutex.Lock()
+	health := serverHealthStatus
+	serverHealthMutex.Unlock()
+	if warning := dnsLeakWarning(); warning != "" {
+		health.Warnings = append(health.Warnings, warning)
+	}
+	health.Warnings = append(health.Warnings, subsystemWarnings()...)
+	breaker := circuitBreakerStatus()
+	health.CircuitBreaker = &breaker
+
+	data, err := json.Marshal(health)
+	if err != nil {
+		appLogger.Error("Failed to marshal server health: %v", err)
+		return exportString(fmt.Sprintf(`{"diagnosis":%q}`, ServerHealthUnknown))
+	}
+	return exportString(string(data))
+}
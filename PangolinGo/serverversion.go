@@ -0,0 +1,258 @@
+package main
+
+import "C"
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	olmpkg "github.com/fosrl/olm/olm"
+	"golang.org/x/mod/semver"
+)
+
+// ErrorCodeVersionMismatch is reported instead of a generic connection
+// failure when the server runs a Pangolin version this client cannot talk to
+const ErrorCodeVersionMismatch = "VERSION_MISMATCH"
+
+const (
+	// defaultMinServerVersion is the oldest Pangolin release the bundled olm
+	// registers with
+	defaultMinServerVersion = "1.10.0"
+	// defaultMaxServerVersion is the first release assumed to break the
+	// protocol; the bound is exclusive
+	defaultMaxServerVersion = "2.0.0"
+	// tokenPath is where olm fetches its token from. The server reports its
+	// version in the answer.
+	tokenPath = "/api/v1/auth/olm/get-token"
+	// serverRegistrationTimeout bounds the bridge's own token request
+	serverRegistrationTimeout = 15 * time.Second
+)
+
+// ServerVersionRange overrides the server versions the tunnel accepts, for
+// servers that are known to work outside the built-in range. Max is
+// exclusive; an empty bound keeps the default.
+type ServerVersionRange struct {
+	Min string `json:"min"`
+	Max string `json:"max"`
+}
+
+// ServerVersionStatus is the JSON returned by getServerVersion
+type ServerVersionStatus struct {
+	// ServerVersion is empty until the server reported one; servers too old
+	// to report it are accepted
+	ServerVersion string    `json:"serverVersion,omitempty"`
+	MinSupported  string    `json:"minSupported"`
+	MaxSupported  string    `json:"maxSupported"`
+	Compatible    bool      `json:"compatible"`
+	CheckedAt     time.Time `json:"checkedAt,omitempty"`
+	ErrorCode     string    `json:"errorCode,omitempty"`
+	ErrorMessage  string    `json:"errorMessage,omitempty"`
+}
+
+var (
+	serverVersionMutex   sync.Mutex
+	serverVersionMin     = defaultMinServerVersion
+	serverVersionMax     = defaultMaxServerVersion
+	serverVersion        string
+	serverVersionChecked time.Time
+	serverVersionError   string
+)
+
+// canonicalVersion turns "1.10.2" or "v1.10.2-rc.1" into the "v1.10.2" form
+// semver compares
+func canonicalVersion(version string) (string, bool) {
+	version = strings.TrimSpace(version)
+	if !strings.HasPrefix(version, "v") {
+		version = "v" + version
+	}
+	if !semver.IsValid(version) {
+		return "", false
+	}
+	return semver.Canonical(version), true
+}
+
+// setServerVersionRange checks and applies the accepted range, forgetting
+// what the previous server reported; nil restores the defaults
+func setServerVersionRange(versions *ServerVersionRange) error {
+	minVersion, maxVersion := defaultMinServerVersion, defaultMaxServerVersion
+	if versions != nil {
+		if versions.Min != "" {
+			minVersion = versions.Min
+		}
+		if versions.Max != "" {
+			maxVersion = versions.Max
+		}
+	}
+	lower, ok := canonicalVersion(minVersion)
+	if !ok {
+		return fmt.Errorf("invalid minimum server version %q", minVersion)
+	}
+	upper, ok := canonicalVersion(maxVersion)
+	if !ok {
+		return fmt.Errorf("invalid maximum server version %q", maxVersion)
+	}
+	if semver.Compare(lower, upper) >= 0 {
+		return fmt.Errorf("minimum server version %s is not below the maximum %s", minVersion, maxVersion)
+	}
+
+	serverVersionMutex.Lock()
+	serverVersionMin, serverVersionMax = minVersion, maxVersion
+	serverVersion = ""
+	serverVersionChecked = time.Time{}
+	serverVersionError = ""
+	serverVersionMutex.Unlock()
+	return nil
+}
+
+// versionMismatch describes why a server version is outside the accepted
+// range, or returns "" when it is inside. Caller must hold
+// serverVersionMutex.
+func versionMismatch(version string) string {
+	current, ok := canonicalVersion(version)
+	if !ok {
+		// Development builds report things like "dev"; let them through
+		return ""
+	}
+	lower, _ := canonicalVersion(serverVersionMin)
+	upper, _ := canonicalVersion(serverVersionMax)
+	switch {
+	case semver.Compare(current, lower) < 0:
+		return fmt.Sprintf("The server runs Pangolin %s, but this client needs %s or newer; update the server", version, serverVersionMin)
+	case semver.Compare(current, upper) >= 0:
+		return fmt.Sprintf("The server runs Pangolin %s, but this client supports versions below %s; update the app", version, serverVersionMax)
+	}
+	return ""
+}
+
+// checkServerRegistration asks the server for a token the way olm does when
+// it registers, through the bridge's own client, and reads the server
+// version and feature flags from the answer; olm's token request uses a client of its own
+// that the bridge cannot see. An incompatible server stops the tunnel with a
+// version mismatch instead of olm retrying forever. A server that cannot be
+// asked, or is too old to have the endpoint, leaves the version unknown. It
+// runs for every olm start and drops the answer when that tunnel generation
+// has stopped in the meantime.
+func checkServerRegistration(generation int, config olmpkg.TunnelConfig) {
+	body, err := json.Marshal(map[string]string{
+		"olmId":     config.ID,
+		"secret":    config.Secret,
+		"userToken": config.UserToken,
+		"orgId":     config.OrgID,
+	})
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), serverRegistrationTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, serverURL(config.Endpoint, tokenPath), bytes.NewReader(body))
+	if err != nil {
+		appLogger.Error("Invalid endpoint %s: %v", config.Endpoint, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-CSRF-Token", "x-csrf-protection")
+	resp, err := controlHTTPClient.Do(req)
+	if err != nil {
+		appLogger.Debug("Could not check the server version: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	var token struct {
+		Data struct {
+			ServerVersion string          `json:"serverVersion"`
+			FeatureFlags  json.RawMessage `json:"featureFlags"`
+		} `json:"data"`
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&token); err != nil {
+			appLogger.Debug("Could not read the server version: %v", err)
+			return
+		}
+	case http.StatusNotFound:
+		// Servers from before olm clients existed do not have the endpoint;
+		// olm fails against them on its own
+		appLogger.Info("The server did not report its version")
+	default:
+		appLogger.Debug("Could not check the server version: status %d", resp.StatusCode)
+		return
+	}
+
+	tunnelMutex.Lock()
+	current := generation == tunnelGeneration && tunnelRunning
+	tunnelMutex.Unlock()
+	if !current {
+		return
+	}
+
+	serverVersionMutex.Lock()
+	if token.Data.ServerVersion != "" && serverVersion != token.Data.ServerVersion {
+		appLogger.Info("Server runs Pangolin %s", token.Data.ServerVersion)
+	}
+	serverVersion = token.Data.ServerVersion
+	serverVersionChecked = time.Now()
+	mismatch := versionMismatch(serverVersion)
+	serverVersionError = mismatch
+	serverVersionMutex.Unlock()
+
+	if len(token.Data.FeatureFlags) > 0 {
+		if flags, err := parseFeatureFlags(token.Data.FeatureFlags); err != nil {
+			appLogger.Warn("Ignoring invalid feature flags from the server: %v", err)
+		} else {
+			applyFeatureFlags(flags)
+		}
+	}
+	if mismatch != "" {
+		stopForVersionMismatch(mismatch)
+	}
+}
+
+// stopForVersionMismatch stops olm's tunnel and records why
+func stopForVersionMismatch(mismatch string) {
+	appLogger.Error("Incompatible server: %s", mismatch)
+	recordEvent(EventState, "incompatible server: %s", mismatch)
+	noteDisconnectReason("incompatible server version")
+	noteTunnelError(ErrorCodeVersionMismatch, mismatch)
+	stopStatusSnapshots(SnapshotStateIncompatible)
+
+	tunnelMutex.Lock()
+	defer tunnelMutex.Unlock()
+	if tunnelRunning {
+		dropOlmObjects()
+		_ = olm.StopTunnel()
+	}
+}
+
+// getServerVersion returns the Pangolin version the server reported and
+// whether this client supports it, as JSON
+//
+//export getServerVersion
+func getServerVersion() *C.char {
+	serverVersionMutex.Lock()
+	status := ServerVersionStatus{
+		ServerVersion: serverVersion,
+		MinSupported:  serverVersionMin,
+		MaxSupported:  serverVersionMax,
+		Compatible:    serverVersionError == "",
+		CheckedAt:     serverVersionChecked,
+	}
+	if serverVersionError != "" {
+		status.ErrorCode = ErrorCodeVersionMismatch
+		status.ErrorMessage = serverVersionError
+	}
+	serverVersionMutex.Unlock()
+
+	data, err := json.Marshal(status)
+	if err != nil {
+		appLogger.Error("Failed to marshal server version: %v", err)
+		return exportString("{}")
+	}
+	return exportString(string(data))
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// The user token is the session token of the signed-in user. olm sends it in
+// the token request body and the websocket query, and the bridge also sends
+// it as the session cookie on control plane requests, for servers that
+// authenticate those by cookie. Pangolin names the cookie after
+// server.session_cookie_name, so self-hosted servers that change it need the
+// name passed in; the websocket is dialed by olm and does not carry it.
+
+// defaultSessionCookieName is Pangolin's default session cookie name
+const defaultSessionCookieName = "p_session_token"
+
+var (
+	sessionCookieMutex sync.Mutex
+	// sessionCookieDefault is the name from the init config
+	sessionCookieDefault = defaultSessionCookieName
+	// sessionCookieName, sessionCookieToken and sessionCookieHost are the
+	// running tunnel's cookie and the control plane host it is sent to
+	sessionCookieName  string
+	sessionCookieToken string
+	sessionCookieHost  string
+)
+
+// validSessionCookieName returns the name trimmed, or the fallback when the
+// name is empty or not a valid cookie name
+func validSessionCookieName(name, fallback string) string {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return fallback
+	}
+	if err := (&http.Cookie{Name: name}).Valid(); err != nil {
+		appLogger.Warn("Ignoring session cookie name %q, using %q: %v", name, fallback, err)
+		return fallback
+	}
+	return name
+}
+
+// setDefaultSessionCookieName sets the cookie name tunnels use when their
+// config does not name one
+func setDefaultSessionCookieName(name string) {
+	name = validSessionCookieName(name, defaultSessionCookieName)
+	sessionCookieMutex.Lock()
+	sessionCookieDefault = name
+	sessionCookieMutex.Unlock()
+}
+
+// endpointHost returns the host of an endpoint URL in lower case
+func endpointHost(endpoint string) string {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// setSessionCookie sets the cookie a starting tunnel sends to the endpoint
+// olm connects to. Without a user token no cookie is sent.
+func setSessionCookie(name, userToken, endpoint string) {
+	sessionCookieMutex.Lock()
+	defer sessionCookieMutex.Unlock()
+	sessionCookieName = validSessionCookieName(name, sessionCookieDefault)
+	sessionCookieToken, sessionCookieHost = userToken, endpointHost(endpoint)
+	if userToken != "" && sessionCookieName != defaultSessionCookieName {
+		appLogger.Info("Using session cookie name %q", sessionCookieName)
+	}
+}
+
+// setSessionCookieEndpoint moves the cookie to the endpoint the running
+// tunnel switched to
+func setSessionCookieEndpoint(endpoint string) {
+	sessionCookieMutex.Lock()
+	sessionCookieHost = endpointHost(endpoint)
+	sessionCookieMutex.Unlock()
+}
+
+// resetSessionCookie stops sending the session cookie when the tunnel stops
+func resetSessionCookie() {
+	sessionCookieMutex.Lock()
+	sessionCookieName, sessionCookieToken, sessionCookieHost = "", "", ""
+	sessionCookieMutex.Unlock()
+}
+
+// withSessionCookie returns the request with the session cookie added when
+// it goes to the tunnel's control plane and does not carry one already
+func withSessionCookie(req *http.Request) *http.Request {
+	sessionCookieMutex.Lock()
+	name, token, host := sessionCookieName, sessionCookieToken, sessionCookieHost
+	sessionCookieMutex.Unlock()
+
+	if token == "" || host == "" || !strings.EqualFold(req.URL.Hostname(), host) {
+		return req
+	}
+	if _, err := req.Cookie(name); err == nil {
+		return req
+	}
+	// A RoundTripper must not change the caller's request
+	req = req.Clone(req.Context())
+	req.AddCookie(&http.Cookie{Name: name, Value: token})
+	return req
+}
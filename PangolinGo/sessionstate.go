@@ -0,0 +1,150 @@
+package main
+
+import "C"
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/fosrl/newt/network"
+)
+
+const (
+	// SessionStateVersion is the only version importSessionState accepts;
+	// bump it whenever SessionState changes shape
+	SessionStateVersion = 1
+	// sessionStateTTL bounds how long exported state can be resumed from.
+	// It is meant for a restart, not for carrying state across networks.
+	sessionStateTTL = 2 * time.Minute
+)
+
+// SessionState is what a restarting extension needs to come back up without
+// waiting on the server. It holds no keys or credentials: WireGuard keys are
+// generated per process and the new one is registered as usual, so the state
+// only saves the lookups and the wait for the first network settings.
+type SessionState struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	// Identity ties the state to the client, endpoint and organization it
+	// came from
+	Identity         string `json:"identity"`
+	ResolvedEndpoint string `json:"resolvedEndpoint"`
+	// NetworkSettings are olm's settings before any bridge adjustments,
+	// which are redone from the new config
+	NetworkSettings network.NetworkSettings `json:"networkSettings"`
+}
+
+var (
+	resumeMutex sync.Mutex
+	// resumedSettings stand in for olm's settings until olm publishes its own
+	resumedSettings *network.NetworkSettings
+)
+
+// sessionIdentity hashes what a session belongs to, so state is never
+// resumed by a different client or organization
+func sessionIdentity(config StartTunnelConfig) string {
+	sum := sha256.Sum256([]byte(config.ID + "\x00" + config.Endpoint + "\x00" + config.OrgID))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseSessionState checks exported state before a start resumes from it
+func parseSessionState(data []byte, config StartTunnelConfig) (SessionState, error) {
+	var state SessionState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, err
+	}
+	switch {
+	case state.Version != SessionStateVersion:
+		return state, fmt.Errorf("unsupported version %d", state.Version)
+	case time.Now().After(state.ExpiresAt):
+		return state, fmt.Errorf("expired at %v", state.ExpiresAt)
+	case state.ExpiresAt.Sub(state.CreatedAt) > sessionStateTTL:
+		return state, fmt.Errorf("lifetime longer than %v", sessionStateTTL)
+	case state.Identity != sessionIdentity(config):
+		return state, fmt.Errorf("state belongs to a different session")
+	case state.ResolvedEndpoint == "":
+		return state, fmt.Errorf("no endpoint")
+	}
+	return state, nil
+}
+
+// resumeSession publishes the saved settings until olm has its own, so
+// Swift can bring the routes up while the new session registers. Caller must
+// hold tunnelMutex.
+func resumeSession(state SessionState) {
+	settings := state.NetworkSettings
+	resumeMutex.Lock()
+	resumedSettings = &settings
+	resumeMutex.Unlock()
+
+	appLogger.Info("Resuming session exported at %v", state.CreatedAt)
+	recordEvent(EventState, "session resumed from state exported at %v", state.CreatedAt.Format(time.RFC3339))
+	bumpSettingsVersion()
+}
+
+// resumedNetworkSettings returns olm's settings, or the resumed ones while
+// olm has not published any addresses yet
+func resumedNetworkSettings(settings network.NetworkSettings) network.NetworkSettings {
+	resumeMutex.Lock()
+	defer resumeMutex.Unlock()
+	if resumedSettings == nil {
+		return settings
+	}
+	if len(settings.IPv4Addresses) > 0 || len(settings.IPv6Addresses) > 0 {
+		appLogger.Debug("Replacing resumed network settings with the server's")
+		resumedSettings = nil
+		return settings
+	}
+	return *resumedSettings
+}
+
+// clearResumedSettings drops resumed settings when the tunnel stops
+func clearResumedSettings() {
+	resumeMutex.Lock()
+	resumedSettings = nil
+	resumeMutex.Unlock()
+}
+
+// exportSessionState returns the running session's state as JSON, for a
+// restart that passes it back as the resumeState of the next startTunnel.
+// The state expires after two minutes.
+//
+//export exportSessionState
+func exportSessionState() *C.char {
+	tunnelMutex.Lock()
+	running := tunnelRunning
+	config := activeTunnelConfig
+	endpoint := olmTunnelConfig.Endpoint
+	tunnelMutex.Unlock()
+
+	if !running {
+		appLogger.Warn("Tunnel is not running")
+		return exportString("Error: Tunnel not running")
+	}
+
+	settings := resumedNetworkSettings(network.GetSettings())
+	if len(settings.IPv4Addresses) == 0 && len(settings.IPv6Addresses) == 0 {
+		return exportString("Error: Session has no network settings yet")
+	}
+
+	now := time.Now()
+	state := SessionState{
+		Version:          SessionStateVersion,
+		CreatedAt:        now,
+		ExpiresAt:        now.Add(sessionStateTTL),
+		Identity:         sessionIdentity(config),
+		ResolvedEndpoint: endpoint,
+		NetworkSettings:  settings,
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		appLogger.Error("Failed to marshal session state: %v", err)
+		return exportString(fmt.Sprintf("Error: %v", err))
+	}
+	recordEvent(EventState, "session state exported")
+	return exportString(string(data))
+}
@@ -0,0 +1,201 @@
+package main
+
+import "C"
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrorCodeSessionSuperseded is reported when the same olm ID connected from
+// another device or process and this session gave way to it
+const ErrorCodeSessionSuperseded = "SESSION_SUPERSEDED"
+
+const (
+	// sessionTakeoverLimit and sessionTakeoverWindow bound force takeovers,
+	// so two sessions that both force one do not fight forever
+	sessionTakeoverLimit  = 3
+	sessionTakeoverWindow = 10 * time.Minute
+	// A control connection that lasts less than sessionShortConnection
+	// counts towards a suspected duplicate; sessionSuspectCount of them
+	// within sessionSuspectWindow raise the suspicion
+	sessionShortConnection = 20 * time.Second
+	sessionSuspectCount    = 4
+	sessionSuspectWindow   = 5 * time.Minute
+)
+
+// Session states
+const (
+	SessionStateActive = "active"
+	// SessionStateSuspected means the control connection keeps getting
+	// dropped right after it comes up, the pattern of two sessions taking
+	// turns; nothing is done about it
+	SessionStateSuspected  = "suspected"
+	SessionStateSuperseded = "superseded"
+)
+
+// SessionStatus is the JSON returned by getSessionStatus
+type SessionStatus struct {
+	State         string    `json:"state"`
+	ForceTakeover bool      `json:"forceTakeover"`
+	Takeovers     int       `json:"takeovers"`
+	ErrorCode     string    `json:"errorCode,omitempty"`
+	ErrorMessage  string    `json:"errorMessage,omitempty"`
+	SupersededAt  time.Time `json:"supersededAt,omitempty"`
+	// ShortConnections counts control connections that ended quickly
+	// within the last few minutes
+	ShortConnections int `json:"shortConnections"`
+}
+
+var (
+	sessionMutex         sync.Mutex
+	sessionForceTakeover bool
+	sessionSuperseded    bool
+	sessionErrorMessage  string
+	sessionSupersededAt  time.Time
+	sessionTakeovers     []time.Time
+	// sessionSupersededCodes are the olm error codes that mean the olm ID
+	// registered from somewhere else. The server has no such code of its
+	// own, so they come from the start config and are empty by default.
+	sessionSupersededCodes []string
+	// sessionConnectedAt is when the control connection last came up
+	sessionConnectedAt time.Time
+	sessionShortDrops  []time.Time
+)
+
+// resetSession forgets the previous session's state when a tunnel starts
+func resetSession(forceTakeover bool, supersededCodes []string) {
+	sessionMutex.Lock()
+	defer sessionMutex.Unlock()
+	sessionForceTakeover = forceTakeover
+	sessionSupersededCodes = nil
+	for _, code := range supersededCodes {
+		sessionSupersededCodes = append(sessionSupersededCodes, strings.ToUpper(code))
+	}
+	sessionSuperseded = false
+	sessionErrorMessage = ""
+	sessionSupersededAt = time.Time{}
+	sessionTakeovers = nil
+	sessionConnectedAt = time.Time{}
+	sessionShortDrops = nil
+}
+
+// noteSessionError is called with every error olm reports, from olm/error
+// through its OnOlmError callback and from olm/terminate through
+// OnTerminated. It reports whether the error means another session took
+// over, which it then handles; terminated is set when olm already closed its
+// tunnel for it.
+func noteSessionError(code, message string, terminated bool) bool {
+	sessionMutex.Lock()
+	superseded := code != "" && slices.Contains(sessionSupersededCodes, strings.ToUpper(code))
+	sessionMutex.Unlock()
+	if !superseded {
+		return false
+	}
+	if message == "" {
+		message = "This olm ID connected from another device or process"
+	}
+	handleSuperseded(message, terminated)
+	return true
+}
+
+// noteControlConnection watches the control connection for sessions taking
+// turns. It runs whenever the connection comes up or goes away.
+func noteControlConnection(connected bool) {
+	sessionMutex.Lock()
+	noteControlConnectionLocked(connected)
+	sessionMutex.Unlock()
+}
+
+// noteControlConnectionLocked counts control connections that end soon after
+// they came up. Caller must hold sessionMutex.
+func noteControlConnectionLocked(connected bool) {
+	now := time.Now()
+	switch {
+	case connected && sessionConnectedAt.IsZero():
+		sessionConnectedAt = now
+	case !connected && !sessionConnectedAt.IsZero():
+		if now.Sub(sessionConnectedAt) < sessionShortConnection {
+			sessionShortDrops = append(sessionShortDrops, now)
+			if len(sessionShortDrops) == sessionSuspectCount {
+				appLogger.Warn("The control connection keeps dropping right after it connects; is this olm ID in use on another device?")
+			}
+		}
+		sessionConnectedAt = time.Time{}
+	}
+	sessionShortDrops = slices.DeleteFunc(sessionShortDrops, func(t time.Time) bool { return now.Sub(t) > sessionSuspectWindow })
+}
+
+// handleSuperseded takes the session back when forced to and under the
+// limit, or else gives way: olm stops and the tunnel reports it was
+// superseded instead of re-registering against the other session
+func handleSuperseded(message string, terminated bool) {
+	now := time.Now()
+	sessionMutex.Lock()
+	sessionTakeovers = slices.DeleteFunc(sessionTakeovers, func(t time.Time) bool { return now.Sub(t) > sessionTakeoverWindow })
+	takeover := sessionForceTakeover && len(sessionTakeovers) < sessionTakeoverLimit
+	if takeover {
+		sessionTakeovers = append(sessionTakeovers, now)
+	} else {
+		sessionSuperseded = true
+		sessionErrorMessage = message
+		sessionSupersededAt = now
+	}
+	sessionMutex.Unlock()
+
+	if takeover {
+		appLogger.Warn("Another session registered with this olm ID; taking over: %s", message)
+		tunnelMutex.Lock()
+		err := restartOlmTunnel("session takeover")
+		tunnelMutex.Unlock()
+		if err != nil {
+			appLogger.Error("Session takeover failed: %v", err)
+		}
+		return
+	}
+
+	appLogger.Error("Session superseded by another device or process: %s", message)
+	recordEvent(EventState, "session superseded: %s", message)
+	noteDisconnectReason("superseded by another session")
+	noteTunnelError(ErrorCodeSessionSuperseded, message)
+	stopStatusSnapshots(SnapshotStateSuperseded)
+	tunnelMutex.Lock()
+	defer tunnelMutex.Unlock()
+	if tunnelRunning && !terminated {
+		dropOlmObjects()
+		_ = olm.StopTunnel()
+	}
+}
+
+// getSessionStatus reports whether this session was superseded by the same
+// olm ID connecting from another device or process, as JSON
+//
+//export getSessionStatus
+func getSessionStatus() *C.char {
+	sessionMutex.Lock()
+	status := SessionStatus{
+		State:            SessionStateActive,
+		ForceTakeover:    sessionForceTakeover,
+		Takeovers:        len(sessionTakeovers),
+		ShortConnections: len(sessionShortDrops),
+	}
+	switch {
+	case sessionSuperseded:
+		status.State = SessionStateSuperseded
+		status.ErrorCode = ErrorCodeSessionSuperseded
+		status.ErrorMessage = sessionErrorMessage
+		status.SupersededAt = sessionSupersededAt
+	case len(sessionShortDrops) >= sessionSuspectCount:
+		status.State = SessionStateSuspected
+	}
+	sessionMutex.Unlock()
+
+	data, err := json.Marshal(status)
+	if err != nil {
+		appLogger.Error("Failed to marshal session status: %v", err)
+		return exportString("{}")
+	}
+	return exportString(string(data))
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/fosrl/newt/network"
+	olmpkg "github.com/fosrl/olm/olm"
+)
+
+// olm publishes network settings through newt's network package. The bridge
+// adjusts them (e.g. client-side route overrides) before handing them to
+// Swift, and bumps its own generation whenever such an adjustment changes so
+// Swift re-fetches even though olm's incrementor did not move.
+var (
+	bridgeSettingsMutex   sync.Mutex
+	bridgeSettingsVersion int
+	// settingsChanged is closed and replaced to wake waitForSettingsChange
+	settingsChanged = make(chan struct{})
+	// olmSettingsSeen is olm's incrementor as of the last olm sync
+	olmSettingsSeen int
+)
+
+// bumpSettingsVersion signals that the effective settings changed on the
+// bridge side
+func bumpSettingsVersion() {
+	bridgeSettingsMutex.Lock()
+	bridgeSettingsVersion++
+	bridgeSettingsMutex.Unlock()
+	notifySettingsChanged()
+	requestOlmSync()
+}
+
+// notifySettingsChanged wakes every waitForSettingsChange caller so it
+// re-reads the token, and tells the event callbacks
+func notifySettingsChanged() {
+	bridgeSettingsMutex.Lock()
+	close(settingsChanged)
+	settingsChanged = make(chan struct{})
+	bridgeSettingsMutex.Unlock()
+	publishSettingsMoved()
+}
+
+// noteOlmSettingsVersion wakes the waiters when olm's incrementor moved.
+// olm has no change notification of its own, but it only changes its
+// settings while handling a control plane message, connecting or taking new
+// system DNS servers; watchOlmChanges notices each of them and requests the
+// olm sync that calls this.
+func noteOlmSettingsVersion() {
+	version := olmpkg.GetNetworkSettingsIncrementor()
+	bridgeSettingsMutex.Lock()
+	changed := version != olmSettingsSeen
+	olmSettingsSeen = version
+	bridgeSettingsMutex.Unlock()
+	if changed {
+		notifySettingsChanged()
+	}
+}
+
+// settingsChangeToken is what getNetworkSettingsVersion and
+// waitForSettingsChange hand to Swift: the settings version while the
+// tunnel runs and 0 otherwise
+func settingsChangeToken() int {
+	tunnelMutex.Lock()
+	running := tunnelRunning
+	tunnelMutex.Unlock()
+
+	if !running {
+		return 0
+	}
+	return networkSettingsVersion()
+}
+
+// waitSettingsChange blocks until the token differs from lastToken or the
+// timeout passes, and returns the current token. It wakes only when
+// notifySettingsChanged is called.
+func waitSettingsChange(lastToken int, timeout time.Duration) int {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		bridgeSettingsMutex.Lock()
+		changed := settingsChanged
+		bridgeSettingsMutex.Unlock()
+
+		token := settingsChangeToken()
+		if token != lastToken {
+			return token
+		}
+
+		select {
+		case <-changed:
+		case <-deadline.C:
+			return settingsChangeToken()
+		}
+	}
+}
+
+// networkSettingsVersion combines olm's incrementor with the bridge's own
+// generation. Both only ever grow, so the sum does too.
+func networkSettingsVersion() int {
+	bridgeSettingsMutex.Lock()
+	bridgeVersion := bridgeSettingsVersion
+	bridgeSettingsMutex.Unlock()
+	return olmpkg.GetNetworkSettingsIncrementor() + bridgeVersion
+}
+
+// effectiveNetworkSettings returns olm's current settings with all bridge-side
+// adjustments applied. The result never aliases olm's slices.
+func effectiveNetworkSettings() network.NetworkSettings {
+	settings := resumedNetworkSettings(network.GetSettings())
+	settings = applyIPv6Settings(settings)
+	settings = applyFullTunnelRoutes(settings)
+	settings = applySafeModeRoutes(settings)
+	settings = applyRouteOverrides(settings)
+	settings = applyNATRoutes(settings)
+	settings = applyExitLANRoutes(settings)
+	settings = applyHopRoutes(settings)
+	settings = applyDomainRoutes(settings)
+	settings = applySiteResolverRoutes(settings)
+	return settings
+}
+
+// effectiveNetworkSettingsJSON marshals effectiveNetworkSettings in the
+// NetworkExtension-shaped schema Swift consumes, checking them against the
+// local network and routing table on the way and noting what changed since
+// the last call. Settings Swift rolled back are replaced by the last good
+// ones.
+func effectiveNetworkSettingsJSON(config StartTunnelConfig) (string, error) {
+	version := networkSettingsVersion()
+	settings := effectiveNetworkSettings()
+	checkAddressConflicts(settings)
+	checkRouteConflicts(settings)
+	out := notePendingSettings(version, tunnelNetworkSettings(settings, config))
+	out.Changes = notePublishedSettings(out)
+	data, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
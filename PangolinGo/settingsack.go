@@ -0,0 +1,119 @@
+package main
+
+import "C"
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	settingsRetryJob = "settingsRetry"
+	// settingsRetryBase is the first retry delay; it doubles per failure up
+	// to settingsRetryMax
+	settingsRetryBase = 2 * time.Second
+	settingsRetryMax  = time.Minute
+)
+
+var (
+	settingsAckMutex sync.Mutex
+	// settingsAppliedVersion is the last version Swift applied
+	settingsAppliedVersion int
+	// settingsApplyFailures counts failed applies since the last success
+	settingsApplyFailures int
+	settingsApplyError    string
+)
+
+// noteSettingsApplied records Swift's result for a settings version. A
+// failure rolls back to the last settings that applied, or without those is
+// retried with backoff by bumping the version, which makes Swift fetch and
+// apply the settings again.
+func noteSettingsApplied(version int, success bool, message string) {
+	settingsAckMutex.Lock()
+	if version < settingsAppliedVersion {
+		// A newer version already went through; this result is stale
+		settingsAckMutex.Unlock()
+		return
+	}
+	recovered := success && settingsApplyFailures > 0
+	if success {
+		settingsAppliedVersion = version
+		settingsApplyFailures = 0
+		settingsApplyError = ""
+	} else {
+		settingsApplyFailures++
+		settingsApplyError = message
+	}
+	failures := settingsApplyFailures
+	settingsAckMutex.Unlock()
+
+	if success {
+		noteSettingsGood()
+		cancelJob(settingsRetryJob)
+		if recovered {
+			appLogger.Info("Network settings version %d applied after earlier failures", version)
+			recordEvent(EventSettings, "settings %d applied", version)
+			refreshServerHealthDiagnosis()
+		} else {
+			appLogger.Debug("Network settings version %d applied", version)
+		}
+		return
+	}
+
+	// Swift may hold on to none, some or all of what it was handed
+	forgetPublishedSettings()
+
+	if _, err := rollbackSettings(fmt.Sprintf("version %d failed to apply: %s", version, message)); err == nil {
+		refreshServerHealthDiagnosis()
+		return
+	}
+
+	delay := min(settingsRetryBase<<min(failures-1, 10), settingsRetryMax)
+	appLogger.Error("Failed to apply network settings version %d (attempt %d), retrying in %v: %s", version, failures, delay, message)
+	recordEvent(EventSettings, "settings %d failed to apply: %s", version, message)
+	refreshServerHealthDiagnosis()
+
+	scheduleJob(settingsRetryJob, false, func() time.Duration { return delay }, func(context.Context) {
+		cancelJob(settingsRetryJob)
+		bumpSettingsVersion()
+	})
+}
+
+// settingsApplyFailure returns the last apply error while the settings are
+// not applied
+func settingsApplyFailure() string {
+	settingsAckMutex.Lock()
+	defer settingsAckMutex.Unlock()
+	return settingsApplyError
+}
+
+// resetSettingsApply forgets apply results when the tunnel stops
+func resetSettingsApply() {
+	cancelJob(settingsRetryJob)
+
+	settingsAckMutex.Lock()
+	settingsAppliedVersion = 0
+	settingsApplyFailures = 0
+	settingsApplyError = ""
+	settingsAckMutex.Unlock()
+	resetSettingsRollback()
+}
+
+// ackNetworkSettingsApplied reports the outcome of setTunnelNetworkSettings
+// for the given settings version. success is non-zero when the settings were
+// applied; otherwise errorMessage says why not.
+//
+//export ackNetworkSettingsApplied
+func ackNetworkSettingsApplied(version C.long, success C.int, errorMessage *C.char) *C.char {
+	message := ""
+	if errorMessage != nil {
+		message = C.GoString(errorMessage)
+	}
+	noteSettingsApplied(int(version), success != 0, message)
+
+	if success != 0 {
+		return exportString(fmt.Sprintf("Settings version %d applied", int(version)))
+	}
+	return exportString(fmt.Sprintf("Settings version %d failure recorded", int(version)))
+}
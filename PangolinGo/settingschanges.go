@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// Reasons listed in the changes of the network settings JSON
+const (
+	// SettingsChangeFull: Swift has to apply everything, e.g. on the first
+	// fetch or after an apply failed
+	SettingsChangeFull          = "full"
+	SettingsChangeAddresses     = "addresses-changed"
+	SettingsChangeRoutesAdded   = "routes-added"
+	SettingsChangeRoutesRemoved = "routes-removed"
+	SettingsChangeDNS           = "dns-changed"
+	SettingsChangeMTU           = "mtu-changed"
+	SettingsChangeRemoteAddress = "remote-address-changed"
+	SettingsChangeProxy         = "proxy-changed"
+	SettingsChangeExclusions    = "exclusions-changed"
+)
+
+var (
+	publishedSettingsMutex sync.Mutex
+	// publishedSettings is what the last getNetworkSettings handed out, or
+	// nil when Swift needs the full settings next
+	publishedSettings *TunnelNetworkSettings
+)
+
+// routeKeys lists a settings object's routes, tagged by family and whether
+// they are included or excluded
+func routeKeys(settings TunnelNetworkSettings) map[string]bool {
+	keys := map[string]bool{}
+	if v4 := settings.IPv4Settings; v4 != nil {
+		for _, route := range v4.IncludedRoutes {
+			keys["in4 "+fmt.Sprint(route)] = true
+		}
+		for _, route := range v4.ExcludedRoutes {
+			keys["ex4 "+fmt.Sprint(route)] = true
+		}
+	}
+	if v6 := settings.IPv6Settings; v6 != nil {
+		for _, route := range v6.IncludedRoutes {
+			keys["in6 "+fmt.Sprint(route)] = true
+		}
+		for _, route := range v6.ExcludedRoutes {
+			keys["ex6 "+fmt.Sprint(route)] = true
+		}
+	}
+	return keys
+}
+
+// settingsAddresses drops the routes, leaving what identifies the interface
+func settingsAddresses(settings TunnelNetworkSettings) (v4 TunnelIPv4Settings, v6 TunnelIPv6Settings) {
+	if settings.IPv4Settings != nil {
+		v4 = TunnelIPv4Settings{Addresses: settings.IPv4Settings.Addresses, SubnetMasks: settings.IPv4Settings.SubnetMasks}
+	}
+	if settings.IPv6Settings != nil {
+		v6 = TunnelIPv6Settings{Addresses: settings.IPv6Settings.Addresses, NetworkPrefixLengths: settings.IPv6Settings.NetworkPrefixLengths}
+	}
+	return v4, v6
+}
+
+// settingsChanges lists why next differs from previous. An empty list means
+// nothing Swift applies changed, e.g. after a bridge-side bump that ended up
+// with the same result.
+func settingsChanges(previous *TunnelNetworkSettings, next TunnelNetworkSettings) []string {
+	if previous == nil {
+		return []string{SettingsChangeFull}
+	}
+
+	changes := []string{}
+	if previous.TunnelRemoteAddress != next.TunnelRemoteAddress {
+		changes = append(changes, SettingsChangeRemoteAddress)
+	}
+	if !reflect.DeepEqual(previous.MTU, next.MTU) {
+		changes = append(changes, SettingsChangeMTU)
+	}
+	prevV4, prevV6 := settingsAddresses(*previous)
+	nextV4, nextV6 := settingsAddresses(next)
+	if !reflect.DeepEqual(prevV4, nextV4) || !reflect.DeepEqual(prevV6, nextV6) {
+		changes = append(changes, SettingsChangeAddresses)
+	}
+
+	before, after := routeKeys(*previous), routeKeys(next)
+	for key := range after {
+		if !before[key] {
+			changes = append(changes, SettingsChangeRoutesAdded)
+			break
+		}
+	}
+	for key := range before {
+		if !after[key] {
+			changes = append(changes, SettingsChangeRoutesRemoved)
+			break
+		}
+	}
+
+	if !reflect.DeepEqual(previous.DNSSettings, next.DNSSettings) {
+		changes = append(changes, SettingsChangeDNS)
+	}
+	if !reflect.DeepEqual(previous.ProxySettings, next.ProxySettings) {
+		changes = append(changes, SettingsChangeProxy)
+	}
+	if !reflect.DeepEqual(previous.AppleServiceExclusions, next.AppleServiceExclusions) {
+		changes = append(changes, SettingsChangeExclusions)
+	}
+	return changes
+}
+
+// notePublishedSettings records the settings handed to Swift and returns why
+// they differ from the previous ones
+func notePublishedSettings(settings TunnelNetworkSettings) []string {
+	publishedSettingsMutex.Lock()
+	defer publishedSettingsMutex.Unlock()
+	changes := settingsChanges(publishedSettings, settings)
+	publishedSettings = &settings
+	return changes
+}
+
+// forgetPublishedSettings makes the next fetch a full one, for when Swift
+// may not have what was last handed out
+func forgetPublishedSettings() {
+	publishedSettingsMutex.Lock()
+	publishedSettings = nil
+	publishedSettingsMutex.Unlock()
+}
@@ -0,0 +1,108 @@
+package main
+
+import "C"
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// settingsGeneration is one set of settings handed to Swift and the version
+// it was handed out under
+type settingsGeneration struct {
+	version  int
+	settings TunnelNetworkSettings
+}
+
+var (
+	settingsRollbackMutex sync.Mutex
+	// pendingSettings were handed out last
+	pendingSettings *settingsGeneration
+	// goodSettings are the last settings Swift reported applied
+	goodSettings *settingsGeneration
+	// rejectedSettings are held back in favour of goodSettings for as long
+	// as they are still what the bridge would publish
+	rejectedSettings *TunnelNetworkSettings
+)
+
+// notePendingSettings records the settings about to be handed out and
+// returns what to hand out instead: the last good generation while the
+// rejected settings are still current
+func notePendingSettings(version int, settings TunnelNetworkSettings) TunnelNetworkSettings {
+	settingsRollbackMutex.Lock()
+	defer settingsRollbackMutex.Unlock()
+
+	if rejectedSettings != nil {
+		if goodSettings != nil && reflect.DeepEqual(*rejectedSettings, settings) {
+			settings = goodSettings.settings
+		} else {
+			appLogger.Info("Network settings moved on from the rolled back version")
+			rejectedSettings = nil
+		}
+	}
+	pendingSettings = &settingsGeneration{version: version, settings: settings}
+	return settings
+}
+
+// noteSettingsGood makes the settings handed out last the generation to
+// roll back to. Swift applies what it fetched before acknowledging, so the
+// last fetch is the one acknowledged.
+func noteSettingsGood() {
+	settingsRollbackMutex.Lock()
+	if pendingSettings != nil {
+		goodSettings = pendingSettings
+	}
+	settingsRollbackMutex.Unlock()
+}
+
+// rollbackSettings holds back the settings handed out last and has Swift
+// fetch the last good generation again. It returns that generation's
+// version.
+func rollbackSettings(reason string) (int, error) {
+	settingsRollbackMutex.Lock()
+	if goodSettings == nil {
+		settingsRollbackMutex.Unlock()
+		return 0, fmt.Errorf("no network settings have been applied yet")
+	}
+	if pendingSettings == nil || reflect.DeepEqual(pendingSettings.settings, goodSettings.settings) {
+		settingsRollbackMutex.Unlock()
+		return 0, fmt.Errorf("the last applied network settings are current")
+	}
+	rejected := pendingSettings.settings
+	rejectedSettings = &rejected
+	goodVersion := goodSettings.version
+	settingsRollbackMutex.Unlock()
+
+	appLogger.Warn("Rolling back network settings to version %d: %s", goodVersion, reason)
+	recordEvent(EventSettings, "settings rolled back to %d: %s", goodVersion, reason)
+	forgetPublishedSettings()
+	bumpSettingsVersion()
+	return goodVersion, nil
+}
+
+// resetSettingsRollback forgets every generation when the tunnel stops
+func resetSettingsRollback() {
+	settingsRollbackMutex.Lock()
+	pendingSettings = nil
+	goodSettings = nil
+	rejectedSettings = nil
+	settingsRollbackMutex.Unlock()
+}
+
+// rollbackNetworkSettings republishes the last network settings Swift
+// applied, for when the newest ones broke connectivity. They are kept until
+// the effective settings change again. reason is logged.
+//
+//export rollbackNetworkSettings
+func rollbackNetworkSettings(reason *C.char) *C.char {
+	why := "requested by Swift"
+	if reason != nil && C.GoString(reason) != "" {
+		why = C.GoString(reason)
+	}
+	version, err := rollbackSettings(why)
+	if err != nil {
+		appLogger.Warn("Cannot roll back network settings: %v", err)
+		return exportString(fmt.Sprintf("Error: Cannot roll back network settings: %v", err))
+	}
+	return exportString(fmt.Sprintf("Rolled back to network settings version %d", version))
+}
@@ -0,0 +1,234 @@
+package main
+
+import "C"
+import (
+	"fmt"
+	"sync"
+
+	olmdevice "github.com/fosrl/olm/device"
+	"golang.org/x/time/rate"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// minShaperBurst lets a full-size packet through even at very low rates
+const minShaperBurst = 64 * 1024
+
+// BandwidthLimit caps the tunnel's throughput. Zero means unlimited.
+type BandwidthLimit struct {
+	// UpstreamKbps limits traffic from this device into the tunnel
+	UpstreamKbps int `json:"upstreamKbps"`
+	// DownstreamKbps limits traffic from the tunnel to this device
+	DownstreamKbps int `json:"downstreamKbps"`
+}
+
+var (
+	shaperMutex       sync.Mutex
+	upstreamLimiter   = rate.NewLimiter(rate.Inf, minShaperBurst)
+	downstreamLimiter = rate.NewLimiter(rate.Inf, minShaperBurst)
+	shaperLimit       BandwidthLimit
+	// shaperEnabled is set once the device has to be wrapped and stays set
+	shaperEnabled   bool
+	shapedMiddleDev *olmdevice.MiddleDevice
+	shaperNeedsWrap bool
+)
+
+// setLimiterRate applies a rate in kilobits per second to a limiter. The
+// burst is a quarter second of traffic so short spikes are not penalized.
+func setLimiterRate(limiter *rate.Limiter, kbps int) {
+	if kbps <= 0 {
+		limiter.SetLimit(rate.Inf)
+		return
+	}
+	bytesPerSecond := kbps * 1000 / 8
+	limiter.SetLimit(rate.Limit(bytesPerSecond))
+	limiter.SetBurst(max(bytesPerSecond/4, minShaperBurst))
+}
+
+// setBandwidthLimit changes the limits. The tunnel device is wrapped the
+// first time a limit is set and stays wrapped; an unlimited limiter costs
+// next to nothing.
+func setBandwidthLimit(limit BandwidthLimit) error {
+	if limit.UpstreamKbps < 0 || limit.DownstreamKbps < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+
+	setLimiterRate(upstreamLimiter, limit.UpstreamKbps)
+	setLimiterRate(downstreamLimiter, limit.DownstreamKbps)
+
+	shaperMutex.Lock()
+	changed := limit != shaperLimit
+	shaperLimit = limit
+	shaperMutex.Unlock()
+
+	if limit.UpstreamKbps > 0 || limit.DownstreamKbps > 0 {
+		wrapTunnelDevice()
+	}
+
+	if !changed {
+		return nil
+	}
+	if limit.UpstreamKbps == 0 && limit.DownstreamKbps == 0 {
+		appLogger.Info("Bandwidth limits removed")
+	} else {
+		appLogger.Info("Bandwidth limited to %d kbps up, %d kbps down (0 is unlimited)", limit.UpstreamKbps, limit.DownstreamKbps)
+	}
+	return nil
+}
+
+// wrapTunnelDevice has the tunnel device wrapped from the next sync on, for
+// features that need to see every packet rather than only those olm's rules
+// match
+func wrapTunnelDevice() {
+	shaperMutex.Lock()
+	shaperEnabled = true
+	shaperMutex.Unlock()
+	requestOlmSync()
+}
+
+// shapedDevice applies the limiters, the per-route MTUs, a drain and the
+// firewall's outbound rules to the packets passing through the tunnel
+// device, counts DNS queries for the leak check, remembers the names to keep
+// warm, times first contacts and counts what utun takes and gives. Waiting
+// for tokens holds back the reads from utun and the writes into it, so the
+// kernel and WireGuard queues absorb the excess instead of the bridge
+// dropping it.
+type shapedDevice struct {
+	tun.Device
+}
+
+func (d *shapedDevice) Read(bufs [][]byte, sizes []int, offset int) (int, error) {
+	n, err := d.Device.Read(bufs, sizes, offset)
+	if n > 0 {
+		tunReadBatches.Add(1)
+		tunReadPackets.Add(uint64(n))
+		if n == len(bufs) {
+			tunFullBatches.Add(1)
+		}
+	}
+	kept := 0
+	for i := 0; i < n; i++ {
+		packet := bufs[i][offset : offset+sizes[i]]
+		noteDNSQuery(packet)
+		noteFirstByteOutbound(packet)
+		noteRecentDNSQuery(packet)
+		if !firewallAdmitsOutbound(packet) || !drainAdmits(d.Device, packet, offset, true) || !applyRouteMTUOutbound(d.Device, packet, offset) {
+			tunBridgeDrops.Add(1)
+			continue
+		}
+		shapeWait(upstreamLimiter, sizes[i])
+		if kept != i {
+			bufs[kept], bufs[i] = bufs[i], bufs[kept]
+			sizes[kept] = sizes[i]
+		}
+		kept++
+	}
+	return kept, err
+}
+
+func (d *shapedDevice) Write(bufs [][]byte, offset int) (int, error) {
+	admitted := bufs
+	if drainActive.Load() {
+		admitted = make([][]byte, 0, len(bufs))
+		for _, buf := range bufs {
+			if drainAdmits(d.Device, buf[offset:], offset, false) {
+				admitted = append(admitted, buf)
+			}
+		}
+		tunBridgeDrops.Add(uint64(len(bufs) - len(admitted)))
+		if len(admitted) == 0 {
+			return len(bufs), nil
+		}
+	}
+
+	for _, buf := range admitted {
+		noteFirstByteInbound(buf[offset:])
+		noteDomainRouteAnswer(buf[offset:])
+		applyRouteMTUInbound(buf[offset:])
+		shapeWait(downstreamLimiter, len(buf)-offset)
+	}
+	n, err := d.Device.Write(admitted, offset)
+	tunWritePackets.Add(uint64(n))
+	if err != nil {
+		tunWriteErrors.Add(1)
+	}
+	if n < len(admitted) {
+		tunWriteDrops.Add(uint64(len(admitted) - n))
+	}
+	return n, err
+}
+
+// writeToHost delivers a packet the bridge made up to the host's network
+// stack, as if it had come out of the tunnel
+func writeToHost(dev tun.Device, packet []byte, offset int) error {
+	buf := make([]byte, offset+len(packet))
+	copy(buf[offset:], packet)
+	_, err := dev.Write([][]byte{buf}, offset)
+	return err
+}
+
+// shaperDeviceReplaced notes that the tunnel device was swapped underneath
+// the shaper, e.g. by replaceTunnelFd
+func shaperDeviceReplaced() {
+	shaperMutex.Lock()
+	shaperNeedsWrap = true
+	shaperMutex.Unlock()
+	requestOlmSync()
+}
+
+// syncTrafficShaper wraps olm's current tunnel device once limits or route
+// MTUs are in use. olm creates a new packet path on every tunnel start, so
+// this runs on every olm sync.
+func syncTrafficShaper() {
+	dev := olmMiddleDevice()
+
+	tunnelMutex.Lock()
+	fd, mtu := tunnelFD, olmTunnelConfig.MTU
+	tunnelMutex.Unlock()
+
+	shaperMutex.Lock()
+	defer shaperMutex.Unlock()
+
+	if !shaperEnabled || dev == nil || fd == 0 || mtu == 0 || (dev == shapedMiddleDev && !shaperNeedsWrap) {
+		return
+	}
+
+	tdev, err := olmdevice.CreateTUNFromFD(uint32(fd), mtu)
+	if err != nil {
+		appLogger.Error("Failed to open tunnel device for wrapping: %v", err)
+		return
+	}
+	dev.AddDevice(&shapedDevice{Device: tdev})
+	shapedMiddleDev, shaperNeedsWrap = dev, false
+	appLogger.Debug("Wrapped the tunnel device for bandwidth limits and route MTUs")
+}
+
+// setBandwidthLimits changes the tunnel's rate limits at runtime, in
+// kilobits per second. Zero removes a limit.
+//
+//export setBandwidthLimits
+func setBandwidthLimits(upstreamKbps C.int, downstreamKbps C.int) *C.char {
+	if locked := managedLockResult("bandwidthLimit"); locked != nil {
+		return locked
+	}
+	limit := BandwidthLimit{UpstreamKbps: int(upstreamKbps), DownstreamKbps: int(downstreamKbps)}
+	if err := updateBandwidthLimits(&limit); err != nil {
+		appLogger.Error("Invalid bandwidth limits: %v", err)
+		return exportString(fmt.Sprintf("Error: %v", err))
+	}
+	return exportString("Bandwidth limits updated")
+}
+
+// updateBandwidthLimits replaces the running tunnel's limits; nil lifts them
+func updateBandwidthLimits(limit *BandwidthLimit) error {
+	var value BandwidthLimit
+	if limit != nil {
+		value = *limit
+	}
+	if err := setBandwidthLimit(value); err != nil {
+		return err
+	}
+	tunnelMutex.Lock()
+	activeTunnelConfig.BandwidthLimit = limit
+	tunnelMutex.Unlock()
+	return nil
+}
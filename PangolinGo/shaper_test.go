@@ -0,0 +1,105 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// testTunDevice hands out queued packets on Read and keeps what is written
+type testTunDevice struct {
+	tun.Device
+	queued  [][]byte
+	written [][]byte
+}
+
+func (d *testTunDevice) Read(bufs [][]byte, sizes []int, offset int) (int, error) {
+	n := 0
+	for ; n < len(bufs) && len(d.queued) > 0; n++ {
+		sizes[n] = copy(bufs[n][offset:], d.queued[0])
+		d.queued = d.queued[1:]
+	}
+	return n, nil
+}
+
+func (d *testTunDevice) Write(bufs [][]byte, offset int) (int, error) {
+	for _, buf := range bufs {
+		d.written = append(d.written, append([]byte(nil), buf[offset:]...))
+	}
+	return len(bufs), nil
+}
+
+func TestSetLimiterRate(t *testing.T) {
+	tests := []struct {
+		name      string
+		kbps      int
+		wantLimit rate.Limit
+		wantBurst int
+	}{
+		{name: "unlimited", kbps: 0, wantLimit: rate.Inf, wantBurst: minShaperBurst},
+		{name: "quarter second burst", kbps: 8000, wantLimit: 1000000, wantBurst: 250000},
+		{name: "burst fits a full packet", kbps: 8, wantLimit: 1000, wantBurst: minShaperBurst},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := rate.NewLimiter(rate.Inf, minShaperBurst)
+			setLimiterRate(limiter, tt.kbps)
+			if limiter.Limit() != tt.wantLimit || limiter.Burst() != tt.wantBurst {
+				t.Errorf("limit %v burst %d, want %v and %d", limiter.Limit(), limiter.Burst(), tt.wantLimit, tt.wantBurst)
+			}
+		})
+	}
+}
+
+func TestSetBandwidthLimitRejectsNegative(t *testing.T) {
+	if err := setBandwidthLimit(BandwidthLimit{UpstreamKbps: -1}); err == nil {
+		t.Error("negative upstream limit accepted")
+	}
+	if err := setBandwidthLimit(BandwidthLimit{DownstreamKbps: -1}); err == nil {
+		t.Error("negative downstream limit accepted")
+	}
+}
+
+func TestShapedDeviceHoldsBackReads(t *testing.T) {
+	// 100 kB/s with a 64 KiB burst
+	setLimiterRate(upstreamLimiter, 800)
+	t.Cleanup(func() { setLimiterRate(upstreamLimiter, 0) })
+
+	const count, size = 60, 1440
+	dev := &testTunDevice{}
+	for range count {
+		dev.queued = append(dev.queued, testIPv6(testClientAddr, testPeerAddr, ipProtoUDP, make([]byte, size-ipv6HeaderLen)))
+	}
+	shaped := &shapedDevice{Device: dev}
+
+	bufs := make([][]byte, count)
+	for i := range bufs {
+		bufs[i] = make([]byte, 2048)
+	}
+	sizes := make([]int, count)
+	start := time.Now()
+	n, err := shaped.Read(bufs, sizes, 0)
+	if err != nil || n != count {
+		t.Fatalf("Read = %d, %v, want %d packets", n, err, count)
+	}
+	// At most the burst passes at once; the remaining 20 kB take about
+	// 200ms at this rate
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("%d bytes passed in %v", count*size, elapsed)
+	}
+}
+
+func TestShapedDeviceWritesEverything(t *testing.T) {
+	dev := &testTunDevice{}
+	shaped := &shapedDevice{Device: dev}
+	packets := [][]byte{
+		testUDP(testPeerAddr, testClientAddr, 443, 50000),
+		testTCP(testPeerAddr, testClientAddr, 443, 50001, tcpFlagACK),
+	}
+	n, err := shaped.Write(packets, 0)
+	if err != nil || n != len(packets) || len(dev.written) != len(packets) {
+		t.Fatalf("Write = %d, %v with %d delivered, want %d", n, err, len(dev.written), len(packets))
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import "C"
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+
+	wgdevice "golang.zx2c4.com/wireguard/device"
+)
+
+const (
+	// defaultStopDeadline bounds a stop that does not name its own timeout
+	defaultStopDeadline = 10 * time.Second
+	// maxStopDeadline keeps a stop within the lifecycle and hang timeouts
+	maxStopDeadline = 15 * time.Second
+	// maxFlushTime bounds how long queued packets get to leave, out of the
+	// deadline
+	maxFlushTime       = 2 * time.Second
+	flushPollInterval  = 10 * time.Millisecond
+	olmStopTaskName    = "olm.StopTunnel"
+	shutdownDumpReason = "stopTunnel deadline passed"
+)
+
+// ShutdownReport describes how a stop went
+type ShutdownReport struct {
+	// Flushed is whether the packet queues emptied before the device closed
+	Flushed bool `json:"flushed"`
+	// PendingPackets were still queued when the flush gave up, and were
+	// dropped
+	PendingPackets int `json:"pendingPackets"`
+	// DeviceClosed is whether olm stopped and closed the WireGuard device
+	// within the deadline
+	DeviceClosed bool `json:"deviceClosed"`
+	// ForceCancelled are jobs the stop cancelled in the middle of a run
+	ForceCancelled []string `json:"forceCancelled"`
+	// StillRunning are the cancelled jobs, and olm's stop, that had not
+	// returned by the deadline. They finish in the background.
+	StillRunning []string `json:"stillRunning"`
+	TimedOut     bool     `json:"timedOut"`
+	DurationMs   float64  `json:"durationMs"`
+}
+
+// StopTunnelResult is the JSON returned by stopTunnel: a LifecycleResult,
+// with a ShutdownReport when the tunnel was stopped
+type StopTunnelResult struct {
+	LifecycleResult
+	Shutdown *ShutdownReport `json:"shutdown,omitempty"`
+}
+
+// olmStopping is closed when the last olm stop returned, nil before the
+// first. A stop that outlives its deadline keeps running, and the next
+// launch waits for it. Guarded by tunnelMutex.
+var olmStopping chan struct{}
+
+// stopDeadline returns the deadline for a stop asking for timeoutSeconds
+func stopDeadline(timeoutSeconds int) time.Duration {
+	if timeoutSeconds <= 0 {
+		return defaultStopDeadline
+	}
+	return min(time.Duration(timeoutSeconds)*time.Second, maxStopDeadline)
+}
+
+// queuedPackets returns how many packets wait on the packet path
+func queuedPackets() int {
+	var total int
+	for _, depth := range sampleQueueDepths() {
+		total += depth.Current
+	}
+	return total
+}
+
+// flushPacketQueues waits up to budget for the packets queued on the packet
+// path to leave and returns how many are left
+func flushPacketQueues(budget time.Duration) int {
+	deadline := time.Now().Add(budget)
+	for {
+		pending := queuedPackets()
+		if pending == 0 || !time.Now().Before(deadline) {
+			return pending
+		}
+		time.Sleep(min(flushPollInterval, time.Until(deadline)))
+	}
+}
+
+// stopOlm stops olm's tunnel and API and reports whether it returned with
+// the WireGuard device closed before the deadline. Caller must hold
+// tunnelMutex.
+func stopOlm(deadline time.Time) bool {
+	done := make(chan struct{})
+	olmStopping = done
+	dropOlmObjects()
+	go func() {
+		defer dumpOnPanic()
+		defer close(done)
+
+		_ = olm.StopTunnel()
+		_ = olm.StopApi()
+	}()
+
+	timer := time.NewTimer(max(time.Until(deadline), 0))
+	defer timer.Stop()
+	select {
+	case <-done:
+		return readOlmField("dev", reflect.TypeOf((*wgdevice.Device)(nil))) == nil
+	case <-timer.C:
+		return false
+	}
+}
+
+// waitForOlmStop waits for a stop that outlived its deadline, before olm's
+// tunnel starts again
+func waitForOlmStop(stopping chan struct{}) {
+	if stopping == nil {
+		return
+	}
+	select {
+	case <-stopping:
+	default:
+		appLogger.Info("Waiting for the previous tunnel to finish stopping")
+		<-stopping
+	}
+}
+
+// logShutdownReport logs how a stop went and dumps the goroutines still
+// running after the deadline
+func logShutdownReport(report ShutdownReport) {
+	if report.TimedOut {
+		appLogger.Warn("Tunnel stop passed its deadline after %.0fms; still running: %s", report.DurationMs, strings.Join(report.StillRunning, ", "))
+		recordEvent(EventState, "tunnel stop passed its deadline")
+		writeGoroutineDump(shutdownDumpReason)
+		return
+	}
+	appLogger.Info("Tunnel stopped in %.0fms (flushed: %t, device closed: %t, cancelled: %d)", report.DurationMs, report.Flushed, report.DeviceClosed, len(report.ForceCancelled))
+	if !report.Flushed {
+		appLogger.Info("Dropped %d queued packets on stop", report.PendingPackets)
+	}
+}
+
+// stopTunnelResultJSON returns a successful stop with its report
+func stopTunnelResultJSON(message string, report ShutdownReport) *C.char {
+	data, err := json.Marshal(StopTunnelResult{LifecycleResult: LifecycleResult{OK: true, Message: message}, Shutdown: &report})
+	if err != nil {
+		appLogger.Error("Failed to marshal stop result: %v", err)
+		return lifecycleOK(message)
+	}
+	return exportString(string(data))
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fosrl/newt/network"
+	"github.com/fosrl/olm/peers"
+	"github.com/miekg/dns"
+	wgdevice "golang.zx2c4.com/wireguard/device"
+)
+
+// siteResolverScheme marks an upstream hosted at the far end of the tunnel,
+// e.g. "tunnel://10.0.0.53" or "tunnel://3@10.0.0.53:53" for the resolver
+// behind site 3. Its queries go through the tunnel, so a site's internal DNS
+// server resolves its internal names without being reachable from anywhere
+// else.
+const siteResolverScheme = "tunnel://"
+
+// siteResolverTimeout bounds one query to a site resolver
+const siteResolverTimeout = 3 * time.Second
+
+// SiteResolver is an upstream reached through the tunnel, as reported by
+// getDNSConfig
+type SiteResolver struct {
+	Address string `json:"address"`
+	// SiteID is the site whose WireGuard peer carries the queries; zero
+	// leaves that to the sites' own routes
+	SiteID int `json:"siteId,omitempty"`
+	// Forwarder is the loopback address olm's proxy sends the queries to,
+	// when olm does not query through the tunnel itself
+	Forwarder string `json:"forwarder,omitempty"`
+}
+
+// siteForwarder relays olm's queries for one site resolver out of the
+// tunnel interface
+type siteForwarder struct {
+	addr     string
+	resolver string
+	server   *loopbackDNS
+}
+
+var (
+	siteResolversMutex sync.Mutex
+	siteForwarders     = map[string]*siteForwarder{}
+	// siteResolverPeers are the resolver addresses assigned to a site's
+	// WireGuard peer, and the site
+	siteResolverPeers = map[netip.Addr]int{}
+	// siteResolverDirect is set while olm queries through the tunnel itself
+	siteResolverDirect atomic.Bool
+)
+
+// isSiteResolver reports whether an upstream is reached through the tunnel
+func isSiteResolver(server string) bool {
+	return strings.HasPrefix(strings.TrimSpace(server), siteResolverScheme)
+}
+
+// parseSiteResolver splits a site resolver upstream into the resolver's
+// address and the site that carries it
+func parseSiteResolver(server string) (netip.AddrPort, int, error) {
+	rest := strings.TrimPrefix(strings.TrimSpace(server), siteResolverScheme)
+	siteID := 0
+	if site, host, ok := strings.Cut(rest, "@"); ok {
+		id, err := strconv.Atoi(site)
+		if err != nil || id <= 0 {
+			return netip.AddrPort{}, 0, fmt.Errorf("invalid site in DNS server %q", server)
+		}
+		siteID, rest = id, host
+	}
+	if addrPort, err := netip.ParseAddrPort(rest); err == nil {
+		return netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port()), siteID, nil
+	}
+	if addr, err := netip.ParseAddr(strings.Trim(rest, "[]")); err == nil {
+		return netip.AddrPortFrom(addr.Unmap(), 53), siteID, nil
+	}
+	// Names would have to be bootstrapped through the tunnel they are
+	// needed for
+	return netip.AddrPort{}, 0, fmt.Errorf("DNS server %q must be given by address", server)
+}
+
+// normalizeSiteResolver puts a site resolver upstream in canonical form
+func normalizeSiteResolver(server string) (string, error) {
+	addrPort, siteID, err := parseSiteResolver(server)
+	if err != nil {
+		return "", err
+	}
+	if siteID > 0 {
+		return fmt.Sprintf("%s%d@%s", siteResolverScheme, siteID, addrPort), nil
+	}
+	return siteResolverScheme + addrPort.String(), nil
+}
+
+// currentSiteResolvers returns the site resolvers among the upstreams in
+// effect: the pinned ones, or else the configured ones
+func currentSiteResolvers() []string {
+	servers, _ := pinnedUpstreamDNS()
+	if len(servers) == 0 {
+		tunnelMutex.Lock()
+		servers = activeTunnelConfig.UpstreamDNS
+		tunnelMutex.Unlock()
+	}
+	var resolvers []string
+	for _, server := range servers {
+		if isSiteResolver(server) {
+			resolvers = append(resolvers, server)
+		}
+	}
+	for _, server := range dnsRouteSiteResolvers() {
+		if !slices.Contains(resolvers, server) {
+			resolvers = append(resolvers, server)
+		}
+	}
+	return resolvers
+}
+
+// setSiteResolverDirect records whether olm's proxy sends its upstream
+// queries through the tunnel itself, in which case it can use a site
+// resolver's address directly. It is fixed for as long as olm runs.
+func setSiteResolverDirect(tunnelDNS bool) {
+	siteResolverDirect.Store(tunnelDNS)
+}
+
+// noteSiteResolversChanged republishes the network settings when the site
+// resolvers differ from before, since their addresses are routed
+func noteSiteResolversChanged(before []string) {
+	if !slices.Equal(before, currentSiteResolvers()) {
+		bumpSettingsVersion()
+	}
+}
+
+// siteResolverUpstream returns the address olm should query for a site
+// resolver, or "" when it cannot be used
+func siteResolverUpstream(server string) string {
+	addrPort, _, err := parseSiteResolver(server)
+	if err != nil {
+		appLogger.Warn("Skipping upstream DNS: %v", err)
+		return ""
+	}
+	if siteResolverDirect.Load() {
+		return addrPort.String()
+	}
+
+	siteResolversMutex.Lock()
+	defer siteResolversMutex.Unlock()
+	resolver := addrPort.String()
+	if f := siteForwarders[resolver]; f != nil {
+		return f.addr
+	}
+	f, err := startSiteForwarder(resolver)
+	if err != nil {
+		appLogger.Warn("Failed to start forwarder for site resolver %s: %v", resolver, err)
+		return ""
+	}
+	siteForwarders[resolver] = f
+	appLogger.Info("Forwarding DNS for site resolver %s through %s", resolver, f.addr)
+	return f.addr
+}
+
+// startSiteForwarder listens on a free loopback port for olm's queries
+func startSiteForwarder(resolver string) (*siteForwarder, error) {
+	f := &siteForwarder{resolver: resolver}
+	server, err := startLoopbackDNS("site resolver forwarder", f.forward)
+	if err != nil {
+		return nil, err
+	}
+	f.server, f.addr = server, server.addr
+	return f, nil
+}
+
+// forward sends a query out of the tunnel interface. The extension's own
+// sockets bypass the tunnel otherwise, and falling back to another path
+// would only leak site-internal names.
+func (f *siteForwarder) forward(w dns.ResponseWriter, query *dns.Msg) {
+	reply, err := f.exchange(query)
+	if err != nil {
+		appLogger.Debug("Query to site resolver %s failed: %v", f.resolver, err)
+		reply = new(dns.Msg)
+		reply.SetRcode(query, dns.RcodeServerFailure)
+	}
+	writeDNSReply(w, query, reply)
+}
+
+// exchange queries the resolver over the tunnel, over TCP when the UDP
+// answer was truncated
+func (f *siteForwarder) exchange(query *dns.Msg) (*dns.Msg, error) {
+	dialer, err := policyDialer(&PathPolicy{Path: SourcePathTunnel}, siteResolverTimeout)
+	if err != nil {
+		return nil, err
+	}
+	started := time.Now()
+	client := &dns.Client{Timeout: siteResolverTimeout, Dialer: dialer}
+	reply, _, err := client.Exchange(query, f.resolver)
+	if err == nil && reply.Truncated {
+		client.Net = "tcp"
+		reply, _, err = client.Exchange(query, f.resolver)
+	}
+	recordDNSQuery(query, siteResolverScheme+f.resolver, started, reply, err)
+	return reply, err
+}
+
+// applySiteResolverRoutes routes the site resolvers' addresses into the
+// tunnel
+func applySiteResolverRoutes(settings network.NetworkSettings) network.NetworkSettings {
+	for _, server := range currentSiteResolvers() {
+		addrPort, _, err := parseSiteResolver(server)
+		if err != nil {
+			continue
+		}
+		addr := addrPort.Addr()
+		cidr := netip.PrefixFrom(addr, addr.BitLen()).String()
+		if addr.Is4() {
+			if !slices.ContainsFunc(settings.IPv4IncludedRoutes, func(r network.IPv4Route) bool { return ipv4RouteCIDR(r) == cidr }) {
+				settings.IPv4IncludedRoutes = append(settings.IPv4IncludedRoutes, network.IPv4Route{
+					DestinationAddress: addr.String(),
+					SubnetMask:         net.IP(net.CIDRMask(32, 32)).String(),
+				})
+			}
+		} else if !slices.ContainsFunc(settings.IPv6IncludedRoutes, func(r network.IPv6Route) bool { return ipv6RouteCIDR(r) == cidr }) {
+			settings.IPv6IncludedRoutes = append(settings.IPv6IncludedRoutes, network.IPv6Route{
+				DestinationAddress:  addr.String(),
+				NetworkPrefixLength: 128,
+			})
+		}
+	}
+	return settings
+}
+
+// syncSiteResolvers assigns the resolvers given with a site to that site's
+// WireGuard peer. It runs on every olm sync.
+func syncSiteResolvers() {
+	resolvers := currentSiteResolvers()
+	if len(resolvers) == 0 {
+		return
+	}
+	pm := (*peers.PeerManager)(olmPointerField("peerManager", reflect.TypeOf((*peers.PeerManager)(nil))))
+	dev := (*wgdevice.Device)(olmPointerField("dev", reflect.TypeOf((*wgdevice.Device)(nil))))
+	if pm == nil || dev == nil {
+		return
+	}
+
+	siteResolversMutex.Lock()
+	defer siteResolversMutex.Unlock()
+	for _, server := range resolvers {
+		addrPort, siteID, err := parseSiteResolver(server)
+		if err != nil || siteID == 0 || siteResolverPeers[addrPort.Addr()] == siteID {
+			continue
+		}
+		site, ok := pm.GetPeer(siteID)
+		if !ok {
+			continue
+		}
+		addr := addrPort.Addr()
+		if err := peers.AddAllowedIP(dev, site.PublicKey, netip.PrefixFrom(addr, addr.BitLen()).String()); err != nil {
+			appLogger.Warn("Failed to route site resolver %s through site %d: %v", addr, siteID, err)
+			continue
+		}
+		siteResolverPeers[addr] = siteID
+	}
+}
+
+// siteResolverStatus describes the site resolvers for getDNSConfig
+func siteResolverStatus(servers []string) []SiteResolver {
+	siteResolversMutex.Lock()
+	defer siteResolversMutex.Unlock()
+	var out []SiteResolver
+	for _, server := range servers {
+		if !isSiteResolver(server) {
+			continue
+		}
+		addrPort, siteID, err := parseSiteResolver(server)
+		if err != nil {
+			continue
+		}
+		resolver := SiteResolver{Address: addrPort.String(), SiteID: siteID}
+		if f := siteForwarders[addrPort.String()]; f != nil {
+			resolver.Forwarder = f.addr
+		}
+		out = append(out, resolver)
+	}
+	return out
+}
+
+// stopSiteResolvers shuts the forwarders down when the tunnel stops. The
+// peer assignments go with olm's WireGuard device.
+func stopSiteResolvers() {
+	siteResolversMutex.Lock()
+	defer siteResolversMutex.Unlock()
+	for _, f := range siteForwarders {
+		f.server.shutdown()
+	}
+	siteForwarders = map[string]*siteForwarder{}
+	siteResolverPeers = map[netip.Addr]int{}
+}
@@ -0,0 +1,264 @@
+package main
+
+import "C"
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Paths the bridge's own traffic can be pinned to
+const (
+	// SourcePathSystem leaves the choice to the routing table
+	SourcePathSystem = "system"
+	// SourcePathPhysical uses the interface of the physical default route,
+	// as reported by setPhysicalInterface
+	SourcePathPhysical = "physical"
+	// SourcePathTunnel sends the traffic into the tunnel's utun interface
+	SourcePathTunnel = "tunnel"
+	// SourcePathInterface uses a named interface, or the one owning
+	// SourceAddress
+	SourcePathInterface = "interface"
+)
+
+// PathPolicy pins one kind of bridge-originated traffic to an interface
+type PathPolicy struct {
+	Path      string `json:"path"`
+	Interface string `json:"interface,omitempty"`
+	// SourceAddress picks the interface by one of its addresses. Control
+	// plane connections also use it as their source address.
+	SourceAddress string `json:"sourceAddress,omitempty"`
+}
+
+// SourcePolicy decides which path the bridge's own traffic takes, for
+// multi-homed Macs where the routing table picks the wrong one. It covers
+// the control plane's HTTPS and websocket and the upstream DNS queries the
+// bridge sends itself. olm queries upstreams directly unless DNS privacy is
+// on, so of olm's own queries only the tunnel path can be pinned, by sending
+// them through the tunnel.
+type SourcePolicy struct {
+	ControlPlane *PathPolicy `json:"controlPlane"`
+	DNS          *PathPolicy `json:"dns"`
+}
+
+var (
+	sourcePolicyMutex sync.Mutex
+	sourcePolicy      SourcePolicy
+	// physicalInterface is the interface of the physical default route
+	physicalInterface string
+)
+
+// parsePathPolicy checks a policy; nil means the system default
+func parsePathPolicy(policy *PathPolicy, what string) error {
+	if policy == nil {
+		return nil
+	}
+	switch policy.Path {
+	case "", SourcePathSystem, SourcePathPhysical, SourcePathTunnel:
+	case SourcePathInterface:
+		if policy.Interface == "" && policy.SourceAddress == "" {
+			return fmt.Errorf("%s path %q needs an interface or source address", what, policy.Path)
+		}
+	default:
+		return fmt.Errorf("unknown %s path %q", what, policy.Path)
+	}
+	if policy.SourceAddress != "" {
+		if _, err := netip.ParseAddr(policy.SourceAddress); err != nil {
+			return fmt.Errorf("invalid %s source address %q", what, policy.SourceAddress)
+		}
+	}
+	return nil
+}
+
+// setSourcePaths checks and applies a policy; nil puts everything back on
+// the system's choice
+func setSourcePaths(policy *SourcePolicy) error {
+	var parsed SourcePolicy
+	if policy != nil {
+		if err := parsePathPolicy(policy.ControlPlane, "control plane"); err != nil {
+			return err
+		}
+		if err := parsePathPolicy(policy.DNS, "DNS"); err != nil {
+			return err
+		}
+		parsed = *policy
+	}
+
+	sourcePolicyMutex.Lock()
+	sourcePolicy = parsed
+	sourcePolicyMutex.Unlock()
+	return nil
+}
+
+// dnsThroughTunnel reports whether upstream DNS is pinned to the tunnel, in
+// which case olm is told to query its upstreams through it as well
+func dnsThroughTunnel() bool {
+	sourcePolicyMutex.Lock()
+	defer sourcePolicyMutex.Unlock()
+	return sourcePolicy.DNS != nil && sourcePolicy.DNS.Path == SourcePathTunnel
+}
+
+// interfaceWithAddress returns the interface that has addr
+func interfaceWithAddress(addr netip.Addr) (string, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", err
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if ipNet, ok := a.(*net.IPNet); ok {
+				if ip, ok := netip.AddrFromSlice(ipNet.IP); ok && ip.Unmap() == addr {
+					return iface.Name, nil
+				}
+			}
+		}
+	}
+	return "", fmt.Errorf("no interface has %s", addr)
+}
+
+// policyInterface returns the interface a policy pins traffic to, or "" to
+// leave it to the routing table
+func policyInterface(policy *PathPolicy) (string, error) {
+	if policy == nil {
+		return "", nil
+	}
+	switch policy.Path {
+	case SourcePathPhysical:
+		sourcePolicyMutex.Lock()
+		name := physicalInterface
+		sourcePolicyMutex.Unlock()
+		// Until Swift reports it there is nothing better than the default
+		return name, nil
+	case SourcePathTunnel:
+		name := trafficInterfaceName()
+		if name == "" {
+			return "", fmt.Errorf("tunnel interface is not known")
+		}
+		return name, nil
+	case SourcePathInterface:
+		if policy.Interface != "" {
+			return policy.Interface, nil
+		}
+		addr, _ := netip.ParseAddr(policy.SourceAddress)
+		return interfaceWithAddress(addr.Unmap())
+	}
+	return "", nil
+}
+
+// policyDialer returns a dialer that follows a policy. A pinned interface
+// that does not exist fails the dial rather than falling back to another
+// path.
+func policyDialer(policy *PathPolicy, timeout time.Duration) (*net.Dialer, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	name, err := policyInterface(policy)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return dialer, nil
+	}
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("interface %s: %w", name, err)
+	}
+	dialer.Control = func(network, _ string, c syscall.RawConn) error {
+		return bindToInterface(network, c, iface.Index)
+	}
+	return dialer, nil
+}
+
+// controlDialer returns the dialer for connections to the control plane
+func controlDialer() (*net.Dialer, error) {
+	sourcePolicyMutex.Lock()
+	policy := sourcePolicy.ControlPlane
+	sourcePolicyMutex.Unlock()
+
+	dialer, err := policyDialer(policy, 0)
+	if err != nil {
+		return nil, err
+	}
+	if policy != nil && policy.SourceAddress != "" {
+		addr, _ := netip.ParseAddr(policy.SourceAddress)
+		dialer.LocalAddr = &net.TCPAddr{IP: addr.AsSlice()}
+	}
+	return dialer, nil
+}
+
+// upstreamDNSClient returns a DNS client for the upstream queries the bridge
+// sends itself. A policy that cannot be followed is logged and the query
+// left to the routing table, since failing DNS outright would be worse.
+func upstreamDNSClient(timeout time.Duration) *dns.Client {
+	sourcePolicyMutex.Lock()
+	policy := sourcePolicy.DNS
+	sourcePolicyMutex.Unlock()
+
+	dialer, err := policyDialer(policy, timeout)
+	if err != nil {
+		appLogger.Debug("Not pinning upstream DNS: %v", err)
+		dialer = &net.Dialer{Timeout: timeout}
+	}
+	return &dns.Client{Timeout: timeout, Dialer: dialer}
+}
+
+// setSourcePolicy replaces the paths the bridge's own control plane and
+// DNS traffic take at runtime. Takes a JSON object with optional
+// "controlPlane" and "dns" policies of the form {"path", "interface",
+// "sourceAddress"}; an empty object puts both back on the system's choice.
+// New connections follow it; the open control connection is kept.
+//
+//export setSourcePolicy
+func setSourcePolicy(policyJSON *C.char) *C.char {
+	if locked := managedLockResult("sourcePolicy"); locked != nil {
+		return locked
+	}
+	var policy SourcePolicy
+	if err := decodeCompatJSON([]byte(C.GoString(policyJSON)), &policy, "source policy"); err != nil {
+		appLogger.Error("Failed to parse source policy: %v", err)
+		return exportString(fmt.Sprintf("Error: Failed to parse source policy: %v", err))
+	}
+	if err := updateSourcePolicy(&policy); err != nil {
+		appLogger.Error("Invalid source policy: %v", err)
+		return exportString(fmt.Sprintf("Error: Invalid source policy: %v", err))
+	}
+	return exportString("Source policy updated")
+}
+
+// updateSourcePolicy replaces the running tunnel's source policy
+func updateSourcePolicy(policy *SourcePolicy) error {
+	if err := setSourcePaths(policy); err != nil {
+		return err
+	}
+	tunnelMutex.Lock()
+	activeTunnelConfig.SourcePolicy = policy
+	tunnelMutex.Unlock()
+
+	appLogger.Info("Source policy updated")
+	return nil
+}
+
+// setPhysicalInterface records the interface of the physical default route,
+// e.g. "en0", which the "physical" path pins traffic to. Swift reports it
+// from its path monitor whenever the path changes; empty means unknown.
+//
+//export setPhysicalInterface
+func setPhysicalInterface(name *C.char) *C.char {
+	n := C.GoString(name)
+	sourcePolicyMutex.Lock()
+	changed := physicalInterface != n
+	physicalInterface = n
+	sourcePolicyMutex.Unlock()
+
+	if changed {
+		appLogger.Debug("Physical interface is now %q", n)
+	}
+	return exportString("Physical interface set")
+}
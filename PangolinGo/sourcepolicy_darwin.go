@@ -0,0 +1,24 @@
+//go:build darwin
+
+package main
+
+import "syscall"
+
+// bindToInterface scopes a socket to one interface, the way Network.framework
+// pins a connection to a path, so it leaves through that interface whatever
+// the routing table says
+func bindToInterface(network string, c syscall.RawConn, index int) error {
+	var bindErr error
+	err := c.Control(func(fd uintptr) {
+		switch network {
+		case "tcp6", "udp6":
+			bindErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_BOUND_IF, index)
+		default:
+			bindErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_BOUND_IF, index)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return bindErr
+}
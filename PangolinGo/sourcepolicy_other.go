@@ -0,0 +1,13 @@
+//go:build !darwin
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// bindToInterface is only implemented on Apple platforms
+func bindToInterface(network string, c syscall.RawConn, index int) error {
+	return fmt.Errorf("pinning sockets to an interface is not supported on this platform")
+}
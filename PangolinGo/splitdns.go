@@ -0,0 +1,299 @@
+package main
+
+import "C"
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+
+	olmdns "github.com/fosrl/olm/dns"
+	"github.com/miekg/dns"
+)
+
+// Split DNS sends queries under a domain suffix to that suffix's upstreams,
+// e.g. corp.example.com to the corporate resolver, and everything else to
+// the usual ones. olm's proxy takes a single upstream list, so it is given a
+// loopback forwarder that picks the upstreams per query. A proxy that sends
+// its upstream queries through the tunnel cannot reach the loopback, so
+// routes need tunnelDNS off; internal resolvers are reached through the
+// tunnel as site resolvers, "tunnel://[site@]address".
+
+// splitForwarder is a resolver on the loopback interface that olm's proxy
+// forwards to in place of its upstreams
+type splitForwarder struct {
+	server *loopbackDNS
+	addr   string
+	mutex  sync.Mutex
+	// defaults are the upstreams for names under no route
+	defaults []string
+}
+
+var (
+	splitDNSMutex sync.Mutex
+	// splitDNSRoutes maps lower case domain suffixes to their upstreams
+	splitDNSRoutes map[string][]string
+	splitDNS       *splitForwarder
+	splitDNSProxy  *olmdns.DNSProxy
+	// splitDNSBlocked is set once the routes were found unreachable for
+	// olm's proxy, so that is logged once
+	splitDNSBlocked bool
+)
+
+// normalizeDNSRoutes checks a route table and puts its domains in lower
+// case without wildcard or trailing dot, and its upstreams in the form
+// setUpstreamDNS takes
+func normalizeDNSRoutes(routes map[string][]string) (map[string][]string, error) {
+	if len(routes) == 0 {
+		return nil, nil
+	}
+	normalized := make(map[string][]string, len(routes))
+	for domain, servers := range routes {
+		suffix := strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(domain), "*."), "."))
+		if _, ok := dns.IsDomainName(suffix); !ok || suffix == "" {
+			return nil, fmt.Errorf("invalid domain %q", domain)
+		}
+		if _, ok := normalized[suffix]; ok {
+			return nil, fmt.Errorf("domain %q is routed twice", suffix)
+		}
+		upstreams, err := normalizeDNSServers(servers)
+		if err != nil {
+			return nil, fmt.Errorf("domain %q: %w", suffix, err)
+		}
+		normalized[suffix] = upstreams
+	}
+	return normalized, nil
+}
+
+// setDNSRouteTable replaces the routes the forwarder uses
+func setDNSRouteTable(routes map[string][]string) {
+	splitDNSMutex.Lock()
+	splitDNSRoutes = routes
+	splitDNSBlocked = false
+	splitDNSMutex.Unlock()
+}
+
+// dnsRouteDomains are the routed suffixes, sorted, which the system has to
+// send to olm's resolver
+func dnsRouteDomains() []string {
+	splitDNSMutex.Lock()
+	defer splitDNSMutex.Unlock()
+	return slices.Sorted(maps.Keys(splitDNSRoutes))
+}
+
+// dnsRouteSiteResolvers are the site resolvers among the routes' upstreams
+func dnsRouteSiteResolvers() []string {
+	splitDNSMutex.Lock()
+	defer splitDNSMutex.Unlock()
+	var resolvers []string
+	for _, domain := range slices.Sorted(maps.Keys(splitDNSRoutes)) {
+		for _, server := range splitDNSRoutes[domain] {
+			if isSiteResolver(server) && !slices.Contains(resolvers, server) {
+				resolvers = append(resolvers, server)
+			}
+		}
+	}
+	return resolvers
+}
+
+// olmMatchDomains adds the routed suffixes to olm's match patterns, which
+// would otherwise send those names to the system's resolvers. Without
+// patterns olm matches every name and there is nothing to add.
+func olmMatchDomains(patterns []string) []string {
+	if len(patterns) == 0 {
+		return patterns
+	}
+	out := olmLinkLocalPatterns(patterns)
+	for _, domain := range dnsRouteDomains() {
+		for _, pattern := range []string{domain, "*." + domain} {
+			if !slices.Contains(out, pattern) {
+				out = append(out, pattern)
+			}
+		}
+	}
+	return out
+}
+
+// dnsRouteFor returns the upstreams of the longest routed suffix name is
+// under
+func dnsRouteFor(name string) ([]string, bool) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	splitDNSMutex.Lock()
+	defer splitDNSMutex.Unlock()
+	var best string
+	for domain := range splitDNSRoutes {
+		if (name == domain || strings.HasSuffix(name, "."+domain)) && len(domain) > len(best) {
+			best = domain
+		}
+	}
+	if best == "" {
+		return nil, false
+	}
+	return splitDNSRoutes[best], true
+}
+
+// forward answers a query from olm's proxy through the first two upstreams
+// of its route, or of the defaults
+func (f *splitForwarder) forward(w dns.ResponseWriter, query *dns.Msg) {
+	var servers []string
+	routed := false
+	if len(query.Question) > 0 {
+		var upstreams []string
+		// A routed name never falls back to the defaults, which would
+		// leak internal names
+		if upstreams, routed = dnsRouteFor(query.Question[0].Name); routed {
+			servers = resolveUpstreams(upstreams, false)
+		}
+	}
+	if !routed {
+		f.mutex.Lock()
+		servers = f.defaults
+		f.mutex.Unlock()
+	}
+
+	var reply *dns.Msg
+	for i, server := range servers {
+		if i == 2 {
+			break
+		}
+		var err error
+		if reply, err = exchange(query, server); err == nil {
+			break
+		}
+		appLogger.Debug("Split DNS forward to %s failed: %v", server, err)
+	}
+	if reply == nil {
+		reply = new(dns.Msg)
+		reply.SetRcode(query, dns.RcodeServerFailure)
+	}
+	writeDNSReply(w, query, reply)
+}
+
+// startSplitForwarder listens on a free loopback port
+func startSplitForwarder() (*splitForwarder, error) {
+	f := &splitForwarder{}
+	server, err := startLoopbackDNS("split DNS forwarder", f.forward)
+	if err != nil {
+		return nil, err
+	}
+	f.server, f.addr = server, server.addr
+	return f, nil
+}
+
+// applySplitDNS puts the forwarder in front of olm's upstreams while there
+// are routes and returns what olm should use instead
+func applySplitDNS(proxy *olmdns.DNSProxy, upstreams []string) []string {
+	splitDNSMutex.Lock()
+	defer splitDNSMutex.Unlock()
+	splitDNSProxy = proxy
+	if len(splitDNSRoutes) == 0 {
+		return upstreams
+	}
+	// Set when olm's proxy queries its upstreams through the tunnel
+	if siteResolverDirect.Load() {
+		if !splitDNSBlocked {
+			splitDNSBlocked = true
+			appLogger.Warn("DNS routes not applied: olm sends upstream queries through the tunnel")
+		}
+		return upstreams
+	}
+	if splitDNS == nil {
+		f, err := startSplitForwarder()
+		if err != nil {
+			appLogger.Warn("Failed to start split DNS forwarder, DNS routes not applied: %v", err)
+			return upstreams
+		}
+		splitDNS = f
+		appLogger.Info("Forwarding DNS by domain through %s", f.addr)
+	}
+	splitDNS.mutex.Lock()
+	splitDNS.defaults = slices.Clone(upstreams)
+	splitDNS.mutex.Unlock()
+	return []string{splitDNS.addr}
+}
+
+// syncSplitDNS redoes the forwarding when olm starts a new proxy, which
+// begins with the real upstreams
+func syncSplitDNS() {
+	proxy := (*olmdns.DNSProxy)(olmPointerField("dnsProxy", reflect.TypeOf((*olmdns.DNSProxy)(nil))))
+	splitDNSMutex.Lock()
+	changed := len(splitDNSRoutes) > 0 && proxy != nil && proxy != splitDNSProxy
+	splitDNSMutex.Unlock()
+	if changed {
+		applyUpstreamDNS()
+	}
+}
+
+// stopSplitDNS shuts the forwarder down when the tunnel stops
+func stopSplitDNS() {
+	splitDNSMutex.Lock()
+	defer splitDNSMutex.Unlock()
+	if splitDNS != nil {
+		splitDNS.server.shutdown()
+	}
+	splitDNS, splitDNSProxy = nil, nil
+}
+
+// setDNSRoutes replaces the split DNS routes of the running tunnel without
+// reconnecting. Takes a JSON object mapping domain suffixes to upstream
+// lists in the form setUpstreamDNS takes, e.g. {"corp.example.com":
+// ["tunnel://3@10.0.0.53"]}; an empty object removes them. Queries under
+// no suffix keep going to the usual upstreams.
+//
+//export setDNSRoutes
+func setDNSRoutes(routesJSON *C.char) *C.char {
+	if locked := managedLockResult("dnsRoutes"); locked != nil {
+		return locked
+	}
+	var routes map[string][]string
+	if err := json.Unmarshal([]byte(C.GoString(routesJSON)), &routes); err != nil {
+		appLogger.Error("Failed to parse DNS routes: %v", err)
+		return exportString(fmt.Sprintf("Error: Failed to parse DNS routes: %v", err))
+	}
+	if err := updateDNSRoutes(routes); err != nil {
+		appLogger.Error("Invalid DNS routes: %v", err)
+		return exportString(fmt.Sprintf("Error: Invalid DNS routes: %v", err))
+	}
+	return exportString("DNS routes updated")
+}
+
+// updateDNSRoutes replaces the running tunnel's DNS routes
+func updateDNSRoutes(routes map[string][]string) error {
+	normalized, err := normalizeDNSRoutes(routes)
+	if err != nil {
+		return err
+	}
+
+	tunnelMutex.Lock()
+	tunnelDNS := activeTunnelConfig.TunnelDNS
+	tunnelMutex.Unlock()
+	if len(normalized) > 0 && tunnelDNS {
+		return fmt.Errorf("DNS routes need tunnelDNS off; give internal resolvers as tunnel:// upstreams")
+	}
+
+	before := currentSiteResolvers()
+	setDNSRouteTable(normalized)
+	tunnelMutex.Lock()
+	activeTunnelConfig.DNSRoutes = normalized
+	olmTunnelConfig.MatchDomains = olmMatchDomains(activeTunnelConfig.MatchDomains)
+	matchDomains := olmTunnelConfig.MatchDomains
+	running := tunnelRunning
+	tunnelMutex.Unlock()
+
+	if running {
+		if proxy := (*olmdns.DNSProxy)(olmPointerField("dnsProxy", reflect.TypeOf((*olmdns.DNSProxy)(nil)))); proxy != nil {
+			proxy.SetMatchDomains(matchDomains)
+		}
+		applyUpstreamDNS()
+		// Cached answers may have come from the previous routes
+		flushDNSCacheEntries()
+		noteSiteResolversChanged(before)
+		bumpSettingsVersion()
+	}
+	appLogger.Info("DNS routes set for %d domain(s)", len(normalized))
+	recordEvent(EventDNS, "DNS routes for %v", slices.Sorted(maps.Keys(normalized)))
+	return nil
+}
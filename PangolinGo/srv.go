@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Self-hosters publish the server under _pangolin._udp, the record the
+// client looks up; its target and port replace the host of the control
+// plane's HTTPS URL. The WireGuard endpoints are handed out by the server
+// and are not affected.
+const (
+	srvService       = "pangolin"
+	srvProto         = "udp"
+	srvLookupTimeout = 3 * time.Second
+	srvProbeTimeout  = 2 * time.Second
+)
+
+// lookupSRV is the resolver's SRV lookup, replaced in tests
+var lookupSRV = net.DefaultResolver.LookupSRV
+
+// srvQueryName is the name looked up for an endpoint host
+func srvQueryName(host string) string {
+	return "_" + srvService + "._" + srvProto + "." + host
+}
+
+// resolveEndpointSRV looks up _pangolin._udp.<host> for an endpoint without
+// an explicit port, so a self-hosted server can move hosts or ports by
+// changing DNS. Targets are probed at once and the first in priority order,
+// randomized by weight within a priority, that accepts a connection is used.
+// The endpoint is returned unchanged when there are no records. A lookup can
+// take several seconds, so callers must not hold tunnelMutex.
+func resolveEndpointSRV(endpoint string) string {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" || u.Port() != "" {
+		return endpoint
+	}
+	host := u.Hostname()
+	if _, err := netip.ParseAddr(host); err == nil {
+		return endpoint
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), srvLookupTimeout)
+	defer cancel()
+	// Without service and proto the name is looked up as given
+	_, records, err := lookupSRV(ctx, "", "", srvQueryName(host))
+	if err != nil || len(records) == 0 {
+		appLogger.Debug("No SRV records for %s: %v", host, err)
+		return endpoint
+	}
+
+	var candidates []string
+	for _, record := range records {
+		target := strings.TrimSuffix(record.Target, ".")
+		// A lone "." means the service is deliberately not offered there
+		if target == "" {
+			continue
+		}
+		candidates = append(candidates, net.JoinHostPort(target, strconv.Itoa(int(record.Port))))
+	}
+	if len(candidates) == 0 {
+		return endpoint
+	}
+
+	chosen := candidates[0]
+	if len(candidates) > 1 {
+		chosen = firstReachable(candidates)
+	}
+
+	u.Host = chosen
+	resolved := u.String()
+	appLogger.Info("Resolved endpoint %s to %s via SRV", endpoint, resolved)
+	recordEvent(EventDNS, "endpoint %s resolved to %s via SRV", endpoint, resolved)
+	return resolved
+}
+
+// firstReachable probes every candidate at once and returns the first, in
+// order, that accepted a connection within srvProbeTimeout, or the first
+// candidate when none did
+func firstReachable(candidates []string) string {
+	reachable := make([]bool, len(candidates))
+	var wg sync.WaitGroup
+	for i, candidate := range candidates {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := net.DialTimeout("tcp", candidate, srvProbeTimeout)
+			if err != nil {
+				appLogger.Debug("SRV target %s is unreachable: %v", candidate, err)
+				return
+			}
+			conn.Close()
+			reachable[i] = true
+		}()
+	}
+	wg.Wait()
+
+	for i, ok := range reachable {
+		if ok {
+			return candidates[i]
+		}
+	}
+	return candidates[0]
+}
+
+// startEndpointSRV resolves the endpoint a start with configStr connects to,
+// before runStartTunnel takes tunnelMutex. It returns the configured
+// endpoint along with the resolved one, or nothing when the config does not
+// parse or resumes a session, which already knows where the server is.
+func startEndpointSRV(configStr string) (configured, resolved string) {
+	configData, _, err := applyManagedConfig([]byte(configStr))
+	if err != nil {
+		return "", ""
+	}
+	var config StartTunnelConfig
+	if err := decodeCompatJSON(configData, &config, "tunnel config"); err != nil {
+		return "", ""
+	}
+	if len(config.ResumeState) > 0 {
+		if _, err := parseSessionState(config.ResumeState, config); err == nil {
+			return "", ""
+		}
+	}
+	return config.Endpoint, resolveEndpointSRV(config.Endpoint)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestResolveEndpointSRVQueryName(t *testing.T) {
+	original := lookupSRV
+	t.Cleanup(func() { lookupSRV = original })
+
+	var queried []string
+	lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		if service != "" || proto != "" {
+			t.Errorf("service %q and proto %q passed besides the name", service, proto)
+		}
+		queried = append(queried, name)
+		return "", []*net.SRV{{Target: "pangolin-2.example.com.", Port: 8443, Priority: 10, Weight: 5}}, nil
+	}
+
+	tests := []struct {
+		endpoint string
+		query    string
+		want     string
+	}{
+		{endpoint: "https://pangolin.example.com", query: "_pangolin._udp.pangolin.example.com", want: "https://pangolin-2.example.com:8443"},
+		{endpoint: "https://pangolin.example.com/", query: "_pangolin._udp.pangolin.example.com", want: "https://pangolin-2.example.com:8443/"},
+		// An explicit port or an address is used as it is
+		{endpoint: "https://pangolin.example.com:443", want: "https://pangolin.example.com:443"},
+		{endpoint: "https://192.0.2.10", want: "https://192.0.2.10"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.endpoint, func(t *testing.T) {
+			queried = nil
+			if got := resolveEndpointSRV(tt.endpoint); got != tt.want {
+				t.Errorf("resolveEndpointSRV = %q, want %q", got, tt.want)
+			}
+			switch {
+			case tt.query == "" && len(queried) > 0:
+				t.Errorf("looked up %q", queried)
+			case tt.query != "" && (len(queried) != 1 || queried[0] != tt.query):
+				t.Errorf("looked up %q, want %q", queried, tt.query)
+			}
+		})
+	}
+}
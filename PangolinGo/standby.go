@@ -0,0 +1,304 @@
+package main
+
+import "C"
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// A standby cannot hold a second live session: olm hosts one session per
+// process, with one websocket, one WireGuard device and one set of network
+// settings. The standby server is kept warm instead. Its address is resolved
+// and its health endpoint probed, which leaves a TLS connection in the
+// shared pool for olm's first request after the switch. Switching restarts
+// olm's tunnel under the running interface, so routes and DNS stay in place
+// until the new server's settings replace them. Traffic pauses for the
+// reconnect; the interface never goes down.
+
+const (
+	standbyJob      = "standby"
+	standbyInterval = time.Minute
+	standbyTimeout  = 10 * time.Second
+)
+
+// StandbyConfig is an alternate server to move the tunnel to, e.g. while
+// migrating a Pangolin server. It takes the same credentials as the
+// primary, so it must be the same installation under another address.
+type StandbyConfig struct {
+	Endpoint string `json:"endpoint"`
+	// FailoverAfterSeconds switches to the standby on its own once the
+	// control plane has been lost for that long and the standby answers;
+	// zero switches only on switchToStandby
+	FailoverAfterSeconds int `json:"failoverAfterSeconds,omitempty"`
+}
+
+// StandbyStatus is the JSON returned by getStandbyStatus
+type StandbyStatus struct {
+	Endpoint string `json:"endpoint,omitempty"`
+	// ResolvedEndpoint is the endpoint after SRV lookup, which the switch
+	// connects to
+	ResolvedEndpoint     string     `json:"resolvedEndpoint,omitempty"`
+	FailoverAfterSeconds int        `json:"failoverAfterSeconds,omitempty"`
+	Ready                bool       `json:"ready"`
+	LatencyMs            float64    `json:"latencyMs,omitempty"`
+	Error                string     `json:"error,omitempty"`
+	CheckedAt            *time.Time `json:"checkedAt,omitempty"`
+	// SwitchedFrom is the endpoint of the last switch, which is the standby
+	// afterwards so the move can be undone
+	SwitchedFrom string     `json:"switchedFrom,omitempty"`
+	SwitchedAt   *time.Time `json:"switchedAt,omitempty"`
+}
+
+var (
+	standbyMutex  sync.Mutex
+	standbyStatus StandbyStatus
+)
+
+// parseStandby checks a standby config; nil or an empty endpoint means none
+func parseStandby(config *StandbyConfig) (*StandbyConfig, error) {
+	if config == nil || config.Endpoint == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(config.Endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid standby endpoint %q", config.Endpoint)
+	}
+	if config.FailoverAfterSeconds < 0 {
+		return nil, fmt.Errorf("invalid failover delay %d", config.FailoverAfterSeconds)
+	}
+	return config, nil
+}
+
+// startStandby keeps the standby warm while the tunnel runs
+func startStandby(config *StandbyConfig) {
+	stopStandby()
+	if config == nil {
+		return
+	}
+
+	standbyMutex.Lock()
+	standbyStatus.Endpoint = config.Endpoint
+	standbyStatus.FailoverAfterSeconds = config.FailoverAfterSeconds
+	standbyMutex.Unlock()
+
+	scheduleJob(standbyJob, true, func() time.Duration {
+		return quietScaledInterval(standbyInterval)
+	}, func(ctx context.Context) {
+		probeStandby(ctx, config.Endpoint)
+		checkStandbyFailover(config)
+	})
+}
+
+// stopStandby stops keeping the standby warm. The last switch is kept.
+func stopStandby() {
+	cancelJob(standbyJob)
+
+	standbyMutex.Lock()
+	standbyStatus = StandbyStatus{SwitchedFrom: standbyStatus.SwitchedFrom, SwitchedAt: standbyStatus.SwitchedAt}
+	standbyMutex.Unlock()
+}
+
+// probeStandby resolves the standby and requests its health endpoint once
+func probeStandby(ctx context.Context, endpoint string) {
+	resolved := resolveEndpointSRV(endpoint)
+
+	probeCtx, cancel := context.WithTimeout(ctx, standbyTimeout)
+	defer cancel()
+	now := time.Now()
+	status := StandbyStatus{ResolvedEndpoint: resolved, CheckedAt: &now}
+	req, err := http.NewRequestWithContext(probeCtx, http.MethodGet, serverHealthURL(resolved), nil)
+	if err != nil {
+		appLogger.Error("Invalid standby endpoint %s: %v", endpoint, err)
+		return
+	}
+	// Probes skip the circuit breaker, so a standby that is not up yet does
+	// not hold back requests to the primary
+	resp, err := controlBaseTransport.RoundTrip(req)
+	if err != nil {
+		status.Error = err.Error()
+	} else {
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+		resp.Body.Close()
+		status.LatencyMs = float64(time.Since(now).Microseconds()) / 1000
+		if resp.StatusCode >= http.StatusInternalServerError {
+			status.Error = fmt.Sprintf("status %d", resp.StatusCode)
+		} else {
+			status.Ready = true
+		}
+	}
+	if ctx.Err() != nil {
+		return
+	}
+
+	standbyMutex.Lock()
+	wasReady := standbyStatus.Ready
+	standbyStatus.ResolvedEndpoint = status.ResolvedEndpoint
+	standbyStatus.Ready = status.Ready
+	standbyStatus.LatencyMs = status.LatencyMs
+	standbyStatus.Error = status.Error
+	standbyStatus.CheckedAt = status.CheckedAt
+	standbyMutex.Unlock()
+
+	if status.Ready != wasReady {
+		if status.Ready {
+			appLogger.Info("Standby server %s is ready", endpoint)
+		} else {
+			appLogger.Warn("Standby server %s is not ready: %s", endpoint, status.Error)
+		}
+	}
+}
+
+// checkStandbyFailover switches to a ready standby once the control plane
+// has been lost for longer than the failover delay
+func checkStandbyFailover(config *StandbyConfig) {
+	if config.FailoverAfterSeconds == 0 {
+		return
+	}
+	standbyMutex.Lock()
+	ready := standbyStatus.Ready
+	standbyMutex.Unlock()
+	if !ready {
+		return
+	}
+
+	tunnelStatusMutex.Lock()
+	state, since := tunnelStatus.State, tunnelStatus.Since
+	tunnelStatusMutex.Unlock()
+	if state != TunnelStateConnecting && state != TunnelStateReconnecting {
+		return
+	}
+	if time.Since(since) < time.Duration(config.FailoverAfterSeconds)*time.Second {
+		return
+	}
+
+	reason := fmt.Sprintf("control plane unreachable for %s", time.Since(since).Round(time.Second))
+	if err := switchStandby(reason); err != nil {
+		appLogger.Warn("Failover to standby server failed: %v", err)
+	}
+}
+
+// switchStandby moves the running tunnel to the standby server. The old
+// endpoint becomes the standby.
+func switchStandby(reason string) error {
+	if err := checkManagedLock("endpoint"); err != nil {
+		return err
+	}
+	tunnelMutex.Lock()
+	standby := activeTunnelConfig.Standby
+	tunnelMutex.Unlock()
+	if standby == nil {
+		return fmt.Errorf("no standby server configured")
+	}
+	resolved := resolveEndpointSRV(standby.Endpoint)
+
+	tunnelMutex.Lock()
+	defer tunnelMutex.Unlock()
+
+	if !tunnelRunning {
+		return fmt.Errorf("tunnel not running")
+	}
+	if activeTunnelConfig.Standby != standby {
+		return fmt.Errorf("standby server changed while it was being resolved")
+	}
+
+	previous, previousResolved := activeTunnelConfig.Endpoint, olmTunnelConfig.Endpoint
+	olmTunnelConfig.Endpoint = resolved
+	activeTunnelConfig.Endpoint = standby.Endpoint
+	if err := restartOlmTunnel(fmt.Sprintf("switching to standby server %s: %s", standby.Endpoint, reason)); err != nil {
+		olmTunnelConfig.Endpoint, activeTunnelConfig.Endpoint = previousResolved, previous
+		return err
+	}
+	activeTunnelConfig.Standby = &StandbyConfig{Endpoint: previous, FailoverAfterSeconds: standby.FailoverAfterSeconds}
+	setSessionCookieEndpoint(olmTunnelConfig.Endpoint)
+
+	now := time.Now()
+	standbyMutex.Lock()
+	standbyStatus.SwitchedFrom, standbyStatus.SwitchedAt = previous, &now
+	standbyMutex.Unlock()
+
+	setSnapshotState(SnapshotStateConnecting, activeTunnelConfig.Endpoint, activeTunnelConfig.OrgID)
+	startServerHealth(activeTunnelConfig.Endpoint)
+	startStandby(activeTunnelConfig.Standby)
+	recordEvent(EventState, "switched from %s to standby %s", previous, standby.Endpoint)
+	return nil
+}
+
+// setStandbyServer replaces the standby of the running tunnel. Takes a JSON
+// object {"endpoint", "failoverAfterSeconds"}; an empty object removes it.
+//
+//export setStandbyServer
+func setStandbyServer(configJSON *C.char) *C.char {
+	if locked := managedLockResult("standby"); locked != nil {
+		return locked
+	}
+	var config StandbyConfig
+	if err := decodeCompatJSON([]byte(C.GoString(configJSON)), &config, "standby server"); err != nil {
+		appLogger.Error("Failed to parse standby server: %v", err)
+		return exportString(fmt.Sprintf("Error: Failed to parse standby server: %v", err))
+	}
+	standby, err := updateStandbyServer(&config)
+	if err != nil {
+		appLogger.Error("Invalid standby server: %v", err)
+		return exportString(fmt.Sprintf("Error: Invalid standby server: %v", err))
+	}
+	if standby == nil {
+		return exportString("Standby server removed")
+	}
+	appLogger.Info("Standby server set to %s", standby.Endpoint)
+	return exportString("Standby server updated")
+}
+
+// switchToStandby moves the running tunnel to the standby server without
+// taking the interface down, and makes the old server the standby. Traffic
+// pauses while olm reconnects.
+//
+//export switchToStandby
+func switchToStandby() *C.char {
+	if err := switchStandby("requested by Swift"); err != nil {
+		appLogger.Error("Failed to switch to standby server: %v", err)
+		return exportString(fmt.Sprintf("Error: Failed to switch to standby server: %v", err))
+	}
+	return exportString("Switched to standby server")
+}
+
+// getStandbyStatus returns whether the standby server is ready to take over,
+// and the last switch, as JSON
+//
+//export getStandbyStatus
+func getStandbyStatus() *C.char {
+	standbyMutex.Lock()
+	status := standbyStatus
+	standbyMutex.Unlock()
+
+	data, err := json.Marshal(status)
+	if err != nil {
+		appLogger.Error("Failed to marshal standby status: %v", err)
+		return exportString(fmt.Sprintf("Error: Failed to marshal standby status: %v", err))
+	}
+	return exportString(string(data))
+}
+
+// updateStandbyServer replaces the running tunnel's standby server and
+// returns it as parsed, nil when there is none
+func updateStandbyServer(config *StandbyConfig) (*StandbyConfig, error) {
+	standby, err := parseStandby(config)
+	if err != nil {
+		return nil, err
+	}
+
+	tunnelMutex.Lock()
+	activeTunnelConfig.Standby = standby
+	running := tunnelRunning
+	tunnelMutex.Unlock()
+
+	if running {
+		startStandby(standby)
+	}
+	return standby, nil
+}
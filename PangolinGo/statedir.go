@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// stateDir is a writable directory supplied by Swift (normally inside the app
+// group container) where the Go layer persists small state files. When it is
+// empty, state is kept in memory only.
+var (
+	stateDir      string
+	stateDirMutex sync.RWMutex
+)
+
+// setStateDir records the state directory, creating it if needed
+func setStateDir(dir string) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			appLogger.Error("Failed to create state directory %s: %v", dir, err)
+			dir = ""
+		}
+	}
+
+	stateDirMutex.Lock()
+	stateDir = dir
+	stateDirMutex.Unlock()
+}
+
+// statePath returns the path of a named state file, or "" when no state
+// directory is configured
+func statePath(name string) string {
+	stateDirMutex.RLock()
+	defer stateDirMutex.RUnlock()
+	if stateDir == "" {
+		return ""
+	}
+	return filepath.Join(stateDir, name)
+}
+
+// readStateFile reads a named state file. A missing file or state directory
+// yields nil data and no error.
+func readStateFile(name string) ([]byte, error) {
+	path := statePath(name)
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// writeStateFile atomically replaces a named state file. It is a no-op when
+// no state directory is configured.
+func writeStateFile(name string, data []byte) error {
+	path := statePath(name)
+	if path == "" {
+		return nil
+	}
+	return writeFileAtomic(path, data, 0o600)
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it
+// into place so readers never observe a partially written file
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	tmpName := tmp.Name()
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return fmt.Errorf("failed to write temporary file: %w", err)
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return fmt.Errorf("failed to set permissions: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return fmt.Errorf("failed to close temporary file: %w", err)
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		os.Remove(tmpName)
+		return fmt.Errorf("failed to replace %s: %w", path, err)
+	}
+	return nil
+}
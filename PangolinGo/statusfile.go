@@ -0,0 +1,86 @@
+package main
+
+import "C"
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// statusFileVersion is bumped when a field of the status file changes
+// meaning or goes away; new fields do not bump it
+const statusFileVersion = 1
+
+// StatusFile is the document written for third-party tooling: the widget
+// snapshot under a version, so scripts can tell a format they do not know
+type StatusFile struct {
+	Version int `json:"version"`
+	StatusSnapshot
+}
+
+var (
+	statusFileMutex sync.Mutex
+	// statusFilePath is where the status file goes; empty writes none
+	statusFilePath string
+)
+
+// setStatusFile checks and records the status file path; empty stops
+// writing it. The directory has to exist already.
+func setStatusFile(path string) error {
+	if path != "" {
+		if !filepath.IsAbs(path) {
+			return fmt.Errorf("status file path %q is not absolute", path)
+		}
+		if info, err := os.Stat(filepath.Dir(path)); err != nil || !info.IsDir() {
+			return fmt.Errorf("directory of %q does not exist", path)
+		}
+	}
+	statusFileMutex.Lock()
+	statusFilePath = path
+	statusFileMutex.Unlock()
+	return nil
+}
+
+// writeStatusFile writes the snapshot to the status file, if one is set.
+// It is replaced atomically, so a reader never sees half a document.
+func writeStatusFile(snapshot StatusSnapshot) {
+	statusFileMutex.Lock()
+	defer statusFileMutex.Unlock()
+	if statusFilePath == "" {
+		return
+	}
+	data, err := json.Marshal(StatusFile{Version: statusFileVersion, StatusSnapshot: snapshot})
+	if err != nil {
+		appLogger.Error("Failed to marshal status file: %v", err)
+		return
+	}
+	if err := writeFileAtomic(statusFilePath, data, 0o444); err != nil {
+		appLogger.Debug("Failed to write status file: %v", err)
+	}
+}
+
+// setStatusFilePath has the tunnel status written as JSON to path on every
+// state change, for scripts and monitoring agents that do not speak the
+// control socket protocol. An empty path stops writing it; the last file is
+// left in place.
+//
+//export setStatusFilePath
+func setStatusFilePath(path *C.char) *C.char {
+	p := C.GoString(path)
+	if err := setStatusFile(p); err != nil {
+		appLogger.Error("Invalid status file path: %v", err)
+		return exportString(fmt.Sprintf("Error: %v", err))
+	}
+	if p == "" {
+		appLogger.Info("Status file disabled")
+		return exportString("Status file disabled")
+	}
+
+	snapshotMutex.Lock()
+	writeStatusSnapshotLocked()
+	snapshotMutex.Unlock()
+	appLogger.Info("Writing status file to %s", p)
+	return exportString(fmt.Sprintf("Status file set: %s", p))
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// statusSnapshotFile is read by the iOS widget and the macOS menu extra so
+// they can render without waking the extension
+const statusSnapshotFile = "status.json"
+
+const (
+	statusSnapshotJob      = "statusSnapshot"
+	statusSnapshotInterval = 15 * time.Second
+	// statusSnapshotMinWrite throttles writes caused only by traffic
+	statusSnapshotMinWrite = time.Minute
+)
+
+// Snapshot states
+const (
+	SnapshotStateDisconnected = "disconnected"
+	SnapshotStateConnecting   = "connecting"
+	SnapshotStateConnected    = "connected"
+	SnapshotStateTerminated   = "terminated"
+	// SnapshotStateSuperseded means the same olm ID connected elsewhere and
+	// this session gave way
+	SnapshotStateSuperseded = "superseded"
+	// SnapshotStateIncompatible means the server runs a Pangolin version
+	// this client does not support
+	SnapshotStateIncompatible = "incompatible"
+)
+
+// StatusSnapshot is the small JSON document written for widgets
+type StatusSnapshot struct {
+	State         string     `json:"state"`
+	Endpoint      string     `json:"endpoint,omitempty"`
+	OrgID         string     `json:"orgId,omitempty"`
+	Hostname      string     `json:"hostname,omitempty"`
+	Day           string     `json:"day"` // local date the byte counts belong to
+	RxBytesToday  uint64     `json:"rxBytesToday"`
+	TxBytesToday  uint64     `json:"txBytesToday"`
+	LastHandshake *time.Time `json:"lastHandshake,omitempty"`
+	// Health is the server health diagnosis, e.g. "serverDown"
+	Health string `json:"health,omitempty"`
+	// Sharing tells the user which local services peers can reach
+	Sharing *InboundExposureStatus `json:"sharing,omitempty"`
+	// SafeMode is set while the tunnel runs with a minimal configuration
+	// after repeated failed starts
+	SafeMode  bool      `json:"safeMode,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+var (
+	snapshotMutex     sync.Mutex
+	snapshot          = StatusSnapshot{State: SnapshotStateDisconnected}
+	snapshotWrittenAt time.Time
+	snapshotDirty     bool
+	snapshotLastRx    uint64
+	snapshotLastTx    uint64
+)
+
+// loadStatusSnapshot restores today's byte counts from the previous session
+func loadStatusSnapshot() {
+	data, err := readStateFile(statusSnapshotFile)
+	if err != nil || data == nil {
+		return
+	}
+
+	var saved StatusSnapshot
+	if err := json.Unmarshal(data, &saved); err != nil {
+		appLogger.Debug("Ignoring unreadable status snapshot: %v", err)
+		return
+	}
+
+	snapshotMutex.Lock()
+	defer snapshotMutex.Unlock()
+	if saved.Day == today() {
+		snapshot.Day = saved.Day
+		snapshot.RxBytesToday = saved.RxBytesToday
+		snapshot.TxBytesToday = saved.TxBytesToday
+	}
+	snapshot.LastHandshake = saved.LastHandshake
+}
+
+func today() string {
+	return time.Now().Format("2006-01-02")
+}
+
+// setSnapshotState records a state change and writes the snapshot right away
+func setSnapshotState(state, endpoint, orgID string) {
+	snapshotMutex.Lock()
+	defer snapshotMutex.Unlock()
+
+	if snapshot.State == state && snapshot.Endpoint == endpoint && snapshot.OrgID == orgID {
+		return
+	}
+	recordEvent(EventState, "status %s -> %s", snapshot.State, state)
+	noteConnectionState(snapshot.State, state, endpoint, orgID)
+	snapshot.State = state
+	snapshot.Endpoint = endpoint
+	snapshot.OrgID = orgID
+	writeStatusSnapshotLocked()
+}
+
+// setSnapshotSafeMode records safe mode and writes the snapshot right away
+func setSnapshotSafeMode(on bool) {
+	snapshotMutex.Lock()
+	defer snapshotMutex.Unlock()
+	if snapshot.SafeMode == on {
+		return
+	}
+	snapshot.SafeMode = on
+	writeStatusSnapshotLocked()
+}
+
+// updateSnapshotState changes only the state, keeping endpoint and org
+func updateSnapshotState(state string) {
+	snapshotMutex.Lock()
+	endpoint, orgID := snapshot.Endpoint, snapshot.OrgID
+	snapshotMutex.Unlock()
+	setSnapshotState(state, endpoint, orgID)
+}
+
+func writeStatusSnapshotLocked() {
+	if day := today(); snapshot.Day != day {
+		snapshot.Day = day
+		snapshot.RxBytesToday = 0
+		snapshot.TxBytesToday = 0
+	}
+	snapshot.UpdatedAt = time.Now()
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		appLogger.Error("Failed to marshal status snapshot: %v", err)
+		return
+	}
+	writeStatusFile(snapshot)
+	if err := writeStateFile(statusSnapshotFile, data); err != nil {
+		appLogger.Debug("Failed to write status snapshot: %v", err)
+		return
+	}
+	snapshotWrittenAt = snapshot.UpdatedAt
+	snapshotDirty = false
+}
+
+// setSnapshotExposure records what is shared with peers. Only the settings
+// are written out; hit counters change too often for the widget file.
+func setSnapshotExposure(status InboundExposureStatus) {
+	status.Accepted, status.Blocked = 0, 0
+
+	snapshotMutex.Lock()
+	defer snapshotMutex.Unlock()
+	snapshot.Sharing = &status
+	writeStatusSnapshotLocked()
+}
+
+// setSnapshotHostname records the name this device resolves as over the
+// tunnel
+func setSnapshotHostname(hostname string) {
+	snapshotMutex.Lock()
+	defer snapshotMutex.Unlock()
+	if snapshot.Hostname == hostname {
+		return
+	}
+	snapshot.Hostname = hostname
+	writeStatusSnapshotLocked()
+}
+
+// setSnapshotHealth records the server health diagnosis
+func setSnapshotHealth(diagnosis string) {
+	snapshotMutex.Lock()
+	defer snapshotMutex.Unlock()
+	if snapshot.Health == diagnosis {
+		return
+	}
+	snapshot.Health = diagnosis
+	writeStatusSnapshotLocked()
+}
+
+// refreshStatusSnapshot folds in new traffic and peer status and writes the
+// snapshot if anything significant changed
+func refreshStatusSnapshot() {
+	counters, countersOK := sampleTrafficCounters()
+	status, statusErr := fetchOlmStatus()
+
+	snapshotMutex.Lock()
+	defer snapshotMutex.Unlock()
+
+	significant := false
+
+	if day := today(); snapshot.Day != day {
+		snapshot.Day = day
+		snapshot.RxBytesToday = 0
+		snapshot.TxBytesToday = 0
+		significant = true
+	}
+
+	if countersOK {
+		// Totals restart from zero with the tunnel
+		if counters.RxBytes < snapshotLastRx || counters.TxBytes < snapshotLastTx {
+			snapshotLastRx, snapshotLastTx = 0, 0
+		}
+		rx := counters.RxBytes - snapshotLastRx
+		tx := counters.TxBytes - snapshotLastTx
+		snapshotLastRx, snapshotLastTx = counters.RxBytes, counters.TxBytes
+		noteConnectionTraffic(rx, tx)
+		if rx != 0 || tx != 0 {
+			snapshot.RxBytesToday += rx
+			snapshot.TxBytesToday += tx
+			snapshotDirty = true
+		}
+	}
+
+	if statusErr == nil {
+		if status.Connected && snapshot.State == SnapshotStateConnecting {
+			recordEvent(EventState, "status connecting -> connected")
+			noteConnectionState(snapshot.State, SnapshotStateConnected, snapshot.Endpoint, snapshot.OrgID)
+			snapshot.State = SnapshotStateConnected
+			significant = true
+		} else if !status.Connected && snapshot.State == SnapshotStateConnected {
+			recordEvent(EventState, "status connected -> connecting")
+			noteConnectionState(snapshot.State, SnapshotStateConnecting, snapshot.Endpoint, snapshot.OrgID)
+			snapshot.State = SnapshotStateConnecting
+			significant = true
+		}
+
+		var latest time.Time
+		for _, peer := range status.PeerStatuses {
+			if peer != nil && peer.LastSeen.After(latest) {
+				latest = peer.LastSeen
+			}
+		}
+		// Widgets show minutes at best, so sub-minute movement is not news
+		if !latest.IsZero() && (snapshot.LastHandshake == nil || latest.Sub(*snapshot.LastHandshake) >= time.Minute) {
+			latest = latest.UTC()
+			snapshot.LastHandshake = &latest
+			snapshotDirty = true
+		}
+	}
+
+	if significant || (snapshotDirty && time.Since(snapshotWrittenAt) >= statusSnapshotMinWrite) {
+		writeStatusSnapshotLocked()
+	}
+}
+
+// startStatusSnapshots begins refreshing the snapshot while the tunnel runs
+func startStatusSnapshots(endpoint, orgID string) {
+	cancelStatusSnapshots()
+
+	snapshotMutex.Lock()
+	snapshotLastRx, snapshotLastTx = 0, 0
+	snapshotMutex.Unlock()
+	setSnapshotState(SnapshotStateConnecting, endpoint, orgID)
+
+	scheduleJob(statusSnapshotJob, false, func() time.Duration {
+		return quietScaledInterval(statusSnapshotInterval)
+	}, func(context.Context) {
+		refreshStatusSnapshot()
+		updateTunnelState()
+	})
+}
+
+func cancelStatusSnapshots() bool {
+	return cancelJob(statusSnapshotJob)
+}
+
+// stopStatusSnapshots stops refreshing and records the final state. Only the
+// first call after a start records anything, so a termination reported by
+// olm is not overwritten when the tunnel then winds down.
+func stopStatusSnapshots(state string) {
+	if cancelStatusSnapshots() {
+		updateSnapshotState(state)
+	}
+}
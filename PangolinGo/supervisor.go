@@ -0,0 +1,152 @@
+package main
+
+import "C"
+import (
+	"encoding/json"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Subsystems whose panics are contained. A panic in one is logged, reported
+// and the failed run dropped; the subsystem runs again on its next trigger
+// while the tunnel and the others carry on. Everything else still crashes
+// through dumpOnPanic.
+const (
+	// SubsystemDNS: the private DNS forwarder, upstream bootstrap, latency
+	// probes, keep-warm and the leak check
+	SubsystemDNS = "dns"
+	// SubsystemStats: the status snapshot, ping monitor, server health and
+	// standby probes
+	SubsystemStats = "stats"
+	// SubsystemSync: applying the control plane's site syncs and the hooks
+	// that follow olm's state
+	SubsystemSync = "sync"
+)
+
+// subsystemWarningWindow is how long a restart shows in the server health
+// warnings
+const subsystemWarningWindow = 10 * time.Minute
+
+// supervisedJobs assigns scheduler jobs to their subsystem
+var supervisedJobs = map[string]string{
+	dnsLeakJob:        SubsystemDNS,
+	statusSnapshotJob: SubsystemStats,
+	pingMonitorJob:    SubsystemStats,
+	serverHealthJob:   SubsystemStats,
+	standbyJob:        SubsystemStats,
+	bandwidthJob:      SubsystemStats,
+	packetPathJob:     SubsystemSync,
+	offlinePeersJob:   SubsystemSync,
+	autoReconnectJob:  SubsystemSync,
+}
+
+// SubsystemHealth is one subsystem's entry in getSubsystemHealth
+type SubsystemHealth struct {
+	Restarts    int        `json:"restarts"`
+	LastPanic   string     `json:"lastPanic,omitempty"`
+	LastPanicIn string     `json:"lastPanicIn,omitempty"`
+	LastPanicAt *time.Time `json:"lastPanicAt,omitempty"`
+}
+
+var (
+	subsystemMutex  sync.Mutex
+	subsystemHealth = map[string]*SubsystemHealth{}
+)
+
+// noteSubsystemPanic records a contained panic, leaves the flight recorder
+// behind as a crash would, and tells Swift
+func noteSubsystemPanic(subsystem, what string, r any) {
+	appLogger.Error("Recovered from panic in %s (%s subsystem): %v\n%s", what, subsystem, r, debug.Stack())
+	recordEvent(EventPanic, "%s (%s): %v", what, subsystem, r)
+	dumpFlightRecorder(fmt.Sprintf("recovered panic in %s: %v", what, r))
+
+	now := time.Now()
+	subsystemMutex.Lock()
+	health := subsystemHealth[subsystem]
+	if health == nil {
+		health = &SubsystemHealth{}
+		subsystemHealth[subsystem] = health
+	}
+	health.Restarts++
+	health.LastPanic = fmt.Sprint(r)
+	health.LastPanicIn = what
+	health.LastPanicAt = &now
+	subsystemMutex.Unlock()
+
+	publishEvent(BridgeEvent{Type: BridgeEventSubsystemRestart, Subsystem: subsystem, Message: fmt.Sprintf("%s: %v", what, r)})
+}
+
+// recoverSubsystem is deferred at the top of a subsystem's goroutines in
+// place of dumpOnPanic
+func recoverSubsystem(subsystem, what string) {
+	if r := recover(); r != nil {
+		noteSubsystemPanic(subsystem, what, r)
+	}
+}
+
+// superviseSubsystem runs fn on the caller's goroutine, which may be olm's,
+// and reports whether it finished without panicking
+func superviseSubsystem(subsystem, what string, fn func()) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			noteSubsystemPanic(subsystem, what, r)
+			ok = false
+		}
+	}()
+	fn()
+	return true
+}
+
+// supervisedDNSHandler answers SERVFAIL for a query whose handler panicked,
+// instead of taking the process down from miekg/dns's goroutine
+func supervisedDNSHandler(what string, handler dns.HandlerFunc) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, req *dns.Msg) {
+		if !superviseSubsystem(SubsystemDNS, what, func() { handler(w, req) }) {
+			resp := new(dns.Msg)
+			resp.SetRcode(req, dns.RcodeServerFailure)
+			_ = w.WriteMsg(resp)
+		}
+	}
+}
+
+// subsystemWarnings describes recent restarts for the server health
+func subsystemWarnings() []string {
+	subsystemMutex.Lock()
+	defer subsystemMutex.Unlock()
+	var warnings []string
+	for _, subsystem := range []string{SubsystemDNS, SubsystemStats, SubsystemSync} {
+		health := subsystemHealth[subsystem]
+		if health != nil && time.Since(*health.LastPanicAt) < subsystemWarningWindow {
+			warnings = append(warnings, fmt.Sprintf("The %s subsystem restarted after an internal error in %s", subsystem, health.LastPanicIn))
+		}
+	}
+	return warnings
+}
+
+// getSubsystemHealth returns how often each supervised subsystem recovered
+// from a panic, and the last one, as JSON keyed by subsystem
+//
+//export getSubsystemHealth
+func getSubsystemHealth() *C.char {
+	subsystemMutex.Lock()
+	out := make(map[string]SubsystemHealth, 3)
+	for _, subsystem := range []string{SubsystemDNS, SubsystemStats, SubsystemSync} {
+		if health := subsystemHealth[subsystem]; health != nil {
+			out[subsystem] = *health
+		} else {
+			out[subsystem] = SubsystemHealth{}
+		}
+	}
+	subsystemMutex.Unlock()
+
+	data, err := json.Marshal(out)
+	if err != nil {
+		appLogger.Error("Failed to marshal subsystem health: %v", err)
+		return exportString("{}")
+	}
+	return exportString(string(data))
+}
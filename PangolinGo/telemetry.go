@@ -0,0 +1,226 @@
+package main
+
+import "C"
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Telemetry is off until Swift turns it on. Only counters are kept, never
+// addresses, names or timestamps of single events, and nothing leaves the
+// device from here: the app reads the report and submits it itself.
+
+const (
+	telemetryFile = "telemetry.json"
+	// telemetrySchemaVersion changes whenever a counter changes meaning
+	telemetrySchemaVersion = 1
+	// telemetrySaveInterval bounds how often frequent counters are written
+	telemetrySaveInterval = time.Minute
+)
+
+// handshakeBuckets are the upper bounds of the handshake time buckets, from
+// the start of the tunnel to its first site handshake; slower ones count in
+// the last bucket
+var handshakeBuckets = []struct {
+	name  string
+	bound time.Duration
+}{
+	{"le1s", time.Second},
+	{"le2s", 2 * time.Second},
+	{"le5s", 5 * time.Second},
+	{"le10s", 10 * time.Second},
+	{"le30s", 30 * time.Second},
+	{"gt30s", 0},
+}
+
+// TelemetryCounters are the aggregates kept while telemetry is on
+type TelemetryCounters struct {
+	ConnectAttempts  uint64 `json:"connectAttempts"`
+	ConnectSuccesses uint64 `json:"connectSuccesses"`
+	// HandshakeBuckets counts first handshakes by how long they took
+	HandshakeBuckets map[string]uint64 `json:"handshakeBuckets"`
+	// DNSQueries and DNSFailures count the bridge's own upstream queries:
+	// latency probes and bootstrap lookups
+	DNSQueries  uint64 `json:"dnsQueries"`
+	DNSFailures uint64 `json:"dnsFailures"`
+}
+
+// TelemetryReport is the JSON returned by getTelemetryReport
+type TelemetryReport struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	Enabled       bool              `json:"enabled"`
+	PeriodStart   *time.Time        `json:"periodStart,omitempty"`
+	PeriodEnd     time.Time         `json:"periodEnd"`
+	Counters      TelemetryCounters `json:"counters"`
+	// ConnectSuccessRate and DNSFailureRate are derived from the counters,
+	// zero when there is nothing to divide by
+	ConnectSuccessRate float64 `json:"connectSuccessRate"`
+	DNSFailureRate     float64 `json:"dnsFailureRate"`
+}
+
+// telemetryState is what telemetryFile holds
+type telemetryState struct {
+	Enabled     bool              `json:"enabled"`
+	PeriodStart *time.Time        `json:"periodStart,omitempty"`
+	Counters    TelemetryCounters `json:"counters"`
+}
+
+var (
+	telemetryMutex   sync.Mutex
+	telemetry        telemetryState
+	telemetryDirty   bool
+	telemetrySavedAt time.Time
+)
+
+// loadTelemetry restores the opt-in and the counters of the current period
+func loadTelemetry() {
+	data, err := readStateFile(telemetryFile)
+	if err != nil || data == nil {
+		return
+	}
+	var saved telemetryState
+	if err := json.Unmarshal(data, &saved); err != nil {
+		appLogger.Debug("Ignoring unreadable telemetry: %v", err)
+		return
+	}
+	telemetryMutex.Lock()
+	telemetry = saved
+	telemetryMutex.Unlock()
+}
+
+// saveTelemetryLocked writes the state now, or with force unset only once
+// telemetrySaveInterval has passed. Caller must hold telemetryMutex.
+func saveTelemetryLocked(force bool) {
+	if !force && (!telemetryDirty || time.Since(telemetrySavedAt) < telemetrySaveInterval) {
+		return
+	}
+	data, err := json.Marshal(telemetry)
+	if err != nil {
+		return
+	}
+	if err := writeStateFile(telemetryFile, data); err != nil {
+		appLogger.Debug("Failed to save telemetry: %v", err)
+		return
+	}
+	telemetryDirty = false
+	telemetrySavedAt = time.Now()
+}
+
+// countTelemetry applies update to the counters while telemetry is on
+func countTelemetry(force bool, update func(*TelemetryCounters)) {
+	telemetryMutex.Lock()
+	defer telemetryMutex.Unlock()
+	if !telemetry.Enabled {
+		return
+	}
+	if telemetry.PeriodStart == nil {
+		now := time.Now().UTC()
+		telemetry.PeriodStart = &now
+	}
+	update(&telemetry.Counters)
+	telemetryDirty = true
+	saveTelemetryLocked(force)
+}
+
+func noteTelemetryConnectAttempt() {
+	countTelemetry(true, func(c *TelemetryCounters) { c.ConnectAttempts++ })
+}
+
+func noteTelemetryConnected() {
+	countTelemetry(true, func(c *TelemetryCounters) { c.ConnectSuccesses++ })
+}
+
+// noteTelemetryHandshake counts a first handshake by how long after the
+// tunnel started it came
+func noteTelemetryHandshake(took time.Duration) {
+	countTelemetry(false, func(c *TelemetryCounters) {
+		if c.HandshakeBuckets == nil {
+			c.HandshakeBuckets = map[string]uint64{}
+		}
+		for _, bucket := range handshakeBuckets {
+			if bucket.bound == 0 || took <= bucket.bound {
+				c.HandshakeBuckets[bucket.name]++
+				return
+			}
+		}
+	})
+}
+
+func noteTelemetryDNSQuery(failed bool) {
+	countTelemetry(false, func(c *TelemetryCounters) {
+		c.DNSQueries++
+		if failed {
+			c.DNSFailures++
+		}
+	})
+}
+
+// telemetryReportLocked builds the report. Caller must hold telemetryMutex.
+func telemetryReportLocked() TelemetryReport {
+	counters := telemetry.Counters
+	buckets := map[string]uint64{}
+	for _, bucket := range handshakeBuckets {
+		buckets[bucket.name] = counters.HandshakeBuckets[bucket.name]
+	}
+	counters.HandshakeBuckets = buckets
+
+	report := TelemetryReport{
+		SchemaVersion: telemetrySchemaVersion,
+		Enabled:       telemetry.Enabled,
+		PeriodStart:   telemetry.PeriodStart,
+		PeriodEnd:     time.Now().UTC(),
+		Counters:      counters,
+	}
+	if counters.ConnectAttempts > 0 {
+		report.ConnectSuccessRate = float64(counters.ConnectSuccesses) / float64(counters.ConnectAttempts)
+	}
+	if counters.DNSQueries > 0 {
+		report.DNSFailureRate = float64(counters.DNSFailures) / float64(counters.DNSQueries)
+	}
+	return report
+}
+
+// setTelemetryEnabled opts in to or out of the anonymous counters. Opting out
+// deletes what was collected.
+//
+//export setTelemetryEnabled
+func setTelemetryEnabled(enabled C.int) *C.char {
+	telemetryMutex.Lock()
+	defer telemetryMutex.Unlock()
+	on := enabled != 0
+	if telemetry.Enabled == on {
+		return exportString("Telemetry unchanged")
+	}
+	telemetry = telemetryState{Enabled: on}
+	saveTelemetryLocked(true)
+	if on {
+		appLogger.Info("Telemetry enabled")
+		return exportString("Telemetry enabled")
+	}
+	appLogger.Info("Telemetry disabled and its counters deleted")
+	return exportString("Telemetry disabled")
+}
+
+// getTelemetryReport returns the counters collected since the period began
+// as JSON, for the app to submit. With reset set a new period begins, so
+// the app resets once the report is submitted and no count is sent twice.
+//
+//export getTelemetryReport
+func getTelemetryReport(reset C.int) *C.char {
+	telemetryMutex.Lock()
+	report := telemetryReportLocked()
+	if reset != 0 && telemetry.Enabled {
+		telemetry = telemetryState{Enabled: true}
+		saveTelemetryLocked(true)
+	}
+	telemetryMutex.Unlock()
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		appLogger.Error("Failed to marshal telemetry report: %v", err)
+		return exportString(fmt.Sprintf("Error: Failed to marshal telemetry report: %v", err))
+	}
+	return exportString(string(data))
+}
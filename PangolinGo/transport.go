@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// controlTransport wraps the transport of the bridge's own control plane
+// requests (health probes, the registration check) so the Go layer can
+// observe the responses. olm's requests keep http.DefaultTransport, which
+// the bridge leaves alone.
+type controlTransport struct {
+	base http.RoundTripper
+}
+
+var (
+	// controlBaseTransport is the bridge's own connection pool to the
+	// control plane. Its dials race the resolved addresses.
+	controlBaseTransport = newControlBaseTransport()
+	// controlHTTPClient sends the bridge's control plane requests
+	controlHTTPClient = &http.Client{Transport: &controlTransport{base: controlBaseTransport}}
+)
+
+func newControlBaseTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = raceDialContext
+	return t
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *controlTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if userAgent, info := clientHeaders(); userAgent != "" && req.Header.Get("User-Agent") == "" {
+		// A RoundTripper must not change the caller's request
+		req = req.Clone(req.Context())
+		req.Header.Set("User-Agent", userAgent)
+		req.Header.Set(clientInfoHeader, info)
+	}
+
+	req = withSessionCookie(req)
+
+	sent := time.Now()
+	resp, err := breakerRoundTrip(t.base, req)
+	if err != nil {
+		return nil, err
+	}
+
+	observeServerDate(resp.Header.Get("Date"), sent, time.Now())
+	return resp, nil
+}
@@ -0,0 +1,257 @@
+package main
+
+import "C"
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tunnel states reported by getTunnelStatus
+const (
+	TunnelStateDisconnected = "disconnected"
+	// TunnelStateConnecting: started, the control plane not reached yet
+	TunnelStateConnecting = "connecting"
+	// TunnelStateHandshaking: registered with the control plane, no site
+	// has completed a WireGuard handshake yet
+	TunnelStateHandshaking = "handshaking"
+	TunnelStateConnected   = "connected"
+	// TunnelStateReconnecting: was connected and lost the control plane, or
+	// olm's tunnel is being restarted
+	TunnelStateReconnecting = "reconnecting"
+	// TunnelStateError: the tunnel stopped on an error; LastError says which
+	TunnelStateError = "error"
+)
+
+// Error codes reported in TunnelStatus.LastError besides those of the
+// features that detect them (CLOCK_SKEW, SESSION_SUPERSEDED,
+// VERSION_MISMATCH)
+const (
+	ErrorCodeStartFailed   = "START_FAILED"
+	ErrorCodeAuthFailed    = "AUTH_FAILED"
+	ErrorCodeTerminated    = "TERMINATED"
+	ErrorCodeTunnelStopped = "TUNNEL_STOPPED"
+)
+
+// TunnelError is the last error the tunnel stopped on
+type TunnelError struct {
+	Code    string    `json:"code"`
+	Message string    `json:"message"`
+	At      time.Time `json:"at"`
+}
+
+// TunnelStatus is the JSON returned by getTunnelStatus
+type TunnelStatus struct {
+	State string `json:"state"`
+	// Since is when the tunnel entered State
+	Since       time.Time  `json:"since"`
+	StartedAt   *time.Time `json:"startedAt,omitempty"`
+	ConnectedAt *time.Time `json:"connectedAt,omitempty"`
+	// Sites and ConnectedSites count the sites olm knows and those with a
+	// working handshake
+	Sites          int          `json:"sites"`
+	ConnectedSites int          `json:"connectedSites"`
+	LastError      *TunnelError `json:"lastError,omitempty"`
+	// ReconnectAttempts counts the reconnect supervisor's attempts since
+	// the tunnel was last connected, and NextReconnectAt is the earliest
+	// the next may be made
+	ReconnectAttempts int        `json:"reconnectAttempts,omitempty"`
+	NextReconnectAt   *time.Time `json:"nextReconnectAt,omitempty"`
+}
+
+var (
+	tunnelStatusMutex sync.Mutex
+	tunnelStatus      = TunnelStatus{State: TunnelStateDisconnected, Since: time.Now()}
+	// tunnelPeersUp is whether each site was connected when olm was last
+	// asked, to report sites going up and down
+	tunnelPeersUp map[int]bool
+)
+
+// setTunnelStateLocked moves to state, keeping Since when it does not
+// change. Caller must hold tunnelStatusMutex.
+func setTunnelStateLocked(state string) {
+	if tunnelStatus.State == state {
+		return
+	}
+	appLogger.Debug("Tunnel state %s -> %s", tunnelStatus.State, state)
+	tunnelStatus.State = state
+	tunnelStatus.Since = time.Now()
+	if state == TunnelStateConnected && tunnelStatus.ConnectedAt == nil {
+		connectedAt := tunnelStatus.Since
+		tunnelStatus.ConnectedAt = &connectedAt
+		noteTelemetryConnected()
+	}
+	event := BridgeEvent{Type: BridgeEventState, State: state}
+	if state == TunnelStateError {
+		event.Message = tunnelStatus.LastError.Message
+	}
+	publishEvent(event)
+}
+
+// notePeersLocked publishes the sites that went up or down since olm was
+// last asked, and the first handshake since the start. Caller must hold
+// tunnelStatusMutex.
+func notePeersLocked(peers map[int]bool) {
+	if tunnelPeersUp == nil {
+		tunnelPeersUp = map[int]bool{}
+	}
+	for siteID, up := range peers {
+		if tunnelPeersUp[siteID] == up {
+			continue
+		}
+		// olm moves shared routes to the best connected site when a site
+		// goes up or down
+		requestOlmSync()
+		if up {
+			if tunnelStatus.ConnectedAt == nil && tunnelStatus.ConnectedSites == 0 {
+				publishEvent(BridgeEvent{Type: BridgeEventHandshake, SiteID: siteID})
+				if tunnelStatus.StartedAt != nil {
+					noteTelemetryHandshake(time.Since(*tunnelStatus.StartedAt))
+				}
+			}
+			publishEvent(BridgeEvent{Type: BridgeEventPeerUp, SiteID: siteID})
+		} else {
+			publishEvent(BridgeEvent{Type: BridgeEventPeerDown, SiteID: siteID})
+		}
+	}
+	for siteID, up := range tunnelPeersUp {
+		if _, ok := peers[siteID]; !ok && up {
+			publishEvent(BridgeEvent{Type: BridgeEventPeerDown, SiteID: siteID})
+		}
+	}
+	tunnelPeersUp = peers
+}
+
+// noteTunnelStarting records a start. The last error is kept until the
+// tunnel connects, so a failing retry loop still shows why.
+func noteTunnelStarting() {
+	tunnelStatusMutex.Lock()
+	defer tunnelStatusMutex.Unlock()
+	now := time.Now()
+	tunnelStatus.StartedAt = &now
+	tunnelStatus.ConnectedAt = nil
+	tunnelStatus.Sites, tunnelStatus.ConnectedSites = 0, 0
+	tunnelPeersUp = nil
+	setTunnelStateLocked(TunnelStateConnecting)
+	noteTelemetryConnectAttempt()
+}
+
+// noteTunnelRestarting records that olm's tunnel is being restarted under a
+// running tunnel
+func noteTunnelRestarting() {
+	tunnelStatusMutex.Lock()
+	defer tunnelStatusMutex.Unlock()
+	if tunnelStatus.State != TunnelStateDisconnected && tunnelStatus.State != TunnelStateError {
+		setTunnelStateLocked(TunnelStateReconnecting)
+	}
+}
+
+// noteTunnelStopped records a stop that was asked for
+func noteTunnelStopped() {
+	tunnelStatusMutex.Lock()
+	defer tunnelStatusMutex.Unlock()
+	tunnelStatus.StartedAt = nil
+	tunnelStatus.ConnectedAt = nil
+	tunnelStatus.Sites, tunnelStatus.ConnectedSites = 0, 0
+	tunnelPeersUp = nil
+	setTunnelStateLocked(TunnelStateDisconnected)
+}
+
+// genericTunnelError reports codes that only say the tunnel went away, which
+// a more specific error reported around the same time replaces
+func genericTunnelError(code string) bool {
+	return code == ErrorCodeTerminated || code == ErrorCodeTunnelStopped
+}
+
+// noteTunnelError records the error the tunnel stopped on. A specific error
+// is kept until the next start, so the generic stop that follows it does
+// not hide it.
+func noteTunnelError(code, message string) {
+	tunnelStatusMutex.Lock()
+	defer tunnelStatusMutex.Unlock()
+	if tunnelStatus.State == TunnelStateError && (genericTunnelError(code) || !genericTunnelError(tunnelStatus.LastError.Code)) {
+		return
+	}
+	tunnelStatus.LastError = &TunnelError{Code: code, Message: strings.TrimPrefix(message, "Error: "), At: time.Now()}
+	setTunnelStateLocked(TunnelStateError)
+}
+
+// updateTunnelState derives the state of a running tunnel from olm's status
+func updateTunnelState() {
+	tunnelStatusMutex.Lock()
+	state := tunnelStatus.State
+	tunnelStatusMutex.Unlock()
+	if state == TunnelStateDisconnected || state == TunnelStateError {
+		return
+	}
+
+	status, err := fetchOlmStatus()
+	if err != nil {
+		return
+	}
+	sites, connected := 0, 0
+	peers := make(map[int]bool, len(status.PeerStatuses))
+	for _, peer := range status.PeerStatuses {
+		if peer == nil {
+			continue
+		}
+		sites++
+		if peer.Connected {
+			connected++
+		}
+		peers[peer.SiteID] = peer.Connected
+	}
+
+	tunnelStatusMutex.Lock()
+	defer tunnelStatusMutex.Unlock()
+	if tunnelStatus.State != state {
+		// Stopped or failed while olm was being asked
+		return
+	}
+	notePeersLocked(peers)
+	tunnelStatus.Sites, tunnelStatus.ConnectedSites = sites, connected
+	switch {
+	case !status.Connected && tunnelStatus.ConnectedAt != nil:
+		setTunnelStateLocked(TunnelStateReconnecting)
+	case !status.Connected:
+		setTunnelStateLocked(TunnelStateConnecting)
+	case !status.Registered || (sites > 0 && connected == 0):
+		setTunnelStateLocked(TunnelStateHandshaking)
+	default:
+		setTunnelStateLocked(TunnelStateConnected)
+		tunnelStatus.LastError = nil
+	}
+}
+
+// terminationError returns the code and reason olm reported for a
+// termination
+func terminationError() (code, message string) {
+	if status, err := fetchOlmStatus(); err == nil && status.OlmError != nil && status.OlmError.Message != "" {
+		return status.OlmError.Code, status.OlmError.Message
+	}
+	return "", "Terminated by the server"
+}
+
+// getTunnelStatus returns the tunnel's state, when it entered it and the
+// last error, as JSON. Swift can poll it to show progress while a start is
+// under way and why it failed.
+//
+//export getTunnelStatus
+func getTunnelStatus() *C.char {
+	updateTunnelState()
+
+	tunnelStatusMutex.Lock()
+	status := tunnelStatus
+	tunnelStatusMutex.Unlock()
+	if attempts, next := reconnectStatus(); attempts > 0 {
+		status.ReconnectAttempts, status.NextReconnectAt = attempts, &next
+	}
+
+	data, err := json.Marshal(status)
+	if err != nil {
+		appLogger.Error("Failed to marshal tunnel status: %v", err)
+		return exportString(`{"state":"disconnected"}`)
+	}
+	return exportString(string(data))
+}
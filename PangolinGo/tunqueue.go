@@ -0,0 +1,197 @@
+package main
+
+import "C"
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+	wgdevice "golang.zx2c4.com/wireguard/device"
+)
+
+// QueueDepth is one queue on the packet path
+type QueueDepth struct {
+	Current  int `json:"current"`
+	Peak     int `json:"peak"`
+	Capacity int `json:"capacity"`
+}
+
+// TunQueueStats is the JSON returned by getTunQueueStats. Where the queues
+// back up tells where throughput is lost: the device queues fill when the
+// TUN side is slow and the crypto queues when encryption cannot keep up.
+// WireGuard's per-peer queues are left out: they sit behind the device's
+// peer lock, which is not the bridge's to take.
+type TunQueueStats struct {
+	// Wrapped is false until a feature has the tunnel device wrapped; the
+	// device counters stay zero until then
+	Wrapped bool `json:"wrapped"`
+	Device  struct {
+		ReadPackets uint64 `json:"readPackets"`
+		ReadBatches uint64 `json:"readBatches"`
+		// FullBatches counts reads that filled the batch, i.e. utun had
+		// more queued than one read takes
+		FullBatches  uint64 `json:"fullBatches"`
+		WritePackets uint64 `json:"writePackets"`
+		WriteErrors  uint64 `json:"writeErrors"`
+		// WriteDrops counts packets utun did not take
+		WriteDrops uint64 `json:"writeDrops"`
+		// BridgeDrops counts packets the bridge dropped itself, while
+		// draining or for exceeding a route's MTU
+		BridgeDrops uint64 `json:"bridgeDrops"`
+		// ShaperWaits and ShaperWaitMs are the backpressure the bandwidth
+		// limits applied
+		ShaperWaits  uint64  `json:"shaperWaits"`
+		ShaperWaitMs float64 `json:"shaperWaitMs"`
+	} `json:"device"`
+	Queues    map[string]QueueDepth `json:"queues"`
+	SampledAt time.Time             `json:"sampledAt,omitempty"`
+}
+
+// Queues on the packet path, in the order a packet meets them
+const (
+	// QueueDeviceRead holds batches read from utun until WireGuard takes them
+	QueueDeviceRead = "deviceRead"
+	// QueueDeviceInject holds packets the bridge and olm make up
+	QueueDeviceInject = "deviceInject"
+	// QueueEncryption and QueueDecryption feed the crypto workers
+	QueueEncryption = "encryption"
+	QueueDecryption = "decryption"
+)
+
+var (
+	tunReadPackets  atomic.Uint64
+	tunReadBatches  atomic.Uint64
+	tunFullBatches  atomic.Uint64
+	tunWritePackets atomic.Uint64
+	tunWriteErrors  atomic.Uint64
+	tunWriteDrops   atomic.Uint64
+	tunBridgeDrops  atomic.Uint64
+	tunShaperWaits  atomic.Uint64
+	tunShaperWaitNs atomic.Int64
+
+	queueDepthMutex sync.Mutex
+	queueDepths     = map[string]QueueDepth{}
+	queueSampledAt  time.Time
+)
+
+// shapeWait waits for a limiter and counts the time it held the packet back
+func shapeWait(limiter *rate.Limiter, size int) {
+	if limiter.Limit() == rate.Inf {
+		return
+	}
+	start := time.Now()
+	_ = limiter.WaitN(context.Background(), min(size, limiter.Burst()))
+	if waited := time.Since(start); waited > time.Millisecond {
+		tunShaperWaits.Add(1)
+		tunShaperWaitNs.Add(int64(waited))
+	}
+}
+
+// chanDepth returns the length and capacity of a channel field of an olm or
+// WireGuard struct, or false when an upgrade renamed it
+func chanDepth(v reflect.Value, path ...string) (length, capacity int, ok bool) {
+	for _, name := range path {
+		if v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				return 0, 0, false
+			}
+			v = v.Elem()
+		}
+		if v.Kind() != reflect.Struct {
+			return 0, 0, false
+		}
+		if v = v.FieldByName(name); !v.IsValid() {
+			return 0, 0, false
+		}
+	}
+	if v.Kind() != reflect.Chan || v.IsNil() {
+		return 0, 0, false
+	}
+	return v.Len(), v.Cap(), true
+}
+
+// sampleQueueDepths reads the length of every queue on the packet path
+func sampleQueueDepths() map[string]QueueDepth {
+	depths := map[string]QueueDepth{}
+	add := func(name string, length, capacity int) {
+		depths[name] = QueueDepth{Current: length, Capacity: capacity}
+	}
+
+	if middle := olmMiddleDevice(); middle != nil {
+		v := reflect.ValueOf(middle)
+		if l, c, ok := chanDepth(v, "readCh"); ok {
+			add(QueueDeviceRead, l, c)
+		}
+		if l, c, ok := chanDepth(v, "injectCh"); ok {
+			add(QueueDeviceInject, l, c)
+		}
+	}
+
+	dev := (*wgdevice.Device)(olmPointerField("dev", reflect.TypeOf((*wgdevice.Device)(nil))))
+	if dev == nil {
+		return depths
+	}
+	v := reflect.ValueOf(dev)
+	if l, c, ok := chanDepth(v, "queue", "encryption", "c"); ok {
+		add(QueueEncryption, l, c)
+	}
+	if l, c, ok := chanDepth(v, "queue", "decryption", "c"); ok {
+		add(QueueDecryption, l, c)
+	}
+
+	return depths
+}
+
+// syncTunQueues samples the queue depths and keeps the peaks. It runs with
+// the packet path sampler.
+func syncTunQueues() {
+	depths := sampleQueueDepths()
+
+	queueDepthMutex.Lock()
+	defer queueDepthMutex.Unlock()
+	for name, d := range depths {
+		d.Peak = max(d.Current, queueDepths[name].Peak)
+		queueDepths[name] = d
+	}
+	queueSampledAt = time.Now()
+}
+
+// getTunQueueStats returns the queue depths, drops and backpressure on the
+// tunnel's packet path as JSON
+//
+//export getTunQueueStats
+func getTunQueueStats() *C.char {
+	var stats TunQueueStats
+	shaperMutex.Lock()
+	stats.Wrapped = shapedMiddleDev != nil
+	shaperMutex.Unlock()
+
+	stats.Device.ReadPackets = tunReadPackets.Load()
+	stats.Device.ReadBatches = tunReadBatches.Load()
+	stats.Device.FullBatches = tunFullBatches.Load()
+	stats.Device.WritePackets = tunWritePackets.Load()
+	stats.Device.WriteErrors = tunWriteErrors.Load()
+	stats.Device.WriteDrops = tunWriteDrops.Load()
+	stats.Device.BridgeDrops = tunBridgeDrops.Load()
+	stats.Device.ShaperWaits = tunShaperWaits.Load()
+	stats.Device.ShaperWaitMs = milliseconds(time.Duration(tunShaperWaitNs.Load()))
+
+	queueDepthMutex.Lock()
+	stats.Queues = make(map[string]QueueDepth, len(queueDepths))
+	for name, d := range queueDepths {
+		stats.Queues[name] = d
+	}
+	stats.SampledAt = queueSampledAt
+	queueDepthMutex.Unlock()
+
+	data, err := json.Marshal(stats)
+	if err != nil {
+		appLogger.Error("Failed to marshal queue stats: %v", err)
+		return exportString(`{"queues":{}}`)
+	}
+	return exportString(string(data))
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/fosrl/newt/network"
+)
+
+// physicalUpstreamScheme marks an upstream that is always queried over the
+// physical network, e.g. "physical://192.168.1.1" for a home router whose
+// subnet a site also routes. Plain upstreams are queried through the tunnel
+// when the sites' routes cover their address, the way a private resolver
+// behind a site is only reachable, and over the physical network otherwise.
+// Default routes do not count: a full tunnel would otherwise take every
+// upstream. While olm queries through the tunnel itself, with tunnelDNS,
+// every upstream goes through it.
+const physicalUpstreamScheme = "physical://"
+
+// How an upstream is reached
+const (
+	UpstreamPathTunnel   = "tunnel"
+	UpstreamPathPhysical = "physical"
+)
+
+// UpstreamPath is how one upstream in getDNSConfig is queried
+type UpstreamPath struct {
+	Server string `json:"server"`
+	Path   string `json:"path"`
+	// Detected is set when the path follows from the routes rather than
+	// the upstream's scheme
+	Detected bool `json:"detected,omitempty"`
+}
+
+var (
+	upstreamPathMutex sync.Mutex
+	// tunnelRoutedUpstreams are the plain upstreams last found inside the
+	// sites' routes
+	tunnelRoutedUpstreams []string
+)
+
+// isPhysicalUpstream reports whether an upstream is pinned to the physical
+// network
+func isPhysicalUpstream(server string) bool {
+	return strings.HasPrefix(strings.TrimSpace(server), physicalUpstreamScheme)
+}
+
+// normalizePhysicalUpstream puts a physical upstream in canonical form
+func normalizePhysicalUpstream(server string) (string, error) {
+	rest := strings.TrimPrefix(strings.TrimSpace(server), physicalUpstreamScheme)
+	if isSiteResolver(rest) || isPhysicalUpstream(rest) {
+		return "", fmt.Errorf("invalid DNS server %q", server)
+	}
+	normalized, err := normalizeDNSServer(rest)
+	if err != nil {
+		return "", err
+	}
+	return physicalUpstreamScheme + normalized, nil
+}
+
+// routeContains reports whether a route that is not a default route covers
+// addr
+func routeContains(cidr string, addr netip.Addr) bool {
+	if isDefaultRoute(cidr) {
+		return false
+	}
+	prefix, err := netip.ParsePrefix(cidr)
+	return err == nil && prefix.Contains(addr)
+}
+
+// tunnelRoutedUpstream reports whether a plain upstream given by address
+// lies inside the routes the server sent, and not in an excluded one
+func tunnelRoutedUpstream(server string) bool {
+	addrPort, err := netip.ParseAddrPort(server)
+	if err != nil {
+		return false
+	}
+	addr := addrPort.Addr().Unmap()
+	settings := network.GetSettings()
+	if addr.Is4() {
+		if slices.ContainsFunc(settings.IPv4ExcludedRoutes, func(r network.IPv4Route) bool { return routeContains(ipv4RouteCIDR(r), addr) }) {
+			return false
+		}
+		return slices.ContainsFunc(settings.IPv4IncludedRoutes, func(r network.IPv4Route) bool { return routeContains(ipv4RouteCIDR(r), addr) })
+	}
+	if slices.ContainsFunc(settings.IPv6ExcludedRoutes, func(r network.IPv6Route) bool { return routeContains(ipv6RouteCIDR(r), addr) }) {
+		return false
+	}
+	return slices.ContainsFunc(settings.IPv6IncludedRoutes, func(r network.IPv6Route) bool { return routeContains(ipv6RouteCIDR(r), addr) })
+}
+
+// upstreamsInEffect are the upstreams olm and the split DNS forwarder use:
+// the pinned or configured ones and those of the DNS routes
+func upstreamsInEffect() []string {
+	servers, _ := pinnedUpstreamDNS()
+	if len(servers) == 0 {
+		tunnelMutex.Lock()
+		servers = activeTunnelConfig.UpstreamDNS
+		tunnelMutex.Unlock()
+	}
+	servers = slices.Clone(servers)
+	splitDNSMutex.Lock()
+	for _, domain := range slices.Sorted(maps.Keys(splitDNSRoutes)) {
+		servers = append(servers, splitDNSRoutes[domain]...)
+	}
+	splitDNSMutex.Unlock()
+	return servers
+}
+
+// syncUpstreamPaths moves plain upstreams into or out of the tunnel as the
+// routes come and go. It runs on every olm sync.
+func syncUpstreamPaths() {
+	var routed []string
+	for _, server := range upstreamsInEffect() {
+		if tunnelRoutedUpstream(server) && !slices.Contains(routed, server) {
+			routed = append(routed, server)
+		}
+	}
+
+	upstreamPathMutex.Lock()
+	changed := !slices.Equal(routed, tunnelRoutedUpstreams)
+	tunnelRoutedUpstreams = routed
+	upstreamPathMutex.Unlock()
+	if !changed {
+		return
+	}
+	if len(routed) > 0 {
+		appLogger.Info("Querying upstream DNS %v through the tunnel, which routes it", routed)
+	} else {
+		appLogger.Info("No upstream DNS is routed through the tunnel")
+	}
+	applyUpstreamDNS()
+}
+
+// resetUpstreamPaths forgets the routed upstreams when the tunnel stops
+func resetUpstreamPaths() {
+	upstreamPathMutex.Lock()
+	tunnelRoutedUpstreams = nil
+	upstreamPathMutex.Unlock()
+}
+
+// upstreamPaths describes how each upstream is queried for getDNSConfig
+func upstreamPaths(servers []string) []UpstreamPath {
+	direct := siteResolverDirect.Load()
+	paths := make([]UpstreamPath, 0, len(servers))
+	for _, server := range servers {
+		path := UpstreamPath{Server: server, Path: UpstreamPathPhysical}
+		switch {
+		case isSiteResolver(server) || direct:
+			path.Path = UpstreamPathTunnel
+		case isPhysicalUpstream(server):
+			// Pinned by its scheme
+		case tunnelRoutedUpstream(server):
+			path.Path, path.Detected = UpstreamPathTunnel, true
+		default:
+			path.Detected = true
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}